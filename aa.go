@@ -0,0 +1,54 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errInvalidAATest = errors.New("invalid A/A test")
+
+// modeAA makes the rules of an experiment an A/A test: sessions are assigned, kept on their
+// variant, exposed and measured as in any experiment, but every variant is served by the same
+// backend, so the measurement pipeline and sample ratio checks can be validated before real
+// experiments.
+const modeAA = "aa"
+
+// validateAATests checks the modes of the rules. Every variant of an A/A test must be in A/A mode
+// and route to the same backend.
+func validateAATests(rules []RoutingRule) error {
+	backends := make(map[string]string)
+	for _, rule := range rules {
+		switch rule.Mode {
+		case "":
+			continue
+		case modeAA:
+		default:
+			return fmt.Errorf("%w: %s: unknown mode %q", errInvalidAATest, rulePathKey(&rule), rule.Mode)
+		}
+		if rule.Experiment == "" || rule.Variant == "" {
+			return fmt.Errorf("%w: %s: A/A tests require an experiment and a variant", errInvalidAATest, rulePathKey(&rule))
+		}
+		if rule.Backend == "" || rule.Static != nil || rule.Redirect != nil || rule.Flag != nil {
+			return fmt.Errorf("%w: %s: A/A tests must route to a backend", errInvalidAATest, rule.Experiment)
+		}
+		if backend, ok := backends[rule.Experiment]; ok && backend != rule.Backend {
+			return fmt.Errorf("%w: %s: every variant must route to the same backend", errInvalidAATest, rule.Experiment)
+		}
+		backends[rule.Experiment] = rule.Backend
+	}
+	for _, rule := range rules {
+		if _, ok := backends[rule.Experiment]; ok && rule.Mode != modeAA {
+			return fmt.Errorf("%w: %s: variant %s is not in A/A mode", errInvalidAATest, rule.Experiment, rule.Variant)
+		}
+	}
+	return nil
+}
+
+// backendURL returns the address of the backend a selection is served by. It is the selected
+// backend, except for A/A tests, whose selections name the variant.
+func backendURL(selected SelectedBackend) string {
+	if selected.Rule != nil && selected.Rule.Mode == modeAA && selected.Backend == backendKey(*selected.Rule) {
+		return selected.Rule.Backend
+	}
+	return selected.Backend
+}
@@ -0,0 +1,382 @@
+package forklift
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/store"
+)
+
+var (
+	errInvalidAdminAPI   = errors.New("invalid admin API")
+	errInvalidImport     = errors.New("invalid assignment import")
+	errExportUnsupported = errors.New("the session store can't list its assignments")
+)
+
+const (
+	adminAssignmentsPath = "/assignments"
+	// assignmentKeyPrefix starts the session store keys of all assignments, see assignmentKey.
+	assignmentKeyPrefix = "forklift:"
+	// importBatchSize is the number of imported assignments written to the store at once.
+	importBatchSize = 500
+
+	csvContentType = "text/csv"
+)
+
+// adminAPI serves administrative endpoints under its path, such as the export and import of the
+// assignments of the session store when migrating to another store.
+type adminAPI struct {
+	path     string
+	token    string
+	tokens   []adminToken
+	users    map[string]adminUser
+	oidc     *oidcVerifier
+	auditLog string
+	ui       bool
+	// mu serializes appends to the audit log.
+	mu sync.Mutex
+}
+
+// adminAuditEntry records a change made through the admin API.
+type adminAuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Remote string    `json:"remote"`
+	// User is the name of the token, user or OIDC subject that made the change.
+	User string `json:"user,omitempty"`
+	// Session is the session ID of an override, hashed if the privacy configuration hashes
+	// identities.
+	Session     string `json:"session,omitempty"`
+	Experiment  string `json:"experiment,omitempty"`
+	Variant     string `json:"variant,omitempty"`
+	Expires     string `json:"expires,omitempty"`
+	Assignments int    `json:"assignments,omitempty"`
+	Version     int    `json:"version,omitempty"`
+}
+
+// exportedAssignment is an assignment as exported and imported: the session store key and the
+// backend, or the variant for assignment groups.
+type exportedAssignment struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// newAdminAPI returns nil when the admin API is not configured.
+func newAdminAPI(cfg *config.Config) (*adminAPI, error) {
+	if cfg.AdminAPI == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(cfg.AdminAPI.Path, "/") {
+		return nil, fmt.Errorf("%w: path must start with /", errInvalidAdminAPI)
+	}
+	if cfg.AdminAPI.Token == "" && len(cfg.AdminAPI.Tokens) == 0 && len(cfg.AdminAPI.Users) == 0 && cfg.AdminAPI.OIDC == nil {
+		return nil, fmt.Errorf("%w: a token, tokens, users or oidc are required", errInvalidAdminAPI)
+	}
+	tokens, users, err := adminCredentials(cfg.AdminAPI)
+	if err != nil {
+		return nil, err
+	}
+	oidc, err := newOIDCVerifier(cfg.AdminAPI.OIDC)
+	if err != nil {
+		return nil, err
+	}
+	return &adminAPI{
+		path:     strings.TrimSuffix(cfg.AdminAPI.Path, "/"),
+		token:    cfg.AdminAPI.Token,
+		tokens:   tokens,
+		users:    users,
+		oidc:     oidc,
+		auditLog: cfg.AdminAPI.AuditLog,
+		ui:       cfg.AdminAPI.UI,
+	}, nil
+}
+
+// handles reports whether the request is for an endpoint of the admin API.
+func (api *adminAPI) handles(req *http.Request) bool {
+	return api != nil && strings.HasPrefix(req.URL.Path, api.path+"/")
+}
+
+// audit logs a change made through the admin API, and appends it to the audit log if configured.
+// Failures to write the audit log are logged.
+func (a *Forklift) audit(req *http.Request, entry adminAuditEntry) {
+	entry.Time = a.now().UTC()
+	entry.Remote = req.RemoteAddr
+	entry.User = adminPrincipalOf(req).name
+	line, err := json.Marshal(entry)
+	if err != nil {
+		a.logger.Errorf("Error encoding admin API audit entry: %v", err)
+		return
+	}
+	a.logger.Infof("Admin API audit: %s", line)
+	if a.admin.auditLog == "" {
+		return
+	}
+
+	a.admin.mu.Lock()
+	defer a.admin.mu.Unlock()
+	file, err := os.OpenFile(a.admin.auditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		a.logger.Errorf("Error opening admin API audit log: %v", err)
+		return
+	}
+	defer func() { _ = file.Close() }()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		a.logger.Errorf("Error writing admin API audit log: %v", err)
+	}
+}
+
+// serveAdmin serves the endpoints of the admin API.
+func (a *Forklift) serveAdmin(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	endpoint := strings.TrimPrefix(req.URL.Path, a.admin.path)
+	principal, ok := a.admin.authenticate(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		if a.admin.ui || len(a.admin.users) > 0 {
+			rw.Header().Add("WWW-Authenticate", `Basic realm="forklift", charset="UTF-8"`)
+		}
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if principal.role < requiredAdminRole(req.Method, endpoint) {
+		http.Error(rw, "Forbidden", http.StatusForbidden)
+		return
+	}
+	req = req.WithContext(context.WithValue(req.Context(), adminPrincipalKey{}, principal))
+
+	switch {
+	case endpoint == adminAssignmentsPath:
+		a.serveAssignments(rw, req)
+	case strings.HasPrefix(endpoint, adminAssignmentsPath+"/"):
+		a.serveOverride(rw, req, strings.TrimPrefix(endpoint, adminAssignmentsPath+"/"))
+	case a.history != nil && strings.HasPrefix(endpoint, adminRulesPath+"/"):
+		a.serveRuleHistory(rw, req, strings.TrimPrefix(endpoint, adminRulesPath))
+	case endpoint == adminAnalysisPath:
+		a.serveAnalysis(rw, req)
+	case endpoint == adminDecisionsPath:
+		a.serveDecisions(rw, req)
+	case endpoint == adminKillSwitchPath:
+		a.serveKillSwitch(rw, req)
+	case a.admin.ui && endpoint == adminUIPath:
+		a.serveAdminUI(rw, req)
+	case a.admin.ui && endpoint == adminOverviewPath:
+		a.serveOverview(rw, req)
+	case a.admin.ui && strings.HasPrefix(endpoint, adminExperimentsPath):
+		a.serveExperimentAction(rw, req, strings.TrimPrefix(endpoint, adminExperimentsPath))
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// serveAssignments exports the assignments of the session store on GET and imports them on POST.
+func (a *Forklift) serveAssignments(rw http.ResponseWriter, req *http.Request) {
+	if a.sessionStore == nil {
+		http.Error(rw, "No session store is configured", http.StatusNotImplemented)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		a.exportAssignments(rw, req)
+	case http.MethodPost:
+		a.importAssignments(rw, req)
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// exportAssignments streams the assignments of the session store as JSON, or as CSV with
+// ?format=csv or an Accept header preferring it. An export that fails midway is cut short, which
+// leaves the JSON invalid, and logged.
+func (a *Forklift) exportAssignments(rw http.ResponseWriter, req *http.Request) {
+	scanner, ok := a.sessionStore.(store.Scanner)
+	if !ok {
+		http.Error(rw, errExportUnsupported.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	exported := 0
+	var err error
+	if req.URL.Query().Get("format") == "csv" || strings.HasPrefix(req.Header.Get("Accept"), csvContentType) {
+		rw.Header().Set("Content-Type", csvContentType)
+		w := csv.NewWriter(rw)
+		err = w.Write([]string{"key", "value"})
+		if err == nil {
+			err = scanner.Scan(req.Context(), assignmentKeyPrefix, func(entry store.Entry) error {
+				exported++
+				return w.Write([]string{entry.Key, entry.Value})
+			})
+		}
+		w.Flush()
+	} else {
+		rw.Header().Set("Content-Type", "application/json")
+		_, err = io.WriteString(rw, `{"assignments":[`)
+		if err == nil {
+			err = scanner.Scan(req.Context(), assignmentKeyPrefix, func(entry store.Entry) error {
+				line, err := json.Marshal(exportedAssignment{Key: entry.Key, Value: entry.Value})
+				if err != nil {
+					return err
+				}
+				if exported > 0 {
+					line = append([]byte{','}, line...)
+				}
+				exported++
+				_, err = rw.Write(line)
+				return err
+			})
+		}
+		if err == nil {
+			_, err = io.WriteString(rw, "]}\n")
+		}
+	}
+	if err != nil {
+		a.logger.Errorf("Error exporting session assignments after %d: %v", exported, err)
+		return
+	}
+	a.logger.Infof("Admin API exported %d session assignments", exported)
+}
+
+// importAssignments writes the assignments of a JSON body, or of a CSV body when its content
+// type is text/csv, to the session store in batches, replacing existing assignments. An invalid
+// entry stops the import, leaving the previous entries imported.
+func (a *Forklift) importAssignments(rw http.ResponseWriter, req *http.Request) {
+	batch := make([]store.Entry, 0, importBatchSize)
+	imported := 0
+	flush := func() error {
+		if err := a.storeAssignments(req.Context(), batch, a.storeOptions.TTL); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	add := func(entry exportedAssignment) error {
+		if !strings.HasPrefix(entry.Key, assignmentKeyPrefix) || entry.Value == "" {
+			return fmt.Errorf("%w: entry %d: key must start with %s and value is required",
+				errInvalidImport, imported+len(batch)+1, assignmentKeyPrefix)
+		}
+		batch = append(batch, store.Entry{Key: entry.Key, Value: entry.Value})
+		if len(batch) == importBatchSize {
+			return flush()
+		}
+		return nil
+	}
+
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == csvContentType {
+		err = readCSVAssignments(req.Body, add)
+	} else {
+		err = readJSONAssignments(req.Body, add)
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		a.logger.Errorf("Error importing session assignments after %d: %v", imported, err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errInvalidImport) {
+			status = http.StatusBadRequest
+		}
+		http.Error(rw, fmt.Sprintf("%v (%d assignments imported)", err, imported), status)
+		return
+	}
+	a.audit(req, adminAuditEntry{Action: "import", Assignments: imported})
+	writeJSON(rw, http.StatusOK, map[string]int{"imported": imported})
+}
+
+// storeAssignments writes assignments to the session store, expiring after ttl, in one batch if
+// the store supports it, and updates the assignment cache.
+func (a *Forklift) storeAssignments(ctx context.Context, entries []store.Entry, ttl time.Duration) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if batch, ok := a.sessionStore.(store.BatchSetter); ok {
+		if err := batch.SetMany(ctx, entries, ttl); err != nil {
+			return err
+		}
+	} else {
+		for _, entry := range entries {
+			if err := a.sessionStore.Set(ctx, entry.Key, entry.Value, ttl); err != nil {
+				return err
+			}
+		}
+	}
+	if a.assignments != nil {
+		for _, entry := range entries {
+			a.assignments.put(entry.Key, entry.Value, true, a.now())
+		}
+	}
+	return nil
+}
+
+// readJSONAssignments decodes an export in JSON, {"assignments": [{"key": ..., "value": ...}]},
+// entry by entry.
+func readJSONAssignments(body io.Reader, add func(exportedAssignment) error) error {
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return fmt.Errorf("%w: expected a JSON object", errInvalidImport)
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidImport, err)
+		}
+		if token != "assignments" {
+			var skipped json.RawMessage
+			if err := decoder.Decode(&skipped); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			continue
+		}
+		if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+			return fmt.Errorf("%w: assignments must be an array", errInvalidImport)
+		}
+		for decoder.More() {
+			var entry exportedAssignment
+			if err := decoder.Decode(&entry); err != nil {
+				return fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			if err := add(entry); err != nil {
+				return err
+			}
+		}
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidImport, err)
+		}
+	}
+	return nil
+}
+
+// readCSVAssignments reads an export in CSV, with a key,value header.
+func readCSVAssignments(body io.Reader, add func(exportedAssignment) error) error {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = 2
+	header, err := reader.Read()
+	if err != nil || header[0] != "key" || header[1] != "value" {
+		return fmt.Errorf("%w: expected a key,value header", errInvalidImport)
+	}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errInvalidImport, err)
+		}
+		if err := add(exportedAssignment{Key: record[0], Value: record[1]}); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package forklift
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+// adminRole grants access to the admin API endpoints: viewers read the rules and experiments,
+// operators also change experiments and assignment overrides, and admins can do everything,
+// including exporting and importing assignments. Roles are ordered, each including the previous.
+type adminRole int
+
+const (
+	adminRoleNone adminRole = iota
+	adminRoleViewer
+	adminRoleOperator
+	adminRoleAdmin
+)
+
+var adminRoleNames = []string{"none", "viewer", "operator", "admin"}
+
+func (r adminRole) String() string {
+	return adminRoleNames[r]
+}
+
+func parseAdminRole(name string) (adminRole, error) {
+	for role, roleName := range adminRoleNames {
+		if role != int(adminRoleNone) && strings.EqualFold(name, roleName) {
+			return adminRole(role), nil
+		}
+	}
+	return adminRoleNone, fmt.Errorf("%w: unknown role %q: must be viewer, operator or admin", errInvalidAdminAPI, name)
+}
+
+// adminPrincipal is the token, user or OIDC subject a request authenticated as.
+type adminPrincipal struct {
+	name string
+	role adminRole
+}
+
+type adminPrincipalKey struct{}
+
+// adminPrincipalOf returns the principal serveAdmin authenticated the request as.
+func adminPrincipalOf(req *http.Request) adminPrincipal {
+	principal, _ := req.Context().Value(adminPrincipalKey{}).(adminPrincipal)
+	return principal
+}
+
+type adminToken struct {
+	name  string
+	token string
+	role  adminRole
+}
+
+type adminUser struct {
+	password string
+	// sha256 is the hex SHA-256 of the password, if the configuration gives it instead.
+	sha256 string
+	role   adminRole
+}
+
+// adminCredentials validates the tokens and users of the configuration.
+func adminCredentials(cfg *config.AdminAPI) ([]adminToken, map[string]adminUser, error) {
+	tokens := make([]adminToken, 0, len(cfg.Tokens))
+	for i, token := range cfg.Tokens {
+		if token.Token == "" {
+			return nil, nil, fmt.Errorf("%w: token %d is empty", errInvalidAdminAPI, i+1)
+		}
+		role, err := parseAdminRole(token.Role)
+		if err != nil {
+			return nil, nil, err
+		}
+		name := token.Name
+		if name == "" {
+			name = fmt.Sprintf("token %d", i+1)
+		}
+		tokens = append(tokens, adminToken{name: name, token: token.Token, role: role})
+	}
+
+	users := make(map[string]adminUser, len(cfg.Users))
+	for _, user := range cfg.Users {
+		if user.Username == "" || user.Password == "" {
+			return nil, nil, fmt.Errorf("%w: users need a username and password", errInvalidAdminAPI)
+		}
+		if _, ok := users[user.Username]; ok {
+			return nil, nil, fmt.Errorf("%w: duplicate user %q", errInvalidAdminAPI, user.Username)
+		}
+		role, err := parseAdminRole(user.Role)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry := adminUser{password: user.Password, role: role}
+		if digest, ok := strings.CutPrefix(user.Password, "sha256:"); ok {
+			if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != sha256.Size {
+				return nil, nil, fmt.Errorf("%w: user %q: invalid sha256 password", errInvalidAdminAPI, user.Username)
+			}
+			entry = adminUser{sha256: strings.ToLower(digest), role: role}
+		}
+		users[user.Username] = entry
+	}
+	return tokens, users, nil
+}
+
+// authenticate returns the principal of the request's credentials: the token, which grants the
+// admin role, one of the tokens or an OIDC token as a bearer token, or a user's basic auth
+// credentials. When the UI is served, browsers may also send the token as a basic auth password.
+// Changes authenticated by basic auth must carry the UI header.
+func (api *adminAPI) authenticate(req *http.Request) (adminPrincipal, bool) {
+	if bearer, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok {
+		if api.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(api.token)) == 1 {
+			return adminPrincipal{name: "token", role: adminRoleAdmin}, true
+		}
+		for _, token := range api.tokens {
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(token.token)) == 1 {
+				return adminPrincipal{name: token.name, role: token.role}, true
+			}
+		}
+		if api.oidc != nil && strings.Count(bearer, ".") == 2 {
+			principal, err := api.oidc.verify(req.Context(), bearer)
+			return principal, err == nil
+		}
+		return adminPrincipal{}, false
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return adminPrincipal{}, false
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead && req.Header.Get(adminUIHeader) == "" {
+		return adminPrincipal{}, false
+	}
+	if user, ok := api.users[username]; ok && user.matches(password) {
+		return adminPrincipal{name: username, role: user.role}, true
+	}
+	if api.ui && api.token != "" && subtle.ConstantTimeCompare([]byte(password), []byte(api.token)) == 1 {
+		return adminPrincipal{name: "token", role: adminRoleAdmin}, true
+	}
+	return adminPrincipal{}, false
+}
+
+func (u adminUser) matches(password string) bool {
+	if u.sha256 != "" {
+		digest := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(digest[:])), []byte(u.sha256)) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(u.password)) == 1
+}
+
+// requiredAdminRole returns the role an admin API request needs: reading needs the viewer role,
+// changing experiments, overrides and rules the operator role, and the export and import of
+// assignments the admin role.
+func requiredAdminRole(method, endpoint string) adminRole {
+	switch {
+	case endpoint == adminAssignmentsPath:
+		return adminRoleAdmin
+	case strings.HasPrefix(endpoint, adminAssignmentsPath+"/"),
+		strings.HasPrefix(endpoint, adminExperimentsPath),
+		method != http.MethodGet && method != http.MethodHead:
+		return adminRoleOperator
+	default:
+		return adminRoleViewer
+	}
+}
@@ -0,0 +1,314 @@
+package forklift
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidOIDCToken = errors.New("invalid oidc token")
+	errOIDCKeys         = errors.New("oidc signing keys unavailable")
+)
+
+const (
+	defaultOIDCTimeout    = 5 * time.Second
+	defaultOIDCRolesClaim = "roles"
+	// oidcKeysTTL is how long signing keys are cached. Tokens signed with an unknown key refetch
+	// them, at most once per oidcKeysRefresh.
+	oidcKeysTTL     = time.Hour
+	oidcKeysRefresh = time.Minute
+	// oidcLeeway tolerates clock skew with the provider.
+	oidcLeeway = time.Minute
+)
+
+// oidcVerifier verifies the ID and access tokens of an OIDC provider, JWTs signed with RS256 or
+// ES256 by a key published in the provider's JWKS, and maps their roles claim to admin roles.
+type oidcVerifier struct {
+	issuer     string
+	audience   string
+	rolesClaim string
+	roles      map[string]adminRole
+	client     *http.Client
+	now        func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// oidcClaims are the claims of a token the verifier reads. Audience and the roles claim can be a
+// string or a list of strings.
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Audience          json.RawMessage `json:"aud"`
+	Expires           int64           `json:"exp"`
+	NotBefore         int64           `json:"nbf"`
+	Subject           string          `json:"sub"`
+	Email             string          `json:"email"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+// newOIDCVerifier returns nil when OIDC is not configured.
+func newOIDCVerifier(cfg *config.AdminOIDC) (*oidcVerifier, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(cfg.Issuer, "https://") && !strings.HasPrefix(cfg.Issuer, "http://") {
+		return nil, fmt.Errorf("%w: oidc issuer must be an http(s) URL", errInvalidAdminAPI)
+	}
+	timeout := defaultOIDCTimeout
+	if cfg.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(cfg.Timeout); err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%w: invalid oidc timeout %q", errInvalidAdminAPI, cfg.Timeout)
+		}
+	}
+	v := &oidcVerifier{
+		issuer:     strings.TrimSuffix(cfg.Issuer, "/"),
+		audience:   cfg.Audience,
+		rolesClaim: cfg.RolesClaim,
+		roles:      make(map[string]adminRole, len(cfg.Roles)),
+		client:     &http.Client{Timeout: timeout},
+		now:        time.Now,
+	}
+	if v.rolesClaim == "" {
+		v.rolesClaim = defaultOIDCRolesClaim
+	}
+	for value, name := range cfg.Roles {
+		role, err := parseAdminRole(name)
+		if err != nil {
+			return nil, err
+		}
+		v.roles[value] = role
+	}
+	return v, nil
+}
+
+// verify checks the signature and claims of a token, and returns the principal it identifies.
+func (v *oidcVerifier) verify(ctx context.Context, token string) (adminPrincipal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return adminPrincipal{}, fmt.Errorf("%w: not a JWT", errInvalidOIDCToken)
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return adminPrincipal{}, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return adminPrincipal{}, fmt.Errorf("%w: %w", errInvalidOIDCToken, err)
+	}
+	key, err := v.key(ctx, header.KeyID)
+	if err != nil {
+		return adminPrincipal{}, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifyJWTSignature(header.Algorithm, key, digest[:], signature) {
+		return adminPrincipal{}, fmt.Errorf("%w: bad signature", errInvalidOIDCToken)
+	}
+
+	var claims oidcClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return adminPrincipal{}, err
+	}
+	now := v.now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.issuer:
+		return adminPrincipal{}, fmt.Errorf("%w: issuer %q", errInvalidOIDCToken, claims.Issuer)
+	case v.audience != "" && !containsClaim(claims.Audience, v.audience):
+		return adminPrincipal{}, fmt.Errorf("%w: audience", errInvalidOIDCToken)
+	case claims.Expires == 0 || now.After(time.Unix(claims.Expires, 0).Add(oidcLeeway)):
+		return adminPrincipal{}, fmt.Errorf("%w: expired", errInvalidOIDCToken)
+	case claims.NotBefore != 0 && now.Add(oidcLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return adminPrincipal{}, fmt.Errorf("%w: not yet valid", errInvalidOIDCToken)
+	}
+
+	var all map[string]json.RawMessage
+	if err := decodeJWTPart(parts[1], &all); err != nil {
+		return adminPrincipal{}, err
+	}
+	principal := adminPrincipal{name: claims.Email}
+	if principal.name == "" {
+		principal.name = claims.PreferredUsername
+	}
+	if principal.name == "" {
+		principal.name = claims.Subject
+	}
+	for _, value := range claimValues(all[v.rolesClaim]) {
+		role, ok := v.roles[value]
+		if !ok {
+			role, _ = parseAdminRole(value)
+		}
+		if role > principal.role {
+			principal.role = role
+		}
+	}
+	return principal, nil
+}
+
+func decodeJWTPart(part string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidOIDCToken, err)
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidOIDCToken, err)
+	}
+	return nil
+}
+
+// claimValues returns the values of a claim that is a string or a list of strings.
+func claimValues(raw json.RawMessage) []string {
+	var value string
+	if json.Unmarshal(raw, &value) == nil {
+		return []string{value}
+	}
+	var values []string
+	_ = json.Unmarshal(raw, &values)
+	return values
+}
+
+func containsClaim(raw json.RawMessage, want string) bool {
+	for _, value := range claimValues(raw) {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+func verifyJWTSignature(algorithm string, key crypto.PublicKey, digest, signature []byte) bool {
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature) == nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest, r, s)
+	default:
+		return false
+	}
+}
+
+// key returns the signing key with the ID, fetching the provider's keys when they are stale or
+// don't include it.
+func (v *oidcVerifier) key(ctx context.Context, id string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	now := v.now()
+	key, ok := v.keys[id]
+	stale := now.Sub(v.fetched) > oidcKeysTTL
+	if ok && !stale {
+		return key, nil
+	}
+	if !stale && now.Sub(v.fetched) < oidcKeysRefresh {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidOIDCToken, id)
+	}
+
+	keys, err := v.fetchKeys(ctx)
+	if err != nil {
+		// Keep verifying with the keys fetched before while the provider is unavailable.
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+	v.keys, v.fetched = keys, now
+	if key, ok := keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", errInvalidOIDCToken, id)
+}
+
+// fetchKeys reads the RSA and P-256 keys of the JWKS named in the provider's discovery document.
+func (v *oidcVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := v.getJSON(ctx, v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(ctx, discovery.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if jwk.Curve != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			keys[jwk.KeyID] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return keys, nil
+}
+
+func (v *oidcVerifier) getJSON(ctx context.Context, target string, value interface{}) error {
+	if target == "" {
+		return fmt.Errorf("%w: no jwks_uri", errOIDCKeys)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errOIDCKeys, err)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errOIDCKeys, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", errOIDCKeys, target, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(value); err != nil {
+		return fmt.Errorf("%w: %w", errOIDCKeys, err)
+	}
+	return nil
+}
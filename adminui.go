@@ -0,0 +1,428 @@
+package forklift
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const (
+	adminUIPath          = "/ui"
+	adminOverviewPath    = "/overview"
+	adminExperimentsPath = "/experiments/"
+
+	// adminUIHeader must be sent with changes authorized by basic auth. Browsers send basic
+	// credentials with requests other sites make too, but other sites can't set custom headers
+	// without a CORS preflight, which the admin API doesn't answer.
+	adminUIHeader = "X-Forklift-UI"
+
+	// defaultDrainGrace is how long sessions keep a variant drained through the admin API, as
+	// with forklift experiment drain.
+	defaultDrainGrace = 24 * time.Hour
+)
+
+// liveTraffic counts the requests and 5xx responses of each variant since the middleware
+// started, which the admin UI turns into live traffic splits and error rates by polling. It is
+// shared by the middleware and the copies created for each rule change.
+type liveTraffic struct {
+	mu       sync.Mutex
+	variants map[variantKey]*liveCounts
+}
+
+type liveCounts struct {
+	requests, errors int64
+}
+
+// newLiveTraffic returns nil when the admin UI is not served.
+func newLiveTraffic(cfg *config.Config) *liveTraffic {
+	if cfg.AdminAPI == nil || !cfg.AdminAPI.UI {
+		return nil
+	}
+	return &liveTraffic{variants: make(map[variantKey]*liveCounts)}
+}
+
+// record counts a request served by an experiment variant.
+func (l *liveTraffic) record(hc *HookContext) {
+	if l == nil {
+		return
+	}
+	experiment, variant := exposureLabels(hc.Selected)
+	if experiment == "" {
+		return
+	}
+	key := variantKey{experiment: experiment, variant: variant}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counts := l.variants[key]
+	if counts == nil {
+		counts = &liveCounts{}
+		l.variants[key] = counts
+	}
+	counts.requests++
+	if hc.Status >= http.StatusInternalServerError {
+		counts.errors++
+	}
+}
+
+func (l *liveTraffic) counts(experiment, variant string) liveCounts {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if counts := l.variants[variantKey{experiment: experiment, variant: variant}]; counts != nil {
+		return *counts
+	}
+	return liveCounts{}
+}
+
+// overviewVariant is a variant of an experiment in the overview, with the percentage and paused
+// state of its first rule and its requests and errors since the middleware started.
+type overviewVariant struct {
+	Variant    string  `json:"variant"`
+	Backend    string  `json:"backend"`
+	Percentage float64 `json:"percentage"`
+	Paused     bool    `json:"paused"`
+	Requests   int64   `json:"requests"`
+	Errors     int64   `json:"errors"`
+	// Cluster holds the totals across instances, with cluster counters.
+	Cluster *clusterVariantCounts `json:"cluster,omitempty"`
+}
+
+type overviewExperiment struct {
+	Name     string             `json:"name"`
+	Paused   bool               `json:"paused"`
+	Variants []*overviewVariant `json:"variants"`
+}
+
+type overviewRule struct {
+	Key        string  `json:"key"`
+	Path       string  `json:"path,omitempty"`
+	PathPrefix string  `json:"pathPrefix,omitempty"`
+	Method     string  `json:"method,omitempty"`
+	Backend    string  `json:"backend"`
+	Experiment string  `json:"experiment,omitempty"`
+	Variant    string  `json:"variant,omitempty"`
+	Percentage float64 `json:"percentage,omitempty"`
+	Paused     bool    `json:"paused,omitempty"`
+}
+
+// serveOverview describes the rules serving requests and their experiments, with the live counts
+// of each variant and, with cluster counters, its totals across instances. It also lists the rule
+// history if it is kept, the role of the caller and, with leader election, whether the instance
+// is the leader.
+func (a *Forklift) serveOverview(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var goals []config.Goal
+	if a.results != nil {
+		goals = a.results.goals
+	}
+	rules := make([]overviewRule, 0, len(a.config.Rules))
+	var experiments []*overviewExperiment
+	byName := make(map[string]*overviewExperiment)
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		rules = append(rules, overviewRule{
+			Key:        a.ruleKey(rule),
+			Path:       rule.Path,
+			PathPrefix: rule.PathPrefix,
+			Method:     rule.Method,
+			Backend:    rule.Backend,
+			Experiment: rule.Experiment,
+			Variant:    rule.Variant,
+			Percentage: rule.Percentage,
+			Paused:     rule.Paused,
+		})
+		if rule.Experiment == "" {
+			continue
+		}
+		experiment := byName[rule.Experiment]
+		if experiment == nil {
+			experiment = &overviewExperiment{Name: rule.Experiment, Paused: true}
+			byName[rule.Experiment] = experiment
+			experiments = append(experiments, experiment)
+		}
+		experiment.Paused = experiment.Paused && rule.Paused
+		_, name := exposureLabels(SelectedBackend{Rule: rule, Backend: rule.Backend})
+		found := false
+		for _, variant := range experiment.Variants {
+			found = found || variant.Variant == name
+		}
+		if !found {
+			counts := a.liveTraffic.counts(rule.Experiment, name)
+			var cluster *clusterVariantCounts
+			if a.counters != nil {
+				cluster = a.counters.counts(rule.Experiment, name, goals)
+			}
+			experiment.Variants = append(experiment.Variants, &overviewVariant{
+				Variant:    name,
+				Backend:    rule.Backend,
+				Percentage: rule.Percentage,
+				Paused:     rule.Paused,
+				Requests:   counts.requests,
+				Errors:     counts.errors,
+				Cluster:    cluster,
+			})
+		}
+	}
+	sort.Slice(experiments, func(i, j int) bool { return experiments[i].Name < experiments[j].Name })
+	if experiments == nil {
+		experiments = []*overviewExperiment{}
+	}
+
+	overview := map[string]interface{}{
+		"rules":       rules,
+		"experiments": experiments,
+		"role":        adminPrincipalOf(req).role.String(),
+	}
+	if a.leader != nil {
+		overview["leader"] = a.leader.leading.Load()
+	}
+	if a.history != nil {
+		a.source.mu.Lock()
+		overview["current"] = a.history.current
+		overview["versions"] = append([]ruleVersion(nil), a.history.versions...)
+		a.source.mu.Unlock()
+	}
+	writeJSON(rw, http.StatusOK, overview)
+}
+
+// serveExperimentAction changes the rules of an experiment: POST <name>/pause and <name>/resume
+// pause and resume all its rules, <name>/promote with {"variant": "<variant>"} sends all its
+// traffic to a variant, and <name>/drain with {"variant": "<variant>", "gracePeriod": "24h"}
+// drains a variant from now.
+func (a *Forklift) serveExperimentAction(rw http.ResponseWriter, req *http.Request, endpoint string) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", "POST")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	slash := strings.LastIndex(endpoint, "/")
+	if slash <= 0 {
+		http.NotFound(rw, req)
+		return
+	}
+	experiment, action := endpoint[:slash], endpoint[slash+1:]
+	entry := adminAuditEntry{Action: action, Experiment: experiment}
+
+	var change func(cfg *config.Config) error
+	switch action {
+	case "pause", "resume":
+		change = func(cfg *config.Config) error { return cfg.SetExperimentPaused(experiment, action == "pause") }
+	case "promote":
+		var body struct {
+			Variant string `json:"variant"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrafficRequestSize)).Decode(&body); err != nil || body.Variant == "" {
+			http.Error(rw, "A variant is required", http.StatusBadRequest)
+			return
+		}
+		entry.Variant = body.Variant
+		change = func(cfg *config.Config) error { return cfg.PromoteVariant(experiment, body.Variant, maxPercentage) }
+	case "drain":
+		var body struct {
+			Variant     string `json:"variant"`
+			GracePeriod string `json:"gracePeriod"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrafficRequestSize)).Decode(&body); err != nil || body.Variant == "" {
+			http.Error(rw, "A variant is required", http.StatusBadRequest)
+			return
+		}
+		grace := defaultDrainGrace
+		if body.GracePeriod != "" {
+			var err error
+			if grace, err = time.ParseDuration(body.GracePeriod); err != nil {
+				http.Error(rw, "Invalid grace period", http.StatusBadRequest)
+				return
+			}
+		}
+		entry.Variant = body.Variant
+		since := a.now()
+		change = func(cfg *config.Config) error { return cfg.DrainVariant(experiment, body.Variant, since, grace) }
+	default:
+		http.NotFound(rw, req)
+		return
+	}
+
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	changed := config.Config{Rules: make([]RoutingRule, len(a.source.rules))}
+	copy(changed.Rules, a.source.rules)
+	if err := change(&changed); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := a.applyRules(changed.Rules); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.history.record(changed.Rules, action+" "+experiment, a.now())
+	a.audit(req, entry)
+	writeJSON(rw, http.StatusOK, map[string]string{"experiment": experiment, "action": action})
+}
+
+// adminUIScriptHash allows the page's inline script in its content security policy.
+var adminUIScriptHash = func() string {
+	sum := sha256.Sum256([]byte(adminUIScript))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}()
+
+// serveAdminUI serves the page of the admin UI, which polls the overview and posts changes with
+// the credentials the browser was authenticated with.
+func (a *Forklift) serveAdminUI(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	rw.Header().Set("Content-Security-Policy", "default-src 'none'; connect-src 'self'; style-src 'unsafe-inline'; script-src "+
+		adminUIScriptHash+"; frame-ancestors 'none'")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = rw.Write([]byte(adminUIHead + "<script>" + adminUIScript + "</script></body></html>\n"))
+}
+
+const adminUIHead = `<!DOCTYPE html>
+<html lang="en"><head><meta charset="utf-8"><title>Forklift</title>
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<style>
+body{font:14px system-ui,sans-serif;margin:2em;color:#222}
+h1{font-size:1.4em}h2{font-size:1.1em;margin:1.5em 0 .5em}
+table{border-collapse:collapse;width:100%;margin-bottom:1em}
+th,td{text-align:left;padding:.3em .6em;border-bottom:1px solid #ddd}
+.bar{background:#eee;width:12em;height:.8em;display:inline-block;vertical-align:middle}
+.bar span{background:#3b82f6;height:100%;display:block}
+.paused{color:#999}.error{color:#b91c1c}
+button{margin-right:.3em}
+</style></head><body>
+<h1>Forklift</h1>
+<p id="status"></p>
+<div id="experiments"></div>
+<div id="history"></div>
+<h2>Rules</h2>
+<table id="rules"><thead><tr><th>Rule</th><th>Backend</th><th>Experiment</th><th>Variant</th><th>%</th></tr></thead><tbody></tbody></table>
+`
+
+const adminUIScript = `
+"use strict";
+let previous = {};
+const el = (tag, text, cls) => {
+  const e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (cls) e.className = cls;
+  return e;
+};
+const row = cells => {
+  const tr = el("tr");
+  for (const c of cells) {
+    const td = el("td");
+    if (c instanceof Node) td.appendChild(c); else td.textContent = c;
+    tr.appendChild(td);
+  }
+  return tr;
+};
+const act = async (path, body) => {
+  if (!confirm(path.replace(/\//g, " ") + "?")) return;
+  const resp = await fetch(path, {method: "POST", headers: {"X-Forklift-UI": "1", "Content-Type": "application/json"}, body: JSON.stringify(body || {})});
+  if (!resp.ok) alert(await resp.text());
+  refresh();
+};
+let readOnly = false;
+const button = (label, onclick) => {
+  if (readOnly) return document.createTextNode("");
+  const b = el("button", label);
+  b.onclick = onclick;
+  return b;
+};
+const render = data => {
+  readOnly = data.role === "viewer";
+  const current = {};
+  const experiments = document.getElementById("experiments");
+  experiments.replaceChildren();
+  for (const x of data.experiments) {
+    const name = encodeURIComponent(x.name);
+    const h = el("h2", x.name + (x.paused ? " (paused)" : ""), x.paused ? "paused" : "");
+    h.appendChild(document.createTextNode(" "));
+    h.appendChild(x.paused ? button("Resume", () => act("experiments/" + name + "/resume")) : button("Pause", () => act("experiments/" + name + "/pause")));
+    experiments.appendChild(h);
+    const table = el("table");
+    const clustered = x.variants.some(v => v.cluster);
+    const clusterTotal = x.variants.reduce((t, v) => t + (v.cluster ? v.cluster.requests : 0), 0);
+    table.appendChild(row(["Variant", "Backend", "Configured", "Live split"].concat(clustered ? ["Cluster split"] : [], ["Error rate", ""])));
+    let total = 0;
+    const deltas = x.variants.map(v => {
+      const key = x.name + "\u0000" + v.variant;
+      current[key] = v;
+      const before = previous[key] || v;
+      const d = {requests: v.requests - before.requests, errors: v.errors - before.errors};
+      total += d.requests;
+      return d;
+    });
+    x.variants.forEach((v, i) => {
+      const d = deltas[i];
+      const share = total ? d.requests / total * 100 : 0;
+      const bar = el("span", undefined, "bar");
+      const fill = el("span");
+      fill.style.width = share + "%";
+      bar.appendChild(fill);
+      const live = el("span");
+      live.appendChild(bar);
+      live.appendChild(document.createTextNode(" " + share.toFixed(1) + "% (" + d.requests + " req)"));
+      const rate = d.requests ? d.errors / d.requests * 100 : 0;
+      const cells = [v.variant, v.backend, v.percentage + "%", live];
+      if (clustered) {
+        const requests = v.cluster ? v.cluster.requests : 0;
+        cells.push((clusterTotal ? requests / clusterTotal * 100 : 0).toFixed(1) + "% (" + requests + " req)");
+      }
+      const tr = row(cells.concat([el("span", rate.toFixed(2) + "%", rate > 1 ? "error" : ""),
+        button("Promote", () => act("experiments/" + name + "/promote", {variant: v.variant}))]));
+      if (v.paused) tr.className = "paused";
+      table.appendChild(tr);
+    });
+    experiments.appendChild(table);
+  }
+  previous = current;
+
+  const history = document.getElementById("history");
+  history.replaceChildren();
+  if (data.versions) {
+    history.appendChild(el("h2", "Rule history"));
+    const table = el("table");
+    for (const v of data.versions.slice().reverse()) {
+      table.appendChild(row([String(v.version), v.source, new Date(v.loaded).toLocaleString(),
+        v.version === data.current ? el("b", "current") : button("Roll back", () => act("rules/rollback", {version: v.version}))]));
+    }
+    history.appendChild(table);
+  }
+
+  const rules = document.querySelector("#rules tbody");
+  rules.replaceChildren();
+  for (const r of data.rules) {
+    const tr = row([r.key, r.backend, r.experiment || "", r.variant || "", r.percentage ? r.percentage + "%" : ""]);
+    if (r.paused) tr.className = "paused";
+    rules.appendChild(tr);
+  }
+};
+const refresh = async () => {
+  const status = document.getElementById("status");
+  try {
+    const resp = await fetch("overview");
+    if (!resp.ok) throw new Error(resp.statusText);
+    render(await resp.json());
+    status.textContent = "Updated " + new Date().toLocaleTimeString() + "; live splits and error rates cover the last 5 seconds.";
+  } catch (e) {
+    status.textContent = "Error: " + e.message;
+  }
+};
+refresh();
+setInterval(refresh, 5000);
+`
@@ -0,0 +1,47 @@
+package forklift
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+)
+
+const adminAnalysisPath = "/analysis"
+
+// analyzeRules analyzes the rules of a configuration, see config.Analyze, and logs the findings
+// that are not among the previous ones, so a rule change only reports the problems it brings.
+func analyzeRules(cfg *config.Config, previous []config.Finding, logger logger.Logger) []config.Finding {
+	findings := config.Analyze(cfg)
+	known := make(map[config.Finding]bool, len(previous))
+	for _, finding := range previous {
+		known[finding] = true
+	}
+	for _, finding := range findings {
+		if known[finding] {
+			continue
+		}
+		if finding.Rule != "" {
+			logger.Warnf("Configuration analysis: %s rule %s: %s", finding.Kind, finding.Rule, finding.Message)
+		} else {
+			logger.Warnf("Configuration analysis: %s: %s", finding.Kind, finding.Message)
+		}
+	}
+	return findings
+}
+
+// serveAnalysis serves the findings of the analysis of the current rules.
+func (a *Forklift) serveAnalysis(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	findings := a.current().findings
+	if findings == nil {
+		findings = []config.Finding{}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{"findings": findings})
+}
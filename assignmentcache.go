@@ -0,0 +1,133 @@
+package forklift
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidSessionCache = errors.New("invalid session store cache")
+
+const (
+	defaultSessionCacheSize        = 10000
+	defaultSessionCacheTTL         = time.Minute
+	defaultSessionCacheNegativeTTL = 5 * time.Second
+)
+
+// assignmentCache keeps the most recently used session assignments in memory, so the session
+// store is not read for every request. Sessions without an assignment are cached too, for a
+// shorter time, as most requests of a new session would otherwise all miss the store. The cache
+// is shared by the middleware and the copies created for each bundle version.
+type assignmentCache struct {
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	lookups     *metrics.CounterVec
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type cachedAssignment struct {
+	key     string
+	backend string
+	found   bool
+	expires time.Time
+}
+
+// newAssignmentCache returns nil when the session store has no cache configured.
+func newAssignmentCache(cfg *config.SessionStore, registry *metrics.Registry) (*assignmentCache, error) {
+	if cfg == nil || cfg.Type == "" || cfg.Cache == nil {
+		return nil, nil
+	}
+	c := &assignmentCache{
+		size:        defaultSessionCacheSize,
+		ttl:         defaultSessionCacheTTL,
+		negativeTTL: defaultSessionCacheNegativeTTL,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+	}
+	if cfg.Cache.Size < 0 {
+		return nil, fmt.Errorf("%w: size %d", errInvalidSessionCache, cfg.Cache.Size)
+	}
+	if cfg.Cache.Size > 0 {
+		c.size = cfg.Cache.Size
+	}
+	var err error
+	if c.ttl, err = parseCacheTTL(cfg.Cache.TTL, c.ttl); err != nil {
+		return nil, err
+	}
+	if c.negativeTTL, err = parseCacheTTL(cfg.Cache.NegativeTTL, c.negativeTTL); err != nil {
+		return nil, err
+	}
+	c.lookups = registry.Counter("forklift_session_cache_lookups_total",
+		"Number of session assignment lookups by result: hit, negative_hit or miss.", "result")
+	return c, nil
+}
+
+func parseCacheTTL(value string, defaultTTL time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultTTL, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%w: ttl %s", errInvalidSessionCache, value)
+	}
+	return d, nil
+}
+
+// get returns the cached assignment for key and whether the session has one. ok reports whether
+// key was cached at all.
+func (c *assignmentCache) get(key string, now time.Time) (backend string, found, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, cached := c.entries[key]
+	if cached {
+		entry := element.Value.(*cachedAssignment)
+		if now.Before(entry.expires) {
+			c.order.MoveToFront(element)
+			if entry.found {
+				c.lookups.Inc("hit")
+			} else {
+				c.lookups.Inc("negative_hit")
+			}
+			return entry.backend, entry.found, true
+		}
+		c.remove(element)
+	}
+	c.lookups.Inc("miss")
+	return "", false, false
+}
+
+// put caches the assignment for key, or its absence. Absences are not cached with a negative
+// TTL of 0.
+func (c *assignmentCache) put(key, backend string, found bool, now time.Time) {
+	ttl := c.ttl
+	if !found {
+		ttl = c.negativeTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, cached := c.entries[key]; cached {
+		c.remove(element)
+	}
+	if ttl == 0 {
+		return
+	}
+	entry := &cachedAssignment{key: key, backend: backend, found: found, expires: now.Add(ttl)}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *assignmentCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cachedAssignment).key)
+}
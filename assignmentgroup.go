@@ -0,0 +1,175 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+var errInvalidAssignmentGroup = errors.New("invalid assignment group")
+
+// assignmentGroupKeyPrefix distinguishes the session store keys of assignment groups from paths.
+const assignmentGroupKeyPrefix = "group:"
+
+// validateAssignmentGroups checks that the rules of each assignment group are percentage rules
+// with a variant, that paths don't mix them with other percentage rules, and that every path of
+// a group splits traffic between the same variants with the same percentages, so a session is in
+// the same variant on each of them.
+func validateAssignmentGroups(rules []RoutingRule) error {
+	// splits holds the percentage of each variant of each group, by group and path.
+	splits := make(map[string]map[string]map[string]float64)
+	pathGroups := make(map[string]string)
+	for _, rule := range rules {
+		if rule.Percentage == 0 || rule.Flag != nil {
+			if rule.AssignmentGroup != "" {
+				return fmt.Errorf("%w: %s: rules need a percentage", errInvalidAssignmentGroup, rule.AssignmentGroup)
+			}
+			continue
+		}
+		path := rulePathKey(&rule)
+		if group, seen := pathGroups[path]; seen && group != rule.AssignmentGroup {
+			return fmt.Errorf("%w: percentage rules of %s must all be in the same group", errInvalidAssignmentGroup, path)
+		}
+		pathGroups[path] = rule.AssignmentGroup
+		if rule.AssignmentGroup == "" {
+			continue
+		}
+		if rule.Variant == "" {
+			return fmt.Errorf("%w: %s: rules need a variant", errInvalidAssignmentGroup, rule.AssignmentGroup)
+		}
+		if splits[rule.AssignmentGroup] == nil {
+			splits[rule.AssignmentGroup] = make(map[string]map[string]float64)
+		}
+		split := splits[rule.AssignmentGroup][path]
+		if split == nil {
+			split = make(map[string]float64)
+			splits[rule.AssignmentGroup][path] = split
+		}
+		if _, exists := split[rule.Variant]; exists {
+			return fmt.Errorf("%w: %s: %s has several rules for variant %s", errInvalidAssignmentGroup, rule.AssignmentGroup, path, rule.Variant)
+		}
+		split[rule.Variant] = rule.Percentage
+	}
+
+	for group, paths := range splits {
+		var first map[string]float64
+		for path, split := range paths {
+			if first == nil {
+				first = split
+				continue
+			}
+			if !sameSplit(first, split) {
+				return fmt.Errorf("%w: %s: %s splits traffic differently", errInvalidAssignmentGroup, group, path)
+			}
+		}
+	}
+	return nil
+}
+
+func sameSplit(a, b map[string]float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for variant, percentage := range a {
+		if b[variant] != percentage {
+			return false
+		}
+	}
+	return true
+}
+
+// assignmentGroup returns the assignment group of the percentage rules of a path, if any.
+func assignmentGroup(rules []*RoutingRule) string {
+	for _, rule := range rules {
+		if rule.AssignmentGroup != "" {
+			return rule.AssignmentGroup
+		}
+	}
+	return ""
+}
+
+// assignGroupBackend returns the backend assigned to the session for the rules of a path in an
+// assignment group. The session is assigned a variant of the group, once for all its paths, and
+// routed to the backend of that variant on the path. With a session store the variant is stored
+// for the group, so changing percentages does not move existing sessions. Like assignBackend, it
+// reports whether the stored variant was reused, and the error reports that the session store
+// couldn't be read.
+func (a *Forklift) assignGroupBackend(req *http.Request, sessionID, group string, pathRules []*RoutingRule) (string, bool, error) {
+	rules := make([]*RoutingRule, 0, len(pathRules))
+	for _, rule := range pathRules {
+		if rule.AssignmentGroup == group {
+			rules = append(rules, rule)
+		}
+	}
+	ctx := context.Background()
+	key := a.assignmentKey(sessionID, assignmentGroupKeyPrefix+group)
+
+	var found bool
+	var err error
+	if a.sessionStore != nil {
+		var variant string
+		variant, found, err = a.storedAssignment(ctx, key)
+		if rule := variantRule(rules, variant); found && rule != nil && !a.drained(rule) {
+			return backendKey(*rule), true, nil
+		}
+	}
+
+	rule := a.selectVariantByHash(sessionID, group, rules)
+	if rule == nil {
+		return a.config.DefaultBackend, false, err
+	}
+	if a.sessionStore == nil || err != nil {
+		return a.admitDrain(req, backendKey(*rule), rules), false, err
+	}
+	// Draining variants are not assigned, so they don't admit the session later on.
+	if backend := a.refuseDrain(backendKey(*rule), rules); backend != backendKey(*rule) {
+		return backend, false, nil
+	}
+	if found {
+		a.saveAssignment(ctx, key, rule.Variant)
+	} else if variant := a.addAssignment(ctx, key, rule.Variant); variant != rule.Variant {
+		if stored := variantRule(rules, variant); stored != nil && !a.drained(stored) {
+			return backendKey(*stored), true, nil
+		}
+	}
+	return backendKey(*rule), false, nil
+}
+
+// selectVariantByHash picks the rule of a variant from the hash of the session ID and the group,
+// taking variants in name order, so the pick is the same on every path of the group. It returns
+// nil for sessions outside of the group's percentages.
+func (a *Forklift) selectVariantByHash(sessionID, group string, rules []*RoutingRule) *RoutingRule {
+	ordered := make([]*RoutingRule, len(rules))
+	copy(ordered, rules)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Variant < ordered[j].Variant
+	})
+
+	scaledHashValue := assignmentGroupHash(sessionID, group) * percentageScale
+	var cumulativePercentage float64
+	for _, rule := range ordered {
+		cumulativePercentage += rule.Percentage
+		if scaledHashValue <= cumulativePercentage {
+			return rule
+		}
+	}
+	return nil
+}
+
+// assignmentGroupHash returns the hash of the session in the group, between 0 and 1.
+func assignmentGroupHash(sessionID, group string) float64 {
+	h := fnv64String(fnv64String(fnvOffset64, sessionID), assignmentGroupKeyPrefix+group)
+	return float64(h) / float64(^uint64(0))
+}
+
+// variantRule returns the rule of the variant, if any.
+func variantRule(rules []*RoutingRule, variant string) *RoutingRule {
+	for _, rule := range rules {
+		if rule.Variant == variant {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+// Package awsauth signs requests to AWS APIs with credentials from the environment or the ECS
+// container credentials endpoint.
+package awsauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errMissingCredentials = errors.New("no AWS credentials found in environment or container metadata")
+
+const (
+	awsDateFormat       = "20060102T150405Z"
+	awsContainerHost    = "http://169.254.170.2"
+	credentialsLeeway   = 5 * time.Minute
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// Credentials are the credentials used to sign AWS requests.
+type Credentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// CredentialProvider resolves credentials from the environment, falling back to the ECS
+// container credentials endpoint. Container credentials are cached until shortly before
+// they expire.
+type CredentialProvider struct {
+	client *http.Client
+	mu     sync.Mutex
+	cached *Credentials
+}
+
+// NewCredentialProvider creates a provider fetching container credentials with client.
+func NewCredentialProvider(client *http.Client) *CredentialProvider {
+	return &CredentialProvider{client: client}
+}
+
+// Credentials returns the current credentials.
+func (p *CredentialProvider) Credentials(ctx context.Context) (*Credentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &Credentials{AccessKeyID: id, SecretAccessKey: secret, Token: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cached != nil && time.Until(p.cached.Expiration) > credentialsLeeway {
+		return p.cached, nil
+	}
+
+	uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		uri = awsContainerHost + relative
+	}
+	if uri == "" {
+		return nil, errMissingCredentials
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("container credentials endpoint returned %s", resp.Status)
+	}
+
+	creds := &Credentials{}
+	if err := json.NewDecoder(resp.Body).Decode(creds); err != nil {
+		return nil, err
+	}
+	p.cached = creds
+	return creds, nil
+}
+
+// SignRequest signs req with AWS Signature Version 4.
+func SignRequest(req *http.Request, payload []byte, creds *Credentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalHeaders, signedHeaders := canonicalAWSHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURIPath(req),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := awsSigningAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsSigningAlgorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalURIPath(req *http.Request) string {
+	if req.URL.EscapedPath() == "" {
+		return "/"
+	}
+	return req.URL.EscapedPath()
+}
+
+func canonicalAWSHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	for _, name := range names {
+		canonical.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return canonical.String(), strings.Join(names, ";")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,207 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidBackendHeaders = errors.New("invalid backend headers")
+
+// Values of ForwardedHeaders.
+const (
+	forwardedKeep      = "keep"
+	forwardedStrip     = "strip"
+	forwardedNormalize = "normalize"
+)
+
+// hopByHopHeaders only apply to a single connection and are never forwarded to scrubbed backends,
+// along with the headers named in Connection.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardedHeaders describe the path of a request through proxies.
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Forwarded-Prefix",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Server",
+	"X-Real-Ip",
+}
+
+// headerScrubber removes and rewrites the headers of the requests sent to a backend.
+type headerScrubber struct {
+	// allowCookies is nil if all cookies are sent.
+	allowCookies       map[string]bool
+	stripAuthorization bool
+	remove             []string
+	set                map[string]string
+	forwarded          string
+}
+
+// newHeaderScrubbers returns the scrubbers of the backends with header configurations, by backend.
+func newHeaderScrubbers(cfg *config.Config) (map[string]*headerScrubber, error) {
+	if len(cfg.BackendHeaders) == 0 {
+		return nil, nil
+	}
+
+	scrubbers := make(map[string]*headerScrubber, len(cfg.BackendHeaders))
+	for _, headers := range cfg.BackendHeaders {
+		switch {
+		case headers.Backend == "":
+			return nil, fmt.Errorf("%w: backend is required", errInvalidBackendHeaders)
+		case scrubbers[headers.Backend] != nil:
+			return nil, fmt.Errorf("%w: %s is configured twice", errInvalidBackendHeaders, headers.Backend)
+		}
+
+		s := &headerScrubber{
+			stripAuthorization: headers.StripAuthorization,
+			set:                make(map[string]string, len(headers.SetHeaders)),
+			forwarded:          headers.ForwardedHeaders,
+		}
+		switch s.forwarded {
+		case "":
+			s.forwarded = forwardedKeep
+		case forwardedKeep, forwardedStrip, forwardedNormalize:
+		default:
+			return nil, fmt.Errorf("%w: forwarded headers must be keep, strip or normalize for %s", errInvalidBackendHeaders, headers.Backend)
+		}
+		if headers.AllowCookies != nil {
+			s.allowCookies = make(map[string]bool, len(headers.AllowCookies))
+			for _, name := range headers.AllowCookies {
+				s.allowCookies[name] = true
+			}
+		}
+		for _, name := range headers.RemoveHeaders {
+			if name == "" {
+				return nil, fmt.Errorf("%w: empty header name for %s", errInvalidBackendHeaders, headers.Backend)
+			}
+			s.remove = append(s.remove, http.CanonicalHeaderKey(name))
+		}
+		for name, value := range headers.SetHeaders {
+			if name == "" {
+				return nil, fmt.Errorf("%w: empty header name for %s", errInvalidBackendHeaders, headers.Backend)
+			}
+			s.set[http.CanonicalHeaderKey(name)] = value
+		}
+		scrubbers[headers.Backend] = s
+	}
+	return scrubbers, nil
+}
+
+// scrubHeaders applies the header configuration of the backend, if any, to a request sent to it.
+// The header of the proxy request shares its values with the original request, so values are
+// replaced rather than modified.
+func (a *Forklift) scrubHeaders(header http.Header, req *http.Request, backend string) {
+	s := a.headerScrubbers[backend]
+	if s == nil {
+		return
+	}
+
+	for _, connection := range header.Values("Connection") {
+		for _, name := range strings.Split(connection, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	// Keep "TE: trailers", which gRPC backends require.
+	trailers := false
+	for _, te := range header.Values("Te") {
+		trailers = trailers || strings.EqualFold(strings.TrimSpace(te), "trailers")
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+
+	if s.allowCookies != nil {
+		s.filterCookies(header, req)
+	}
+	if s.stripAuthorization {
+		header.Del("Authorization")
+	}
+	switch s.forwarded {
+	case forwardedStrip:
+		for _, name := range forwardedHeaders {
+			header.Del(name)
+		}
+	case forwardedNormalize:
+		normalizeForwarded(header, req)
+	}
+	for _, name := range s.remove {
+		header.Del(name)
+	}
+	for name, value := range s.set {
+		header.Set(name, value)
+	}
+}
+
+// filterCookies keeps only the allowed cookies in the Cookie header.
+func (s *headerScrubber) filterCookies(header http.Header, req *http.Request) {
+	var kept []string
+	for _, cookie := range req.Cookies() {
+		if s.allowCookies[cookie.Name] {
+			kept = append(kept, cookie.Name+"="+cookie.Value)
+		}
+	}
+	if len(kept) == 0 {
+		header.Del("Cookie")
+		return
+	}
+	header.Set("Cookie", strings.Join(kept, "; "))
+}
+
+// clientAddress returns the address of the client of a request: the first of X-Forwarded-For,
+// which Traefik only keeps from trusted proxies, or the remote address.
+func clientAddress(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
+		first, _, _ := strings.Cut(forwardedFor, ",")
+		if client := strings.TrimSpace(first); client != "" {
+			return client
+		}
+	}
+	client := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return client
+}
+
+// normalizeForwarded replaces the forwarded headers with the client address, the protocol and the
+// host of the request, hiding the proxies in between.
+func normalizeForwarded(header http.Header, req *http.Request) {
+	client := clientAddress(req)
+
+	proto := "http"
+	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		proto = "https"
+	}
+
+	for _, name := range forwardedHeaders {
+		header.Del(name)
+	}
+	if client != "" {
+		header.Set("X-Forwarded-For", client)
+	}
+	header.Set("X-Forwarded-Proto", proto)
+	header.Set("X-Forwarded-Host", req.Host)
+}
@@ -0,0 +1,141 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+const defaultQueueTimeout = 250 * time.Millisecond
+
+var errInvalidBackendLimit = errors.New("invalid backend limit")
+
+// backpressure limits the requests in flight to individual backends. Requests beyond the limit
+// wait in a bounded queue, and requests that find the queue full or time out waiting are sent to
+// the default backend instead.
+type backpressure struct {
+	limiters map[string]*backendLimiter
+
+	inFlight *metrics.GaugeVec
+	queued   *metrics.GaugeVec
+	overflow *metrics.CounterVec
+}
+
+type backendLimiter struct {
+	slots    chan struct{}
+	maxQueue int64
+	timeout  time.Duration
+	waiting  int64
+}
+
+// newBackpressure returns nil when no backend limits are configured.
+func newBackpressure(cfg *config.Config, registry *metrics.Registry) (*backpressure, error) {
+	if len(cfg.BackendLimits) == 0 {
+		return nil, nil
+	}
+
+	limiters := make(map[string]*backendLimiter, len(cfg.BackendLimits))
+	for _, limit := range cfg.BackendLimits {
+		switch {
+		case limit.Backend == "":
+			return nil, fmt.Errorf("%w: backend is required", errInvalidBackendLimit)
+		case limit.Backend == cfg.DefaultBackend:
+			return nil, fmt.Errorf("%w: the default backend takes the overflow and can't be limited", errInvalidBackendLimit)
+		case limit.MaxInFlight < 1:
+			return nil, fmt.Errorf("%w: maxInFlight must be at least 1 for %s", errInvalidBackendLimit, limit.Backend)
+		case limit.MaxQueue < 0:
+			return nil, fmt.Errorf("%w: maxQueue must not be negative for %s", errInvalidBackendLimit, limit.Backend)
+		}
+
+		timeout := defaultQueueTimeout
+		if limit.QueueTimeout != "" {
+			parsed, err := time.ParseDuration(limit.QueueTimeout)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("%w: invalid queue timeout %q for %s", errInvalidBackendLimit, limit.QueueTimeout, limit.Backend)
+			}
+			timeout = parsed
+		}
+
+		limiters[limit.Backend] = &backendLimiter{
+			slots:    make(chan struct{}, limit.MaxInFlight),
+			maxQueue: int64(limit.MaxQueue),
+			timeout:  timeout,
+		}
+	}
+
+	return &backpressure{
+		limiters: limiters,
+		inFlight: registry.Gauge("forklift_backend_in_flight",
+			"Number of requests in flight to a limited backend.", "backend"),
+		queued: registry.Gauge("forklift_backend_queue_depth",
+			"Number of requests waiting for a limited backend.", "backend"),
+		overflow: registry.Counter("forklift_backend_overflow_total",
+			"Number of requests sent to the default backend because a limited backend was saturated.", "backend"),
+	}, nil
+}
+
+func noRelease() {}
+
+// admit reserves a slot on the selected backend and returns the function releasing it. If the
+// backend is saturated the request is moved to the default backend.
+func (a *Forklift) admit(req *http.Request, selected SelectedBackend) (SelectedBackend, func()) {
+	if a.backpressure == nil {
+		return selected, noRelease
+	}
+	limiter := a.backpressure.limiters[backendURL(selected)]
+	if limiter == nil {
+		return selected, noRelease
+	}
+
+	bp := a.backpressure
+	backend := backendURL(selected)
+	if !bp.acquire(req.Context(), backend, limiter) {
+		bp.overflow.Inc(backend)
+		if a.config.Debug {
+			a.logger.Debugf("Backend %s is saturated, using default backend", backend)
+		}
+		return SelectedBackend{Backend: a.config.DefaultBackend, Reason: reasonBackpressure}, noRelease
+	}
+
+	bp.inFlight.Add(1, backend)
+	return selected, func() {
+		bp.inFlight.Add(-1, backend)
+		<-limiter.slots
+	}
+}
+
+// acquire takes a slot of the limiter, waiting in its queue if there is room.
+func (bp *backpressure) acquire(ctx context.Context, backend string, limiter *backendLimiter) bool {
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if atomic.AddInt64(&limiter.waiting, 1) > limiter.maxQueue {
+		atomic.AddInt64(&limiter.waiting, -1)
+		return false
+	}
+	bp.queued.Add(1, backend)
+	defer func() {
+		atomic.AddInt64(&limiter.waiting, -1)
+		bp.queued.Add(-1, backend)
+	}()
+
+	timer := time.NewTimer(limiter.timeout)
+	defer timer.Stop()
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,257 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidBlackout = errors.New("invalid blackout")
+	errInvalidCron     = errors.New("invalid cron expression")
+)
+
+// maxBlackoutDuration bounds the duration of cron blackouts, which are found by looking back
+// minute by minute for the last time the expression matched.
+const maxBlackoutDuration = 31 * 24 * time.Hour
+
+// blackout is a parsed blackout window: a fixed range of time, or a cron schedule and the duration
+// of each occurrence.
+type blackout struct {
+	name       string
+	start, end time.Time
+
+	schedule *cronSchedule
+	duration time.Duration
+	location *time.Location
+	// state caches whether a cron blackout is active for a minute: the Unix minute shifted left by
+	// one, with the result in the lowest bit.
+	state atomic.Int64
+}
+
+// parseBlackouts parses blackout windows, naming unnamed ones by their position.
+func parseBlackouts(blackouts []config.Blackout) ([]*blackout, error) {
+	parsed := make([]*blackout, 0, len(blackouts))
+	for i, cfg := range blackouts {
+		if cfg.Name == "" {
+			cfg.Name = strconv.Itoa(i)
+		}
+		b, err := parseBlackout(cfg)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, b)
+	}
+	return parsed, nil
+}
+
+func parseBlackout(cfg config.Blackout) (*blackout, error) {
+	b := &blackout{name: cfg.Name, location: time.UTC}
+	if cfg.Cron == "" {
+		start, err := time.Parse(time.RFC3339, cfg.Start)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: start must be an RFC 3339 time", errInvalidBlackout, cfg.Name)
+		}
+		end, err := time.Parse(time.RFC3339, cfg.End)
+		if err != nil || !end.After(start) {
+			return nil, fmt.Errorf("%w %s: end must be an RFC 3339 time after start", errInvalidBlackout, cfg.Name)
+		}
+		b.start, b.end = start, end
+		return b, nil
+	}
+
+	if cfg.Start != "" || cfg.End != "" {
+		return nil, fmt.Errorf("%w %s: cron excludes start and end", errInvalidBlackout, cfg.Name)
+	}
+	schedule, err := parseCron(cfg.Cron)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s: %v", errInvalidBlackout, cfg.Name, err)
+	}
+	duration, err := time.ParseDuration(cfg.Duration)
+	if err != nil || duration < time.Minute || duration > maxBlackoutDuration {
+		return nil, fmt.Errorf("%w %s: duration must be between 1m and %s", errInvalidBlackout, cfg.Name, maxBlackoutDuration)
+	}
+	if cfg.Timezone != "" {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %v", errInvalidBlackout, cfg.Name, err)
+		}
+		b.location = location
+	}
+	b.schedule, b.duration = schedule, duration
+	return b, nil
+}
+
+// ruleBlackouts parses the blackouts of all rules that have some.
+func ruleBlackouts(rules []RoutingRule) (map[*RoutingRule][]*blackout, error) {
+	blackouts := make(map[*RoutingRule][]*blackout)
+	for i := range rules {
+		rule := &rules[i]
+		if len(rule.Blackouts) == 0 {
+			continue
+		}
+		parsed, err := parseBlackouts(rule.Blackouts)
+		if err != nil {
+			return nil, err
+		}
+		blackouts[rule] = parsed
+	}
+	return blackouts, nil
+}
+
+// active reports whether the blackout covers now.
+func (b *blackout) active(now time.Time) bool {
+	if b.schedule == nil {
+		return !now.Before(b.start) && now.Before(b.end)
+	}
+	minute := now.Unix() / 60
+	if state := b.state.Load(); state>>1 == minute {
+		return state&1 == 1
+	}
+	active := b.schedule.matchedWithin(now.In(b.location), b.duration)
+	state := minute << 1
+	if active {
+		state |= 1
+	}
+	b.state.Store(state)
+	return active
+}
+
+// activeBlackout returns the first active blackout, if any.
+func activeBlackout(blackouts []*blackout, now time.Time) *blackout {
+	for _, b := range blackouts {
+		if b.active(now) {
+			return b
+		}
+	}
+	return nil
+}
+
+// blackedOut reports whether a rule is in one of its blackouts or, for rules that are part of an
+// experiment, in a global one. Rules in a blackout are skipped like paused rules, so sessions get
+// their variants back once it ends.
+func (a *Forklift) blackedOut(rule *RoutingRule) bool {
+	if len(a.blackouts) == 0 && rule.Blackouts == nil {
+		return false
+	}
+	now := a.now()
+	b := activeBlackout(a.ruleBlackouts[rule], now)
+	if b == nil && isExperimentRule(rule) {
+		b = activeBlackout(a.blackouts, now)
+	}
+	if b != nil && a.config.Debug {
+		a.logger.Debugf("Rule for %s is in blackout %s", backendKey(*rule), b.name)
+	}
+	return b != nil
+}
+
+// isExperimentRule reports whether the rule splits traffic, by percentage, experiment or flag,
+// rather than only routing it.
+func isExperimentRule(rule *RoutingRule) bool {
+	return rule.Percentage > 0 || rule.Experiment != "" || rule.Flag != nil
+}
+
+// cronSchedule is a parsed cron expression with the standard five fields. Each field is the set
+// of values it matches, as a bit set.
+type cronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// anyDay and anyWeekday are set for "*" fields. As in cron, a time matches if either the day
+	// of month or the weekday matches when both are restricted.
+	anyDay, anyWeekday bool
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week", where each field is "*", a
+// value, a range "a-b", a step "*/n" or "a-b/n", or a comma separated list of these. Sunday is 0
+// or 7.
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: %q must have 5 fields", errInvalidCron, expression)
+	}
+	s := &cronSchedule{anyDay: fields[2] == "*", anyWeekday: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*uint64{&s.minutes, &s.hours, &s.days, &s.months, &s.weekdays}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", errInvalidCron, expression, err)
+		}
+		*sets[i] = set
+	}
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+	return s, nil
+}
+
+func parseCronField(field string, lowest, highest int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		values, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+		}
+		from, to := lowest, highest
+		if values != "*" {
+			low, high, isRange := strings.Cut(values, "-")
+			var err error
+			if from, err = strconv.Atoi(low); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(high); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				to = highest
+			}
+		}
+		if from < lowest || to > highest || from > to {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, lowest, highest)
+		}
+		for value := from; value <= to; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule matches the minute of t.
+func (s *cronSchedule) matches(t time.Time) bool {
+	if s.minutes&(1<<uint(t.Minute())) == 0 || s.hours&(1<<uint(t.Hour())) == 0 || s.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.anyDay && s.anyWeekday:
+		return true
+	case s.anyDay:
+		return weekday
+	case s.anyWeekday:
+		return day
+	default:
+		return day || weekday
+	}
+}
+
+// matchedWithin reports whether the schedule matched in the duration up to and including the
+// minute of now.
+func (s *cronSchedule) matchedWithin(now time.Time, duration time.Duration) bool {
+	for t := now.Truncate(time.Minute); now.Sub(t) < duration; t = t.Add(-time.Minute) {
+		if s.matches(t) {
+			return true
+		}
+	}
+	return false
+}
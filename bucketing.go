@@ -0,0 +1,117 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var errInvalidBucketing = errors.New("invalid bucketing")
+
+// bucketBySession is the default bucketing of percentage splits, by session ID.
+const bucketBySession = "session"
+
+// bucketByURL buckets percentage splits by the path and query of the request.
+const bucketByURL = "url"
+
+// validatePageBuckets checks the bucketBy and bucketPattern of the rules: only percentage rules
+// outside assignment groups may bucket by something other than the session, and the percentage
+// rules of a path must all bucket the same way, so every request of a page is in one bucket.
+func validatePageBuckets(rules []RoutingRule) error {
+	type bucketing struct{ by, pattern string }
+	paths := make(map[string]bucketing)
+	for _, rule := range rules {
+		by := pageBucketSource(&rule)
+		if by != "" && by != bucketByURL && !validFlagSource(by) {
+			return fmt.Errorf("%w: unknown bucketBy %q", errInvalidBucketing, rule.BucketBy)
+		}
+		if rule.BucketPattern != "" {
+			if by == "" {
+				return fmt.Errorf("%w: bucketPattern requires a bucketBy other than session", errInvalidBucketing)
+			}
+			if _, err := regexp.Compile(rule.BucketPattern); err != nil {
+				return fmt.Errorf("%w: %w", errInvalidBucketing, err)
+			}
+		}
+		if rule.Percentage == 0 || rule.Flag != nil {
+			if by != "" {
+				return fmt.Errorf("%w: %s: bucketBy requires a percentage", errInvalidBucketing, rulePathKey(&rule))
+			}
+			continue
+		}
+		if by != "" && rule.AssignmentGroup != "" {
+			return fmt.Errorf("%w: %s: assignment groups bucket by session", errInvalidBucketing, rule.AssignmentGroup)
+		}
+		path := rulePathKey(&rule)
+		current := bucketing{by: by, pattern: rule.BucketPattern}
+		if seen, ok := paths[path]; ok && seen != current {
+			return fmt.Errorf("%w: percentage rules of %s must all bucket the same way", errInvalidBucketing, path)
+		}
+		paths[path] = current
+	}
+	return nil
+}
+
+// pageBucketSource returns the request source a rule buckets by, or "" for sessions.
+func pageBucketSource(rule *RoutingRule) string {
+	if rule.BucketBy == bucketBySession {
+		return ""
+	}
+	return rule.BucketBy
+}
+
+// bucketPatterns compiles the bucket patterns of the rules.
+func bucketPatterns(rules []RoutingRule) (map[*RoutingRule]*regexp.Regexp, error) {
+	patterns := make(map[*RoutingRule]*regexp.Regexp)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.BucketPattern == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(rule.BucketPattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidBucketing, err)
+		}
+		patterns[rule] = pattern
+	}
+	return patterns, nil
+}
+
+// pageBucketRule returns the percentage rule of a path's rules bucketing by the request rather
+// than the session, if any.
+func pageBucketRule(rules []*RoutingRule) *RoutingRule {
+	for _, rule := range rules {
+		if rule.Percentage > 0 && rule.Flag == nil && pageBucketSource(rule) != "" {
+			return rule
+		}
+	}
+	return nil
+}
+
+// pageBucketKey returns the key a request is bucketed by for a rule: the value of its bucketBy
+// source, narrowed to the first group of its bucketPattern, or to the whole match without groups.
+// Values the pattern doesn't match are used whole.
+func (a *Forklift) pageBucketKey(req *http.Request, rule *RoutingRule) string {
+	var key string
+	if by := pageBucketSource(rule); by == bucketByURL {
+		key = req.URL.Path
+		if req.URL.RawQuery != "" {
+			key += "?" + req.URL.RawQuery
+		}
+	} else {
+		key = flagSourceValue(req, by)
+	}
+	pattern := a.bucketPatterns[rule]
+	if pattern == nil || key == "" {
+		return key
+	}
+	match := pattern.FindStringSubmatch(key)
+	switch {
+	case match == nil:
+		return key
+	case len(match) > 1:
+		return match[1]
+	}
+	return match[0]
+}
@@ -0,0 +1,124 @@
+package forklift
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/bundle"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+// watchRuleBundle loads the configured rule bundle and keeps polling it for new versions. The
+// inline rules keep serving until a bundle with a valid signature loads, and a bundle that fails
+// to fetch, verify or validate leaves the current rules in place.
+func (a *Forklift) watchRuleBundle(ctx context.Context) error {
+	loader, err := bundle.New(a.config.RuleBundle)
+	if err != nil {
+		return err
+	}
+	a.rulesReady = &atomic.Bool{}
+	reloads := a.metrics.Counter("forklift_rule_bundle_reloads_total",
+		"Number of rule bundle loads by result: applied, failed or rejected.", "result")
+
+	a.reloadRuleBundle(ctx, loader, reloads)
+	go func() {
+		ticker := time.NewTicker(loader.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.reloadRuleBundle(ctx, loader, reloads)
+			case <-a.lifecycle.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *Forklift) reloadRuleBundle(ctx context.Context, loader *bundle.Loader, reloads *metrics.CounterVec) {
+	rules, version, changed, err := loader.Load(context.WithoutCancel(ctx))
+	if err != nil {
+		a.logger.Errorf("Error loading rule bundle: %v", err)
+		reloads.Inc("failed")
+		return
+	}
+	if !changed {
+		return
+	}
+	if err := a.replaceRules(rules, "bundle "+version); err != nil {
+		a.logger.Errorf("Rejected rule bundle %s: %v", version, err)
+		reloads.Inc("rejected")
+		return
+	}
+	a.rulesReady.Store(true)
+	reloads.Inc("applied")
+	a.logger.Infof("Applied rule bundle %s with %d rules", version, len(rules))
+}
+
+// ruleSource holds the rules canary steps and traffic weights are applied to: the configured
+// rules, or those of the latest rule bundle. Its lock serializes rule changes. It is shared by
+// the middleware and the copies created for each rule change.
+type ruleSource struct {
+	mu    sync.Mutex
+	rules []RoutingRule
+}
+
+// overrideRules returns a copy of rules with the canary steps and the weights set through the
+// traffic API applied, the weights taking precedence.
+func overrideRules(rules []RoutingRule, canary *canaryAnalysis, traffic *trafficAPI) ([]RoutingRule, error) {
+	overridden := config.Config{Rules: make([]RoutingRule, len(rules))}
+	copy(overridden.Rules, rules)
+	if canary != nil {
+		if err := canary.apply(&overridden); err != nil {
+			return nil, err
+		}
+	}
+	if traffic != nil {
+		if err := traffic.apply(&overridden); err != nil {
+			return nil, err
+		}
+	}
+	return overridden.Rules, nil
+}
+
+// replaceRules makes a copy of the middleware with the rules, and the canary steps and traffic
+// weights applied to them, serve requests, and records them in the rule history as loaded from
+// source.
+func (a *Forklift) replaceRules(rules []RoutingRule, source string) error {
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	if err := a.applyRules(rules); err != nil {
+		return err
+	}
+	a.history.record(rules, source, a.now())
+	return nil
+}
+
+// applyRules is replaceRules with the rule source locked.
+func (a *Forklift) applyRules(rules []RoutingRule) error {
+	overridden, err := overrideRules(rules, a.canary, a.traffic)
+	if err != nil {
+		return err
+	}
+	next, err := a.withRules(overridden)
+	if err != nil {
+		return err
+	}
+	a.source.rules = rules
+	a.active.Store(next)
+	return nil
+}
+
+// current returns the middleware serving requests, which is a copy with the latest rules when
+// rules are loaded from a bundle or changed at runtime.
+func (a *Forklift) current() *Forklift {
+	if a.active == nil {
+		return a
+	}
+	active, _ := a.active.Load().(*Forklift)
+	return active
+}
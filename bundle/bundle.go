@@ -0,0 +1,264 @@
+// Package bundle loads signed rule bundles from S3, Google Cloud Storage or HTTP(S), so rules
+// can be deployed as artifacts instead of through Traefik's dynamic configuration.
+package bundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/daemonp/forklift/awsauth"
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidBundle    = errors.New("invalid rule bundle")
+	errUnsupportedURL   = errors.New("unsupported rule bundle url: must be s3://, gs://, http:// or https://")
+	errBundleStatus     = errors.New("rule bundle request failed")
+	errMissingPublicKey = errors.New("rule bundle requires a public key to verify signatures")
+)
+
+const (
+	defaultPollInterval = time.Minute
+	defaultTimeout      = 10 * time.Second
+	defaultS3Region     = "us-east-1"
+	maxBundleSize       = 16 << 20
+
+	gcsURL              = "https://storage.googleapis.com"
+	gcsMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// Loader fetches a rule bundle and its detached signature, and returns the rules of new versions
+// once their signature is verified.
+type Loader struct {
+	url          string
+	signatureURL string
+	verifier     verifier
+	region       string
+	endpoint     string
+	client       *http.Client
+	credentials  *awsauth.CredentialProvider
+	now          func() time.Time
+
+	// PollInterval is how often the bundle is checked for a new version.
+	PollInterval time.Duration
+
+	etag    string
+	version string
+}
+
+// New creates a loader for the configured bundle.
+func New(cfg *config.RuleBundle) (*Loader, error) {
+	if cfg.PublicKey == "" {
+		return nil, errMissingPublicKey
+	}
+	signatureType := cfg.SignatureType
+	if signatureType == "" {
+		signatureType = "cosign"
+	}
+	verifier, err := newVerifier(signatureType, cfg.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errUnsupportedURL, err)
+	}
+	switch parsed.Scheme {
+	case "s3", "gs", "http", "https":
+	default:
+		return nil, errUnsupportedURL
+	}
+
+	pollInterval := defaultPollInterval
+	if cfg.PollInterval != "" {
+		pollInterval, err = time.ParseDuration(cfg.PollInterval)
+		if err != nil || pollInterval <= 0 {
+			return nil, fmt.Errorf("%w: invalid poll interval %q", errInvalidBundle, cfg.PollInterval)
+		}
+	}
+	timeout := defaultTimeout
+	if cfg.Timeout != "" {
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%w: invalid timeout %q", errInvalidBundle, cfg.Timeout)
+		}
+	}
+
+	signatureURL := cfg.SignatureURL
+	if signatureURL == "" {
+		signatureURL = cfg.URL + verifier.suffix()
+	}
+	region := cfg.Region
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = defaultS3Region
+	}
+
+	client := &http.Client{Timeout: timeout}
+	return &Loader{
+		url:          cfg.URL,
+		signatureURL: signatureURL,
+		verifier:     verifier,
+		region:       region,
+		endpoint:     strings.TrimSuffix(cfg.Endpoint, "/"),
+		client:       client,
+		credentials:  awsauth.NewCredentialProvider(client),
+		now:          time.Now,
+		PollInterval: pollInterval,
+	}, nil
+}
+
+// Load fetches the bundle and returns its rules if it changed since the last successful load.
+// Bundles whose signature doesn't verify are rejected with an error. The version is the
+// SHA-256 digest of the bundle.
+func (l *Loader) Load(ctx context.Context) (rules []config.RoutingRule, version string, changed bool, err error) {
+	data, etag, modified, err := l.get(ctx, l.url, l.etag)
+	if err != nil || !modified {
+		return nil, l.version, false, err
+	}
+	digest := sha256.Sum256(data)
+	version = hex.EncodeToString(digest[:])
+	if version == l.version {
+		l.etag = etag
+		return nil, version, false, nil
+	}
+
+	signature, _, _, err := l.get(ctx, l.signatureURL, "")
+	if err != nil {
+		return nil, version, false, fmt.Errorf("fetching signature: %w", err)
+	}
+	if err := l.verifier.verify(data, signature); err != nil {
+		return nil, version, false, err
+	}
+
+	var bundle config.Config
+	if err := yaml.Unmarshal(data, &bundle); err != nil {
+		return nil, version, false, fmt.Errorf("%w: %w", errInvalidBundle, err)
+	}
+
+	l.etag, l.version = etag, version
+	return bundle.Rules, version, true, nil
+}
+
+// get fetches an object, conditionally on its ETag if one is given.
+func (l *Loader) get(ctx context.Context, rawURL, etag string) (data []byte, newETag string, modified bool, err error) {
+	req, err := l.request(ctx, rawURL)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if err := l.authorize(ctx, req, rawURL); err != nil {
+		return nil, "", false, err
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, "", false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, etag, false, nil
+	case http.StatusOK:
+	default:
+		return nil, "", false, fmt.Errorf("%w: %s: %s", errBundleStatus, rawURL, resp.Status)
+	}
+
+	data, err = io.ReadAll(io.LimitReader(resp.Body, maxBundleSize+1))
+	if err != nil {
+		return nil, "", false, err
+	}
+	if len(data) > maxBundleSize {
+		return nil, "", false, fmt.Errorf("%w: %s exceeds %d bytes", errInvalidBundle, rawURL, maxBundleSize)
+	}
+	return data, resp.Header.Get("ETag"), true, nil
+}
+
+// request creates the GET request for an s3://, gs:// or http(s):// URL.
+func (l *Loader) request(ctx context.Context, rawURL string) (*http.Request, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := parsed.Host, strings.TrimPrefix(parsed.Path, "/")
+
+	target := rawURL
+	switch parsed.Scheme {
+	case "s3":
+		if l.endpoint != "" {
+			target = l.endpoint + "/" + bucket + "/" + key
+		} else {
+			target = "https://" + bucket + ".s3." + l.region + ".amazonaws.com/" + key
+		}
+	case "gs":
+		endpoint := gcsURL
+		if l.endpoint != "" {
+			endpoint = l.endpoint
+		}
+		target = endpoint + "/" + bucket + "/" + key
+	}
+	return http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+}
+
+// authorize signs S3 requests with AWS credentials and adds an OAuth token to GCS requests when
+// one is available from GOOGLE_OAUTH_ACCESS_TOKEN or the GCE metadata server. GCS objects are
+// fetched anonymously otherwise.
+func (l *Loader) authorize(ctx context.Context, req *http.Request, rawURL string) error {
+	switch {
+	case strings.HasPrefix(rawURL, "s3://"):
+		creds, err := l.credentials.Credentials(ctx)
+		if err != nil {
+			return err
+		}
+		emptyHash := sha256.Sum256(nil)
+		req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(emptyHash[:]))
+		awsauth.SignRequest(req, nil, creds, l.region, "s3", l.now())
+	case strings.HasPrefix(rawURL, "gs://"):
+		if token := gcsToken(ctx, l.client); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return nil
+}
+
+func gcsToken(ctx context.Context, client *http.Client) string {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcsMetadataTokenURL, nil)
+	if err != nil {
+		return ""
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&token) != nil {
+		return ""
+	}
+	return token.AccessToken
+}
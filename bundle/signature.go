@@ -0,0 +1,143 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	errInvalidPublicKey = errors.New("invalid bundle public key")
+	errInvalidSignature = errors.New("invalid bundle signature")
+	errBadSignature     = errors.New("bundle signature verification failed")
+)
+
+// verifier checks a detached signature of a bundle.
+type verifier interface {
+	verify(data, signature []byte) error
+	// suffix is appended to the bundle URL to find its signature by default.
+	suffix() string
+}
+
+func newVerifier(signatureType, publicKey string) (verifier, error) {
+	switch strings.ToLower(signatureType) {
+	case "cosign":
+		return newCosignVerifier(publicKey)
+	case "minisign":
+		return newMinisignVerifier(publicKey)
+	}
+	return nil, fmt.Errorf("%w: unknown signature type %q", errInvalidPublicKey, signatureType)
+}
+
+// cosignVerifier verifies signatures made with `cosign sign-blob --key`: a base64 encoded ECDSA
+// signature of the SHA-256 digest of the bundle, or an Ed25519 signature of the bundle itself.
+type cosignVerifier struct {
+	key interface{}
+}
+
+func newCosignVerifier(publicKey string) (*cosignVerifier, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, fmt.Errorf("%w: expected a PEM encoded public key", errInvalidPublicKey)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidPublicKey, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return &cosignVerifier{key: key}, nil
+	}
+	return nil, fmt.Errorf("%w: unsupported key type %T", errInvalidPublicKey, key)
+}
+
+func (c *cosignVerifier) suffix() string { return ".sig" }
+
+func (c *cosignVerifier) verify(data, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidSignature, err)
+	}
+	valid := false
+	switch key := c.key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(data)
+		valid = ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, data, sig)
+	}
+	if !valid {
+		return errBadSignature
+	}
+	return nil
+}
+
+// minisignVerifier verifies minisign signatures, both legacy and prehashed, including the
+// signature of their trusted comment.
+type minisignVerifier struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+const (
+	minisignLegacy    = "Ed"
+	minisignPrehashed = "ED"
+)
+
+func newMinisignVerifier(publicKey string) (*minisignVerifier, error) {
+	// Accept the contents of a minisign.pub file as well as the bare key.
+	lines := strings.Split(strings.TrimSpace(publicKey), "\n")
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil || len(raw) != 2+8+ed25519.PublicKeySize || string(raw[:2]) != minisignLegacy {
+		return nil, fmt.Errorf("%w: expected a minisign public key", errInvalidPublicKey)
+	}
+	v := &minisignVerifier{key: ed25519.PublicKey(raw[10:])}
+	copy(v.keyID[:], raw[2:10])
+	return v, nil
+}
+
+func (m *minisignVerifier) suffix() string { return ".minisig" }
+
+func (m *minisignVerifier) verify(data, signature []byte) error {
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("%w: expected a minisign signature file", errInvalidSignature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed signature", errInvalidSignature)
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: malformed trusted comment signature", errInvalidSignature)
+	}
+	if !bytes.Equal(sig[2:10], m.keyID[:]) {
+		return fmt.Errorf("%w: signed with another key", errBadSignature)
+	}
+
+	message := data
+	switch string(sig[:2]) {
+	case minisignLegacy:
+	case minisignPrehashed:
+		digest := blake2b512(data)
+		message = digest[:]
+	default:
+		return fmt.Errorf("%w: unknown algorithm", errInvalidSignature)
+	}
+	if !ed25519.Verify(m.key, message, sig[10:]) {
+		return errBadSignature
+	}
+
+	trustedComment := strings.TrimSuffix(strings.TrimPrefix(lines[2], "trusted comment: "), "\r")
+	if !ed25519.Verify(m.key, append(append([]byte{}, sig[10:]...), trustedComment...), globalSig) {
+		return fmt.Errorf("%w: trusted comment", errBadSignature)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package forklift
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const utmPrefix = "utm_"
+
+// checkReferer compares the host of the Referer header with the condition value. Besides the
+// usual operators it supports "domain", which matches the value and any of its subdomains.
+func (re *RuleEngine) checkReferer(req *http.Request, condition RuleCondition) bool {
+	host := refererHost(req)
+	expected := strings.ToLower(strings.TrimSpace(condition.Value))
+
+	var result bool
+	switch {
+	case host == "":
+	case strings.EqualFold(condition.Operator, "domain"):
+		result = host == expected || strings.HasSuffix(host, "."+expected)
+	default:
+		result = re.compareValues(host, condition.Operator, expected)
+	}
+	if re.config.Debug {
+		re.logger.Debugf("Referer host %q %s %q: %v", host, condition.Operator, expected, result)
+	}
+	return result
+}
+
+// refererHost returns the lowercased host of the Referer header without its port.
+func refererHost(req *http.Request) string {
+	referer := req.Referer()
+	if referer == "" {
+		return ""
+	}
+	parsed, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Hostname())
+}
+
+// checkUTM compares a UTM query parameter with the condition value. The parameter may be given
+// with or without its prefix, so "source" and "utm_source" are equivalent. UTM values are
+// compared case-insensitively since campaign tools are inconsistent about their case.
+func (re *RuleEngine) checkUTM(req *http.Request, condition RuleCondition) bool {
+	name := strings.ToLower(condition.Parameter)
+	if !strings.HasPrefix(name, utmPrefix) {
+		name = utmPrefix + name
+	}
+	value := strings.ToLower(queryParamValue(req.URL.RawQuery, name))
+	result := value != "" && re.compareValues(value, condition.Operator, strings.ToLower(condition.Value))
+	if re.config.Debug {
+		re.logger.Debugf("UTM parameter %s=%q %s %q: %v", name, value, condition.Operator, condition.Value, result)
+	}
+	return result
+}
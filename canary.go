@@ -0,0 +1,447 @@
+package forklift
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errInvalidCanaryAnalysis = errors.New("invalid canary analysis")
+	errPrometheusQuery       = errors.New("prometheus query failed")
+)
+
+const (
+	defaultCanaryInterval      = 5 * time.Minute
+	defaultCanaryTimeout       = 10 * time.Second
+	defaultCanaryPassScore     = 95.0
+	defaultCanaryMarginalScore = 75.0
+	defaultCanaryTolerance     = 0.1
+
+	canaryIncrease = "increase"
+	canaryDecrease = "decrease"
+	canaryEither   = "either"
+
+	canaryRamping    = "ramping"
+	canaryPromoted   = "promoted"
+	canaryRolledBack = "rolled_back"
+
+	// maxPrometheusResponseSize bounds the responses read from Prometheus.
+	maxPrometheusResponseSize = 1 << 20
+)
+
+// canaryAnalysis ramps canary variants up, or rolls them back, from the scores of their metrics
+// in Prometheus. The step of each canary is applied on top of the rules of the rule source. It is
+// shared by the middleware and the copies created for each rule change, and its ramps are only
+// changed with the rule source locked.
+type canaryAnalysis struct {
+	prometheus string
+	client     *http.Client
+	interval   time.Duration
+	ramps      []*canaryRamp
+	logger     logger.Logger
+	scores     *metrics.GaugeVec
+	decisions  *metrics.CounterVec
+}
+
+// canaryRamp is the progress of a canary through its steps.
+type canaryRamp struct {
+	experiment    string
+	variant       string
+	baseline      string
+	steps         []float64
+	passScore     float64
+	marginalScore float64
+	metrics       []config.CanaryMetric
+
+	step  int
+	state string
+}
+
+// newCanaryAnalysis returns nil when canary analysis is not configured.
+func newCanaryAnalysis(cfg *config.Config, logger logger.Logger, registry *metrics.Registry) (*canaryAnalysis, error) {
+	analysis := cfg.CanaryAnalysis
+	if analysis == nil {
+		return nil, nil
+	}
+	prometheus, err := url.Parse(analysis.Prometheus)
+	if err != nil || (prometheus.Scheme != "http" && prometheus.Scheme != "https") || prometheus.Host == "" {
+		return nil, fmt.Errorf("%w: invalid prometheus URL %q", errInvalidCanaryAnalysis, analysis.Prometheus)
+	}
+	interval, err := parseCanaryDuration(analysis.Interval, defaultCanaryInterval)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseCanaryDuration(analysis.Timeout, defaultCanaryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(analysis.Canaries) == 0 {
+		return nil, fmt.Errorf("%w: no canaries", errInvalidCanaryAnalysis)
+	}
+
+	c := &canaryAnalysis{
+		prometheus: strings.TrimSuffix(analysis.Prometheus, "/"),
+		client:     &http.Client{Timeout: timeout},
+		interval:   interval,
+		logger:     logger,
+		scores: registry.Gauge("forklift_canary_score",
+			"Latest score of each canary variant, from 0 to 100.", "experiment", "variant"),
+		decisions: registry.Counter("forklift_canary_decisions_total",
+			"Number of canary analyses by decision: advance, hold, promote or rollback.", "experiment", "variant", "decision"),
+	}
+	seen := make(map[string]bool)
+	for _, canary := range analysis.Canaries {
+		if seen[canary.Experiment] {
+			return nil, fmt.Errorf("%w: %s has several canaries", errInvalidCanaryAnalysis, canary.Experiment)
+		}
+		seen[canary.Experiment] = true
+		if err := validateCanary(canary, cfg.Rules); err != nil {
+			return nil, err
+		}
+		ramp := &canaryRamp{
+			experiment:    canary.Experiment,
+			variant:       canary.Canary,
+			baseline:      canary.Baseline,
+			steps:         canary.Steps,
+			passScore:     canary.PassScore,
+			marginalScore: canary.MarginalScore,
+			metrics:       canary.Metrics,
+			state:         canaryRamping,
+		}
+		if ramp.passScore == 0 {
+			ramp.passScore = defaultCanaryPassScore
+		}
+		if ramp.marginalScore == 0 {
+			ramp.marginalScore = defaultCanaryMarginalScore
+		}
+		if ramp.marginalScore > ramp.passScore {
+			return nil, fmt.Errorf("%w: %s: marginal score above pass score", errInvalidCanaryAnalysis, canary.Experiment)
+		}
+		c.ramps = append(c.ramps, ramp)
+	}
+	return c, nil
+}
+
+func parseCanaryDuration(value string, defaultDuration time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultDuration, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: duration %s", errInvalidCanaryAnalysis, value)
+	}
+	return d, nil
+}
+
+// validateCanary checks that the canary's variants are in the rules, and its steps and metrics.
+func validateCanary(canary config.Canary, rules []RoutingRule) error {
+	if canary.Canary == "" || canary.Baseline == "" || canary.Canary == canary.Baseline {
+		return fmt.Errorf("%w: %s needs distinct canary and baseline variants", errInvalidCanaryAnalysis, canary.Experiment)
+	}
+	for _, variant := range []string{canary.Canary, canary.Baseline} {
+		if !hasVariant(rules, canary.Experiment, variant) {
+			return fmt.Errorf("%w: unknown variant %s/%s", errInvalidCanaryAnalysis, canary.Experiment, variant)
+		}
+	}
+	if len(canary.Steps) == 0 {
+		return fmt.Errorf("%w: %s has no steps", errInvalidCanaryAnalysis, canary.Experiment)
+	}
+	previous := 0.0
+	for _, step := range canary.Steps {
+		if step <= previous || step > maxPercentage {
+			return fmt.Errorf("%w: %s: steps must increase up to 100", errInvalidCanaryAnalysis, canary.Experiment)
+		}
+		previous = step
+	}
+	if canary.PassScore < 0 || canary.PassScore > 100 || canary.MarginalScore < 0 || canary.MarginalScore > 100 {
+		return fmt.Errorf("%w: %s: scores must be between 0 and 100", errInvalidCanaryAnalysis, canary.Experiment)
+	}
+	if len(canary.Metrics) == 0 {
+		return fmt.Errorf("%w: %s has no metrics", errInvalidCanaryAnalysis, canary.Experiment)
+	}
+	for _, metric := range canary.Metrics {
+		if metric.Query == "" {
+			return fmt.Errorf("%w: %s: metric %s has no query", errInvalidCanaryAnalysis, canary.Experiment, metric.Name)
+		}
+		switch strings.ToLower(metric.Direction) {
+		case "", canaryIncrease, canaryDecrease, canaryEither:
+		default:
+			return fmt.Errorf("%w: %s: unknown direction %q", errInvalidCanaryAnalysis, canary.Experiment, metric.Direction)
+		}
+		if metric.Tolerance < 0 || metric.Weight < 0 {
+			return fmt.Errorf("%w: %s: metric %s has a negative tolerance or weight", errInvalidCanaryAnalysis, canary.Experiment, metric.Name)
+		}
+	}
+	return nil
+}
+
+func hasVariant(rules []RoutingRule, experiment, variant string) bool {
+	for _, rule := range rules {
+		if rule.Experiment == experiment && rule.Variant == variant {
+			return true
+		}
+	}
+	return false
+}
+
+// apply promotes each canary to the percentage of its step, or the baseline to all traffic once
+// the canary is rolled back.
+func (c *canaryAnalysis) apply(cfg *config.Config) error {
+	for _, ramp := range c.ramps {
+		var err error
+		if ramp.state == canaryRolledBack {
+			err = cfg.PromoteVariant(ramp.experiment, ramp.baseline, maxPercentage)
+		} else {
+			err = cfg.PromoteVariant(ramp.experiment, ramp.variant, ramp.steps[ramp.step])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// analyzeCanaries scores the canaries every interval until the middleware shuts down.
+func (a *Forklift) analyzeCanaries() {
+	go func() {
+		ticker := time.NewTicker(a.canary.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.analyzeCanaryRound(context.Background())
+			case <-a.lifecycle.done:
+				return
+			}
+		}
+	}()
+}
+
+// analyzeCanaryRound scores the canaries still ramping, and applies the steps they advanced or
+// rolled back to. With leader election, only the leader analyzes, and publishes the steps.
+func (a *Forklift) analyzeCanaryRound(ctx context.Context) {
+	if a.leader != nil {
+		if !a.leader.leading.Load() {
+			return
+		}
+		defer a.publishCanaries(ctx)
+	}
+	c := a.canary
+	scores := make([]float64, len(c.ramps))
+	scored := make([]bool, len(c.ramps))
+	for i, ramp := range c.ramps {
+		if ramp.state == canaryRamping {
+			scores[i], scored[i] = c.score(ctx, ramp)
+		}
+	}
+
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	changed := false
+	for i, ramp := range c.ramps {
+		if !scored[i] {
+			continue
+		}
+		score := scores[i]
+		c.scores.Set(score, ramp.experiment, ramp.variant)
+		var decision string
+		switch {
+		case score >= ramp.passScore && ramp.step == len(ramp.steps)-1:
+			decision = "promote"
+			ramp.state = canaryPromoted
+		case score >= ramp.passScore:
+			decision = "advance"
+			ramp.step++
+			changed = true
+		case score < ramp.marginalScore:
+			decision = "rollback"
+			ramp.state = canaryRolledBack
+			changed = true
+		default:
+			decision = "hold"
+		}
+		c.decisions.Inc(ramp.experiment, ramp.variant, decision)
+		a.logger.Infof("Canary %s/%s scored %.1f: %s at %g%%", ramp.experiment, ramp.variant, score, decision, c.percentage(ramp))
+	}
+	if !changed {
+		return
+	}
+	if err := a.applyRules(a.source.rules); err != nil {
+		a.logger.Errorf("Error applying canary steps: %v", err)
+	}
+}
+
+// states returns the progress of the canaries by experiment. The rule source must be locked.
+func (c *canaryAnalysis) states() map[string]canaryState {
+	states := make(map[string]canaryState, len(c.ramps))
+	for _, ramp := range c.ramps {
+		states[ramp.experiment] = canaryState{Variant: ramp.variant, Step: ramp.step, State: ramp.state}
+	}
+	return states
+}
+
+// adopt sets the progress of the canaries to the published states, skipping states of other
+// canaries or steps, e.g. published by instances with another configuration. It reports whether
+// any step changed. The rule source must be locked.
+func (c *canaryAnalysis) adopt(states map[string]canaryState) bool {
+	changed := false
+	for _, ramp := range c.ramps {
+		state, ok := states[ramp.experiment]
+		if !ok || state.Variant != ramp.variant || state.Step < 0 || state.Step >= len(ramp.steps) {
+			continue
+		}
+		switch state.State {
+		case canaryRamping, canaryPromoted, canaryRolledBack:
+		default:
+			continue
+		}
+		if state.Step != ramp.step || state.State != ramp.state {
+			ramp.step, ramp.state = state.Step, state.State
+			changed = true
+		}
+	}
+	return changed
+}
+
+// percentage returns the percentage of traffic the ramp's canary is at.
+func (c *canaryAnalysis) percentage(ramp *canaryRamp) float64 {
+	if ramp.state == canaryRolledBack {
+		return 0
+	}
+	return ramp.steps[ramp.step]
+}
+
+// score returns the weighted percentage of the ramp's metrics within tolerance of the baseline.
+// Metrics without data for either variant are left out. It reports false when no metric could be
+// compared.
+func (c *canaryAnalysis) score(ctx context.Context, ramp *canaryRamp) (float64, bool) {
+	var total, passed float64
+	for _, metric := range ramp.metrics {
+		canary, ok, err := c.query(ctx, metric.Query, ramp.experiment, ramp.variant)
+		if err != nil {
+			c.logger.Errorf("Error querying %s of canary %s/%s: %v", metric.Name, ramp.experiment, ramp.variant, err)
+			return 0, false
+		}
+		if !ok {
+			continue
+		}
+		baseline, ok, err := c.query(ctx, metric.Query, ramp.experiment, ramp.baseline)
+		if err != nil {
+			c.logger.Errorf("Error querying %s of baseline %s/%s: %v", metric.Name, ramp.experiment, ramp.baseline, err)
+			return 0, false
+		}
+		if !ok {
+			continue
+		}
+		weight := metric.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		total += weight
+		if withinTolerance(canary, baseline, metric) {
+			passed += weight
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return passed / total * 100, true
+}
+
+// withinTolerance reports whether the canary's value doesn't deviate from the baseline's by more
+// than the metric's tolerance in its failing direction.
+func withinTolerance(canary, baseline float64, metric config.CanaryMetric) bool {
+	tolerance := metric.Tolerance
+	if tolerance == 0 {
+		tolerance = defaultCanaryTolerance
+	}
+	limit := math.Abs(baseline) * tolerance
+	deviation := canary - baseline
+	switch strings.ToLower(metric.Direction) {
+	case canaryDecrease:
+		return -deviation <= limit
+	case canaryEither:
+		return math.Abs(deviation) <= limit
+	default:
+		return deviation <= limit
+	}
+}
+
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// query runs an instant query for the variant and returns its value, the first sample of a
+// vector or a scalar. It reports false when the query returned no data.
+func (c *canaryAnalysis) query(ctx context.Context, query, experiment, variant string) (float64, bool, error) {
+	query = strings.NewReplacer("{experiment}", experiment, "{variant}", variant).Replace(query)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		c.prometheus+"/api/v1/query?query="+url.QueryEscape(query), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var body prometheusResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPrometheusResponseSize)).Decode(&body); err != nil {
+		return 0, false, fmt.Errorf("%w: status %d", errPrometheusQuery, resp.StatusCode)
+	}
+	if body.Status != "success" {
+		return 0, false, fmt.Errorf("%w: %s", errPrometheusQuery, body.Error)
+	}
+
+	var sample []interface{}
+	switch body.Data.ResultType {
+	case "scalar":
+		if err := json.Unmarshal(body.Data.Result, &sample); err != nil {
+			return 0, false, fmt.Errorf("%w: %v", errPrometheusQuery, err)
+		}
+	case "vector":
+		var vector []struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(body.Data.Result, &vector); err != nil {
+			return 0, false, fmt.Errorf("%w: %v", errPrometheusQuery, err)
+		}
+		if len(vector) == 0 {
+			return 0, false, nil
+		}
+		sample = vector[0].Value
+	default:
+		return 0, false, fmt.Errorf("%w: unsupported result type %q", errPrometheusQuery, body.Data.ResultType)
+	}
+	if len(sample) != 2 {
+		return 0, false, fmt.Errorf("%w: malformed sample", errPrometheusQuery)
+	}
+	text, _ := sample[1].(string)
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("%w: invalid value %q", errPrometheusQuery, text)
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, nil
+	}
+	return value, true, nil
+}
@@ -0,0 +1,231 @@
+package forklift
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidChurn = errors.New("invalid churn monitoring")
+
+const (
+	defaultChurnWindow       = 5 * time.Minute
+	defaultChurnThreshold    = 1.0
+	defaultChurnMinReturning = 100
+	churnWebhookTimeout      = 5 * time.Second
+	// maxChurnIdentities bounds the variants remembered by identity. They are all forgotten
+	// when it is reached.
+	maxChurnIdentities = 100000
+)
+
+// churnMonitor watches the variants identities are routed to, and raises an alert when too many
+// of the requests of identities seen before get a different variant than their previous request
+// over a window. It is shared by the middleware and the copies created for each rule change.
+type churnMonitor struct {
+	name         string
+	source       string
+	window       time.Duration
+	threshold    float64
+	minReturning int
+	webhookURL   string
+	client       *http.Client
+	logger       logger.Logger
+
+	changes *metrics.CounterVec
+	churn   *metrics.GaugeVec
+	alerts  *metrics.CounterVec
+
+	mu sync.Mutex
+	// variants holds the last variant of each identity, by identity and experiment or path.
+	variants    map[string]string
+	windowStart time.Time
+	returning   int
+	changed     int
+	// changedBy counts the changes of the window by experiment, or path for rules without one.
+	changedBy map[string]int
+}
+
+// churnAlert is the body of the alerts POSTed to the webhook.
+type churnAlert struct {
+	Middleware  string         `json:"middleware"`
+	Start       time.Time      `json:"start"`
+	End         time.Time      `json:"end"`
+	Returning   int            `json:"returning"`
+	Changed     int            `json:"changed"`
+	Percentage  float64        `json:"percentage"`
+	Threshold   float64        `json:"threshold"`
+	Experiments map[string]int `json:"experiments"`
+}
+
+// newChurnMonitor returns nil when churn is not monitored.
+func newChurnMonitor(cfg *config.Config, name string, logger logger.Logger, registry *metrics.Registry) (*churnMonitor, error) {
+	churn := cfg.Churn
+	if churn == nil {
+		return nil, nil
+	}
+	if kind, _, _ := strings.Cut(churn.Source, ":"); churn.Source != "" &&
+		(!validFlagSource(churn.Source) || kind != "header" && kind != "cookie" && kind != "query") {
+		return nil, fmt.Errorf("%w: unknown source %q", errInvalidChurn, churn.Source)
+	}
+	window := defaultChurnWindow
+	if churn.Window != "" {
+		var err error
+		if window, err = time.ParseDuration(churn.Window); err != nil || window <= 0 {
+			return nil, fmt.Errorf("%w: window %q", errInvalidChurn, churn.Window)
+		}
+	}
+	if churn.Threshold < 0 || churn.Threshold > 100 {
+		return nil, fmt.Errorf("%w: threshold must be a percentage", errInvalidChurn)
+	}
+	threshold := churn.Threshold
+	if threshold == 0 {
+		threshold = defaultChurnThreshold
+	}
+	if churn.MinReturning < 0 {
+		return nil, fmt.Errorf("%w: minReturning must be positive", errInvalidChurn)
+	}
+	minReturning := churn.MinReturning
+	if minReturning == 0 {
+		minReturning = defaultChurnMinReturning
+	}
+	if churn.WebhookURL != "" {
+		if u, err := url.Parse(churn.WebhookURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("%w: webhook URL %q", errInvalidChurn, churn.WebhookURL)
+		}
+	}
+
+	return &churnMonitor{
+		name:         name,
+		source:       churn.Source,
+		window:       window,
+		threshold:    threshold,
+		minReturning: minReturning,
+		webhookURL:   churn.WebhookURL,
+		client:       &http.Client{Timeout: churnWebhookTimeout},
+		logger:       logger,
+		changes: registry.Counter("forklift_assignment_changes_total",
+			"Number of requests routed to a different variant than the previous request of their identity, by experiment or path.", "experiment"),
+		churn: registry.Gauge("forklift_assignment_churn_percent",
+			"Percentage of the requests of returning identities that changed variants over the last churn window."),
+		alerts: registry.Counter("forklift_assignment_churn_alerts_total",
+			"Number of churn windows over the churn threshold."),
+		variants:  make(map[string]string),
+		changedBy: make(map[string]int),
+	}, nil
+}
+
+// record records the variant a request was routed to. Only percentage splits and flags assign
+// variants; other requests only move the window along.
+func (c *churnMonitor) record(req *http.Request, sessionID string, selected SelectedBackend, now time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(now)
+
+	rule := selected.Rule
+	if rule == nil || selected.Reason != reasonSplit && selected.Reason != reasonFlag {
+		return
+	}
+	identity := sessionID
+	if c.source != "" {
+		if value := flagSourceValue(req, c.source); value != "" {
+			identity = value
+		}
+	}
+	label, key, variant := rulePathKey(rule), "path:"+rulePathKey(rule), selected.Backend
+	if rule.Experiment != "" {
+		label, key, variant = rule.Experiment, "experiment:"+rule.Experiment, rule.Variant
+		if selected.Variant != "" {
+			variant = selected.Variant
+		}
+	}
+	key = identity + "\xff" + key
+
+	previous, seen := c.variants[key]
+	if seen {
+		c.returning++
+		if previous != variant {
+			c.changed++
+			c.changedBy[label]++
+			c.changes.Inc(label)
+		}
+	} else if len(c.variants) >= maxChurnIdentities {
+		c.variants = make(map[string]string)
+	}
+	c.variants[key] = variant
+}
+
+// rotate ends the window once it is over, alerting if its churn is over the threshold.
+func (c *churnMonitor) rotate(now time.Time) {
+	if c.windowStart.IsZero() {
+		c.windowStart = now
+		return
+	}
+	if now.Sub(c.windowStart) < c.window {
+		return
+	}
+	var percentage float64
+	if c.returning > 0 {
+		percentage = float64(c.changed) * 100 / float64(c.returning)
+	}
+	c.churn.Set(percentage)
+	if c.returning >= c.minReturning && percentage > c.threshold {
+		c.alerts.Inc()
+		c.logger.Warnf("Assignment churn of %.2f%% over the %.2f%% threshold: %d of %d requests of returning identities changed variants since %s",
+			percentage, c.threshold, c.changed, c.returning, c.windowStart.Format(time.RFC3339))
+		if c.webhookURL != "" {
+			go c.notify(churnAlert{
+				Middleware:  c.name,
+				Start:       c.windowStart,
+				End:         now,
+				Returning:   c.returning,
+				Changed:     c.changed,
+				Percentage:  percentage,
+				Threshold:   c.threshold,
+				Experiments: c.changedBy,
+			})
+		}
+	}
+	c.windowStart = now
+	c.returning, c.changed = 0, 0
+	c.changedBy = make(map[string]int)
+}
+
+// notify POSTs an alert to the webhook.
+func (c *churnMonitor) notify(alert churnAlert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		c.logger.Errorf("Error encoding churn alert: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), churnWebhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		c.logger.Errorf("Error creating churn alert: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.logger.Errorf("Error sending churn alert: %v", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		c.logger.Errorf("Error sending churn alert: %s", resp.Status)
+	}
+}
@@ -0,0 +1,145 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var errUnknownClientHint = errors.New("unknown client hint")
+
+// clientHint reads a client hint from the first of its headers the request carries.
+type clientHint struct {
+	headers []string
+	// value normalizes the raw header value, if set.
+	value func(raw string) string
+}
+
+// clientHints are the hints clientHint conditions match on, by lowercased parameter. Besides the
+// low entropy Sec-CH-UA hints and Save-Data, browsers only send hints a site asked for with
+// Accept-CH.
+var clientHints = map[string]clientHint{
+	"brand":        {headers: []string{"Sec-CH-UA"}},
+	"mobile":       {headers: []string{"Sec-CH-UA-Mobile"}, value: structuredBoolean},
+	"platform":     {headers: []string{"Sec-CH-UA-Platform"}, value: unquoteHint},
+	"model":        {headers: []string{"Sec-CH-UA-Model"}, value: unquoteHint},
+	"savedata":     {headers: []string{"Save-Data"}, value: saveData},
+	"devicememory": {headers: []string{"Sec-CH-Device-Memory", "Device-Memory"}},
+	"ect":          {headers: []string{"ECT"}},
+	"rtt":          {headers: []string{"RTT"}},
+	"downlink":     {headers: []string{"Downlink"}},
+}
+
+// validateClientHintConditions checks that clientHint conditions reference known hints.
+func validateClientHintConditions(rules []RoutingRule) error {
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "clientHint") {
+				continue
+			}
+			if _, ok := clientHints[strings.ToLower(condition.Parameter)]; !ok {
+				return fmt.Errorf("%w: %s", errUnknownClientHint, condition.Parameter)
+			}
+		}
+	}
+	return nil
+}
+
+// acceptClientHints returns the Accept-CH header asking browsers for the hints the rules match
+// on, or "" if they match on none.
+func acceptClientHints(rules []RoutingRule) string {
+	var headers []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "clientHint") {
+				continue
+			}
+			for _, header := range clientHints[strings.ToLower(condition.Parameter)].headers {
+				if !seen[header] {
+					seen[header] = true
+					headers = append(headers, header)
+				}
+			}
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+// checkClientHint compares a client hint with the condition value, case-insensitively. Requests
+// without the hint don't match, whatever the operator. Brands match if any brand of Sec-CH-UA
+// does.
+func (re *RuleEngine) checkClientHint(req *http.Request, condition RuleCondition) bool {
+	name := strings.ToLower(condition.Parameter)
+	hint, ok := clientHints[name]
+	if !ok {
+		re.logger.Warnf("Unknown client hint: %s", condition.Parameter)
+		return false
+	}
+	raw := ""
+	for _, header := range hint.headers {
+		if raw = strings.TrimSpace(req.Header.Get(header)); raw != "" {
+			break
+		}
+	}
+	values := []string{raw}
+	switch {
+	case name == "brand":
+		values = uaBrands(raw)
+	case hint.value != nil:
+		values[0] = hint.value(raw)
+	}
+
+	expected := strings.ToLower(condition.Value)
+	result := false
+	for _, value := range values {
+		if value != "" && re.compareValues(strings.ToLower(value), condition.Operator, expected) {
+			result = true
+			break
+		}
+	}
+	if re.config.Debug {
+		re.logger.Debugf("Client hint %s %v %s %q: %v", condition.Parameter, values, condition.Operator, condition.Value, result)
+	}
+	return result
+}
+
+// uaBrands returns the brand names of a Sec-CH-UA list, e.g. `"Chromium";v="124", "Not-A.Brand";v="99"`.
+func uaBrands(raw string) []string {
+	var brands []string
+	for _, item := range strings.Split(raw, ",") {
+		brand, _, _ := strings.Cut(item, ";")
+		if brand = unquoteHint(strings.TrimSpace(brand)); brand != "" {
+			brands = append(brands, brand)
+		}
+	}
+	return brands
+}
+
+// unquoteHint returns the string of a structured header string item, e.g. "Android".
+func unquoteHint(raw string) string {
+	if unquoted, err := strconv.Unquote(raw); err == nil {
+		return unquoted
+	}
+	return raw
+}
+
+// structuredBoolean returns "true" or "false" for the structured header booleans ?1 and ?0.
+func structuredBoolean(raw string) string {
+	switch raw {
+	case "?1":
+		return "true"
+	case "?0":
+		return "false"
+	default:
+		return ""
+	}
+}
+
+// saveData returns "true" for Save-Data: on, and "false" otherwise, as browsers only send the
+// header when the user asked to save data.
+func saveData(raw string) string {
+	return strconv.FormatBool(strings.EqualFold(raw, "on"))
+}
@@ -0,0 +1,204 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/store"
+)
+
+var errInvalidClusterCounters = errors.New("invalid cluster counters")
+
+const (
+	defaultCounterFlushInterval = 10 * time.Second
+	counterKeyPrefix            = "forklift:counters:"
+)
+
+// clusterCounters counts the requests, errors and conversions of each experiment variant across
+// instances. Each instance counts locally, and adds its counts to counters in the session store
+// every interval, a hash per experiment, reading back the totals. It is shared by the middleware
+// and the copies created for each rule change.
+type clusterCounters struct {
+	counter  store.Counter
+	key      string
+	interval time.Duration
+	ttl      time.Duration
+	logger   logger.Logger
+	flushes  *metrics.CounterVec
+
+	mu sync.Mutex
+	// pending holds the increments not yet flushed, by experiment and field.
+	pending map[string]map[string]int64
+	// totals holds the cluster-wide totals read at the last flush, by experiment and field.
+	totals map[string]map[string]int64
+}
+
+// clusterVariantCounts are the totals of a variant across the cluster.
+type clusterVariantCounts struct {
+	Requests    int64            `json:"requests"`
+	Errors      int64            `json:"errors"`
+	Conversions map[string]int64 `json:"conversions,omitempty"`
+}
+
+// newClusterCounters returns nil when cluster counters are not configured.
+func newClusterCounters(cfg *config.Config, name string, sessionStore store.SessionStore, opts store.Options,
+	logger logger.Logger, registry *metrics.Registry,
+) (*clusterCounters, error) {
+	counters := cfg.ClusterCounters
+	if counters == nil {
+		return nil, nil
+	}
+	if sessionStore == nil {
+		return nil, fmt.Errorf("%w: requires a session store", errInvalidClusterCounters)
+	}
+	counter, ok := sessionStore.(store.Counter)
+	if !ok {
+		return nil, fmt.Errorf("%w: session store %s can't keep counters", errInvalidClusterCounters, cfg.SessionStore.Type)
+	}
+	interval := defaultCounterFlushInterval
+	if counters.FlushInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(counters.FlushInterval); err != nil || interval <= 0 {
+			return nil, fmt.Errorf("%w: flush interval %s", errInvalidClusterCounters, counters.FlushInterval)
+		}
+	}
+	key := counters.Key
+	if key == "" {
+		key = counterKeyPrefix + name
+	}
+
+	c := &clusterCounters{
+		counter:  counter,
+		key:      key,
+		interval: interval,
+		ttl:      opts.TTL,
+		logger:   logger,
+		flushes: registry.Counter("forklift_cluster_counter_flushes_total",
+			"Number of flushes of the cluster counters of an experiment by result: success or error.", "result"),
+		pending: make(map[string]map[string]int64),
+		totals:  make(map[string]map[string]int64),
+	}
+	// Read the totals of the configured experiments even before this instance serves them.
+	for _, rule := range cfg.Rules {
+		if rule.Experiment != "" {
+			c.add(rule.Experiment, "", 0)
+		}
+	}
+	return c, nil
+}
+
+func requestsField(variant string) string { return "requests:" + variant }
+
+func errorsField(variant string) string { return "errors:" + variant }
+
+func conversionsField(variant, goal string) string { return "conversions:" + goal + ":" + variant }
+
+// record counts a request served by an experiment variant.
+func (c *clusterCounters) record(hc *HookContext) {
+	if c == nil {
+		return
+	}
+	experiment, variant := exposureLabels(hc.Selected)
+	if experiment == "" {
+		return
+	}
+	c.add(experiment, requestsField(variant), 1)
+	if hc.Status >= http.StatusInternalServerError {
+		c.add(experiment, errorsField(variant), 1)
+	}
+}
+
+// convert counts a conversion to a goal attributed to an experiment variant.
+func (c *clusterCounters) convert(experiment, variant, goal string) {
+	if c == nil {
+		return
+	}
+	c.add(experiment, conversionsField(variant, goal), 1)
+}
+
+// add adds an increment to a field of an experiment's counters. An empty field only registers
+// the experiment, so its totals are read at each flush.
+func (c *clusterCounters) add(experiment, field string, increment int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fields := c.pending[experiment]
+	if fields == nil {
+		fields = make(map[string]int64)
+		c.pending[experiment] = fields
+	}
+	if field != "" {
+		fields[field] += increment
+	}
+}
+
+// flush adds the pending increments of each experiment to its counters and reads back their
+// totals. Increments that fail to be added are kept for the next flush.
+func (c *clusterCounters) flush(ctx context.Context) {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]map[string]int64, len(pending))
+	for experiment := range pending {
+		c.pending[experiment] = make(map[string]int64)
+	}
+	c.mu.Unlock()
+
+	for experiment, increments := range pending {
+		totals, err := c.counter.Count(ctx, c.key+":"+experiment, increments, c.ttl)
+		if err != nil {
+			c.logger.Errorf("Error flushing cluster counters of %s: %v", experiment, err)
+			c.flushes.Inc("error")
+			for field, increment := range increments {
+				c.add(experiment, field, increment)
+			}
+			continue
+		}
+		c.flushes.Inc("success")
+		c.mu.Lock()
+		c.totals[experiment] = totals
+		c.mu.Unlock()
+	}
+}
+
+// counts returns the totals of a variant at the last flush, with its conversions to goals.
+func (c *clusterCounters) counts(experiment, variant string, goals []config.Goal) *clusterVariantCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	totals := c.totals[experiment]
+	counts := &clusterVariantCounts{
+		Requests: totals[requestsField(variant)],
+		Errors:   totals[errorsField(variant)],
+	}
+	for _, goal := range goals {
+		if counts.Conversions == nil {
+			counts.Conversions = make(map[string]int64, len(goals))
+		}
+		counts.Conversions[goal.Name] = totals[conversionsField(variant, goal.Name)]
+	}
+	return counts
+}
+
+// flushClusterCounters flushes the cluster counters every interval until the middleware shuts
+// down, which flushes them one last time.
+func (a *Forklift) flushClusterCounters() {
+	go func() {
+		ticker := time.NewTicker(a.counters.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), a.counters.interval)
+				a.counters.flush(ctx)
+				cancel()
+			case <-a.lifecycle.done:
+				return
+			}
+		}
+	}()
+}
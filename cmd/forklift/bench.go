@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidCount = errors.New("invalid count: use a positive number with an optional k or m suffix")
+
+// benchResult collects the assignments and evaluation latencies of a bench run.
+type benchResult struct {
+	counts    map[string]map[string]int
+	latencies []time.Duration
+	allocated uint64
+	heap      uint64
+	elapsed   time.Duration
+}
+
+// runBench evaluates simulated requests against the rule engine in process and reports the
+// assignment distribution, evaluation latency and memory use.
+func runBench(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rules := flags.String("rules", "", "rules file to evaluate")
+	requests := flags.String("requests", "10k", "number of requests to simulate, e.g. 100k or 1m")
+	sessions := flags.String("sessions", "", "number of distinct sessions (defaults to one per request)")
+	paths := flags.String("paths", "", "comma-separated request paths (defaults to the paths of the rules)")
+	method := flags.String("method", http.MethodGet, "request method")
+	seed := flags.Int64("seed", 1, "seed for session IDs and path selection")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rules == "" {
+		return errMissingRules
+	}
+	total, err := parseCount(*requests)
+	if err != nil {
+		return err
+	}
+	sessionCount := total
+	if *sessions != "" {
+		if sessionCount, err = parseCount(*sessions); err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(*rules)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadConfig(string(data))
+	if err != nil {
+		return err
+	}
+	// Assignments are computed from the session hash only and the rules alone decide, so the bench
+	// never leaves the process.
+	cfg.SessionStore = nil
+	cfg.Decision = nil
+	cfg.Churn = nil
+
+	requestPaths := benchPaths(cfg, *paths)
+	engine, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "forklift-bench")
+	if err != nil {
+		return err
+	}
+
+	result := bench(engine, requestPaths, strings.ToUpper(*method), total, sessionCount, *seed)
+	return writeBenchReport(stdout, result, total)
+}
+
+func bench(engine *forklift.Forklift, paths []string, method string, total, sessionCount int, seed int64) benchResult {
+	rng := rand.New(rand.NewSource(seed))
+	sessionIDs := make([]string, sessionCount)
+	raw := make([]byte, 32)
+	for i := range sessionIDs {
+		_, _ = rng.Read(raw)
+		sessionIDs[i] = base64.URLEncoding.EncodeToString(raw)
+	}
+	requests := make([]*http.Request, len(paths))
+	for i, path := range paths {
+		requests[i] = httptest.NewRequest(method, path, nil)
+	}
+
+	result := benchResult{
+		counts:    make(map[string]map[string]int, len(paths)),
+		latencies: make([]time.Duration, total),
+	}
+	for _, path := range paths {
+		result.counts[path] = make(map[string]int)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := range total {
+		p := rng.Intn(len(paths))
+		evalStart := time.Now()
+		selected := engine.SelectBackend(requests[p], sessionIDs[i%sessionCount])
+		result.latencies[i] = time.Since(evalStart)
+		result.counts[paths[p]][assignmentLabel(selected)]++
+	}
+	result.elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	result.allocated = after.TotalAlloc - before.TotalAlloc
+	result.heap = after.HeapInuse
+
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result
+}
+
+// benchPaths returns the requested paths, or one path per distinct rule path.
+func benchPaths(cfg *config.Config, paths string) []string {
+	if paths != "" {
+		return strings.Split(paths, ",")
+	}
+	seen := map[string]bool{}
+	var result []string
+	for _, rule := range cfg.Rules {
+		path := rule.Path
+		if path == "" {
+			path = rule.PathPrefix
+		}
+		if path == "" {
+			path = "/"
+		}
+		if !seen[path] {
+			seen[path] = true
+			result = append(result, path)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, "/")
+	}
+	return result
+}
+
+func assignmentLabel(selected forklift.SelectedBackend) string {
+	if selected.Rule == nil {
+		return "default"
+	}
+	if selected.Rule.Experiment != "" && selected.Rule.Variant != "" {
+		return selected.Rule.Experiment + "/" + selected.Rule.Variant
+	}
+	return selected.Backend
+}
+
+func writeBenchReport(stdout io.Writer, result benchResult, total int) error {
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tASSIGNMENT\tREQUESTS\tSHARE")
+	paths := make([]string, 0, len(result.counts))
+	for path := range result.counts {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		counts := result.counts[path]
+		pathTotal := 0
+		labels := make([]string, 0, len(counts))
+		for label, count := range counts {
+			labels = append(labels, label)
+			pathTotal += count
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			share := float64(counts[label]) / float64(pathTotal) * 100
+			fmt.Fprintf(w, "%s\t%s\t%d\t%.2f%%\n", path, label, counts[label], share)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "\n%d requests in %s (%.0f req/s)\n", total, result.elapsed.Round(time.Millisecond),
+		float64(total)/result.elapsed.Seconds())
+	fmt.Fprintf(stdout, "evaluation latency: p50 %s  p90 %s  p99 %s  max %s\n",
+		percentile(result.latencies, 50), percentile(result.latencies, 90),
+		percentile(result.latencies, 99), result.latencies[len(result.latencies)-1])
+	fmt.Fprintf(stdout, "memory: %d B allocated per request, %.1f MiB heap in use\n",
+		result.allocated/uint64(total), float64(result.heap)/(1<<20))
+	return nil
+}
+
+// percentile returns the p-th percentile of sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := len(sorted) * p / 100
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// parseCount parses counts such as 500, 100k or 1m.
+func parseCount(s string) (int, error) {
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(strings.ToLower(s), "k"):
+		multiplier, s = 1000, s[:len(s)-1]
+	case strings.HasSuffix(strings.ToLower(s), "m"):
+		multiplier, s = 1000000, s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%w: %s", errInvalidCount, s)
+	}
+	return n * multiplier, nil
+}
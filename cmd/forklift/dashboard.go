@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const (
+	dashboardPanelHeight = 8
+	dashboardPanelWidth  = 8
+	dashboardGridWidth   = 24
+)
+
+// grafanaPanel is the subset of Grafana's panel model the generated dashboards use.
+type grafanaPanel struct {
+	ID          int                    `json:"id"`
+	Type        string                 `json:"type"`
+	Title       string                 `json:"title"`
+	GridPos     grafanaGridPos         `json:"gridPos"`
+	Datasource  *grafanaDatasource     `json:"datasource,omitempty"`
+	Targets     []grafanaTarget        `json:"targets,omitempty"`
+	FieldConfig map[string]interface{} `json:"fieldConfig,omitempty"`
+	Collapsed   *bool                  `json:"collapsed,omitempty"`
+	Panels      []grafanaPanel         `json:"panels,omitempty"`
+}
+
+type grafanaGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// runDashboard prints a Grafana dashboard for the experiments of a rules file: a row per
+// experiment with its traffic distribution, error rate and latency per variant, below a panel
+// of the requests in flight per rule.
+func runDashboard(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rules := flags.String("rules", "", "rules file to generate the dashboard for")
+	title := flags.String("title", "Forklift experiments", "dashboard title")
+	uid := flags.String("uid", "forklift-experiments", "dashboard UID, kept stable so imports replace the previous version")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rules == "" {
+		return errMissingRules
+	}
+	cfg, err := config.LoadFile(*rules)
+	if err != nil {
+		return err
+	}
+
+	dashboard := map[string]interface{}{
+		"uid":           *uid,
+		"title":         *title,
+		"tags":          []string{"forklift"},
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": dashboardPanels(experiments(cfg.Rules)),
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dashboard)
+}
+
+// experiments returns the experiment names of the rules, including flags, in sorted order.
+func experiments(rules []config.RoutingRule) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, rule := range rules {
+		name := rule.Experiment
+		if name == "" && rule.Flag != nil {
+			name = rule.Flag.Name
+		}
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func dashboardPanels(experiments []string) []grafanaPanel {
+	datasource := &grafanaDatasource{Type: "prometheus", UID: "${datasource}"}
+	id := 0
+	nextID := func() int {
+		id++
+		return id
+	}
+
+	panels := []grafanaPanel{{
+		ID:         nextID(),
+		Type:       "timeseries",
+		Title:      "Requests in flight per rule",
+		GridPos:    grafanaGridPos{W: dashboardGridWidth, H: dashboardPanelHeight},
+		Datasource: datasource,
+		Targets:    []grafanaTarget{{RefID: "A", Expr: "sum by (rule) (forklift_rule_in_flight)", LegendFormat: "{{rule}}"}},
+	}}
+	y := dashboardPanelHeight
+
+	for _, experiment := range experiments {
+		selector := fmt.Sprintf(`experiment="%s"`, escapePromQL(experiment))
+		requests := fmt.Sprintf("sum by (variant) (rate(forklift_variant_requests_total{%s}[$__rate_interval]))", selector)
+		collapsed := false
+		panels = append(panels, grafanaPanel{
+			ID:        nextID(),
+			Type:      "row",
+			Title:     "Experiment: " + experiment,
+			GridPos:   grafanaGridPos{Y: y, W: dashboardGridWidth, H: 1},
+			Collapsed: &collapsed,
+		})
+		y++
+
+		panels = append(panels,
+			grafanaPanel{
+				ID:         nextID(),
+				Type:       "timeseries",
+				Title:      experiment + ": traffic distribution",
+				GridPos:    grafanaGridPos{X: 0, Y: y, W: dashboardPanelWidth, H: dashboardPanelHeight},
+				Datasource: datasource,
+				Targets:    []grafanaTarget{{RefID: "A", Expr: requests, LegendFormat: "{{variant}}"}},
+				FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{
+					"custom": map[string]interface{}{"stacking": map[string]string{"mode": "percent"}, "fillOpacity": 60},
+				}},
+			},
+			grafanaPanel{
+				ID:         nextID(),
+				Type:       "timeseries",
+				Title:      experiment + ": error rate",
+				GridPos:    grafanaGridPos{X: dashboardPanelWidth, Y: y, W: dashboardPanelWidth, H: dashboardPanelHeight},
+				Datasource: datasource,
+				Targets: []grafanaTarget{{
+					RefID: "A",
+					Expr: fmt.Sprintf(`sum by (variant) (rate(forklift_variant_requests_total{%s,code="5xx"}[$__rate_interval])) / %s`,
+						selector, requests),
+					LegendFormat: "{{variant}}",
+				}},
+				FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{"unit": "percentunit"}},
+			},
+			grafanaPanel{
+				ID:         nextID(),
+				Type:       "timeseries",
+				Title:      experiment + ": latency",
+				GridPos:    grafanaGridPos{X: 2 * dashboardPanelWidth, Y: y, W: dashboardPanelWidth, H: dashboardPanelHeight},
+				Datasource: datasource,
+				Targets: []grafanaTarget{
+					{RefID: "A", Expr: latencyQuantile(0.5, selector), LegendFormat: "{{variant}} p50"},
+					{RefID: "B", Expr: latencyQuantile(0.95, selector), LegendFormat: "{{variant}} p95"},
+					{RefID: "C", Expr: latencyQuantile(0.99, selector), LegendFormat: "{{variant}} p99"},
+				},
+				FieldConfig: map[string]interface{}{"defaults": map[string]interface{}{"unit": "s"}},
+			},
+		)
+		y += dashboardPanelHeight
+	}
+	return panels
+}
+
+func latencyQuantile(quantile float64, selector string) string {
+	return fmt.Sprintf("histogram_quantile(%g, sum by (variant, le) (rate(forklift_variant_request_duration_seconds_bucket{%s}[$__rate_interval])))",
+		quantile, selector)
+}
+
+// escapePromQL escapes a label value for a double-quoted PromQL string.
+func escapePromQL(value string) string {
+	b, _ := json.Marshal(value)
+	return string(b[1 : len(b)-1])
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/events"
+)
+
+var (
+	errExperimentUsage = errors.New("usage: forklift experiment <promote|pause|resume|drain> <experiment> --file <rules.yaml> [--variant <variant> --to <percentage> --grace <duration>]")
+	errMissingFile     = errors.New("--file is required")
+	errMissingVariant  = errors.New("--variant is required")
+)
+
+const (
+	defaultAuditSubject = "forklift.audit.{action}.{experiment}"
+	auditTimeout        = 10 * time.Second
+)
+
+// auditEntry records a change made through the CLI.
+type auditEntry struct {
+	Time       time.Time `json:"time"`
+	User       string    `json:"user"`
+	Action     string    `json:"action"`
+	File       string    `json:"file"`
+	Experiment string    `json:"experiment"`
+	Variant    string    `json:"variant,omitempty"`
+	Percentage float64   `json:"percentage,omitempty"`
+	Grace      string    `json:"grace,omitempty"`
+}
+
+func runExperiment(command string, args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errExperimentUsage
+	}
+	experiment := args[0]
+
+	flags := flag.NewFlagSet("experiment "+command, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "rules file to update")
+	variant := flags.String("variant", "", "variant to promote or drain")
+	to := flags.Float64("to", 100, "percentage of traffic for the promoted variant")
+	grace := flags.Duration("grace", 24*time.Hour, "how long sessions already assigned to a drained variant keep it")
+	auditLog := flags.String("audit-log", "", "file to append audit entries to (defaults to stderr)")
+	auditNATS := flags.String("audit-nats", "", "NATS JetStream server to publish audit entries to, e.g. nats://localhost:4222")
+	auditSubject := flags.String("audit-subject", defaultAuditSubject, "subject template for audit entries published to NATS")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errMissingFile
+	}
+
+	cfg, err := config.LoadFile(*file)
+	if err != nil {
+		return err
+	}
+
+	entry := auditEntry{Action: command, File: *file, Experiment: experiment}
+	switch command {
+	case "promote":
+		if *variant == "" {
+			return errMissingVariant
+		}
+		err = cfg.PromoteVariant(experiment, *variant, *to)
+		entry.Variant = *variant
+		entry.Percentage = *to
+	case "drain":
+		if *variant == "" {
+			return errMissingVariant
+		}
+		err = cfg.DrainVariant(experiment, *variant, time.Now(), *grace)
+		entry.Variant = *variant
+		entry.Grace = grace.String()
+	case "pause":
+		err = cfg.SetExperimentPaused(experiment, true)
+	case "resume":
+		err = cfg.SetExperimentPaused(experiment, false)
+	default:
+		return errExperimentUsage
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.WriteFile(*file); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "%s %s: updated %s\n", command, experiment, *file)
+
+	entry.Time = time.Now().UTC()
+	entry.User = currentUser()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := writeAudit(data, *auditLog, stderr); err != nil {
+		return err
+	}
+	if *auditNATS != "" {
+		return publishAudit(entry, data, *auditNATS, *auditSubject)
+	}
+	return nil
+}
+
+// writeAudit appends an audit entry as a JSON line to the audit log, or to stderr if none is set.
+func writeAudit(data []byte, path string, stderr io.Writer) error {
+	data = append(data, '\n')
+
+	if path == "" {
+		_, err := stderr.Write(data)
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	_, err = f.Write(data)
+	return err
+}
+
+// publishAudit publishes an audit entry to NATS JetStream on the subject rendered from the
+// template's {action}, {experiment} and {variant} placeholders.
+func publishAudit(entry auditEntry, data []byte, server, subject string) error {
+	sink, err := events.NewNATSSink(server, os.Getenv("NATS_TOKEN"), subject)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+	defer cancel()
+	return sink.Publish(ctx, map[string]string{
+		"action":     entry.Action,
+		"experiment": entry.Experiment,
+		"variant":    entry.Variant,
+	}, data)
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,53 @@
+// Command forklift manages and tests rule files for the Forklift middleware and runs it as a
+// standalone reverse proxy.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	// The standalone proxy runs the scripts and WASM evaluators the Traefik plugin can't interpret.
+	_ "github.com/daemonp/forklift/luascript"
+	_ "github.com/daemonp/forklift/wasmcond"
+)
+
+var errUsage = errors.New("usage: forklift <rules|experiment|serve|bench|dashboard|test|simulate> [command] [arguments]")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "forklift: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run dispatches the command line to the matching command group.
+func run(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "serve":
+		return runServe(args[1:], stdout, stderr)
+	case "bench":
+		return runBench(args[1:], stdout, stderr)
+	case "dashboard":
+		return runDashboard(args[1:], stdout, stderr)
+	case "test":
+		return runTest(args[1:], stdout, stderr)
+	case "simulate":
+		return runSimulate(args[1:], stdout, stderr)
+	}
+	if len(args) < 2 {
+		return errUsage
+	}
+	switch args[0] {
+	case "rules":
+		return runRules(args[1], args[2:], stdout)
+	case "experiment":
+		return runExperiment(args[1], args[2:], stdout, stderr)
+	default:
+		return errUsage
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errRulesListUsage  = errors.New("usage: forklift rules list <file>")
+	errRulesDiffUsage  = errors.New("usage: forklift rules diff <old> <new>")
+	errRulesCheckUsage = errors.New("usage: forklift rules check <file>")
+	errRulesFindings   = errors.New("the analysis found likely mistakes")
+)
+
+func runRules(command string, args []string, stdout io.Writer) error {
+	switch command {
+	case "list":
+		if len(args) != 1 {
+			return errRulesListUsage
+		}
+		return listRules(args[0], stdout)
+	case "diff":
+		if len(args) != 2 {
+			return errRulesDiffUsage
+		}
+		return diffRules(args[0], args[1], stdout)
+	case "check":
+		if len(args) != 1 {
+			return errRulesCheckUsage
+		}
+		return checkRules(args[0], stdout)
+	default:
+		return errUsage
+	}
+}
+
+// listRules prints the rules of a configuration file as a table.
+func listRules(path string, stdout io.Writer) error {
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PRIORITY\tMETHOD\tPATH\tBACKEND\tPERCENTAGE\tEXPERIMENT\tVARIANT\tPAUSED")
+	for _, rule := range cfg.Rules {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n",
+			rule.Priority, orDash(rule.Method), orDash(rulePath(rule)), orDash(ruleTarget(rule)),
+			strconv.FormatFloat(rule.Percentage, 'f', -1, 64), orDash(rule.Experiment), orDash(rule.Variant), rule.Paused)
+	}
+	fmt.Fprintf(w, "default\t-\t-\t%s\t-\t-\t-\t-\n", orDash(cfg.DefaultBackend))
+	return w.Flush()
+}
+
+// diffRules prints the rule changes between two configuration files.
+func diffRules(oldPath, newPath string, stdout io.Writer) error {
+	oldCfg, err := config.LoadFile(oldPath)
+	if err != nil {
+		return err
+	}
+	newCfg, err := config.LoadFile(newPath)
+	if err != nil {
+		return err
+	}
+
+	if oldCfg.DefaultBackend != newCfg.DefaultBackend {
+		fmt.Fprintf(stdout, "~ defaultBackend: %s -> %s\n", oldCfg.DefaultBackend, newCfg.DefaultBackend)
+	}
+
+	changes, err := config.DiffRules(oldCfg.Rules, newCfg.Rules)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		switch change.Kind {
+		case config.RuleAdded:
+			fmt.Fprintf(stdout, "+ %s\n", change.Key)
+		case config.RuleRemoved:
+			fmt.Fprintf(stdout, "- %s\n", change.Key)
+		case config.RuleChanged:
+			fmt.Fprintf(stdout, "~ %s\n", change.Key)
+			for _, field := range change.Fields {
+				fmt.Fprintf(stdout, "    %s: %s -> %s\n", field.Name, orDash(field.Old), orDash(field.New))
+			}
+		}
+	}
+	return nil
+}
+
+// checkRules prints the findings of the analysis of a configuration file, failing if there are
+// any.
+func checkRules(path string, stdout io.Writer) error {
+	cfg, err := config.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := config.Migrate(cfg); err != nil {
+		return err
+	}
+
+	findings := config.Analyze(cfg)
+	if len(findings) == 0 {
+		fmt.Fprintln(stdout, "No findings")
+		return nil
+	}
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tRULE\tFINDING")
+	for _, finding := range findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", finding.Kind, orDash(finding.Rule), finding.Message)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return errRulesFindings
+}
+
+func rulePath(rule config.RoutingRule) string {
+	if rule.Path != "" {
+		return rule.Path
+	}
+	if rule.PathPrefix != "" {
+		return rule.PathPrefix + "*"
+	}
+	return ""
+}
+
+func ruleTarget(rule config.RoutingRule) string {
+	switch {
+	case rule.Static != nil:
+		return "static:" + strconv.Itoa(rule.Static.Status)
+	case rule.Redirect != nil:
+		return "redirect:" + rule.Redirect.Location
+	default:
+		return rule.Backend
+	}
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
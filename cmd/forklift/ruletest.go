@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errTestUsage        = errors.New("usage: forklift test <tests.yaml> [--rules <rules.yaml>]")
+	errNoRuleTests      = errors.New("no tests")
+	errTestsFailed      = errors.New("tests failed")
+	errMissingTestRules = errors.New("the tests file names no rules file: set rules or --rules")
+)
+
+// defaultTestSession is the session ID of requests whose test sets none, so percentage splits
+// assign them the same backend on every run.
+const defaultTestSession = "forklift-test"
+
+// ruleTests is a file of rule tests: requests given to the rules of a rules file, and the
+// assignment expected for each.
+type ruleTests struct {
+	Rules string     `yaml:"rules"`
+	Tests []ruleTest `yaml:"tests"`
+}
+
+type ruleTest struct {
+	Name   string       `yaml:"name"`
+	Given  givenRequest `yaml:"given"`
+	Expect expectation  `yaml:"expect"`
+}
+
+// givenRequest is the request of a rule test. Method defaults to GET, or POST with a form.
+type givenRequest struct {
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Cookies map[string]string `yaml:"cookies"`
+	Form    map[string]string `yaml:"form"`
+	Session string            `yaml:"session"`
+}
+
+// expectation is the assignment expected of a rule test. Empty fields are not checked; the
+// backend "default" is the default backend.
+type expectation struct {
+	Backend    string `yaml:"backend"`
+	Experiment string `yaml:"experiment"`
+	Variant    string `yaml:"variant"`
+	Reason     string `yaml:"reason"`
+}
+
+// runTest runs the rule tests of a tests file against its rules file in process, and fails if
+// any assignment differs from the expected one.
+func runTest(args []string, stdout, stderr io.Writer) error {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return errTestUsage
+	}
+	path := args[0]
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rules := flags.String("rules", "", "rules file to test (defaults to the rules of the tests file)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var tests ruleTests
+	if err := yaml.Unmarshal(data, &tests); err != nil {
+		return fmt.Errorf("reading %s: %w", path, err)
+	}
+	if len(tests.Tests) == 0 {
+		return fmt.Errorf("%s: %w", path, errNoRuleTests)
+	}
+	rulesPath := *rules
+	if rulesPath == "" {
+		if tests.Rules == "" {
+			return errMissingTestRules
+		}
+		// The rules file of a tests file is relative to it, so tests run from any directory.
+		rulesPath = tests.Rules
+		if !filepath.IsAbs(rulesPath) {
+			rulesPath = filepath.Join(filepath.Dir(path), rulesPath)
+		}
+	}
+
+	data, err = os.ReadFile(rulesPath)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadConfig(string(data))
+	if err != nil {
+		return err
+	}
+	// Assignments are computed from the session hash only and the rules alone decide, as for bench.
+	cfg.SessionStore = nil
+	cfg.Decision = nil
+	engine, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "forklift-test")
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for i, test := range tests.Tests {
+		name := test.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+		req, sessionID := test.Given.request()
+		if problems := test.Expect.check(engine.SelectBackend(req, sessionID), cfg.DefaultBackend); len(problems) > 0 {
+			failed++
+			fmt.Fprintf(stdout, "FAIL  %s\n", name)
+			for _, problem := range problems {
+				fmt.Fprintf(stdout, "      %s\n", problem)
+			}
+			continue
+		}
+		fmt.Fprintf(stdout, "ok    %s\n", name)
+	}
+	fmt.Fprintf(stdout, "%d passed, %d failed\n", len(tests.Tests)-failed, failed)
+	if failed > 0 {
+		return errTestsFailed
+	}
+	return nil
+}
+
+// request builds the request of a test, and returns it with its session ID.
+func (g givenRequest) request() (*http.Request, string) {
+	method := strings.ToUpper(g.Method)
+	if method == "" {
+		method = http.MethodGet
+		if len(g.Form) > 0 {
+			method = http.MethodPost
+		}
+	}
+	path := g.Path
+	if path == "" {
+		path = "/"
+	}
+
+	var body io.Reader
+	if len(g.Form) > 0 {
+		form := url.Values{}
+		for name, value := range g.Form {
+			form.Set(name, value)
+		}
+		body = strings.NewReader(form.Encode())
+	}
+	req := httptest.NewRequest(method, path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	for name, value := range g.Headers {
+		req.Header.Set(name, value)
+	}
+	names := make([]string, 0, len(g.Cookies))
+	for name := range g.Cookies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		req.AddCookie(&http.Cookie{Name: name, Value: g.Cookies[name]})
+	}
+
+	sessionID := g.Session
+	if sessionID == "" {
+		sessionID = defaultTestSession
+	}
+	return req, sessionID
+}
+
+// check compares a selection to the expectation, describing each difference.
+func (e expectation) check(selected forklift.SelectedBackend, defaultBackend string) []string {
+	var experiment, variant string
+	if selected.Rule != nil {
+		experiment, variant = selected.Rule.Experiment, selected.Rule.Variant
+	}
+	if variant == "" {
+		variant = selected.Variant
+	}
+	backend := e.Backend
+	if backend == "default" {
+		backend = defaultBackend
+	}
+
+	var problems []string
+	for _, field := range []struct{ name, expected, actual string }{
+		{"backend", backend, selected.Backend},
+		{"experiment", e.Experiment, experiment},
+		{"variant", e.Variant, variant},
+		{"reason", e.Reason, selected.Reason},
+	} {
+		if field.expected != "" && field.expected != field.actual {
+			problems = append(problems, fmt.Sprintf("expected %s %q, got %q", field.name, field.expected, field.actual))
+		}
+	}
+	return problems
+}
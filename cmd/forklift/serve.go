@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/fingerprint"
+)
+
+const readHeaderTimeout = 10 * time.Second
+
+var (
+	errMissingRules = errors.New("--rules is required")
+	errTLSFiles     = errors.New("--tls-cert and --tls-key must be given together")
+)
+
+// shutdowner is implemented by handlers that shut down gracefully, like the middleware.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// runServe runs the middleware as a standalone reverse proxy until it receives SIGINT or SIGTERM.
+func runServe(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	listen := flags.String("listen", ":8080", "address to listen on")
+	rules := flags.String("rules", "", "rules file to serve")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight requests and event flushes on shutdown")
+	certFile := flags.String("tls-cert", "", "certificate file to terminate TLS with")
+	keyFile := flags.String("tls-key", "", "private key file of the certificate")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rules == "" {
+		return errMissingRules
+	}
+	if (*certFile == "") != (*keyFile == "") {
+		return errTLSFiles
+	}
+
+	// The file is loaded like the middleware configuration, so configFile and the
+	// environment overrides work the same way as under Traefik.
+	data, err := os.ReadFile(*rules)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadConfig(string(data))
+	if err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if *certFile != "" {
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	handler, err := forklift.New(ctx, http.NotFoundHandler(), cfg, "forklift")
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "serving %s on %s\n", *rules, listener.Addr())
+	return serve(ctx, listener, tlsConfig, cfg.Fingerprint, handler, *shutdownTimeout)
+}
+
+// serve serves handler on listener until ctx is done, then shuts down gracefully. With a TLS
+// configuration, it terminates TLS and passes the fingerprints of clients to handler in the
+// headers of the fingerprint configuration.
+func serve(ctx context.Context, listener net.Listener, tlsConfig *tls.Config, fingerprints *config.Fingerprint,
+	handler http.Handler, shutdownTimeout time.Duration,
+) error {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(fingerprint.NewListener(listener), tlsConfig)
+		server.Handler = fingerprintHeaders(handler, fingerprints)
+		server.ConnContext = fingerprint.ConnContext
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	// The middleware flushes its events and session assignments once the requests are done.
+	if s, ok := handler.(shutdowner); ok {
+		if shutdownErr := s.Shutdown(shutdownCtx); err == nil {
+			err = shutdownErr
+		}
+	}
+	return err
+}
+
+// fingerprintHeaders sets the headers of the JA3 and JA4 fingerprints of the client's TLS
+// connection on requests, replacing any the client sent.
+func fingerprintHeaders(next http.Handler, fingerprints *config.Fingerprint) http.Handler {
+	ja3Header, ja4Header := fingerprints.Headers()
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Header.Del(ja3Header)
+		req.Header.Del(ja4Header)
+		if hello := fingerprint.FromRequest(req); hello != nil {
+			req.Header.Set(ja3Header, hello.JA3())
+			req.Header.Set(ja4Header, hello.JA4())
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
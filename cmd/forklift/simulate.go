@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errMissingProfiles = errors.New("--profiles is required")
+	errNoProfiles      = errors.New("no profiles with a positive weight")
+	errCohortWarnings  = errors.New("the simulation found targeting problems")
+)
+
+// userProfiles is a file of synthetic user profiles.
+type userProfiles struct {
+	Profiles []userProfile `yaml:"profiles"`
+}
+
+// userProfile describes the requests of a kind of user, with the fields of a rule test request.
+// Weight is the profile's share of the users, relative to the other profiles. Users of a profile
+// without a path request the paths of the rules.
+type userProfile struct {
+	Name         string  `yaml:"name"`
+	Weight       float64 `yaml:"weight"`
+	givenRequest `yaml:",inline"`
+}
+
+// simulation counts the users of each profile assigned to each rule.
+type simulation struct {
+	users    int
+	profiles map[string]int
+	rules    map[string]int
+}
+
+// runSimulate assigns synthetic users drawn from profiles to the rules of a rules file in process,
+// and reports the predicted size of each cohort, warning of rules no user reaches and of
+// experiments that assign every user to one variant.
+func runSimulate(args []string, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	rules := flags.String("rules", "", "rules file to simulate")
+	profilesPath := flags.String("profiles", "", "profiles file describing the synthetic users")
+	n := flags.String("n", "10k", "number of synthetic users, e.g. 100k or 1m")
+	seed := flags.Int64("seed", 1, "seed for profiles, session IDs and paths")
+	strict := flags.Bool("strict", false, "exit with an error if the simulation warns")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rules == "" {
+		return errMissingRules
+	}
+	if *profilesPath == "" {
+		return errMissingProfiles
+	}
+	total, err := parseCount(*n)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(*profilesPath)
+	if err != nil {
+		return err
+	}
+	var profiles userProfiles
+	if err := yaml.Unmarshal(data, &profiles); err != nil {
+		return fmt.Errorf("reading %s: %w", *profilesPath, err)
+	}
+	data, err = os.ReadFile(*rules)
+	if err != nil {
+		return err
+	}
+	cfg, err := config.LoadConfig(string(data))
+	if err != nil {
+		return err
+	}
+	// Assignments are computed from the session hash only and the rules alone decide, as for bench.
+	cfg.SessionStore = nil
+	cfg.Decision = nil
+	engine, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "forklift-simulate")
+	if err != nil {
+		return err
+	}
+
+	result, err := simulate(engine, profiles.Profiles, benchPaths(cfg, ""), total, *seed)
+	if err != nil {
+		return err
+	}
+	warnings := cohortWarnings(cfg.Rules, result)
+	if err := writeSimulationReport(stdout, cfg.Rules, result, warnings); err != nil {
+		return err
+	}
+	if *strict && len(warnings) > 0 {
+		return errCohortWarnings
+	}
+	return nil
+}
+
+func simulate(engine *forklift.Forklift, profiles []userProfile, paths []string, total int, seed int64) (simulation, error) {
+	var weights float64
+	for _, profile := range profiles {
+		if profile.Weight > 0 {
+			weights += profile.Weight
+		}
+	}
+	if weights == 0 {
+		return simulation{}, errNoProfiles
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	raw := make([]byte, 32)
+	result := simulation{users: total, profiles: map[string]int{}, rules: map[string]int{}}
+	for range total {
+		profile := pickProfile(profiles, rng.Float64()*weights)
+		given := profile.givenRequest
+		if given.Path == "" {
+			given.Path = paths[rng.Intn(len(paths))]
+		}
+		_, _ = rng.Read(raw)
+		given.Session = base64.URLEncoding.EncodeToString(raw)
+
+		req, sessionID := given.request()
+		selected := engine.SelectBackend(req, sessionID)
+		result.profiles[profile.Name]++
+		result.rules[cohortKey(selected)]++
+	}
+	return result, nil
+}
+
+// pickProfile returns the profile at a point of the cumulative weights.
+func pickProfile(profiles []userProfile, point float64) userProfile {
+	var last userProfile
+	for _, profile := range profiles {
+		if profile.Weight <= 0 {
+			continue
+		}
+		last = profile
+		if point < profile.Weight {
+			return profile
+		}
+		point -= profile.Weight
+	}
+	return last
+}
+
+// cohortKey identifies the rule that selected a backend, or the default backend.
+func cohortKey(selected forklift.SelectedBackend) string {
+	if selected.Rule == nil {
+		return "default"
+	}
+	return config.RuleKey(*selected.Rule)
+}
+
+// cohortWarnings reports the active rules no user reached, and the experiments with several
+// variants that assigned all their users to one.
+func cohortWarnings(rules []config.RoutingRule, result simulation) []string {
+	var warnings []string
+	variants := map[string][]string{}
+	var experiments []string
+	for _, rule := range rules {
+		if rule.Paused {
+			continue
+		}
+		key := config.RuleKey(rule)
+		if result.rules[key] == 0 {
+			warnings = append(warnings, fmt.Sprintf("rule %s matched no users", key))
+		}
+		if rule.Experiment != "" && rule.Variant != "" {
+			if variants[rule.Experiment] == nil {
+				experiments = append(experiments, rule.Experiment)
+			}
+			variants[rule.Experiment] = append(variants[rule.Experiment], key)
+		}
+	}
+	for _, experiment := range experiments {
+		keys := variants[experiment]
+		var assigned []string
+		users := 0
+		for _, key := range keys {
+			if result.rules[key] > 0 {
+				assigned = append(assigned, key)
+				users += result.rules[key]
+			}
+		}
+		if len(keys) > 1 && len(assigned) == 1 {
+			warnings = append(warnings, fmt.Sprintf("experiment %s assigned all %d of its users to %s", experiment, users, assigned[0]))
+		}
+	}
+	return warnings
+}
+
+func writeSimulationReport(stdout io.Writer, rules []config.RoutingRule, result simulation, warnings []string) error {
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tUSERS\tSHARE")
+	for _, name := range sortedKeys(result.profiles) {
+		writeCohort(w, name, result.profiles[name], result.users)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "RULE\tUSERS\tSHARE")
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		key := config.RuleKey(rule)
+		if !seen[key] {
+			seen[key] = true
+			writeCohort(w, key, result.rules[key], result.users)
+		}
+	}
+	writeCohort(w, "default", result.rules["default"], result.users)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for _, warning := range warnings {
+		fmt.Fprintf(stdout, "WARNING: %s\n", warning)
+	}
+	return nil
+}
+
+func writeCohort(w io.Writer, name string, users, total int) {
+	fmt.Fprintf(w, "%s\t%d\t%.2f%%\n", orDash(name), users, float64(users)*100/float64(total))
+}
+
+func sortedKeys(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
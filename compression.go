@@ -0,0 +1,241 @@
+package forklift
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidCompression = errors.New("invalid compression: minSize must not be negative and content types must be media types")
+
+const defaultCompressionMinSize = 1024
+
+// defaultCompressedTypes are the content types compressed when a rule lists none.
+var defaultCompressedTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// Content codings the middleware compresses with.
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// responseEncoder is a pooled gzip or Brotli writer.
+type responseEncoder interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var (
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} { return gzip.NewWriter(nil) },
+	}
+	brotliWriterPool = sync.Pool{
+		New: func() interface{} { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) },
+	}
+)
+
+// validateCompression checks the compression policies of the rules.
+func validateCompression(rules []RoutingRule) error {
+	for _, rule := range rules {
+		if rule.Compression == nil {
+			continue
+		}
+		if rule.Compression.MinSize < 0 {
+			return errInvalidCompression
+		}
+		for _, contentType := range rule.Compression.ContentTypes {
+			if _, _, err := mime.ParseMediaType(contentType); err != nil || !strings.Contains(contentType, "/") {
+				return errInvalidCompression
+			}
+		}
+	}
+	return nil
+}
+
+// acceptedEncoding returns the content coding the client prefers among br and gzip, by quality
+// value and then preferring br, or "" if it accepts neither.
+func acceptedEncoding(req *http.Request) string {
+	var brotliQuality, gzipQuality, anyQuality float64 = -1, -1, -1
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+			quality := 1.0
+			if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+				if weight, err := strconv.ParseFloat(q, 64); err == nil {
+					quality = weight
+				}
+			}
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case encodingBrotli:
+				brotliQuality = quality
+			case encodingGzip:
+				gzipQuality = quality
+			case "*":
+				anyQuality = quality
+			}
+		}
+	}
+	// Codings the header doesn't name are accepted with the quality of *.
+	if brotliQuality < 0 {
+		brotliQuality = anyQuality
+	}
+	if gzipQuality < 0 {
+		gzipQuality = anyQuality
+	}
+	switch {
+	case brotliQuality > 0 && brotliQuality >= gzipQuality:
+		return encodingBrotli
+	case gzipQuality > 0:
+		return encodingGzip
+	}
+	return ""
+}
+
+// compressedType reports whether responses of the content type are compressed.
+func compressedType(policy *config.Compression, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := policy.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressedTypes
+	}
+	for _, allowed := range types {
+		allowed = strings.ToLower(allowed)
+		if prefix, ok := strings.CutSuffix(allowed, "*"); (ok && strings.HasPrefix(mediaType, prefix)) || mediaType == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses the response of a backend with the coding the client prefers, br or
+// gzip. Responses whose length is unknown are buffered up to the minimum size to find out whether
+// they are large enough.
+type compressWriter struct {
+	http.ResponseWriter
+	req      *http.Request
+	policy   *config.Compression
+	minSize  int
+	encoding string
+
+	status      int
+	wroteHeader bool
+	buffering   bool
+	body        bytes.Buffer
+	encoder     responseEncoder
+}
+
+func newCompressWriter(rw http.ResponseWriter, req *http.Request, policy *config.Compression, encoding string) *compressWriter {
+	minSize := policy.MinSize
+	if minSize == 0 {
+		minSize = defaultCompressionMinSize
+	}
+	return &compressWriter{ResponseWriter: rw, req: req, policy: policy, minSize: minSize, encoding: encoding}
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if isInformational(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	w.wroteHeader = true
+
+	header := w.Header()
+	if status != http.StatusOK || w.req.Method == http.MethodHead || header.Get("Content-Encoding") != "" ||
+		!compressedType(w.policy, header.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	header.Add("Vary", "Accept-Encoding")
+	if length := header.Get("Content-Length"); length != "" {
+		if size, err := strconv.Atoi(length); err == nil && size < w.minSize {
+			w.ResponseWriter.WriteHeader(status)
+			return
+		}
+		w.compress()
+		return
+	}
+	w.buffering = true
+}
+
+// compress sends the headers of a compressed response and starts compressing the body.
+func (w *compressWriter) compress() {
+	header := w.Header()
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", w.encoding)
+	// The compressed body differs from the one a strong validator was computed for.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.encoder, _ = w.pool().Get().(responseEncoder)
+	w.encoder.Reset(w.ResponseWriter)
+}
+
+// pool returns the pool of writers of the coding of the response.
+func (w *compressWriter) pool() *sync.Pool {
+	if w.encoding == encodingBrotli {
+		return &brotliWriterPool
+	}
+	return &gzipWriterPool
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	if !w.buffering {
+		return w.ResponseWriter.Write(b)
+	}
+	w.body.Write(b)
+	if w.body.Len() < w.minSize {
+		return len(b), nil
+	}
+	w.buffering = false
+	w.compress()
+	if _, err := w.encoder.Write(w.body.Bytes()); err != nil {
+		return 0, err
+	}
+	w.body.Reset()
+	return len(b), nil
+}
+
+// finish sends a buffered body too small to be compressed, or completes the compressed body.
+func (w *compressWriter) finish() {
+	if w.buffering {
+		w.ResponseWriter.WriteHeader(w.status)
+		_, _ = w.ResponseWriter.Write(w.body.Bytes())
+		return
+	}
+	if w.encoder != nil {
+		_ = w.encoder.Close()
+		w.encoder.Reset(nil)
+		w.pool().Put(w.encoder)
+		w.encoder = nil
+	}
+}
@@ -0,0 +1,136 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errUnknownEvaluator = errors.New("unknown condition evaluator")
+
+var (
+	evaluatorRegistryMu sync.RWMutex
+	evaluatorRegistry   = make(map[string]ConditionEvaluator)
+	evaluatorLoaders    []EvaluatorLoader
+)
+
+// ConditionEvaluator decides whether a request satisfies a custom condition.
+// The condition's Parameter selects the evaluator and its Value is passed through as an argument.
+type ConditionEvaluator interface {
+	Evaluate(req *http.Request, condition RuleCondition) bool
+}
+
+// ConditionEvaluatorFunc adapts a plain function to the ConditionEvaluator interface.
+type ConditionEvaluatorFunc func(req *http.Request, condition RuleCondition) bool
+
+// Evaluate implements ConditionEvaluator.
+func (f ConditionEvaluatorFunc) Evaluate(req *http.Request, condition RuleCondition) bool {
+	return f(req, condition)
+}
+
+// RegisterConditionEvaluator makes an evaluator available to conditions of type custom.
+// It is meant to be called from init functions of packages built into the same binary, such as
+// a Traefik or standalone proxy build importing the middleware; the middleware loaded as a
+// Traefik plugin can't see them.
+func RegisterConditionEvaluator(name string, evaluator ConditionEvaluator) {
+	evaluatorRegistryMu.Lock()
+	defer evaluatorRegistryMu.Unlock()
+	evaluatorRegistry[name] = evaluator
+}
+
+// EvaluatorLoader loads the evaluators a configuration defines, such as its WASM evaluators, and
+// returns them by name with a function releasing them once the middleware shuts down.
+type EvaluatorLoader func(cfg *config.Config, logger logger.Logger, registry *metrics.Registry) (map[string]ConditionEvaluator, func(), error)
+
+// RegisterEvaluatorLoader adds a loader run by each middleware when it starts. Like
+// RegisterConditionEvaluator, it only reaches middlewares compiled into the same binary.
+func RegisterEvaluatorLoader(loader EvaluatorLoader) {
+	evaluatorRegistryMu.Lock()
+	defer evaluatorRegistryMu.Unlock()
+	evaluatorLoaders = append(evaluatorLoaders, loader)
+}
+
+// loadEvaluators runs the registered loaders, and fails when a configured WASM evaluator was
+// loaded by none of them, as in the middleware loaded as a Traefik plugin. The returned function
+// releases the loaded evaluators, and is nil when there is nothing to release.
+func loadEvaluators(cfg *config.Config, logger logger.Logger, registry *metrics.Registry) (map[string]ConditionEvaluator, func(), error) {
+	evaluatorRegistryMu.RLock()
+	loaders := evaluatorLoaders
+	evaluatorRegistryMu.RUnlock()
+
+	loaded := make(map[string]ConditionEvaluator)
+	var releases []func()
+	release := func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+	for _, loader := range loaders {
+		evaluators, done, err := loader(cfg, logger, registry)
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		if done != nil {
+			releases = append(releases, done)
+		}
+		for name, evaluator := range evaluators {
+			loaded[name] = evaluator
+		}
+	}
+	for _, evaluator := range cfg.WasmEvaluators {
+		if _, ok := loaded[evaluator.Name]; !ok {
+			release()
+			return nil, nil, fmt.Errorf("%w: WASM evaluator %s needs a build importing github.com/daemonp/forklift/wasmcond, such as the standalone proxy",
+				errUnknownEvaluator, evaluator.Name)
+		}
+	}
+	if len(releases) == 0 {
+		return loaded, nil, nil
+	}
+	return loaded, release, nil
+}
+
+func lookupEvaluator(name string) (ConditionEvaluator, bool) {
+	evaluatorRegistryMu.RLock()
+	defer evaluatorRegistryMu.RUnlock()
+	evaluator, ok := evaluatorRegistry[name]
+	return evaluator, ok
+}
+
+// validateEvaluators checks that all custom conditions reference a registered or WASM evaluator.
+func validateEvaluators(cfg *config.Config) error {
+	wasm := make(map[string]bool, len(cfg.WasmEvaluators))
+	for _, evaluator := range cfg.WasmEvaluators {
+		wasm[evaluator.Name] = true
+	}
+	for _, rule := range cfg.Rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "custom") {
+				continue
+			}
+			if _, ok := lookupEvaluator(condition.Parameter); !ok && !wasm[condition.Parameter] {
+				return fmt.Errorf("%w: %s", errUnknownEvaluator, condition.Parameter)
+			}
+		}
+	}
+	return nil
+}
+
+func (re *RuleEngine) checkCustom(req *http.Request, condition RuleCondition) bool {
+	evaluator, ok := re.loaded[condition.Parameter]
+	if !ok {
+		evaluator, ok = lookupEvaluator(condition.Parameter)
+	}
+	if !ok {
+		re.logger.Warnf("Unknown condition evaluator: %s", condition.Parameter)
+		return false
+	}
+	return evaluator.Evaluate(req, condition)
+}
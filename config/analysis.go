@@ -0,0 +1,294 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Kinds of findings reported by Analyze.
+const (
+	// FindingUnreachable is a rule whose own criteria can't all be met.
+	FindingUnreachable = "unreachable"
+	// FindingShadowed is a rule that never decides a request, as another rule always decides the
+	// requests it matches.
+	FindingShadowed = "shadowed"
+	// FindingStickyConflict is an experiment whose sessions are kept on their variants
+	// inconsistently, or correlated with another experiment's.
+	FindingStickyConflict = "stickyConflict"
+	// FindingBackend is a backend URL that is likely a typo.
+	FindingBackend = "backend"
+)
+
+// Finding is a likely mistake in a configuration found by Analyze. Rule is the key of the rule it
+// concerns, if any.
+type Finding struct {
+	Kind    string `json:"kind"`
+	Rule    string `json:"rule,omitempty"`
+	Message string `json:"message"`
+}
+
+// Analyze looks for likely mistakes in the rules of a configuration: unreachable and shadowed
+// rules, conflicting assignment groups and affinity tokens, and backends that differ only in how
+// they are written. The findings are sorted by kind, then rule. Paused rules are not analyzed.
+func Analyze(cfg *Config) []Finding {
+	var rules []RoutingRule
+	for _, rule := range cfg.Rules {
+		if rule.Paused {
+			continue
+		}
+		conditions, err := ParseMatch(rule.Match)
+		if err == nil {
+			rule.Conditions = append(append([]RuleCondition(nil), rule.Conditions...), conditions...)
+		}
+		rules = append(rules, rule)
+	}
+
+	var findings []Finding
+	findings = append(findings, unreachableRules(rules)...)
+	findings = append(findings, shadowedRules(rules)...)
+	findings = append(findings, stickyConflicts(rules)...)
+	findings = append(findings, backendTypos(cfg.DefaultBackend, rules)...)
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Kind != findings[j].Kind {
+			return findings[i].Kind < findings[j].Kind
+		}
+		return findings[i].Rule < findings[j].Rule
+	})
+	return findings
+}
+
+// unreachableRules reports rules whose path is outside their path prefix, or that require a
+// request value to equal two different values.
+func unreachableRules(rules []RoutingRule) []Finding {
+	var findings []Finding
+	for _, rule := range rules {
+		if rule.Path != "" && rule.PathPrefix != "" && !strings.HasPrefix(rule.Path, rule.PathPrefix) {
+			findings = append(findings, Finding{Kind: FindingUnreachable, Rule: RuleKey(rule),
+				Message: fmt.Sprintf("path %s is not under path prefix %s", rule.Path, rule.PathPrefix)})
+		}
+		expected := map[string]string{}
+		for _, condition := range rule.Conditions {
+			if !isEquality(condition.Operator) {
+				continue
+			}
+			source := conditionSource(condition)
+			if value, ok := expected[source]; ok && !strings.EqualFold(value, condition.Value) {
+				findings = append(findings, Finding{Kind: FindingUnreachable, Rule: RuleKey(rule),
+					Message: fmt.Sprintf("%s must equal both %q and %q", source, value, condition.Value)})
+				continue
+			}
+			expected[source] = condition.Value
+		}
+	}
+	return findings
+}
+
+// shadowedRules reports rules every request of which is decided by another rule: a rule without a
+// percentage of higher priority matching all its requests, or one of the same path taking them
+// from a percentage split, as rules without a percentage are matched before splits.
+func shadowedRules(rules []RoutingRule) []Finding {
+	var findings []Finding
+	for i, rule := range rules {
+		for j, other := range rules {
+			if i == j || !alwaysDecides(other) || !covers(other, rule) {
+				continue
+			}
+			samePath := rulePathKey(other) == rulePathKey(rule)
+			if other.Priority > rule.Priority || (samePath && rule.Percentage > 0) {
+				findings = append(findings, Finding{Kind: FindingShadowed, Rule: RuleKey(rule),
+					Message: fmt.Sprintf("every request it matches is decided by %s", RuleKey(other))})
+				break
+			}
+		}
+	}
+	return findings
+}
+
+// alwaysDecides reports whether a rule decides every request it matches, whatever the session.
+func alwaysDecides(rule RoutingRule) bool {
+	return rule.Percentage == 0 && rule.Flag == nil && !rule.NewSessionsOnly && rule.Identities == nil &&
+		rule.Requires == nil && rule.Excludes == nil && len(rule.Blackouts) == 0 && rule.Drain == nil &&
+		rule.AssignmentGroup == ""
+}
+
+// covers reports whether rule a matches every request rule b matches.
+func covers(a, b RoutingRule) bool {
+	if a.Path != "" && a.Path != b.Path {
+		return false
+	}
+	if a.PathPrefix != "" && !strings.HasPrefix(b.Path, a.PathPrefix) && !strings.HasPrefix(b.PathPrefix, a.PathPrefix) {
+		return false
+	}
+	if a.Method != "" && a.Method != b.Method {
+		return false
+	}
+	for _, condition := range a.Conditions {
+		found := false
+		for _, other := range b.Conditions {
+			if condition == other {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// stickyConflicts reports experiments whose variants are assigned to sessions in different
+// assignment groups, and affinity tokens shared by experiments, which assign the sessions of
+// either experiment to correlated variants.
+func stickyConflicts(rules []RoutingRule) []Finding {
+	var findings []Finding
+	groups := map[string]map[string]bool{}
+	tokens := map[string]map[string]bool{}
+	for _, rule := range rules {
+		if rule.Experiment == "" {
+			continue
+		}
+		if groups[rule.Experiment] == nil {
+			groups[rule.Experiment] = map[string]bool{}
+		}
+		if rule.Percentage > 0 {
+			groups[rule.Experiment][rule.AssignmentGroup] = true
+		}
+		if rule.AffinityToken != "" {
+			if tokens[rule.AffinityToken] == nil {
+				tokens[rule.AffinityToken] = map[string]bool{}
+			}
+			tokens[rule.AffinityToken][rule.Experiment] = true
+		}
+	}
+	for _, experiment := range sortedKeys(groups) {
+		if names := sortedSet(groups[experiment]); len(names) > 1 {
+			for i, name := range names {
+				if name == "" {
+					names[i] = "none"
+				}
+			}
+			findings = append(findings, Finding{Kind: FindingStickyConflict,
+				Message: fmt.Sprintf("experiment %s assigns sessions in assignment groups %s",
+					experiment, strings.Join(names, ", "))})
+		}
+	}
+	for _, token := range sortedKeys(tokens) {
+		if experiments := sortedSet(tokens[token]); len(experiments) > 1 {
+			findings = append(findings, Finding{Kind: FindingStickyConflict,
+				Message: fmt.Sprintf("affinity token %s is shared by experiments %s, so their assignments are correlated",
+					token, strings.Join(experiments, ", "))})
+		}
+	}
+	return findings
+}
+
+// backendTypos reports backends without a scheme or host, hosts reached over both HTTP and HTTPS,
+// backends that differ only in case or a trailing slash, and variants of an experiment sharing a
+// backend.
+func backendTypos(defaultBackend string, rules []RoutingRule) []Finding {
+	var findings []Finding
+	type backend struct {
+		url  string
+		rule string
+	}
+	var backends []backend
+	if defaultBackend != "" {
+		backends = append(backends, backend{url: defaultBackend})
+	}
+	for _, rule := range rules {
+		if rule.Backend != "" {
+			backends = append(backends, backend{url: rule.Backend, rule: RuleKey(rule)})
+		}
+	}
+
+	schemes := map[string]map[string]bool{}
+	spellings := map[string]map[string]bool{}
+	for _, b := range backends {
+		u, err := url.Parse(b.url)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			findings = append(findings, Finding{Kind: FindingBackend, Rule: b.rule,
+				Message: fmt.Sprintf("backend %s has no scheme or host", b.url)})
+			continue
+		}
+		host := strings.ToLower(u.Host)
+		if schemes[host] == nil {
+			schemes[host] = map[string]bool{}
+		}
+		schemes[host][strings.ToLower(u.Scheme)] = true
+		normalized := strings.ToLower(u.Scheme) + "://" + host + strings.TrimSuffix(u.Path, "/")
+		if spellings[normalized] == nil {
+			spellings[normalized] = map[string]bool{}
+		}
+		spellings[normalized][b.url] = true
+	}
+	for _, host := range sortedKeys(schemes) {
+		if len(schemes[host]) > 1 {
+			findings = append(findings, Finding{Kind: FindingBackend,
+				Message: fmt.Sprintf("host %s is reached over both http and https", host)})
+		}
+	}
+	for _, normalized := range sortedKeys(spellings) {
+		if urls := sortedSet(spellings[normalized]); len(urls) > 1 {
+			findings = append(findings, Finding{Kind: FindingBackend,
+				Message: fmt.Sprintf("backends %s differ only in case or a trailing slash", strings.Join(urls, ", "))})
+		}
+	}
+
+	variants := map[string]string{}
+	for _, rule := range rules {
+		if rule.Experiment == "" || rule.Variant == "" || rule.Backend == "" {
+			continue
+		}
+		key := rule.Experiment + "\x00" + rulePathKey(rule) + "\x00" + rule.Backend
+		if variant, ok := variants[key]; ok && variant != rule.Variant {
+			findings = append(findings, Finding{Kind: FindingBackend, Rule: RuleKey(rule),
+				Message: fmt.Sprintf("variants %s and %s of experiment %s share backend %s",
+					variant, rule.Variant, rule.Experiment, rule.Backend)})
+			continue
+		}
+		variants[key] = rule.Variant
+	}
+	return findings
+}
+
+func isEquality(operator string) bool {
+	return operator == "eq" || operator == "equals"
+}
+
+// conditionSource names the request value a condition compares.
+func conditionSource(condition RuleCondition) string {
+	name := condition.Parameter
+	if condition.QueryParam != "" {
+		name = condition.QueryParam
+	}
+	return strings.ToLower(condition.Type) + ":" + name
+}
+
+// rulePathKey returns the path a rule is grouped by when matching.
+func rulePathKey(rule RoutingRule) string {
+	if rule.Path == "" {
+		return rule.PathPrefix
+	}
+	return rule.Path
+}
+
+func sortedKeys(m map[string]map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,6 +2,7 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
@@ -11,25 +12,830 @@ import (
 
 // Config holds the configuration for the Forklift middleware.
 type Config struct {
-	DefaultBackend    string        `yaml:"defaultBackend,omitempty"`
-	Rules             []RoutingRule `yaml:"rules,omitempty"`
-	Debug             bool          `yaml:"debug,omitempty"`
-	ConfigFile        string        `yaml:"configFile,omitempty"`
-	DefaultBackendEnv string        `yaml:"defaultBackendEnv,omitempty"`
-	DebugEnv          string        `yaml:"debugEnv,omitempty"`
+	SchemaVersion     int              `yaml:"schemaVersion,omitempty"`
+	DefaultBackend    string           `yaml:"defaultBackend,omitempty"`
+	Rules             []RoutingRule    `yaml:"rules,omitempty"`
+	Debug             bool             `yaml:"debug,omitempty"`
+	ConfigFile        string           `yaml:"configFile,omitempty"`
+	DefaultBackendEnv string           `yaml:"defaultBackendEnv,omitempty"`
+	DebugEnv          string           `yaml:"debugEnv,omitempty"`
+	Hooks             []string         `yaml:"hooks,omitempty"`
+	SessionStore      *SessionStore    `yaml:"sessionStore,omitempty"`
+	MetricsPath       string           `yaml:"metricsPath,omitempty"`
+	MetricsLabels     *MetricsLabels   `yaml:"metricsLabels,omitempty"`
+	HealthPath        string           `yaml:"healthPath,omitempty"`
+	ReadinessPath     string           `yaml:"readinessPath,omitempty"`
+	ShutdownTimeout   string           `yaml:"shutdownTimeout,omitempty"`
+	ResourcePinTTL    string           `yaml:"resourcePinTTL,omitempty"`
+	ConnectionPinTTL  string           `yaml:"connectionPinTTL,omitempty"`
+	Fallback          *Fallback        `yaml:"fallback,omitempty"`
+	Privacy           *Privacy         `yaml:"privacy,omitempty"`
+	Consent           *Consent         `yaml:"consent,omitempty"`
+	Frequency         *Frequency       `yaml:"frequency,omitempty"`
+	ExposureLog       *ExposureLog     `yaml:"exposureLog,omitempty"`
+	ExposureDedup     *ExposureDedup   `yaml:"exposureDedup,omitempty"`
+	BackendLimits     []BackendLimit   `yaml:"backendLimits,omitempty"`
+	BackendHeaders    []BackendHeader  `yaml:"backendHeaders,omitempty"`
+	FlagProviders     []FlagProvider   `yaml:"flagProviders,omitempty"`
+	EventSinks        []EventSink      `yaml:"eventSinks,omitempty"`
+	Vault             *Vault           `yaml:"vault,omitempty"`
+	RuleBundle        *RuleBundle      `yaml:"ruleBundle,omitempty"`
+	CanaryAnalysis    *CanaryAnalysis  `yaml:"canaryAnalysis,omitempty"`
+	LeaderElection    *LeaderElection  `yaml:"leaderElection,omitempty"`
+	ClusterCounters   *ClusterCounters `yaml:"clusterCounters,omitempty"`
+	TrafficAPI        *TrafficAPI      `yaml:"trafficAPI,omitempty"`
+	AdminAPI          *AdminAPI        `yaml:"adminAPI,omitempty"`
+	RuleHistory       *RuleHistory     `yaml:"ruleHistory,omitempty"`
+	SPIFFE            *SPIFFE          `yaml:"spiffe,omitempty"`
+	Introspection     *Introspection   `yaml:"introspection,omitempty"`
+	Identity          *Identity        `yaml:"identity,omitempty"`
+	Propagation       *Propagation     `yaml:"propagation,omitempty"`
+	Blackouts         []Blackout       `yaml:"blackouts,omitempty"`
+	ResultsExport     *ResultsExport   `yaml:"resultsExport,omitempty"`
+	Decision          *Decision        `yaml:"decision,omitempty"`
+	Script            *Script          `yaml:"script,omitempty"`
+	Regex             *Regex           `yaml:"regex,omitempty"`
+	Fingerprint       *Fingerprint     `yaml:"fingerprint,omitempty"`
+	Churn             *Churn           `yaml:"churn,omitempty"`
+	GeoIP             *GeoIP           `yaml:"geoIP,omitempty"`
+	Tags              []Tag            `yaml:"tags,omitempty"`
+	PathCaseFolding   bool             `yaml:"pathCaseFolding,omitempty"`
+	RequestLimits     *RequestLimits   `yaml:"requestLimits,omitempty"`
+	KillSwitch        *KillSwitch      `yaml:"killSwitch,omitempty"`
+	WasmEvaluators    []WasmEvaluator  `yaml:"wasmEvaluators,omitempty"`
+
+	// V1Backend, V2Backend and V2Percentage are the backends of schema version 1, migrated to
+	// DefaultBackend and a rule by Migrate.
+	V1Backend    string  `yaml:"v1Backend,omitempty"`
+	V2Backend    string  `yaml:"v2Backend,omitempty"`
+	V2Percentage float64 `yaml:"v2Percentage,omitempty"`
+}
+
+// MetricsLabels limits the cardinality of the rule and variant labels of metrics. RulePaths is
+// "keep", the default, "hash" or "drop" for the paths in the labels of rules outside experiments.
+// Rules after the first MaxRules, in priority order, are labelled "other", as are the variants of
+// rules whose percentage is below MinVariantPercentage.
+type MetricsLabels struct {
+	RulePaths            string  `yaml:"rulePaths,omitempty"`
+	MaxRules             int     `yaml:"maxRules,omitempty"`
+	MinVariantPercentage float64 `yaml:"minVariantPercentage,omitempty"`
+}
+
+// Decision delegates routing decisions to an external decision service. With Type "remote", the
+// context of each request is POSTed to URL, and the request is routed to the experiment variant
+// or backend of the response. Requests the service doesn't decide, or fails to within Timeout,
+// 100ms by default, are routed by the rules. Decisions are cached per session and path for
+// CacheTTL, one minute by default. Headers and Cookies name the request headers and cookies sent
+// to the service.
+type Decision struct {
+	Type     string   `yaml:"type,omitempty"`
+	URL      string   `yaml:"url,omitempty"`
+	Timeout  string   `yaml:"timeout,omitempty"`
+	CacheTTL string   `yaml:"cacheTTL,omitempty"`
+	Headers  []string `yaml:"headers,omitempty"`
+	Cookies  []string `yaml:"cookies,omitempty"`
+}
+
+// Script is a Lua script hooked into request handling, for transformations short of a Go plugin.
+// It is Source, or read from File, and may define the global functions identity(request), whose
+// result identifies the request's client, headers(request, headers, backend), which changes the
+// headers forwarded to the backend, and match(request, rule), which vetoes a matching rule by
+// returning false. Each call may run for Timeout, 10ms by default.
+type Script struct {
+	Source  string `yaml:"source,omitempty"`
+	File    string `yaml:"file,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// WasmEvaluator loads the WebAssembly module at Path as the evaluator of the custom conditions
+// whose parameter is Name. The module exports its memory and evaluate() -> i32, which matches when
+// non-zero, and reads the request through the functions the host module "forklift" exports. Each
+// evaluation may run for Timeout, 50ms by default.
+type WasmEvaluator struct {
+	Name    string `yaml:"name,omitempty"`
+	Path    string `yaml:"path,omitempty"`
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// Regex limits the regular expressions of rules. Patterns compiling to more than MaxProgramSize
+// instructions, 2,000 by default, are rejected. Values longer than MaxInputLength bytes, 8 KiB by
+// default, don't match. Budget is the time the regex conditions of a rule may take on a request,
+// 1ms by default; rules going over it don't match.
+type Regex struct {
+	MaxProgramSize int    `yaml:"maxProgramSize,omitempty"`
+	MaxInputLength int    `yaml:"maxInputLength,omitempty"`
+	Budget         string `yaml:"budget,omitempty"`
+}
+
+// Default headers of the TLS fingerprints of clients.
+const (
+	DefaultJA3Header = "X-JA3-Fingerprint"
+	DefaultJA4Header = "X-JA4-Fingerprint"
+)
+
+// Fingerprint names the headers carrying the JA3 and JA4 TLS fingerprints of clients, which
+// fingerprint conditions match on. Under Traefik they must be set by the TLS terminator in front
+// of it; the standalone server sets them itself when it terminates TLS.
+type Fingerprint struct {
+	JA3Header string `yaml:"ja3Header,omitempty"`
+	JA4Header string `yaml:"ja4Header,omitempty"`
+}
+
+// Headers returns the JA3 and JA4 headers, or their defaults if not set.
+func (f *Fingerprint) Headers() (ja3, ja4 string) {
+	ja3, ja4 = DefaultJA3Header, DefaultJA4Header
+	if f != nil && f.JA3Header != "" {
+		ja3 = f.JA3Header
+	}
+	if f != nil && f.JA4Header != "" {
+		ja4 = f.JA4Header
+	}
+	return ja3, ja4
+}
+
+// Churn monitors how often identities change variants, which breaks the stickiness experiment
+// results rely on. Source identifies clients across sessions, "header:<name>", "cookie:<name>" or
+// "query:<name>", so lost cookies are noticed too; by default the session ID is used, noticing
+// store evictions and moved buckets. Every Window, 5 minutes by default, the percentage of
+// identities seen before that changed variants is compared to Threshold, 1% by default, once
+// MinReturning identities were seen, 100 by default. Going over raises an alert, logged and POSTed
+// to WebhookURL if set.
+type Churn struct {
+	Source       string  `yaml:"source,omitempty"`
+	Window       string  `yaml:"window,omitempty"`
+	Threshold    float64 `yaml:"threshold,omitempty"`
+	MinReturning int     `yaml:"minReturning,omitempty"`
+	WebhookURL   string  `yaml:"webhookURL,omitempty"`
+}
+
+// GeoIP locates requests for the country percentages of rules. CountryHeader names a header
+// holding the ISO 3166-1 alpha-2 code of the client's country, set by a CDN or proxy in front of
+// Traefik such as Cloudflare's CF-IPCountry. Database is the path of a MaxMind DB, such as
+// GeoLite2 Country, the client address is looked up in when the header is missing or not set.
+type GeoIP struct {
+	CountryHeader string `yaml:"countryHeader,omitempty"`
+	Database      string `yaml:"database,omitempty"`
+}
+
+// Tag classifies requests under a name, such as isMobile or isInternal, from its conditions and
+// Match, which are given as for rules. Rules and later tags reference it with conditions of type
+// tag, and it is computed at most once per request however many rules reference it.
+type Tag struct {
+	Name       string          `yaml:"name,omitempty"`
+	Match      string          `yaml:"match,omitempty"`
+	Conditions []RuleCondition `yaml:"conditions,omitempty"`
+}
+
+// RequestLimits bounds the headers of the requests rules are evaluated for. MaxHeaders limits
+// the number of header values, counting declared trailers, and MaxHeaderBytes their total size,
+// defaulting to 100 and 64 KiB. Requests over a limit, or with invalid header bytes or trailers
+// declaring fields that must not be sent as trailers, are rejected when Action is "reject", the
+// default, or sent to the default backend without evaluating the rules when it is "bypass".
+type RequestLimits struct {
+	MaxHeaders     int    `yaml:"maxHeaders,omitempty"`
+	MaxHeaderBytes int    `yaml:"maxHeaderBytes,omitempty"`
+	Action         string `yaml:"action,omitempty"`
+}
+
+// KillSwitch sends all requests to the default backend without evaluating the rules, e.g. during
+// incidents. It is engaged by Engaged, through the admin API, or by Key, a key of the session
+// store holding "on", which is read every PollInterval, 5 seconds by default. With Key, the
+// admin API engages and releases it by writing the key, so all instances sharing the store
+// follow.
+type KillSwitch struct {
+	Engaged      bool   `yaml:"engaged,omitempty"`
+	Key          string `yaml:"key,omitempty"`
+	PollInterval string `yaml:"pollInterval,omitempty"`
+}
+
+// ResultsExport writes the exposures and conversions of each experiment, aggregated by variant
+// and goal, to a file per experiment every Interval, one hour by default. Destination is a local
+// directory or an s3://bucket/prefix URL, with Region and Endpoint as for rule bundles. Format is
+// "csv", the default, or "parquet". A conversion is a request matching one of Goals by a session
+// exposed to the experiment within AttributionWindow, one day by default.
+type ResultsExport struct {
+	Destination       string `yaml:"destination,omitempty"`
+	Format            string `yaml:"format,omitempty"`
+	Interval          string `yaml:"interval,omitempty"`
+	Region            string `yaml:"region,omitempty"`
+	Endpoint          string `yaml:"endpoint,omitempty"`
+	Goals             []Goal `yaml:"goals,omitempty"`
+	AttributionWindow string `yaml:"attributionWindow,omitempty"`
+}
+
+// Goal defines a conversion: a request below status 400 to Path, or under PathPrefix, with
+// Method if set.
+type Goal struct {
+	Name       string `yaml:"name,omitempty"`
+	Path       string `yaml:"path,omitempty"`
+	PathPrefix string `yaml:"pathPrefix,omitempty"`
+	Method     string `yaml:"method,omitempty"`
+}
+
+// Identity identifies clients that keep no cookies, such as legacy API clients, by the first of
+// Sources the request carries: "basic" for the username of Basic credentials, or "header:<name>"
+// or "query:<name>" for an API key. Identified requests are bucketed by their identity instead of
+// a session cookie, and rules can allow or deny identities.
+type Identity struct {
+	Sources []string `yaml:"sources,omitempty"`
+}
+
+// Introspection configures the OAuth2 token introspection endpoint (RFC 7662) that "token"
+// conditions check bearer tokens with, e.g. Keycloak's. The middleware authenticates as ClientID
+// with ClientSecret, which may be a Vault reference. Results are cached for CacheTTL, or until
+// the token expires if that is sooner.
+type Introspection struct {
+	URL          string `yaml:"url,omitempty"`
+	ClientID     string `yaml:"clientID,omitempty"`
+	ClientSecret string `yaml:"clientSecret,omitempty"`
+	CacheTTL     string `yaml:"cacheTTL,omitempty"`
+	CacheSize    int    `yaml:"cacheSize,omitempty"`
+	Timeout      string `yaml:"timeout,omitempty"`
+}
+
+// SPIFFE authenticates the middleware to HTTPS backends with an X.509 SVID, for zero-trust
+// meshes. The SVID, its key and the trust bundle are read from the PEM files a spiffe-helper
+// sidecar writes from the SPIRE agent's Workload API, and reloaded every ReloadInterval when they
+// changed, so rotated SVIDs are picked up. Backends must present an SVID of TrustDomain, and one
+// of AllowedIDs if it is set.
+type SPIFFE struct {
+	CertFile       string   `yaml:"certFile,omitempty"`
+	KeyFile        string   `yaml:"keyFile,omitempty"`
+	BundleFile     string   `yaml:"bundleFile,omitempty"`
+	TrustDomain    string   `yaml:"trustDomain,omitempty"`
+	AllowedIDs     []string `yaml:"allowedIDs,omitempty"`
+	ReloadInterval string   `yaml:"reloadInterval,omitempty"`
+}
+
+// AdminAPI serves administrative endpoints under Path, such as the export and import of the
+// session assignments of the session store. Requests authenticate with Token, which may be a
+// Vault reference and grants the admin role, as a bearer token, with one of Tokens, as a user
+// with basic auth, or with an ID or access token issued by the OIDC provider. Changes are logged,
+// and appended as JSON lines to AuditLog if set. UI serves a web page with an overview of the
+// experiments and controls to pause, promote and roll them back, which browsers also
+// authenticate to with the token as a basic auth password. Decisions keeps that many of the most
+// recent routing decisions in memory to be queried.
+type AdminAPI struct {
+	Path      string       `yaml:"path,omitempty"`
+	Token     string       `yaml:"token,omitempty"`
+	Tokens    []AdminToken `yaml:"tokens,omitempty"`
+	Users     []AdminUser  `yaml:"users,omitempty"`
+	OIDC      *AdminOIDC   `yaml:"oidc,omitempty"`
+	AuditLog  string       `yaml:"auditLog,omitempty"`
+	UI        bool         `yaml:"ui,omitempty"`
+	Decisions int          `yaml:"decisions,omitempty"`
+}
+
+// AdminToken is a bearer token of the admin API with a Role: "viewer", "operator" or "admin".
+// Name identifies its requests in the audit log.
+type AdminToken struct {
+	Name  string `yaml:"name,omitempty"`
+	Token string `yaml:"token,omitempty"`
+	Role  string `yaml:"role,omitempty"`
+}
+
+// AdminUser logs in to the admin API with basic auth. Password may be a Vault reference, or the
+// hex SHA-256 of the password prefixed with "sha256:".
+type AdminUser struct {
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Role     string `yaml:"role,omitempty"`
+}
+
+// AdminOIDC accepts ID and access tokens signed by Issuer for Audience. The role of a token is
+// the highest role its RolesClaim values map to in Roles, or that they name directly.
+type AdminOIDC struct {
+	Issuer     string            `yaml:"issuer,omitempty"`
+	Audience   string            `yaml:"audience,omitempty"`
+	RolesClaim string            `yaml:"rolesClaim,omitempty"`
+	Roles      map[string]string `yaml:"roles,omitempty"`
+	Timeout    string            `yaml:"timeout,omitempty"`
+}
+
+// Propagation sends backends headers describing the routing decision of each request: the
+// experiment, variant, bucket, reason and the version of the rules. StripClientHeaders removes
+// these headers from client requests, so backends can trust them, and ContractPath serves their
+// description as JSON.
+type Propagation struct {
+	StripClientHeaders bool   `yaml:"stripClientHeaders,omitempty"`
+	ContractPath       string `yaml:"contractPath,omitempty"`
+}
+
+// RuleHistory keeps the last Size rule sets the middleware loaded, from its configuration or
+// rule bundles, so the admin API can diff them and roll back to one. With Path, a directory, the
+// history is also written to disk and survives restarts and reloads of the middleware.
+type RuleHistory struct {
+	Size int    `yaml:"size,omitempty"`
+	Path string `yaml:"path,omitempty"`
+}
+
+// TrafficAPI serves an endpoint on Path through which progressive delivery controllers, such as
+// Flagger and Argo Rollouts, set the weights of experiment variants. Requests must carry Token,
+// which may be a Vault reference, as a bearer token.
+type TrafficAPI struct {
+	Path  string `yaml:"path,omitempty"`
+	Token string `yaml:"token,omitempty"`
+}
+
+// CanaryAnalysis ramps canary variants up from Prometheus metrics. Every Interval, the Metrics of
+// each canary are queried for the canary and the baseline variant, and the canary is scored by
+// the weighted share of metrics within tolerance of the baseline. Canaries scoring PassScore or
+// more advance to their next step, canaries scoring below MarginalScore are rolled back to the
+// baseline, and the others stay at their step.
+type CanaryAnalysis struct {
+	Prometheus string   `yaml:"prometheus,omitempty"`
+	Interval   string   `yaml:"interval,omitempty"`
+	Timeout    string   `yaml:"timeout,omitempty"`
+	Canaries   []Canary `yaml:"canaries,omitempty"`
+}
+
+// Canary ramps the Canary variant of an experiment through Steps, percentages of traffic it is
+// promoted to, comparing it with the Baseline variant.
+type Canary struct {
+	Experiment    string         `yaml:"experiment,omitempty"`
+	Canary        string         `yaml:"canary,omitempty"`
+	Baseline      string         `yaml:"baseline,omitempty"`
+	Steps         []float64      `yaml:"steps,omitempty"`
+	PassScore     float64        `yaml:"passScore,omitempty"`
+	MarginalScore float64        `yaml:"marginalScore,omitempty"`
+	Metrics       []CanaryMetric `yaml:"metrics,omitempty"`
+}
+
+// CanaryMetric is a PromQL Query returning a single value, with {experiment} and {variant}
+// placeholders. The canary fails the metric when its value deviates from the baseline by more
+// than Tolerance, relative to the baseline, in the failing Direction: "increase" (the default),
+// "decrease" or "either".
+type CanaryMetric struct {
+	Name      string  `yaml:"name,omitempty"`
+	Query     string  `yaml:"query,omitempty"`
+	Direction string  `yaml:"direction,omitempty"`
+	Tolerance float64 `yaml:"tolerance,omitempty"`
+	Weight    float64 `yaml:"weight,omitempty"`
+}
+
+// LeaderElection elects one of the instances sharing the session store, which must be "redis",
+// "dynamodb" or "memory", to advance canary analyses, while all instances serve traffic with the
+// steps it publishes. The leader holds a lease on Key, which defaults to a key derived from the
+// middleware name, for LeaseDuration, 15 seconds by default, and renews it every third of it.
+type LeaderElection struct {
+	Key           string `yaml:"key,omitempty"`
+	LeaseDuration string `yaml:"leaseDuration,omitempty"`
+}
+
+// ClusterCounters counts the requests, 5xx responses and goal conversions of each experiment
+// variant across the instances sharing the session store, which must be "redis", or "memory" for
+// a single instance. Every FlushInterval, 10 seconds by default, each instance adds its counts to
+// counters under Key, which defaults to a key derived from the middleware name, and reads back the
+// totals. Counters expire after the TTL of the session store without traffic.
+type ClusterCounters struct {
+	Key           string `yaml:"key,omitempty"`
+	FlushInterval string `yaml:"flushInterval,omitempty"`
+}
+
+// RuleBundle configures a signed bundle of rules loaded from an s3://, gs:// or https:// URL.
+// The bundle is polled every PollInterval, and new versions replace the rules once their
+// detached signature verifies against PublicKey. SignatureType is "cosign" (the default) or
+// "minisign", and SignatureURL defaults to the bundle URL with a ".sig" or ".minisig" suffix.
+type RuleBundle struct {
+	URL           string `yaml:"url,omitempty"`
+	SignatureURL  string `yaml:"signatureURL,omitempty"`
+	SignatureType string `yaml:"signatureType,omitempty"`
+	PublicKey     string `yaml:"publicKey,omitempty"`
+	PollInterval  string `yaml:"pollInterval,omitempty"`
+	Timeout       string `yaml:"timeout,omitempty"`
+	Region        string `yaml:"region,omitempty"`
+	Endpoint      string `yaml:"endpoint,omitempty"`
+}
+
+// Vault configures the HashiCorp Vault that "vault:<path>#<key>" references in API keys are
+// read from. Forklift authenticates with Token, the token in TokenFile, or the Kubernetes
+// service account of the pod when KubernetesRole is set. Address and Token default to the
+// VAULT_ADDR and VAULT_TOKEN environment variables.
+type Vault struct {
+	Address             string `yaml:"address,omitempty"`
+	Token               string `yaml:"token,omitempty"`
+	TokenFile           string `yaml:"tokenFile,omitempty"`
+	Namespace           string `yaml:"namespace,omitempty"`
+	KubernetesRole      string `yaml:"kubernetesRole,omitempty"`
+	KubernetesMountPath string `yaml:"kubernetesMountPath,omitempty"`
+	Timeout             string `yaml:"timeout,omitempty"`
+}
+
+// EventSink configures a service exposures are sent to. Exposures are sent in batches of
+// BatchSize, or every FlushInterval, and failed batches are retried up to MaxRetries times.
+// Batches that still fail are kept in SpillPath, up to SpillMaxBytes, if it is set.
+//
+// IDSource reads the user or device ID of exposures from "header:<name>" or "cookie:<name>";
+// IDType tells sinks that distinguish them whether it is a "device" or "user" ID.
+//
+// Kafka sinks produce to Topic in Format, "json", "avro" or "protobuf", and register the Avro
+// and Protobuf schemas with the SchemaRegistry URL. NATS sinks publish to the Subject template,
+// which defaults to "forklift.exposures.{experiment}.{variant}". BigQuery sinks stream into
+// Table of Dataset in Project, and append the rows BigQuery rejects to DeadLetterPath. ClickHouse
+// sinks insert into Table of Database, and create it and its rollups if they don't exist.
+type EventSink struct {
+	Name          string `yaml:"name,omitempty"`
+	Type          string `yaml:"type,omitempty"`
+	URL           string `yaml:"url,omitempty"`
+	APIKey        string `yaml:"apiKey,omitempty"`
+	BatchSize     int    `yaml:"batchSize,omitempty"`
+	FlushInterval string `yaml:"flushInterval,omitempty"`
+	Timeout       string `yaml:"timeout,omitempty"`
+	MaxRetries    int    `yaml:"maxRetries,omitempty"`
+	QueueSize     int    `yaml:"queueSize,omitempty"`
+	IDSource      string `yaml:"idSource,omitempty"`
+	IDType        string `yaml:"idType,omitempty"`
+	SpillPath     string `yaml:"spillPath,omitempty"`
+	SpillMaxBytes int64  `yaml:"spillMaxBytes,omitempty"`
+
+	Topic          string `yaml:"topic,omitempty"`
+	Format         string `yaml:"format,omitempty"`
+	SchemaRegistry string `yaml:"schemaRegistry,omitempty"`
+	Subject        string `yaml:"subject,omitempty"`
+
+	Project        string `yaml:"project,omitempty"`
+	Dataset        string `yaml:"dataset,omitempty"`
+	Database       string `yaml:"database,omitempty"`
+	Table          string `yaml:"table,omitempty"`
+	DeadLetterPath string `yaml:"deadLetterPath,omitempty"`
+}
+
+// FlagProvider configures a feature flag provider that rules can reference by name. With
+// FailureMode "closed", requests whose flag can't be evaluated are rejected rather than routed
+// by the other rules.
+type FlagProvider struct {
+	Name            string `yaml:"name,omitempty"`
+	Type            string `yaml:"type,omitempty"`
+	URL             string `yaml:"url,omitempty"`
+	APIKey          string `yaml:"apiKey,omitempty"`
+	CacheTTL        string `yaml:"cacheTTL,omitempty"`
+	Timeout         string `yaml:"timeout,omitempty"`
+	RefreshInterval string `yaml:"refreshInterval,omitempty"`
+	LocalEvaluation bool   `yaml:"localEvaluation,omitempty"`
+	FailureMode     string `yaml:"failureMode,omitempty"`
+	SendEvents      bool   `yaml:"sendEvents,omitempty"`
+}
+
+// BackendLimit bounds the requests in flight to a backend. Requests beyond MaxInFlight wait up to
+// QueueTimeout in a queue of MaxQueue requests; requests that don't get a slot are sent to the
+// default backend.
+type BackendLimit struct {
+	Backend      string `yaml:"backend,omitempty"`
+	MaxInFlight  int    `yaml:"maxInFlight,omitempty"`
+	MaxQueue     int    `yaml:"maxQueue,omitempty"`
+	QueueTimeout string `yaml:"queueTimeout,omitempty"`
+}
+
+// BackendHeader scrubs the headers of the requests sent to a backend, such as one hosted by a
+// third party that must not receive the credentials of our users. Hop-by-hop headers are always
+// removed. AllowCookies, if set, is the list of the only cookies sent; StripAuthorization removes
+// the Authorization header; RemoveHeaders and SetHeaders remove and set other headers.
+// ForwardedHeaders is "keep", the default, "strip" to remove the X-Forwarded-*, Forwarded and
+// X-Real-Ip headers, or "normalize" to replace them with the client address, the protocol and the
+// host of the request.
+type BackendHeader struct {
+	Backend            string            `yaml:"backend,omitempty"`
+	AllowCookies       []string          `yaml:"allowCookies,omitempty"`
+	StripAuthorization bool              `yaml:"stripAuthorization,omitempty"`
+	RemoveHeaders      []string          `yaml:"removeHeaders,omitempty"`
+	SetHeaders         map[string]string `yaml:"setHeaders,omitempty"`
+	ForwardedHeaders   string            `yaml:"forwardedHeaders,omitempty"`
+}
+
+// ExposureLog configures logging of experiment exposures.
+type ExposureLog struct {
+	Enabled         bool                 `yaml:"enabled,omitempty"`
+	SampleRate      int                  `yaml:"sampleRate,omitempty"`
+	AlwaysLogErrors bool                 `yaml:"alwaysLogErrors,omitempty"`
+	Experiments     []ExperimentSampling `yaml:"experiments,omitempty"`
+}
+
+// ExposureDedup emits one exposure per session, experiment and variant per Window to the
+// exposure log and the event sinks, remembering at most MaxEntries of them.
+type ExposureDedup struct {
+	Window     string `yaml:"window,omitempty"`
+	MaxEntries int    `yaml:"maxEntries,omitempty"`
+}
+
+// ExperimentSampling overrides the exposure log sample rate for one experiment.
+type ExperimentSampling struct {
+	Experiment string `yaml:"experiment,omitempty"`
+	SampleRate int    `yaml:"sampleRate,omitempty"`
+}
+
+// SessionStore configures where session assignments are persisted.
+type SessionStore struct {
+	Type        string        `yaml:"type,omitempty"`
+	Servers     []string      `yaml:"servers,omitempty"`
+	Replicas    []string      `yaml:"replicas,omitempty"`
+	TTL         string        `yaml:"ttl,omitempty"`
+	Timeout     string        `yaml:"timeout,omitempty"`
+	Table       string        `yaml:"table,omitempty"`
+	Region      string        `yaml:"region,omitempty"`
+	Endpoint    string        `yaml:"endpoint,omitempty"`
+	Cache       *SessionCache `yaml:"cache,omitempty"`
+	WriteBehind *WriteBehind  `yaml:"writeBehind,omitempty"`
+}
+
+// WriteBehind configures the asynchronous, batched writes of session assignments.
+type WriteBehind struct {
+	QueueSize     int    `yaml:"queueSize,omitempty"`
+	BatchSize     int    `yaml:"batchSize,omitempty"`
+	FlushInterval string `yaml:"flushInterval,omitempty"`
+	Overflow      string `yaml:"overflow,omitempty"`
+}
+
+// SessionCache configures the in-process cache of session assignments read from the store.
+type SessionCache struct {
+	Size        int    `yaml:"size,omitempty"`
+	TTL         string `yaml:"ttl,omitempty"`
+	NegativeTTL string `yaml:"negativeTTL,omitempty"`
 }
 
 // RoutingRule defines the structure for routing rules in the middleware.
 type RoutingRule struct {
-	Path              string          `yaml:"path,omitempty"`
-	PathPrefix        string          `yaml:"pathPrefix,omitempty"`
-	Method            string          `yaml:"method,omitempty"`
-	Conditions        []RuleCondition `yaml:"conditions,omitempty"`
-	Backend           string          `yaml:"backend,omitempty"`
-	Percentage        float64         `yaml:"percentage,omitempty"`
-	Priority          int             `yaml:"priority,omitempty"`
-	PathPrefixRewrite string          `yaml:"pathPrefixRewrite,omitempty"`
-	AffinityToken     string          `yaml:"affinityToken,omitempty"`
+	Path               string                `yaml:"path,omitempty"`
+	PathPrefix         string                `yaml:"pathPrefix,omitempty"`
+	Method             string                `yaml:"method,omitempty"`
+	Conditions         []RuleCondition       `yaml:"conditions,omitempty"`
+	Match              string                `yaml:"match,omitempty"`
+	Backend            string                `yaml:"backend,omitempty"`
+	Percentage         float64               `yaml:"percentage,omitempty"`
+	CountryPercentages map[string]float64    `yaml:"countryPercentages,omitempty"`
+	Priority           int                   `yaml:"priority,omitempty"`
+	PathPrefixRewrite  string                `yaml:"pathPrefixRewrite,omitempty"`
+	AffinityToken      string                `yaml:"affinityToken,omitempty"`
+	Static             *StaticResponse       `yaml:"static,omitempty"`
+	Redirect           *Redirect             `yaml:"redirect,omitempty"`
+	Experiment         string                `yaml:"experiment,omitempty"`
+	Variant            string                `yaml:"variant,omitempty"`
+	Mode               string                `yaml:"mode,omitempty"`
+	AssignmentGroup    string                `yaml:"assignmentGroup,omitempty"`
+	BucketBy           string                `yaml:"bucketBy,omitempty"`
+	BucketPattern      string                `yaml:"bucketPattern,omitempty"`
+	Paused             bool                  `yaml:"paused,omitempty"`
+	NewSessionsOnly    bool                  `yaml:"newSessionsOnly,omitempty"`
+	NewSessionWindow   string                `yaml:"newSessionWindow,omitempty"`
+	Requires           *ExperimentMembership `yaml:"requires,omitempty"`
+	Excludes           *ExperimentMembership `yaml:"excludes,omitempty"`
+	ResponsePolicy     *ResponsePolicy       `yaml:"responsePolicy,omitempty"`
+	SessionFallback    *SessionFallback      `yaml:"sessionFallback,omitempty"`
+	Drain              *Drain                `yaml:"drain,omitempty"`
+	WarmUp             *WarmUp               `yaml:"warmUp,omitempty"`
+	OnEnd              *OnEnd                `yaml:"onEnd,omitempty"`
+	Flag               *FlagRule             `yaml:"flag,omitempty"`
+	ErrorBudget        *ErrorBudget          `yaml:"errorBudget,omitempty"`
+	Fallback           *Fallback             `yaml:"fallback,omitempty"`
+	Identities         *IdentityList         `yaml:"identities,omitempty"`
+	Blackouts          []Blackout            `yaml:"blackouts,omitempty"`
+	InterceptErrors    *ErrorInterception    `yaml:"interceptErrors,omitempty"`
+	Compression        *Compression          `yaml:"compression,omitempty"`
+	Preload            *Preload              `yaml:"preload,omitempty"`
+}
+
+// IdentityList restricts a rule to the identities of Allow, if it is set, other than those of
+// Deny. Entries are identities, or "sha256:<hex>" hashes of them so API keys need not be written
+// in the configuration.
+type IdentityList struct {
+	Allow []string `yaml:"allow,omitempty"`
+	Deny  []string `yaml:"deny,omitempty"`
+}
+
+// Fallback decides where requests go when selecting their backend fails: ProviderError when a
+// flag provider fails or times out, StoreUnavailable when the session store can't be read, and
+// BodyTooLarge when the body is too large for form conditions. Each is "default" for the
+// default backend, "lastAssignment" for the backend the session was last routed to on the
+// rule's path, or "error(<status>)" for an error response. Unset classes keep the built-in
+// behavior.
+type Fallback struct {
+	ProviderError    string `yaml:"providerError,omitempty"`
+	StoreUnavailable string `yaml:"storeUnavailable,omitempty"`
+	BodyTooLarge     string `yaml:"bodyTooLarge,omitempty"`
+}
+
+// Privacy scrubs personal data from everything the middleware logs or exports. DenyHeaders are
+// removed, the values of RedactCookies and MaskQueryParams are replaced ("*" matches every
+// cookie or parameter), and client IPs are truncated to their IPv4Prefix (default 24) or
+// IPv6Prefix (default 48) network with TruncateIPs.
+//
+// HashIdentities replaces session IDs and the identity sources of event sinks and flags with
+// their HMAC-SHA256 keyed with Pepper, which may be a Vault reference, before they are stored or
+// exported.
+type Privacy struct {
+	DenyHeaders     []string `yaml:"denyHeaders,omitempty"`
+	RedactCookies   []string `yaml:"redactCookies,omitempty"`
+	MaskQueryParams []string `yaml:"maskQueryParams,omitempty"`
+	TruncateIPs     bool     `yaml:"truncateIPs,omitempty"`
+	IPv4Prefix      int      `yaml:"ipv4Prefix,omitempty"`
+	IPv6Prefix      int      `yaml:"ipv6Prefix,omitempty"`
+	HashIdentities  bool     `yaml:"hashIdentities,omitempty"`
+	Pepper          string   `yaml:"pepper,omitempty"`
+}
+
+// Consent excludes users who haven't consented from experiments. Source is where consent is
+// read from: "header:<name>", "cookie:<name>" or "query:<name>". Without a Purpose any value
+// counts as consent, such as a TCF string; otherwise the value must list the Purpose, e.g.
+// "analytics" in "analytics,marketing".
+type Consent struct {
+	Source  string `yaml:"source,omitempty"`
+	Purpose string `yaml:"purpose,omitempty"`
+}
+
+// Frequency configures the counting of requests per identity for frequency conditions. Requests
+// are counted over Window (default 168h) in count-min sketches of Width counters (default 4096)
+// by Depth rows (default 4); wider sketches overestimate counts less often.
+type Frequency struct {
+	Window string `yaml:"window,omitempty"`
+	Width  int    `yaml:"width,omitempty"`
+	Depth  int    `yaml:"depth,omitempty"`
+}
+
+// ErrorBudget skips a rule for Cooldown, which defaults to Window, once evaluating it failed
+// Failures times within Window, e.g. because a custom condition evaluator panicked or a flag
+// provider returned errors.
+type ErrorBudget struct {
+	Failures int    `yaml:"failures,omitempty"`
+	Window   string `yaml:"window,omitempty"`
+	Cooldown string `yaml:"cooldown,omitempty"`
+}
+
+// FlagRule selects the backend of a rule from the treatment of a feature flag. Treatments maps
+// treatments to backends; requests with other treatments, or whose evaluation fails without a
+// Fallback treatment, fall through to the next rule.
+//
+// Key and Attributes take request sources: "header:<name>", "cookie:<name>", "query:<name>",
+// "path", "method" or "host". The key defaults to the session ID.
+type FlagRule struct {
+	Provider   string            `yaml:"provider,omitempty"`
+	Name       string            `yaml:"name,omitempty"`
+	Treatments map[string]string `yaml:"treatments,omitempty"`
+	Key        string            `yaml:"key,omitempty"`
+	Attributes map[string]string `yaml:"attributes,omitempty"`
+	Fallback   string            `yaml:"fallback,omitempty"`
+}
+
+// OnEnd defines where sessions assigned to a variant go once the variant ends, that is once its
+// rule is paused. MigrateTo names another variant of the experiment, or "default" for the
+// default backend.
+type OnEnd struct {
+	MigrateTo string `yaml:"migrateTo,omitempty"`
+}
+
+// Drain stops assigning new sessions to a rule from Since, an RFC 3339 time, while sessions
+// assigned before keep it for GracePeriod. After the grace period no session is routed by the rule.
+type Drain struct {
+	Since       string `yaml:"since,omitempty"`
+	GracePeriod string `yaml:"gracePeriod,omitempty"`
+}
+
+// WarmUp holds the backend of a rule out of assignment while it is sent Percentage of the
+// requests the rule matches as mirrored requests, whose responses are discarded. The rule starts
+// assigning sessions once Duration has passed since the first of them, the health check at
+// HealthPath passes, and the last MinRequests mirrored requests took MaxLatency on average with at
+// most MaxErrorRate percent of errors.
+type WarmUp struct {
+	Duration     string  `yaml:"duration,omitempty"`
+	Percentage   float64 `yaml:"percentage,omitempty"`
+	HealthPath   string  `yaml:"healthPath,omitempty"`
+	MaxLatency   string  `yaml:"maxLatency,omitempty"`
+	MaxErrorRate float64 `yaml:"maxErrorRate,omitempty"`
+	MinRequests  int     `yaml:"minRequests,omitempty"`
+}
+
+// Blackout is a window during which experiments serve the default backend, e.g. a Black Friday
+// freeze: from Start until End, RFC 3339 times, or for Duration from each time the cron
+// expression Cron matches in Timezone, UTC by default.
+type Blackout struct {
+	Name     string `yaml:"name,omitempty"`
+	Start    string `yaml:"start,omitempty"`
+	End      string `yaml:"end,omitempty"`
+	Cron     string `yaml:"cron,omitempty"`
+	Duration string `yaml:"duration,omitempty"`
+	Timezone string `yaml:"timezone,omitempty"`
+}
+
+// SessionFallback persists the session ID of clients whose session cookie is stripped, by
+// setting it from a script injected into HTML responses ("script"), or by carrying it in a query
+// parameter ("query").
+type SessionFallback struct {
+	Mode      string `yaml:"mode,omitempty"`
+	Parameter string `yaml:"parameter,omitempty"`
+}
+
+// ResponsePolicy defines the CORS and security headers of responses served by a rule. The
+// policy replaces the corresponding headers returned by the backend.
+type ResponsePolicy struct {
+	CORS                    *CORSPolicy       `yaml:"cors,omitempty"`
+	ContentSecurityPolicy   string            `yaml:"contentSecurityPolicy,omitempty"`
+	StrictTransportSecurity string            `yaml:"strictTransportSecurity,omitempty"`
+	Headers                 map[string]string `yaml:"headers,omitempty"`
+}
+
+// CORSPolicy defines the cross-origin requests allowed by a rule. An origin of "*" allows any origin.
+type CORSPolicy struct {
+	AllowOrigins     []string `yaml:"allowOrigins,omitempty"`
+	AllowMethods     []string `yaml:"allowMethods,omitempty"`
+	AllowHeaders     []string `yaml:"allowHeaders,omitempty"`
+	ExposeHeaders    []string `yaml:"exposeHeaders,omitempty"`
+	AllowCredentials bool     `yaml:"allowCredentials,omitempty"`
+	MaxAge           int      `yaml:"maxAge,omitempty"`
+}
+
+// ExperimentMembership refers to the sessions assigned to a variant of an experiment, or to any
+// of its variants if Variant is empty.
+type ExperimentMembership struct {
+	Experiment string `yaml:"experiment,omitempty"`
+	Variant    string `yaml:"variant,omitempty"`
+}
+
+var errInvalidBackend = errors.New("invalid backend")
+
+// StaticResponse defines a fixed response served by the middleware in place of a backend. The
+// body is Body, or read from BodyFile or fetched from BodyURL when the rules are loaded.
+type StaticResponse struct {
+	Status   int               `yaml:"status,omitempty"`
+	Body     string            `yaml:"body,omitempty"`
+	BodyFile string            `yaml:"bodyFile,omitempty"`
+	BodyURL  string            `yaml:"bodyURL,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty"`
+}
+
+// staticBackend is a static response given as the backend of a rule.
+type staticBackend struct {
+	Type           string `yaml:"type"`
+	StaticResponse `yaml:",inline"`
+}
+
+// UnmarshalYAML accepts a static response given as the backend of a rule, as in
+// backend: {type: static, status: 503, bodyFile: maintenance.html}, and sets it as Static.
+func (r *RoutingRule) UnmarshalYAML(node *yaml.Node) error {
+	type plain RoutingRule
+	if node.Kind != yaml.MappingNode {
+		return node.Decode((*plain)(r))
+	}
+	fields := *node
+	fields.Content = nil
+	var backend *yaml.Node
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "backend" && node.Content[i+1].Kind == yaml.MappingNode {
+			backend = node.Content[i+1]
+			continue
+		}
+		fields.Content = append(fields.Content, node.Content[i], node.Content[i+1])
+	}
+	if err := fields.Decode((*plain)(r)); err != nil {
+		return err
+	}
+	if backend == nil {
+		return nil
+	}
+	var static staticBackend
+	if err := backend.Decode(&static); err != nil {
+		return err
+	}
+	if static.Type != "static" {
+		return fmt.Errorf("%w: type %q, only static backends can be objects", errInvalidBackend, static.Type)
+	}
+	if r.Static != nil {
+		return fmt.Errorf("%w: a static backend and static are both set", errInvalidBackend)
+	}
+	r.Static = &static.StaticResponse
+	return nil
+}
+
+// ErrorInterception handles the 5xx responses of a rule's backend, and failures to reach it, so
+// they don't reach clients: Action "retry" sends the request to the default backend instead, and
+// "page" serves Page. Statuses restricts the interception to some 5xx statuses.
+type ErrorInterception struct {
+	Action   string          `yaml:"action,omitempty"`
+	Statuses []int           `yaml:"statuses,omitempty"`
+	Page     *StaticResponse `yaml:"page,omitempty"`
+}
+
+// Compression compresses the responses of a rule's backend with gzip for clients accepting it,
+// unless the backend compressed them already. Only responses of ContentTypes, which may end in
+// "/*", or of common text types by default, and of at least MinSize bytes, 1024 by default, are
+// compressed.
+type Compression struct {
+	ContentTypes []string `yaml:"contentTypes,omitempty"`
+	MinSize      int      `yaml:"minSize,omitempty"`
+}
+
+// Preload adds Link headers, such as "</app.css>; rel=preload; as=style", to the responses of a
+// rule's backend. With EarlyHints they are also sent in a 103 Early Hints response before the
+// request is proxied, so browsers can fetch the resources while the backend is still working.
+type Preload struct {
+	Links      []string `yaml:"links,omitempty"`
+	EarlyHints bool     `yaml:"earlyHints,omitempty"`
+}
+
+// Redirect defines a redirect response served by the middleware in place of a backend.
+// Location may reference the ${scheme}, ${host}, ${path} and ${query} template variables,
+// where ${path} expands to the escaped path and ${query} to the raw query string including its
+// leading "?", if any. ${host} is the Host header of the request, which the client controls.
+type Redirect struct {
+	Status   int    `yaml:"status,omitempty"`
+	Location string `yaml:"location,omitempty"`
 }
 
 // RuleCondition defines the structure for conditions in routing rules.
@@ -71,6 +877,33 @@ func LoadConfig(yamlConfig string) (*Config, error) {
 	return config, nil
 }
 
+// LoadFile loads a configuration from a YAML file without applying environment variables.
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// WriteFile writes the configuration to a YAML file.
+func (c *Config) WriteFile(path string) error {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// MarshalRules returns the YAML of rules as they appear in a configuration file.
+func MarshalRules(rules []RoutingRule) ([]byte, error) {
+	return yaml.Marshal(&Config{Rules: rules})
+}
+
 // loadFromFile loads configuration from the specified file.
 func (c *Config) loadFromFile() error {
 	data, err := os.ReadFile(c.ConfigFile)
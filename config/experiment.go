@@ -0,0 +1,315 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errUnknownExperiment = errors.New("unknown experiment")
+	errUnknownVariant    = errors.New("unknown variant")
+	errInvalidPromotion  = errors.New("invalid promotion percentage: must be between 1 and 100")
+	errInvalidGrace      = errors.New("invalid grace period: must not be negative")
+)
+
+const fullPercentage = 100.0
+
+// ExperimentRules returns the indices of the rules belonging to the named experiment.
+func (c *Config) ExperimentRules(experiment string) []int {
+	var indices []int
+	for i, rule := range c.Rules {
+		if rule.Experiment == experiment {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// PromoteVariant sets the traffic share of a variant to the given percentage and scales the
+// remaining variants of the experiment proportionally. Variants left with no traffic are paused,
+// since a zero percentage would otherwise make a rule unconditional.
+func (c *Config) PromoteVariant(experiment, variant string, percentage float64) error {
+	if percentage <= 0 || percentage > fullPercentage {
+		return errInvalidPromotion
+	}
+	indices := c.ExperimentRules(experiment)
+	if len(indices) == 0 {
+		return fmt.Errorf("%w: %s", errUnknownExperiment, experiment)
+	}
+
+	found := false
+	for _, group := range c.groupByPath(indices) {
+		var others []int
+		othersTotal := 0.0
+		for _, i := range group {
+			if c.Rules[i].Variant == variant {
+				found = true
+				c.Rules[i].Percentage = percentage
+				c.Rules[i].Paused = false
+				continue
+			}
+			others = append(others, i)
+			othersTotal += c.Rules[i].Percentage
+		}
+		c.rebalance(others, othersTotal, fullPercentage-percentage)
+	}
+	if !found {
+		return fmt.Errorf("%w: %s/%s", errUnknownVariant, experiment, variant)
+	}
+	return nil
+}
+
+// SetVariantWeight sets the percentage of traffic of a variant like PromoteVariant, and also
+// accepts 0, which pauses the variant and shares its traffic between the other variants.
+func (c *Config) SetVariantWeight(experiment, variant string, percentage float64) error {
+	if percentage != 0 {
+		return c.PromoteVariant(experiment, variant, percentage)
+	}
+	indices := c.ExperimentRules(experiment)
+	if len(indices) == 0 {
+		return fmt.Errorf("%w: %s", errUnknownExperiment, experiment)
+	}
+
+	found := false
+	for _, group := range c.groupByPath(indices) {
+		var others []int
+		othersTotal := 0.0
+		for _, i := range group {
+			if c.Rules[i].Variant == variant {
+				found = true
+				// A zero share keeps the variant paused when other variants are rebalanced later.
+				c.Rules[i].Percentage = 0
+				c.Rules[i].Paused = true
+				continue
+			}
+			others = append(others, i)
+			othersTotal += c.Rules[i].Percentage
+		}
+		c.rebalance(others, othersTotal, fullPercentage)
+	}
+	if !found {
+		return fmt.Errorf("%w: %s/%s", errUnknownVariant, experiment, variant)
+	}
+	return nil
+}
+
+// rebalance distributes remaining among the given rules in proportion to their current share.
+// Rules given a share are resumed, such as the variants paused by a full promotion, and rules
+// left without one are paused.
+func (c *Config) rebalance(indices []int, total, remaining float64) {
+	for _, i := range indices {
+		if remaining <= 0 {
+			c.Rules[i].Paused = true
+			continue
+		}
+		share := remaining / float64(len(indices))
+		if total > 0 {
+			share = remaining * c.Rules[i].Percentage / total
+		}
+		if share <= 0 {
+			c.Rules[i].Paused = true
+			continue
+		}
+		c.Rules[i].Percentage = share
+		c.Rules[i].Paused = false
+	}
+}
+
+// groupByPath groups rule indices by the path or path prefix they match.
+func (c *Config) groupByPath(indices []int) [][]int {
+	groups := make(map[string][]int)
+	var keys []string
+	for _, i := range indices {
+		key := c.Rules[i].Path
+		if key == "" {
+			key = c.Rules[i].PathPrefix
+		}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+	result := make([][]int, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, groups[key])
+	}
+	return result
+}
+
+// SetExperimentPaused pauses or resumes all rules of the named experiment.
+func (c *Config) SetExperimentPaused(experiment string, paused bool) error {
+	indices := c.ExperimentRules(experiment)
+	if len(indices) == 0 {
+		return fmt.Errorf("%w: %s", errUnknownExperiment, experiment)
+	}
+	for _, i := range indices {
+		c.Rules[i].Paused = paused
+	}
+	return nil
+}
+
+// DrainVariant drains the rules of a variant from since, letting sessions assigned before keep
+// the variant for the grace period.
+func (c *Config) DrainVariant(experiment, variant string, since time.Time, grace time.Duration) error {
+	if grace < 0 {
+		return errInvalidGrace
+	}
+	indices := c.ExperimentRules(experiment)
+	if len(indices) == 0 {
+		return fmt.Errorf("%w: %s", errUnknownExperiment, experiment)
+	}
+
+	found := false
+	for _, i := range indices {
+		if c.Rules[i].Variant != variant {
+			continue
+		}
+		found = true
+		c.Rules[i].Drain = &Drain{
+			Since:       since.UTC().Format(time.RFC3339),
+			GracePeriod: grace.String(),
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: %s/%s", errUnknownVariant, experiment, variant)
+	}
+	return nil
+}
+
+// RuleChange describes the difference of a single rule between two configurations.
+type RuleChange struct {
+	Key    string        `json:"key"`
+	Kind   string        `json:"kind"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// FieldChange describes a changed field of a rule.
+type FieldChange struct {
+	Name string `json:"name"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+// Rule change kinds reported by DiffRules.
+const (
+	RuleAdded   = "added"
+	RuleRemoved = "removed"
+	RuleChanged = "changed"
+)
+
+// RuleKey returns a stable identifier for a rule, used to match rules across configurations and
+// to label its metrics. Keys aren't unique: rules of the same method, path and backend without
+// an experiment variant share one.
+func RuleKey(rule RoutingRule) string {
+	if rule.Experiment != "" && rule.Variant != "" {
+		return rule.Experiment + "/" + rule.Variant
+	}
+	path := rule.Path
+	if path == "" {
+		path = rule.PathPrefix + "*"
+	}
+	method := rule.Method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + path + " -> " + rule.Backend
+}
+
+// DiffRules compares two rule sets and reports added, removed and changed rules. Rules sharing a
+// key are matched in the order they are listed, the second one keyed with a " #2" suffix, and so on.
+func DiffRules(oldRules, newRules []RoutingRule) ([]RuleChange, error) {
+	oldByKey := rulesByKey(oldRules)
+	newByKey := rulesByKey(newRules)
+
+	var changes []RuleChange
+	for key, oldRule := range oldByKey {
+		newRule, ok := newByKey[key]
+		if !ok {
+			changes = append(changes, RuleChange{Key: key, Kind: RuleRemoved})
+			continue
+		}
+		fields, err := diffFields(oldRule, newRule)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 {
+			changes = append(changes, RuleChange{Key: key, Kind: RuleChanged, Fields: fields})
+		}
+	}
+	for key := range newByKey {
+		if _, ok := oldByKey[key]; !ok {
+			changes = append(changes, RuleChange{Key: key, Kind: RuleAdded})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes, nil
+}
+
+// rulesByKey returns the rules by their key, numbering the rules after the first of a key.
+func rulesByKey(rules []RoutingRule) map[string]RoutingRule {
+	byKey := make(map[string]RoutingRule, len(rules))
+	seen := make(map[string]int, len(rules))
+	for _, rule := range rules {
+		key := RuleKey(rule)
+		seen[key]++
+		if n := seen[key]; n > 1 {
+			key = fmt.Sprintf("%s #%d", key, n)
+		}
+		byKey[key] = rule
+	}
+	return byKey
+}
+
+// diffFields compares the YAML representation of two rules field by field.
+func diffFields(oldRule, newRule RoutingRule) ([]FieldChange, error) {
+	oldFields, err := ruleFields(oldRule)
+	if err != nil {
+		return nil, err
+	}
+	newFields, err := ruleFields(newRule)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range oldFields {
+		names[name] = true
+	}
+	for name := range newFields {
+		names[name] = true
+	}
+
+	var fields []FieldChange
+	for name := range names {
+		if oldFields[name] != newFields[name] {
+			fields = append(fields, FieldChange{Name: name, Old: oldFields[name], New: newFields[name]})
+		}
+	}
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Name < fields[j].Name
+	})
+	return fields, nil
+}
+
+func ruleFields(rule RoutingRule) (map[string]string, error) {
+	data, err := yaml.Marshal(rule)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string, len(raw))
+	for name, value := range raw {
+		fields[name] = fmt.Sprint(value)
+	}
+	return fields, nil
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var errInvalidMatch = errors.New("invalid match")
+
+// ParseMatch parses the conditions of a match: conditions separated by semicolons, each
+// "<type>[:<parameter>] [<operator> [<value>]]", e.g. `header:X-Beta eq true; query:plan eq pro`.
+// The parameter of query conditions is their query parameter. Values run to the end of the
+// condition, and may be double-quoted to include semicolons or surrounding spaces.
+func ParseMatch(match string) ([]RuleCondition, error) {
+	parts, err := splitMatch(match)
+	if err != nil {
+		return nil, err
+	}
+	conditions := make([]RuleCondition, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var condition RuleCondition
+		selector, rest, _ := strings.Cut(part, " ")
+		condition.Type, condition.Parameter, _ = strings.Cut(selector, ":")
+		if condition.Type == "" {
+			return nil, fmt.Errorf("%w: %q has no type", errInvalidMatch, part)
+		}
+		if strings.EqualFold(condition.Type, "query") {
+			condition.QueryParam, condition.Parameter = condition.Parameter, ""
+		}
+		condition.Operator, rest, _ = strings.Cut(strings.TrimSpace(rest), " ")
+		value := strings.TrimSpace(rest)
+		if strings.HasPrefix(value, `"`) {
+			if value, err = strconv.Unquote(value); err != nil {
+				return nil, fmt.Errorf("%w: %q has a malformed quoted value", errInvalidMatch, part)
+			}
+		}
+		condition.Value = value
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// splitMatch splits a match at the semicolons outside double quotes.
+func splitMatch(match string) ([]string, error) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(match); i++ {
+		switch match[i] {
+		case '\\':
+			if quoted {
+				i++
+			}
+		case '"':
+			quoted = !quoted
+		case ';':
+			if !quoted {
+				parts = append(parts, match[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote in %q", errInvalidMatch, match)
+	}
+	return append(parts, match[start:]), nil
+}
+
+// ExpandMatch appends the conditions of the rule's Match to its Conditions, and clears Match, so
+// expanding a rule again doesn't repeat them.
+func (r *RoutingRule) ExpandMatch() error {
+	if r.Match == "" {
+		return nil
+	}
+	conditions, err := ParseMatch(r.Match)
+	if err != nil {
+		return err
+	}
+	r.Conditions = append(append([]RuleCondition(nil), r.Conditions...), conditions...)
+	r.Match = ""
+	return nil
+}
+
+// ExpandMatch appends the conditions of the tag's Match to its Conditions, as for rules.
+func (t *Tag) ExpandMatch() error {
+	if t.Match == "" {
+		return nil
+	}
+	conditions, err := ParseMatch(t.Match)
+	if err != nil {
+		return err
+	}
+	t.Conditions = append(append([]RuleCondition(nil), t.Conditions...), conditions...)
+	t.Match = ""
+	return nil
+}
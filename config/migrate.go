@@ -0,0 +1,91 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the version of the configuration schema of this release. Configurations of
+// earlier versions are migrated to it when loaded.
+const SchemaVersion = 2
+
+// legacySchemaVersion is the version of configurations without a schema version that use fields
+// removed since.
+const legacySchemaVersion = 1
+
+// defaultLegacyPercentage is the share of traffic V2Backend received by default in schema version 1.
+const defaultLegacyPercentage = 50
+
+var errUnsupportedSchemaVersion = errors.New("unsupported schema version")
+
+// migration upgrades a configuration from the previous schema version to version to, returning a
+// deprecation notice for each field it rewrote.
+type migration struct {
+	to      int
+	migrate func(cfg *Config) []string
+}
+
+// migrations are the steps from each schema version to the next, in order.
+var migrations = []migration{
+	{to: 2, migrate: migrateLegacyBackends},
+}
+
+// Migrate upgrades a configuration to the current schema version in place, returning deprecation
+// notices for the fields it rewrote. Configurations without a schema version are of the current
+// version, unless they use fields removed since. Migrating a configuration twice changes nothing.
+func Migrate(cfg *Config) ([]string, error) {
+	version := cfg.SchemaVersion
+	if version == 0 {
+		version = SchemaVersion
+		if cfg.hasLegacyBackends() {
+			version = legacySchemaVersion
+		}
+	}
+	if version < legacySchemaVersion || version > SchemaVersion {
+		return nil, fmt.Errorf("%w: %d, this release supports up to %d", errUnsupportedSchemaVersion,
+			cfg.SchemaVersion, SchemaVersion)
+	}
+	if version >= 2 && cfg.hasLegacyBackends() {
+		return nil, fmt.Errorf("%w: v1Backend, v2Backend and v2Percentage were removed in schema version 2",
+			errUnsupportedSchemaVersion)
+	}
+
+	var notices []string
+	if cfg.SchemaVersion != 0 && version < SchemaVersion {
+		notices = append(notices, fmt.Sprintf("schemaVersion %d is deprecated, the configuration was migrated to %d",
+			version, SchemaVersion))
+	}
+	for _, m := range migrations {
+		if m.to > version {
+			notices = append(notices, m.migrate(cfg)...)
+		}
+	}
+	cfg.SchemaVersion = SchemaVersion
+	return notices, nil
+}
+
+func (c *Config) hasLegacyBackends() bool {
+	return c.V1Backend != "" || c.V2Backend != "" || c.V2Percentage != 0
+}
+
+// migrateLegacyBackends replaces the V1Backend and V2Backend of schema version 1 with the default
+// backend and a rule sending V2Percentage of all requests to V2Backend.
+func migrateLegacyBackends(cfg *Config) []string {
+	var notices []string
+	if cfg.V1Backend != "" {
+		notices = append(notices, "v1Backend is deprecated, use defaultBackend")
+		if cfg.DefaultBackend == "" {
+			cfg.DefaultBackend = cfg.V1Backend
+		}
+	}
+	if cfg.V2Backend != "" {
+		notices = append(notices, "v2Backend and v2Percentage are deprecated, use a rule with pathPrefix / and a percentage")
+		percentage := cfg.V2Percentage
+		if percentage == 0 {
+			percentage = defaultLegacyPercentage
+		}
+		cfg.Rules = append(cfg.Rules, RoutingRule{PathPrefix: "/", Backend: cfg.V2Backend, Percentage: percentage})
+	}
+	cfg.V1Backend, cfg.V2Backend, cfg.V2Percentage = "", "", 0
+	return notices
+}
@@ -0,0 +1,109 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errInvalidConnectionPinTTL = errors.New("invalid connection pin ttl")
+
+const maxConnectionPins = 100000
+
+// connectionPins pin the backend each rule group selected on a client connection, so every
+// request of a keep-alive connection, or stream of an HTTP/2 connection, gets the same backend
+// for the group even when the client drops the session cookie or the rules change. Without them
+// the rules are evaluated again for every request, which gives sessions the same backend but
+// doesn't tie requests to their connection.
+//
+// Connections are told apart by the remote address and port of the request, which is the client's
+// only when Traefik is reached directly. A proxy in front of Traefik, such as a load balancer or
+// CDN, pools the connections of many clients, which would then share pins, so requests forwarded
+// by a proxy, which carry the X-Forwarded-For header Traefik only keeps from trusted proxies, are
+// never pinned. Proxies that don't set X-Forwarded-For can't be told apart from clients.
+//
+// Plugins are not told when connections close, so pins expire once a connection was idle for
+// the TTL, and are cleared when they grow past maxConnectionPins. They are shared by the
+// middleware and the copies created for each rule change.
+type connectionPins struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]connectionPin
+}
+
+type connectionPin struct {
+	backend string
+	expires time.Time
+}
+
+// newConnectionPins returns nil when requests are not pinned to their connection.
+func newConnectionPins(ttl string) (*connectionPins, error) {
+	if ttl == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("%w: %s", errInvalidConnectionPinTTL, ttl)
+	}
+	if d == 0 {
+		return nil, nil
+	}
+	return &connectionPins{ttl: d, entries: make(map[string]connectionPin)}, nil
+}
+
+// pinnable reports whether the remote address of a request is the client's connection.
+func pinnable(req *http.Request) bool {
+	return req.RemoteAddr != "" && req.Header.Get("X-Forwarded-For") == ""
+}
+
+// connectionPinKey identifies a rule group on the connection of a request.
+func connectionPinKey(req *http.Request, path string) string {
+	return req.RemoteAddr + " " + path
+}
+
+// pinned returns the backend pinned to the connection for a group of rules, if one of the rules
+// still targets it. Using a pin extends it.
+func (p *connectionPins) pinned(req *http.Request, path string, rules []*RoutingRule, now time.Time) (SelectedBackend, bool) {
+	if p == nil || !pinnable(req) {
+		return SelectedBackend{}, false
+	}
+	key := connectionPinKey(req, path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pin, ok := p.entries[key]
+	if !ok || now.After(pin.expires) {
+		delete(p.entries, key)
+		return SelectedBackend{}, false
+	}
+	for _, rule := range rules {
+		if backendKey(*rule) == pin.backend {
+			pin.expires = now.Add(p.ttl)
+			p.entries[key] = pin
+			return SelectedBackend{Backend: pin.backend, Rule: rule, Reason: reasonPinned}, true
+		}
+	}
+	delete(p.entries, key)
+	return SelectedBackend{}, false
+}
+
+// pin records the backend a rule group selected on the connection of a request.
+func (p *connectionPins) pin(req *http.Request, path string, selected SelectedBackend, now time.Time) {
+	if p == nil || !pinnable(req) || selected.Rule == nil {
+		return
+	}
+	if selected.Reason != reasonRule && selected.Reason != reasonSplit {
+		// Fallbacks stand in for a failure and are not repeated once it is over, and flags
+		// are evaluated by their provider for every request.
+		return
+	}
+	key := connectionPinKey(req, path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.entries[key]; !ok && len(p.entries) >= maxConnectionPins {
+		p.entries = make(map[string]connectionPin)
+	}
+	p.entries[key] = connectionPin{backend: selected.Backend, expires: now.Add(p.ttl)}
+}
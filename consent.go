@@ -0,0 +1,70 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidConsentSource = errors.New("invalid consent source: must be header:<name>, cookie:<name> or query:<name>")
+
+// validateConsent checks the consent source of the configuration and of consent conditions.
+func validateConsent(cfg *config.Config) error {
+	if cfg.Consent != nil && !validConsentSource(cfg.Consent.Source) {
+		return fmt.Errorf("%w: %q", errInvalidConsentSource, cfg.Consent.Source)
+	}
+	for _, rule := range cfg.Rules {
+		for _, condition := range rule.Conditions {
+			if strings.EqualFold(condition.Type, "consent") && !validConsentSource(condition.Parameter) {
+				return fmt.Errorf("%w: %q", errInvalidConsentSource, condition.Parameter)
+			}
+		}
+	}
+	return nil
+}
+
+func validConsentSource(source string) bool {
+	kind, _, _ := strings.Cut(source, ":")
+	return (kind == "header" || kind == "cookie" || kind == "query") && validFlagSource(source)
+}
+
+// consentGiven reports whether the request carries consent in source. Without a purpose any
+// value counts; otherwise the value must list the purpose among its comma, semicolon, pipe or
+// space separated tokens.
+func consentGiven(req *http.Request, source, purpose string) bool {
+	value := flagSourceValue(req, source)
+	if value == "" {
+		return false
+	}
+	if purpose == "" {
+		return true
+	}
+	for _, token := range strings.FieldsFunc(value, isConsentSeparator) {
+		if strings.EqualFold(token, purpose) {
+			return true
+		}
+	}
+	return false
+}
+
+func isConsentSeparator(r rune) bool {
+	return r == ',' || r == ';' || r == '|' || r == ' ' || r == '+'
+}
+
+// consented reports whether the request may take part in experiments. Requests without consent
+// are served by the default backend, without a session cookie, assignment or exposure.
+func (a *Forklift) consented(req *http.Request) bool {
+	consent := a.config.Consent
+	return consent == nil || consentGiven(req, consent.Source, consent.Purpose)
+}
+
+func (re *RuleEngine) checkConsent(req *http.Request, condition RuleCondition) bool {
+	result := consentGiven(req, condition.Parameter, condition.Value)
+	if re.config.Debug {
+		re.logger.Debugf("Consent %s for %q: %v", condition.Parameter, condition.Value, result)
+	}
+	return result
+}
@@ -0,0 +1,296 @@
+package forklift
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errInvalidDecision = errors.New("invalid decision")
+	errDecisionStatus  = errors.New("decision service returned an error")
+)
+
+const (
+	decisionRemote = "remote"
+
+	defaultDecisionTimeout  = 100 * time.Millisecond
+	defaultDecisionCacheTTL = time.Minute
+	maxDecisionCacheEntries = 100000
+	// maxDecisionResponseBytes bounds the responses read from the decision service.
+	maxDecisionResponseBytes = 64 << 10
+)
+
+// remoteDecisions asks an external decision service where to route each request, for teams whose
+// experiments are assigned by a service of their own. Answers are cached per session and path.
+// It is shared by the middleware and the copies created for each rule change.
+type remoteDecisions struct {
+	url     string
+	client  *http.Client
+	timeout time.Duration
+	ttl     time.Duration
+	headers []string
+	cookies []string
+	results *metrics.CounterVec
+	logger  logger.Logger
+
+	mu    sync.Mutex
+	cache map[string]cachedDecision
+}
+
+type cachedDecision struct {
+	answer  decisionAnswer
+	expires time.Time
+}
+
+// decisionRequest is the context of a request sent to the decision service. Experiments are the
+// variants of the experiments with rules for the request's path. The session ID is hashed if the
+// privacy configuration hashes identities.
+type decisionRequest struct {
+	SessionID   string              `json:"sessionId"`
+	Method      string              `json:"method"`
+	Host        string              `json:"host"`
+	Path        string              `json:"path"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Cookies     map[string]string   `json:"cookies,omitempty"`
+	Experiments map[string][]string `json:"experiments,omitempty"`
+}
+
+// decisionAnswer is the response of the decision service: an experiment variant, a backend, or
+// neither to leave the request to the rules.
+type decisionAnswer struct {
+	Experiment string `json:"experiment,omitempty"`
+	Variant    string `json:"variant,omitempty"`
+	Backend    string `json:"backend,omitempty"`
+}
+
+// newRemoteDecisions returns nil when no decision service is configured.
+func newRemoteDecisions(cfg *config.Config, logger logger.Logger, registry *metrics.Registry) (*remoteDecisions, error) {
+	decision := cfg.Decision
+	if decision == nil {
+		return nil, nil
+	}
+	if decision.Type != decisionRemote {
+		return nil, fmt.Errorf("%w: unknown type %q", errInvalidDecision, decision.Type)
+	}
+	if u, err := url.Parse(decision.URL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%w: url %q", errInvalidDecision, decision.URL)
+	}
+	timeout, err := parseDecisionDuration("timeout", decision.Timeout, defaultDecisionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		return nil, fmt.Errorf("%w: timeout must be positive", errInvalidDecision)
+	}
+	ttl, err := parseDecisionDuration("cache TTL", decision.CacheTTL, defaultDecisionCacheTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &remoteDecisions{
+		url:     decision.URL,
+		client:  &http.Client{Timeout: timeout},
+		timeout: timeout,
+		ttl:     ttl,
+		headers: decision.Headers,
+		cookies: decision.Cookies,
+		results: registry.Counter("forklift_remote_decisions_total",
+			"Number of requests routed by the decision service by result: decided, deferred, unknown or error.", "result"),
+		logger: logger,
+		cache:  make(map[string]cachedDecision),
+	}, nil
+}
+
+func parseDecisionDuration(name, value string, defaultValue time.Duration) (time.Duration, error) {
+	if value == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%w: %s %s", errInvalidDecision, name, value)
+	}
+	return d, nil
+}
+
+// remoteDecision routes a request as the decision service answers. Requests it leaves to the
+// rules, answers naming a variant or backend the rules don't have, and failures to get an answer
+// are routed by the rules.
+func (a *Forklift) remoteDecision(req *http.Request, sessionID string) (SelectedBackend, bool) {
+	r := a.remote
+	answer, err := r.answer(req.Context(), a.scrubber.identity(sessionID)+" "+req.Method+" "+req.URL.Path, a.now(),
+		func() decisionRequest { return a.decisionRequest(req, sessionID) })
+	if err != nil {
+		r.results.Inc("error")
+		a.logger.Errorf("Error asking the decision service: %v", err)
+		return SelectedBackend{}, false
+	}
+	if answer == (decisionAnswer{}) {
+		r.results.Inc("deferred")
+		return SelectedBackend{}, false
+	}
+	selected, ok := a.resolveDecision(req, answer)
+	if !ok {
+		r.results.Inc("unknown")
+		a.logger.Warnf("Decision service answered an unknown variant or backend: %+v", answer)
+		return SelectedBackend{}, false
+	}
+	r.results.Inc("decided")
+	return selected, true
+}
+
+// decisionRequest describes a request to the decision service.
+func (a *Forklift) decisionRequest(req *http.Request, sessionID string) decisionRequest {
+	dr := decisionRequest{
+		SessionID: a.scrubber.identity(sessionID),
+		Method:    req.Method,
+		Host:      req.Host,
+		Path:      req.URL.Path,
+	}
+	for _, name := range a.remote.headers {
+		if value := req.Header.Get(name); value != "" {
+			if dr.Headers == nil {
+				dr.Headers = make(map[string]string, len(a.remote.headers))
+			}
+			dr.Headers[name] = value
+		}
+	}
+	for _, name := range a.remote.cookies {
+		if cookie, err := req.Cookie(name); err == nil {
+			if dr.Cookies == nil {
+				dr.Cookies = make(map[string]string, len(a.remote.cookies))
+			}
+			dr.Cookies[name] = cookie.Value
+		}
+	}
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		if rule.Experiment == "" || rule.Variant == "" || rule.Paused || a.warming(rule) || !a.ruleEngine.matchPath(req, rule) {
+			continue
+		}
+		if dr.Experiments == nil {
+			dr.Experiments = make(map[string][]string)
+		}
+		if !containsString(dr.Experiments[rule.Experiment], rule.Variant) {
+			dr.Experiments[rule.Experiment] = append(dr.Experiments[rule.Experiment], rule.Variant)
+		}
+	}
+	return dr
+}
+
+// resolveDecision returns the selection of an answer: the first active rule of the variant
+// matching the request's path and method, or the named backend if it is the default backend or
+// the backend of a rule, so the service can't send requests anywhere else.
+func (a *Forklift) resolveDecision(req *http.Request, answer decisionAnswer) (SelectedBackend, bool) {
+	var fallback *RoutingRule
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		if rule.Paused || rule.Flag != nil || a.warming(rule) {
+			continue
+		}
+		if answer.Variant != "" {
+			if rule.Experiment == answer.Experiment && rule.Variant == answer.Variant &&
+				a.ruleEngine.matchPath(req, rule) && a.ruleEngine.matchMethod(req, rule) {
+				return SelectedBackend{Backend: backendKey(*rule), Rule: rule, Reason: reasonRemote}, true
+			}
+			continue
+		}
+		if rule.Backend == answer.Backend {
+			if a.ruleEngine.matchPath(req, rule) && a.ruleEngine.matchMethod(req, rule) {
+				return SelectedBackend{Backend: rule.Backend, Rule: rule, Reason: reasonRemote}, true
+			}
+			if fallback == nil {
+				fallback = rule
+			}
+		}
+	}
+	if answer.Variant == "" && (answer.Backend == a.config.DefaultBackend || fallback != nil) {
+		return SelectedBackend{Backend: answer.Backend, Reason: reasonRemote}, true
+	}
+	return SelectedBackend{}, false
+}
+
+// answer returns the cached answer for key, or asks the decision service. Errors are not cached.
+func (r *remoteDecisions) answer(ctx context.Context, key string, now time.Time, request func() decisionRequest) (decisionAnswer, error) {
+	if r.ttl > 0 {
+		r.mu.Lock()
+		cached, ok := r.cache[key]
+		r.mu.Unlock()
+		if ok && now.Before(cached.expires) {
+			return cached.answer, nil
+		}
+	}
+
+	answer, err := r.ask(ctx, request())
+	if err != nil {
+		return decisionAnswer{}, err
+	}
+	if r.ttl > 0 {
+		r.mu.Lock()
+		if len(r.cache) >= maxDecisionCacheEntries {
+			for k, cached := range r.cache {
+				if !now.Before(cached.expires) {
+					delete(r.cache, k)
+				}
+			}
+		}
+		if len(r.cache) < maxDecisionCacheEntries {
+			r.cache[key] = cachedDecision{answer: answer, expires: now.Add(r.ttl)}
+		}
+		r.mu.Unlock()
+	}
+	return answer, nil
+}
+
+// ask POSTs a request's context to the decision service. A 204 No Content leaves the request to
+// the rules.
+func (r *remoteDecisions) ask(ctx context.Context, dr decisionRequest) (decisionAnswer, error) {
+	body, err := json.Marshal(dr)
+	if err != nil {
+		return decisionAnswer{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return decisionAnswer{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return decisionAnswer{}, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return decisionAnswer{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return decisionAnswer{}, fmt.Errorf("%w: %s", errDecisionStatus, resp.Status)
+	}
+	var answer decisionAnswer
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxDecisionResponseBytes)).Decode(&answer); err != nil {
+		return decisionAnswer{}, fmt.Errorf("decoding decision: %w", err)
+	}
+	return answer, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package forklift
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const (
+	adminDecisionsPath = "/decisions"
+	// defaultDecisionsLimit is the number of decisions served when the query sets no limit.
+	defaultDecisionsLimit = 100
+)
+
+// decisionLog keeps the most recent routing decisions in a ring buffer for the admin API, so a
+// production issue can be looked into without a metrics stack. It is shared by the middleware and
+// the copies created for each rule change.
+type decisionLog struct {
+	mu        sync.Mutex
+	decisions []decision
+	// next is the index the next decision is written to, and full whether the ring has wrapped.
+	next int
+	full bool
+}
+
+// decision is a routing decision and the outcome of the request. Rule is the rule's key, or
+// "default" for the default backend. Session IDs and query strings are not kept.
+type decision struct {
+	Time       time.Time `json:"time"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Rule       string    `json:"rule"`
+	Experiment string    `json:"experiment,omitempty"`
+	Variant    string    `json:"variant,omitempty"`
+	Backend    string    `json:"backend"`
+	Reason     string    `json:"reason,omitempty"`
+	Assignment string    `json:"assignment,omitempty"`
+	Status     int       `json:"status"`
+	LatencyMS  float64   `json:"latencyMs"`
+}
+
+// newDecisionLog returns nil when the admin API keeps no decisions.
+func newDecisionLog(cfg *config.Config) (*decisionLog, error) {
+	if cfg.AdminAPI == nil || cfg.AdminAPI.Decisions == 0 {
+		return nil, nil
+	}
+	if cfg.AdminAPI.Decisions < 0 {
+		return nil, fmt.Errorf("%w: decisions must be positive", errInvalidAdminAPI)
+	}
+	return &decisionLog{decisions: make([]decision, cfg.AdminAPI.Decisions)}, nil
+}
+
+// recordDecision keeps the decision of a served request, replacing the oldest one once the log
+// is full.
+func (a *Forklift) recordDecision(hc *HookContext, start time.Time) {
+	l := a.decisions
+	if l == nil {
+		return
+	}
+	d := decision{
+		Time:       start.UTC(),
+		RequestID:  hc.RequestID,
+		Method:     hc.Request.Method,
+		Path:       hc.Request.URL.Path,
+		Rule:       reasonDefault,
+		Backend:    backendURL(hc.Selected),
+		Reason:     hc.Selected.Reason,
+		Assignment: hc.Selected.Assignment,
+		Status:     hc.Status,
+		LatencyMS:  float64(hc.Duration.Microseconds()) / 1000,
+	}
+	if hc.Selected.Rule != nil {
+		d.Rule = a.ruleKey(hc.Selected.Rule)
+	}
+	d.Experiment, d.Variant = exposureLabels(hc.Selected)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions[l.next] = d
+	l.next++
+	if l.next == len(l.decisions) {
+		l.next, l.full = 0, true
+	}
+}
+
+// recent returns up to limit decisions matching filter, newest first.
+func (l *decisionLog) recent(limit int, filter func(d *decision) bool) []decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := l.next
+	if l.full {
+		count = len(l.decisions)
+	}
+	if limit > count {
+		limit = count
+	}
+	result := make([]decision, 0, limit)
+	for i := 1; i <= count && len(result) < limit; i++ {
+		d := &l.decisions[(l.next-i+len(l.decisions))%len(l.decisions)]
+		if filter(d) {
+			result = append(result, *d)
+		}
+	}
+	return result
+}
+
+// serveDecisions serves the most recent decisions, newest first, filtered by the rule,
+// experiment, variant, backend and status query parameters. The status may be a class, e.g. 5xx.
+// limit caps the number of decisions served.
+func (a *Forklift) serveDecisions(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.decisions == nil {
+		http.Error(rw, "The admin API keeps no decisions", http.StatusNotImplemented)
+		return
+	}
+
+	query := req.URL.Query()
+	limit := defaultDecisionsLimit
+	if value := query.Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			http.Error(rw, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	status := query.Get("status")
+	statusClass := len(status) == 3 && status[1:] == "xx"
+	filters := map[string]func(d *decision) string{
+		"rule":       func(d *decision) string { return d.Rule },
+		"experiment": func(d *decision) string { return d.Experiment },
+		"variant":    func(d *decision) string { return d.Variant },
+		"backend":    func(d *decision) string { return d.Backend },
+	}
+	decisions := a.decisions.recent(limit, func(d *decision) bool {
+		for name, field := range filters {
+			if value := query.Get(name); value != "" && field(d) != value {
+				return false
+			}
+		}
+		if status == "" {
+			return true
+		}
+		code := strconv.Itoa(d.Status)
+		if statusClass {
+			return code[0] == status[0]
+		}
+		return code == status
+	})
+
+	rw.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{"decisions": decisions})
+}
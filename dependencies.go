@@ -0,0 +1,191 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errUnknownDependency = errors.New("rule depends on unknown experiment")
+	errDependencyCycle   = errors.New("experiment dependencies form a cycle")
+)
+
+// experimentGroups returns, per experiment, the rules of the first path group of the experiment
+// in priority order. The split of that group decides which variant a session belongs to.
+func experimentGroups(rules []RoutingRule) map[string][]*RoutingRule {
+	groups := make(map[string][]*RoutingRule)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Experiment == "" {
+			continue
+		}
+		group := groups[rule.Experiment]
+		if len(group) > 0 && rulePathKey(group[0]) != rulePathKey(rule) {
+			continue
+		}
+		groups[rule.Experiment] = append(group, rule)
+	}
+	return groups
+}
+
+// ruleDependencies returns the experiment memberships a rule depends on.
+func ruleDependencies(rule *RoutingRule) []*config.ExperimentMembership {
+	var dependencies []*config.ExperimentMembership
+	if rule.Requires != nil {
+		dependencies = append(dependencies, rule.Requires)
+	}
+	if rule.Excludes != nil {
+		dependencies = append(dependencies, rule.Excludes)
+	}
+	return dependencies
+}
+
+// validateDependencies checks that rules only depend on known experiments and that no
+// experiment transitively depends on itself.
+func validateDependencies(rules []RoutingRule) error {
+	experiments := experimentGroups(rules)
+	edges := make(map[string][]string)
+	for i := range rules {
+		rule := &rules[i]
+		for _, dependency := range ruleDependencies(rule) {
+			if _, ok := experiments[dependency.Experiment]; !ok {
+				return fmt.Errorf("%w: %s", errUnknownDependency, dependency.Experiment)
+			}
+			if rule.Experiment != "" {
+				edges[rule.Experiment] = append(edges[rule.Experiment], dependency.Experiment)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := make(map[string]int)
+	var visit func(experiment string) error
+	visit = func(experiment string) error {
+		switch state[experiment] {
+		case visiting:
+			return fmt.Errorf("%w: %s", errDependencyCycle, experiment)
+		case done:
+			return nil
+		}
+		state[experiment] = visiting
+		for _, next := range edges[experiment] {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		state[experiment] = done
+		return nil
+	}
+	for experiment := range edges {
+		if err := visit(experiment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dependenciesMet reports whether the session satisfies the requires and excludes constraints
+// of a rule.
+func (a *Forklift) dependenciesMet(req *http.Request, sessionID string, rule *RoutingRule) bool {
+	if rule.Requires != nil && !a.isMember(req, sessionID, rule.Requires) {
+		if a.config.Debug {
+			a.logger.Debugf("Session is not in required experiment %s", rule.Requires.Experiment)
+		}
+		return false
+	}
+	if rule.Excludes != nil && a.isMember(req, sessionID, rule.Excludes) {
+		if a.config.Debug {
+			a.logger.Debugf("Session is in excluded experiment %s", rule.Excludes.Experiment)
+		}
+		return false
+	}
+	return true
+}
+
+// isMember reports whether the session is assigned to the given variant of an experiment, or to
+// any of its variants if none is given.
+func (a *Forklift) isMember(req *http.Request, sessionID string, membership *config.ExperimentMembership) bool {
+	variant, ok := a.experimentVariant(req, sessionID, membership.Experiment)
+	if !ok {
+		return false
+	}
+	return membership.Variant == "" || membership.Variant == variant
+}
+
+// experimentVariant returns the variant of an experiment the session is assigned to. The
+// assignment is the one the session has on the experiment's path, independent of the path of the
+// request at hand, so membership is stable across paths. It is only read, never made: with a
+// session store the session is a member once it was assigned a variant there, and without one, or
+// when the store can't be read, the variant is the one the hash of the session picks. Rules whose
+// conditions don't hold for the request don't count.
+func (a *Forklift) experimentVariant(req *http.Request, sessionID, experiment string) (string, bool) {
+	scratch, _ := selectionScratchPool.Get().(*selectionScratch)
+	defer selectionScratchPool.Put(scratch)
+
+	rules := scratch.group[:0]
+	for _, rule := range a.experiments[experiment] {
+		if !rule.Paused && a.ruleEngine.matchConditions(req, rule) && a.dependenciesMet(req, sessionID, rule) {
+			rules = append(rules, rule)
+		}
+	}
+	scratch.group = rules
+	if len(rules) == 0 {
+		return "", false
+	}
+
+	for _, rule := range rules {
+		if rule.Percentage == 0 && a.drainAdmits(req, rule) {
+			return rule.Variant, true
+		}
+	}
+
+	if group := assignmentGroup(rules); group != "" {
+		return a.groupVariant(req, sessionID, group, rules)
+	}
+	var backend string
+	var found bool
+	if a.sessionStore != nil {
+		var err error
+		backend, found, err = a.storedAssignment(context.Background(), a.assignmentKey(sessionID, rulePathKey(rules[0])))
+		if err == nil && (!found || a.drainedBackend(rules, backend)) {
+			return "", false
+		}
+	}
+	if !found {
+		scratch.shares = a.calculateBackendPercentages(rules, a.requestCountry(req, rules), scratch.shares[:0])
+		backend = a.admitDrain(req, a.selectBackendByPercentageAndRuleHash(sessionID, scratch.shares, rules), rules)
+	}
+	for _, rule := range rules {
+		if backendKey(*rule) == backend {
+			return rule.Variant, true
+		}
+	}
+	return "", false
+}
+
+// groupVariant returns the variant of an assignment group the session is assigned to, read like
+// experimentVariant reads the assignment of a path.
+func (a *Forklift) groupVariant(req *http.Request, sessionID, group string, rules []*RoutingRule) (string, bool) {
+	if a.sessionStore != nil {
+		variant, found, err := a.storedAssignment(context.Background(), a.assignmentKey(sessionID, assignmentGroupKeyPrefix+group))
+		if err == nil {
+			rule := variantRule(rules, variant)
+			if !found || rule == nil || a.drained(rule) {
+				return "", false
+			}
+			return rule.Variant, true
+		}
+	}
+	rule := a.selectVariantByHash(sessionID, group, rules)
+	if rule == nil || a.admitDrain(req, backendKey(*rule), rules) != backendKey(*rule) {
+		return "", false
+	}
+	return rule.Variant, true
+}
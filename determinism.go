@@ -0,0 +1,71 @@
+package forklift
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// clockSetter is implemented by session stores whose TTLs follow an injectable clock.
+type clockSetter interface {
+	SetClock(now func() time.Time)
+}
+
+// lockedReader serializes reads from a random source that is not safe for concurrent use,
+// such as a seeded math/rand.Rand.
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return io.ReadFull(l.r, p)
+}
+
+// SetRandomSource replaces the source session IDs are generated from, which decides how new
+// sessions are bucketed. Tests can pass a seeded math/rand.Rand to get the same assignments on
+// every run. It must be called before the middleware serves requests.
+func (a *Forklift) SetRandomSource(random io.Reader) {
+	a.random = &lockedReader{r: random}
+	if active := a.current(); active != a {
+		active.random = a.random
+	}
+}
+
+// SetClock replaces the clock used for first-seen times, new session windows, drains, exposure
+// events, remote decisions, exported results, the TTLs of the session store and the refreshes of
+// flag providers. It must be called before the middleware serves requests.
+func (a *Forklift) SetClock(now func() time.Time) {
+	a.now = now
+	a.ruleEngine.now = now
+	if setter, ok := a.sessionStore.(clockSetter); ok {
+		setter.SetClock(now)
+	}
+	if a.migrator != nil {
+		if setter, ok := a.migrator.marks.(clockSetter); ok {
+			setter.SetClock(now)
+		}
+	}
+	if a.exposures != nil {
+		a.exposures.now = now
+	}
+	if a.results != nil {
+		a.results.restart(now())
+	}
+	for _, provider := range a.flagProviders {
+		if setter, ok := provider.Provider.(clockSetter); ok {
+			setter.SetClock(now)
+		}
+	}
+	if active := a.current(); active != a {
+		active.now = now
+		active.ruleEngine.now = now
+		if active.migrator != nil {
+			if setter, ok := active.migrator.marks.(clockSetter); ok {
+				setter.SetClock(now)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var errInvalidDrain = errors.New("invalid drain: since must be an RFC 3339 time and gracePeriod a non-negative duration")
+
+// drainWindow is the parsed drain of a rule. New sessions stop being assigned at since, and
+// sessions assigned before keep the rule until until.
+type drainWindow struct {
+	since time.Time
+	until time.Time
+}
+
+func parseDrain(rule *RoutingRule) (drainWindow, error) {
+	since, err := time.Parse(time.RFC3339, rule.Drain.Since)
+	if err != nil {
+		return drainWindow{}, fmt.Errorf("%w: %s", errInvalidDrain, rule.Drain.Since)
+	}
+	var grace time.Duration
+	if rule.Drain.GracePeriod != "" {
+		grace, err = time.ParseDuration(rule.Drain.GracePeriod)
+		if err != nil || grace < 0 {
+			return drainWindow{}, fmt.Errorf("%w: %s", errInvalidDrain, rule.Drain.GracePeriod)
+		}
+	}
+	return drainWindow{since: since, until: since.Add(grace)}, nil
+}
+
+// drainWindows parses the drains of all draining rules.
+func drainWindows(rules []RoutingRule) (map[*RoutingRule]drainWindow, error) {
+	windows := make(map[*RoutingRule]drainWindow)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Drain == nil {
+			continue
+		}
+		window, err := parseDrain(rule)
+		if err != nil {
+			return nil, err
+		}
+		windows[rule] = window
+	}
+	return windows, nil
+}
+
+// drained reports whether the grace period of a draining rule is over, after which the rule no
+// longer admits any session. Drained rules still take part in the hash of their group, so
+// removing them from the split does not move the sessions of the other backends.
+func (a *Forklift) drained(rule *RoutingRule) bool {
+	return rule.Drain != nil && a.now().After(a.drains[rule].until)
+}
+
+// drainedBackend reports whether backend is the target of a drained rule.
+func (a *Forklift) drainedBackend(rules []*RoutingRule, backend string) bool {
+	rule := drainingRule(rules, backend)
+	return rule != nil && a.drained(rule)
+}
+
+// drainAdmits reports whether the session may still be routed by a rule it isn't known to be
+// assigned to, for rules whose assignments aren't stored. Rules that are not draining admit
+// everyone; draining rules only admit sessions that existed before the drain, as the session
+// would then have been assigned the rule, until the grace period is over. Sessions created before
+// first-seen tracking count as existing.
+func (a *Forklift) drainAdmits(req *http.Request, rule *RoutingRule) bool {
+	if rule.Drain == nil || a.now().Before(a.drains[rule].since) {
+		return true
+	}
+	if a.drained(rule) {
+		return false
+	}
+	cookie, err := req.Cookie(sessionCookieName)
+	if err != nil || !isValidSessionID(cookie.Value) {
+		return false
+	}
+	firstSeen, ok := sessionFirstSeen(req)
+	admitted := !ok || firstSeen.Before(a.drains[rule].since)
+	if a.config.Debug {
+		a.logger.Debugf("Rule for %s is draining, session admitted: %v", backendKey(*rule), admitted)
+	}
+	return admitted
+}
+
+// admitDrain returns the default backend in place of a draining backend the session may no
+// longer be assigned to. The share of the draining backend is not redistributed, so the
+// assignments of the other backends don't move.
+func (a *Forklift) admitDrain(req *http.Request, backend string, rules []*RoutingRule) string {
+	if rule := drainingRule(rules, backend); rule != nil && !a.drainAdmits(req, rule) {
+		return a.config.DefaultBackend
+	}
+	return backend
+}
+
+// refuseDrain returns the default backend in place of a backend that has started draining, for
+// sessions the session store holds no assignment to it for. Only the stored assignment admits a
+// session to a draining backend, so sessions that existed before the drain but were assigned
+// elsewhere, e.g. before the percentages changed, aren't moved to it.
+func (a *Forklift) refuseDrain(backend string, rules []*RoutingRule) string {
+	if rule := drainingRule(rules, backend); rule != nil && !a.now().Before(a.drains[rule].since) {
+		return a.config.DefaultBackend
+	}
+	return backend
+}
+
+// drainingRule returns the draining rule targeting backend, if any.
+func drainingRule(rules []*RoutingRule, backend string) *RoutingRule {
+	for _, rule := range rules {
+		if rule.Drain != nil && backendKey(*rule) == backend {
+			return rule
+		}
+	}
+	return nil
+}
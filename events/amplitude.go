@@ -0,0 +1,104 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errAmplitudeStatus = errors.New("amplitude returned an error")
+
+const (
+	defaultAmplitudeURL = "https://api2.amplitude.com"
+
+	// amplitudeExposure is the event type Amplitude Experiment analyzes exposures from.
+	amplitudeExposure = "$exposure"
+
+	// Amplitude rejects device and user IDs shorter than this.
+	amplitudeMinIDLength = 5
+)
+
+// AmplitudeSink sends exposures to Amplitude's HTTP V2 API as $exposure events. Events are keyed
+// on the exposure's ID as a device or user ID, or on the session ID as the device ID when the
+// exposure has no usable ID.
+type AmplitudeSink struct {
+	url    string
+	apiKey string
+	userID bool
+	client *http.Client
+}
+
+type amplitudeEvent struct {
+	EventType       string                 `json:"event_type"`
+	DeviceID        string                 `json:"device_id,omitempty"`
+	UserID          string                 `json:"user_id,omitempty"`
+	Time            int64                  `json:"time"`
+	InsertID        string                 `json:"insert_id"`
+	EventProperties map[string]interface{} `json:"event_properties"`
+}
+
+// NewAmplitudeSink creates a sink for the project with apiKey, sending to baseURL or Amplitude's
+// API if it is empty. With userID, exposure IDs are sent as user IDs rather than device IDs.
+func NewAmplitudeSink(baseURL, apiKey string, userID bool, timeout time.Duration) *AmplitudeSink {
+	if baseURL == "" {
+		baseURL = defaultAmplitudeURL
+	}
+	return &AmplitudeSink{
+		url:    strings.TrimSuffix(baseURL, "/") + "/2/httpapi",
+		apiKey: apiKey,
+		userID: userID,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Send implements Sink.
+func (s *AmplitudeSink) Send(ctx context.Context, batch []Exposure) error {
+	amplitudeEvents := make([]amplitudeEvent, len(batch))
+	for i, exposure := range batch {
+		event := amplitudeEvent{
+			EventType: amplitudeExposure,
+			Time:      exposure.Time.UnixMilli(),
+			InsertID:  messageID(),
+			EventProperties: map[string]interface{}{
+				"flag_key":   exposure.Experiment,
+				"variant":    exposure.Variant,
+				"backend":    exposure.Backend,
+				"path":       exposure.Path,
+				"status":     exposure.Status,
+				"request_id": exposure.RequestID,
+				"assignment": exposure.Assignment,
+			},
+		}
+		switch {
+		case len(exposure.ID) < amplitudeMinIDLength:
+			event.DeviceID = exposure.SessionID
+		case s.userID:
+			event.UserID = exposure.ID
+		default:
+			event.DeviceID = exposure.ID
+		}
+		amplitudeEvents[i] = event
+	}
+	data, err := json.Marshal(map[string]interface{}{"api_key": s.apiKey, "events": amplitudeEvents})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return statusError(errAmplitudeStatus, resp)
+}
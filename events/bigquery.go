@@ -0,0 +1,334 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errBigQueryStatus = errors.New("bigquery returned an error")
+
+const (
+	defaultBigQueryURL   = "https://bigquery.googleapis.com"
+	defaultBigQueryTable = "exposures"
+	bigQueryScope        = "https://www.googleapis.com/auth/bigquery"
+)
+
+// bigQueryField is a column of the exposure table.
+type bigQueryField struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+}
+
+// bigQueryFields is the schema of the exposure table. Like the Avro and Protobuf schemas, it only
+// grows by nullable fields, which are added to existing tables.
+var bigQueryFields = []bigQueryField{
+	{Name: "time", Type: "TIMESTAMP", Mode: "REQUIRED"},
+	{Name: "experiment", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "variant", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "backend", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "session_id", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "id", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "request_id", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "path", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "status", Type: "INTEGER", Mode: "NULLABLE"},
+	{Name: "schema_version", Type: "INTEGER", Mode: "NULLABLE"},
+	{Name: "duration_ms", Type: "INTEGER", Mode: "NULLABLE"},
+	{Name: "assignment", Type: "STRING", Mode: "NULLABLE"},
+}
+
+// BigQuerySink streams exposures into a BigQuery table with the tabledata.insertAll API. Rows
+// carry an insert ID derived from the exposure, so BigQuery deduplicates retried batches. The
+// table is created, partitioned by day on the exposure time, before the first batch is sent if
+// it doesn't exist, and fields missing from an existing table are added.
+//
+// Rows BigQuery rejects, such as values that don't fit a column changed by hand, are appended to
+// the dead-letter file as JSON lines with the errors, and the rest of the batch is inserted.
+// Without a dead-letter file, a batch with a rejected row is rejected as a whole.
+//
+// Requests are authorized with the API key as an OAuth access token if set, or tokens from
+// GOOGLE_OAUTH_ACCESS_TOKEN, the service account key file in GOOGLE_APPLICATION_CREDENTIALS or
+// the GCE metadata server.
+type BigQuerySink struct {
+	tables     string
+	table      string
+	project    string
+	dataset    string
+	deadLetter string
+	tokens     *googleTokenSource
+	client     *http.Client
+	now        func() time.Time
+
+	mu    sync.Mutex
+	ready bool
+}
+
+type bigQueryRow struct {
+	InsertID string                 `json:"insertId"`
+	JSON     map[string]interface{} `json:"json"`
+}
+
+type bigQueryInsertError struct {
+	Index  int `json:"index"`
+	Errors []struct {
+		Reason   string `json:"reason"`
+		Location string `json:"location,omitempty"`
+		Message  string `json:"message"`
+	} `json:"errors"`
+}
+
+// NewBigQuerySink creates a sink streaming into table, or "exposures", of dataset in project,
+// through the API at baseURL or BigQuery's if it is empty.
+func NewBigQuerySink(baseURL, token, project, dataset, table, deadLetterPath string, timeout time.Duration) (*BigQuerySink, error) {
+	if project == "" || dataset == "" {
+		return nil, fmt.Errorf("%w: bigquery sinks require a project and dataset", errInvalidSink)
+	}
+	if baseURL == "" {
+		baseURL = defaultBigQueryURL
+	}
+	if table == "" {
+		table = defaultBigQueryTable
+	}
+	if deadLetterPath != "" {
+		f, err := os.OpenFile(deadLetterPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidSink, err)
+		}
+		_ = f.Close()
+	}
+	client := &http.Client{Timeout: timeout}
+	tokens, err := newGoogleTokenSource(token, bigQueryScope, client)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidSink, err)
+	}
+	return &BigQuerySink{
+		tables: strings.TrimSuffix(baseURL, "/") + "/bigquery/v2/projects/" + url.PathEscape(project) +
+			"/datasets/" + url.PathEscape(dataset) + "/tables",
+		table:      table,
+		project:    project,
+		dataset:    dataset,
+		deadLetter: deadLetterPath,
+		tokens:     tokens,
+		client:     client,
+		now:        time.Now,
+	}, nil
+}
+
+// Send implements Sink.
+func (b *BigQuerySink) Send(ctx context.Context, batch []Exposure) error {
+	if err := b.ensureTable(ctx); err != nil {
+		return err
+	}
+
+	rows := make([]bigQueryRow, len(batch))
+	for i, exposure := range batch {
+		rows[i] = bigQueryRow{
+			InsertID: exposureID(exposure),
+			JSON: map[string]interface{}{
+				"time":           exposure.Time.UTC().Format(time.RFC3339Nano),
+				"experiment":     exposure.Experiment,
+				"variant":        exposure.Variant,
+				"backend":        exposure.Backend,
+				"session_id":     exposure.SessionID,
+				"id":             exposure.ID,
+				"request_id":     exposure.RequestID,
+				"path":           exposure.Path,
+				"status":         exposure.Status,
+				"schema_version": ExposureSchemaVersion,
+				"duration_ms":    exposure.DurationMS,
+				"assignment":     exposure.Assignment,
+			},
+		}
+	}
+	resp, err := b.do(ctx, http.MethodPost, b.tables+"/"+url.PathEscape(b.table)+"/insertAll", map[string]interface{}{
+		"skipInvalidRows": b.deadLetter != "",
+		"rows":            rows,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode == http.StatusNotFound {
+		// The table was deleted since it was checked: create it again for the next batch.
+		b.mu.Lock()
+		b.ready = false
+		b.mu.Unlock()
+		return fmt.Errorf("%w: table %s not found", errBigQueryStatus, b.table)
+	}
+	if err := statusError(errBigQueryStatus, resp); err != nil {
+		return err
+	}
+
+	var inserted struct {
+		InsertErrors []bigQueryInsertError `json:"insertErrors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inserted); err != nil {
+		return fmt.Errorf("%w: %w", errBigQueryStatus, err)
+	}
+	if len(inserted.InsertErrors) == 0 {
+		return nil
+	}
+	if b.deadLetter == "" {
+		return fmt.Errorf("%w: %w: %d rows rejected", ErrPermanent, errBigQueryStatus, len(inserted.InsertErrors))
+	}
+	// The valid rows were inserted, so the batch must not be retried even if the rejected rows
+	// can't be kept.
+	if err := b.writeDeadLetters(batch, inserted.InsertErrors); err != nil {
+		return fmt.Errorf("%w: writing dead letters: %w", ErrPermanent, err)
+	}
+	return nil
+}
+
+// writeDeadLetters appends the rejected exposures to the dead-letter file with their errors.
+func (b *BigQuerySink) writeDeadLetters(batch []Exposure, rejected []bigQueryInsertError) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, insertErr := range rejected {
+		if insertErr.Index < 0 || insertErr.Index >= len(batch) {
+			continue
+		}
+		if err := enc.Encode(map[string]interface{}{
+			"rejected": b.now().UTC(),
+			"exposure": batch[insertErr.Index],
+			"errors":   insertErr.Errors,
+		}); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := os.OpenFile(b.deadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ensureTable creates the table if it doesn't exist, or adds the fields it lacks, once.
+func (b *BigQuerySink) ensureTable(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ready {
+		return nil
+	}
+
+	resp, err := b.do(ctx, http.MethodGet, b.tables+"/"+url.PathEscape(b.table), nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		err = b.createTable(ctx)
+	case resp.StatusCode == http.StatusOK:
+		var table struct {
+			Schema struct {
+				Fields []map[string]interface{} `json:"fields"`
+			} `json:"schema"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&table); err != nil {
+			return fmt.Errorf("%w: %w", errBigQueryStatus, err)
+		}
+		err = b.addMissingFields(ctx, table.Schema.Fields)
+	default:
+		err = statusError(errBigQueryStatus, resp)
+	}
+	if err != nil {
+		return err
+	}
+	b.ready = true
+	return nil
+}
+
+func (b *BigQuerySink) createTable(ctx context.Context) error {
+	resp, err := b.do(ctx, http.MethodPost, b.tables, map[string]interface{}{
+		"tableReference": map[string]string{
+			"projectId": b.project,
+			"datasetId": b.dataset,
+			"tableId":   b.table,
+		},
+		"schema":           map[string]interface{}{"fields": bigQueryFields},
+		"timePartitioning": map[string]string{"type": "DAY", "field": "time"},
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	// Another instance may have created the table first.
+	if resp.StatusCode == http.StatusConflict {
+		return nil
+	}
+	return statusError(errBigQueryStatus, resp)
+}
+
+// addMissingFields patches the schema of an existing table with the fields it lacks, as nullable
+// fields since BigQuery can't add required ones.
+func (b *BigQuerySink) addMissingFields(ctx context.Context, fields []map[string]interface{}) error {
+	existing := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if name, ok := field["name"].(string); ok {
+			existing[strings.ToLower(name)] = true
+		}
+	}
+	missing := false
+	for _, field := range bigQueryFields {
+		if !existing[field.Name] {
+			fields = append(fields, map[string]interface{}{"name": field.Name, "type": field.Type, "mode": "NULLABLE"})
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+
+	resp, err := b.do(ctx, http.MethodPatch, b.tables+"/"+url.PathEscape(b.table), map[string]interface{}{
+		"schema": map[string]interface{}{"fields": fields},
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return statusError(errBigQueryStatus, resp)
+}
+
+// do sends an authorized request to the BigQuery API with body encoded as JSON.
+func (b *BigQuerySink) do(ctx context.Context, method, target string, body interface{}) (*http.Response, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, payload)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	token, err := b.tokens.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return b.client.Do(req)
+}
@@ -0,0 +1,239 @@
+package events
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var errCorruptBuffer = errors.New("corrupt event buffer")
+
+const (
+	defaultBufferMaxBytes = 64 << 20
+
+	bufferMagic        = "FKRB"
+	bufferVersion      = 1
+	bufferHeaderSize   = 32
+	bufferRecordHeader = 8
+)
+
+// ringBuffer is an on-disk ring of exposures waiting to be delivered. Exposures are appended
+// before they are sent and only removed once the sink accepts them, so they survive sink outages
+// and restarts. When the ring is full the oldest exposures are overwritten.
+//
+// The file starts with a header holding the capacity of the ring and the logical head and tail
+// offsets, followed by the ring itself. Records are a length and CRC-32 followed by the exposure
+// as JSON, and may wrap around the end of the ring. It is only used from the dispatcher
+// goroutine.
+type ringBuffer struct {
+	f        *os.File
+	capacity uint64
+	head     uint64
+	tail     uint64
+}
+
+// openRingBuffer opens the buffer at path, creating it with the given capacity if it doesn't
+// exist. Existing buffers keep their capacity. A spill file of JSON lines written by earlier
+// versions is converted, keeping its exposures.
+func openRingBuffer(path string, capacity int64) (*ringBuffer, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	r := &ringBuffer{f: f, capacity: uint64(capacity)}
+
+	header := make([]byte, bufferHeaderSize)
+	n, err := f.ReadAt(header, 0)
+	switch {
+	case n == bufferHeaderSize && string(header[:4]) == bufferMagic:
+		r.capacity = binary.BigEndian.Uint64(header[8:16])
+		r.head = binary.BigEndian.Uint64(header[16:24])
+		r.tail = binary.BigEndian.Uint64(header[24:32])
+		if r.capacity <= bufferRecordHeader || r.tail < r.head || r.tail-r.head > r.capacity {
+			_ = f.Close()
+			return nil, errCorruptBuffer
+		}
+		return r, nil
+	case err != nil && !errors.Is(err, io.EOF):
+		_ = f.Close()
+		return nil, err
+	}
+
+	legacy, err := readSpillLines(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(0); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if _, err := r.append(legacy); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// readSpillLines reads the exposures of a spill file of JSON lines.
+func readSpillLines(f *os.File) ([]Exposure, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var exposures []Exposure
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var exposure Exposure
+		if err := json.Unmarshal(scanner.Bytes(), &exposure); err == nil {
+			exposures = append(exposures, exposure)
+		}
+	}
+	return exposures, scanner.Err()
+}
+
+// empty reports whether every buffered exposure has been delivered.
+func (r *ringBuffer) empty() bool {
+	return r.head == r.tail
+}
+
+// append adds exposures to the ring and returns how many older ones were overwritten, or didn't
+// fit at all, to make room.
+func (r *ringBuffer) append(exposures []Exposure) (dropped int, err error) {
+	for _, exposure := range exposures {
+		payload, err := json.Marshal(exposure)
+		if err != nil {
+			return dropped, err
+		}
+		size := uint64(bufferRecordHeader + len(payload))
+		if size > r.capacity {
+			dropped++
+			continue
+		}
+		for r.tail+size-r.head > r.capacity {
+			next, err := r.skip(r.head)
+			if err != nil {
+				// A record we can't read can't be delivered either; start over.
+				next = r.tail
+			}
+			r.head = next
+			dropped++
+		}
+
+		record := make([]byte, size)
+		binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+		copy(record[bufferRecordHeader:], payload)
+		if err := r.writeAt(record, r.tail); err != nil {
+			return dropped, err
+		}
+		r.tail += size
+	}
+	return dropped, r.sync()
+}
+
+// peek returns up to n exposures from the head of the ring and the offset just past them.
+// Corrupt records are skipped.
+func (r *ringBuffer) peek(n int) ([]Exposure, uint64, error) {
+	var exposures []Exposure
+	pos := r.head
+	for len(exposures) < n && pos < r.tail {
+		header := make([]byte, bufferRecordHeader)
+		if err := r.readAt(header, pos); err != nil {
+			return nil, pos, err
+		}
+		length := uint64(binary.BigEndian.Uint32(header[0:4]))
+		if pos+bufferRecordHeader+length > r.tail {
+			// The rest of the ring can't be parsed; deliver what we have and drop the rest.
+			return exposures, r.tail, nil
+		}
+		payload := make([]byte, length)
+		if err := r.readAt(payload, pos+bufferRecordHeader); err != nil {
+			return nil, pos, err
+		}
+		pos += bufferRecordHeader + length
+
+		var exposure Exposure
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) || json.Unmarshal(payload, &exposure) != nil {
+			continue
+		}
+		exposures = append(exposures, exposure)
+	}
+	return exposures, pos, nil
+}
+
+// advance removes the exposures before pos, which have been delivered.
+func (r *ringBuffer) advance(pos uint64) error {
+	r.head = pos
+	if r.head == r.tail {
+		r.head, r.tail = 0, 0
+	}
+	return r.sync()
+}
+
+// skip returns the offset of the record after the one at pos.
+func (r *ringBuffer) skip(pos uint64) (uint64, error) {
+	header := make([]byte, bufferRecordHeader)
+	if err := r.readAt(header, pos); err != nil {
+		return 0, err
+	}
+	next := pos + bufferRecordHeader + uint64(binary.BigEndian.Uint32(header[0:4]))
+	if next > r.tail {
+		return 0, errCorruptBuffer
+	}
+	return next, nil
+}
+
+// sync persists the header, and with it the records written before it.
+func (r *ringBuffer) sync() error {
+	header := make([]byte, bufferHeaderSize)
+	copy(header, bufferMagic)
+	binary.BigEndian.PutUint32(header[4:8], bufferVersion)
+	binary.BigEndian.PutUint64(header[8:16], r.capacity)
+	binary.BigEndian.PutUint64(header[16:24], r.head)
+	binary.BigEndian.PutUint64(header[24:32], r.tail)
+	if _, err := r.f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	return r.f.Sync()
+}
+
+// span returns how many of length bytes at offset fit before the end of the ring.
+func (r *ringBuffer) span(length int, offset uint64) uint64 {
+	if n := uint64(length); n < r.capacity-offset {
+		return n
+	}
+	return r.capacity - offset
+}
+
+// writeAt writes p at a logical offset, wrapping around the end of the ring.
+func (r *ringBuffer) writeAt(p []byte, pos uint64) error {
+	offset := pos % r.capacity
+	n := r.span(len(p), offset)
+	if _, err := r.f.WriteAt(p[:n], int64(bufferHeaderSize+offset)); err != nil {
+		return err
+	}
+	if n < uint64(len(p)) {
+		_, err := r.f.WriteAt(p[n:], bufferHeaderSize)
+		return err
+	}
+	return nil
+}
+
+// readAt reads p from a logical offset, wrapping around the end of the ring.
+func (r *ringBuffer) readAt(p []byte, pos uint64) error {
+	offset := pos % r.capacity
+	n := r.span(len(p), offset)
+	if _, err := r.f.ReadAt(p[:n], int64(bufferHeaderSize+offset)); err != nil {
+		return err
+	}
+	if n < uint64(len(p)) {
+		_, err := r.f.ReadAt(p[n:], bufferHeaderSize)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errClickHouseStatus = errors.New("clickhouse returned an error")
+
+const (
+	defaultClickHouseDatabase = "default"
+	defaultClickHouseTable    = "exposures"
+	clickHouseTime            = "2006-01-02 15:04:05.000"
+	// maxClickHouseError bounds the part of error responses included in errors.
+	maxClickHouseError = 512
+)
+
+// clickHouseIdentifier matches the database and table names the sink accepts, so they can be
+// interpolated into statements.
+var clickHouseIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// clickHouseColumns are the columns of the exposure table. Like the other exposure schemas, they
+// only grow: columns missing from an existing table are added with their defaults.
+var clickHouseColumns = []struct{ name, typ string }{
+	{"time", "DateTime64(3, 'UTC')"},
+	{"experiment", "LowCardinality(String)"},
+	{"variant", "LowCardinality(String)"},
+	{"backend", "LowCardinality(String)"},
+	{"session_id", "String"},
+	{"id", "String"},
+	{"request_id", "String"},
+	{"path", "String"},
+	{"status", "UInt16"},
+	{"duration_ms", "UInt32"},
+	{"assignment", "LowCardinality(String)"},
+}
+
+// ClickHouseSink inserts exposures into a ClickHouse table through the HTTP interface, one
+// INSERT in JSONEachRow format per batch. Before the first batch it creates the table if it
+// doesn't exist, adds the columns an existing table lacks, and creates two rollups fed by
+// materialized views:
+//
+//   - <table>_hourly: exposures, 5xx errors, distinct sessions and duration quantiles by hour,
+//     experiment and variant.
+//   - <table>_status_daily: exposures by day, experiment, variant, backend and status.
+//
+// Batches carry a deduplication token derived from their exposures, so replicated tables
+// deduplicate retried batches. Credentials are "user:password", given as the API key.
+type ClickHouseSink struct {
+	url      string
+	database string
+	table    string
+	user     string
+	password string
+	client   *http.Client
+
+	mu    sync.Mutex
+	ready bool
+}
+
+type clickHouseRow struct {
+	Time       string `json:"time"`
+	Experiment string `json:"experiment"`
+	Variant    string `json:"variant"`
+	Backend    string `json:"backend"`
+	SessionID  string `json:"session_id"`
+	ID         string `json:"id"`
+	RequestID  string `json:"request_id"`
+	Path       string `json:"path"`
+	Status     int    `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+	Assignment string `json:"assignment"`
+}
+
+// NewClickHouseSink creates a sink inserting into table, or "exposures", of database, or
+// "default", on the server at baseURL.
+func NewClickHouseSink(baseURL, credentials, database, table string, timeout time.Duration) (*ClickHouseSink, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: clickhouse sinks require an http:// or https:// url", errInvalidSink)
+	}
+	if database == "" {
+		database = defaultClickHouseDatabase
+	}
+	if table == "" {
+		table = defaultClickHouseTable
+	}
+	if !clickHouseIdentifier.MatchString(database) || !clickHouseIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("%w: invalid clickhouse database or table %s.%s", errInvalidSink, database, table)
+	}
+	sink := &ClickHouseSink{
+		url:      strings.TrimSuffix(baseURL, "/") + "/",
+		database: database,
+		table:    table,
+		client:   &http.Client{Timeout: timeout},
+	}
+	if user, password, ok := strings.Cut(credentials, ":"); ok {
+		sink.user, sink.password = user, password
+	} else {
+		sink.user = credentials
+	}
+	return sink, nil
+}
+
+// Send implements Sink.
+func (c *ClickHouseSink) Send(ctx context.Context, batch []Exposure) error {
+	if err := c.ensureTables(ctx); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	token := sha256.New()
+	for _, exposure := range batch {
+		if err := enc.Encode(clickHouseRow{
+			Time:       exposure.Time.UTC().Format(clickHouseTime),
+			Experiment: exposure.Experiment,
+			Variant:    exposure.Variant,
+			Backend:    exposure.Backend,
+			SessionID:  exposure.SessionID,
+			ID:         exposure.ID,
+			RequestID:  exposure.RequestID,
+			Path:       exposure.Path,
+			Status:     exposure.Status,
+			DurationMS: exposure.DurationMS,
+			Assignment: exposure.Assignment,
+		}); err != nil {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+		token.Write([]byte(exposureID(exposure)))
+	}
+
+	query := url.Values{
+		"query":                      {"INSERT INTO " + c.qualified(c.table) + " FORMAT JSONEachRow"},
+		"insert_deduplication_token": {hex.EncodeToString(token.Sum(nil))},
+	}
+	return c.exec(ctx, query, &body)
+}
+
+// ensureTables creates the exposure table and its rollups, or adds the columns the table lacks,
+// once.
+func (c *ClickHouseSink) ensureTables(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ready {
+		return nil
+	}
+	for _, statement := range c.schema() {
+		if err := c.exec(ctx, nil, strings.NewReader(statement)); err != nil {
+			return err
+		}
+	}
+	c.ready = true
+	return nil
+}
+
+// schema returns the statements creating the exposure table and its rollups. They are
+// idempotent, so every instance runs them when it starts sending.
+func (c *ClickHouseSink) schema() []string {
+	table := c.qualified(c.table)
+	columns := make([]string, len(clickHouseColumns))
+	additions := make([]string, len(clickHouseColumns))
+	for i, column := range clickHouseColumns {
+		columns[i] = column.name + " " + column.typ
+		additions[i] = "ADD COLUMN IF NOT EXISTS " + columns[i]
+	}
+
+	hourly, status := c.qualified(c.table+"_hourly"), c.qualified(c.table+"_status_daily")
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + table + " (" + strings.Join(columns, ", ") + ") " +
+			"ENGINE = MergeTree PARTITION BY toYYYYMM(time) ORDER BY (experiment, variant, time)",
+		"ALTER TABLE " + table + " " + strings.Join(additions, ", "),
+
+		"CREATE TABLE IF NOT EXISTS " + hourly + " (" +
+			"hour DateTime('UTC'), experiment LowCardinality(String), variant LowCardinality(String), " +
+			"exposures SimpleAggregateFunction(sum, UInt64), errors SimpleAggregateFunction(sum, UInt64), " +
+			"sessions AggregateFunction(uniq, String), " +
+			"duration_ms AggregateFunction(quantiles(0.5, 0.95, 0.99), UInt32)) " +
+			"ENGINE = AggregatingMergeTree PARTITION BY toYYYYMM(hour) ORDER BY (experiment, variant, hour)",
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS " + c.qualified(c.table+"_hourly_mv") + " TO " + hourly + " AS " +
+			"SELECT toStartOfHour(time) AS hour, experiment, variant, count() AS exposures, " +
+			"countIf(status >= 500) AS errors, uniqState(session_id) AS sessions, " +
+			"quantilesState(0.5, 0.95, 0.99)(duration_ms) AS duration_ms " +
+			"FROM " + table + " GROUP BY hour, experiment, variant",
+
+		"CREATE TABLE IF NOT EXISTS " + status + " (" +
+			"day Date, experiment LowCardinality(String), variant LowCardinality(String), " +
+			"backend LowCardinality(String), status UInt16, exposures UInt64) " +
+			"ENGINE = SummingMergeTree PARTITION BY toYYYYMM(day) ORDER BY (experiment, variant, backend, status, day)",
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS " + c.qualified(c.table+"_status_daily_mv") + " TO " + status + " AS " +
+			"SELECT toDate(time) AS day, experiment, variant, backend, status, count() AS exposures " +
+			"FROM " + table + " GROUP BY day, experiment, variant, backend, status",
+	}
+}
+
+func (c *ClickHouseSink) qualified(table string) string {
+	return "`" + c.database + "`.`" + table + "`"
+}
+
+// exec runs a statement given in the query parameters or the body.
+func (c *ClickHouseSink) exec(ctx context.Context, query url.Values, body io.Reader) error {
+	target := c.url
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	if c.user != "" {
+		req.Header.Set("X-ClickHouse-User", c.user)
+		req.Header.Set("X-ClickHouse-Key", c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := statusError(errClickHouseStatus, resp); err != nil {
+		// ClickHouse explains failures, such as a column type mismatch, in the body.
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxClickHouseError))
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(message)))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
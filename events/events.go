@@ -0,0 +1,388 @@
+// Package events sends experiment exposures to analytics services.
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errUnknownSinkType = errors.New("unknown event sink type")
+	errMissingAPIKey   = errors.New("event sink requires an api key")
+	errInvalidSink     = errors.New("invalid event sink")
+	errInvalidIDSource = errors.New("invalid event sink id source: must be header:<name> or cookie:<name>")
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = time.Second
+	defaultTimeout       = 5 * time.Second
+	defaultMaxRetries    = 3
+	defaultQueueSize     = 10000
+	retryBackoff         = 100 * time.Millisecond
+)
+
+// Exposure records that a session was served a variant of an experiment. ID is the user or
+// device ID read from the request by the sink's ID source, if it has one, RequestID the
+// X-Request-ID of the request and DurationMS how long serving it took. Assignment is how the
+// session got the variant, e.g. sticky-reuse for a stored assignment or provider-error when a
+// flag provider failed.
+type Exposure struct {
+	Time       time.Time `json:"time"`
+	Experiment string    `json:"experiment"`
+	Variant    string    `json:"variant"`
+	Backend    string    `json:"backend"`
+	SessionID  string    `json:"sessionId"`
+	ID         string    `json:"id,omitempty"`
+	RequestID  string    `json:"requestId,omitempty"`
+	Path       string    `json:"path"`
+	Status     int       `json:"status"`
+	DurationMS int64     `json:"durationMs,omitempty"`
+	Assignment string    `json:"assignment,omitempty"`
+}
+
+// ErrPermanent marks errors that retrying won't fix, such as a rejected payload. Sinks wrap it
+// to have a batch dropped instead of retried.
+var ErrPermanent = errors.New("permanent error")
+
+// Sink delivers batches of exposures to a service. Third parties can implement it and make their
+// sinks available to configurations with Register.
+type Sink interface {
+	Send(ctx context.Context, batch []Exposure) error
+}
+
+// Options holds the parsed delivery settings of a sink.
+type Options struct {
+	BatchSize     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	MaxRetries    int
+	QueueSize     int
+	IDSource      string
+	// BufferPath is the on-disk ring buffer exposures are kept in until they are delivered.
+	BufferPath     string
+	BufferMaxBytes int64
+}
+
+// Metrics counts the events delivered and dropped by each sink.
+type Metrics struct {
+	sent    *metrics.CounterVec
+	dropped *metrics.CounterVec
+}
+
+// NewMetrics registers the event sink metrics.
+func NewMetrics(registry *metrics.Registry) *Metrics {
+	return &Metrics{
+		sent: registry.Counter("forklift_events_sent_total",
+			"Number of exposure events delivered to an event sink.", "sink"),
+		dropped: registry.Counter("forklift_events_dropped_total",
+			"Number of exposure events dropped by an event sink.", "sink"),
+	}
+}
+
+// Factory creates a sink from its configuration and parsed delivery options.
+type Factory func(cfg config.EventSink, opts Options) (Sink, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{
+		"segment":    newSegment,
+		"amplitude":  newAmplitude,
+		"kafka":      newKafka,
+		"nats":       newNATS,
+		"bigquery":   newBigQuery,
+		"clickhouse": newClickHouse,
+	}
+)
+
+// Register makes a sink type available to event sink configurations, replacing any sink
+// registered under the same type. It is meant to be called from init functions.
+func Register(sinkType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[strings.ToLower(sinkType)] = factory
+}
+
+// New creates the dispatcher for the sink described by the configuration.
+func New(cfg config.EventSink, m *Metrics) (*Dispatcher, error) {
+	opts, err := parseOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.Name
+	if name == "" {
+		name = strings.ToLower(cfg.Type)
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[strings.ToLower(cfg.Type)]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errUnknownSinkType, cfg.Type)
+	}
+	sink, err := factory(cfg, opts)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return NewDispatcher(name, sink, opts, m)
+}
+
+func newSegment(cfg config.EventSink, opts Options) (Sink, error) {
+	if cfg.APIKey == "" {
+		return nil, errMissingAPIKey
+	}
+	return NewSegmentSink(cfg.URL, cfg.APIKey, opts.Timeout), nil
+}
+
+func newAmplitude(cfg config.EventSink, opts Options) (Sink, error) {
+	if cfg.APIKey == "" {
+		return nil, errMissingAPIKey
+	}
+	return NewAmplitudeSink(cfg.URL, cfg.APIKey, strings.EqualFold(cfg.IDType, "user"), opts.Timeout), nil
+}
+
+func newKafka(cfg config.EventSink, opts Options) (Sink, error) {
+	return NewKafkaSink(cfg.URL, cfg.APIKey, cfg.Topic, strings.ToLower(cfg.Format), cfg.SchemaRegistry, opts.Timeout)
+}
+
+func newNATS(cfg config.EventSink, _ Options) (Sink, error) {
+	return NewNATSSink(cfg.URL, cfg.APIKey, cfg.Subject)
+}
+
+func newBigQuery(cfg config.EventSink, opts Options) (Sink, error) {
+	return NewBigQuerySink(cfg.URL, cfg.APIKey, cfg.Project, cfg.Dataset, cfg.Table, cfg.DeadLetterPath, opts.Timeout)
+}
+
+func newClickHouse(cfg config.EventSink, opts Options) (Sink, error) {
+	return NewClickHouseSink(cfg.URL, cfg.APIKey, cfg.Database, cfg.Table, opts.Timeout)
+}
+
+func parseOptions(cfg config.EventSink) (Options, error) {
+	opts := Options{
+		BatchSize:      defaultBatchSize,
+		FlushInterval:  defaultFlushInterval,
+		Timeout:        defaultTimeout,
+		MaxRetries:     defaultMaxRetries,
+		QueueSize:      defaultQueueSize,
+		IDSource:       cfg.IDSource,
+		BufferPath:     cfg.SpillPath,
+		BufferMaxBytes: defaultBufferMaxBytes,
+	}
+	if cfg.BatchSize < 0 || cfg.MaxRetries < 0 || cfg.QueueSize < 0 || cfg.SpillMaxBytes < 0 {
+		return Options{}, fmt.Errorf("%w: batch size, retries, queue size and spill size must not be negative", errInvalidSink)
+	}
+	if cfg.IDSource != "" && !validSource(cfg.IDSource) {
+		return Options{}, fmt.Errorf("%w: %q", errInvalidIDSource, cfg.IDSource)
+	}
+	if cfg.SpillMaxBytes > 0 {
+		opts.BufferMaxBytes = cfg.SpillMaxBytes
+	}
+	if cfg.BatchSize > 0 {
+		opts.BatchSize = cfg.BatchSize
+	}
+	if cfg.MaxRetries > 0 {
+		opts.MaxRetries = cfg.MaxRetries
+	}
+	if cfg.QueueSize > 0 {
+		opts.QueueSize = cfg.QueueSize
+	}
+	if cfg.FlushInterval != "" {
+		interval, err := time.ParseDuration(cfg.FlushInterval)
+		if err != nil || interval <= 0 {
+			return Options{}, fmt.Errorf("%w: invalid flush interval %q", errInvalidSink, cfg.FlushInterval)
+		}
+		opts.FlushInterval = interval
+	}
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil || timeout <= 0 {
+			return Options{}, fmt.Errorf("%w: invalid timeout %q", errInvalidSink, cfg.Timeout)
+		}
+		opts.Timeout = timeout
+	}
+	return opts, nil
+}
+
+// Dispatcher queues exposures and sends them to a sink in batches from a background goroutine,
+// retrying failed batches with exponential backoff. Publishing never blocks: exposures are
+// dropped when the queue is full.
+//
+// Without a buffer, batches are dropped once their retries are exhausted. With one, delivery is
+// at least once: batches are written to the on-disk ring buffer before they are sent and removed
+// once the sink accepts them, so undelivered exposures are retried on every flush until the sink
+// recovers, including after a restart.
+type Dispatcher struct {
+	name   string
+	sink   Sink
+	opts   Options
+	queue  chan Exposure
+	buffer *ringBuffer
+	m      *Metrics
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+// NewDispatcher starts delivering exposures published to it to the sink.
+func NewDispatcher(name string, sink Sink, opts Options, m *Metrics) (*Dispatcher, error) {
+	d := &Dispatcher{
+		name:  name,
+		sink:  sink,
+		opts:  opts,
+		queue: make(chan Exposure, opts.QueueSize),
+		m:     m,
+
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if opts.BufferPath != "" {
+		buffer, err := openRingBuffer(opts.BufferPath, opts.BufferMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", errInvalidSink, name, err)
+		}
+		d.buffer = buffer
+	}
+	go d.run()
+	return d, nil
+}
+
+// Publish queues an exposure of the request for delivery.
+func (d *Dispatcher) Publish(exposure Exposure, req *http.Request) {
+	if d.opts.IDSource != "" {
+		exposure.ID = sourceValue(req, d.opts.IDSource)
+	}
+	select {
+	case d.queue <- exposure:
+	default:
+		d.m.dropped.Inc(d.name)
+	}
+}
+
+func (d *Dispatcher) run() {
+	ticker := time.NewTicker(d.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Exposure, 0, d.opts.BatchSize)
+	for {
+		select {
+		case exposure := <-d.queue:
+			batch = append(batch, exposure)
+			if len(batch) < d.opts.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				if d.buffer != nil && !d.buffer.empty() {
+					d.drain()
+				}
+				continue
+			}
+		case <-d.closing:
+			d.flush(batch)
+			close(d.done)
+			return
+		}
+		d.deliver(batch)
+		batch = make([]Exposure, 0, d.opts.BatchSize)
+	}
+}
+
+// flush delivers the pending batch and the exposures left in the queue.
+func (d *Dispatcher) flush(batch []Exposure) {
+	for {
+		select {
+		case exposure := <-d.queue:
+			batch = append(batch, exposure)
+			if len(batch) < d.opts.BatchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				d.deliver(batch)
+			}
+			return
+		}
+		d.deliver(batch)
+		batch = make([]Exposure, 0, d.opts.BatchSize)
+	}
+}
+
+// Close stops the dispatcher after delivering the exposures queued so far, waiting until ctx is
+// done. Exposures published after Close are dropped once the queue is full.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.closeOnce.Do(func() { close(d.closing) })
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: flushing event sink %s", ctx.Err(), d.name)
+	}
+}
+
+// deliver sends a batch through the buffer if there is one, or directly, retrying transient
+// failures.
+func (d *Dispatcher) deliver(batch []Exposure) {
+	if d.buffer != nil {
+		dropped, err := d.buffer.append(batch)
+		d.m.dropped.Add(float64(dropped), d.name)
+		if err == nil {
+			d.drain()
+			return
+		}
+		// Deliver directly while the buffer can't be written.
+	}
+	if err := d.send(batch); err != nil {
+		d.m.dropped.Add(float64(len(batch)), d.name)
+		return
+	}
+	d.m.sent.Add(float64(len(batch)), d.name)
+}
+
+// drain delivers buffered exposures in batches until the buffer is empty or the sink fails.
+// Rejected batches are dropped.
+func (d *Dispatcher) drain() {
+	for !d.buffer.empty() {
+		batch, next, err := d.buffer.peek(d.opts.BatchSize)
+		if err != nil {
+			return
+		}
+		if len(batch) > 0 {
+			err := d.send(batch)
+			if err != nil && !errors.Is(err, ErrPermanent) {
+				return
+			}
+			if err == nil {
+				d.m.sent.Add(float64(len(batch)), d.name)
+			} else {
+				d.m.dropped.Add(float64(len(batch)), d.name)
+			}
+		}
+		if err := d.buffer.advance(next); err != nil {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) send(batch []Exposure) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+		err := d.sink.Send(ctx, batch)
+		cancel()
+		if err == nil || errors.Is(err, ErrPermanent) || attempt >= d.opts.MaxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
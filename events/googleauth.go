@@ -0,0 +1,185 @@
+package events
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errGoogleToken      = errors.New("google access token request failed")
+	errGoogleCredential = errors.New("invalid google service account credentials")
+)
+
+const (
+	googleMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+	googleTokenURL         = "https://oauth2.googleapis.com/token"
+	googleJWTGrantType     = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	// googleTokenLeeway renews tokens before they expire, so requests never carry expired ones.
+	googleTokenLeeway = time.Minute
+)
+
+// googleTokenSource provides OAuth access tokens for Google APIs. It uses, in order, a static
+// token, GOOGLE_OAUTH_ACCESS_TOKEN, the service account key file in
+// GOOGLE_APPLICATION_CREDENTIALS, or the GCE metadata server. Tokens are cached until shortly
+// before they expire.
+type googleTokenSource struct {
+	static  string
+	scope   string
+	account *googleServiceAccount
+	client  *http.Client
+	now     func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// googleServiceAccount holds the fields of a service account key file used to sign token
+// requests.
+type googleServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+}
+
+func newGoogleTokenSource(static, scope string, client *http.Client) (*googleTokenSource, error) {
+	source := &googleTokenSource{static: static, scope: scope, client: client, now: time.Now}
+	if static == "" {
+		source.static = os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	}
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); source.static == "" && path != "" {
+		account, err := loadGoogleServiceAccount(path)
+		if err != nil {
+			return nil, err
+		}
+		source.account = account
+	}
+	return source, nil
+}
+
+func loadGoogleServiceAccount(path string) (*googleServiceAccount, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errGoogleCredential, err)
+	}
+	var account googleServiceAccount
+	if err := json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("%w: %w", errGoogleCredential, err)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil || account.ClientEmail == "" {
+		return nil, fmt.Errorf("%w: %s needs a client_email and private_key", errGoogleCredential, path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errGoogleCredential, err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: private_key is not an RSA key", errGoogleCredential)
+	}
+	account.key = key
+	if account.TokenURI == "" {
+		account.TokenURI = googleTokenURL
+	}
+	return &account, nil
+}
+
+// Token returns an access token, requesting a new one when the cached one is about to expire.
+func (s *googleTokenSource) Token(ctx context.Context) (string, error) {
+	if s.static != "" {
+		return s.static, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && s.now().Before(s.expiry.Add(-googleTokenLeeway)) {
+		return s.token, nil
+	}
+
+	var req *http.Request
+	var err error
+	if s.account != nil {
+		req, err = s.serviceAccountRequest(ctx)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, googleMetadataTokenURL, nil)
+		if err == nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", errGoogleToken, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%w: %s", errGoogleToken, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("%w: invalid response", errGoogleToken)
+	}
+	s.token = token.AccessToken
+	s.expiry = s.now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return s.token, nil
+}
+
+// serviceAccountRequest exchanges a JWT signed with the service account's key for an access
+// token.
+func (s *googleTokenSource) serviceAccountRequest(ctx context.Context) (*http.Request, error) {
+	now := s.now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.account.PrivateKeyID})
+	if err != nil {
+		return nil, err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.account.ClientEmail,
+		"scope": s.scope,
+		"aud":   s.account.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.account.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type": {googleJWTGrantType},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.account.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
@@ -0,0 +1,127 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errKafkaStatus = errors.New("kafka rest proxy returned an error")
+
+// KafkaSink produces exposures to a Kafka topic through a Confluent REST Proxy. Records are
+// keyed by session ID, so the exposures of a session stay in order on one partition. Avro and
+// Protobuf records use the schema registered for the topic's value subject. APIKey, if set, is
+// "key:secret" for basic authentication, as used by Confluent Cloud.
+type KafkaSink struct {
+	url      string
+	apiKey   string
+	format   string
+	registry *schemaRegistry
+	client   *http.Client
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// NewKafkaSink creates a sink producing to topic through the REST proxy at baseURL. Avro and
+// Protobuf formats require registryURL.
+func NewKafkaSink(baseURL, apiKey, topic, format, registryURL string, timeout time.Duration) (*KafkaSink, error) {
+	if baseURL == "" || topic == "" {
+		return nil, fmt.Errorf("%w: kafka sinks require a url and topic", errInvalidSink)
+	}
+	if format == "" {
+		format = FormatJSON
+	}
+	client := &http.Client{Timeout: timeout}
+	sink := &KafkaSink{
+		url:    strings.TrimSuffix(baseURL, "/") + "/topics/" + url.PathEscape(topic),
+		apiKey: apiKey,
+		format: format,
+		client: client,
+	}
+	switch format {
+	case FormatJSON:
+	case FormatAvro, FormatProtobuf:
+		if registryURL == "" {
+			return nil, fmt.Errorf("%w: %s records require a schema registry", errInvalidSink, format)
+		}
+		// The TopicNameStrategy subject that Kafka serializers look schemas up in.
+		sink.registry = newSchemaRegistry(registryURL, topic+"-value", format, client)
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", errInvalidSink, format)
+	}
+	return sink, nil
+}
+
+// Send implements Sink.
+func (k *KafkaSink) Send(ctx context.Context, batch []Exposure) error {
+	schemaID := 0
+	if k.registry != nil {
+		var err error
+		if schemaID, err = k.registry.schemaID(ctx); err != nil {
+			return err
+		}
+	}
+
+	records := make([]kafkaRecord, len(batch))
+	for i, exposure := range batch {
+		value, err := encodeExposure(k.format, schemaID, exposure)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+		records[i] = kafkaRecord{
+			Key:   base64.StdEncoding.EncodeToString([]byte(exposure.SessionID)),
+			Value: base64.StdEncoding.EncodeToString(value),
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.binary.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	if key, secret, ok := strings.Cut(k.apiKey, ":"); ok {
+		req.SetBasicAuth(key, secret)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if err := statusError(errKafkaStatus, resp); err != nil {
+		return err
+	}
+
+	// The proxy reports failures of individual records in the offsets of a successful response.
+	// Retrying resends the whole batch, so consumers may see duplicates but never gaps.
+	var produced struct {
+		Offsets []struct {
+			ErrorCode *int   `json:"error_code"`
+			Error     string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&produced); err != nil {
+		return fmt.Errorf("%w: %w", errKafkaStatus, err)
+	}
+	for _, offset := range produced.Offsets {
+		if offset.ErrorCode != nil {
+			return fmt.Errorf("%w: %s", errKafkaStatus, offset.Error)
+		}
+	}
+	return nil
+}
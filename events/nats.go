@@ -0,0 +1,338 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNATSProtocol = errors.New("nats protocol error")
+	errNATSAck      = errors.New("jetstream rejected the message")
+)
+
+const (
+	defaultNATSSubject = "forklift.exposures.{experiment}.{variant}"
+	natsInboxSID       = "1"
+)
+
+// NATSSink publishes exposures to NATS JetStream, one message per exposure, on a subject rendered
+// from a template with {experiment}, {variant} and {backend} placeholders. The subjects must be
+// bound to a stream: every message waits for the stream's acknowledgement, and carries a
+// Nats-Msg-Id derived from the exposure so redelivered batches are deduplicated by the stream.
+//
+// Credentials are a token or "user:password", given as the API key or in the URL.
+type NATSSink struct {
+	address string
+	tls     bool
+	user    string
+	pass    string
+	token   string
+	subject string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	inbox  string
+}
+
+// natsMessage is a message to publish and the subject fields of its template.
+type natsMessage struct {
+	fields map[string]string
+	id     string
+	data   []byte
+}
+
+// NewNATSSink creates a sink for the server at rawURL, a nats:// or tls:// URL.
+func NewNATSSink(rawURL, credentials, subject string) (*NATSSink, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "nats" && parsed.Scheme != "tls") || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: nats sinks require a nats:// or tls:// url", errInvalidSink)
+	}
+	if subject == "" {
+		subject = defaultNATSSubject
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return nil, fmt.Errorf("%w: invalid subject %q", errInvalidSink, subject)
+	}
+
+	address := parsed.Host
+	if parsed.Port() == "" {
+		address = net.JoinHostPort(parsed.Hostname(), "4222")
+	}
+	sink := &NATSSink{address: address, tls: parsed.Scheme == "tls", subject: subject}
+	if credentials == "" && parsed.User != nil {
+		credentials = parsed.User.String()
+		if unescaped, err := url.PathUnescape(credentials); err == nil {
+			credentials = unescaped
+		}
+	}
+	if user, pass, ok := strings.Cut(credentials, ":"); ok {
+		sink.user, sink.pass = user, pass
+	} else {
+		sink.token = credentials
+	}
+	return sink, nil
+}
+
+// Send implements Sink.
+func (n *NATSSink) Send(ctx context.Context, batch []Exposure) error {
+	messages := make([]natsMessage, len(batch))
+	for i, exposure := range batch {
+		data, err := json.Marshal(exposure)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrPermanent, err)
+		}
+		messages[i] = natsMessage{
+			fields: map[string]string{
+				"experiment": exposure.Experiment,
+				"variant":    exposure.Variant,
+				"backend":    exposure.Backend,
+			},
+			id:   exposureID(exposure),
+			data: data,
+		}
+	}
+	return n.publish(ctx, messages)
+}
+
+// Publish sends data on the subject rendered from the sink's template with fields, and waits for
+// JetStream to store it.
+func (n *NATSSink) Publish(ctx context.Context, fields map[string]string, data []byte) error {
+	sum := sha256.Sum256(data)
+	return n.publish(ctx, []natsMessage{{fields: fields, id: hex.EncodeToString(sum[:16]), data: data}})
+}
+
+// exposureID identifies an exposure for JetStream's deduplication.
+func exposureID(exposure Exposure) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		exposure.SessionID, exposure.Experiment, exposure.Variant, exposure.Path,
+		strconv.FormatInt(exposure.Time.UnixNano(), 10),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// renderSubject replaces the {field} placeholders of a subject template. Values are made valid
+// subject tokens: separators, wildcards and whitespace become underscores, and empty values "_".
+func renderSubject(template string, fields map[string]string) string {
+	subject := template
+	for name, value := range fields {
+		subject = strings.ReplaceAll(subject, "{"+name+"}", subjectToken(value))
+	}
+	return subject
+}
+
+func subjectToken(value string) string {
+	if value == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+func (n *NATSSink) publish(ctx context.Context, messages []natsMessage) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+	err := n.publishAcked(ctx, messages)
+	if err != nil && !errors.Is(err, errNATSAck) {
+		// The connection is in an unknown state; reconnect on the next attempt.
+		_ = n.conn.Close()
+		n.conn = nil
+	}
+	return err
+}
+
+// connect dials the server, upgrades to TLS if required, authenticates and subscribes to the
+// inbox acknowledgements are sent to.
+func (n *NATSSink) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if !strings.HasPrefix(line, "INFO ") || json.Unmarshal([]byte(line[5:]), &info) != nil {
+		_ = conn.Close()
+		return fmt.Errorf("%w: expected INFO, got %q", errNATSProtocol, strings.TrimSpace(line))
+	}
+	if n.tls || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(n.address)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return err
+		}
+		conn, reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"tls_required":  n.tls || info.TLSRequired,
+		"name":          "forklift",
+		"lang":          "go",
+		"version":       "1.0.0",
+		"protocol":      1,
+		"headers":       true,
+		"no_responders": true,
+	}
+	if n.user != "" {
+		options["user"], options["pass"] = n.user, n.pass
+	}
+	if n.token != "" {
+		options["auth_token"] = n.token
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	inbox := "_INBOX." + messageID()
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\nSUB %s.* %s\r\n", connect, inbox, natsInboxSID); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			_ = conn.Close()
+			return fmt.Errorf("%w: %s", errNATSProtocol, line)
+		}
+	}
+	n.conn, n.reader, n.inbox = conn, reader, inbox
+	return nil
+}
+
+// publishAcked publishes the messages with replies to the inbox and waits for every
+// acknowledgement. Any failed acknowledgement fails the batch.
+func (n *NATSSink) publishAcked(ctx context.Context, messages []natsMessage) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = n.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	for i, message := range messages {
+		header := "NATS/1.0\r\nNats-Msg-Id: " + message.id + "\r\n\r\n"
+		fmt.Fprintf(&b, "HPUB %s %s.%d %d %d\r\n%s%s\r\n",
+			renderSubject(n.subject, message.fields), n.inbox, i,
+			len(header), len(header)+len(message.data), header, message.data)
+	}
+	if _, err := n.conn.Write([]byte(b.String())); err != nil {
+		return err
+	}
+
+	var rejected error
+	for pending := len(messages); pending > 0; {
+		line, err := n.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PING":
+			if _, err := n.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case line == "+OK" || line == "PONG" || line == "":
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%w: %s", errNATSProtocol, line)
+		case strings.HasPrefix(line, "MSG ") || strings.HasPrefix(line, "HMSG "):
+			header, payload, err := n.readMessage(line)
+			if err != nil {
+				return err
+			}
+			pending--
+			if err := ackError(header, payload); err != nil && rejected == nil {
+				rejected = err
+			}
+		default:
+			return fmt.Errorf("%w: unexpected %q", errNATSProtocol, line)
+		}
+	}
+	return rejected
+}
+
+// readMessage reads the header and payload of a MSG or HMSG.
+func (n *NATSSink) readMessage(line string) (header, payload []byte, err error) {
+	fields := strings.Fields(line)
+	headerSize := 0
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err == nil && fields[0] == "HMSG" && len(fields) >= 5 {
+		headerSize, err = strconv.Atoi(fields[len(fields)-2])
+	}
+	if err != nil || headerSize > total {
+		return nil, nil, fmt.Errorf("%w: malformed %q", errNATSProtocol, line)
+	}
+	data := make([]byte, total+2)
+	if _, err := io.ReadFull(n.reader, data); err != nil {
+		return nil, nil, err
+	}
+	return data[:headerSize], data[headerSize:total], nil
+}
+
+// ackError returns the error of a JetStream publish acknowledgement, if any. A 503 status means
+// no stream is bound to the subject.
+func ackError(header, payload []byte) error {
+	if status := strings.Fields(strings.SplitN(string(header), "\r\n", 2)[0]); len(status) > 1 && status[1] != "200" {
+		return fmt.Errorf("%w: status %s", errNATSAck, strings.Join(status[1:], " "))
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(payload, &ack); err != nil {
+		return fmt.Errorf("%w: %w", errNATSAck, err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("%w: %d %s", errNATSAck, ack.Error.Code, ack.Error.Description)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package events
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// ExposureSchemaVersion is the version of the exposure schema written to each Avro and
+// Protobuf record. The schema only changes by adding fields with defaults, or new field
+// numbers, so consumers built against an older version keep reading newer records.
+const ExposureSchemaVersion = 3
+
+// ExposureAvroSchema is the Avro schema of exposures.
+const ExposureAvroSchema = `{
+  "type": "record",
+  "name": "Exposure",
+  "namespace": "io.forklift.events",
+  "fields": [
+    {"name": "schema_version", "type": "int", "default": 3},
+    {"name": "time", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "experiment", "type": "string"},
+    {"name": "variant", "type": "string", "default": ""},
+    {"name": "backend", "type": "string", "default": ""},
+    {"name": "session_id", "type": "string", "default": ""},
+    {"name": "id", "type": ["null", "string"], "default": null},
+    {"name": "path", "type": "string", "default": ""},
+    {"name": "status", "type": "int", "default": 0},
+    {"name": "request_id", "type": ["null", "string"], "default": null},
+    {"name": "assignment", "type": "string", "default": ""}
+  ]
+}`
+
+// ExposureProtoSchema is the Protobuf schema of exposures.
+const ExposureProtoSchema = `syntax = "proto3";
+
+package forklift.events.v1;
+
+message Exposure {
+  int32 schema_version = 1;
+  int64 time_unix_millis = 2;
+  string experiment = 3;
+  string variant = 4;
+  string backend = 5;
+  string session_id = 6;
+  string id = 7;
+  string path = 8;
+  int32 status = 9;
+  string request_id = 10;
+  string assignment = 11;
+}
+`
+
+// Formats exposures can be serialized in.
+const (
+	FormatJSON     = "json"
+	FormatAvro     = "avro"
+	FormatProtobuf = "protobuf"
+)
+
+// encodeExposure serializes an exposure in the given format. Avro and Protobuf records are
+// framed in the Confluent wire format with the registry ID of their schema, so standard
+// deserializers can decode them.
+func encodeExposure(format string, schemaID int, exposure Exposure) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		return json.Marshal(exposure)
+	case FormatAvro:
+		return encodeAvro(confluentHeader(schemaID), exposure), nil
+	case FormatProtobuf:
+		// A single zero byte is the message index list of the first message in the schema.
+		return encodeProto(append(confluentHeader(schemaID), 0), exposure), nil
+	}
+	return nil, fmt.Errorf("%w: unknown format %q", errInvalidSink, format)
+}
+
+// confluentHeader is the magic byte and schema ID that start records in the Confluent wire format.
+func confluentHeader(schemaID int) []byte {
+	b := make([]byte, 5, 128)
+	binary.BigEndian.PutUint32(b[1:], uint32(schemaID))
+	return b
+}
+
+// encodeAvro appends the Avro binary encoding of an exposure, following ExposureAvroSchema.
+func encodeAvro(b []byte, exposure Exposure) []byte {
+	b = binary.AppendVarint(b, ExposureSchemaVersion)
+	b = binary.AppendVarint(b, exposure.Time.UnixMilli())
+	b = appendAvroString(b, exposure.Experiment)
+	b = appendAvroString(b, exposure.Variant)
+	b = appendAvroString(b, exposure.Backend)
+	b = appendAvroString(b, exposure.SessionID)
+	b = appendAvroOptionalString(b, exposure.ID)
+	b = appendAvroString(b, exposure.Path)
+	b = binary.AppendVarint(b, int64(exposure.Status))
+	b = appendAvroOptionalString(b, exposure.RequestID)
+	return appendAvroString(b, exposure.Assignment)
+}
+
+// appendAvroOptionalString appends a union of null and string, which is null for empty strings.
+func appendAvroOptionalString(b []byte, s string) []byte {
+	if s == "" {
+		return binary.AppendVarint(b, 0)
+	}
+	b = binary.AppendVarint(b, 1)
+	return appendAvroString(b, s)
+}
+
+func appendAvroString(b []byte, s string) []byte {
+	b = binary.AppendVarint(b, int64(len(s)))
+	return append(b, s...)
+}
+
+// encodeProto appends the Protobuf encoding of an exposure, following ExposureProtoSchema.
+// Fields with default values are omitted, as in proto3.
+func encodeProto(b []byte, exposure Exposure) []byte {
+	b = appendProtoInt(b, 1, ExposureSchemaVersion)
+	b = appendProtoInt(b, 2, exposure.Time.UnixMilli())
+	b = appendProtoString(b, 3, exposure.Experiment)
+	b = appendProtoString(b, 4, exposure.Variant)
+	b = appendProtoString(b, 5, exposure.Backend)
+	b = appendProtoString(b, 6, exposure.SessionID)
+	b = appendProtoString(b, 7, exposure.ID)
+	b = appendProtoString(b, 8, exposure.Path)
+	b = appendProtoInt(b, 9, int64(exposure.Status))
+	b = appendProtoString(b, 10, exposure.RequestID)
+	return appendProtoString(b, 11, exposure.Assignment)
+}
+
+const (
+	protoVarint          = 0
+	protoLengthDelimited = 2
+)
+
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field<<3|protoVarint))
+	// Negative values are encoded as their two's complement, like int64 and int32 fields.
+	return binary.AppendUvarint(b, uint64(v))
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field<<3|protoLengthDelimited))
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,117 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var errSegmentStatus = errors.New("segment returned an error")
+
+const (
+	defaultSegmentURL = "https://api.segment.io"
+
+	// segmentEvent is the event name of Segment's A/B testing spec.
+	segmentEvent = "Experiment Viewed"
+)
+
+// SegmentSink sends exposures to Segment's HTTP tracking API as "Experiment Viewed" track
+// calls. The session ID is the anonymous ID, so exposures join the sessions of analytics.js
+// when it shares the Forklift session cookie.
+type SegmentSink struct {
+	url      string
+	writeKey string
+	client   *http.Client
+}
+
+type segmentTrack struct {
+	Type        string                 `json:"type"`
+	Event       string                 `json:"event"`
+	AnonymousID string                 `json:"anonymousId"`
+	MessageID   string                 `json:"messageId"`
+	Timestamp   time.Time              `json:"timestamp"`
+	Properties  map[string]interface{} `json:"properties"`
+	Context     map[string]interface{} `json:"context"`
+}
+
+// NewSegmentSink creates a sink for the source with writeKey, sending to baseURL or Segment's
+// API if it is empty.
+func NewSegmentSink(baseURL, writeKey string, timeout time.Duration) *SegmentSink {
+	if baseURL == "" {
+		baseURL = defaultSegmentURL
+	}
+	return &SegmentSink{
+		url:      strings.TrimSuffix(baseURL, "/") + "/v1/batch",
+		writeKey: writeKey,
+		client:   &http.Client{Timeout: timeout},
+	}
+}
+
+// Send implements Sink.
+func (s *SegmentSink) Send(ctx context.Context, batch []Exposure) error {
+	tracks := make([]segmentTrack, len(batch))
+	for i, exposure := range batch {
+		tracks[i] = segmentTrack{
+			Type:        "track",
+			Event:       segmentEvent,
+			AnonymousID: exposure.SessionID,
+			MessageID:   messageID(),
+			Timestamp:   exposure.Time.UTC(),
+			Properties: map[string]interface{}{
+				"experiment_name": exposure.Experiment,
+				"variation_name":  exposure.Variant,
+				"backend":         exposure.Backend,
+				"path":            exposure.Path,
+				"status":          exposure.Status,
+				"request_id":      exposure.RequestID,
+				"assignment":      exposure.Assignment,
+			},
+			Context: map[string]interface{}{"library": map[string]string{"name": "forklift"}},
+		}
+	}
+	data, err := json.Marshal(map[string]interface{}{"batch": tracks})
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrPermanent, err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(s.writeKey, "")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return statusError(errSegmentStatus, resp)
+}
+
+// statusError returns nil for successful responses and an error for others, marked permanent
+// for client errors other than 429 Too Many Requests.
+func statusError(statusErr error, resp *http.Response) error {
+	switch {
+	case resp.StatusCode < http.StatusMultipleChoices:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+		return fmt.Errorf("%w: %s", statusErr, resp.Status)
+	default:
+		return fmt.Errorf("%w: %w: %s", ErrPermanent, statusErr, resp.Status)
+	}
+}
+
+// messageID returns a random ID Segment uses to deduplicate retried messages.
+func messageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
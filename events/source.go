@@ -0,0 +1,24 @@
+package events
+
+import (
+	"net/http"
+	"strings"
+)
+
+// validSource reports whether source names a header or cookie: "header:<name>" or "cookie:<name>".
+func validSource(source string) bool {
+	kind, name, _ := strings.Cut(source, ":")
+	return (kind == "header" || kind == "cookie") && name != ""
+}
+
+// sourceValue reads a source validated by validSource from the request.
+func sourceValue(req *http.Request, source string) string {
+	kind, name, _ := strings.Cut(source, ":")
+	if kind == "header" {
+		return req.Header.Get(name)
+	}
+	if cookie, err := req.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
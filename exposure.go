@@ -0,0 +1,197 @@
+package forklift
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/events"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidSampleRate = errors.New("invalid exposure sample rate: must not be negative")
+
+// EventSink is an alias for events.Sink, implemented by custom destinations of exposures.
+type EventSink = events.Sink
+
+// RegisterEventSink makes a custom event sink available under the given type so configurations
+// can list it in eventSinks. It is meant to be called from init functions.
+func RegisterEventSink(sinkType string, factory events.Factory) {
+	events.Register(sinkType, factory)
+}
+
+// exposureLogger logs the exposure of sessions to experiment variants. Log lines are sampled
+// 1 in N per experiment, while the exposure counter keeps exact totals. Every exposure is also
+// published to the configured event sinks.
+type exposureLogger struct {
+	cfg    *config.ExposureLog
+	rates  map[string]int
+	logger logger.Logger
+	sinks  []*events.Dispatcher
+	// scrubber hashes session IDs and scrubs the request sinks read exposure IDs from.
+	scrubber *scrubber
+	now      func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]uint64
+
+	exposures *metrics.CounterVec
+	logged    *metrics.CounterVec
+	// labels limits the cardinality of the variant labels of the metrics, if set.
+	labels *config.MetricsLabels
+	// dedup suppresses repeated exposures, if configured.
+	dedup *exposureDedup
+}
+
+// newExposureLogger returns nil when exposure logging is disabled and no event sinks are
+// configured.
+func newExposureLogger(cfg *config.Config, logger logger.Logger, registry *metrics.Registry, scrubber *scrubber) (*exposureLogger, error) {
+	logCfg := cfg.ExposureLog
+	if logCfg != nil && !logCfg.Enabled {
+		logCfg = nil
+	}
+	dedup, err := newExposureDedup(cfg.ExposureDedup, registry)
+	if err != nil {
+		return nil, err
+	}
+	if logCfg == nil && len(cfg.EventSinks) == 0 {
+		return nil, nil
+	}
+
+	var rates map[string]int
+	if logCfg != nil {
+		if logCfg.SampleRate < 0 {
+			return nil, errInvalidSampleRate
+		}
+		rates = make(map[string]int, len(logCfg.Experiments))
+		for _, sampling := range logCfg.Experiments {
+			if sampling.SampleRate < 0 {
+				return nil, errInvalidSampleRate
+			}
+			rates[sampling.Experiment] = sampling.SampleRate
+		}
+	}
+
+	var sinks []*events.Dispatcher
+	if len(cfg.EventSinks) > 0 {
+		sinkMetrics := events.NewMetrics(registry)
+		for _, sinkCfg := range cfg.EventSinks {
+			sink, err := events.New(sinkCfg, sinkMetrics)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		}
+	}
+
+	return &exposureLogger{
+		cfg:    logCfg,
+		rates:  rates,
+		logger: logger,
+		sinks:  sinks,
+		now:    time.Now,
+
+		scrubber: scrubber,
+		seen:     make(map[string]uint64),
+		exposures: registry.Counter("forklift_exposures_total",
+			"Number of requests exposed to an experiment variant.", "experiment", "variant"),
+		logged: registry.Counter("forklift_exposures_logged_total",
+			"Number of exposures written to the exposure log.", "experiment", "variant"),
+		labels: cfg.MetricsLabels,
+		dedup:  dedup,
+	}, nil
+}
+
+// exposureLabels returns the experiment and variant a selection exposes the session to. The
+// experiment is empty if the selected rule is not part of one.
+func exposureLabels(selected SelectedBackend) (experiment, variant string) {
+	rule := selected.Rule
+	if rule == nil {
+		return "", ""
+	}
+	experiment = rule.Experiment
+	if experiment == "" && rule.Flag != nil {
+		experiment = rule.Flag.Name
+	}
+	if experiment == "" {
+		return "", ""
+	}
+	variant = selected.Variant
+	if variant == "" {
+		variant = rule.Variant
+	}
+	if variant == "" {
+		variant = selected.Backend
+	}
+	return experiment, variant
+}
+
+// sampleRate returns N for 1-in-N sampling of the experiment.
+func (e *exposureLogger) sampleRate(experiment string) int {
+	rate, ok := e.rates[experiment]
+	if !ok {
+		rate = e.cfg.SampleRate
+	}
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+// record counts the exposure of a served request, and publishes and logs it if it is sampled
+// and not a duplicate.
+func (e *exposureLogger) record(hc *HookContext) {
+	if e == nil || hc.Selected.Rule == nil {
+		return
+	}
+	experiment, variant := exposureLabels(hc.Selected)
+	if experiment == "" {
+		return
+	}
+
+	e.exposures.Inc(experiment, metricVariant(e.labels, hc.Selected.Rule, variant))
+	if e.dedup.duplicate(hc.SessionID, experiment, variant, e.now()) {
+		e.dedup.suppressed.Inc(experiment, metricVariant(e.labels, hc.Selected.Rule, variant))
+		return
+	}
+
+	if len(e.sinks) > 0 {
+		exposure := events.Exposure{
+			Time:       e.now(),
+			Experiment: experiment,
+			Variant:    variant,
+			Backend:    backendURL(hc.Selected),
+			SessionID:  e.scrubber.identity(hc.SessionID),
+			RequestID:  hc.RequestID,
+			Path:       hc.Request.URL.Path,
+			Status:     hc.Status,
+			DurationMS: hc.Duration.Milliseconds(),
+			Assignment: hc.Selected.Assignment,
+		}
+		req := e.scrubber.request(hc.Request)
+		for _, sink := range e.sinks {
+			sink.Publish(exposure, req)
+		}
+	}
+	if e.cfg == nil {
+		return
+	}
+
+	rate := e.sampleRate(experiment)
+	e.mu.Lock()
+	count := e.seen[experiment]
+	e.seen[experiment] = count + 1
+	e.mu.Unlock()
+
+	sampled := count%uint64(rate) == 0
+	if !sampled && !(e.cfg.AlwaysLogErrors && hc.Status >= http.StatusInternalServerError) {
+		return
+	}
+
+	e.logged.Inc(experiment, metricVariant(e.labels, hc.Selected.Rule, variant))
+	logger.WithRequestID(e.logger, hc.RequestID).Infof("Exposure: experiment=%s variant=%s backend=%s assignment=%s session=%s path=%s status=%d sampleRate=%d",
+		experiment, variant, backendURL(hc.Selected), hc.Selected.Assignment, e.scrubber.identity(hc.SessionID), hc.Request.URL.Path, hc.Status, rate)
+}
@@ -0,0 +1,89 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidExposureDedup = errors.New("invalid exposure dedup")
+
+const defaultExposureDedupEntries = 100000
+
+// exposureDedup suppresses the repeated exposures of a session to the same variant of an
+// experiment within a window, which add no information to the analysis of the experiment. A
+// session is emitted again once the window after its last emitted exposure is over, or as soon as
+// it switches variants. Suppressed exposures are counted exactly.
+//
+// Expired entries are evicted when the table is full, and the table is cleared if that frees
+// less than a quarter of it, so exposures may be emitted again early but are never lost.
+type exposureDedup struct {
+	window     time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	emitted map[string]time.Time
+
+	suppressed *metrics.CounterVec
+}
+
+// newExposureDedup returns nil when exposures are not deduplicated.
+func newExposureDedup(cfg *config.ExposureDedup, registry *metrics.Registry) (*exposureDedup, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	window, err := time.ParseDuration(cfg.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("%w: window must be a positive duration", errInvalidExposureDedup)
+	}
+	if cfg.MaxEntries < 0 {
+		return nil, fmt.Errorf("%w: maxEntries must not be negative", errInvalidExposureDedup)
+	}
+	maxEntries := cfg.MaxEntries
+	if maxEntries == 0 {
+		maxEntries = defaultExposureDedupEntries
+	}
+	return &exposureDedup{
+		window:     window,
+		maxEntries: maxEntries,
+		emitted:    make(map[string]time.Time),
+		suppressed: registry.Counter("forklift_exposures_suppressed_total",
+			"Number of exposures not emitted because the session was exposed to the variant within the dedup window.",
+			"experiment", "variant"),
+	}, nil
+}
+
+// duplicate reports whether the exposure of the session repeats one emitted within the window,
+// and records it as emitted otherwise.
+func (d *exposureDedup) duplicate(sessionID, experiment, variant string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+	key := sessionID + "\xff" + experiment + "\xff" + variant
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if emitted, ok := d.emitted[key]; ok && now.Sub(emitted) < d.window {
+		return true
+	}
+	if len(d.emitted) >= d.maxEntries {
+		d.evict(now)
+	}
+	d.emitted[key] = now
+	return false
+}
+
+// evict removes the expired entries, or all of them if few expired. The caller holds the lock.
+func (d *exposureDedup) evict(now time.Time) {
+	for key, emitted := range d.emitted {
+		if now.Sub(emitted) >= d.window {
+			delete(d.emitted, key)
+		}
+	}
+	if len(d.emitted) > d.maxEntries*3/4 {
+		d.emitted = make(map[string]time.Time)
+	}
+}
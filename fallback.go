@@ -0,0 +1,228 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidFallback = errors.New("invalid fallback: must be default, lastAssignment or error(<status>)")
+
+const (
+	fallbackDefault        = "default"
+	fallbackLastAssignment = "lastAssignment"
+	fallbackError          = "error"
+
+	maxFormBodyBytes   = 10 << 20
+	maxLastAssignments = 100000
+)
+
+// failureClass identifies what failed while selecting a backend.
+type failureClass int
+
+const (
+	providerError failureClass = iota
+	storeUnavailable
+	bodyTooLarge
+)
+
+// fallbackMode is a parsed fallback. Error fallbacks answer with the static response of rule.
+type fallbackMode struct {
+	kind string
+	rule *RoutingRule
+}
+
+// fallbackPolicy holds the fallback of each failure class. Unset classes keep the built-in
+// behavior.
+type fallbackPolicy [3]fallbackMode
+
+func parseFallbackPolicy(cfg *config.Fallback) (*fallbackPolicy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	var policy fallbackPolicy
+	for class, value := range []string{cfg.ProviderError, cfg.StoreUnavailable, cfg.BodyTooLarge} {
+		mode, err := parseFallback(value)
+		if err != nil {
+			return nil, err
+		}
+		policy[class] = mode
+	}
+	return &policy, nil
+}
+
+// parseFallback parses "default", "lastAssignment", "error" or "error(<status>)". Error
+// fallbacks answer with 503 Service Unavailable unless a status is given.
+func parseFallback(value string) (fallbackMode, error) {
+	switch value {
+	case "":
+		return fallbackMode{}, nil
+	case fallbackDefault, fallbackLastAssignment:
+		return fallbackMode{kind: value}, nil
+	}
+	status := http.StatusServiceUnavailable
+	if value != fallbackError {
+		code, ok := strings.CutPrefix(value, fallbackError+"(")
+		if !ok || !strings.HasSuffix(code, ")") {
+			return fallbackMode{}, fmt.Errorf("%w: %q", errInvalidFallback, value)
+		}
+		var err error
+		status, err = strconv.Atoi(strings.TrimSuffix(code, ")"))
+		if err != nil || status < 400 || status > 599 {
+			return fallbackMode{}, fmt.Errorf("%w: %q", errInvalidFallback, value)
+		}
+	}
+	return fallbackMode{kind: fallbackError, rule: &RoutingRule{
+		Static: &config.StaticResponse{Status: status, Body: http.StatusText(status) + "\n"},
+	}}, nil
+}
+
+// fallbackPolicies returns the fallback policy of each rule that has one. Rules must already be
+// sorted.
+func fallbackPolicies(rules []RoutingRule) (map[*RoutingRule]*fallbackPolicy, error) {
+	var policies map[*RoutingRule]*fallbackPolicy
+	for i := range rules {
+		policy, err := parseFallbackPolicy(rules[i].Fallback)
+		if err != nil {
+			return nil, err
+		}
+		if policy == nil {
+			continue
+		}
+		if policies == nil {
+			policies = make(map[*RoutingRule]*fallbackPolicy)
+		}
+		policies[&rules[i]] = policy
+	}
+	return policies, nil
+}
+
+// usesLastAssignment reports whether the policy falls back to the last assignment for any class.
+func (p *fallbackPolicy) usesLastAssignment() bool {
+	if p == nil {
+		return false
+	}
+	for _, mode := range p {
+		if mode.kind == fallbackLastAssignment {
+			return true
+		}
+	}
+	return false
+}
+
+// newLastAssignments returns the assignments to remember, or nil if no policy needs them.
+func newLastAssignments(global *fallbackPolicy, policies map[*RoutingRule]*fallbackPolicy) *lastAssignments {
+	needed := global.usesLastAssignment()
+	for _, policy := range policies {
+		needed = needed || policy.usesLastAssignment()
+	}
+	if !needed {
+		return nil
+	}
+	return &lastAssignments{entries: make(map[string]SelectedBackend)}
+}
+
+// lastAssignments remembers the latest selection of each session per path, for fallbacks to
+// the last assignment. It is cleared when it grows past maxLastAssignments.
+type lastAssignments struct {
+	mu      sync.Mutex
+	entries map[string]SelectedBackend
+}
+
+func (l *lastAssignments) record(key string, selected SelectedBackend) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.entries[key]; !ok && len(l.entries) >= maxLastAssignments {
+		l.entries = make(map[string]SelectedBackend)
+	}
+	l.entries[key] = selected
+}
+
+func (l *lastAssignments) get(key string) (SelectedBackend, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	selected, ok := l.entries[key]
+	return selected, ok
+}
+
+// recordAssignment remembers a selection made by a configured rule.
+func (a *Forklift) recordAssignment(sessionID string, selected SelectedBackend) {
+	if a.lastAssignments == nil || selected.Rule == nil {
+		return
+	}
+	if _, ok := a.ruleKeys[selected.Rule]; !ok {
+		return
+	}
+	a.lastAssignments.record(sessionID+":"+rulePathKey(selected.Rule), selected)
+}
+
+// fallbackSelection returns the selection of the fallback for a failure of the rule, from the
+// rule's policy or the global one. It reports false when neither sets a fallback for the class,
+// so the built-in behavior applies.
+func (a *Forklift) fallbackSelection(sessionID string, rule *RoutingRule, class failureClass) (SelectedBackend, bool) {
+	var mode fallbackMode
+	if policy := a.fallbacks[rule]; policy != nil {
+		mode = policy[class]
+	}
+	if mode.kind == "" && a.fallback != nil {
+		mode = a.fallback[class]
+	}
+
+	var selected SelectedBackend
+	switch mode.kind {
+	case fallbackDefault:
+		selected = a.defaultBackendSelection()
+	case fallbackLastAssignment:
+		var ok bool
+		if selected, ok = a.lastAssignments.get(sessionID + ":" + rulePathKey(rule)); !ok {
+			selected = a.defaultBackendSelection()
+		}
+	case fallbackError:
+		selected = SelectedBackend{Backend: backendKey(*mode.rule), Rule: mode.rule}
+	default:
+		return SelectedBackend{}, false
+	}
+	selected.Reason = reasonFallback
+	if class == providerError {
+		selected.Assignment = assignedProviderError
+	}
+	return selected, true
+}
+
+// formBodyTooLarge reports whether the rule has form conditions and the request body is too
+// large to parse them. The result is remembered in scratch, since the body can only be read once.
+func (a *Forklift) formBodyTooLarge(req *http.Request, rule *RoutingRule, scratch *selectionScratch) bool {
+	if !hasFormCondition(rule) {
+		return false
+	}
+	if scratch.formParsed {
+		return scratch.formTooLarge
+	}
+	scratch.formParsed = true
+
+	if req.ContentLength > maxFormBodyBytes {
+		scratch.formTooLarge = true
+		return true
+	}
+	if req.Body == nil || req.PostForm != nil {
+		return false
+	}
+	req.Body = http.MaxBytesReader(nil, req.Body, maxFormBodyBytes)
+	var tooLarge *http.MaxBytesError
+	scratch.formTooLarge = errors.As(req.ParseForm(), &tooLarge)
+	return scratch.formTooLarge
+}
+
+func hasFormCondition(rule *RoutingRule) bool {
+	for _, condition := range rule.Conditions {
+		if strings.EqualFold(condition.Type, "form") {
+			return true
+		}
+	}
+	return false
+}
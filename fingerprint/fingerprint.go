@@ -0,0 +1,325 @@
+// Package fingerprint computes the JA3 and JA4 fingerprints of TLS clients from their
+// ClientHello, for the standalone server which terminates TLS itself. Under Traefik the
+// fingerprints come from headers set by the TLS terminator.
+package fingerprint
+
+import (
+	"crypto/md5" //nolint:gosec // JA3 is defined as an MD5 hash.
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrIncomplete is returned for data holding the start of a ClientHello only.
+	ErrIncomplete = errors.New("incomplete ClientHello")
+	// ErrNotClientHello is returned for data that isn't a TLS ClientHello.
+	ErrNotClientHello = errors.New("not a TLS ClientHello")
+)
+
+const (
+	recordTypeHandshake      = 0x16
+	handshakeTypeClientHello = 0x01
+	recordHeaderLength       = 5
+
+	extensionServerName          = 0x0000
+	extensionSupportedGroups     = 0x000a
+	extensionPointFormats        = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+)
+
+// ClientHello holds the fields of a ClientHello fingerprints are computed from, in the order the
+// client sent them.
+type ClientHello struct {
+	Version             uint16
+	CipherSuites        []uint16
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	ALPN                []string
+	SupportedVersions   []uint16
+}
+
+// Parse parses the ClientHello starting data, which holds the TLS records the client sent first.
+// It returns ErrIncomplete when data ends before the ClientHello does.
+func Parse(data []byte) (*ClientHello, error) {
+	// The handshake message may span several records.
+	var message []byte
+	for {
+		if len(data) < recordHeaderLength {
+			return nil, ErrIncomplete
+		}
+		if data[0] != recordTypeHandshake || data[1] != 0x03 {
+			return nil, ErrNotClientHello
+		}
+		length := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < recordHeaderLength+length {
+			return nil, ErrIncomplete
+		}
+		message = append(message, data[recordHeaderLength:recordHeaderLength+length]...)
+		data = data[recordHeaderLength+length:]
+		if len(message) < 4 {
+			continue
+		}
+		if message[0] != handshakeTypeClientHello {
+			return nil, ErrNotClientHello
+		}
+		if length := int(message[1])<<16 | int(message[2])<<8 | int(message[3]); len(message) >= 4+length {
+			return parseClientHello(message[4 : 4+length])
+		}
+	}
+}
+
+// reader reads the fields of a ClientHello, remembering whether one was truncated.
+type reader struct {
+	data []byte
+	bad  bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.bad || len(r.data) < n {
+		r.bad = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) uint8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) uint16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(b))
+}
+
+// vector reads a vector whose length takes lengthBytes bytes.
+func (r *reader) vector(lengthBytes int) *reader {
+	var n int
+	if lengthBytes == 1 {
+		n = r.uint8()
+	} else {
+		n = r.uint16()
+	}
+	b := r.bytes(n)
+	return &reader{data: b, bad: r.bad}
+}
+
+func (r *reader) uint16s() []uint16 {
+	var values []uint16
+	for len(r.data) >= 2 && !r.bad {
+		values = append(values, uint16(r.uint16()))
+	}
+	if len(r.data) != 0 {
+		r.bad = true
+	}
+	return values
+}
+
+func parseClientHello(body []byte) (*ClientHello, error) {
+	r := &reader{data: body}
+	hello := &ClientHello{Version: uint16(r.uint16())}
+	r.bytes(32) // random
+	r.vector(1) // session ID
+	ciphers := r.vector(2)
+	hello.CipherSuites = ciphers.uint16s()
+	r.vector(1) // compression methods
+	if r.bad || ciphers.bad {
+		return nil, fmt.Errorf("%w: truncated", ErrNotClientHello)
+	}
+	if len(r.data) == 0 {
+		return hello, nil
+	}
+
+	extensions := r.vector(2)
+	for len(extensions.data) > 0 && !extensions.bad {
+		kind := uint16(extensions.uint16())
+		data := extensions.vector(2)
+		if data.bad {
+			break
+		}
+		hello.Extensions = append(hello.Extensions, kind)
+		switch kind {
+		case extensionSupportedGroups:
+			hello.SupportedGroups = data.vector(2).uint16s()
+		case extensionPointFormats:
+			hello.PointFormats = append([]uint8(nil), data.vector(1).data...)
+		case extensionSignatureAlgorithms:
+			hello.SignatureAlgorithms = data.vector(2).uint16s()
+		case extensionALPN:
+			protocols := data.vector(2)
+			for len(protocols.data) > 0 && !protocols.bad {
+				hello.ALPN = append(hello.ALPN, string(protocols.vector(1).data))
+			}
+		case extensionSupportedVersions:
+			hello.SupportedVersions = data.vector(1).uint16s()
+		}
+	}
+	if r.bad || extensions.bad {
+		return nil, fmt.Errorf("%w: truncated extensions", ErrNotClientHello)
+	}
+	return hello, nil
+}
+
+// isGREASE reports whether a value is one of the reserved GREASE values clients send at random,
+// which fingerprints ignore.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+func withoutGREASE(values []uint16) []uint16 {
+	kept := make([]uint16, 0, len(values))
+	for _, value := range values {
+		if !isGREASE(value) {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+func joinDecimal(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = strconv.Itoa(int(value))
+	}
+	return strings.Join(parts, "-")
+}
+
+// JA3String returns the JA3 fields of the ClientHello: its version, cipher suites, extensions,
+// supported groups and point formats, without GREASE values.
+func (h *ClientHello) JA3String() string {
+	formats := make([]uint16, len(h.PointFormats))
+	for i, format := range h.PointFormats {
+		formats[i] = uint16(format)
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		joinDecimal(withoutGREASE(h.CipherSuites)),
+		joinDecimal(withoutGREASE(h.Extensions)),
+		joinDecimal(withoutGREASE(h.SupportedGroups)),
+		joinDecimal(formats),
+	}, ",")
+}
+
+// JA3 returns the JA3 fingerprint of the ClientHello, the MD5 hash of its JA3 string.
+func (h *ClientHello) JA3() string {
+	sum := md5.Sum([]byte(h.JA3String())) //nolint:gosec // JA3 is defined as an MD5 hash.
+	return hex.EncodeToString(sum[:])
+}
+
+// ja4Versions are the JA4 codes of TLS versions.
+var ja4Versions = map[uint16]string{
+	0x0304: "13", 0x0303: "12", 0x0302: "11", 0x0301: "10", 0x0300: "s3",
+	0xfeff: "d1", 0xfefd: "d2", 0xfefc: "d3",
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello, e.g. t13d1516h2_8daaf6152771_e5627efa2ab1:
+// the highest TLS version, whether a server name was sent, the numbers of cipher suites and
+// extensions and the first ALPN protocol, then the truncated hashes of the sorted cipher suites
+// and of the sorted extensions followed by the signature algorithms.
+func (h *ClientHello) JA4() string {
+	ciphers := withoutGREASE(h.CipherSuites)
+	extensions := withoutGREASE(h.Extensions)
+
+	version := h.Version
+	if supported := withoutGREASE(h.SupportedVersions); len(supported) > 0 {
+		version = supported[0]
+		for _, v := range supported[1:] {
+			if v > version {
+				version = v
+			}
+		}
+	}
+	versionCode, ok := ja4Versions[version]
+	if !ok {
+		versionCode = "00"
+	}
+	destination := "i"
+	for _, extension := range extensions {
+		if extension == extensionServerName {
+			destination = "d"
+		}
+	}
+	a := "t" + versionCode + destination + twoDigits(len(ciphers)) + twoDigits(len(extensions)) + ja4ALPN(h.ALPN)
+
+	sortedExtensions := make([]uint16, 0, len(extensions))
+	for _, extension := range extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			sortedExtensions = append(sortedExtensions, extension)
+		}
+	}
+	c := ""
+	if len(sortedExtensions) > 0 {
+		c = joinHex(sortedUint16s(sortedExtensions))
+		if algorithms := withoutGREASE(h.SignatureAlgorithms); len(algorithms) > 0 {
+			c += "_" + joinHex(algorithms)
+		}
+	}
+	return a + "_" + truncatedHash(joinHex(sortedUint16s(ciphers))) + "_" + truncatedHash(c)
+}
+
+func twoDigits(n int) string {
+	if n > 99 {
+		n = 99
+	}
+	return fmt.Sprintf("%02d", n)
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol, or of its hex form
+// if either isn't alphanumeric.
+func ja4ALPN(protocols []string) string {
+	if len(protocols) == 0 || protocols[0] == "" {
+		return "00"
+	}
+	protocol := protocols[0]
+	first, last := protocol[0], protocol[len(protocol)-1]
+	if !isAlphanumeric(first) || !isAlphanumeric(last) {
+		encoded := hex.EncodeToString([]byte(protocol))
+		first, last = encoded[0], encoded[len(encoded)-1]
+	}
+	return string([]byte{first, last})
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func sortedUint16s(values []uint16) []uint16 {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+func joinHex(values []uint16) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = fmt.Sprintf("%04x", value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// truncatedHash returns the first 12 hex characters of the SHA-256 of s, or zeros if s is empty.
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
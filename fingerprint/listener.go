@@ -0,0 +1,92 @@
+package fingerprint
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// maxClientHelloLength bounds the data recorded to parse a ClientHello. ClientHellos with large
+// post-quantum key shares are under 2 KiB.
+const maxClientHelloLength = 16 << 10
+
+// Listener records the ClientHello of the connections it accepts, before they are handed to
+// tls.NewListener.
+type Listener struct {
+	net.Listener
+}
+
+// NewListener wraps a listener to record ClientHellos.
+func NewListener(listener net.Listener) *Listener {
+	return &Listener{Listener: listener}
+}
+
+// Accept accepts a connection recording its ClientHello.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn}, nil
+}
+
+// Conn is a connection recording the ClientHello it reads.
+type Conn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	recorded []byte
+	done     bool
+	hello    *ClientHello
+}
+
+// Read reads from the connection, recording the data until a ClientHello is parsed from it.
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if !c.done {
+			c.recorded = append(c.recorded, p[:n]...)
+			hello, parseErr := Parse(c.recorded)
+			if !errors.Is(parseErr, ErrIncomplete) || len(c.recorded) >= maxClientHelloLength {
+				c.hello, c.done, c.recorded = hello, true, nil
+			}
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// ClientHello returns the ClientHello of the connection, or nil if it hasn't been read or
+// couldn't be parsed.
+func (c *Conn) ClientHello() *ClientHello {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hello
+}
+
+type connKey struct{}
+
+// ConnContext is an http.Server ConnContext making the ClientHello of connections accepted by a
+// Listener available to FromRequest.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if recording, ok := conn.(*Conn); ok {
+		return context.WithValue(ctx, connKey{}, recording)
+	}
+	return ctx
+}
+
+// FromRequest returns the ClientHello of the connection of a request, or nil if there is none.
+func FromRequest(req *http.Request) *ClientHello {
+	conn, ok := req.Context().Value(connKey{}).(*Conn)
+	if !ok {
+		return nil
+	}
+	return conn.ClientHello()
+}
@@ -0,0 +1,278 @@
+package forklift
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errInvalidSessionFallback = errors.New("invalid session fallback")
+	errInjectedBodyTooLarge   = errors.New("page too large to inject the session script into")
+)
+
+// Reasons HTML pages are sent without the session script.
+const (
+	injectionSkippedEncoding = "encoding"
+	injectionSkippedSize     = "size"
+	injectionSkippedInvalid  = "invalid"
+)
+
+const (
+	sessionFallbackScript = "script"
+	sessionFallbackQuery  = "query"
+
+	defaultSessionParameter = sessionCookieName
+	// maxInjectedBodySize is the largest HTML body buffered to inject the session script into.
+	// Larger bodies are sent as is.
+	maxInjectedBodySize = 2 << 20
+)
+
+// validateSessionFallbacks checks the modes of the rules' session fallbacks.
+func validateSessionFallbacks(rules []RoutingRule) error {
+	for _, rule := range rules {
+		fallback := rule.SessionFallback
+		if fallback == nil {
+			continue
+		}
+		switch fallback.Mode {
+		case sessionFallbackScript:
+		case sessionFallbackQuery:
+			if fallback.Parameter != "" && url.QueryEscape(fallback.Parameter) != fallback.Parameter {
+				return fmt.Errorf("%w: invalid parameter %q", errInvalidSessionFallback, fallback.Parameter)
+			}
+		default:
+			return fmt.Errorf("%w: unknown mode %q", errInvalidSessionFallback, fallback.Mode)
+		}
+	}
+	return nil
+}
+
+// sessionParameter returns the query parameter carrying the session ID for the rule's query
+// fallback.
+func sessionParameter(rule *RoutingRule) string {
+	if rule.SessionFallback.Parameter != "" {
+		return rule.SessionFallback.Parameter
+	}
+	return defaultSessionParameter
+}
+
+// sessionParameters returns the query parameters the rules' query fallbacks carry session IDs in.
+func sessionParameters(rules []RoutingRule) []string {
+	var parameters []string
+	seen := make(map[string]bool)
+	for i := range rules {
+		if rules[i].SessionFallback == nil || rules[i].SessionFallback.Mode != sessionFallbackQuery {
+			continue
+		}
+		if parameter := sessionParameter(&rules[i]); !seen[parameter] {
+			seen[parameter] = true
+			parameters = append(parameters, parameter)
+		}
+	}
+	return parameters
+}
+
+// sessionIDFromQuery returns the session ID carried in the query by a query fallback, if any.
+func (a *Forklift) sessionIDFromQuery(req *http.Request) string {
+	if len(a.sessionParameters) == 0 || req.URL.RawQuery == "" {
+		return ""
+	}
+	query := req.URL.Query()
+	for _, parameter := range a.sessionParameters {
+		if sessionID := query.Get(parameter); isValidSessionID(sessionID) {
+			return sessionID
+		}
+	}
+	return ""
+}
+
+// sessionFallbackOf returns the rule when it has a session fallback and the request came without
+// the session cookie, i.e. the cookie set for the session didn't persist.
+func sessionFallbackOf(rule *RoutingRule, req *http.Request) *RoutingRule {
+	if rule == nil || rule.SessionFallback == nil {
+		return nil
+	}
+	if cookie, err := req.Cookie(sessionCookieName); err == nil && isValidSessionID(cookie.Value) {
+		return nil
+	}
+	return rule
+}
+
+// redirectWithSession redirects GET and HEAD requests to their URL with the session ID in the
+// query parameter of the rule's query fallback, so it survives in the address the client
+// navigates to. It reports whether the request was redirected.
+func redirectWithSession(rw http.ResponseWriter, req *http.Request, sessionID string, rule *RoutingRule) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	parameter := sessionParameter(rule)
+	query := req.URL.Query()
+	if query.Get(parameter) == sessionID {
+		return false
+	}
+	query.Set(parameter, sessionID)
+	location := url.URL{Path: req.URL.Path, RawPath: req.URL.RawPath, RawQuery: query.Encode()}
+	rw.Header().Set("Cache-Control", "no-store")
+	http.Redirect(rw, req, location.String(), http.StatusFound)
+	return true
+}
+
+// sessionScriptWriter injects a script setting the session cookie from the page into HTML
+// responses, for clients whose session cookie set by the response is stripped. The body is
+// buffered to insert the script before the end of the head, or of the body, and to update its
+// length. Backends are asked for uncompressed responses; gzip bodies of backends sending them
+// anyway are decoded and encoded again, and bodies in other encodings, such as br, are left as is.
+// Pages sent without the script are counted in skipped by reason.
+type sessionScriptWriter struct {
+	http.ResponseWriter
+	script  []byte
+	skipped *metrics.CounterVec
+
+	status      int
+	wroteHeader bool
+	buffering   bool
+	gzipped     bool
+	body        bytes.Buffer
+}
+
+// newSessionScriptWriter returns the writer and a copy of req without Accept-Encoding.
+func newSessionScriptWriter(rw http.ResponseWriter, req *http.Request, sessionID string, skipped *metrics.CounterVec) (*sessionScriptWriter, *http.Request) {
+	secure := ""
+	if req.TLS != nil {
+		secure = "; Secure"
+	}
+	script := fmt.Sprintf(`<script>document.cookie=%s;</script>`,
+		strconv.Quote(fmt.Sprintf("%s=%s; Path=/; Max-Age=%d; SameSite=Strict%s",
+			sessionCookieName, sessionID, sessionCookieMaxAge, secure)))
+	uncompressed := req.Clone(req.Context())
+	uncompressed.Header.Del("Accept-Encoding")
+	return &sessionScriptWriter{ResponseWriter: rw, script: []byte(script), skipped: skipped}, uncompressed
+}
+
+func (w *sessionScriptWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	if isInformational(status) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	w.wroteHeader = true
+	if status == http.StatusOK && isHTML(w.Header()) {
+		encoding := w.Header().Get("Content-Encoding")
+		if encoding == "" || strings.EqualFold(encoding, "gzip") {
+			w.buffering = true
+			w.gzipped = encoding != ""
+			return
+		}
+		w.skipped.Inc(injectionSkippedEncoding)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// isHTML reports whether a response is an HTML page.
+func isHTML(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == "text/html"
+}
+
+func (w *sessionScriptWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.body.Len()+len(b) > maxInjectedBodySize {
+		// Too large to buffer, the body is sent without the script.
+		w.skipped.Inc(injectionSkippedSize)
+		w.buffering = false
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.body.Bytes()); err != nil {
+			return 0, err
+		}
+		w.body.Reset()
+		return w.ResponseWriter.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+// finish sends the buffered body with the script.
+func (w *sessionScriptWriter) finish() {
+	if !w.buffering {
+		return
+	}
+	body := w.body.Bytes()
+	if w.gzipped {
+		decoded, err := gunzipPage(body)
+		if err != nil {
+			// The body can't be decoded, or is too large once decoded, so it is sent as is.
+			if errors.Is(err, errInjectedBodyTooLarge) {
+				w.skipped.Inc(injectionSkippedSize)
+			} else {
+				w.skipped.Inc(injectionSkippedInvalid)
+			}
+			w.ResponseWriter.WriteHeader(w.status)
+			_, _ = w.ResponseWriter.Write(body)
+			return
+		}
+		body = decoded
+	}
+	i := bytes.Index(bytes.ToLower(body), []byte("</head>"))
+	if i < 0 {
+		i = bytes.LastIndex(bytes.ToLower(body), []byte("</body>"))
+	}
+	if i < 0 {
+		i = len(body)
+	}
+	injected := make([]byte, 0, len(body)+len(w.script))
+	injected = append(injected, body[:i]...)
+	injected = append(injected, w.script...)
+	injected = append(injected, body[i:]...)
+	if w.gzipped {
+		injected = gzipPage(injected)
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(injected)))
+	w.ResponseWriter.WriteHeader(w.status)
+	_, _ = w.ResponseWriter.Write(injected)
+}
+
+// gunzipPage decodes a gzip encoded page, failing for pages larger than maxInjectedBodySize.
+func gunzipPage(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := io.ReadAll(io.LimitReader(r, maxInjectedBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) > maxInjectedBodySize {
+		return nil, errInjectedBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// gzipPage encodes a page with gzip.
+func gzipPage(body []byte) []byte {
+	var encoded bytes.Buffer
+	gz, _ := gzipWriterPool.Get().(*gzip.Writer)
+	gz.Reset(&encoded)
+	_, _ = gz.Write(body)
+	_ = gz.Close()
+	gz.Reset(nil)
+	gzipWriterPool.Put(gz)
+	return encoded.Bytes()
+}
@@ -0,0 +1,177 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/flags"
+)
+
+var (
+	errUnknownFlagProvider = errors.New("unknown flag provider")
+	errDuplicateProvider   = errors.New("duplicate flag provider")
+	errInvalidFlagRule     = errors.New("invalid flag rule")
+	errInvalidFlagSource   = errors.New("invalid flag attribute source")
+	errInvalidFailureMode  = errors.New("invalid flag provider failure mode: must be open or closed")
+)
+
+const (
+	failOpen   = "open"
+	failClosed = "closed"
+)
+
+// flagProvider is a configured provider and what happens when it fails.
+type flagProvider struct {
+	flags.Provider
+	failClosed bool
+}
+
+// flagUnavailable answers requests whose flag can't be evaluated by a provider that fails closed.
+var flagUnavailable = RoutingRule{
+	Static: &config.StaticResponse{Status: http.StatusServiceUnavailable, Body: "Service Unavailable\n"},
+}
+
+// newFlagProviders creates the configured flag providers by name.
+func newFlagProviders(cfg *config.Config) (map[string]flagProvider, error) {
+	if len(cfg.FlagProviders) == 0 {
+		return nil, nil
+	}
+	providers := make(map[string]flagProvider, len(cfg.FlagProviders))
+	for _, providerConfig := range cfg.FlagProviders {
+		if _, ok := providers[providerConfig.Name]; ok {
+			return nil, fmt.Errorf("%w: %s", errDuplicateProvider, providerConfig.Name)
+		}
+		mode := strings.ToLower(providerConfig.FailureMode)
+		if mode != "" && mode != failOpen && mode != failClosed {
+			return nil, fmt.Errorf("%w: %q", errInvalidFailureMode, providerConfig.FailureMode)
+		}
+		provider, err := flags.New(providerConfig)
+		if err != nil {
+			return nil, err
+		}
+		providers[providerConfig.Name] = flagProvider{Provider: provider, failClosed: mode == failClosed}
+	}
+	return providers, nil
+}
+
+// validateFlagRules checks that flag rules reference a configured provider and map treatments to
+// backends. Flag rules pick their backend from the treatment, so they can't also set one.
+func validateFlagRules(cfg *config.Config) error {
+	names := make(map[string]bool, len(cfg.FlagProviders))
+	for _, provider := range cfg.FlagProviders {
+		names[provider.Name] = true
+	}
+
+	for _, rule := range cfg.Rules {
+		flag := rule.Flag
+		if flag == nil {
+			continue
+		}
+		switch {
+		case !names[flag.Provider]:
+			return fmt.Errorf("%w: %q", errUnknownFlagProvider, flag.Provider)
+		case flag.Name == "":
+			return fmt.Errorf("%w: name is required", errInvalidFlagRule)
+		case len(flag.Treatments) == 0:
+			return fmt.Errorf("%w: %s maps no treatments", errInvalidFlagRule, flag.Name)
+		case rule.Backend != "" || rule.Percentage != 0 || rule.Static != nil || rule.Redirect != nil:
+			return fmt.Errorf("%w: %s selects its backend from treatments and can't set a backend or percentage", errInvalidFlagRule, flag.Name)
+		}
+		if flag.Fallback != "" && flag.Treatments[flag.Fallback] == "" {
+			return fmt.Errorf("%w: fallback %q of %s maps to no backend", errInvalidFlagRule, flag.Fallback, flag.Name)
+		}
+		if flag.Key != "" && !validFlagSource(flag.Key) {
+			return fmt.Errorf("%w: %q", errInvalidFlagSource, flag.Key)
+		}
+		for _, source := range flag.Attributes {
+			if !validFlagSource(source) {
+				return fmt.Errorf("%w: %q", errInvalidFlagSource, source)
+			}
+		}
+	}
+	return nil
+}
+
+func validFlagSource(source string) bool {
+	kind, name, hasName := strings.Cut(source, ":")
+	switch kind {
+	case "header", "cookie", "query":
+		return hasName && name != ""
+	case "path", "method", "host":
+		return !hasName
+	}
+	return false
+}
+
+// flagSourceValue reads a request source, as validated by validFlagSource.
+func flagSourceValue(req *http.Request, source string) string {
+	kind, name, _ := strings.Cut(source, ":")
+	switch kind {
+	case "header":
+		return req.Header.Get(name)
+	case "cookie":
+		if cookie, err := req.Cookie(name); err == nil {
+			return cookie.Value
+		}
+	case "query":
+		return queryParamValue(req.URL.RawQuery, name)
+	case "path":
+		return req.URL.Path
+	case "method":
+		return req.Method
+	case "host":
+		return req.Host
+	}
+	return ""
+}
+
+// evaluateFlag selects the backend mapped to the treatment of a flag rule. It reports false when
+// the treatment maps to no backend, or when the evaluation fails and the rule has no fallback
+// and its provider fails open.
+func (a *Forklift) evaluateFlag(req *http.Request, sessionID string, rule *RoutingRule) (SelectedBackend, bool) {
+	flag := rule.Flag
+	subject := flags.Subject{Key: sessionID}
+	if flag.Key != "" {
+		subject.Key = flagSourceValue(req, flag.Key)
+	}
+	if len(flag.Attributes) > 0 {
+		subject.Attributes = make(map[string]string, len(flag.Attributes))
+		for name, source := range flag.Attributes {
+			subject.Attributes[name] = flagSourceValue(req, source)
+		}
+	}
+	subject.Key = a.scrubber.identity(subject.Key)
+
+	provider := a.flagProviders[flag.Provider]
+	treatment, err := a.evaluateProvider(req.Context(), provider, rule, subject)
+	if err != nil {
+		a.requestLogger(req).Errorf("Error evaluating flag %s: %v", flag.Name, err)
+		if flag.Fallback == "" {
+			if selected, ok := a.fallbackSelection(sessionID, rule, providerError); ok {
+				return selected, true
+			}
+		}
+		if flag.Fallback == "" && provider.failClosed {
+			return SelectedBackend{Backend: backendKey(flagUnavailable), Rule: &flagUnavailable, Reason: reasonFallback,
+				Assignment: assignedProviderError}, true
+		}
+		treatment = flag.Fallback
+	}
+
+	backend, ok := flag.Treatments[treatment]
+	if a.config.Debug {
+		a.logger.Debugf("Flag %s: treatment=%s backend=%s", flag.Name, treatment, backend)
+	}
+	if !ok || backend == "" {
+		return SelectedBackend{}, false
+	}
+	selected := SelectedBackend{Backend: backend, Rule: rule, Variant: treatment, Reason: reasonFlag}
+	if err != nil {
+		// The treatment is the flag's fallback.
+		selected.Assignment = assignedProviderError
+	}
+	return selected, true
+}
@@ -0,0 +1,81 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// document caches the definitions of a locally evaluating provider. Definitions are fetched on
+// first use and refreshed in the background once they are older than the refresh interval, so
+// only the first evaluation waits for the provider.
+type document struct {
+	fetch   func(ctx context.Context) (interface{}, error)
+	refresh time.Duration
+
+	mu         sync.RWMutex
+	value      interface{}
+	fetched    time.Time
+	now        func() time.Time
+	refreshing int32
+}
+
+func newDocument(refresh time.Duration, fetch func(ctx context.Context) (interface{}, error)) *document {
+	if refresh <= 0 {
+		refresh = defaultRefreshInterval
+	}
+	return &document{fetch: fetch, refresh: refresh, now: time.Now}
+}
+
+func (d *document) get(ctx context.Context) (interface{}, error) {
+	d.mu.RLock()
+	value, fetched, now := d.value, d.fetched, d.now
+	d.mu.RUnlock()
+
+	if value == nil {
+		return d.load(ctx)
+	}
+	if now().Sub(fetched) > d.refresh && atomic.CompareAndSwapInt32(&d.refreshing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&d.refreshing, 0)
+			_, _ = d.load(context.Background())
+		}()
+	}
+	return value, nil
+}
+
+func (d *document) load(ctx context.Context) (interface{}, error) {
+	value, err := d.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.value = value
+	d.fetched = d.now()
+	d.mu.Unlock()
+	return value, nil
+}
+
+func (d *document) setClock(now func() time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.now = now
+}
+
+// getJSON sends req and decodes the JSON response into v, failing with statusErr on other
+// statuses than 200.
+func getJSON(client *http.Client, req *http.Request, statusErr error, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", statusErr, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
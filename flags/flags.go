@@ -0,0 +1,214 @@
+// Package flags provides feature flag providers whose treatments select backends in the
+// Forklift middleware.
+package flags
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errUnknownProviderType = errors.New("unknown flag provider type")
+	errMissingProviderName = errors.New("flag provider requires a name")
+	errMissingURL          = errors.New("flag provider requires a url")
+	errInvalidRefresh      = errors.New("invalid flag provider refresh interval")
+)
+
+const (
+	defaultCacheTTL = 30 * time.Second
+	defaultTimeout  = 100 * time.Millisecond
+	maxCacheEntries = 100000
+)
+
+// Subject is the entity a flag is evaluated for.
+type Subject struct {
+	// Key identifies the subject, usually the session ID.
+	Key string
+	// Attributes are the targeting attributes derived from the request.
+	Attributes map[string]string
+}
+
+// Provider evaluates feature flags.
+type Provider interface {
+	// Evaluate returns the treatment, or variation, of the flag for the subject.
+	Evaluate(ctx context.Context, flag string, subject Subject) (string, error)
+}
+
+// Checker is implemented by providers that evaluate flags from definitions they load, to report
+// whether the definitions can be loaded.
+type Checker interface {
+	Ready(ctx context.Context) error
+}
+
+// Closer is implemented by providers that queue events, to send them before shutting down.
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// Options holds the parsed settings of a provider.
+type Options struct {
+	CacheTTL        time.Duration
+	Timeout         time.Duration
+	RefreshInterval time.Duration
+}
+
+// New creates the provider described by the configuration. Providers evaluating remotely are
+// wrapped in an evaluation cache.
+func New(cfg config.FlagProvider) (Provider, error) {
+	if cfg.Name == "" {
+		return nil, errMissingProviderName
+	}
+	opts, err := parseOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	typ := strings.ToLower(cfg.Type)
+	if cfg.URL == "" && typ != "flagsmith" && typ != "posthog" {
+		return nil, fmt.Errorf("%w: %s", errMissingURL, cfg.Name)
+	}
+
+	switch typ {
+	case "split":
+		return NewCache(NewSplitProvider(cfg.URL, cfg.APIKey, opts.Timeout), opts.CacheTTL), nil
+	case "growthbook":
+		return NewGrowthBookProvider(cfg.URL, cfg.APIKey, opts.Timeout, opts.RefreshInterval), nil
+	case "flagsmith":
+		provider := NewFlagsmithProvider(cfg.URL, cfg.APIKey, cfg.LocalEvaluation, opts.Timeout, opts.RefreshInterval)
+		if cfg.LocalEvaluation {
+			return provider, nil
+		}
+		return NewCache(provider, opts.CacheTTL), nil
+	case "posthog":
+		return NewCache(NewPostHogProvider(cfg.URL, cfg.APIKey, cfg.SendEvents, opts.Timeout), opts.CacheTTL), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownProviderType, cfg.Type)
+	}
+}
+
+func parseOptions(cfg config.FlagProvider) (Options, error) {
+	opts := Options{CacheTTL: defaultCacheTTL, Timeout: defaultTimeout, RefreshInterval: defaultRefreshInterval}
+	if cfg.CacheTTL != "" {
+		ttl, err := time.ParseDuration(cfg.CacheTTL)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid flag provider cache ttl: %w", err)
+		}
+		opts.CacheTTL = ttl
+	}
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid flag provider timeout: %w", err)
+		}
+		opts.Timeout = timeout
+	}
+	if cfg.RefreshInterval != "" {
+		interval, err := time.ParseDuration(cfg.RefreshInterval)
+		if err != nil || interval <= 0 {
+			return Options{}, fmt.Errorf("%w: %q", errInvalidRefresh, cfg.RefreshInterval)
+		}
+		opts.RefreshInterval = interval
+	}
+	return opts, nil
+}
+
+// Cache remembers evaluations for a TTL so flags are not evaluated remotely on every request.
+// Errors are not cached.
+type Cache struct {
+	provider Provider
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	treatment string
+	expires   time.Time
+}
+
+// NewCache wraps provider in an evaluation cache. A zero TTL disables caching.
+func NewCache(provider Provider, ttl time.Duration) *Cache {
+	return &Cache{
+		provider: provider,
+		ttl:      ttl,
+		now:      time.Now,
+		entries:  make(map[string]cacheEntry),
+	}
+}
+
+// Evaluate implements Provider.
+func (c *Cache) Evaluate(ctx context.Context, flag string, subject Subject) (string, error) {
+	if c.ttl <= 0 {
+		return c.provider.Evaluate(ctx, flag, subject)
+	}
+
+	key := cacheKey(flag, subject)
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.treatment, nil
+	}
+
+	treatment, err := c.provider.Evaluate(ctx, flag, subject)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	if len(c.entries) >= maxCacheEntries {
+		c.evictExpired(now)
+	}
+	if len(c.entries) < maxCacheEntries {
+		c.entries[key] = cacheEntry{treatment: treatment, expires: now.Add(c.ttl)}
+	}
+	c.mu.Unlock()
+	return treatment, nil
+}
+
+// Close implements Closer for cached providers that queue events.
+func (c *Cache) Close(ctx context.Context) error {
+	if closer, ok := c.provider.(Closer); ok {
+		return closer.Close(ctx)
+	}
+	return nil
+}
+
+// evictExpired removes expired entries. The caller must hold the lock.
+func (c *Cache) evictExpired(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// SetClock replaces the clock used for cache expiry. It must be called before the cache is used.
+func (c *Cache) SetClock(now func() time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func cacheKey(flag string, subject Subject) string {
+	var b strings.Builder
+	b.WriteString(flag)
+	b.WriteByte(0)
+	b.WriteString(subject.Key)
+	for _, name := range sortedKeys(subject.Attributes) {
+		b.WriteByte(0)
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(subject.Attributes[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,428 @@
+package flags
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" //nolint:gosec // Flagsmith buckets identities with MD5.
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errFlagsmithStatus = errors.New("flagsmith returned an error")
+
+const (
+	defaultFlagsmithURL = "https://edge.api.flagsmith.com"
+
+	// Treatments of flags without a value.
+	flagsmithEnabled  = "enabled"
+	flagsmithDisabled = "disabled"
+)
+
+// FlagsmithProvider evaluates Flagsmith flags for identities. In remote mode every evaluation,
+// subject to the cache, asks the identities endpoint. In local mode the environment document is
+// fetched with a server-side key and flags are evaluated in process, including segment and
+// identity overrides and multivariate splits.
+type FlagsmithProvider struct {
+	url            string
+	environmentKey string
+	client         *http.Client
+	environment    *document
+}
+
+// flagsmithFeatureState is a feature state in both the identities response and the
+// environment document.
+type flagsmithFeatureState struct {
+	Feature struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	} `json:"feature"`
+	Enabled                        bool                         `json:"enabled"`
+	FeatureStateValue              json.RawMessage              `json:"feature_state_value"`
+	DjangoID                       *int                         `json:"django_id"`
+	FeatureStateUUID               string                       `json:"featurestate_uuid"`
+	MultivariateFeatureStateValues []flagsmithMultivariateValue `json:"multivariate_feature_state_values"`
+	FeatureSegment                 *struct {
+		Priority int `json:"priority"`
+	} `json:"feature_segment"`
+}
+
+type flagsmithMultivariateValue struct {
+	ID                        *int    `json:"id"`
+	UUID                      string  `json:"mv_fs_value_uuid"`
+	PercentageAllocation      float64 `json:"percentage_allocation"`
+	MultivariateFeatureOption struct {
+		Value json.RawMessage `json:"value"`
+	} `json:"multivariate_feature_option"`
+}
+
+type flagsmithEnvironment struct {
+	APIKey        string                  `json:"api_key"`
+	FeatureStates []flagsmithFeatureState `json:"feature_states"`
+	Project       struct {
+		Segments []flagsmithSegment `json:"segments"`
+	} `json:"project"`
+	IdentityOverrides []struct {
+		Identifier       string                  `json:"identifier"`
+		IdentityFeatures []flagsmithFeatureState `json:"identity_features"`
+	} `json:"identity_overrides"`
+}
+
+type flagsmithSegment struct {
+	ID            int                     `json:"id"`
+	Rules         []flagsmithSegmentRule  `json:"rules"`
+	FeatureStates []flagsmithFeatureState `json:"feature_states"`
+}
+
+type flagsmithSegmentRule struct {
+	Type       string                 `json:"type"`
+	Rules      []flagsmithSegmentRule `json:"rules"`
+	Conditions []struct {
+		Operator string  `json:"operator"`
+		Property string  `json:"property_"`
+		Value    *string `json:"value"`
+	} `json:"conditions"`
+}
+
+// NewFlagsmithProvider creates a provider for the Flagsmith API at baseURL, or the Flagsmith Edge
+// API if it is empty. Local evaluation requires a server-side environment key.
+func NewFlagsmithProvider(baseURL, environmentKey string, local bool, timeout, refresh time.Duration) *FlagsmithProvider {
+	if baseURL == "" {
+		baseURL = defaultFlagsmithURL
+	}
+	f := &FlagsmithProvider{
+		url:            strings.TrimSuffix(baseURL, "/"),
+		environmentKey: environmentKey,
+		client:         &http.Client{Timeout: timeout},
+	}
+	if local {
+		f.environment = newDocument(refresh, f.fetchEnvironment)
+	}
+	return f
+}
+
+// Evaluate implements Provider. Flags with a value evaluate to it when they are enabled, flags
+// without one to "enabled", and disabled flags to "disabled".
+func (f *FlagsmithProvider) Evaluate(ctx context.Context, flag string, subject Subject) (string, error) {
+	var (
+		state *flagsmithFeatureState
+		err   error
+	)
+	if f.environment != nil {
+		state, err = f.evaluateLocally(ctx, flag, subject)
+	} else {
+		state, err = f.evaluateRemotely(ctx, flag, subject)
+	}
+	if err != nil {
+		return "", err
+	}
+	return state.treatment(), nil
+}
+
+func (s *flagsmithFeatureState) treatment() string {
+	if !s.Enabled {
+		return flagsmithDisabled
+	}
+	value := growthBookValue(s.FeatureStateValue)
+	if value == "" || value == "null" {
+		return flagsmithEnabled
+	}
+	return value
+}
+
+func (f *FlagsmithProvider) evaluateRemotely(ctx context.Context, flag string, subject Subject) (*flagsmithFeatureState, error) {
+	type trait struct {
+		Key   string `json:"trait_key"`
+		Value string `json:"trait_value"`
+	}
+	body := struct {
+		Identifier string  `json:"identifier"`
+		Traits     []trait `json:"traits"`
+		Transient  bool    `json:"transient"`
+	}{Identifier: subject.Key, Transient: true}
+	for _, name := range sortedKeys(subject.Attributes) {
+		body.Traits = append(body.Traits, trait{Key: name, Value: subject.Attributes[name]})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url+"/api/v1/identities/", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Environment-Key", f.environmentKey)
+
+	var result struct {
+		Flags []flagsmithFeatureState `json:"flags"`
+	}
+	if err := getJSON(f.client, req, errFlagsmithStatus, &result); err != nil {
+		return nil, err
+	}
+	for i := range result.Flags {
+		if result.Flags[i].Feature.Name == flag {
+			return &result.Flags[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", errUnknownFeature, flag)
+}
+
+func (f *FlagsmithProvider) fetchEnvironment(ctx context.Context) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.url+"/api/v1/environment-document/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Environment-Key", f.environmentKey)
+
+	environment := &flagsmithEnvironment{}
+	if err := getJSON(f.client, req, errFlagsmithStatus, environment); err != nil {
+		return nil, err
+	}
+	return environment, nil
+}
+
+// Ready implements Checker. In local mode it loads the environment document if it isn't yet;
+// remote evaluation has nothing to load.
+func (f *FlagsmithProvider) Ready(ctx context.Context) error {
+	if f.environment == nil {
+		return nil
+	}
+	_, err := f.environment.get(ctx)
+	return err
+}
+
+// SetClock replaces the clock used to decide when the environment document is refreshed.
+func (f *FlagsmithProvider) SetClock(now func() time.Time) {
+	if f.environment != nil {
+		f.environment.setClock(now)
+	}
+}
+
+// evaluateLocally resolves the feature state of an identity the way Flagsmith does: identity
+// overrides win over segment overrides, which win over the environment default. Multivariate
+// values are then chosen by the identity's bucket.
+func (f *FlagsmithProvider) evaluateLocally(ctx context.Context, flag string, subject Subject) (*flagsmithFeatureState, error) {
+	value, err := f.environment.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	environment, _ := value.(*flagsmithEnvironment)
+	compositeKey := environment.APIKey + "_" + subject.Key
+
+	var state *flagsmithFeatureState
+	for i := range environment.FeatureStates {
+		if environment.FeatureStates[i].Feature.Name == flag {
+			state = &environment.FeatureStates[i]
+			break
+		}
+	}
+	if state == nil {
+		return nil, fmt.Errorf("%w: %s", errUnknownFeature, flag)
+	}
+
+	priority := 0
+	overridden := false
+	for _, segment := range environment.Project.Segments {
+		for i := range segment.FeatureStates {
+			override := &segment.FeatureStates[i]
+			if override.Feature.Name != flag {
+				continue
+			}
+			overridePriority := 0
+			if override.FeatureSegment != nil {
+				overridePriority = override.FeatureSegment.Priority
+			}
+			if (!overridden || overridePriority < priority) && segment.matches(subject.Attributes, compositeKey) {
+				state, priority, overridden = override, overridePriority, true
+			}
+		}
+	}
+
+	for _, identity := range environment.IdentityOverrides {
+		if identity.Identifier != subject.Key {
+			continue
+		}
+		for i := range identity.IdentityFeatures {
+			if identity.IdentityFeatures[i].Feature.Name == flag {
+				state = &identity.IdentityFeatures[i]
+			}
+		}
+	}
+
+	resolved := *state
+	resolved.FeatureStateValue = state.multivariateValue(compositeKey)
+	return &resolved, nil
+}
+
+// multivariateValue returns the value of the multivariate option the identity falls into, or
+// the control value if it falls into none.
+func (s *flagsmithFeatureState) multivariateValue(compositeKey string) json.RawMessage {
+	if len(s.MultivariateFeatureStateValues) == 0 {
+		return s.FeatureStateValue
+	}
+	objectID := s.FeatureStateUUID
+	if s.DjangoID != nil {
+		objectID = strconv.Itoa(*s.DjangoID)
+	}
+	percentage := flagsmithPercentage([]string{objectID, compositeKey}, 1)
+
+	values := append([]flagsmithMultivariateValue(nil), s.MultivariateFeatureStateValues...)
+	sort.SliceStable(values, func(i, j int) bool { return values[i].sortKey() < values[j].sortKey() })
+	cumulative := 0.0
+	for _, value := range values {
+		cumulative += value.PercentageAllocation
+		if percentage < cumulative {
+			return value.MultivariateFeatureOption.Value
+		}
+	}
+	return s.FeatureStateValue
+}
+
+func (v flagsmithMultivariateValue) sortKey() string {
+	if v.ID != nil {
+		return fmt.Sprintf("%020d", *v.ID)
+	}
+	return v.UUID
+}
+
+// flagsmithPercentage hashes object IDs to a percentage in [0, 100) the way Flagsmith does.
+func flagsmithPercentage(objectIDs []string, iterations int) float64 {
+	toHash := strings.Repeat(strings.Join(objectIDs, ","), iterations)
+	sum := md5.Sum([]byte(toHash)) //nolint:gosec // Not used for security.
+	hashed := new(big.Int).SetBytes(sum[:])
+	value := float64(new(big.Int).Mod(hashed, big.NewInt(9999)).Int64()) / 9998 * 100
+	if value == 100 {
+		return flagsmithPercentage(objectIDs, iterations+1)
+	}
+	return value
+}
+
+func (s flagsmithSegment) matches(traits map[string]string, compositeKey string) bool {
+	if len(s.Rules) == 0 {
+		return false
+	}
+	for _, rule := range s.Rules {
+		if !rule.matches(traits, strconv.Itoa(s.ID), compositeKey) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r flagsmithSegmentRule) matches(traits map[string]string, segmentID, compositeKey string) bool {
+	if len(r.Conditions) > 0 {
+		matched := 0
+		for _, condition := range r.Conditions {
+			value := ""
+			if condition.Value != nil {
+				value = *condition.Value
+			}
+			if flagsmithCondition(condition.Operator, condition.Property, value, traits, segmentID, compositeKey) {
+				matched++
+			}
+		}
+		switch r.Type {
+		case "ALL":
+			if matched != len(r.Conditions) {
+				return false
+			}
+		case "ANY":
+			if matched == 0 {
+				return false
+			}
+		case "NONE":
+			if matched != 0 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	for _, nested := range r.Rules {
+		if !nested.matches(traits, segmentID, compositeKey) {
+			return false
+		}
+	}
+	return true
+}
+
+// flagsmithCondition evaluates a segment condition against string traits. Unsupported
+// operators never match.
+func flagsmithCondition(operator, property, value string, traits map[string]string, segmentID, compositeKey string) bool {
+	if operator == "PERCENTAGE_SPLIT" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		return err == nil && flagsmithPercentage([]string{segmentID, compositeKey}, 1) <= threshold
+	}
+
+	trait, exists := traits[property]
+	if exists && trait == "" {
+		exists = false
+	}
+	switch operator {
+	case "IS_SET":
+		return exists
+	case "IS_NOT_SET":
+		return !exists
+	}
+	if !exists {
+		return false
+	}
+
+	switch operator {
+	case "EQUAL":
+		return trait == value
+	case "NOT_EQUAL":
+		return trait != value
+	case "CONTAINS":
+		return strings.Contains(trait, value)
+	case "NOT_CONTAINS":
+		return !strings.Contains(trait, value)
+	case "IN":
+		for _, item := range strings.Split(value, ",") {
+			if trait == item {
+				return true
+			}
+		}
+		return false
+	case "REGEX":
+		re, err := regexp.Compile(value)
+		return err == nil && re.MatchString(trait)
+	case "GREATER_THAN":
+		return compareOrdered("$gt", trait, value)
+	case "GREATER_THAN_INCLUSIVE":
+		return compareOrdered("$gte", trait, value)
+	case "LESS_THAN":
+		return compareOrdered("$lt", trait, value)
+	case "LESS_THAN_INCLUSIVE":
+		return compareOrdered("$lte", trait, value)
+	case "MODULO":
+		divisor, remainder, ok := strings.Cut(value, "|")
+		d, errD := strconv.ParseFloat(divisor, 64)
+		r, errR := strconv.ParseFloat(remainder, 64)
+		t, errT := strconv.ParseFloat(trait, 64)
+		if !ok || errD != nil || errR != nil || errT != nil || d == 0 {
+			return false
+		}
+		return math.Mod(t, d) == r
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,380 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errGrowthBookStatus = errors.New("growthbook returned an error")
+	errUnknownFeature   = errors.New("unknown feature")
+)
+
+const (
+	defaultHashAttribute   = "id"
+	defaultRefreshInterval = 30 * time.Second
+)
+
+// GrowthBookProvider evaluates GrowthBook features locally from the definitions served by the
+// features endpoint of a GrowthBook API host.
+type GrowthBookProvider struct {
+	url      string
+	client   *http.Client
+	features *document
+}
+
+type growthBookFeature struct {
+	DefaultValue json.RawMessage  `json:"defaultValue"`
+	Rules        []growthBookRule `json:"rules"`
+}
+
+type growthBookRule struct {
+	Condition     map[string]interface{} `json:"condition"`
+	Force         json.RawMessage        `json:"force"`
+	Variations    []json.RawMessage      `json:"variations"`
+	Weights       []float64              `json:"weights"`
+	Coverage      *float64               `json:"coverage"`
+	HashAttribute string                 `json:"hashAttribute"`
+	HashVersion   int                    `json:"hashVersion"`
+	Key           string                 `json:"key"`
+	Seed          string                 `json:"seed"`
+}
+
+// NewGrowthBookProvider creates a provider for the features of clientKey on the GrowthBook API
+// host at baseURL.
+func NewGrowthBookProvider(baseURL, clientKey string, timeout, refresh time.Duration) *GrowthBookProvider {
+	g := &GrowthBookProvider{
+		url:    strings.TrimSuffix(baseURL, "/") + "/api/features/" + clientKey,
+		client: &http.Client{Timeout: timeout},
+	}
+	g.features = newDocument(refresh, g.fetch)
+	return g
+}
+
+// Evaluate implements Provider. The value of the feature is returned as its JSON text, with
+// strings unquoted, so boolean features evaluate to "true" or "false".
+func (g *GrowthBookProvider) Evaluate(ctx context.Context, flag string, subject Subject) (string, error) {
+	features, err := g.features.get(ctx)
+	if err != nil {
+		return "", err
+	}
+	feature, ok := features.(map[string]growthBookFeature)[flag]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errUnknownFeature, flag)
+	}
+
+	attributes := make(map[string]string, len(subject.Attributes)+1)
+	attributes[defaultHashAttribute] = subject.Key
+	for name, value := range subject.Attributes {
+		attributes[name] = value
+	}
+	return growthBookValue(evaluateFeature(flag, feature, attributes)), nil
+}
+
+func (g *GrowthBookProvider) fetch(ctx context.Context) (interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	var payload struct {
+		Features map[string]growthBookFeature `json:"features"`
+	}
+	if err := getJSON(g.client, req, errGrowthBookStatus, &payload); err != nil {
+		return nil, err
+	}
+	if payload.Features == nil {
+		payload.Features = make(map[string]growthBookFeature)
+	}
+	return payload.Features, nil
+}
+
+// Ready implements Checker, loading the feature definitions if they aren't yet.
+func (g *GrowthBookProvider) Ready(ctx context.Context) error {
+	_, err := g.features.get(ctx)
+	return err
+}
+
+// SetClock replaces the clock used to decide when definitions are refreshed.
+func (g *GrowthBookProvider) SetClock(now func() time.Time) {
+	g.features.setClock(now)
+}
+
+// evaluateFeature applies the rules of a feature in order: the first rule whose condition
+// matches and whose rollout or experiment includes the subject decides the value.
+func evaluateFeature(key string, feature growthBookFeature, attributes map[string]string) json.RawMessage {
+	for _, rule := range feature.Rules {
+		if rule.Condition != nil && !matchCondition(rule.Condition, attributes) {
+			continue
+		}
+
+		hashAttribute := rule.HashAttribute
+		if hashAttribute == "" {
+			hashAttribute = defaultHashAttribute
+		}
+		hashValue := attributes[hashAttribute]
+
+		if rule.Force != nil {
+			if rule.Coverage != nil {
+				if hashValue == "" {
+					continue
+				}
+				n, ok := growthBookHash(ruleSeed(rule, key), hashValue, rule.HashVersion)
+				if !ok || n > *rule.Coverage {
+					continue
+				}
+			}
+			return rule.Force
+		}
+
+		if len(rule.Variations) == 0 || hashValue == "" {
+			continue
+		}
+		experimentKey := rule.Key
+		if experimentKey == "" {
+			experimentKey = key
+		}
+		seed := rule.Seed
+		if seed == "" {
+			seed = experimentKey
+		}
+		n, ok := growthBookHash(seed, hashValue, rule.HashVersion)
+		if !ok {
+			continue
+		}
+		if variation := chooseVariation(n, bucketRanges(len(rule.Variations), rule.Coverage, rule.Weights)); variation >= 0 {
+			return rule.Variations[variation]
+		}
+	}
+	return feature.DefaultValue
+}
+
+func ruleSeed(rule growthBookRule, key string) string {
+	if rule.Seed != "" {
+		return rule.Seed
+	}
+	return key
+}
+
+// growthBookHash maps a value to [0, 1) the way GrowthBook SDKs do for hash versions 1 and 2.
+func growthBookHash(seed, value string, version int) (float64, bool) {
+	switch version {
+	case 0, 1:
+		return float64(fnv32a(value+seed)%1000) / 1000, true
+	case 2:
+		return float64(fnv32a(strconv.FormatUint(uint64(fnv32a(seed+value)), 10))%10000) / 10000, true
+	}
+	return 0, false
+}
+
+func fnv32a(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+type bucketRange struct {
+	start, end float64
+}
+
+// bucketRanges splits [0, 1) between the variations by weight, each range shrunk to the coverage.
+func bucketRanges(variations int, coverage *float64, weights []float64) []bucketRange {
+	c := 1.0
+	if coverage != nil {
+		c = *coverage
+	}
+	if c < 0 {
+		c = 0
+	}
+	if c > 1 {
+		c = 1
+	}
+
+	if len(weights) != variations {
+		weights = nil
+	} else {
+		total := 0.0
+		for _, w := range weights {
+			total += w
+		}
+		if total < 0.99 || total > 1.01 {
+			weights = nil
+		}
+	}
+	if weights == nil {
+		weights = make([]float64, variations)
+		for i := range weights {
+			weights[i] = 1 / float64(variations)
+		}
+	}
+
+	ranges := make([]bucketRange, variations)
+	cumulative := 0.0
+	for i, w := range weights {
+		ranges[i] = bucketRange{start: cumulative, end: cumulative + c*w}
+		cumulative += w
+	}
+	return ranges
+}
+
+func chooseVariation(n float64, ranges []bucketRange) int {
+	for i, r := range ranges {
+		if n >= r.start && n < r.end {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchCondition evaluates the subset of GrowthBook's targeting conditions that applies to
+// string attributes: equality, $eq, $ne, $in, $nin, $exists, $regex, $gt, $gte, $lt, $lte and
+// the $and, $or, $nor and $not combinators. Unsupported operators never match.
+func matchCondition(condition map[string]interface{}, attributes map[string]string) bool {
+	for field, expected := range condition {
+		switch field {
+		case "$and", "$or", "$nor":
+			conditions, ok := expected.([]interface{})
+			if !ok || !matchCombinator(field, conditions, attributes) {
+				return false
+			}
+		case "$not":
+			nested, ok := expected.(map[string]interface{})
+			if !ok || matchCondition(nested, attributes) {
+				return false
+			}
+		default:
+			value, exists := attributes[field]
+			if !matchValue(expected, value, exists) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchCombinator(op string, conditions []interface{}, attributes map[string]string) bool {
+	matched := 0
+	for _, c := range conditions {
+		nested, ok := c.(map[string]interface{})
+		if ok && matchCondition(nested, attributes) {
+			matched++
+		}
+	}
+	switch op {
+	case "$and":
+		return matched == len(conditions)
+	case "$or":
+		return matched > 0 || len(conditions) == 0
+	default:
+		return matched == 0
+	}
+}
+
+func matchValue(expected interface{}, value string, exists bool) bool {
+	operators, ok := expected.(map[string]interface{})
+	if !ok {
+		return exists && value == conditionString(expected)
+	}
+	for op, operand := range operators {
+		if !matchOperator(op, operand, value, exists) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchOperator(op string, operand interface{}, value string, exists bool) bool {
+	switch op {
+	case "$eq":
+		return exists && value == conditionString(operand)
+	case "$ne":
+		return !exists || value != conditionString(operand)
+	case "$in", "$nin":
+		list, _ := operand.([]interface{})
+		found := false
+		for _, item := range list {
+			if exists && value == conditionString(item) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in")
+	case "$exists":
+		want, _ := operand.(bool)
+		return exists == want
+	case "$regex":
+		pattern, _ := operand.(string)
+		re, err := regexp.Compile(pattern)
+		return err == nil && exists && re.MatchString(value)
+	case "$gt", "$gte", "$lt", "$lte":
+		return exists && compareOrdered(op, value, operand)
+	case "$not":
+		return !matchValue(operand, value, exists)
+	}
+	return false
+}
+
+// compareOrdered compares numerically when both sides are numbers and as strings otherwise.
+func compareOrdered(op, value string, operand interface{}) bool {
+	expected := conditionString(operand)
+	cmp := strings.Compare(value, expected)
+	if v, err := strconv.ParseFloat(value, 64); err == nil {
+		if e, err := strconv.ParseFloat(expected, 64); err == nil {
+			switch {
+			case v < e:
+				cmp = -1
+			case v > e:
+				cmp = 1
+			default:
+				cmp = 0
+			}
+		}
+	}
+	switch op {
+	case "$gt":
+		return cmp > 0
+	case "$gte":
+		return cmp >= 0
+	case "$lt":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
+
+// conditionString converts a condition operand to the string form attributes are compared in.
+func conditionString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// growthBookValue returns a feature value as a treatment: strings unquoted, anything else as JSON.
+func growthBookValue(value json.RawMessage) string {
+	if len(value) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		return s
+	}
+	return string(value)
+}
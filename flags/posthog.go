@@ -0,0 +1,219 @@
+package flags
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errPostHogStatus = errors.New("posthog returned an error")
+
+const (
+	defaultPostHogURL = "https://us.i.posthog.com"
+
+	postHogBatchSize     = 100
+	postHogFlushInterval = time.Second
+	postHogQueueSize     = 10000
+	postHogMaxReported   = 100000
+)
+
+// PostHogProvider evaluates PostHog feature flags with the decide endpoint. When events are
+// enabled, the first evaluation of each flag value per distinct ID is reported as a
+// $feature_flag_called event, the way PostHog's SDKs do, so insights can break funnels down by
+// the variant served.
+type PostHogProvider struct {
+	url    string
+	apiKey string
+	client *http.Client
+
+	events   chan postHogEvent
+	mu       sync.Mutex
+	reported map[string]struct{}
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+type postHogEvent struct {
+	Event      string                 `json:"event"`
+	DistinctID string                 `json:"distinct_id"`
+	Properties map[string]interface{} `json:"properties"`
+	Timestamp  time.Time              `json:"timestamp"`
+}
+
+// NewPostHogProvider creates a provider for the PostHog project with apiKey at baseURL, or
+// PostHog's US cloud if it is empty.
+func NewPostHogProvider(baseURL, apiKey string, sendEvents bool, timeout time.Duration) *PostHogProvider {
+	if baseURL == "" {
+		baseURL = defaultPostHogURL
+	}
+	p := &PostHogProvider{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		apiKey: apiKey,
+		client: &http.Client{Timeout: timeout},
+	}
+	if sendEvents {
+		p.events = make(chan postHogEvent, postHogQueueSize)
+		p.reported = make(map[string]struct{})
+		p.closing = make(chan struct{})
+		p.done = make(chan struct{})
+		go p.sendEvents()
+	}
+	return p
+}
+
+// Evaluate implements Provider. Boolean flags evaluate to "true" or "false" and multivariate
+// flags to their variant. Flags missing from the response evaluate to "false".
+func (p *PostHogProvider) Evaluate(ctx context.Context, flag string, subject Subject) (string, error) {
+	body := map[string]interface{}{"api_key": p.apiKey, "distinct_id": subject.Key}
+	if len(subject.Attributes) > 0 {
+		body["person_properties"] = subject.Attributes
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/decide/?v=3", bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var result struct {
+		FeatureFlags map[string]interface{} `json:"featureFlags"`
+	}
+	if err := getJSON(p.client, req, errPostHogStatus, &result); err != nil {
+		return "", err
+	}
+
+	treatment := "false"
+	switch value := result.FeatureFlags[flag].(type) {
+	case string:
+		treatment = value
+	case bool:
+		if value {
+			treatment = "true"
+		}
+	}
+	p.report(flag, subject.Key, treatment)
+	return treatment, nil
+}
+
+// report queues a $feature_flag_called event unless the same response was already reported for
+// the distinct ID. Events are dropped when the queue is full.
+func (p *PostHogProvider) report(flag, distinctID, treatment string) {
+	if p.events == nil {
+		return
+	}
+	key := flag + "\x00" + distinctID + "\x00" + treatment
+	p.mu.Lock()
+	if _, ok := p.reported[key]; ok {
+		p.mu.Unlock()
+		return
+	}
+	if len(p.reported) >= postHogMaxReported {
+		p.reported = make(map[string]struct{})
+	}
+	p.reported[key] = struct{}{}
+	p.mu.Unlock()
+
+	event := postHogEvent{
+		Event:      "$feature_flag_called",
+		DistinctID: distinctID,
+		Properties: map[string]interface{}{
+			"$feature_flag":          flag,
+			"$feature_flag_response": treatment,
+			"$lib":                   "forklift",
+		},
+		Timestamp: time.Now().UTC(),
+	}
+	select {
+	case p.events <- event:
+	default:
+	}
+}
+
+// sendEvents sends queued events to the batch endpoint, every second or once a batch is full.
+func (p *PostHogProvider) sendEvents() {
+	ticker := time.NewTicker(postHogFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]postHogEvent, 0, postHogBatchSize)
+	for {
+		select {
+		case event := <-p.events:
+			batch = append(batch, event)
+			if len(batch) < postHogBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-p.closing:
+			p.flush(batch)
+			close(p.done)
+			return
+		}
+		_ = p.sendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush sends the pending batch and the events left in the queue.
+func (p *PostHogProvider) flush(batch []postHogEvent) {
+	for {
+		select {
+		case event := <-p.events:
+			batch = append(batch, event)
+			if len(batch) < postHogBatchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				_ = p.sendBatch(batch)
+			}
+			return
+		}
+		_ = p.sendBatch(batch)
+		batch = batch[:0]
+	}
+}
+
+// Close implements Closer. It sends the queued events and stops sending new ones, waiting until
+// ctx is done.
+func (p *PostHogProvider) Close(ctx context.Context) error {
+	if p.events == nil {
+		return nil
+	}
+	p.closeOnce.Do(func() { close(p.closing) })
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *PostHogProvider) sendBatch(batch []postHogEvent) error {
+	data, err := json.Marshal(map[string]interface{}{"api_key": p.apiKey, "batch": batch})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, p.url+"/batch/", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,64 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errSplitStatus = errors.New("split evaluator returned an error")
+
+// SplitProvider evaluates splits through the Split Evaluator, Split's REST service for
+// evaluating treatments outside of its SDK languages.
+type SplitProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewSplitProvider creates a provider for the Split Evaluator at baseURL. The token is sent as
+// the Authorization header, matching the evaluator's SPLIT_EVALUATOR_AUTH_TOKEN.
+func NewSplitProvider(baseURL, token string, timeout time.Duration) *SplitProvider {
+	return &SplitProvider{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		token:  token,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+type splitTreatment struct {
+	SplitName string `json:"splitName"`
+	Treatment string `json:"treatment"`
+}
+
+// Evaluate implements Provider.
+func (s *SplitProvider) Evaluate(ctx context.Context, flag string, subject Subject) (string, error) {
+	query := url.Values{}
+	query.Set("key", subject.Key)
+	query.Set("split-name", flag)
+	if len(subject.Attributes) > 0 {
+		attributes, err := json.Marshal(subject.Attributes)
+		if err != nil {
+			return "", err
+		}
+		query.Set("attributes", string(attributes))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url+"/client/get-treatment?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if s.token != "" {
+		req.Header.Set("Authorization", s.token)
+	}
+
+	var result splitTreatment
+	if err := getJSON(s.client, req, errSplitStatus, &result); err != nil {
+		return "", err
+	}
+	return result.Treatment, nil
+}
@@ -7,18 +7,23 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
-	"hash"
-	"hash/fnv"
 	"io"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/daemonp/forklift/config"
 	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/secrets"
+	"github.com/daemonp/forklift/store"
 )
 
 // RoutingRule is an alias for config.RoutingRule.
@@ -46,6 +51,7 @@ const (
 	sessionIDByteLength  = 32
 	maxPercentage        = 100.0
 	percentageScale      = 100.0
+	copyBufferSize       = 32 * 1024
 )
 
 // Forklift is the main struct for the middleware.
@@ -55,6 +61,116 @@ type Forklift struct {
 	name       string
 	ruleEngine *RuleEngine
 	logger     logger.Logger
+	scrubber   *scrubber
+	hooks      []Hook
+	client     *http.Client
+	svid       *svidSource
+
+	sessionStore store.SessionStore
+	storeOptions store.Options
+	assignments  *assignmentCache
+	writer       *assignmentWriter
+
+	metrics      *metrics.Registry
+	exposures    *exposureLogger
+	churn        *churnMonitor
+	results      *resultsExporter
+	backpressure *backpressure
+	// headerScrubbers scrub the headers of requests to the backends they are keyed by.
+	headerScrubbers map[string]*headerScrubber
+
+	experiments map[string][]*RoutingRule
+	drains      map[*RoutingRule]drainWindow
+	migrator    *migrator
+	migrations  *metrics.CounterVec
+
+	blackouts     []*blackout
+	ruleBlackouts map[*RoutingRule][]*blackout
+
+	// warmUps mirror requests to the backends of rules warming up, which are not assigned yet.
+	warmUps     *warmUps
+	ruleWarmUps map[*RoutingRule]*backendWarmUp
+
+	// bucketPatterns narrow the values percentage splits of pages are bucketed by.
+	bucketPatterns map[*RoutingRule]*regexp.Regexp
+	// countries locates requests for the country percentages of rules.
+	countries *countryResolver
+
+	ruleMetrics *ruleMetrics
+	ruleKeys    map[*RoutingRule]string
+	// ruleLabels are the labels of the rules in metrics, if their cardinality is limited.
+	ruleLabels map[*RoutingRule]string
+	// findings are the likely mistakes found in the rules, served by the admin API.
+	findings []config.Finding
+	// sessionParameters are the query parameters carrying session IDs for query fallbacks.
+	sessionParameters []string
+
+	frequency        *requestFrequency
+	frequencySources []string
+
+	// acceptCH is the Accept-CH header asking for the client hints of the rules, if any.
+	acceptCH string
+
+	errorBudgets map[*RoutingRule]*errorBudget
+	ruleFailures *metrics.CounterVec
+
+	fallback        *fallbackPolicy
+	fallbacks       map[*RoutingRule]*fallbackPolicy
+	lastAssignments *lastAssignments
+	resourcePins    *resourcePins
+	connectionPins  *connectionPins
+	requestLimits   *requestLimits
+	killSwitch      *killSwitch
+
+	flagProviders map[string]flagProvider
+
+	canary  *canaryAnalysis
+	leader  *leaderElection
+	traffic *trafficAPI
+	admin   *adminAPI
+	history *ruleHistory
+	// liveTraffic counts the requests of each variant for the admin UI.
+	liveTraffic *liveTraffic
+	// decisions keeps the most recent routing decisions for the admin API.
+	decisions *decisionLog
+	// remote asks the decision service where to route requests, if one is configured.
+	remote *remoteDecisions
+	// script runs the functions of the configured script, if any.
+	script ScriptEngine
+	// counters counts the requests of each variant across the cluster.
+	counters *clusterCounters
+
+	propagation *propagation
+	// rulesVersion identifies the rules in propagated headers. It is only set with propagation.
+	rulesVersion string
+
+	interceptedErrors *metrics.CounterVec
+	withoutConsent    *metrics.CounterVec
+	assignmentReasons *metrics.CounterVec
+	skippedScripts    *metrics.CounterVec
+
+	// active holds the *Forklift serving requests when rules are loaded from a bundle or changed
+	// at runtime, and source the rules the changes are applied to. They are shared by the
+	// middleware and the copies created for each rule change.
+	active *atomic.Value
+	source *ruleSource
+	// rulesReady is set once the first bundle has been applied.
+	rulesReady *atomic.Bool
+
+	lifecycle  *lifecycle
+	unsaved    *unsavedAssignments
+	requestIDs *requestIDs
+
+	random io.Reader
+	now    func() time.Time
+}
+
+// copyBufferPool holds the buffers used to copy backend responses to clients.
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, copyBufferSize)
+		return &buf
+	},
 }
 
 // RuleEngine handles rule matching and caching.
@@ -62,14 +178,48 @@ type RuleEngine struct {
 	config *config.Config
 	cache  *sync.Map
 	logger logger.Logger
+	index  *ruleIndex
+	// scrubber scrubs the request data in debug logs. It is set by NewForklift.
+	scrubber *scrubber
+	// frequency counts the requests of identities for frequency conditions. It is set by
+	// NewForklift.
+	frequency *requestFrequency
+	// introspector checks bearer tokens for token conditions. It is set by NewForklift.
+	introspector *tokenIntrospector
+	// loaded holds the evaluators of custom conditions loaded from the configuration, such as
+	// WASM evaluators, by name. It is set by NewForklift.
+	loaded map[string]ConditionEvaluator
+
+	newSessionWindows map[*RoutingRule]time.Duration
+	now               func() time.Time
+
+	regexLimits regexLimits
+	// regexes holds the compiled patterns of regex conditions.
+	regexes *sync.Map
+	// regexBudgets counts the rules going over the regex budget. It is set by NewForklift.
+	regexBudgets *metrics.CounterVec
+	// tags holds the index of each tag of the configuration by name.
+	tags map[string]int
 }
 
 // NewRuleEngine creates a new RuleEngine instance.
 func NewRuleEngine(cfg *config.Config, logger logger.Logger) *RuleEngine {
+	limits, err := parseRegexLimits(cfg.Regex)
+	if err != nil {
+		limits, _ = parseRegexLimits(nil)
+	}
 	return &RuleEngine{
 		config: cfg,
 		cache:  &sync.Map{},
 		logger: logger,
+		index:  newRuleIndex(cfg.Rules),
+
+		newSessionWindows: newSessionWindows(cfg.Rules),
+		now:               time.Now,
+
+		regexLimits: limits,
+		regexes:     &sync.Map{},
+		tags:        tagIndexes(cfg.Tags),
 	}
 }
 
@@ -86,6 +236,9 @@ func New(ctx context.Context, next http.Handler, cfg interface{}, name string) (
 	if !ok {
 		return nil, errInvalidConfigType
 	}
+	if err := migrateConfig(parsedConfig, logger.NewLogger("forklift")); err != nil {
+		return nil, err
+	}
 
 	if parsedConfig.DefaultBackend == "" {
 		return nil, errDefaultBackendNotSet
@@ -100,34 +253,225 @@ func New(ctx context.Context, next http.Handler, cfg interface{}, name string) (
 }
 
 // NewForklift creates a new middleware.
-func NewForklift(_ context.Context, next http.Handler, cfg *config.Config, name string) (*Forklift, error) {
+func NewForklift(ctx context.Context, next http.Handler, cfg *config.Config, name string) (*Forklift, error) {
 	if cfg == nil {
 		return nil, errEmptyConfig
 	}
+	logger := logger.NewLogger("forklift")
+	if err := migrateConfig(cfg, logger); err != nil {
+		return nil, err
+	}
 	if cfg.DefaultBackend == "" {
 		return nil, errMissingDefaultBackend
 	}
-	for _, rule := range cfg.Rules {
-		if rule.Percentage < 0 || rule.Percentage > 100 {
-			return nil, errInvalidPercentage
-		}
+	if err := validateRules(cfg); err != nil {
+		return nil, err
 	}
 
 	// Turn off debugging
 	cfg.Debug = false
 
-	// Sort rules by priority (higher priority first)
-	sort.Slice(cfg.Rules, func(i, j int) bool {
-		return cfg.Rules[i].Priority > cfg.Rules[j].Priority
-	})
+	sortRules(cfg.Rules)
 
-	logger := logger.NewLogger("forklift")
+	registry := metrics.NewRegistry()
+	if err := validateMetricsLabels(cfg.MetricsLabels); err != nil {
+		return nil, err
+	}
 
-	ruleEngine := &RuleEngine{
-		config: cfg,
-		cache:  &sync.Map{},
-		logger: logger,
+	canary, err := newCanaryAnalysis(cfg, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	configuredRules := cfg.Rules
+	if canary != nil {
+		if cfg.Rules, err = overrideRules(cfg.Rules, canary, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	ruleEngine := NewRuleEngine(cfg, logger)
+
+	drains, err := drainWindows(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := bucketPatterns(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	blackoutWindows, err := ruleBlackouts(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	blackouts, err := parseBlackouts(cfg.Blackouts)
+	if err != nil {
+		return nil, err
+	}
+	warmUps := newWarmUps(registry)
+	ruleWarmUps, err := warmUps.rules(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	budgets, err := errorBudgets(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := parseFallbackPolicy(cfg.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	fallbacks, err := fallbackPolicies(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := lookupHooks(cfg.Hooks)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionStore, storeOptions, err := store.New(cfg.SessionStore)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := secrets.Resolve(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	scrubber, err := newScrubber(credentials)
+	if err != nil {
+		return nil, err
+	}
+	ruleEngine.scrubber = scrubber
+	ruleEngine.regexBudgets = registry.Counter("forklift_regex_budget_exceeded_total",
+		"Number of rule evaluations whose regex conditions went over their time budget.")
+
+	admin, err := newAdminAPI(credentials)
+	if err != nil {
+		return nil, err
+	}
+	history, err := newRuleHistory(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	propagation, err := newPropagation(cfg)
+	if err != nil {
+		return nil, err
+	}
+	traffic, err := newTrafficAPI(credentials)
+	if err != nil {
+		return nil, err
+	}
+	leader, err := newLeaderElection(cfg, name, sessionStore, storeOptions, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	counters, err := newClusterCounters(cfg, name, sessionStore, storeOptions, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	decisions, err := newDecisionLog(cfg)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := newRemoteDecisions(cfg, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	script, err := loadScript(cfg, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	svid, err := newSVIDSource(cfg.SPIFFE, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: defaultTimeout}
+	if svid != nil {
+		client.Transport = svid.transport()
+	}
+
+	frequency, err := newRequestFrequency(cfg.Frequency)
+	if err != nil {
+		return nil, err
+	}
+	ruleEngine.frequency = frequency
+
+	introspector, err := newTokenIntrospector(credentials.Introspection, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	ruleEngine.introspector = introspector
+	loaded, releaseEvaluators, err := loadEvaluators(cfg, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	ruleEngine.loaded = loaded
+
+	exposures, err := newExposureLogger(credentials, logger, registry, scrubber)
+	if err != nil {
+		return nil, err
+	}
+	churn, err := newChurnMonitor(cfg, name, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	countries, err := newCountryResolver(cfg, registry)
+	if err != nil {
+		return nil, err
+	}
+	resultsExport, err := newResultsExporter(cfg, name, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	if resultsExport != nil {
+		resultsExport.counters = counters
+	}
+	backpressure, err := newBackpressure(cfg, registry)
+	if err != nil {
+		return nil, err
 	}
+	headerScrubbers, err := newHeaderScrubbers(cfg)
+	if err != nil {
+		return nil, err
+	}
+	flagProviders, err := newFlagProviders(credentials)
+	if err != nil {
+		return nil, err
+	}
+	lifecycle, err := newLifecycle(cfg.ShutdownTimeout)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := newResourcePins(cfg.ResourcePinTTL)
+	if err != nil {
+		return nil, err
+	}
+	connectionPins, err := newConnectionPins(cfg.ConnectionPinTTL)
+	if err != nil {
+		return nil, err
+	}
+	limits, err := newRequestLimits(cfg.RequestLimits, registry)
+	if err != nil {
+		return nil, err
+	}
+	killSwitch, err := newKillSwitch(cfg, sessionStore, storeOptions, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := newAssignmentCache(cfg.SessionStore, registry)
+	if err != nil {
+		return nil, err
+	}
+	unsaved := newUnsavedAssignments()
+	writer, err := newAssignmentWriter(cfg.SessionStore, sessionStore, storeOptions, unsaved, logger, registry)
+	if err != nil {
+		return nil, err
+	}
+	migrations := registry.Counter("forklift_migrations_total",
+		"Number of sessions migrated from an ended variant.", "experiment", "from", "to")
 
 	go ruleEngine.cleanupCache()
 
@@ -137,17 +481,336 @@ func NewForklift(_ context.Context, next http.Handler, cfg *config.Config, name
 		name:       name,
 		ruleEngine: ruleEngine,
 		logger:     logger,
+		scrubber:   scrubber,
+		hooks:      hooks,
+		client:     client,
+		svid:       svid,
+
+		sessionStore: sessionStore,
+		storeOptions: storeOptions,
+		assignments:  assignments,
+		writer:       writer,
+
+		metrics:      registry,
+		exposures:    exposures,
+		churn:        churn,
+		results:      resultsExport,
+		backpressure: backpressure,
+
+		headerScrubbers: headerScrubbers,
+
+		experiments: experimentGroups(cfg.Rules),
+		drains:      drains,
+		migrator:    newMigrator(cfg.Rules, sessionStore, storeOptions, migrations),
+		migrations:  migrations,
+
+		blackouts:     blackouts,
+		ruleBlackouts: blackoutWindows,
+
+		warmUps:     warmUps,
+		ruleWarmUps: ruleWarmUps,
+
+		bucketPatterns: patterns,
+		countries:      countries,
+
+		ruleMetrics: newRuleMetrics(cfg, registry),
+		ruleKeys:    ruleKeys(cfg.Rules),
+		ruleLabels:  ruleLabels(cfg.Rules, cfg.MetricsLabels),
+		findings:    analyzeRules(cfg, nil, logger),
+
+		sessionParameters: sessionParameters(cfg.Rules),
+
+		frequency:        frequency,
+		frequencySources: frequencySources(append(tagRules(cfg.Tags), cfg.Rules...)),
+
+		acceptCH: acceptClientHints(append(tagRules(cfg.Tags), cfg.Rules...)),
+
+		errorBudgets: budgets,
+		ruleFailures: registry.Counter("forklift_rule_failures_total",
+			"Number of rule evaluation failures by rule and reason: panic or flag_error.", "rule", "reason"),
+
+		fallback:        fallback,
+		fallbacks:       fallbacks,
+		lastAssignments: newLastAssignments(fallback, fallbacks),
+		resourcePins:    pins,
+		connectionPins:  connectionPins,
+		requestLimits:   limits,
+		killSwitch:      killSwitch,
+
+		flagProviders: flagProviders,
+
+		canary:  canary,
+		leader:  leader,
+		traffic: traffic,
+		admin:   admin,
+		history: history,
+
+		liveTraffic: newLiveTraffic(cfg),
+		decisions:   decisions,
+		remote:      remote,
+		script:      script,
+		counters:    counters,
+
+		propagation: propagation,
+
+		interceptedErrors: registry.Counter("forklift_intercepted_errors_total",
+			"Number of backend errors intercepted by rule and action: retry or page.", "rule", "action"),
+
+		withoutConsent: registry.Counter("forklift_requests_without_consent_total",
+			"Number of requests served by the default backend for lack of consent."),
+		assignmentReasons: registry.Counter("forklift_assignments_total",
+			"Number of requests by experiment and assignment reason: rule-match, sticky-reuse, override, fallback-default or provider-error.",
+			"experiment", "reason"),
+		skippedScripts: registry.Counter("forklift_session_script_skipped_total",
+			"Number of HTML pages sent without the session script by reason: encoding, size or invalid.", "reason"),
+
+		lifecycle:  lifecycle,
+		unsaved:    unsaved,
+		requestIDs: newRequestIDs(),
+
+		random: rand.Reader,
+		now:    time.Now,
+	}
+
+	if propagation != nil {
+		forklift.rulesVersion = rulesVersion(cfg.Rules)
+	}
+	if cfg.RuleBundle != nil || canary != nil || traffic != nil || history != nil || (admin != nil && admin.ui) {
+		forklift.source = &ruleSource{rules: configuredRules}
+		forklift.active = &atomic.Value{}
+		forklift.active.Store(forklift)
+	}
+	history.record(configuredRules, "configuration", forklift.now())
+	if cfg.RuleBundle != nil {
+		if err := forklift.watchRuleBundle(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if canary != nil {
+		forklift.analyzeCanaries()
+	}
+	if leader != nil {
+		forklift.electLeader()
+	}
+	if counters != nil {
+		forklift.flushClusterCounters()
+	}
+	if killSwitch != nil && killSwitch.store != nil {
+		forklift.pollKillSwitch()
+	}
+	if resultsExport != nil {
+		resultsExport.restart(forklift.now())
+		forklift.exportResults()
+	}
+	if svid != nil {
+		go svid.watch(lifecycle.done)
+	}
+	if releaseEvaluators != nil {
+		go func() {
+			<-lifecycle.done
+			releaseEvaluators()
+		}()
 	}
 
+	forklift.shutdownOnDone(ctx)
 	forklift.logger.Infof("Starting Forklift middleware: %s", name)
 
 	return forklift, nil
 }
 
+// migrateConfig upgrades a configuration to the current schema version, logging its deprecation
+// notices.
+func migrateConfig(cfg *config.Config, logger logger.Logger) error {
+	notices, err := config.Migrate(cfg)
+	if err != nil {
+		return err
+	}
+	for _, notice := range notices {
+		logger.Warnf("Deprecated configuration: %s", notice)
+	}
+	return nil
+}
+
+// validateRules checks the rules of a configuration, expands their matches into conditions and
+// loads the bodies of static responses.
+func validateRules(cfg *config.Config) error {
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].ExpandMatch(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Percentage < 0 || rule.Percentage > 100 {
+			return errInvalidPercentage
+		}
+		if rule.Redirect != nil {
+			if err := validateRedirect(rule.Redirect); err != nil {
+				return err
+			}
+		}
+	}
+	if err := loadStaticBodies(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateErrorInterceptions(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateCompression(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validatePreloads(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateEvaluators(cfg); err != nil {
+		return err
+	}
+	if err := validateTraefikConditions(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateClientHintConditions(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateFingerprintConditions(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateNewSessionWindows(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateDependencies(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateMigrations(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateFlagRules(cfg); err != nil {
+		return err
+	}
+	if err := validateConsent(cfg); err != nil {
+		return err
+	}
+	if err := validateSessionFallbacks(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateFrequencyConditions(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateAssignmentGroups(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validatePageBuckets(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateCountryPercentages(cfg); err != nil {
+		return err
+	}
+	if err := validateRegexes(cfg); err != nil {
+		return err
+	}
+	if err := validateTokenConditions(cfg); err != nil {
+		return err
+	}
+	if err := validateIdentities(cfg); err != nil {
+		return err
+	}
+	if err := validateWarmUps(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateAATests(cfg.Rules); err != nil {
+		return err
+	}
+	if err := validateTags(cfg); err != nil {
+		return err
+	}
+	if err := validateRulePaths(cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sortRules sorts rules by priority, higher priority first. Lookups keyed by rule pointers must
+// be built after sorting.
+func sortRules(rules []RoutingRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Priority > rules[j].Priority
+	})
+}
+
+// withRules returns a copy of the middleware that routes with the given rules. The copy shares
+// the session store, metrics, exposure logger, flag providers and hooks of the original.
+func (a *Forklift) withRules(rules []RoutingRule) (*Forklift, error) {
+	cfg := *a.config
+	cfg.Rules = rules
+	if err := validateRules(&cfg); err != nil {
+		return nil, err
+	}
+	sortRules(cfg.Rules)
+
+	drains, err := drainWindows(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	patterns, err := bucketPatterns(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	blackoutWindows, err := ruleBlackouts(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	budgets, err := errorBudgets(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	fallbacks, err := fallbackPolicies(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+	ruleWarmUps, err := a.warmUps.rules(cfg.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	clone := *a
+	clone.config = &cfg
+	clone.ruleEngine = NewRuleEngine(&cfg, a.logger)
+	clone.ruleEngine.now = a.ruleEngine.now
+	clone.ruleEngine.scrubber = a.scrubber
+	clone.ruleEngine.frequency = a.frequency
+	clone.ruleEngine.introspector = a.ruleEngine.introspector
+	clone.ruleEngine.loaded = a.ruleEngine.loaded
+	clone.ruleEngine.regexBudgets = a.ruleEngine.regexBudgets
+	clone.experiments = experimentGroups(cfg.Rules)
+	clone.drains = drains
+	clone.ruleBlackouts = blackoutWindows
+	clone.ruleWarmUps = ruleWarmUps
+	clone.bucketPatterns = patterns
+	clone.ruleKeys = ruleKeys(cfg.Rules)
+	clone.ruleLabels = ruleLabels(cfg.Rules, cfg.MetricsLabels)
+	clone.findings = analyzeRules(&cfg, a.findings, a.logger)
+	clone.sessionParameters = sessionParameters(cfg.Rules)
+	clone.frequencySources = frequencySources(append(tagRules(cfg.Tags), cfg.Rules...))
+	clone.acceptCH = acceptClientHints(append(tagRules(cfg.Tags), cfg.Rules...))
+	clone.errorBudgets = budgets
+	clone.fallbacks = fallbacks
+	if a.propagation != nil {
+		clone.rulesVersion = rulesVersion(cfg.Rules)
+	}
+	if clone.lastAssignments == nil {
+		clone.lastAssignments = newLastAssignments(a.fallback, fallbacks)
+	}
+	clone.migrator = newMigrator(cfg.Rules, a.sessionStore, a.storeOptions, a.migrations)
+	if clone.migrator != nil {
+		if setter, ok := clone.migrator.marks.(clockSetter); ok {
+			setter.SetClock(a.now)
+		}
+	}
+	return &clone, nil
+}
+
 // generateSessionID creates a new random session ID.
-func generateSessionID() (string, error) {
+func generateSessionID(random io.Reader) (string, error) {
 	b := make([]byte, sessionIDByteLength)
-	_, err := rand.Read(b)
+	_, err := io.ReadFull(random, b)
 	if err != nil {
 		return "", err
 	}
@@ -156,9 +819,62 @@ func generateSessionID() (string, error) {
 
 // ServeHTTP implements the http.Handler interface.
 func (a *Forklift) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if active := a.current(); active != a {
+		active.ServeHTTP(rw, req)
+		return
+	}
+
+	requestID := a.requestID(rw, req)
 	if a.config.Debug {
-		a.logger.Debugf("Received request: %s %s", req.Method, req.URL.Path)
-		a.logger.Debugf("Headers: %v", req.Header)
+		log := a.requestLogger(req)
+		log.Debugf("Received request: %s %s", req.Method, req.URL.Path)
+		log.Debugf("Headers: %v", a.scrubber.header(req.Header))
+	}
+
+	if a.config.MetricsPath != "" && req.URL.Path == a.config.MetricsPath {
+		a.metrics.ServeHTTP(rw, req)
+		return
+	}
+	if a.traffic != nil && req.URL.Path == a.traffic.path {
+		a.serveTraffic(rw, req)
+		return
+	}
+	if a.admin.handles(req) {
+		a.serveAdmin(rw, req)
+		return
+	}
+	if a.propagation != nil && a.propagation.contractPath != "" && req.URL.Path == a.propagation.contractPath {
+		a.serveContract(rw)
+		return
+	}
+	if a.config.HealthPath != "" && req.URL.Path == a.config.HealthPath {
+		a.serveHealth(rw)
+		return
+	}
+	if a.config.ReadinessPath != "" && req.URL.Path == a.config.ReadinessPath {
+		a.serveReadiness(rw, req)
+		return
+	}
+
+	if !a.lifecycle.enter() {
+		serveShuttingDown(rw)
+		return
+	}
+	defer a.lifecycle.leave()
+
+	if a.limited(rw, req) || a.killed(rw, req) {
+		return
+	}
+	if a.acceptCH != "" {
+		rw.Header().Add("Accept-CH", a.acceptCH)
+	}
+
+	if !a.consented(req) {
+		a.withoutConsent.Inc()
+		selected := a.defaultBackendSelection()
+		selected.Reason = reasonNoConsent
+		a.serve(rw, req, a.assigned(selected))
+		return
 	}
 
 	sessionID := a.handleSessionID(rw, req)
@@ -166,31 +882,128 @@ func (a *Forklift) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	selected := a.selectBackend(req, sessionID)
-	backend := selected.Backend
+	hc := &HookContext{Request: req, SessionID: sessionID, RequestID: requestID}
+	a.runPreMatch(hc)
+	req = hc.Request
+	a.frequency.record(req, a.frequencySources, a.now())
+	req = a.ruleEngine.classify(req)
+
+	selected, pinned := a.resourcePins.pinned(req, hc.SessionID, a.config, a.now())
+	if !pinned {
+		selected = a.selectBackend(selectionRequest(req), hc.SessionID)
+	}
+	selected, release := a.admit(req, selected)
+	defer release()
+	hc.Selected = selected
+	a.runPostDecision(hc)
+	hc.Selected = a.assigned(hc.Selected)
+	a.churn.record(req, hc.SessionID, hc.Selected, a.now())
+
+	if rule := sessionFallbackOf(hc.Selected.Rule, req); rule != nil {
+		switch rule.SessionFallback.Mode {
+		case sessionFallbackQuery:
+			if redirectWithSession(rw, req, hc.SessionID, rule) {
+				return
+			}
+		case sessionFallbackScript:
+			if req.Method == http.MethodGet {
+				var injector *sessionScriptWriter
+				injector, req = newSessionScriptWriter(rw, req, hc.SessionID, a.skippedScripts)
+				defer injector.finish()
+				rw = injector
+			}
+		}
+	}
+
+	if len(a.hooks) == 0 && a.exposures == nil && a.results == nil && a.ruleMetrics == nil && a.resourcePins == nil && a.liveTraffic == nil &&
+		a.counters == nil && a.decisions == nil {
+		a.serve(rw, req, hc.Selected)
+		return
+	}
+	start := time.Now()
+	a.started(hc.Selected)
+	recorder := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+	a.serve(recorder, req, hc.Selected)
+	hc.Status = recorder.status
+	hc.Duration = time.Since(start)
+	a.resourcePins.pin(req, hc.SessionID, hc.Selected, hc.Status, rw.Header(), a.now())
+	a.finished(req, hc.Selected, hc.Status, hc.Duration)
+	a.runPostResponse(hc)
+	a.exposures.record(hc)
+	a.results.record(hc, a.now())
+	a.liveTraffic.record(hc)
+	a.counters.record(hc)
+	a.recordDecision(hc, start)
+}
+
+// serve sends the request to the selected backend or answers it directly.
+func (a *Forklift) serve(rw http.ResponseWriter, req *http.Request, selected SelectedBackend) {
+	backend := backendURL(selected)
 	selectedRule := selected.Rule
 
 	if a.config.Debug {
+		log := a.requestLogger(req)
 		rw.Header().Set("X-Selected-Backend", backend)
-		a.logger.Debugf("Routing request to backend: %s", backend)
+		rw.Header().Set("X-Selected-Assignment", assignmentReason(selected))
+		log.Debugf("Routing request to backend: %s", backend)
 		if selectedRule != nil {
-			a.logger.Debugf("Selected rule: Path: %s, Method: %s, Backend: %s, Percentage: %f",
+			log.Debugf("Selected rule: Path: %s, Method: %s, Backend: %s, Percentage: %f",
 				selectedRule.Path, selectedRule.Method, selectedRule.Backend, selectedRule.Percentage)
 		}
 	}
 
-	proxyReq, err := a.createProxyRequest(req, backend, selectedRule)
+	if selectedRule != nil && selectedRule.ResponsePolicy != nil {
+		policy := selectedRule.ResponsePolicy
+		if policy.CORS != nil && isPreflight(req) {
+			a.servePreflight(rw, req, policy.CORS)
+			return
+		}
+		rw = &policyWriter{ResponseWriter: rw, req: req, policy: policy}
+	}
+
+	if selectedRule != nil && selectedRule.Static != nil {
+		a.serveStatic(rw, selectedRule.Static)
+		return
+	}
+	if selectedRule != nil && selectedRule.Redirect != nil {
+		a.serveRedirect(rw, req, selectedRule.Redirect)
+		return
+	}
+
+	if selectedRule != nil && selectedRule.Compression != nil {
+		if encoding := acceptedEncoding(req); encoding != "" {
+			compressor := newCompressWriter(rw, req, selectedRule.Compression, encoding)
+			defer compressor.finish()
+			rw = compressor
+		}
+	}
+	if selectedRule != nil && selectedRule.Preload != nil {
+		sendPreload(rw, selectedRule.Preload)
+	}
+
+	if selectedRule != nil && selectedRule.InterceptErrors != nil && backend != a.config.DefaultBackend {
+		a.serveIntercepted(rw, req, selected)
+		return
+	}
+
+	a.proxy(rw, req, selected)
+}
+
+// proxy sends the request to the selected backend and copies its response to rw.
+func (a *Forklift) proxy(rw http.ResponseWriter, req *http.Request, selected SelectedBackend) {
+	proxyReq, err := a.createProxyRequest(req, backendURL(selected), selected.Rule)
 	if err != nil {
-		a.logger.Errorf("Error creating proxy request: %v", err)
+		a.requestLogger(req).Errorf("Error creating proxy request: %v", err)
 		http.Error(rw, "Error creating proxy request", http.StatusInternalServerError)
 		return
 	}
+	a.propagate(proxyReq.Header, selected)
 
 	a.sendProxyRequest(rw, proxyReq)
 }
 
 func (a *Forklift) handleSessionID(rw http.ResponseWriter, req *http.Request) string {
-	sessionID := getOrCreateSessionID(rw, req)
+	sessionID := a.getOrCreateSessionID(rw, req)
 	if sessionID == "" {
 		a.logger.Errorf("Error handling session ID")
 		http.Error(rw, "Internal Server Error", http.StatusInternalServerError)
@@ -204,7 +1017,7 @@ func (a *Forklift) handleSessionID(rw http.ResponseWriter, req *http.Request) st
 	}
 
 	if a.config.Debug {
-		a.logger.Debugf("Session ID: %s", sessionID)
+		a.logger.Debugf("Session ID: %s", a.scrubber.identity(sessionID))
 	}
 
 	return sessionID
@@ -214,36 +1027,100 @@ func (a *Forklift) handleSessionID(rw http.ResponseWriter, req *http.Request) st
 type SelectedBackend struct {
 	Backend string
 	Rule    *RoutingRule
+	// Variant is the flag treatment that selected the backend, if any.
+	Variant string
+	// Reason is why the backend was selected, e.g. "split" for a percentage split or "default"
+	// when no rule matched. Hooks replacing the selection may set it.
+	Reason string
+	// Assignment is how the session got the backend: rule-match, sticky-reuse, override,
+	// fallback-default or provider-error. It is set once the selection is final, from the
+	// reason unless the selection says otherwise.
+	Assignment string
+	// Bucket is the bucket of the session in the percentage split that selected the backend, 1 to
+	// 100, if the bucket is propagated to backends.
+	Bucket int
+}
+
+// SelectBackend evaluates the rules for a request and session without serving it.
+func (a *Forklift) SelectBackend(req *http.Request, sessionID string) SelectedBackend {
+	selected := a.current().selectBackend(req, sessionID)
+	selected.Assignment = assignmentReason(selected)
+	return selected
+}
+
+// selectionScratch holds the buffers used while selecting a backend. Scratch values are
+// pooled so the per-request selection path does not allocate.
+type selectionScratch struct {
+	candidates []int
+	matches    []*RoutingRule
+	group      []*RoutingRule
+	ended      []*RoutingRule
+	shares     []backendShare
+
+	// formParsed and formTooLarge remember whether the body was parsed for form conditions.
+	formParsed   bool
+	formTooLarge bool
+	// fallback is the selection of a fallback taken while matching rules, if fellBack is set.
+	fallback SelectedBackend
+	fellBack bool
+}
+
+// backendShare is the combined percentage of the rules targeting one backend.
+type backendShare struct {
+	backend    string
+	percentage float64
+}
+
+var selectionScratchPool = sync.Pool{
+	New: func() interface{} { return &selectionScratch{} },
 }
 
 func (a *Forklift) selectBackend(req *http.Request, sessionID string) SelectedBackend {
-	matchingRules := a.getMatchingRules(req)
+	if normalized := a.normalizedRequest(req); normalized != req {
+		defer keepForm(req, normalized)
+		req = normalized
+	}
+	if a.remote != nil {
+		if selected, ok := a.remoteDecision(req, sessionID); ok {
+			return selected
+		}
+	}
+
+	scratch, _ := selectionScratchPool.Get().(*selectionScratch)
+	defer selectionScratchPool.Put(scratch)
+
+	// Matching rules keep the configuration order, which is already sorted by priority.
+	matchingRules := a.getMatchingRules(req, sessionID, scratch)
+	if scratch.fellBack {
+		return scratch.fallback
+	}
+
+	if a.migrator != nil {
+		scratch.ended = a.endedRules(req, scratch.ended[:0])
+		if selected, ok := a.migrateSession(req, sessionID, scratch.ended); ok {
+			return selected
+		}
+	}
 
 	if len(matchingRules) == 0 {
 		return a.defaultBackendSelection()
 	}
 
-	a.sortRulesByPriority(matchingRules)
 	a.logMatchingRules(matchingRules)
 
-	rulesByPath := a.groupRulesByPath(matchingRules)
-	return a.processRulesByPath(rulesByPath, sessionID)
+	selected := a.processRulesByPath(req, matchingRules, sessionID, scratch)
+	a.recordAssignment(sessionID, selected)
+	return selected
 }
 
 func (a *Forklift) defaultBackendSelection() SelectedBackend {
 	if a.config.Debug {
 		a.logger.Debugf("No matching rules found, using default backend: %s", a.config.DefaultBackend)
 	}
-	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil}
-}
-
-func (a *Forklift) sortRulesByPriority(rules []RoutingRule) {
-	sort.Slice(rules, func(i, j int) bool {
-		return rules[i].Priority > rules[j].Priority
-	})
+	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil, Reason: reasonDefault}
 }
 
-func (a *Forklift) logMatchingRules(rules []RoutingRule) {
+func (a *Forklift) logMatchingRules(rules []*RoutingRule) {
 	if a.config.Debug {
 		a.logger.Debugf("Matching rules (sorted by priority):")
 		for _, rule := range rules {
@@ -253,75 +1130,220 @@ func (a *Forklift) logMatchingRules(rules []RoutingRule) {
 	}
 }
 
-func (a *Forklift) groupRulesByPath(rules []RoutingRule) map[string][]RoutingRule {
-	rulesByPath := make(map[string][]RoutingRule)
-	for _, rule := range rules {
-		path := rule.Path
-		if path == "" {
-			path = rule.PathPrefix
-		}
-		rulesByPath[path] = append(rulesByPath[path], rule)
+// assignmentKey returns the session store key of the session's assignment on a path. The session
+// ID is hashed if the privacy configuration hashes identities.
+func (a *Forklift) assignmentKey(sessionID, path string) string {
+	return "forklift:" + a.scrubber.identity(sessionID) + ":" + path
+}
+
+// rulePathKey returns the path a rule is grouped by.
+func rulePathKey(rule *RoutingRule) string {
+	if rule.Path == "" {
+		return rule.PathPrefix
 	}
-	return rulesByPath
+	return rule.Path
 }
 
-func (a *Forklift) processRulesByPath(rulesByPath map[string][]RoutingRule, sessionID string) SelectedBackend {
-	for _, rules := range rulesByPath {
-		if selected := a.processRulesForPath(rules, sessionID); selected.Backend != "" {
+// processRulesByPath evaluates the matching rules grouped by path, in priority order of each
+// group's first rule, and returns the first group's selection.
+func (a *Forklift) processRulesByPath(req *http.Request, rules []*RoutingRule, sessionID string, scratch *selectionScratch) SelectedBackend {
+	for i, rule := range rules {
+		path := rulePathKey(rule)
+		if groupSeen(rules[:i], path) {
+			continue
+		}
+
+		scratch.group = scratch.group[:0]
+		for _, candidate := range rules[i:] {
+			if rulePathKey(candidate) == path {
+				scratch.group = append(scratch.group, candidate)
+			}
+		}
+
+		if selected, ok := a.connectionPins.pinned(req, path, scratch.group, a.now()); ok {
+			return selected
+		}
+		if selected := a.processRulesForPath(req, scratch.group, sessionID, scratch); selected.Backend != "" {
+			a.connectionPins.pin(req, path, selected, a.now())
 			return selected
 		}
 	}
-	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil}
+	return SelectedBackend{Backend: a.config.DefaultBackend, Rule: nil, Reason: reasonDefault}
+}
+
+func groupSeen(rules []*RoutingRule, path string) bool {
+	for _, rule := range rules {
+		if rulePathKey(rule) == path {
+			return true
+		}
+	}
+	return false
 }
 
-func (a *Forklift) processRulesForPath(rules []RoutingRule, sessionID string) SelectedBackend {
+func (a *Forklift) processRulesForPath(req *http.Request, rules []*RoutingRule, sessionID string, scratch *selectionScratch) SelectedBackend {
 	// Check for non-percentage based rules first
 	for _, rule := range rules {
-		if rule.Percentage == 0 {
-			return SelectedBackend{Backend: rule.Backend, Rule: &rule}
+		if rule.Flag != nil {
+			if selected, ok := a.evaluateFlag(req, sessionID, rule); ok {
+				return selected
+			}
+			continue
+		}
+		if rule.Percentage == 0 && a.drainAdmits(req, rule) {
+			return SelectedBackend{Backend: backendKey(*rule), Rule: rule, Reason: reasonRule}
 		}
 	}
 
 	// If we reach here, we only have percentage-based rules for this path
-	backendPercentages := a.calculateBackendPercentages(rules)
-	selectedBackend := a.selectBackendByPercentageAndRuleHash(sessionID, backendPercentages, rules)
+	var selectedBackend string
+	var reused bool
+	var err error
+	bucketKey := sessionID
+	group := assignmentGroup(rules)
+	country := a.requestCountry(req, rules)
+	if rule := pageBucketRule(rules); rule != nil {
+		// Every request of a page is in the same bucket whatever its session, so the
+		// assignment is not stored for the session.
+		bucketKey = a.pageBucketKey(req, rule)
+		if bucketKey == "" {
+			return SelectedBackend{Backend: "", Rule: nil}
+		}
+		scratch.shares = a.calculateBackendPercentages(rules, country, scratch.shares[:0])
+		selectedBackend = a.admitDrain(req, a.selectBackendByPercentageAndRuleHash(bucketKey, scratch.shares, rules), rules)
+	} else if group != "" {
+		selectedBackend, reused, err = a.assignGroupBackend(req, sessionID, group, rules)
+	} else {
+		scratch.shares = a.calculateBackendPercentages(rules, country, scratch.shares[:0])
+		selectedBackend, reused, err = a.assignBackend(req, sessionID, scratch.shares, rules)
+	}
+	if err != nil {
+		if selected, ok := a.fallbackSelection(sessionID, rules[0], storeUnavailable); ok {
+			return selected
+		}
+	}
 
 	for _, rule := range rules {
-		if rule.Backend == selectedBackend {
-			return SelectedBackend{Backend: selectedBackend, Rule: &rule}
+		if backendKey(*rule) == selectedBackend {
+			selected := SelectedBackend{Backend: selectedBackend, Rule: rule, Reason: reasonSplit}
+			if reused {
+				selected.Assignment = assignedStickyReuse
+			}
+			if a.propagation != nil {
+				selected.Bucket = a.splitBucket(bucketKey, group, rules)
+			}
+			return selected
 		}
 	}
 
 	return SelectedBackend{Backend: "", Rule: nil}
 }
 
-func (a *Forklift) calculateBackendPercentages(rules []RoutingRule) map[string]float64 {
-	backendPercentages := make(map[string]float64)
+// backendKey identifies the target of a rule when grouping rules by backend.
+func backendKey(rule RoutingRule) string {
+	if rule.Static != nil {
+		hashValue := fnvString(fnvOffset32, rule.Static.Body)
+		return "static:" + strconv.Itoa(staticStatus(rule.Static)) + ":" + strconv.FormatUint(uint64(hashValue), 16)
+	}
+	if rule.Redirect != nil {
+		return "redirect:" + rule.Redirect.Location
+	}
+	if rule.Mode == modeAA {
+		// The variants of A/A tests share their backend, so they are told apart by name.
+		return "aa:" + rule.Variant + ":" + rule.Backend
+	}
+	return rule.Backend
+}
+
+// calculateBackendPercentages sums the percentages per backend in a country, or globally if it
+// is empty, into shares, sorted by backend.
+func (a *Forklift) calculateBackendPercentages(rules []*RoutingRule, country string, shares []backendShare) []backendShare {
 	for _, rule := range rules {
-		backendPercentages[rule.Backend] += rule.Percentage
+		if rule.Flag != nil {
+			continue
+		}
+		shares = addBackendShare(shares, backendKey(*rule), rulePercentage(rule, country))
 	}
-	return backendPercentages
+	return shares
 }
 
-func (a *Forklift) selectBackendByPercentageAndRuleHash(sessionID string, backendPercentages map[string]float64, matchingRules []RoutingRule) string {
-	backends := a.sortBackends(backendPercentages)
-	hashValue := a.calculateHash(sessionID, matchingRules)
+// addBackendShare adds percentage to the share of backend, keeping shares sorted by backend.
+func addBackendShare(shares []backendShare, backend string, percentage float64) []backendShare {
+	i := 0
+	for i < len(shares) && shares[i].backend < backend {
+		i++
+	}
+	if i < len(shares) && shares[i].backend == backend {
+		shares[i].percentage += percentage
+		return shares
+	}
+	shares = append(shares, backendShare{})
+	copy(shares[i+1:], shares[i:])
+	shares[i] = backendShare{backend: backend, percentage: percentage}
+	return shares
+}
 
-	totalPercentage := 0.0
-	for _, percentage := range backendPercentages {
-		totalPercentage += percentage
+// assignBackend returns the backend assigned to the session for a group of percentage rules, and
+// whether it is the session's stored assignment. With a session store configured, a stored
+// assignment is reused as long as its backend is still part of the split, so changing
+// percentages does not move existing sessions, and a new assignment only replaces one another
+// instance stored meanwhile if that one left the split. The error reports that the session store
+// couldn't be read, in which case the backend is derived from the hash of the session ID but not
+// stored, so it can't take the place of an assignment the store may hold. Instances that can't
+// read a replicated store thus agree on the backend as long as they share the rules.
+func (a *Forklift) assignBackend(req *http.Request, sessionID string, shares []backendShare, rules []*RoutingRule) (string, bool, error) {
+	if a.sessionStore == nil {
+		return a.admitDrain(req, a.selectBackendByPercentageAndRuleHash(sessionID, shares, rules), rules), false, nil
+	}
+
+	ctx := context.Background()
+	key := a.assignmentKey(sessionID, rulePathKey(rules[0]))
+	backend, found, err := a.storedAssignment(ctx, key)
+	if found && hasBackendShare(shares, backend) && !a.drainedBackend(rules, backend) {
+		return backend, true, nil
+	}
+
+	backend = a.selectBackendByPercentageAndRuleHash(sessionID, shares, rules)
+	if err == nil {
+		backend = a.refuseDrain(backend, rules)
+	} else {
+		backend = a.admitDrain(req, backend, rules)
+	}
+	// Sessions falling through to the default backend are not stored, so they remain
+	// eligible when the percentages are increased.
+	if err == nil && hasBackendShare(shares, backend) {
+		if found {
+			// The stored backend left the split or drains, so it is replaced.
+			a.saveAssignment(ctx, key, backend)
+		} else if stored := a.addAssignment(ctx, key, backend); stored != backend &&
+			hasBackendShare(shares, stored) && !a.drainedBackend(rules, stored) {
+			return stored, true, nil
+		}
+	}
+	return backend, false, err
+}
+
+func hasBackendShare(shares []backendShare, backend string) bool {
+	for _, share := range shares {
+		if share.backend == backend {
+			return true
+		}
 	}
+	return false
+}
+
+func (a *Forklift) selectBackendByPercentageAndRuleHash(sessionID string, shares []backendShare, matchingRules []*RoutingRule) string {
+	hashValue := a.calculateHash(sessionID, matchingRules)
 
 	scaledHashValue := hashValue * percentageScale // Scale hash to 0-100 range
 
 	var cumulativePercentage float64
-	for _, backend := range backends {
-		cumulativePercentage += backendPercentages[backend]
+	for _, share := range shares {
+		cumulativePercentage += share.percentage
 		if scaledHashValue <= cumulativePercentage {
 			if a.config.Debug {
-				a.logger.Debugf("Selected backend: %s", backend)
+				a.logger.Debugf("Selected backend: %s", share.backend)
 			}
-			return backend
+			return share.backend
 		}
 	}
 
@@ -332,15 +1354,6 @@ func (a *Forklift) selectBackendByPercentageAndRuleHash(sessionID string, backen
 	return a.config.DefaultBackend
 }
 
-func (a *Forklift) sortBackends(backendPercentages map[string]float64) []string {
-	backends := make([]string, 0, len(backendPercentages))
-	for backend := range backendPercentages {
-		backends = append(backends, backend)
-	}
-	sort.Strings(backends)
-	return backends
-}
-
 /*
 func (a *Forklift) selectBackendFromRanges(backends []string, backendPercentages map[string]float64, hashValue float64) string {
 	cumulativeRanges := a.createCumulativeRanges(backends, backendPercentages)
@@ -387,43 +1400,72 @@ func (a *Forklift) createCumulativeRanges(backends []string, backendPercentages
 }
 */
 
-func (a *Forklift) calculateHash(sessionID string, matchingRules []RoutingRule) float64 {
-	h := fnv.New64a()
-	a.writeToHash(h, []byte(sessionID))
+// FNV-1a parameters, applied directly to strings to avoid allocating hash state.
+const (
+	fnvOffset32 uint32 = 2166136261
+	fnvPrime32  uint32 = 16777619
+	fnvOffset64 uint64 = 14695981039346656037
+	fnvPrime64  uint64 = 1099511628211
+)
+
+func fnvString(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+func fnv64String(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+func (a *Forklift) calculateHash(sessionID string, matchingRules []*RoutingRule) float64 {
+	h := fnv64String(fnvOffset64, sessionID)
 
 	for _, rule := range matchingRules {
 		if rule.AffinityToken != "" {
-			a.writeToHash(h, []byte(rule.AffinityToken))
+			h = fnv64String(h, rule.AffinityToken)
 		} else {
-			a.writeToHash(h, []byte(rule.Path), []byte(rule.Method), []byte(rule.Backend))
+			h = fnv64String(h, rule.Path)
+			h = fnv64String(h, rule.Method)
+			h = fnv64String(h, backendKey(*rule))
 		}
 	}
 
-	hashValue := float64(h.Sum64()) / float64(^uint64(0))
+	hashValue := float64(h) / float64(^uint64(0))
 	if a.config.Debug {
 		a.logger.Debugf("Calculated hash value: %f", hashValue)
 	}
 	return hashValue
 }
 
-func (a *Forklift) writeToHash(h hash.Hash64, data ...[]byte) {
-	var err error
-	for _, d := range data {
-		_, err = h.Write(d)
-		if err != nil {
-			a.logger.Errorf("Error hashing data: %v", err)
+func (a *Forklift) getMatchingRules(req *http.Request, sessionID string, scratch *selectionScratch) []*RoutingRule {
+	scratch.candidates = a.ruleEngine.index.candidates(req.URL.Path, scratch.candidates[:0])
+	scratch.matches = scratch.matches[:0]
+	scratch.formParsed, scratch.formTooLarge, scratch.fellBack = false, false, false
+	match := a.scriptMatch(req)
+	for _, i := range scratch.candidates {
+		rule := &a.config.Rules[i]
+		if rule.Paused || a.blackedOut(rule) {
+			continue
 		}
-	}
-}
-
-func (a *Forklift) getMatchingRules(req *http.Request) []RoutingRule {
-	matchingRules := []RoutingRule{}
-	for _, rule := range a.config.Rules {
-		if a.ruleEngine.ruleMatches(req, rule) {
-			matchingRules = append(matchingRules, rule)
+		// A failing rule only decides the request if no rule of higher priority matched.
+		if a.formBodyTooLarge(req, rule, scratch) && len(scratch.matches) == 0 {
+			if selected, ok := a.fallbackSelection(sessionID, rule, bodyTooLarge); ok {
+				scratch.fallback, scratch.fellBack = selected, true
+				return nil
+			}
+		}
+		if a.matchRule(req, rule) && a.dependenciesMet(req, sessionID, rule) && a.scriptAllows(rule, match) && !a.warmingUp(req, rule) {
+			scratch.matches = append(scratch.matches, rule)
 		}
 	}
-	return matchingRules
+	return scratch.matches
 }
 
 func (a *Forklift) createProxyRequest(req *http.Request, backend string, selectedRule *RoutingRule) (*http.Request, error) {
@@ -438,43 +1480,62 @@ func (a *Forklift) createProxyRequest(req *http.Request, backend string, selecte
 	}
 
 	// Copy headers from the original request
-	proxyReq.Header = make(http.Header)
+	proxyReq.Header = make(http.Header, len(req.Header))
 	for key, values := range req.Header {
 		proxyReq.Header[key] = values
 	}
 
+	a.scrubHeaders(proxyReq.Header, req, backend)
+	a.scriptHeaders(proxyReq.Header, req, backend)
+
 	// Update the Host header to match the backend
 	proxyReq.Host = proxyReq.URL.Host
+	// Trailers of streamed request bodies, e.g. from gRPC clients, are sent after the body
+	proxyReq.Trailer = req.Trailer
+	// Keep the length of bodies not consumed by form conditions, so backends can reject
+	// Expect: 100-continue uploads by their size before they are sent
+	if req.PostForm == nil {
+		proxyReq.ContentLength = req.ContentLength
+	}
 
 	if a.config.Debug {
 		a.logger.Debugf("Final request URL: %s", proxyReq.URL.String())
-		a.logger.Debugf("Final request headers: %v", proxyReq.Header)
+		a.logger.Debugf("Final request headers: %v", a.scrubber.header(proxyReq.Header))
 	}
 
 	return proxyReq, nil
 }
 
 func (a *Forklift) constructBackendURL(req *http.Request, backend string, selectedRule *RoutingRule) string {
-	backendPath := req.URL.Path
-	if selectedRule != nil && selectedRule.PathPrefixRewrite != "" {
-		// Perform path prefix rewrite
-		if selectedRule.PathPrefix != "" && strings.HasPrefix(backendPath, selectedRule.PathPrefix) {
-			backendPath = strings.Replace(backendPath, selectedRule.PathPrefix, selectedRule.PathPrefixRewrite, 1)
+	// The escaped path is forwarded, so backends don't take the encoded slashes of a segment
+	// for separators and resolve paths rules didn't match.
+	backendPath := req.URL.EscapedPath()
+	if selectedRule != nil && selectedRule.PathPrefix != "" && selectedRule.PathPrefixRewrite != "" {
+		if rest, ok := a.trimPathPrefix(req.URL, selectedRule.PathPrefix); ok {
+			backendPath = selectedRule.PathPrefixRewrite + rest
 		}
 	}
 	return backend + backendPath
 }
 
 func (a *Forklift) sendProxyRequest(rw http.ResponseWriter, proxyReq *http.Request) {
-	client := &http.Client{
-		Timeout: defaultTimeout, // Default timeout for client requests
-	}
-	resp, err := client.Do(proxyReq)
+	resp, err := a.doProxyRequest(rw, proxyReq)
 	if err != nil {
-		a.logger.Errorf("Error sending request to backend: %v", err)
+		a.requestLogger(proxyReq).Errorf("Error sending request to backend: %v", err)
 		http.Error(rw, "Error sending request to backend", http.StatusBadGateway)
 		return
 	}
+	a.writeProxyResponse(rw, proxyReq, resp)
+}
+
+// doProxyRequest sends the request to the backend, forwarding informational responses to rw.
+func (a *Forklift) doProxyRequest(rw http.ResponseWriter, proxyReq *http.Request) (*http.Response, error) {
+	proxyReq = proxyReq.WithContext(httptrace.WithClientTrace(proxyReq.Context(), forwardInformational(rw)))
+	return a.client.Do(proxyReq)
+}
+
+// writeProxyResponse copies the response of the backend to rw and closes it.
+func (a *Forklift) writeProxyResponse(rw http.ResponseWriter, proxyReq *http.Request, resp *http.Response) {
 	defer func() { _ = resp.Body.Close() }()
 
 	// Copy the response from the backend to the original response writer
@@ -483,73 +1544,97 @@ func (a *Forklift) sendProxyRequest(rw http.ResponseWriter, proxyReq *http.Reque
 			rw.Header().Add(key, value)
 		}
 	}
+	announceTrailers(rw.Header(), resp)
+	announced := len(resp.Trailer)
 	rw.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(rw, resp.Body)
+	buf, _ := copyBufferPool.Get().(*[]byte)
+	_, err := io.CopyBuffer(rw, resp.Body, *buf)
+	copyBufferPool.Put(buf)
 	if err != nil {
-		a.logger.Errorf("Error copying response body: %v", err)
+		a.requestLogger(proxyReq).Errorf("Error copying response body: %v", err)
 		// If we've already started writing the response, we can't change the status code
 		// So we'll just log the error and return
 		return
 	}
+	copyTrailers(rw.Header(), resp, announced)
 
 	if a.config.Debug {
 		a.logger.Debugf("Response status code: %d", resp.StatusCode)
-		a.logger.Debugf("Response headers: %v", resp.Header)
+		a.logger.Debugf("Response headers: %v", a.scrubber.header(resp.Header))
 	}
 }
 
 // ruleMatches checks if a request matches a given rule.
-func (re *RuleEngine) ruleMatches(req *http.Request, rule RoutingRule) bool {
+func (re *RuleEngine) ruleMatches(req *http.Request, rule *RoutingRule) bool {
 	if !re.matchPath(req, rule) {
 		return false
 	}
 	if !re.matchMethod(req, rule) {
 		return false
 	}
+	if !re.matchNewSession(req, rule) {
+		return false
+	}
+	if !re.matchIdentities(req, rule) {
+		return false
+	}
 	return re.matchConditions(req, rule)
 }
 
-func (re *RuleEngine) matchPath(req *http.Request, rule RoutingRule) bool {
+func (re *RuleEngine) matchPath(req *http.Request, rule *RoutingRule) bool {
 	if rule.Path != "" && rule.Path != req.URL.Path {
-		re.logDebugf("Path mismatch: %s != %s", rule.Path, req.URL.Path)
+		if re.config.Debug {
+			re.logger.Debugf("Path mismatch: %s != %s", rule.Path, req.URL.Path)
+		}
 		return false
 	}
 	if rule.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, rule.PathPrefix) {
-		re.logDebugf("Path prefix mismatch: %s for path: %s", rule.PathPrefix, req.URL.Path)
+		if re.config.Debug {
+			re.logger.Debugf("Path prefix mismatch: %s for path: %s", rule.PathPrefix, req.URL.Path)
+		}
 		return false
 	}
-	if rule.PathPrefix != "" {
-		re.logDebugf("Path prefix match: %s for path: %s", rule.PathPrefix, req.URL.Path)
+	if rule.PathPrefix != "" && re.config.Debug {
+		re.logger.Debugf("Path prefix match: %s for path: %s", rule.PathPrefix, req.URL.Path)
 	}
 	return true
 }
 
-func (re *RuleEngine) matchMethod(req *http.Request, rule RoutingRule) bool {
+func (re *RuleEngine) matchMethod(req *http.Request, rule *RoutingRule) bool {
 	if rule.Method != "" && rule.Method != req.Method {
-		re.logDebugf("Method mismatch: %s != %s", rule.Method, req.Method)
+		if re.config.Debug {
+			re.logger.Debugf("Method mismatch: %s != %s", rule.Method, req.Method)
+		}
 		return false
 	}
 	return true
 }
 
-func (re *RuleEngine) matchConditions(req *http.Request, rule RoutingRule) bool {
-	re.logDebugf("Checking conditions for path: %s", req.URL.Path)
+func (re *RuleEngine) matchConditions(req *http.Request, rule *RoutingRule) bool {
+	if re.config.Debug {
+		re.logger.Debugf("Checking conditions for path: %s", req.URL.Path)
+	}
 	if len(rule.Conditions) == 0 {
 		return true
 	}
 	return re.checkConditions(req, rule.Conditions)
 }
 
-func (re *RuleEngine) logDebugf(format string, args ...interface{}) {
-	if re.config.Debug {
-		re.logger.Debugf(format, args...)
-	}
-}
-
-// checkConditions verifies if all conditions in a rule are met.
+// checkConditions verifies if all conditions in a rule are met. Rules whose regex conditions take
+// longer than the regex budget don't match.
 func (re *RuleEngine) checkConditions(req *http.Request, conditions []RuleCondition) bool {
+	var regexTime time.Duration
 	for _, condition := range conditions {
-		if !re.checkCondition(req, condition) {
+		if !isRegexCondition(condition) {
+			if !re.checkCondition(req, condition) {
+				return false
+			}
+			continue
+		}
+		start := time.Now()
+		matched := re.checkCondition(req, condition)
+		regexTime += time.Since(start)
+		if !matched || re.overRegexBudget(regexTime, condition) {
 			return false
 		}
 	}
@@ -568,6 +1653,26 @@ func (re *RuleEngine) checkCondition(req *http.Request, condition RuleCondition)
 		result = re.checkCookie(req, condition)
 	case "form":
 		result = re.checkForm(req, condition)
+	case "referer":
+		result = re.checkReferer(req, condition)
+	case "utm":
+		result = re.checkUTM(req, condition)
+	case "traefik":
+		result = re.checkTraefik(req, condition)
+	case "custom":
+		result = re.checkCustom(req, condition)
+	case "consent":
+		result = re.checkConsent(req, condition)
+	case "frequency":
+		result = re.checkFrequency(req, condition)
+	case "token":
+		result = re.checkToken(req, condition)
+	case "clienthint":
+		result = re.checkClientHint(req, condition)
+	case "fingerprint":
+		result = re.checkFingerprint(req, condition)
+	case "tag":
+		result = re.checkTag(req, condition)
 	default:
 		re.logger.Warnf("Unknown condition type: %s", condition.Type)
 	}
@@ -584,9 +1689,9 @@ func (re *RuleEngine) checkForm(req *http.Request, condition RuleCondition) bool
 	}
 	formValue := req.PostFormValue(condition.Parameter)
 	if re.config.Debug {
-		re.logger.Debugf("Form parameter %s: %s", condition.Parameter, formValue)
+		re.logger.Debugf("Form parameter %s: %s", condition.Parameter, re.scrubber.paramValue(condition.Parameter, formValue))
 	}
-	result := compareValues(formValue, condition.Operator, condition.Value)
+	result := re.compareValues(formValue, condition.Operator, condition.Value)
 	if re.config.Debug {
 		re.logger.Debugf("Form condition result: %v", result)
 	}
@@ -596,10 +1701,14 @@ func (re *RuleEngine) checkForm(req *http.Request, condition RuleCondition) bool
 func (re *RuleEngine) checkHeader(req *http.Request, condition RuleCondition) bool {
 	headerValues := req.Header.Values(condition.Parameter)
 	if re.config.Debug {
-		re.logger.Debugf("Header %s values: %v", condition.Parameter, headerValues)
+		logged := make([]string, len(headerValues))
+		for i, headerValue := range headerValues {
+			logged[i] = re.scrubber.headerValue(http.CanonicalHeaderKey(condition.Parameter), headerValue)
+		}
+		re.logger.Debugf("Header %s values: %v", condition.Parameter, logged)
 	}
 	for _, headerValue := range headerValues {
-		result := compareValues(strings.TrimSpace(strings.ToLower(headerValue)), condition.Operator, strings.TrimSpace(strings.ToLower(condition.Value)))
+		result := re.compareValues(strings.TrimSpace(strings.ToLower(headerValue)), condition.Operator, strings.TrimSpace(strings.ToLower(condition.Value)))
 		if result {
 			if re.config.Debug {
 				re.logger.Debugf("Header condition result: true")
@@ -616,12 +1725,13 @@ func (re *RuleEngine) checkHeader(req *http.Request, condition RuleCondition) bo
 }
 
 func (re *RuleEngine) checkQuery(req *http.Request, condition RuleCondition) bool {
-	queryValue := req.URL.Query().Get(condition.QueryParam)
+	queryValue := queryParamValue(req.URL.RawQuery, condition.QueryParam)
 	if re.config.Debug {
-		re.logger.Debugf("Query parameter %s: %s", condition.QueryParam, queryValue)
-		re.logger.Debugf("Comparing query value: %s %s %s", queryValue, condition.Operator, condition.Value)
+		logged := re.scrubber.paramValue(condition.QueryParam, queryValue)
+		re.logger.Debugf("Query parameter %s: %s", condition.QueryParam, logged)
+		re.logger.Debugf("Comparing query value: %s %s %s", logged, condition.Operator, condition.Value)
 	}
-	result := compareValues(queryValue, condition.Operator, condition.Value)
+	result := re.compareValues(queryValue, condition.Operator, condition.Value)
 	if re.config.Debug {
 		re.logger.Debugf("Query condition result: %v", result)
 	}
@@ -632,9 +1742,9 @@ func (re *RuleEngine) checkCookie(req *http.Request, condition RuleCondition) bo
 	cookies := req.Cookies()
 	for _, cookie := range cookies {
 		if cookie.Name == condition.Parameter {
-			result := compareValues(cookie.Value, condition.Operator, condition.Value)
+			result := re.compareValues(cookie.Value, condition.Operator, condition.Value)
 			if re.config.Debug {
-				re.logger.Debugf("Cookie %s value: %s", condition.Parameter, cookie.Value)
+				re.logger.Debugf("Cookie %s value: %s", condition.Parameter, re.scrubber.cookieValue(cookie.Name, cookie.Value))
 				re.logger.Debugf("Cookie condition result: %v", result)
 				re.logger.Debugf("Cookie condition details: Parameter=%s, Operator=%s, Value=%s", condition.Parameter, condition.Operator, condition.Value)
 			}
@@ -647,11 +1757,41 @@ func (re *RuleEngine) checkCookie(req *http.Request, condition RuleCondition) bo
 	return false
 }
 
+// queryParamValue returns the first value of the named query parameter, like url.Values.Get,
+// without parsing the whole query string into a map.
+func queryParamValue(rawQuery, name string) string {
+	for rawQuery != "" {
+		var pair string
+		pair, rawQuery, _ = strings.Cut(rawQuery, "&")
+		if pair == "" || strings.Contains(pair, ";") {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		if key != name {
+			if !strings.Contains(key, "%") && !strings.Contains(key, "+") {
+				continue
+			}
+			unescaped, err := url.QueryUnescape(key)
+			if err != nil || unescaped != name {
+				continue
+			}
+		}
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			continue
+		}
+		return unescaped
+	}
+	return ""
+}
+
 // compareValues compares two string values based on the given operator.
-func compareValues(actual, operator, expected string) bool {
+func (re *RuleEngine) compareValues(actual, operator, expected string) bool {
 	switch strings.ToLower(operator) {
 	case "eq", "equals":
 		return actual == expected
+	case "regex":
+		return re.regexMatch(actual, expected)
 	case "contains":
 		return strings.Contains(actual, expected)
 	case "prefix":
@@ -661,6 +1801,9 @@ func compareValues(actual, operator, expected string) bool {
 	case "gt":
 		actualFloat, expectedFloat := parseFloats(actual, expected)
 		return actualFloat > expectedFloat
+	case "lt":
+		actualFloat, expectedFloat := parseFloats(actual, expected)
+		return actualFloat < expectedFloat
 	default:
 		return false
 	}
@@ -693,20 +1836,39 @@ func isValidSessionID(sessionID string) bool {
 	return err == nil
 }
 
-// getOrCreateSessionID retrieves the existing session ID or creates a new one.
-func getOrCreateSessionID(rw http.ResponseWriter, req *http.Request) string {
+// getOrCreateSessionID retrieves the existing session ID or creates a new one. Requests with an
+// identity, from the script or the identity sources, use the session ID derived from it, without a
+// cookie.
+func (a *Forklift) getOrCreateSessionID(rw http.ResponseWriter, req *http.Request) string {
+	if sessionID := a.scriptIdentity(req); sessionID != "" {
+		return sessionID
+	}
+	if sessionID := identitySessionID(req, a.config.Identity); sessionID != "" {
+		return sessionID
+	}
 	cookie, err := req.Cookie(sessionCookieName)
 	if err == nil && cookie.Value != "" && isValidSessionID(cookie.Value) {
 		return cookie.Value
 	}
+	if sessionID := a.sessionIDFromQuery(req); sessionID != "" {
+		setSessionCookie(rw, req, sessionID)
+		return sessionID
+	}
 
-	sessionID, err := generateSessionID()
+	sessionID, err := generateSessionID(a.random)
 	if err != nil {
-		// Use the logger directly
-		logger.NewLogger("forklift").Errorf("Error generating session ID: %v", err)
+		a.logger.Errorf("Error generating session ID: %v", err)
 		return ""
 	}
 
+	setSessionCookie(rw, req, sessionID)
+	setFirstSeenCookie(rw, req, a.now())
+
+	return sessionID
+}
+
+// setSessionCookie sets the session cookie.
+func setSessionCookie(rw http.ResponseWriter, req *http.Request, sessionID string) {
 	http.SetCookie(rw, &http.Cookie{
 		Name:     sessionCookieName,
 		Value:    sessionID,
@@ -716,6 +1878,4 @@ func getOrCreateSessionID(rw http.ResponseWriter, req *http.Request) string {
 		Secure:   req.TLS != nil,
 		SameSite: http.SameSiteStrictMode,
 	})
-
-	return sessionID
 }
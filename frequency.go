@@ -0,0 +1,229 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidFrequency          = errors.New("invalid request frequency")
+	errInvalidFrequencyCondition = errors.New("invalid frequency condition")
+)
+
+const (
+	defaultFrequencyWindow = 7 * 24 * time.Hour
+	defaultFrequencyWidth  = 4096
+	defaultFrequencyDepth  = 4
+	// frequencyBuckets is the number of sketches the window is split into. Requests older than
+	// the window are forgotten one bucket at a time.
+	frequencyBuckets = 7
+	// sessionFrequencySource identifies sessions by their session cookie.
+	sessionFrequencySource = "session"
+)
+
+// requestFrequency approximately counts the requests of each identity over a sliding window with
+// count-min sketches, so counts may be overestimated, but never underestimated, for identities
+// whose hashes collide. Its memory use doesn't grow with the number of identities. It is shared
+// by the middleware and the copies created for each bundle version.
+type requestFrequency struct {
+	width      uint64
+	depth      int
+	bucketSize time.Duration
+
+	mu sync.Mutex
+	// buckets holds a sketch of width * depth counters per bucket, allocated on first use.
+	buckets [frequencyBuckets][]uint32
+	// epochs holds the index of the period of bucketSize counted by each bucket.
+	epochs [frequencyBuckets]int64
+}
+
+func newRequestFrequency(cfg *config.Frequency) (*requestFrequency, error) {
+	window, width, depth := defaultFrequencyWindow, defaultFrequencyWidth, defaultFrequencyDepth
+	if cfg != nil {
+		if cfg.Window != "" {
+			d, err := time.ParseDuration(cfg.Window)
+			if err != nil || d < frequencyBuckets {
+				return nil, fmt.Errorf("%w: window %s", errInvalidFrequency, cfg.Window)
+			}
+			window = d
+		}
+		if cfg.Width < 0 || cfg.Depth < 0 {
+			return nil, fmt.Errorf("%w: width and depth must not be negative", errInvalidFrequency)
+		}
+		if cfg.Width > 0 {
+			width = cfg.Width
+		}
+		if cfg.Depth > 0 {
+			depth = cfg.Depth
+		}
+	}
+	return &requestFrequency{
+		width:      uint64(width),
+		depth:      depth,
+		bucketSize: window / frequencyBuckets,
+	}, nil
+}
+
+// frequencySources returns the identity sources of the frequency conditions of the rules.
+func frequencySources(rules []RoutingRule) []string {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "frequency") {
+				continue
+			}
+			source := frequencySource(condition)
+			if !seen[source] {
+				seen[source] = true
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources
+}
+
+func frequencySource(condition RuleCondition) string {
+	if condition.Parameter == "" {
+		return sessionFrequencySource
+	}
+	return condition.Parameter
+}
+
+// validateFrequencyConditions checks the sources, operators and counts of frequency conditions.
+func validateFrequencyConditions(rules []RoutingRule) error {
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "frequency") {
+				continue
+			}
+			source := frequencySource(condition)
+			if source != sessionFrequencySource && !validConsentSource(source) {
+				return fmt.Errorf("%w: source %q", errInvalidFrequencyCondition, source)
+			}
+			switch strings.ToLower(condition.Operator) {
+			case "gt", "lt", "eq":
+			default:
+				return fmt.Errorf("%w: operator %q", errInvalidFrequencyCondition, condition.Operator)
+			}
+			if _, err := strconv.ParseUint(condition.Value, 10, 32); err != nil {
+				return fmt.Errorf("%w: count %q", errInvalidFrequencyCondition, condition.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// frequencyIdentity returns the identity a request has in source, or "" if it has none.
+func frequencyIdentity(req *http.Request, source string) string {
+	if source == sessionFrequencySource {
+		if cookie, err := req.Cookie(sessionCookieName); err == nil && isValidSessionID(cookie.Value) {
+			return cookie.Value
+		}
+		return ""
+	}
+	return flagSourceValue(req, source)
+}
+
+// record counts a request of the identities it has in sources.
+func (f *requestFrequency) record(req *http.Request, sources []string, now time.Time) {
+	if f == nil || len(sources) == 0 {
+		return
+	}
+	epoch := now.UnixNano() / int64(f.bucketSize)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	bucket := f.bucket(epoch)
+	for _, source := range sources {
+		identity := frequencyIdentity(req, source)
+		if identity == "" {
+			continue
+		}
+		h1, h2 := frequencyHashes(source, identity)
+		for row := 0; row < f.depth; row++ {
+			i := uint64(row)*f.width + (h1+uint64(row)*h2)%f.width
+			if bucket[i] < ^uint32(0) {
+				bucket[i]++
+			}
+		}
+	}
+}
+
+// bucket returns the sketch counting the period epoch, clearing it if it last counted an older
+// period.
+func (f *requestFrequency) bucket(epoch int64) []uint32 {
+	i := int(epoch % frequencyBuckets)
+	if f.buckets[i] == nil {
+		f.buckets[i] = make([]uint32, f.width*uint64(f.depth))
+	} else if f.epochs[i] != epoch {
+		for j := range f.buckets[i] {
+			f.buckets[i][j] = 0
+		}
+	}
+	f.epochs[i] = epoch
+	return f.buckets[i]
+}
+
+// count returns the estimated number of requests of the identity over the window.
+func (f *requestFrequency) count(source, identity string, now time.Time) uint64 {
+	if f == nil || identity == "" {
+		return 0
+	}
+	epoch := now.UnixNano() / int64(f.bucketSize)
+	h1, h2 := frequencyHashes(source, identity)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var total uint64
+	for i, bucket := range f.buckets {
+		if bucket == nil || epoch-f.epochs[i] >= frequencyBuckets {
+			continue
+		}
+		estimate := ^uint32(0)
+		for row := 0; row < f.depth; row++ {
+			if c := bucket[uint64(row)*f.width+(h1+uint64(row)*h2)%f.width]; c < estimate {
+				estimate = c
+			}
+		}
+		total += uint64(estimate)
+	}
+	return total
+}
+
+// frequencyHashes returns the two hashes an identity's counters are derived from.
+func frequencyHashes(source, identity string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(source))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(identity))
+	sum := h.Sum64()
+	return sum & 0xffffffff, sum>>32 | 1
+}
+
+// checkFrequency compares the number of requests of the identity in the condition's source to
+// its value.
+func (re *RuleEngine) checkFrequency(req *http.Request, condition RuleCondition) bool {
+	source := frequencySource(condition)
+	count := re.frequency.count(source, frequencyIdentity(req, source), re.now())
+	expected, _ := strconv.ParseUint(condition.Value, 10, 64)
+	var result bool
+	switch strings.ToLower(condition.Operator) {
+	case "gt":
+		result = count > expected
+	case "lt":
+		result = count < expected
+	case "eq":
+		result = count == expected
+	}
+	if re.config.Debug {
+		re.logger.Debugf("Frequency of %s: %d %s %d: %v", source, count, condition.Operator, expected, result)
+	}
+	return result
+}
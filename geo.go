@@ -0,0 +1,136 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/geoip"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errInvalidGeoIP              = errors.New("invalid geoIP")
+	errInvalidCountryPercentages = errors.New("invalid country percentages")
+)
+
+// validateCountryPercentages checks the country percentages of the rules: they are keyed by
+// uppercase ISO 3166-1 alpha-2 codes, and only replace the percentage of percentage rules outside
+// assignment groups, which split on one percentage per variant everywhere. Locating requests
+// requires the geoIP configuration.
+func validateCountryPercentages(cfg *config.Config) error {
+	for _, rule := range cfg.Rules {
+		if len(rule.CountryPercentages) == 0 {
+			continue
+		}
+		path := rulePathKey(&rule)
+		if rule.Percentage == 0 || rule.Flag != nil {
+			return fmt.Errorf("%w: %s: country percentages require a percentage", errInvalidCountryPercentages, path)
+		}
+		if rule.AssignmentGroup != "" {
+			return fmt.Errorf("%w: %s: assignment groups split the same way in every country", errInvalidCountryPercentages, rule.AssignmentGroup)
+		}
+		if cfg.GeoIP == nil {
+			return fmt.Errorf("%w: %s: country percentages require geoIP", errInvalidCountryPercentages, path)
+		}
+		for country, percentage := range rule.CountryPercentages {
+			if !isCountryCode(country) {
+				return fmt.Errorf("%w: %s: %q is not an uppercase ISO country code", errInvalidCountryPercentages, path, country)
+			}
+			if percentage < 0 || percentage > 100 {
+				return fmt.Errorf("%w: %s: %s: %w", errInvalidCountryPercentages, path, country, errInvalidPercentage)
+			}
+		}
+	}
+	return nil
+}
+
+func isCountryCode(code string) bool {
+	return len(code) == 2 && code[0] >= 'A' && code[0] <= 'Z' && code[1] >= 'A' && code[1] <= 'Z'
+}
+
+// rulePercentage returns the percentage of a rule for requests from a country: its percentage in
+// the country if it has one, and its global percentage otherwise.
+func rulePercentage(rule *RoutingRule, country string) float64 {
+	if percentage, ok := rule.CountryPercentages[country]; ok && country != "" {
+		return percentage
+	}
+	return rule.Percentage
+}
+
+// countryResolver finds the country requests come from, in a header set by a CDN or proxy in
+// front of Traefik or by looking the client address up in a MaxMind DB. It is shared by the
+// middleware and the copies created for each rule change.
+type countryResolver struct {
+	header   string
+	database *geoip.Reader
+	lookups  *metrics.CounterVec
+}
+
+// newCountryResolver returns nil when requests are not located.
+func newCountryResolver(cfg *config.Config, registry *metrics.Registry) (*countryResolver, error) {
+	geo := cfg.GeoIP
+	if geo == nil {
+		return nil, nil
+	}
+	if geo.CountryHeader == "" && geo.Database == "" {
+		return nil, fmt.Errorf("%w: a country header or a database is required", errInvalidGeoIP)
+	}
+	resolver := &countryResolver{
+		header: geo.CountryHeader,
+		lookups: registry.Counter("forklift_geoip_lookups_total",
+			"Number of client addresses looked up in the GeoIP database by result: found, unknown or error.", "result"),
+	}
+	if geo.Database != "" {
+		database, err := geoip.Open(geo.Database)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidGeoIP, err)
+		}
+		resolver.database = database
+	}
+	return resolver, nil
+}
+
+// country returns the uppercase ISO code of the country of a request, or "" if it is unknown.
+func (c *countryResolver) country(req *http.Request) string {
+	if c == nil {
+		return ""
+	}
+	if c.header != "" {
+		if code := strings.ToUpper(strings.TrimSpace(req.Header.Get(c.header))); isCountryCode(code) {
+			return code
+		}
+	}
+	if c.database == nil {
+		return ""
+	}
+	ip := net.ParseIP(clientAddress(req))
+	if ip == nil {
+		c.lookups.Inc("unknown")
+		return ""
+	}
+	code, err := c.database.Country(ip)
+	switch {
+	case err != nil:
+		c.lookups.Inc("error")
+	case code == "":
+		c.lookups.Inc("unknown")
+	default:
+		c.lookups.Inc("found")
+	}
+	return code
+}
+
+// requestCountry returns the country of a request if a rule of the path has country
+// percentages, so other requests are not looked up.
+func (a *Forklift) requestCountry(req *http.Request, rules []*RoutingRule) string {
+	for _, rule := range rules {
+		if len(rule.CountryPercentages) > 0 {
+			return a.countries.country(req)
+		}
+	}
+	return ""
+}
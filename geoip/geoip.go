@@ -0,0 +1,351 @@
+// Package geoip looks up the country of IP addresses in MaxMind DB files, such as the GeoLite2
+// and GeoIP2 Country or City databases, or the DB-IP databases in the same format.
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrInvalidDatabase is returned for files that aren't MaxMind DB files, or are corrupt.
+	ErrInvalidDatabase = errors.New("invalid MaxMind DB")
+	// ErrIPv6Lookup is returned for IPv6 lookups in IPv4 databases.
+	ErrIPv6Lookup = errors.New("IPv6 address in an IPv4 database")
+)
+
+// metadataMarker starts the metadata section, at the end of the file.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSectionSeparator is the number of zero bytes between the search tree and the data section.
+const dataSectionSeparator = 16
+
+// Data section types.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Reader looks up records in a MaxMind DB held in memory.
+type Reader struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// dataStart is the offset of the data section, which pointers are relative to.
+	dataStart int
+	// ipv4Start is the node IPv4 addresses start from in IPv6 databases.
+	ipv4Start uint
+}
+
+// Open reads a MaxMind DB file.
+func Open(path string) (*Reader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return New(data)
+}
+
+// New reads a MaxMind DB from its contents.
+func New(data []byte) (*Reader, error) {
+	start := bytes.LastIndex(data, metadataMarker)
+	if start < 0 {
+		return nil, fmt.Errorf("%w: no metadata", ErrInvalidDatabase)
+	}
+	metadataStart := start + len(metadataMarker)
+	d := decoder{data: data[metadataStart:]}
+	value, _, err := d.decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+	r := &Reader{
+		data:       data,
+		nodeCount:  metadataUint(metadata, "node_count"),
+		recordSize: metadataUint(metadata, "record_size"),
+		ipVersion:  metadataUint(metadata, "ip_version"),
+	}
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%w: record size %d", ErrInvalidDatabase, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%w: IP version %d", ErrInvalidDatabase, r.ipVersion)
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(start) {
+		return nil, fmt.Errorf("%w: search tree larger than the file", ErrInvalidDatabase)
+	}
+	r.dataStart = int(treeSize) + dataSectionSeparator
+
+	if r.ipVersion == 6 {
+		// IPv4 addresses are stored as ::a.b.c.d, under 96 zero bits.
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+func metadataUint(metadata map[string]interface{}, key string) uint {
+	value, _ := metadata[key].(uint64)
+	if value > math.MaxInt32 {
+		return 0
+	}
+	return uint(value)
+}
+
+// record returns the left (bit 0) or right (bit 1) record of a node.
+func (r *Reader) record(node uint, bit byte) uint {
+	size := r.recordSize / 4
+	b := r.data[node*size : (node+1)*size]
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	}
+	if bit == 0 {
+		return uint(binary.BigEndian.Uint32(b[:4]))
+	}
+	return uint(binary.BigEndian.Uint32(b[4:]))
+}
+
+// Lookup returns the record of the network an IP address is in, or nil if it is in none.
+func (r *Reader) Lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return nil, ErrIPv6Lookup
+	}
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, ip[i/8]>>(7-uint(i%8))&1)
+	}
+	if node <= r.nodeCount {
+		// Equal to the node count, the record means the address is in no network.
+		return nil, nil
+	}
+	offset := int(node-r.nodeCount) - dataSectionSeparator
+	d := decoder{data: r.data[r.dataStart:]}
+	value, _, err := d.decode(offset, 0)
+	return value, err
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country an IP address is in, or of the
+// country its network is registered in if the database doesn't know where it is used. It is
+// empty for addresses the database doesn't have.
+func (r *Reader) Country(ip net.IP) (string, error) {
+	record, err := r.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if code := isoCode(record, key); code != "" {
+			return strings.ToUpper(code), nil
+		}
+	}
+	return "", nil
+}
+
+func isoCode(record interface{}, key string) string {
+	fields, _ := record.(map[string]interface{})
+	country, _ := fields[key].(map[string]interface{})
+	code, _ := country["iso_code"].(string)
+	return code
+}
+
+// maxDepth bounds the nesting of decoded values, and the pointers followed, so corrupt files
+// can't recurse forever.
+const maxDepth = 32
+
+// decoder decodes values of a data section.
+type decoder struct {
+	data []byte
+}
+
+// decode decodes the value at offset, returning the offset following it. Maps are decoded as
+// map[string]interface{}, arrays as []interface{}, unsigned integers as uint64, signed ones as
+// int64, and floats as float64.
+func (d *decoder) decode(offset, depth int) (interface{}, int, error) {
+	if depth > maxDepth {
+		return nil, 0, fmt.Errorf("%w: data nested too deep", ErrInvalidDatabase)
+	}
+	kind, size, offset, err := d.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if kind == typePointer {
+		target, next, err := d.pointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decode(target, depth+1)
+		return value, next, err
+	}
+	if kind == typeBool {
+		return size != 0, offset, nil
+	}
+	if kind == typeMap {
+		values := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			var key, value interface{}
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: map key is not a string", ErrInvalidDatabase)
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			values[name] = value
+		}
+		return values, offset, nil
+	}
+	if kind == typeArray {
+		values := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			var value interface{}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			values = append(values, value)
+		}
+		return values, offset, nil
+	}
+
+	if size > len(d.data)-offset {
+		return nil, 0, fmt.Errorf("%w: value past the end of the data", ErrInvalidDatabase)
+	}
+	b := d.data[offset : offset+size]
+	next := offset + size
+	switch kind {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: double of %d bytes", ErrInvalidDatabase, size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: float of %d bytes", ErrInvalidDatabase, size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), next, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		if size > 8 {
+			// 128-bit values are not needed for lookups; their low 64 bits are kept.
+			b = b[size-8:]
+		}
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		return value, next, nil
+	case typeInt32:
+		var value uint32
+		for _, c := range b {
+			value = value<<8 | uint32(c)
+		}
+		return int64(int32(value)), next, nil
+	case typeContainer, typeEndMarker:
+		return nil, next, nil
+	}
+	return nil, 0, fmt.Errorf("%w: unknown type %d", ErrInvalidDatabase, kind)
+}
+
+// control reads the control byte of the value at offset, returning its type and size, and the
+// offset of its payload.
+func (d *decoder) control(offset int) (kind, size, next int, err error) {
+	if offset < 0 || offset >= len(d.data) {
+		return 0, 0, 0, fmt.Errorf("%w: offset %d out of the data", ErrInvalidDatabase, offset)
+	}
+	c := d.data[offset]
+	offset++
+	kind = int(c >> 5)
+	if kind == typeExtended {
+		if offset >= len(d.data) {
+			return 0, 0, 0, fmt.Errorf("%w: truncated type", ErrInvalidDatabase)
+		}
+		kind = 7 + int(d.data[offset])
+		offset++
+	}
+	size = int(c & 0x1f)
+	if kind == typePointer || size < 29 {
+		return kind, size, offset, nil
+	}
+	n := size - 28
+	if offset+n > len(d.data) {
+		return 0, 0, 0, fmt.Errorf("%w: truncated size", ErrInvalidDatabase)
+	}
+	extra := 0
+	for _, b := range d.data[offset : offset+n] {
+		extra = extra<<8 | int(b)
+	}
+	switch n {
+	case 1:
+		size = 29 + extra
+	case 2:
+		size = 285 + extra
+	default:
+		size = 65821 + extra
+	}
+	return kind, size, offset + n, nil
+}
+
+// pointer decodes a pointer from the size bits of its control byte and the bytes following it,
+// returning its target and the offset after it.
+func (d *decoder) pointer(bits, offset int) (target, next int, err error) {
+	n := bits>>3&0x3 + 1
+	if offset+n > len(d.data) {
+		return 0, 0, fmt.Errorf("%w: truncated pointer", ErrInvalidDatabase)
+	}
+	value := 0
+	if n < 4 {
+		value = bits & 0x7
+	}
+	for _, b := range d.data[offset : offset+n] {
+		value = value<<8 | int(b)
+	}
+	switch n {
+	case 2:
+		value += 2048
+	case 3:
+		value += 526336
+	}
+	return value, offset + n, nil
+}
@@ -0,0 +1,93 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/flags"
+)
+
+var errRulesNotLoaded = errors.New("waiting for a verified rule bundle")
+
+const (
+	readinessTimeout  = 2 * time.Second
+	readinessProbeKey = "forklift:readiness-probe"
+)
+
+// readinessCheck is the result of one readiness check.
+type readinessCheck struct {
+	name string
+	err  error
+}
+
+// serveHealth answers liveness probes. The middleware is alive as long as it serves requests.
+func (a *Forklift) serveHealth(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	_, _ = rw.Write([]byte("ok\n"))
+}
+
+// serveReadiness answers readiness probes with the result of each check, and 503 Service
+// Unavailable if any failed.
+func (a *Forklift) serveReadiness(rw http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readinessTimeout)
+	defer cancel()
+
+	var b strings.Builder
+	status := http.StatusOK
+	for _, check := range a.readinessChecks(ctx) {
+		if check.err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&b, "[-]%s failed: %v\n", check.name, check.err)
+		} else {
+			fmt.Fprintf(&b, "[+]%s ok\n", check.name)
+		}
+	}
+	if a.config.Debug && status != http.StatusOK {
+		a.logger.Debugf("Readiness check failed:\n%s", b.String())
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_, _ = rw.Write([]byte(b.String()))
+}
+
+// readinessChecks checks that the rules are loaded, the SVID hasn't expired, the session store is
+// reachable and flag providers that evaluate locally have loaded their definitions.
+func (a *Forklift) readinessChecks(ctx context.Context) []readinessCheck {
+	var rules error
+	if a.rulesReady != nil && !a.rulesReady.Load() {
+		rules = errRulesNotLoaded
+	}
+	checks := []readinessCheck{{name: "rules", err: rules}}
+	if a.lifecycle.closing.Load() {
+		checks = append(checks, readinessCheck{name: "shutdown", err: errShuttingDown})
+	}
+
+	if a.svid != nil {
+		checks = append(checks, readinessCheck{name: "svid", err: a.svid.ready(a.now())})
+	}
+
+	if a.sessionStore != nil {
+		_, _, err := a.sessionStore.Get(ctx, readinessProbeKey)
+		checks = append(checks, readinessCheck{name: "sessionStore", err: err})
+	}
+
+	names := make([]string, 0, len(a.flagProviders))
+	for name := range a.flagProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if checker, ok := a.flagProviders[name].Provider.(flags.Checker); ok {
+			checks = append(checks, readinessCheck{name: "flagProvider/" + name, err: checker.Ready(ctx)})
+		}
+	}
+	return checks
+}
@@ -0,0 +1,282 @@
+package forklift
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+)
+
+var (
+	errInvalidRuleHistory = errors.New("invalid rule history")
+	errUnknownRuleVersion = errors.New("unknown rule version")
+)
+
+const (
+	defaultRuleHistorySize = 10
+	// ruleHistoryIndex is the file listing the versions of a history kept on disk, next to one
+	// rules-<version>.yaml file per version.
+	ruleHistoryIndex = "history.json"
+
+	adminRulesPath = "/rules"
+)
+
+// ruleHistory keeps the last rule sets the middleware loaded, oldest first, so a bad rule push
+// can be diffed and rolled back. It is shared by the middleware and the copies created for each
+// rule change, and only accessed with the rule source locked.
+type ruleHistory struct {
+	size     int
+	path     string
+	logger   logger.Logger
+	versions []ruleVersion
+	// current is the version serving requests, 0 until the configured rules are recorded.
+	current int
+}
+
+// ruleVersion is a rule set in the history. Its metadata is written to the index of a history
+// kept on disk, and its rules to their own file.
+type ruleVersion struct {
+	Version int       `json:"version"`
+	Source  string    `json:"source"`
+	Loaded  time.Time `json:"loaded"`
+	rules   []RoutingRule
+}
+
+// newRuleHistory loads the history kept on disk, if any, and returns nil when the history is not
+// configured.
+func newRuleHistory(cfg *config.Config, logger logger.Logger) (*ruleHistory, error) {
+	if cfg.RuleHistory == nil {
+		return nil, nil
+	}
+	if cfg.AdminAPI == nil {
+		return nil, fmt.Errorf("%w: the admin API is required", errInvalidRuleHistory)
+	}
+	if cfg.RuleHistory.Size < 0 {
+		return nil, fmt.Errorf("%w: size %d", errInvalidRuleHistory, cfg.RuleHistory.Size)
+	}
+	h := &ruleHistory{size: defaultRuleHistorySize, path: cfg.RuleHistory.Path, logger: logger}
+	if cfg.RuleHistory.Size > 0 {
+		h.size = cfg.RuleHistory.Size
+	}
+	if h.path == "" {
+		return h, nil
+	}
+	if err := os.MkdirAll(h.path, 0o700); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRuleHistory, err)
+	}
+	if err := h.load(); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRuleHistory, err)
+	}
+	return h, nil
+}
+
+// load reads the history kept on disk. Versions whose rules can't be read are dropped.
+func (h *ruleHistory) load() error {
+	data, err := os.ReadFile(filepath.Join(h.path, ruleHistoryIndex))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var versions []ruleVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return err
+	}
+	for _, version := range versions {
+		cfg, err := config.LoadFile(h.versionFile(version.Version))
+		if err != nil {
+			h.logger.Errorf("Error loading rule version %d: %v", version.Version, err)
+			continue
+		}
+		version.rules = cfg.Rules
+		h.versions = append(h.versions, version)
+	}
+	return nil
+}
+
+func (h *ruleHistory) versionFile(version int) string {
+	return filepath.Join(h.path, "rules-"+strconv.Itoa(version)+".yaml")
+}
+
+// record adds the rules that now serve requests to the history, unless they are those of the
+// latest version, and drops the oldest versions beyond its size. Failures to write the history to
+// disk are logged.
+func (h *ruleHistory) record(rules []RoutingRule, source string, now time.Time) {
+	if h == nil {
+		return
+	}
+	data, err := config.MarshalRules(rules)
+	if err != nil {
+		h.logger.Errorf("Error recording rule version: %v", err)
+		return
+	}
+	if n := len(h.versions); n > 0 {
+		latest := h.versions[n-1]
+		if previous, err := config.MarshalRules(latest.rules); err == nil && bytes.Equal(previous, data) {
+			h.current = latest.Version
+			return
+		}
+	}
+
+	version := ruleVersion{Version: 1, Source: source, Loaded: now.UTC(), rules: rules}
+	if n := len(h.versions); n > 0 {
+		version.Version = h.versions[n-1].Version + 1
+	}
+	h.versions = append(h.versions, version)
+	h.current = version.Version
+	var dropped []ruleVersion
+	if len(h.versions) > h.size {
+		dropped = append(dropped, h.versions[:len(h.versions)-h.size]...)
+		h.versions = append([]ruleVersion(nil), h.versions[len(h.versions)-h.size:]...)
+	}
+	if h.path != "" {
+		if err := h.write(version.Version, data, dropped); err != nil {
+			h.logger.Errorf("Error writing rule version %d: %v", version.Version, err)
+		}
+	}
+}
+
+// write writes the rules of a new version and the index, and removes the files of dropped
+// versions.
+func (h *ruleHistory) write(version int, data []byte, dropped []ruleVersion) error {
+	if err := os.WriteFile(h.versionFile(version), data, 0o600); err != nil {
+		return err
+	}
+	index, err := json.Marshal(h.versions)
+	if err != nil {
+		return err
+	}
+	// The index is replaced atomically, so a crash never leaves it truncated.
+	temp := filepath.Join(h.path, ruleHistoryIndex+".tmp")
+	if err := os.WriteFile(temp, index, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, filepath.Join(h.path, ruleHistoryIndex)); err != nil {
+		return err
+	}
+	for _, version := range dropped {
+		_ = os.Remove(h.versionFile(version.Version))
+	}
+	return nil
+}
+
+func (h *ruleHistory) get(version int) (ruleVersion, error) {
+	for _, v := range h.versions {
+		if v.Version == version {
+			return v, nil
+		}
+	}
+	return ruleVersion{}, fmt.Errorf("%w: %d", errUnknownRuleVersion, version)
+}
+
+// serveRuleHistory serves the rule history endpoints of the admin API: GET /versions lists the
+// versions, GET /versions/<n> returns the rules of one as YAML, GET /diff?from=<n>&to=<n>
+// compares two, the current one by default, and POST /rollback with {"version": <n>} makes a
+// version serve requests again.
+func (a *Forklift) serveRuleHistory(rw http.ResponseWriter, req *http.Request, endpoint string) {
+	if req.Method == http.MethodPost && endpoint == "/rollback" {
+		a.rollbackRules(rw, req)
+		return
+	}
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	history := a.history
+	switch {
+	case endpoint == "/versions":
+		type summary struct {
+			ruleVersion
+			Rules   int  `json:"rules"`
+			Current bool `json:"current"`
+		}
+		versions := make([]summary, len(history.versions))
+		for i, v := range history.versions {
+			versions[i] = summary{ruleVersion: v, Rules: len(v.rules), Current: v.Version == history.current}
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"current": history.current, "versions": versions})
+	case strings.HasPrefix(endpoint, "/versions/"):
+		number, _ := strconv.Atoi(strings.TrimPrefix(endpoint, "/versions/"))
+		version, err := history.get(number)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		data, err := config.MarshalRules(version.rules)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/yaml")
+		_, _ = rw.Write(data)
+	case endpoint == "/diff":
+		query := req.URL.Query()
+		from, _ := strconv.Atoi(query.Get("from"))
+		to := history.current
+		if query.Has("to") {
+			to, _ = strconv.Atoi(query.Get("to"))
+		}
+		fromVersion, err := history.get(from)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		toVersion, err := history.get(to)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		changes, err := config.DiffRules(fromVersion.rules, toVersion.rules)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if changes == nil {
+			changes = []config.RuleChange{}
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"from": from, "to": to, "changes": changes})
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// rollbackRules makes the rules of a version serve requests, with the current canary steps and
+// traffic weights applied, and records them as a new version.
+func (a *Forklift) rollbackRules(rw http.ResponseWriter, req *http.Request) {
+	var body struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrafficRequestSize)).Decode(&body); err != nil {
+		http.Error(rw, "Malformed JSON", http.StatusBadRequest)
+		return
+	}
+
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	version, err := a.history.get(body.Version)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := a.applyRules(version.rules); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.history.record(version.rules, "rollback to "+strconv.Itoa(version.Version), a.now())
+	a.audit(req, adminAuditEntry{Action: "rollback", Version: version.Version})
+	writeJSON(rw, http.StatusOK, map[string]int{"current": a.history.current})
+}
@@ -0,0 +1,131 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errUnknownHook = errors.New("unknown hook")
+
+var (
+	hookRegistryMu sync.RWMutex
+	hookRegistry   = make(map[string]Hook)
+)
+
+// HookContext carries the state of a request through the hook stages.
+// Hooks may replace the request or session ID in PreMatch and the selection in PostDecision.
+type HookContext struct {
+	Request   *http.Request
+	SessionID string
+	// RequestID is the X-Request-ID of the request, generated if the client sent none.
+	RequestID string
+	Selected  SelectedBackend
+	Status    int
+	// Duration is how long serving the request took, set with Status.
+	Duration time.Duration
+}
+
+// Hook is implemented by custom logic that runs at fixed stages of request handling.
+type Hook interface {
+	// PreMatch runs before rules are matched, e.g. to derive a custom identity.
+	PreMatch(hc *HookContext)
+	// PostDecision runs after a backend has been selected and before the request is served.
+	PostDecision(hc *HookContext)
+	// PostResponse runs after the response has been written, with the response status set.
+	PostResponse(hc *HookContext)
+}
+
+// HookFuncs adapts plain functions to the Hook interface. Nil functions are skipped.
+type HookFuncs struct {
+	PreMatchFunc     func(hc *HookContext)
+	PostDecisionFunc func(hc *HookContext)
+	PostResponseFunc func(hc *HookContext)
+}
+
+// PreMatch implements Hook.
+func (h HookFuncs) PreMatch(hc *HookContext) {
+	if h.PreMatchFunc != nil {
+		h.PreMatchFunc(hc)
+	}
+}
+
+// PostDecision implements Hook.
+func (h HookFuncs) PostDecision(hc *HookContext) {
+	if h.PostDecisionFunc != nil {
+		h.PostDecisionFunc(hc)
+	}
+}
+
+// PostResponse implements Hook.
+func (h HookFuncs) PostResponse(hc *HookContext) {
+	if h.PostResponseFunc != nil {
+		h.PostResponseFunc(hc)
+	}
+}
+
+// RegisterHook makes a hook available under the given name so configurations can enable it
+// through the hooks setting. It is meant to be called from init functions of packages built into
+// the same binary, such as a Traefik or standalone proxy build importing the middleware; the
+// middleware loaded as a Traefik plugin is interpreted on its own and can't see them.
+func RegisterHook(name string, hook Hook) {
+	hookRegistryMu.Lock()
+	defer hookRegistryMu.Unlock()
+	hookRegistry[name] = hook
+}
+
+// lookupHooks resolves configured hook names in the order they are listed.
+func lookupHooks(names []string) ([]Hook, error) {
+	hookRegistryMu.RLock()
+	defer hookRegistryMu.RUnlock()
+
+	hooks := make([]Hook, 0, len(names))
+	for _, name := range names {
+		hook, ok := hookRegistry[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", errUnknownHook, name)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+func (a *Forklift) runPreMatch(hc *HookContext) {
+	for _, hook := range a.hooks {
+		hook.PreMatch(hc)
+	}
+}
+
+func (a *Forklift) runPostDecision(hc *HookContext) {
+	for _, hook := range a.hooks {
+		hook.PostDecision(hc)
+	}
+}
+
+func (a *Forklift) runPostResponse(hc *HookContext) {
+	for _, hook := range a.hooks {
+		hook.PostResponse(hc)
+	}
+}
+
+// statusRecorder records the status code written to the wrapped response writer.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader && !isInformational(status) {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
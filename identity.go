@@ -0,0 +1,130 @@
+package forklift
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidIdentitySource = errors.New("invalid identity source: must be basic, header:<name> or query:<name>")
+	errInvalidIdentityList   = errors.New("invalid identity list")
+)
+
+const (
+	basicIdentitySource = "basic"
+	identityHashPrefix  = "sha256:"
+)
+
+// validateIdentities checks the identity sources, and the identity lists of the rules.
+func validateIdentities(cfg *config.Config) error {
+	if cfg.Identity != nil {
+		for _, source := range cfg.Identity.Sources {
+			kind, _, _ := strings.Cut(source, ":")
+			if source != basicIdentitySource && ((kind != "header" && kind != "query") || !validFlagSource(source)) {
+				return fmt.Errorf("%w: %q", errInvalidIdentitySource, source)
+			}
+		}
+	}
+	for _, rule := range cfg.Rules {
+		if rule.Identities == nil {
+			continue
+		}
+		if cfg.Identity == nil || len(cfg.Identity.Sources) == 0 {
+			return fmt.Errorf("%w: identity sources are required", errInvalidIdentityList)
+		}
+		for _, entry := range append(append([]string(nil), rule.Identities.Allow...), rule.Identities.Deny...) {
+			if hash, ok := strings.CutPrefix(entry, identityHashPrefix); ok {
+				if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+					return fmt.Errorf("%w: invalid hash %q", errInvalidIdentityList, entry)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// requestIdentity returns the first of the identity sources the request carries, and its value,
+// or "" if it carries none.
+func requestIdentity(req *http.Request, identity *config.Identity) (string, string) {
+	if identity == nil {
+		return "", ""
+	}
+	for _, source := range identity.Sources {
+		var value string
+		if source == basicIdentitySource {
+			value, _, _ = req.BasicAuth()
+		} else {
+			value = flagSourceValue(req, source)
+		}
+		if value != "" {
+			return source, value
+		}
+	}
+	return "", ""
+}
+
+// identitySessionID returns the session ID of an identified request, derived from its identity
+// so that its requests are bucketed alike without a session cookie, or "" if it has no identity.
+// The identity is hashed, so API keys don't end up in the session store or logs.
+func identitySessionID(req *http.Request, identity *config.Identity) string {
+	source, value := requestIdentity(req, identity)
+	if value == "" {
+		return ""
+	}
+	return identityHash(source, value)
+}
+
+// identityHash returns the session ID of an identity.
+func identityHash(source, value string) string {
+	sum := sha256.Sum256([]byte(source + "\x00" + value))
+	return base64.URLEncoding.EncodeToString(sum[:])
+}
+
+// matchIdentities checks the rule's identity list. Requests without an identity only match
+// rules without an allow list.
+func (re *RuleEngine) matchIdentities(req *http.Request, rule *RoutingRule) bool {
+	list := rule.Identities
+	if list == nil {
+		return true
+	}
+	_, identity := requestIdentity(req, re.config.Identity)
+	var result bool
+	switch {
+	case identity == "":
+		result = len(list.Allow) == 0
+	case identityListed(list.Deny, identity):
+		result = false
+	default:
+		result = len(list.Allow) == 0 || identityListed(list.Allow, identity)
+	}
+	if re.config.Debug {
+		re.logger.Debugf("Identity allowed by rule: %v", result)
+	}
+	return result
+}
+
+// identityListed reports whether the identity, or its hash, is one of the entries.
+func identityListed(entries []string, identity string) bool {
+	var hash string
+	for _, entry := range entries {
+		if expected, ok := strings.CutPrefix(entry, identityHashPrefix); ok {
+			if hash == "" {
+				sum := sha256.Sum256([]byte(identity))
+				hash = hex.EncodeToString(sum[:])
+			}
+			if strings.EqualFold(expected, hash) {
+				return true
+			}
+		} else if entry == identity {
+			return true
+		}
+	}
+	return false
+}
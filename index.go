@@ -0,0 +1,72 @@
+package forklift
+
+import "sort"
+
+// ruleIndex narrows the rules that can match a request path without scanning every rule.
+// Rules with an exact path are looked up in a map, rules with only a path prefix are stored
+// in a byte trie, and rules without either are candidates for every request.
+type ruleIndex struct {
+	exact    map[string][]int
+	prefixes *prefixNode
+	catchAll []int
+}
+
+// prefixNode is a node of the path prefix trie.
+type prefixNode struct {
+	children map[byte]*prefixNode
+	rules    []int
+}
+
+// newRuleIndex compiles the rules into an index. Indices refer to positions in rules.
+func newRuleIndex(rules []RoutingRule) *ruleIndex {
+	idx := &ruleIndex{
+		exact:    make(map[string][]int),
+		prefixes: &prefixNode{},
+	}
+	for i, rule := range rules {
+		switch {
+		case rule.Path != "":
+			idx.exact[rule.Path] = append(idx.exact[rule.Path], i)
+		case rule.PathPrefix != "":
+			idx.prefixes.insert(rule.PathPrefix, i)
+		default:
+			idx.catchAll = append(idx.catchAll, i)
+		}
+	}
+	return idx
+}
+
+func (n *prefixNode) insert(prefix string, rule int) {
+	node := n
+	for i := 0; i < len(prefix); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*prefixNode)
+		}
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = &prefixNode{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	node.rules = append(node.rules, rule)
+}
+
+// candidates appends the indices of rules whose path settings may match the path to result,
+// in rule order.
+func (idx *ruleIndex) candidates(path string, result []int) []int {
+	result = append(result, idx.exact[path]...)
+	result = append(result, idx.catchAll...)
+
+	node := idx.prefixes
+	for i := 0; node != nil; i++ {
+		result = append(result, node.rules...)
+		if i == len(path) {
+			break
+		}
+		node = node.children[path[i]]
+	}
+
+	sort.Ints(result)
+	return result
+}
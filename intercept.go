@@ -0,0 +1,116 @@
+package forklift
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidInterception = errors.New("invalid error interception: action must be retry or page, page needs a page, and statuses must be 5xx")
+
+const (
+	interceptRetry = "retry"
+	interceptPage  = "page"
+	// maxReplayBodyBytes bounds the request bodies buffered so requests can be retried against
+	// the default backend. Requests with larger bodies are not intercepted.
+	maxReplayBodyBytes = 1 << 20
+)
+
+// validateErrorInterceptions checks the error interceptions of the rules.
+func validateErrorInterceptions(rules []RoutingRule) error {
+	for _, rule := range rules {
+		interception := rule.InterceptErrors
+		if interception == nil {
+			continue
+		}
+		switch {
+		case interception.Action != interceptRetry && interception.Action != interceptPage:
+			return errInvalidInterception
+		case interception.Action == interceptPage && interception.Page == nil:
+			return errInvalidInterception
+		}
+		for _, status := range interception.Statuses {
+			if status < 500 || status > 599 {
+				return errInvalidInterception
+			}
+		}
+	}
+	return nil
+}
+
+// intercepts reports whether the interception handles responses with the status.
+func intercepts(interception *config.ErrorInterception, status int) bool {
+	if len(interception.Statuses) == 0 {
+		return status >= 500 && status <= 599
+	}
+	for _, intercepted := range interception.Statuses {
+		if status == intercepted {
+			return true
+		}
+	}
+	return false
+}
+
+// serveIntercepted proxies the request to the backend of the selected rule and, if it answers
+// with an intercepted status or can't be reached, retries the request against the default
+// backend or serves the error page of the rule instead.
+func (a *Forklift) serveIntercepted(rw http.ResponseWriter, req *http.Request, selected SelectedBackend) {
+	interception := selected.Rule.InterceptErrors
+	body, ok := replayableBody(req)
+	if !ok && interception.Action == interceptRetry {
+		a.proxy(rw, req, selected)
+		return
+	}
+
+	proxyReq, err := a.createProxyRequest(req, backendURL(selected), selected.Rule)
+	if err != nil {
+		a.requestLogger(req).Errorf("Error creating proxy request: %v", err)
+		http.Error(rw, "Error creating proxy request", http.StatusInternalServerError)
+		return
+	}
+	a.propagate(proxyReq.Header, selected)
+	resp, err := a.doProxyRequest(rw, proxyReq)
+	status := http.StatusBadGateway
+	if err == nil {
+		if !intercepts(interception, resp.StatusCode) {
+			a.writeProxyResponse(rw, proxyReq, resp)
+			return
+		}
+		status = resp.StatusCode
+		_ = resp.Body.Close()
+	} else {
+		a.requestLogger(req).Errorf("Error sending request to backend: %v", err)
+	}
+
+	a.interceptedErrors.Inc(a.ruleLabel(selected.Rule), interception.Action)
+	a.requestLogger(req).Warnf("Intercepted status %d of backend %s: %s", status, backendURL(selected), interception.Action)
+	if interception.Action == interceptPage {
+		a.serveStatic(rw, interception.Page)
+		return
+	}
+	if body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	a.proxy(rw, req, SelectedBackend{Backend: a.config.DefaultBackend, Reason: reasonFallback})
+}
+
+// replayableBody reads the request body so the request can be sent twice, and resets it to what
+// was read. It reports false if the body is larger than maxReplayBodyBytes.
+func replayableBody(req *http.Request) ([]byte, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true
+	}
+	if req.ContentLength > maxReplayBodyBytes {
+		return nil, false
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxReplayBodyBytes+1))
+	if err != nil || len(body) > maxReplayBodyBytes {
+		req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
@@ -0,0 +1,292 @@
+package forklift
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errInvalidIntrospection  = errors.New("invalid token introspection")
+	errInvalidTokenCondition = errors.New("invalid token condition: parameter must be scope, role or claim:<path>")
+	errMissingIntrospection  = errors.New("token conditions require introspection to be configured")
+	errIntrospectionStatus   = errors.New("token introspection failed")
+)
+
+const (
+	defaultIntrospectionCacheTTL  = time.Minute
+	defaultIntrospectionCacheSize = 10000
+	defaultIntrospectionTimeout   = 2 * time.Second
+
+	// maxIntrospectionResponseSize bounds the responses read from the introspection endpoint.
+	maxIntrospectionResponseSize = 1 << 20
+
+	tokenScope       = "scope"
+	tokenRole        = "role"
+	tokenClaimPrefix = "claim:"
+)
+
+// tokenIntrospector checks bearer tokens with an OAuth2 introspection endpoint for token
+// conditions. Results, including inactive tokens, are cached by the hash of the token, so each
+// token is introspected once per cache TTL rather than on every request.
+type tokenIntrospector struct {
+	url          string
+	clientID     string
+	clientSecret string
+	ttl          time.Duration
+	size         int
+	client       *http.Client
+	logger       logger.Logger
+	lookups      *metrics.CounterVec
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]introspectedToken
+}
+
+// introspectedToken is a cached introspection result. claims is nil for inactive tokens.
+type introspectedToken struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+// newTokenIntrospector returns nil when introspection is not configured.
+func newTokenIntrospector(cfg *config.Introspection, logger logger.Logger, registry *metrics.Registry) (*tokenIntrospector, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	endpoint, err := url.Parse(cfg.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("%w: invalid URL %q", errInvalidIntrospection, cfg.URL)
+	}
+	if cfg.ClientID == "" {
+		return nil, fmt.Errorf("%w: clientID is required", errInvalidIntrospection)
+	}
+	if cfg.CacheSize < 0 {
+		return nil, fmt.Errorf("%w: cache size %d", errInvalidIntrospection, cfg.CacheSize)
+	}
+	i := &tokenIntrospector{
+		url:          cfg.URL,
+		clientID:     cfg.ClientID,
+		clientSecret: cfg.ClientSecret,
+		ttl:          defaultIntrospectionCacheTTL,
+		size:         defaultIntrospectionCacheSize,
+		logger:       logger,
+		entries:      make(map[[sha256.Size]byte]introspectedToken),
+	}
+	if cfg.CacheSize > 0 {
+		i.size = cfg.CacheSize
+	}
+	if cfg.CacheTTL != "" {
+		ttl, err := time.ParseDuration(cfg.CacheTTL)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("%w: cache TTL %s", errInvalidIntrospection, cfg.CacheTTL)
+		}
+		i.ttl = ttl
+	}
+	timeout := defaultIntrospectionTimeout
+	if cfg.Timeout != "" {
+		timeout, err = time.ParseDuration(cfg.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%w: timeout %s", errInvalidIntrospection, cfg.Timeout)
+		}
+	}
+	i.client = &http.Client{Timeout: timeout}
+	i.lookups = registry.Counter("forklift_token_introspections_total",
+		"Number of bearer token lookups by result: cached, active, inactive or error.", "result")
+	return i, nil
+}
+
+// validateTokenConditions checks the parameters of token conditions, and that introspection is
+// configured when they are used.
+func validateTokenConditions(cfg *config.Config) error {
+	for _, rule := range cfg.Rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "token") {
+				continue
+			}
+			if cfg.Introspection == nil {
+				return errMissingIntrospection
+			}
+			switch {
+			case condition.Parameter == tokenScope, condition.Parameter == tokenRole:
+			case strings.HasPrefix(condition.Parameter, tokenClaimPrefix) && len(condition.Parameter) > len(tokenClaimPrefix):
+			default:
+				return fmt.Errorf("%w: %q", errInvalidTokenCondition, condition.Parameter)
+			}
+		}
+	}
+	return nil
+}
+
+// claims returns the claims of the request's bearer token, or nil if it has none, the token is
+// inactive or couldn't be introspected.
+func (i *tokenIntrospector) claims(req *http.Request, now time.Time) map[string]interface{} {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+	key := sha256.Sum256([]byte(token))
+	i.mu.Lock()
+	entry, cached := i.entries[key]
+	i.mu.Unlock()
+	if cached && now.Before(entry.expires) {
+		i.lookups.Inc("cached")
+		return entry.claims
+	}
+
+	claims, err := i.introspect(req.Context(), token)
+	if err != nil {
+		i.logger.Errorf("Error introspecting bearer token: %v", err)
+		i.lookups.Inc("error")
+		return nil
+	}
+	expires := now.Add(i.ttl)
+	if claims == nil {
+		i.lookups.Inc("inactive")
+	} else {
+		i.lookups.Inc("active")
+		if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(expires) {
+			expires = time.Unix(int64(exp), 0)
+		}
+	}
+	i.put(key, introspectedToken{claims: claims, expires: expires}, now)
+	return claims
+}
+
+// put caches a result, dropping expired results, or all of them, when the cache is full.
+func (i *tokenIntrospector) put(key [sha256.Size]byte, entry introspectedToken, now time.Time) {
+	if i.ttl == 0 {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.entries) >= i.size {
+		for k, e := range i.entries {
+			if !now.Before(e.expires) {
+				delete(i.entries, k)
+			}
+		}
+		if len(i.entries) >= i.size {
+			i.entries = make(map[[sha256.Size]byte]introspectedToken)
+		}
+	}
+	i.entries[key] = entry
+}
+
+// introspect asks the endpoint about the token. It returns nil claims for inactive tokens.
+func (i *tokenIntrospector) introspect(ctx context.Context, token string) (map[string]interface{}, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", errIntrospectionStatus, resp.Status)
+	}
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxIntrospectionResponseSize)).Decode(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", errIntrospectionStatus, err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+// tokenValues returns the values of the condition's parameter in the claims: the scopes, the
+// roles, including Keycloak's realm and client roles, or the values of a claim, by its dotted
+// path.
+func tokenValues(claims map[string]interface{}, parameter string) []string {
+	switch parameter {
+	case tokenScope:
+		scope, _ := claims["scope"].(string)
+		return strings.Fields(scope)
+	case tokenRole:
+		roles := claimStrings(claims["roles"])
+		roles = append(roles, claimStrings(claimPath(claims, "realm_access.roles"))...)
+		if clients, ok := claims["resource_access"].(map[string]interface{}); ok {
+			for _, client := range clients {
+				if access, ok := client.(map[string]interface{}); ok {
+					roles = append(roles, claimStrings(access["roles"])...)
+				}
+			}
+		}
+		return roles
+	default:
+		return claimStrings(claimPath(claims, strings.TrimPrefix(parameter, tokenClaimPrefix)))
+	}
+}
+
+func claimPath(claims map[string]interface{}, path string) interface{} {
+	var value interface{} = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// claimStrings returns the strings of a claim, of each element for arrays.
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case []interface{}:
+		var values []string
+		for _, element := range v {
+			values = append(values, claimStrings(element)...)
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// checkToken compares the values of the parameter in the claims of the request's bearer token
+// with the condition value. It matches if any value does.
+func (re *RuleEngine) checkToken(req *http.Request, condition RuleCondition) bool {
+	if re.introspector == nil {
+		return false
+	}
+	claims := re.introspector.claims(req, re.now())
+	result := false
+	for _, value := range tokenValues(claims, condition.Parameter) {
+		if re.compareValues(value, condition.Operator, condition.Value) {
+			result = true
+			break
+		}
+	}
+	if re.config.Debug {
+		re.logger.Debugf("Token %s %s %q: %v", condition.Parameter, condition.Operator, condition.Value, result)
+	}
+	return result
+}
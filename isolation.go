@@ -0,0 +1,145 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/flags"
+)
+
+var (
+	errRulePanic          = errors.New("rule evaluation panicked")
+	errInvalidErrorBudget = errors.New("invalid error budget")
+)
+
+const (
+	failurePanic     = "panic"
+	failureFlagError = "flag_error"
+)
+
+// errorBudget tracks the failures of a rule. Once the rule fails Failures times within Window it
+// is skipped, as if it didn't match, until Cooldown has passed.
+type errorBudget struct {
+	max      int
+	window   time.Duration
+	cooldown time.Duration
+
+	mu            sync.Mutex
+	windowStart   time.Time
+	failures      int
+	disabledUntil time.Time
+}
+
+// errorBudgets returns the error budget of each rule that has one. Rules must already be sorted.
+func errorBudgets(rules []RoutingRule) (map[*RoutingRule]*errorBudget, error) {
+	var budgets map[*RoutingRule]*errorBudget
+	for i := range rules {
+		cfg := rules[i].ErrorBudget
+		if cfg == nil {
+			continue
+		}
+		if cfg.Failures < 1 {
+			return nil, fmt.Errorf("%w: failures must be at least 1", errInvalidErrorBudget)
+		}
+		window, err := time.ParseDuration(cfg.Window)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("%w: window %q", errInvalidErrorBudget, cfg.Window)
+		}
+		cooldown := window
+		if cfg.Cooldown != "" {
+			cooldown, err = time.ParseDuration(cfg.Cooldown)
+			if err != nil || cooldown <= 0 {
+				return nil, fmt.Errorf("%w: cooldown %q", errInvalidErrorBudget, cfg.Cooldown)
+			}
+		}
+		if budgets == nil {
+			budgets = make(map[*RoutingRule]*errorBudget)
+		}
+		budgets[&rules[i]] = &errorBudget{max: cfg.Failures, window: window, cooldown: cooldown}
+	}
+	return budgets, nil
+}
+
+// available reports whether the rule may be evaluated at now.
+func (b *errorBudget) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.disabledUntil)
+}
+
+// fail records a failure at now and reports whether it exhausted the budget.
+func (b *errorBudget) fail(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.windowStart) >= b.window {
+		b.windowStart = now
+		b.failures = 0
+	}
+	b.failures++
+	if b.failures < b.max {
+		return false
+	}
+	b.failures = 0
+	b.windowStart = now
+	b.disabledUntil = now.Add(b.cooldown)
+	return true
+}
+
+// withinBudget reports whether the rule has not exhausted its error budget.
+func (a *Forklift) withinBudget(rule *RoutingRule) bool {
+	if rule.ErrorBudget == nil {
+		return true
+	}
+	budget, ok := a.errorBudgets[rule]
+	return !ok || budget.available(a.now())
+}
+
+// ruleFailed counts a failure of the rule and charges it to the rule's error budget.
+func (a *Forklift) ruleFailed(rule *RoutingRule, reason string) {
+	key := a.ruleKey(rule)
+	a.ruleFailures.Inc(a.ruleLabel(rule), reason)
+	if rule.ErrorBudget == nil {
+		return
+	}
+	if budget, ok := a.errorBudgets[rule]; ok && budget.fail(a.now()) {
+		a.logger.Warnf("Rule %s exhausted its error budget, skipping it for %s", key, budget.cooldown)
+	}
+}
+
+// matchRule reports whether the request matches the rule. A panic while matching, e.g. in a
+// custom condition evaluator, counts as a failure of the rule, which then doesn't match, so the
+// request falls through to the next rule instead of failing. Rules that exhausted their error
+// budget don't match either.
+func (a *Forklift) matchRule(req *http.Request, rule *RoutingRule) (matched bool) {
+	if !a.withinBudget(rule) {
+		return false
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			a.requestLogger(req).Errorf("%v: %s: %v", errRulePanic, a.ruleKey(rule), r)
+			a.ruleFailed(rule, failurePanic)
+			matched = false
+		}
+	}()
+	return a.ruleEngine.ruleMatches(req, rule)
+}
+
+// evaluateProvider evaluates the flag of a rule with its provider. A panic in the provider is
+// returned as an error, so the rule's fallback applies, and every failure counts against the rule.
+func (a *Forklift) evaluateProvider(ctx context.Context, provider flags.Provider, rule *RoutingRule, subject flags.Subject) (treatment string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			a.ruleFailed(rule, failurePanic)
+			treatment, err = "", fmt.Errorf("%w: %v", errRulePanic, r)
+			return
+		}
+		if err != nil {
+			a.ruleFailed(rule, failureFlagError)
+		}
+	}()
+	return provider.Evaluate(ctx, rule.Flag.Name, subject)
+}
@@ -0,0 +1,263 @@
+package forklift
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/store"
+)
+
+var (
+	errInvalidKillSwitch = errors.New("invalid kill switch")
+	errKillSwitchRequest = errors.New("invalid kill switch request")
+)
+
+const (
+	adminKillSwitchPath = "/killswitch"
+
+	defaultKillSwitchPollInterval = 5 * time.Second
+
+	killSwitchOn  = "on"
+	killSwitchOff = "off"
+)
+
+// Sources engaging the kill switch.
+const (
+	killSwitchConfig = "config"
+	killSwitchAdmin  = "admin"
+	killSwitchStore  = "store"
+)
+
+// killSwitch sends all requests to the default backend, across all rules, while one of its
+// sources engages it: the configuration, the admin API of this instance, or a key of the session
+// store shared by instances. Sessions keep their stored assignments, and get their variants back
+// once it is released. It is shared by the middleware and the copies created for each rule change,
+// so rule changes don't release it.
+type killSwitch struct {
+	configured bool
+	admin      atomic.Bool
+	stored     atomic.Bool
+
+	store    store.SessionStore
+	key      string
+	interval time.Duration
+	// ttl is how long the key written through the admin API is kept, the TTL of session
+	// assignments.
+	ttl time.Duration
+
+	engaged  *metrics.GaugeVec
+	requests *metrics.CounterVec
+	logger   logger.Logger
+}
+
+// killSwitchState is the state of the kill switch served by the admin API.
+type killSwitchState struct {
+	Engaged bool     `json:"engaged"`
+	Sources []string `json:"sources"`
+}
+
+// newKillSwitch returns nil when neither the kill switch nor the admin API, which can engage it,
+// is configured.
+func newKillSwitch(cfg *config.Config, sessionStore store.SessionStore, opts store.Options,
+	logger logger.Logger, registry *metrics.Registry,
+) (*killSwitch, error) {
+	if cfg.KillSwitch == nil && cfg.AdminAPI == nil {
+		return nil, nil
+	}
+	k := &killSwitch{
+		interval: defaultKillSwitchPollInterval,
+		ttl:      opts.TTL,
+		engaged: registry.Gauge("forklift_kill_switch_engaged",
+			"Whether the kill switch is engaged by the source: config, admin or store, 1 or 0.", "source"),
+		requests: registry.Counter("forklift_kill_switch_requests_total",
+			"Number of requests sent to the default backend by the kill switch."),
+		logger: logger,
+	}
+	if ks := cfg.KillSwitch; ks != nil {
+		k.configured = ks.Engaged
+		if ks.Key != "" {
+			if sessionStore == nil {
+				return nil, fmt.Errorf("%w: key requires a session store", errInvalidKillSwitch)
+			}
+			k.store, k.key = sessionStore, ks.Key
+		}
+		if ks.PollInterval != "" {
+			interval, err := time.ParseDuration(ks.PollInterval)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("%w: poll interval %s", errInvalidKillSwitch, ks.PollInterval)
+			}
+			k.interval = interval
+		}
+	}
+	k.engaged.Set(gaugeValue(k.configured), killSwitchConfig)
+	k.engaged.Set(0, killSwitchAdmin)
+	if k.store != nil {
+		k.engaged.Set(0, killSwitchStore)
+	}
+	if k.configured {
+		logger.Warnf("Kill switch engaged by the configuration: all requests go to the default backend")
+	}
+	return k, nil
+}
+
+// isEngaged reports whether any source engages the kill switch.
+func (k *killSwitch) isEngaged() bool {
+	return k != nil && (k.configured || k.admin.Load() || k.stored.Load())
+}
+
+// state returns whether the kill switch is engaged and the sources engaging it.
+func (k *killSwitch) state() killSwitchState {
+	sources := []string{}
+	for _, source := range []struct {
+		name    string
+		engaged bool
+	}{
+		{killSwitchConfig, k.configured},
+		{killSwitchAdmin, k.admin.Load()},
+		{killSwitchStore, k.stored.Load()},
+	} {
+		if source.engaged {
+			sources = append(sources, source.name)
+		}
+	}
+	return killSwitchState{Engaged: len(sources) > 0, Sources: sources}
+}
+
+// set engages or releases the kill switch for a source, logging the changes.
+func (k *killSwitch) set(source string, flag *atomic.Bool, engaged bool) {
+	if flag.Swap(engaged) == engaged {
+		return
+	}
+	k.engaged.Set(gaugeValue(engaged), source)
+	if engaged {
+		k.logger.Warnf("Kill switch engaged by %s: all requests go to the default backend", source)
+	} else {
+		k.logger.Infof("Kill switch released by %s", source)
+	}
+}
+
+// switchTo engages or releases the kill switch through the key of the session store, for all
+// instances, or for this instance only without a key.
+func (k *killSwitch) switchTo(ctx context.Context, engaged bool) error {
+	if k.store == nil {
+		k.set(killSwitchAdmin, &k.admin, engaged)
+		return nil
+	}
+	value := killSwitchOff
+	if engaged {
+		value = killSwitchOn
+	}
+	if err := k.store.Set(ctx, k.key, value, k.ttl); err != nil {
+		return err
+	}
+	k.set(killSwitchStore, &k.stored, engaged)
+	return nil
+}
+
+// poll reads the key of the kill switch. Errors reading the store are logged and keep the last
+// state, so an unreachable store neither engages nor releases it.
+func (k *killSwitch) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), k.interval)
+	defer cancel()
+	value, found, err := k.store.Get(ctx, k.key)
+	if err != nil {
+		k.logger.Errorf("Error reading kill switch %s: %v", k.key, err)
+		return
+	}
+	k.set(killSwitchStore, &k.stored, found && killSwitchValue(value))
+}
+
+// killSwitchValue reports whether the value of the key engages the kill switch: "on", or true as
+// parsed by strconv.ParseBool.
+func killSwitchValue(value string) bool {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, killSwitchOn) {
+		return true
+	}
+	engaged, _ := strconv.ParseBool(value)
+	return engaged
+}
+
+// pollKillSwitch reads the key of the kill switch every interval until the middleware shuts down.
+func (a *Forklift) pollKillSwitch() {
+	go func() {
+		ticker := time.NewTicker(a.killSwitch.interval)
+		defer ticker.Stop()
+		for {
+			a.killSwitch.poll()
+			select {
+			case <-ticker.C:
+			case <-a.lifecycle.done:
+				return
+			}
+		}
+	}()
+}
+
+// killed sends the request to the default backend without evaluating the rules while the kill
+// switch is engaged, and reports whether it did.
+func (a *Forklift) killed(rw http.ResponseWriter, req *http.Request) bool {
+	if !a.killSwitch.isEngaged() {
+		return false
+	}
+	a.killSwitch.requests.Inc()
+	selected := a.defaultBackendSelection()
+	selected.Reason = reasonKillSwitch
+	a.serve(rw, req, a.assigned(selected))
+	return true
+}
+
+// serveKillSwitch serves the state of the kill switch on GET, and engages or releases it on PUT
+// with {"engaged": true} or {"engaged": false}. A kill switch engaged by the configuration can't
+// be released through the admin API.
+func (a *Forklift) serveKillSwitch(rw http.ResponseWriter, req *http.Request) {
+	k := a.killSwitch
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		var body struct {
+			Engaged *bool `json:"engaged"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrafficRequestSize)).Decode(&body); err != nil {
+			http.Error(rw, "Malformed JSON", http.StatusBadRequest)
+			return
+		}
+		if body.Engaged == nil {
+			http.Error(rw, fmt.Sprintf("%v: engaged is required", errKillSwitchRequest), http.StatusBadRequest)
+			return
+		}
+		if err := k.switchTo(req.Context(), *body.Engaged); err != nil {
+			a.logger.Errorf("Error writing kill switch %s: %v", k.key, err)
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		action := "kill_switch_release"
+		if *body.Engaged {
+			action = "kill_switch_engage"
+		}
+		a.audit(req, adminAuditEntry{Action: action})
+	default:
+		rw.Header().Set("Allow", "GET, PUT")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, http.StatusOK, k.state())
+}
+
+// gaugeValue returns 1 for true and 0 for false.
+func gaugeValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
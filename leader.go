@@ -0,0 +1,207 @@
+package forklift
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/store"
+)
+
+var errInvalidLeaderElection = errors.New("invalid leader election")
+
+const (
+	defaultLeaseDuration = 15 * time.Second
+	leaderKeyPrefix      = "forklift:leader:"
+	// canaryStateSuffix is appended to the lease key for the key the leader publishes the steps
+	// of its canaries under.
+	canaryStateSuffix = ":canaries"
+)
+
+// leaderElection elects one of the instances sharing the session store to advance canary
+// analyses. The leader holds a lease in the store, and publishes the steps of its canaries there
+// after each analysis; the other instances apply the published steps instead of analyzing, so all
+// instances serve the same percentages and a new leader carries on where the last one stopped.
+type leaderElection struct {
+	store  store.SessionStore
+	leaser store.Leaser
+	key    string
+	holder string
+	lease  time.Duration
+	// ttl is how long the published canary steps are kept, the TTL of session assignments.
+	ttl     time.Duration
+	leading atomic.Bool
+	gauge   *metrics.GaugeVec
+	logger  logger.Logger
+}
+
+// canaryState is the published progress of a canary.
+type canaryState struct {
+	Variant string `json:"variant"`
+	Step    int    `json:"step"`
+	State   string `json:"state"`
+}
+
+// newLeaderElection returns nil when leader election is not configured.
+func newLeaderElection(cfg *config.Config, name string, sessionStore store.SessionStore, opts store.Options,
+	logger logger.Logger, registry *metrics.Registry,
+) (*leaderElection, error) {
+	election := cfg.LeaderElection
+	if election == nil {
+		return nil, nil
+	}
+	if sessionStore == nil {
+		return nil, fmt.Errorf("%w: requires a session store", errInvalidLeaderElection)
+	}
+	leaser, ok := sessionStore.(store.Leaser)
+	if !ok {
+		return nil, fmt.Errorf("%w: session store %s can't hold leases", errInvalidLeaderElection, cfg.SessionStore.Type)
+	}
+	lease := defaultLeaseDuration
+	if election.LeaseDuration != "" {
+		var err error
+		if lease, err = time.ParseDuration(election.LeaseDuration); err != nil || lease <= 0 {
+			return nil, fmt.Errorf("%w: lease duration %s", errInvalidLeaderElection, election.LeaseDuration)
+		}
+	}
+	key := election.Key
+	if key == "" {
+		key = leaderKeyPrefix + name
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "forklift"
+	}
+	suffix := make([]byte, 4)
+	_, _ = rand.Read(suffix)
+
+	return &leaderElection{
+		store:  sessionStore,
+		leaser: leaser,
+		key:    key,
+		holder: host + "-" + hex.EncodeToString(suffix),
+		lease:  lease,
+		ttl:    opts.TTL,
+		gauge: registry.Gauge("forklift_leader",
+			"Whether this instance is the leader advancing canary analyses: 1 or 0."),
+		logger: logger,
+	}, nil
+}
+
+// electLeader campaigns for the lease every third of its duration until the middleware shuts
+// down.
+func (a *Forklift) electLeader() {
+	go func() {
+		ticker := time.NewTicker(a.leader.lease / 3)
+		defer ticker.Stop()
+		for {
+			a.campaign()
+			select {
+			case <-ticker.C:
+			case <-a.lifecycle.done:
+				return
+			}
+		}
+	}()
+}
+
+// campaign takes or renews the lease. Instances that don't hold it, or just took it over, apply
+// the canary steps the leader published. An instance that fails to renew its lease steps down, as
+// the lease may expire before the store is reachable again.
+func (a *Forklift) campaign() {
+	l := a.leader
+	if a.lifecycle.closing.Load() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.lease/3)
+	defer cancel()
+
+	leading, err := l.leaser.Lease(ctx, l.key, l.holder, l.lease)
+	if err != nil {
+		a.logger.Errorf("Error renewing leader lease %s: %v", l.key, err)
+		leading = false
+	}
+	was := l.leading.Load()
+	if !leading || !was {
+		a.syncCanaries(ctx)
+	}
+	if leading == was {
+		return
+	}
+	l.leading.Store(leading)
+	if leading {
+		l.gauge.Set(1)
+		a.logger.Infof("Instance %s is now the leader of %s", l.holder, l.key)
+	} else {
+		l.gauge.Set(0)
+		a.logger.Infof("Instance %s is no longer the leader of %s", l.holder, l.key)
+	}
+}
+
+// release gives up the lease on shutdown, so another instance takes over without waiting for it
+// to expire.
+func (l *leaderElection) release(ctx context.Context) error {
+	if !l.leading.Swap(false) {
+		return nil
+	}
+	l.gauge.Set(0)
+	if err := l.leaser.Release(ctx, l.key, l.holder); err != nil {
+		return fmt.Errorf("releasing leader lease %s: %w", l.key, err)
+	}
+	return nil
+}
+
+// syncCanaries applies the canary steps the leader published.
+func (a *Forklift) syncCanaries(ctx context.Context) {
+	if a.canary == nil {
+		return
+	}
+	value, found, err := a.leader.store.Get(ctx, a.leader.key+canaryStateSuffix)
+	if err != nil {
+		a.logger.Errorf("Error reading canary steps: %v", err)
+		return
+	}
+	if !found {
+		return
+	}
+	var states map[string]canaryState
+	if err := json.Unmarshal([]byte(value), &states); err != nil {
+		a.logger.Errorf("Error reading canary steps: %v", err)
+		return
+	}
+
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	if !a.canary.adopt(states) {
+		return
+	}
+	if err := a.applyRules(a.source.rules); err != nil {
+		a.logger.Errorf("Error applying canary steps: %v", err)
+	}
+}
+
+// publishCanaries writes the steps of the canaries for the other instances.
+func (a *Forklift) publishCanaries(ctx context.Context) {
+	a.source.mu.Lock()
+	value, err := json.Marshal(a.canary.states())
+	a.source.mu.Unlock()
+	if err != nil {
+		a.logger.Errorf("Error publishing canary steps: %v", err)
+		return
+	}
+
+	err = a.leader.store.Set(ctx, a.leader.key+canaryStateSuffix, string(value), a.leader.ttl)
+	if err != nil {
+		a.logger.Errorf("Error publishing canary steps: %v", err)
+	}
+}
@@ -40,3 +40,37 @@ func (s *simpleLogger) Warnf(format string, args ...interface{}) {
 func (s *simpleLogger) Errorf(format string, args ...interface{}) {
 	s.logger.Printf("ERROR: "+format, args...)
 }
+
+// WithRequestID returns a logger that prefixes messages with the ID of the request they are
+// about, or l itself if the ID is empty.
+func WithRequestID(l Logger, requestID string) Logger {
+	if requestID == "" {
+		return l
+	}
+	return &requestLogger{logger: l, requestID: requestID}
+}
+
+type requestLogger struct {
+	logger    Logger
+	requestID string
+}
+
+func (r *requestLogger) args(args []interface{}) []interface{} {
+	return append([]interface{}{r.requestID}, args...)
+}
+
+func (r *requestLogger) Debugf(format string, args ...interface{}) {
+	r.logger.Debugf("request_id=%s "+format, r.args(args)...)
+}
+
+func (r *requestLogger) Infof(format string, args ...interface{}) {
+	r.logger.Infof("request_id=%s "+format, r.args(args)...)
+}
+
+func (r *requestLogger) Warnf(format string, args ...interface{}) {
+	r.logger.Warnf("request_id=%s "+format, r.args(args)...)
+}
+
+func (r *requestLogger) Errorf(format string, args ...interface{}) {
+	r.logger.Errorf("request_id=%s "+format, r.args(args)...)
+}
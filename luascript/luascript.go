@@ -0,0 +1,330 @@
+// Package luascript runs the Lua script configured with the script setting, with gopher-lua. It
+// registers itself with the middleware when imported, as the standalone proxy does; the
+// middleware loaded as a Traefik plugin doesn't import it, as Yaegi can't interpret gopher-lua.
+package luascript
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+var errInvalidScript = errors.New("invalid script")
+
+// Functions a script may define to hook into request handling.
+const (
+	scriptIdentity = "identity"
+	scriptHeaders  = "headers"
+	scriptMatch    = "match"
+)
+
+const (
+	defaultScriptTimeout = 10 * time.Millisecond
+	// scriptCallStackSize bounds the depth of the script's calls, so runaway recursion fails.
+	scriptCallStackSize = 200
+	// maxScriptStringLength bounds the strings scripts build with string.rep.
+	maxScriptStringLength = 1 << 20
+)
+
+func init() {
+	forklift.RegisterScriptLoader(load)
+}
+
+// scriptGlobals are the globals of gopher-lua's basic library removed from script states, as they
+// reach outside the script, load code or print to the standard output.
+var scriptGlobals = []string{
+	"collectgarbage", "dofile", "load", "loadfile", "loadstring", "module", "newproxy", "print",
+	"require", "_printregs",
+}
+
+// scriptHooks runs the functions of the configured Lua script with gopher-lua. A script failing,
+// or running out of time, is logged and counted, and the request is handled as if the function
+// wasn't defined. It is shared by the middleware and the copies created for each rule change.
+type scriptHooks struct {
+	proto     *lua.FunctionProto
+	timeout   time.Duration
+	functions map[string]bool
+	errors    *metrics.CounterVec
+	logger    logger.Logger
+}
+
+// load compiles the script and checks the functions it defines.
+func load(s *config.Script, logger logger.Logger, registry *metrics.Registry) (forklift.ScriptEngine, error) {
+	if (s.Source == "") == (s.File == "") {
+		return nil, fmt.Errorf("%w: one of source or file is required", errInvalidScript)
+	}
+	h := &scriptHooks{
+		timeout:   defaultScriptTimeout,
+		functions: make(map[string]bool),
+		errors: registry.Counter("forklift_script_errors_total",
+			"Number of failed script calls by function.", "function"),
+		logger: logger,
+	}
+	if s.Timeout != "" {
+		timeout, err := time.ParseDuration(s.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("%w: timeout %s", errInvalidScript, s.Timeout)
+		}
+		h.timeout = timeout
+	}
+	source, name := s.Source, "script"
+	if s.File != "" {
+		data, err := os.ReadFile(s.File)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errInvalidScript, err)
+		}
+		source, name = string(data), s.File
+	}
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidScript, err)
+	}
+	if h.proto, err = lua.Compile(chunk, name); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidScript, err)
+	}
+
+	// Loading the script once finds the functions it defines.
+	state, err := h.load()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidScript, err)
+	}
+	defer state.Close()
+	for _, function := range []string{scriptIdentity, scriptHeaders, scriptMatch} {
+		h.functions[function] = state.GetGlobal(function).Type() == lua.LTFunction
+	}
+	if !h.defines(scriptIdentity) && !h.defines(scriptHeaders) && !h.defines(scriptMatch) {
+		return nil, fmt.Errorf("%w: %s defines none of the functions identity, headers or match", errInvalidScript, name)
+	}
+	return h, nil
+}
+
+// defines reports whether the script defines a global function.
+func (h *scriptHooks) defines(function string) bool {
+	return h != nil && h.functions[function]
+}
+
+// load runs the script in a fresh state with the basic, string, table and math libraries.
+func (h *scriptHooks) load() (*lua.LState, error) {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: scriptCallStackSize, MinimizeStackMemory: true})
+	for name, open := range map[string]lua.LGFunction{
+		lua.BaseLibName:   lua.OpenBase,
+		lua.StringLibName: lua.OpenString,
+		lua.TabLibName:    lua.OpenTable,
+		lua.MathLibName:   lua.OpenMath,
+	} {
+		state.Push(state.NewFunction(open))
+		state.Push(lua.LString(name))
+		state.Call(1, 0)
+	}
+	for _, name := range scriptGlobals {
+		state.SetGlobal(name, lua.LNil)
+	}
+	if str, ok := state.GetGlobal(lua.StringLibName).(*lua.LTable); ok {
+		str.RawSetString("rep", state.NewFunction(scriptStringRep))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	state.SetContext(ctx)
+	defer state.RemoveContext()
+	state.Push(state.NewFunctionFromProto(h.proto))
+	if err := state.PCall(0, 0, nil); err != nil {
+		state.Close()
+		return nil, err
+	}
+	return state, nil
+}
+
+// scriptStringRep is string.rep, failing for results longer than maxScriptStringLength.
+func scriptStringRep(state *lua.LState) int {
+	str := state.CheckString(1)
+	n := state.CheckInt(2)
+	if n > 0 && len(str) > maxScriptStringLength/n {
+		state.RaiseError("resulting string too large")
+		return 0
+	}
+	if n < 0 {
+		n = 0
+	}
+	state.Push(lua.LString(strings.Repeat(str, n)))
+	return 1
+}
+
+// scriptRun is the script state of a request, created on its first call so that the calls of a
+// request share one state.
+type scriptRun struct {
+	state   *lua.LState
+	request *lua.LTable
+}
+
+// run returns the script state of the request, loading the script on the first call, or false if
+// it failed to load.
+func (h *scriptHooks) run(run **scriptRun, req *http.Request, function string) (*scriptRun, bool) {
+	if *run == nil {
+		state, err := h.load()
+		if err != nil {
+			h.failed(function, err)
+			return nil, false
+		}
+		*run = &scriptRun{state: state, request: scriptRequest(state, req)}
+	}
+	return *run, true
+}
+
+// call calls a function of the script with the request and args, returning its first result, or
+// false if it failed.
+func (h *scriptHooks) call(run *scriptRun, function string, args ...lua.LValue) (lua.LValue, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	state := run.state
+	state.SetContext(ctx)
+	defer state.RemoveContext()
+	err := state.CallByParam(lua.P{Fn: state.GetGlobal(function), NRet: 1, Protect: true}, append([]lua.LValue{run.request}, args...)...)
+	if err != nil {
+		h.failed(function, err)
+		return lua.LNil, false
+	}
+	result := state.Get(-1)
+	state.Pop(1)
+	return result, true
+}
+
+func (h *scriptHooks) failed(function string, err error) {
+	h.errors.Inc(function)
+	// The message of Lua errors has the script's line, without gopher-lua's stack traceback.
+	var luaErr *lua.ApiError
+	if errors.As(err, &luaErr) {
+		err = errors.New(luaErr.Object.String())
+	}
+	h.logger.Errorf("Error running the script's %s function: %v", function, err)
+}
+
+// Identity implements forklift.ScriptEngine.
+func (h *scriptHooks) Identity(req *http.Request) string {
+	if !h.defines(scriptIdentity) {
+		return ""
+	}
+	var run *scriptRun
+	r, ok := h.run(&run, req, scriptIdentity)
+	if !ok {
+		return ""
+	}
+	result, ok := h.call(r, scriptIdentity)
+	if !ok || !lua.LVAsBool(result) {
+		return ""
+	}
+	return result.String()
+}
+
+// Match implements forklift.ScriptEngine. Only false vetoes a rule, and a script failing lets it
+// decide the request.
+func (h *scriptHooks) Match(req *http.Request) func(key string, rule *forklift.RoutingRule) bool {
+	if !h.defines(scriptMatch) {
+		return nil
+	}
+	var run *scriptRun
+	return func(key string, rule *forklift.RoutingRule) bool {
+		r, ok := h.run(&run, req, scriptMatch)
+		if !ok {
+			return true
+		}
+		result, ok := h.call(r, scriptMatch, scriptRule(r.state, key, rule))
+		return !ok || result != lua.LFalse
+	}
+}
+
+// Headers implements forklift.ScriptEngine. Headers the function sets are replaced, and headers it
+// sets to nil removed. Values of repeated headers are joined with commas.
+func (h *scriptHooks) Headers(header http.Header, req *http.Request, backend string) {
+	if !h.defines(scriptHeaders) {
+		return
+	}
+	var run *scriptRun
+	r, ok := h.run(&run, req, scriptHeaders)
+	if !ok {
+		return
+	}
+	table := r.state.NewTable()
+	for name, values := range header {
+		table.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+	if _, ok := h.call(r, scriptHeaders, table, lua.LString(backend)); !ok {
+		return
+	}
+
+	for name, values := range header {
+		value := table.RawGetString(name)
+		if value == lua.LNil {
+			header.Del(name)
+		} else if value == lua.LString(strings.Join(values, ", ")) {
+			table.RawSetString(name, lua.LNil)
+		}
+	}
+	table.ForEach(func(key, value lua.LValue) {
+		name, ok := key.(lua.LString)
+		if !ok {
+			return
+		}
+		switch value.(type) {
+		case lua.LString, lua.LNumber, lua.LBool:
+			header.Set(string(name), value.String())
+		default:
+			h.failed(scriptHeaders, fmt.Errorf("%w: header %s is a %s", errInvalidScript, name, value.Type()))
+		}
+	})
+}
+
+// scriptRequest describes a request to the script: its method, host, path, remoteAddr, and its
+// query, headers and cookies by name. Values of repeated query parameters and headers are the
+// first and the joined values.
+func scriptRequest(state *lua.LState, req *http.Request) *lua.LTable {
+	t := state.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("host", lua.LString(req.Host))
+	t.RawSetString("path", lua.LString(req.URL.Path))
+	t.RawSetString("remoteAddr", lua.LString(req.RemoteAddr))
+	query := state.NewTable()
+	for name, values := range req.URL.Query() {
+		query.RawSetString(name, lua.LString(values[0]))
+	}
+	t.RawSetString("query", query)
+	headers := state.NewTable()
+	for name, values := range req.Header {
+		headers.RawSetString(name, lua.LString(strings.Join(values, ", ")))
+	}
+	t.RawSetString("headers", headers)
+	cookies := state.NewTable()
+	for _, cookie := range req.Cookies() {
+		if cookies.RawGetString(cookie.Name) == lua.LNil {
+			cookies.RawSetString(cookie.Name, lua.LString(cookie.Value))
+		}
+	}
+	t.RawSetString("cookies", cookies)
+	return t
+}
+
+// scriptRule describes a rule to the script's match function.
+func scriptRule(state *lua.LState, key string, rule *forklift.RoutingRule) *lua.LTable {
+	t := state.NewTable()
+	t.RawSetString("key", lua.LString(key))
+	t.RawSetString("path", lua.LString(rule.Path))
+	t.RawSetString("pathPrefix", lua.LString(rule.PathPrefix))
+	t.RawSetString("method", lua.LString(rule.Method))
+	t.RawSetString("backend", lua.LString(rule.Backend))
+	t.RawSetString("experiment", lua.LString(rule.Experiment))
+	t.RawSetString("variant", lua.LString(rule.Variant))
+	t.RawSetString("priority", lua.LNumber(rule.Priority))
+	t.RawSetString("percentage", lua.LNumber(rule.Percentage))
+	return t
+}
@@ -0,0 +1,101 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidMetricsLabels = errors.New("invalid metrics labels")
+
+const (
+	rulePathsKeep = "keep"
+	rulePathsHash = "hash"
+	rulePathsDrop = "drop"
+
+	// otherLabel stands for the rules and variants whose labels are aggregated.
+	otherLabel = "other"
+)
+
+func validateMetricsLabels(labels *config.MetricsLabels) error {
+	if labels == nil {
+		return nil
+	}
+	switch labels.RulePaths {
+	case "", rulePathsKeep, rulePathsHash, rulePathsDrop:
+	default:
+		return fmt.Errorf("%w: rulePaths must be keep, hash or drop, got %q", errInvalidMetricsLabels, labels.RulePaths)
+	}
+	if labels.MaxRules < 0 {
+		return fmt.Errorf("%w: maxRules must not be negative", errInvalidMetricsLabels)
+	}
+	if labels.MinVariantPercentage < 0 || labels.MinVariantPercentage > 100 {
+		return fmt.Errorf("%w: minVariantPercentage: %w", errInvalidMetricsLabels, errInvalidPercentage)
+	}
+	return nil
+}
+
+// ruleLabels returns the metric label of each rule, or nil if labels are not limited. Rules must
+// already be sorted, so the rules labelled "other" past maxRules are the ones of lowest priority.
+func ruleLabels(rules []RoutingRule, labels *config.MetricsLabels) map[*RoutingRule]string {
+	if labels == nil {
+		return nil
+	}
+	keys := make(map[*RoutingRule]string, len(rules))
+	for i := range rules {
+		if labels.MaxRules > 0 && i >= labels.MaxRules {
+			keys[&rules[i]] = otherLabel
+			continue
+		}
+		keys[&rules[i]] = metricRuleLabel(&rules[i], labels)
+	}
+	return keys
+}
+
+// metricRuleLabel returns the label of a rule with its path hashed or dropped, and its variant
+// aggregated if its percentage is too low.
+func metricRuleLabel(rule *RoutingRule, labels *config.MetricsLabels) string {
+	if rule.Experiment != "" && rule.Variant != "" {
+		return rule.Experiment + "/" + metricVariant(labels, rule, rule.Variant)
+	}
+	if labels.RulePaths == "" || labels.RulePaths == rulePathsKeep {
+		return config.RuleKey(*rule)
+	}
+	path := "*"
+	if labels.RulePaths == rulePathsHash {
+		path = rule.Path
+		if path == "" {
+			path = rule.PathPrefix + "*"
+		}
+		path = strconv.FormatUint(fnv64String(fnvOffset64, path), 16)
+	}
+	method := rule.Method
+	if method == "" {
+		method = "*"
+	}
+	return method + " " + path + " -> " + rule.Backend
+}
+
+// metricVariant returns the label of a variant of a rule: "other" for the rules of the smallest
+// percentages, whose variants are aggregated.
+func metricVariant(labels *config.MetricsLabels, rule *RoutingRule, variant string) string {
+	if labels != nil && rule.Percentage > 0 && rule.Percentage < labels.MinVariantPercentage {
+		return otherLabel
+	}
+	return variant
+}
+
+// ruleLabel returns the label of a rule in metrics, which is its key unless labels are limited.
+// Rules created at runtime, such as the response of an unavailable flag provider, aren't in the
+// precomputed labels nor counted against maxRules.
+func (a *Forklift) ruleLabel(rule *RoutingRule) string {
+	if a.config.MetricsLabels == nil {
+		return a.ruleKey(rule)
+	}
+	if label, ok := a.ruleLabels[rule]; ok {
+		return label
+	}
+	return metricRuleLabel(rule, a.config.MetricsLabels)
+}
@@ -0,0 +1,392 @@
+// Package metrics provides counters and gauges for the Forklift middleware, rendered in the
+// Prometheus text exposition format, or in OpenMetrics with the exemplars of histograms. Updates
+// take no locks: the values of each label set are found in a sync.Map and changed with atomic
+// operations, so concurrent requests only contend when they update the same value at the same
+// time.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const labelSeparator = "\xff"
+
+const (
+	textContentType        = "text/plain; version=0.0.4; charset=utf-8"
+	openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of latency histograms.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Registry holds the metrics of a middleware instance.
+type Registry struct {
+	mu     sync.Mutex
+	series []metric
+}
+
+// metric is a metric family that can be rendered, in OpenMetrics or the text format.
+type metric interface {
+	writeTo(w io.Writer, openMetrics bool) (int64, error)
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// series holds the values of a metric partitioned by label values.
+type series struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	// values holds the *atomicFloat of each label set.
+	values sync.Map
+}
+
+// atomicFloat is a float64 updated atomically through its bits.
+type atomicFloat struct {
+	bits atomic.Uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(f.bits.Load())
+}
+
+func (f *atomicFloat) store(value float64) {
+	f.bits.Store(math.Float64bits(value))
+}
+
+func (f *atomicFloat) add(value float64) {
+	for {
+		old := f.bits.Load()
+		if f.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+value)) {
+			return
+		}
+	}
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	series
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	series
+}
+
+func (r *Registry) register(s metric) {
+	r.mu.Lock()
+	r.series = append(r.series, s)
+	r.mu.Unlock()
+}
+
+// Counter registers a new counter with the given label names.
+func (r *Registry) Counter(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{series{
+		name:       name,
+		help:       help,
+		kind:       "counter",
+		labelNames: labelNames,
+	}}
+	r.register(&c.series)
+	return c
+}
+
+// Gauge registers a new gauge with the given label names.
+func (r *Registry) Gauge(name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{series{
+		name:       name,
+		help:       help,
+		kind:       "gauge",
+		labelNames: labelNames,
+	}}
+	r.register(&g.series)
+	return g
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+
+	// values holds the *histogram of each label set.
+	values sync.Map
+}
+
+// histogram holds the number of observations in each bucket, their sum and their count. Bucket
+// counts are not cumulative, so a histogram read while it's observed never has a bucket counting
+// more than the next; the count is incremented before the bucket, so it never counts fewer
+// observations than the buckets. exemplars holds the last *exemplar of each bucket, the last one
+// being the +Inf bucket.
+type histogram struct {
+	counts    []atomic.Uint64
+	sum       atomicFloat
+	count     atomic.Uint64
+	exemplars []atomic.Value
+}
+
+// exemplar is an observation of a histogram made while serving a traced request.
+type exemplar struct {
+	traceID string
+	value   float64
+	time    time.Time
+}
+
+// Histogram registers a new histogram with the given bucket upper bounds, in increasing order,
+// and label names.
+func (r *Registry) Histogram(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    buckets,
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds an observation to the histogram for the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.observe(value, labelValues)
+}
+
+// ObserveWithExemplar adds an observation made while serving the trace with the given ID, which
+// becomes the exemplar of its bucket in OpenMetrics. Observations without a trace ID keep the
+// previous exemplar.
+func (h *HistogramVec) ObserveWithExemplar(value float64, traceID string, labelValues ...string) {
+	v, bucket := h.observe(value, labelValues)
+	if traceID != "" {
+		v.exemplars[bucket].Store(&exemplar{traceID: traceID, value: value, time: time.Now()})
+	}
+}
+
+// observe adds an observation and returns the histogram of the label values and the bucket it
+// fell in, len(h.buckets) for +Inf.
+func (h *HistogramVec) observe(value float64, labelValues []string) (*histogram, int) {
+	key := strings.Join(labelValues, labelSeparator)
+	cell, ok := h.values.Load(key)
+	if !ok {
+		cell, _ = h.values.LoadOrStore(key, &histogram{
+			counts:    make([]atomic.Uint64, len(h.buckets)),
+			exemplars: make([]atomic.Value, len(h.buckets)+1),
+		})
+	}
+	v := cell.(*histogram)
+	v.count.Add(1)
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		v.counts[i].Add(1)
+	}
+	v.sum.add(value)
+	return v, i
+}
+
+func (h *HistogramVec) writeTo(w io.Writer, openMetrics bool) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", h.name, escapeHelp(h.help, openMetrics), h.name)
+	for _, key := range sortedKeys(&h.values) {
+		cell, _ := h.values.Load(key)
+		v := cell.(*histogram)
+		labels := formatLabels(h.labelNames, key)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.counts[i].Load()
+			fmt.Fprintf(&b, "%s_bucket%s %d", h.name, withLabel(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+			writeExemplar(&b, v, i, openMetrics)
+		}
+		count := v.count.Load()
+		fmt.Fprintf(&b, "%s_bucket%s %d", h.name, withLabel(labels, "le", "+Inf"), count)
+		writeExemplar(&b, v, len(h.buckets), openMetrics)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", h.name, labels, strconv.FormatFloat(v.sum.load(), 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count%s %d\n", h.name, labels, count)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// writeExemplar ends the line of a bucket, with its exemplar in OpenMetrics.
+func writeExemplar(b *strings.Builder, v *histogram, bucket int, openMetrics bool) {
+	if e, ok := v.exemplars[bucket].Load().(*exemplar); ok && openMetrics {
+		fmt.Fprintf(b, ` # {trace_id="%s"} %s %s`, escapeLabelValue(e.traceID),
+			strconv.FormatFloat(e.value, 'g', -1, 64), strconv.FormatFloat(float64(e.time.UnixMilli())/1000, 'f', 3, 64))
+	}
+	b.WriteByte('\n')
+}
+
+// withLabel adds a label to a formatted label set.
+func withLabel(labels, name, value string) string {
+	pair := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+// Inc increments the counter for the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter for the given label values by value.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.add(value, labelValues)
+}
+
+// Set sets the gauge for the given label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.value(labelValues).store(value)
+}
+
+// Add adds value, which may be negative, to the gauge for the given label values.
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.add(value, labelValues)
+}
+
+func (s *series) add(value float64, labelValues []string) {
+	s.value(labelValues).add(value)
+}
+
+// value returns the value of the label values, adding it on first use.
+func (s *series) value(labelValues []string) *atomicFloat {
+	key := strings.Join(labelValues, labelSeparator)
+	cell, ok := s.values.Load(key)
+	if !ok {
+		cell, _ = s.values.LoadOrStore(key, &atomicFloat{})
+	}
+	return cell.(*atomicFloat)
+}
+
+// Value returns the current value for the given label values.
+func (s *series) Value(labelValues ...string) float64 {
+	cell, ok := s.values.Load(strings.Join(labelValues, labelSeparator))
+	if !ok {
+		return 0
+	}
+	return cell.(*atomicFloat).load()
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	return r.write(w, false)
+}
+
+// WriteOpenMetrics writes all metrics in the OpenMetrics text format, with the exemplars of
+// histograms.
+func (r *Registry) WriteOpenMetrics(w io.Writer) (int64, error) {
+	written, err := r.write(w, true)
+	if err != nil {
+		return written, err
+	}
+	n, err := io.WriteString(w, "# EOF\n")
+	return written + int64(n), err
+}
+
+func (r *Registry) write(w io.Writer, openMetrics bool) (int64, error) {
+	r.mu.Lock()
+	all := append([]metric(nil), r.series...)
+	r.mu.Unlock()
+
+	var written int64
+	for _, s := range all {
+		n, err := s.writeTo(w, openMetrics)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ServeHTTP serves the metrics in OpenMetrics to scrapers accepting it, such as Prometheus with
+// exemplar storage enabled, and in the Prometheus text exposition format otherwise.
+func (r *Registry) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req != nil && strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text") {
+		rw.Header().Set("Content-Type", openMetricsContentType)
+		_, _ = r.WriteOpenMetrics(rw)
+		return
+	}
+	rw.Header().Set("Content-Type", textContentType)
+	_, _ = r.WriteTo(rw)
+}
+
+func (s *series) writeTo(w io.Writer, openMetrics bool) (int64, error) {
+	var b strings.Builder
+	family, sample := s.name, s.name
+	if openMetrics && s.kind == "counter" {
+		// OpenMetrics names counter families without the suffix their samples must have.
+		family = strings.TrimSuffix(s.name, "_total")
+		sample = family + "_total"
+	}
+	fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family, escapeHelp(s.help, openMetrics), family, s.kind)
+	for _, key := range sortedKeys(&s.values) {
+		cell, _ := s.values.Load(key)
+		b.WriteString(sample)
+		b.WriteString(formatLabels(s.labelNames, key))
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(cell.(*atomicFloat).load(), 'g', -1, 64))
+		b.WriteByte('\n')
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// sortedKeys returns the label sets of values, sorted.
+func sortedKeys(values *sync.Map) []string {
+	var keys []string
+	values.Range(func(key, _ interface{}) bool {
+		keys = append(keys, key.(string))
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names []string, key string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	values := strings.Split(key, labelSeparator)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = name + `="` + escapeLabelValue(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// helpEscaper escapes HELP text in the Prometheus text format, which unlike OpenMetrics keeps
+// double quotes as they are.
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(help string, openMetrics bool) string {
+	if openMetrics {
+		return labelValueEscaper.Replace(help)
+	}
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
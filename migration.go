@@ -0,0 +1,166 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/store"
+)
+
+const migrateToDefault = "default"
+
+var errInvalidMigration = errors.New("invalid onEnd migration: migrateTo must be another variant of the experiment or default")
+
+// validateMigrations checks that migrations target the default backend or another variant of the
+// same experiment.
+func validateMigrations(rules []RoutingRule) error {
+	for _, rule := range rules {
+		if rule.OnEnd == nil {
+			continue
+		}
+		target := rule.OnEnd.MigrateTo
+		if rule.Experiment == "" || target == "" || target == rule.Variant {
+			return fmt.Errorf("%w: %s", errInvalidMigration, target)
+		}
+		if target == migrateToDefault {
+			continue
+		}
+		found := false
+		for _, other := range rules {
+			if other.Experiment == rule.Experiment && other.Variant == target {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%w: %s", errInvalidMigration, target)
+		}
+	}
+	return nil
+}
+
+// migrator routes sessions assigned to an ended variant, that is a paused rule with an onEnd
+// migration, to the migration target and reports each migrated session once.
+type migrator struct {
+	// rules holds the rules with a migration in priority order, and groups holds, per rule
+	// with a migration, the rules of its experiment on the same path, including paused ones,
+	// in priority order.
+	rules  []*RoutingRule
+	groups map[*RoutingRule][]*RoutingRule
+	marks  store.SessionStore
+	ttl    time.Duration
+
+	migrations *metrics.CounterVec
+}
+
+// newMigrator returns nil when no rule declares a migration. Migrated sessions are marked in the
+// session store if there is one, otherwise in memory, in which case each instance reports them.
+func newMigrator(rules []RoutingRule, sessionStore store.SessionStore, opts store.Options, migrations *metrics.CounterVec) *migrator {
+	var migrating []*RoutingRule
+	groups := make(map[*RoutingRule][]*RoutingRule)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.OnEnd == nil {
+			continue
+		}
+		migrating = append(migrating, rule)
+		for j := range rules {
+			other := &rules[j]
+			if other.Experiment == rule.Experiment && rulePathKey(other) == rulePathKey(rule) {
+				groups[rule] = append(groups[rule], other)
+			}
+		}
+	}
+	if len(migrating) == 0 {
+		return nil
+	}
+
+	marks, ttl := sessionStore, opts.TTL
+	if marks == nil {
+		// Marks live as long as the session cookie.
+		marks, ttl = store.NewMemoryStore(), sessionCookieMaxAge*time.Second
+	}
+	return &migrator{
+		rules:  migrating,
+		groups: groups,
+		marks:  marks,
+		ttl:    ttl,
+
+		migrations: migrations,
+	}
+}
+
+// endedRules returns the paused rules with a migration that match the request.
+func (a *Forklift) endedRules(req *http.Request, ended []*RoutingRule) []*RoutingRule {
+	for _, rule := range a.migrator.rules {
+		if rule.Paused && a.matchRule(req, rule) {
+			ended = append(ended, rule)
+		}
+	}
+	return ended
+}
+
+// migrateSession returns the migration target if the session was assigned to one of the ended
+// rules. A session was assigned to an ended rule if the session store says so or, without a
+// stored assignment, if the rule's split would assign it there with all variants active.
+func (a *Forklift) migrateSession(req *http.Request, sessionID string, ended []*RoutingRule) (SelectedBackend, bool) {
+	for _, rule := range ended {
+		group := a.migrator.groups[rule]
+		from := backendKey(*rule)
+		if a.previousAssignment(sessionID, group) != from {
+			continue
+		}
+
+		selected := SelectedBackend{Backend: a.config.DefaultBackend, Reason: reasonMigration}
+		for _, target := range group {
+			if target.Variant == rule.OnEnd.MigrateTo && !target.Paused && a.drainAdmits(req, target) {
+				selected = SelectedBackend{Backend: backendKey(*target), Rule: target, Reason: reasonMigration}
+				break
+			}
+		}
+		a.recordMigration(req, sessionID, rule, selected)
+		return selected, true
+	}
+	return SelectedBackend{}, false
+}
+
+func (a *Forklift) previousAssignment(sessionID string, group []*RoutingRule) string {
+	if a.sessionStore != nil {
+		backend, found, _ := a.storedAssignment(context.Background(), a.assignmentKey(sessionID, rulePathKey(group[0])))
+		if found {
+			return backend
+		}
+	}
+	shares := a.calculateBackendPercentages(group, "", nil)
+	return a.selectBackendByPercentageAndRuleHash(sessionID, shares, group)
+}
+
+// recordMigration reports a migrated session the first time it is migrated. With a session store
+// the assignment is moved to the target, so later requests no longer see the ended variant.
+func (a *Forklift) recordMigration(req *http.Request, sessionID string, rule *RoutingRule, selected SelectedBackend) {
+	ctx := context.Background()
+	path := rulePathKey(rule)
+	if a.sessionStore != nil && selected.Rule != nil {
+		a.saveAssignment(ctx, a.assignmentKey(sessionID, path), selected.Backend)
+	}
+
+	key := "forklift:migrated:" + a.scrubber.identity(sessionID) + ":" + path
+	if _, found, err := a.migrator.marks.Get(ctx, key); found || err != nil {
+		return
+	}
+	if err := a.migrator.marks.Set(ctx, key, selected.Backend, a.migrator.ttl); err != nil {
+		a.requestLogger(req).Errorf("Error storing session migration: %v", err)
+	}
+
+	to := migrateToDefault
+	if selected.Rule != nil {
+		to = selected.Rule.Variant
+	}
+	a.migrator.migrations.Inc(rule.Experiment, rule.Variant, to)
+	a.requestLogger(req).Infof("Migration: experiment=%s from=%s to=%s backend=%s session=%s path=%s",
+		rule.Experiment, rule.Variant, to, selected.Backend, a.scrubber.identity(sessionID), path)
+}
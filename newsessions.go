@@ -0,0 +1,99 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	firstSeenCookieName     = "forklift_first_seen"
+	defaultNewSessionWindow = 30 * time.Minute
+)
+
+var errInvalidNewSessionWindow = errors.New("invalid new session window: must be a positive duration")
+
+// validateNewSessionWindows checks the new session window of every rule that targets new sessions.
+func validateNewSessionWindows(rules []RoutingRule) error {
+	for _, rule := range rules {
+		if !rule.NewSessionsOnly || rule.NewSessionWindow == "" {
+			continue
+		}
+		if window, err := time.ParseDuration(rule.NewSessionWindow); err != nil || window <= 0 {
+			return fmt.Errorf("%w: %s", errInvalidNewSessionWindow, rule.NewSessionWindow)
+		}
+	}
+	return nil
+}
+
+// newSessionWindows parses the new session window of every rule that targets new sessions,
+// so it is not parsed on each request. Invalid windows fall back to the default.
+func newSessionWindows(rules []RoutingRule) map[*RoutingRule]time.Duration {
+	windows := make(map[*RoutingRule]time.Duration)
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.NewSessionsOnly {
+			continue
+		}
+		window, err := time.ParseDuration(rule.NewSessionWindow)
+		if err != nil || window <= 0 {
+			window = defaultNewSessionWindow
+		}
+		windows[rule] = window
+	}
+	return windows
+}
+
+// matchNewSession checks that the session is new when the rule targets new sessions only.
+// A session is new on the request that creates it and until its first-seen time is older
+// than the rule's window. Sessions created before first-seen tracking count as returning.
+func (re *RuleEngine) matchNewSession(req *http.Request, rule *RoutingRule) bool {
+	if !rule.NewSessionsOnly {
+		return true
+	}
+
+	firstSeen, ok := sessionFirstSeen(req)
+	if !ok {
+		cookie, err := req.Cookie(sessionCookieName)
+		isNew := err != nil || !isValidSessionID(cookie.Value)
+		if re.config.Debug {
+			re.logger.Debugf("No first-seen time for session, new session: %v", isNew)
+		}
+		return isNew
+	}
+
+	age := re.now().Sub(firstSeen)
+	isNew := age <= re.newSessionWindows[rule]
+	if re.config.Debug {
+		re.logger.Debugf("Session first seen %s ago, new session: %v", age, isNew)
+	}
+	return isNew
+}
+
+// sessionFirstSeen returns the time the session was first seen, if the request carries it.
+func sessionFirstSeen(req *http.Request) (time.Time, bool) {
+	cookie, err := req.Cookie(firstSeenCookieName)
+	if err != nil {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(cookie.Value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0), true
+}
+
+// setFirstSeenCookie records when a new session was first seen.
+func setFirstSeenCookie(rw http.ResponseWriter, req *http.Request, now time.Time) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     firstSeenCookieName,
+		Value:    strconv.FormatInt(now.Unix(), 10),
+		Path:     "/",
+		MaxAge:   sessionCookieMaxAge,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
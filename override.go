@@ -0,0 +1,125 @@
+package forklift
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/store"
+)
+
+var (
+	errInvalidOverride = errors.New("invalid assignment override")
+	errUnknownVariant  = errors.New("unknown variant")
+)
+
+// defaultOverrideTTL is how long an override pins an identity when the request sets no ttl.
+const defaultOverrideTTL = 24 * time.Hour
+
+// assignmentOverride is the body of a request pinning an identity to a variant.
+type assignmentOverride struct {
+	Experiment string `json:"experiment"`
+	Variant    string `json:"variant"`
+	TTL        string `json:"ttl"`
+}
+
+// serveOverride pins an identity to a variant of an experiment on PUT, by writing its assignments
+// to the session store with the override's expiry. Once they expire, the identity is assigned by
+// its hash again.
+func (a *Forklift) serveOverride(rw http.ResponseWriter, req *http.Request, identity string) {
+	if req.Method != http.MethodPut {
+		rw.Header().Set("Allow", "PUT")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.sessionStore == nil {
+		http.Error(rw, "No session store is configured", http.StatusNotImplemented)
+		return
+	}
+
+	var override assignmentOverride
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxTrafficRequestSize)).Decode(&override); err != nil {
+		http.Error(rw, "Malformed JSON", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultOverrideTTL
+	if override.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(override.TTL); err != nil || ttl <= 0 {
+			http.Error(rw, fmt.Sprintf("%v: ttl %q", errInvalidOverride, override.TTL), http.StatusBadRequest)
+			return
+		}
+	}
+	sessionID := a.overrideSessionID(identity)
+	if sessionID == "" || override.Experiment == "" || override.Variant == "" {
+		http.Error(rw, fmt.Sprintf("%v: identity, experiment and variant are required", errInvalidOverride), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := a.overrideEntries(sessionID, override.Experiment, override.Variant)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := a.storeAssignments(req.Context(), entries, ttl); err != nil {
+		a.logger.Errorf("Error storing assignment override: %v", err)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+	expires := a.now().Add(ttl).UTC()
+	a.audit(req, adminAuditEntry{
+		Action:     "override",
+		Session:    a.scrubber.identity(sessionID),
+		Experiment: override.Experiment,
+		Variant:    override.Variant,
+		Expires:    expires.Format(time.RFC3339),
+	})
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"experiment":  override.Experiment,
+		"variant":     override.Variant,
+		"expires":     expires,
+		"assignments": len(entries),
+	})
+}
+
+// overrideSessionID returns the session ID of an identity given as a session ID, or as one of the
+// identity sources and its value, e.g. basic:alice or header:X-API-Key:<key>.
+func (a *Forklift) overrideSessionID(identity string) string {
+	if a.config.Identity != nil {
+		for _, source := range a.config.Identity.Sources {
+			if value, ok := strings.CutPrefix(identity, source+":"); ok && value != "" {
+				return identityHash(source, value)
+			}
+		}
+	}
+	return identity
+}
+
+// overrideEntries returns the assignments pinning the session to the variant on every path of
+// the experiment: the backend of the variant for percentage splits, or the variant for
+// assignment groups.
+func (a *Forklift) overrideEntries(sessionID, experiment, variant string) ([]store.Entry, error) {
+	var entries []store.Entry
+	seen := make(map[string]bool)
+	for i := range a.config.Rules {
+		rule := &a.config.Rules[i]
+		if rule.Experiment != experiment || rule.Variant != variant || rule.Percentage == 0 {
+			continue
+		}
+		key, value := a.assignmentKey(sessionID, rulePathKey(rule)), backendKey(*rule)
+		if rule.AssignmentGroup != "" {
+			key, value = a.assignmentKey(sessionID, assignmentGroupKeyPrefix+rule.AssignmentGroup), rule.Variant
+		}
+		if !seen[key] {
+			seen[key] = true
+			entries = append(entries, store.Entry{Key: key, Value: value})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no percentage split of experiment %s has variant %s", errUnknownVariant, experiment, variant)
+	}
+	return entries, nil
+}
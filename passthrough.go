@@ -0,0 +1,60 @@
+package forklift
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+)
+
+// isInformational reports whether status is a 1xx response that precedes the final one, such as
+// 100 Continue or 103 Early Hints. 101 Switching Protocols is final.
+func isInformational(status int) bool {
+	return status >= http.StatusContinue && status < http.StatusOK && status != http.StatusSwitchingProtocols
+}
+
+// forwardInformational returns a client trace that relays the 1xx responses of a backend to the
+// client. A 100 Continue is only relayed once the backend asks for the body of an
+// Expect: 100-continue request, so backends can still reject uploads before they are sent. The
+// headers of 1xx responses are not kept for the final response.
+func forwardInformational(rw http.ResponseWriter) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			h := rw.Header()
+			previous := make(http.Header, len(header))
+			for key, values := range header {
+				if existing, ok := h[key]; ok {
+					previous[key] = existing
+				}
+				h[key] = values
+			}
+			rw.WriteHeader(code)
+			for key := range header {
+				if existing, ok := previous[key]; ok {
+					h[key] = existing
+				} else {
+					delete(h, key)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// announceTrailers declares the trailers of a backend response before its header is written.
+func announceTrailers(h http.Header, resp *http.Response) {
+	for key := range resp.Trailer {
+		h.Add("Trailer", key)
+	}
+}
+
+// copyTrailers sets the trailers of a backend response once its body was copied. Trailers the
+// backend didn't announce are sent with the TrailerPrefix.
+func copyTrailers(h http.Header, resp *http.Response, announced int) {
+	prefix := ""
+	if len(resp.Trailer) != announced {
+		prefix = http.TrailerPrefix
+	}
+	for key, values := range resp.Trailer {
+		h[prefix+key] = values
+	}
+}
@@ -0,0 +1,123 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidRulePath = errors.New("invalid rule path")
+
+// validateRulePaths checks that the paths and path prefixes of rules are normalized, and
+// lowercase when paths are matched case-insensitively, as they would never match otherwise.
+func validateRulePaths(cfg *config.Config) error {
+	for _, rule := range cfg.Rules {
+		for _, p := range []string{rule.Path, rule.PathPrefix} {
+			if p == "" {
+				continue
+			}
+			if cleanPath(p) != p {
+				return fmt.Errorf("%w: %q is not normalized, use %q", errInvalidRulePath, p, cleanPath(p))
+			}
+			if cfg.PathCaseFolding && strings.ToLower(p) != p {
+				return fmt.Errorf("%w: %q must be lowercase with pathCaseFolding", errInvalidRulePath, p)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizedRequest returns the request rules are matched against, with its path percent-decoded,
+// duplicate slashes collapsed, dot segments removed and, with pathCaseFolding, lowercased.
+// Encoded slashes stay encoded, since backends don't take them as segment separators, so
+// /admin%2F..%2Fcheckout neither matches /checkout nor escapes the rules of /admin. Requests
+// whose path is already normalized are returned as they are; the path forwarded to backends is
+// never changed.
+func (a *Forklift) normalizedRequest(req *http.Request) *http.Request {
+	normalized := normalizePath(req.URL, a.config.PathCaseFolding)
+	if normalized == req.URL.Path && req.URL.RawPath == "" {
+		return req
+	}
+	u := *req.URL
+	u.Path, u.RawPath = normalized, ""
+	r := *req
+	r.URL = &u
+	return &r
+}
+
+// trimPathPrefix returns the escaped rest of the path of u after prefix, and whether the path has
+// the prefix. The prefix is looked for in the normalized path, as rules match it, so //API/users
+// loses /api with pathCaseFolding. The rest keeps its case.
+func (a *Forklift) trimPathPrefix(u *url.URL, prefix string) (string, bool) {
+	p := normalizePath(u, false)
+	if len(p) < len(prefix) {
+		return "", false
+	}
+	head, rest := p[:len(prefix)], p[len(prefix):]
+	if head != prefix && !(a.config.PathCaseFolding && strings.EqualFold(head, prefix)) {
+		return "", false
+	}
+	if u.RawPath == "" {
+		return (&url.URL{Path: rest}).EscapedPath(), true
+	}
+	// The encoded slashes normalizePath kept stay encoded.
+	parts := strings.Split(rest, "%2F")
+	for i, part := range parts {
+		parts[i] = (&url.URL{Path: part}).EscapedPath()
+	}
+	return strings.Join(parts, "%2F"), true
+}
+
+// keepForm gives req the form parsed on its normalized copy for form conditions, as the copy
+// consumed the body.
+func keepForm(req, normalized *http.Request) {
+	if normalized.PostForm != nil {
+		req.Form, req.PostForm, req.MultipartForm = normalized.Form, normalized.PostForm, normalized.MultipartForm
+	}
+}
+
+func normalizePath(u *url.URL, foldCase bool) string {
+	p := u.Path
+	if u.RawPath != "" {
+		p = decodeSegments(u.RawPath)
+	}
+	if strings.Contains(p, "//") || strings.Contains(p, "/.") {
+		p = cleanPath(p)
+	}
+	if foldCase {
+		p = strings.ToLower(p)
+	}
+	return p
+}
+
+// decodeSegments percent-decodes each segment of an escaped path, keeping encoded slashes. Paths
+// with invalid escapes are returned as they are.
+func decodeSegments(raw string) string {
+	segments := strings.Split(raw, "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			return raw
+		}
+		segments[i] = strings.ReplaceAll(decoded, "/", "%2F")
+	}
+	return strings.Join(segments, "/")
+}
+
+// cleanPath collapses the duplicate slashes of a path and removes its dot segments, keeping a
+// trailing slash, which also ends paths whose last segment is a dot segment.
+func cleanPath(p string) string {
+	if p == "" {
+		return p
+	}
+	cleaned := path.Clean("/" + p)
+	if cleaned != "/" && (strings.HasSuffix(p, "/") || strings.HasSuffix(p, "/.") || strings.HasSuffix(p, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
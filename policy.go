@@ -0,0 +1,134 @@
+package forklift
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const defaultCORSMethods = "GET, HEAD, POST"
+
+// isPreflight reports whether the request is a CORS preflight request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// selectionRequest returns the request rules are matched against. Preflight requests are
+// matched as the request they announce, so they find the rule whose CORS policy applies.
+func selectionRequest(req *http.Request) *http.Request {
+	if !isPreflight(req) {
+		return req
+	}
+	announced := req.Clone(req.Context())
+	announced.Method = strings.ToUpper(req.Header.Get("Access-Control-Request-Method"))
+	return announced
+}
+
+// servePreflight answers a CORS preflight request from the rule's policy, since preflight
+// requests carry no cookies and can't be relied on to reach the backend of the session.
+func (a *Forklift) servePreflight(rw http.ResponseWriter, req *http.Request, cors *config.CORSPolicy) {
+	header := rw.Header()
+	if applyCORSOrigin(header, req, cors) {
+		methods := defaultCORSMethods
+		if len(cors.AllowMethods) > 0 {
+			methods = strings.Join(cors.AllowMethods, ", ")
+		}
+		header.Set("Access-Control-Allow-Methods", methods)
+		if len(cors.AllowHeaders) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowHeaders, ", "))
+		}
+		if cors.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+		}
+	}
+	if a.config.Debug {
+		a.logger.Debugf("Answered CORS preflight for origin %s", req.Header.Get("Origin"))
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// applyCORSOrigin sets the origin related CORS headers if the request origin is allowed and
+// reports whether it is.
+func applyCORSOrigin(header http.Header, req *http.Request, cors *config.CORSPolicy) bool {
+	header.Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+
+	allowed := ""
+	for _, candidate := range cors.AllowOrigins {
+		if candidate == "*" {
+			allowed = "*"
+			if cors.AllowCredentials {
+				// Browsers reject a wildcard origin on credentialed requests.
+				allowed = origin
+			}
+			break
+		}
+		if strings.EqualFold(candidate, origin) {
+			allowed = origin
+			break
+		}
+	}
+	if allowed == "" {
+		return false
+	}
+
+	header.Set("Access-Control-Allow-Origin", allowed)
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	return true
+}
+
+// applyResponsePolicy replaces the CORS and security headers of a response with the policy's.
+func applyResponsePolicy(header http.Header, req *http.Request, policy *config.ResponsePolicy) {
+	if policy.CORS != nil {
+		for key := range header {
+			if strings.HasPrefix(key, "Access-Control-") {
+				header.Del(key)
+			}
+		}
+		if applyCORSOrigin(header, req, policy.CORS) && len(policy.CORS.ExposeHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(policy.CORS.ExposeHeaders, ", "))
+		}
+	}
+	if policy.ContentSecurityPolicy != "" {
+		header.Set("Content-Security-Policy", policy.ContentSecurityPolicy)
+	}
+	if policy.StrictTransportSecurity != "" {
+		header.Set("Strict-Transport-Security", policy.StrictTransportSecurity)
+	}
+	for key, value := range policy.Headers {
+		header.Set(key, value)
+	}
+}
+
+// policyWriter applies a response policy to the headers of the wrapped response writer right
+// before they are sent, so the policy overrides whatever the backend returned.
+type policyWriter struct {
+	http.ResponseWriter
+	req         *http.Request
+	policy      *config.ResponsePolicy
+	wroteHeader bool
+}
+
+func (w *policyWriter) WriteHeader(status int) {
+	if !w.wroteHeader && !isInformational(status) {
+		w.wroteHeader = true
+		applyResponsePolicy(w.ResponseWriter.Header(), w.req, w.policy)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *policyWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,41 @@
+package forklift
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidPreload = errors.New("invalid preload: links are required and must start with a <URI>")
+
+// validatePreloads checks the preload links of the rules.
+func validatePreloads(rules []RoutingRule) error {
+	for _, rule := range rules {
+		if rule.Preload == nil {
+			continue
+		}
+		if len(rule.Preload.Links) == 0 {
+			return errInvalidPreload
+		}
+		for _, link := range rule.Preload.Links {
+			if !strings.HasPrefix(link, "<") || !strings.Contains(link, ">") {
+				return errInvalidPreload
+			}
+		}
+	}
+	return nil
+}
+
+// sendPreload adds the preload links to the response and, with early hints, sends them in a 103
+// response right away. The links stay in the header of the final response, before the backend's
+// own.
+func sendPreload(rw http.ResponseWriter, preload *config.Preload) {
+	for _, link := range preload.Links {
+		rw.Header().Add("Link", link)
+	}
+	if preload.EarlyHints {
+		rw.WriteHeader(http.StatusEarlyHints)
+	}
+}
@@ -0,0 +1,302 @@
+package forklift
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errMissingPepper   = errors.New("privacy: hashIdentities requires a pepper")
+	errInvalidIPPrefix = errors.New("privacy: invalid ip prefix")
+)
+
+const (
+	redacted = "REDACTED"
+
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 48
+)
+
+// ipHeaders are the headers carrying client IPs, which are truncated rather than removed.
+var ipHeaders = map[string]bool{
+	"X-Forwarded-For":  true,
+	"X-Real-Ip":        true,
+	"True-Client-Ip":   true,
+	"Cf-Connecting-Ip": true,
+	"Forwarded":        true,
+}
+
+// scrubber removes personal data from the headers, cookies, query parameters and IPs the
+// middleware logs or exports, and hashes the identities it stores or exports, according to the
+// privacy configuration. A nil scrubber leaves everything as is.
+type scrubber struct {
+	denyHeaders map[string]bool
+	cookies     nameSet
+	params      nameSet
+
+	truncateIPs bool
+	ipv4Mask    net.IPMask
+	ipv6Mask    net.IPMask
+
+	// pepper keys the hashes of identities. It is nil unless identities are hashed.
+	pepper []byte
+	// sources are the identity sources of event sinks, "header:<canonical name>" or
+	// "cookie:<name>", whose values are hashed in exports.
+	sources map[string]bool
+}
+
+// nameSet matches the names listed in a privacy setting, or every name if "*" is listed.
+type nameSet struct {
+	all   bool
+	names map[string]bool
+}
+
+func newNameSet(names []string) nameSet {
+	set := nameSet{names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		if name == "*" {
+			set.all = true
+		}
+		set.names[name] = true
+	}
+	return set
+}
+
+func (n nameSet) has(name string) bool {
+	return n.all || n.names[name]
+}
+
+// newScrubber returns the scrubber of the privacy configuration of cfg, or nil if it has none.
+// The configuration must have its secrets resolved.
+func newScrubber(cfg *config.Config) (*scrubber, error) {
+	privacy := cfg.Privacy
+	if privacy == nil {
+		return nil, nil
+	}
+	ipv4Mask, err := ipMask(privacy.IPv4Prefix, defaultIPv4Prefix, 32)
+	if err != nil {
+		return nil, err
+	}
+	ipv6Mask, err := ipMask(privacy.IPv6Prefix, defaultIPv6Prefix, 128)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &scrubber{
+		denyHeaders: make(map[string]bool, len(privacy.DenyHeaders)),
+		cookies:     newNameSet(privacy.RedactCookies),
+		params:      newNameSet(privacy.MaskQueryParams),
+		truncateIPs: privacy.TruncateIPs,
+		ipv4Mask:    ipv4Mask,
+		ipv6Mask:    ipv6Mask,
+	}
+	for _, name := range privacy.DenyHeaders {
+		s.denyHeaders[http.CanonicalHeaderKey(name)] = true
+	}
+	if privacy.HashIdentities {
+		if privacy.Pepper == "" {
+			return nil, errMissingPepper
+		}
+		s.pepper = []byte(privacy.Pepper)
+		s.sources = make(map[string]bool)
+		for _, sink := range cfg.EventSinks {
+			if kind, name, ok := strings.Cut(sink.IDSource, ":"); ok && kind == "header" {
+				s.sources["header:"+http.CanonicalHeaderKey(name)] = true
+			} else if ok {
+				s.sources[sink.IDSource] = true
+			}
+		}
+	}
+	return s, nil
+}
+
+func ipMask(prefix, defaultPrefix, bits int) (net.IPMask, error) {
+	if prefix == 0 {
+		prefix = defaultPrefix
+	}
+	if prefix < 0 || prefix > bits {
+		return nil, fmt.Errorf("%w: /%d", errInvalidIPPrefix, prefix)
+	}
+	return net.CIDRMask(prefix, bits), nil
+}
+
+// identity returns the hash of an identity, such as a session ID, if identities are hashed.
+func (s *scrubber) identity(id string) string {
+	if s == nil || s.pepper == nil || id == "" {
+		return id
+	}
+	mac := hmac.New(sha256.New, s.pepper)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// header returns a copy of h without denied headers and with cookies and IPs scrubbed.
+func (s *scrubber) header(h http.Header) http.Header {
+	if s == nil {
+		return h
+	}
+	scrubbed := make(http.Header, len(h))
+	for key, values := range h {
+		name := http.CanonicalHeaderKey(key)
+		if s.denyHeaders[name] {
+			continue
+		}
+		scrubbedValues := make([]string, len(values))
+		for i, value := range values {
+			scrubbedValues[i] = s.headerValue(name, value)
+		}
+		scrubbed[key] = scrubbedValues
+	}
+	return scrubbed
+}
+
+// headerValue scrubs a value of the header with the canonical name.
+func (s *scrubber) headerValue(name, value string) string {
+	switch {
+	case s == nil:
+		return value
+	case s.denyHeaders[name]:
+		return redacted
+	case name == "Cookie":
+		return s.cookieHeader(value)
+	case name == "Set-Cookie":
+		cookie, attributes, _ := strings.Cut(value, ";")
+		if attributes != "" {
+			attributes = ";" + attributes
+		}
+		return s.cookieHeader(cookie) + attributes
+	case s.truncateIPs && ipHeaders[name]:
+		return s.truncateIPHeader(name, value)
+	}
+	return value
+}
+
+// cookieHeader replaces the values of redacted cookies in a Cookie header.
+func (s *scrubber) cookieHeader(value string) string {
+	pairs := strings.Split(value, ";")
+	for i, pair := range pairs {
+		name, _, found := strings.Cut(pair, "=")
+		if found && s.cookies.has(strings.TrimSpace(name)) {
+			pairs[i] = name + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, ";")
+}
+
+// cookieValue scrubs the value of the named cookie.
+func (s *scrubber) cookieValue(name, value string) string {
+	if s != nil && s.cookies.has(name) {
+		return redacted
+	}
+	return value
+}
+
+// paramValue scrubs the value of the named query parameter. Form fields are masked like query
+// parameters of the same name.
+func (s *scrubber) paramValue(name, value string) string {
+	if s != nil && s.params.has(name) {
+		return redacted
+	}
+	return value
+}
+
+// rawQuery masks the values of parameters in a raw query.
+func (s *scrubber) rawQuery(rawQuery string) string {
+	if s == nil || rawQuery == "" {
+		return rawQuery
+	}
+	pairs := strings.Split(rawQuery, "&")
+	for i, pair := range pairs {
+		key, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(key); err == nil && s.params.has(name) {
+			pairs[i] = key + "=" + redacted
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// request returns a copy of req to export data from, such as the IDs event sinks read. Denied
+// headers and redacted cookies are removed, so they can't end up in exports even as placeholders,
+// and the values of identity sources are hashed.
+func (s *scrubber) request(req *http.Request) *http.Request {
+	if s == nil {
+		return req
+	}
+	scrubbed := req.Clone(req.Context())
+	scrubbed.Header = s.header(req.Header)
+	for source := range s.sources {
+		if name, ok := strings.CutPrefix(source, "header:"); ok && scrubbed.Header.Get(name) != "" {
+			scrubbed.Header.Set(name, s.identity(scrubbed.Header.Get(name)))
+		}
+	}
+	scrubbed.Header.Del("Cookie")
+	if !s.denyHeaders["Cookie"] {
+		for _, cookie := range req.Cookies() {
+			if s.cookies.has(cookie.Name) {
+				continue
+			}
+			if s.sources["cookie:"+cookie.Name] {
+				cookie.Value = s.identity(cookie.Value)
+			}
+			scrubbed.AddCookie(cookie)
+		}
+	}
+	scrubbed.URL.RawQuery = s.rawQuery(req.URL.RawQuery)
+	if s.truncateIPs {
+		scrubbed.RemoteAddr = s.truncateIP(req.RemoteAddr)
+	}
+	return scrubbed
+}
+
+// truncateIPHeader truncates the IPs listed in a value of the header with the canonical name.
+func (s *scrubber) truncateIPHeader(name, value string) string {
+	elements := strings.Split(value, ",")
+	for i, element := range elements {
+		if name != "Forwarded" {
+			elements[i] = s.truncateIP(element)
+			continue
+		}
+		pairs := strings.Split(element, ";")
+		for j, pair := range pairs {
+			key, node, found := strings.Cut(pair, "=")
+			parameter := strings.ToLower(strings.TrimSpace(key))
+			if !found || (parameter != "for" && parameter != "by") {
+				continue
+			}
+			if ip := s.truncateIP(node); ip != node {
+				if strings.Contains(ip, ":") {
+					ip = `"[` + ip + `]"`
+				}
+				pairs[j] = key + "=" + ip
+			}
+		}
+		elements[i] = strings.Join(pairs, ";")
+	}
+	return strings.Join(elements, ",")
+}
+
+// truncateIP returns the network of an IP, an IP and port or a Forwarded node. Values that are
+// not IPs are returned as is.
+func (s *scrubber) truncateIP(value string) string {
+	host := strings.Trim(strings.TrimSpace(value), `"`)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	if ip == nil {
+		return value
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(s.ipv4Mask).String()
+	}
+	return ip.Mask(s.ipv6Mask).String()
+}
@@ -0,0 +1,216 @@
+package forklift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidPropagation = errors.New("invalid propagation")
+
+// Headers sent to backends with the routing decision of each request.
+const (
+	experimentHeader   = "X-Forklift-Experiment"
+	variantHeader      = "X-Forklift-Variant"
+	bucketHeader       = "X-Forklift-Bucket"
+	reasonHeader       = "X-Forklift-Reason"
+	assignmentHeader   = "X-Forklift-Assignment"
+	rulesVersionHeader = "X-Forklift-Rules-Version"
+
+	// contractVersion is incremented when the propagated headers change in a way backends relying
+	// on them must know about.
+	contractVersion = 1
+	// rulesVersionLength is the number of hex digits of the rules hash sent as the rules version.
+	rulesVersionLength = 12
+)
+
+// Reasons of routing decisions, set on the selections that carry them.
+const (
+	reasonDefault      = "default"
+	reasonRule         = "rule"
+	reasonSplit        = "split"
+	reasonFlag         = "flag"
+	reasonPinned       = "pinned"
+	reasonMigration    = "migration"
+	reasonFallback     = "fallback"
+	reasonBackpressure = "backpressure"
+	reasonNoConsent    = "no_consent"
+	reasonRemote       = "remote"
+	reasonLimited      = "limited"
+	reasonKillSwitch   = "kill_switch"
+	// reasonHook is sent for selections set by hooks without a reason.
+	reasonHook = "hook"
+)
+
+// Assignment reasons say how the session got the selected backend, so fallbacks masking
+// targeting can be counted: the rules were evaluated, the session's stored assignment was reused,
+// a hook overrode the rules, the default backend was used, or a flag provider failed.
+const (
+	assignedRuleMatch       = "rule-match"
+	assignedStickyReuse     = "sticky-reuse"
+	assignedOverride        = "override"
+	assignedFallbackDefault = "fallback-default"
+	assignedProviderError   = "provider-error"
+)
+
+// assignmentReason returns the assignment reason of a selection: the one it carries, or the one
+// its reason implies.
+func assignmentReason(selected SelectedBackend) string {
+	if selected.Assignment != "" {
+		return selected.Assignment
+	}
+	switch selected.Reason {
+	case reasonRule, reasonSplit, reasonFlag, reasonMigration, reasonRemote:
+		return assignedRuleMatch
+	case reasonPinned:
+		return assignedStickyReuse
+	case reasonDefault, reasonFallback, reasonBackpressure, reasonNoConsent, reasonLimited, reasonKillSwitch:
+		return assignedFallbackDefault
+	}
+	return assignedOverride
+}
+
+// assigned sets the assignment reason of the final selection of a request and counts it.
+func (a *Forklift) assigned(selected SelectedBackend) SelectedBackend {
+	selected.Assignment = assignmentReason(selected)
+	experiment, _ := exposureLabels(selected)
+	a.assignmentReasons.Inc(experiment, selected.Assignment)
+	return selected
+}
+
+// propagatedHeader describes a header of the contract with backends.
+type propagatedHeader struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Presence is "always" or the kind of decision the header is sent for.
+	Presence string   `json:"presence"`
+	Values   []string `json:"values,omitempty"`
+}
+
+var propagatedHeaders = []propagatedHeader{
+	{
+		Name:        experimentHeader,
+		Description: "Experiment of the selected rule, or name of the flag that selected the backend.",
+		Presence:    "experiment",
+	},
+	{
+		Name:        variantHeader,
+		Description: "Variant of the experiment, or treatment of the flag.",
+		Presence:    "experiment",
+	},
+	{
+		Name: bucketHeader,
+		Description: "Bucket of the session in the percentage split, 1 to 100. " +
+			"The session falls in the first N percent of the split if its bucket is at most N.",
+		Presence: "split",
+	},
+	{
+		Name:        reasonHeader,
+		Description: "Reason the backend was selected.",
+		Presence:    "always",
+		Values: []string{reasonDefault, reasonRule, reasonSplit, reasonFlag, reasonPinned, reasonMigration,
+			reasonFallback, reasonBackpressure, reasonNoConsent, reasonLimited, reasonKillSwitch, reasonRemote, reasonHook},
+	},
+	{
+		Name:        assignmentHeader,
+		Description: "How the session got the backend, to tell fallbacks from targeting.",
+		Presence:    "always",
+		Values: []string{assignedRuleMatch, assignedStickyReuse, assignedOverride, assignedFallbackDefault,
+			assignedProviderError},
+	},
+	{
+		Name:        rulesVersionHeader,
+		Description: "Hash of the rules that made the decision, including canary steps and traffic weights.",
+		Presence:    "always",
+	},
+}
+
+// propagation sends backends the routing decision of each request in the headers of the contract,
+// optionally removing the headers clients sent so backends can trust them.
+type propagation struct {
+	strip        bool
+	contractPath string
+}
+
+// newPropagation returns nil when propagation is not configured.
+func newPropagation(cfg *config.Config) (*propagation, error) {
+	if cfg.Propagation == nil {
+		return nil, nil
+	}
+	path := cfg.Propagation.ContractPath
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("%w: contract path must start with /", errInvalidPropagation)
+	}
+	return &propagation{strip: cfg.Propagation.StripClientHeaders, contractPath: path}, nil
+}
+
+// rulesVersion identifies a rule set by the hash of its YAML, so instances loading the same rules
+// agree on it.
+func rulesVersion(rules []RoutingRule) string {
+	data, err := config.MarshalRules(rules)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:rulesVersionLength]
+}
+
+// splitBucket returns the bucket of the session in the percentage split of the rules, or of the
+// assignment group if set, from the hash the split is based on.
+func (a *Forklift) splitBucket(sessionID, group string, rules []*RoutingRule) int {
+	var hashValue float64
+	if group != "" {
+		hashValue = assignmentGroupHash(sessionID, group)
+	} else {
+		hashValue = a.calculateHash(sessionID, rules)
+	}
+	return int(math.Max(1, math.Ceil(hashValue*percentageScale)))
+}
+
+// propagate sets the headers of the contract on a request to a backend.
+func (a *Forklift) propagate(header http.Header, selected SelectedBackend) {
+	p := a.propagation
+	if p == nil {
+		return
+	}
+	if p.strip {
+		for _, propagated := range propagatedHeaders {
+			header.Del(propagated.Name)
+		}
+	}
+
+	reason := selected.Reason
+	if reason == "" {
+		reason = reasonHook
+	}
+	header.Set(reasonHeader, reason)
+	header.Set(assignmentHeader, assignmentReason(selected))
+	header.Set(rulesVersionHeader, a.rulesVersion)
+	if experiment, variant := exposureLabels(selected); experiment != "" {
+		header.Set(experimentHeader, experiment)
+		if variant != "" {
+			header.Set(variantHeader, variant)
+		}
+	}
+	if selected.Bucket > 0 {
+		header.Set(bucketHeader, strconv.Itoa(selected.Bucket))
+	}
+}
+
+// serveContract describes the propagated headers as JSON, with the version of the rules serving
+// requests.
+func (a *Forklift) serveContract(rw http.ResponseWriter) {
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"version":            contractVersion,
+		"rulesVersion":       a.rulesVersion,
+		"stripClientHeaders": a.propagation.strip,
+		"headers":            propagatedHeaders,
+	})
+}
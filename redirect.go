@@ -0,0 +1,61 @@
+package forklift
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errMissingRedirectLocation = errors.New("redirect rule must set a location")
+	errInvalidRedirectStatus   = errors.New("invalid redirect status: must be between 300 and 399")
+)
+
+const defaultRedirectStatus = http.StatusFound
+
+// validateRedirect checks the redirect settings of a rule.
+func validateRedirect(redirect *config.Redirect) error {
+	if redirect.Location == "" {
+		return errMissingRedirectLocation
+	}
+	if redirect.Status != 0 && (redirect.Status < 300 || redirect.Status > 399) {
+		return errInvalidRedirectStatus
+	}
+	return nil
+}
+
+// redirectLocation expands the template variables in the redirect location for the given request.
+// The path is expanded escaped, as decoding it could change the meaning of the location, e.g.
+// /a%3Fb would start a query. The host is the Host header sent by the client.
+func redirectLocation(req *http.Request, location string) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	query := ""
+	if req.URL.RawQuery != "" {
+		query = "?" + req.URL.RawQuery
+	}
+	replacer := strings.NewReplacer(
+		"${scheme}", scheme,
+		"${host}", req.Host,
+		"${path}", req.URL.EscapedPath(),
+		"${query}", query,
+	)
+	return replacer.Replace(location)
+}
+
+// serveRedirect redirects the client instead of proxying the request.
+func (a *Forklift) serveRedirect(rw http.ResponseWriter, req *http.Request, redirect *config.Redirect) {
+	status := redirect.Status
+	if status == 0 {
+		status = defaultRedirectStatus
+	}
+	location := redirectLocation(req, redirect.Location)
+	if a.config.Debug {
+		a.logger.Debugf("Redirecting request to: %s", location)
+	}
+	http.Redirect(rw, req, location, status)
+}
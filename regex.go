@@ -0,0 +1,150 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidRegex = errors.New("invalid regex")
+
+const (
+	defaultRegexMaxProgramSize = 2000
+	defaultRegexMaxInputLength = 8 << 10
+	defaultRegexBudget         = time.Millisecond
+)
+
+// regexLimits are the parsed limits of the regex configuration.
+type regexLimits struct {
+	maxProgramSize int
+	maxInputLength int
+	budget         time.Duration
+}
+
+func parseRegexLimits(cfg *config.Regex) (regexLimits, error) {
+	limits := regexLimits{
+		maxProgramSize: defaultRegexMaxProgramSize,
+		maxInputLength: defaultRegexMaxInputLength,
+		budget:         defaultRegexBudget,
+	}
+	if cfg == nil {
+		return limits, nil
+	}
+	if cfg.MaxProgramSize < 0 || cfg.MaxInputLength < 0 {
+		return regexLimits{}, fmt.Errorf("%w: limits must be positive", errInvalidRegex)
+	}
+	if cfg.MaxProgramSize > 0 {
+		limits.maxProgramSize = cfg.MaxProgramSize
+	}
+	if cfg.MaxInputLength > 0 {
+		limits.maxInputLength = cfg.MaxInputLength
+	}
+	if cfg.Budget != "" {
+		budget, err := time.ParseDuration(cfg.Budget)
+		if err != nil || budget <= 0 {
+			return regexLimits{}, fmt.Errorf("%w: budget %q", errInvalidRegex, cfg.Budget)
+		}
+		limits.budget = budget
+	}
+	return limits, nil
+}
+
+// compileRegex compiles a pattern with Go's RE2 engine, which matches in time linear in the size
+// of the input, rejecting patterns whose program is larger than maxProgramSize instructions, such
+// as large counted repetitions.
+func compileRegex(pattern string, maxProgramSize int) (*regexp.Regexp, error) {
+	parsed, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidRegex, err)
+	}
+	prog, err := syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidRegex, err)
+	}
+	if len(prog.Inst) > maxProgramSize {
+		return nil, fmt.Errorf("%w: %q compiles to %d instructions, more than %d", errInvalidRegex, pattern, len(prog.Inst), maxProgramSize)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidRegex, err)
+	}
+	return re, nil
+}
+
+// isRegexCondition reports whether a condition compares with the regex operator.
+func isRegexCondition(condition RuleCondition) bool {
+	return strings.EqualFold(condition.Operator, "regex")
+}
+
+// lowercasedConditionTypes are the condition types comparing lowercased values, whose patterns
+// are lowercased too.
+var lowercasedConditionTypes = map[string]bool{"header": true, "referer": true, "utm": true, "clienthint": true}
+
+// validateRegexes checks the regex limits, and that the patterns of the rules compile within them.
+// Patterns of conditions comparing lowercased values must be lowercase, since lowercasing a
+// pattern changes escapes such as \D.
+func validateRegexes(cfg *config.Config) error {
+	limits, err := parseRegexLimits(cfg.Regex)
+	if err != nil {
+		return err
+	}
+	for _, rule := range cfg.Rules {
+		if rule.BucketPattern != "" {
+			if _, err := compileRegex(rule.BucketPattern, limits.maxProgramSize); err != nil {
+				return err
+			}
+		}
+		for _, condition := range rule.Conditions {
+			if !isRegexCondition(condition) {
+				continue
+			}
+			if lowercasedConditionTypes[strings.ToLower(condition.Type)] && strings.ToLower(condition.Value) != condition.Value {
+				return fmt.Errorf("%w: patterns of %s conditions must be lowercase: %q", errInvalidRegex, condition.Type, condition.Value)
+			}
+			if _, err := compileRegex(condition.Value, limits.maxProgramSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// regexMatch reports whether a value matches a pattern of the rules. Values longer than the
+// maximum input length don't match. Patterns are compiled on first use, as callers may trim
+// them; they were validated with the rules.
+func (re *RuleEngine) regexMatch(value, pattern string) bool {
+	if len(value) > re.regexLimits.maxInputLength {
+		if re.config.Debug {
+			re.logger.Debugf("Value of %d bytes too long for regex %q", len(value), pattern)
+		}
+		return false
+	}
+	cached, ok := re.regexes.Load(pattern)
+	if !ok {
+		compiled, err := compileRegex(pattern, re.regexLimits.maxProgramSize)
+		if err != nil {
+			re.logger.Warnf("Error compiling regex: %v", err)
+			return false
+		}
+		cached, _ = re.regexes.LoadOrStore(pattern, compiled)
+	}
+	return cached.(*regexp.Regexp).MatchString(value)
+}
+
+// overRegexBudget reports whether the regex conditions of a rule took more than the budget so
+// far, and counts it.
+func (re *RuleEngine) overRegexBudget(spent time.Duration, condition RuleCondition) bool {
+	if spent <= re.regexLimits.budget {
+		return false
+	}
+	if re.regexBudgets != nil {
+		re.regexBudgets.Inc()
+	}
+	re.logger.Warnf("Regex conditions over their budget of %s at %s %s, the rule doesn't match", re.regexLimits.budget, condition.Type, condition.Parameter)
+	return true
+}
@@ -0,0 +1,67 @@
+package forklift
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/daemonp/forklift/logger"
+)
+
+const (
+	requestIDHeader      = "X-Request-ID"
+	maxRequestIDLength   = 200
+	requestIDPrefixBytes = 8
+)
+
+// requestIDs generates request IDs from a random prefix per middleware and a counter, so IDs are
+// unique across instances without reading randomness on every request. The prefix doesn't come
+// from the middleware's random source, which decides how sessions are bucketed.
+type requestIDs struct {
+	prefix  string
+	counter atomic.Uint64
+}
+
+func newRequestIDs() *requestIDs {
+	b := make([]byte, requestIDPrefixBytes)
+	_, _ = rand.Read(b)
+	return &requestIDs{prefix: hex.EncodeToString(b)}
+}
+
+func (r *requestIDs) next() string {
+	return r.prefix + "-" + strconv.FormatUint(r.counter.Add(1), 16)
+}
+
+// requestID returns the ID of the request from its X-Request-ID header. Requests without a valid
+// ID get a new one. The ID is set on the request, so backends receive it, and on the response.
+func (a *Forklift) requestID(rw http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = a.requestIDs.next()
+		req.Header.Set(requestIDHeader, id)
+	}
+	rw.Header().Set(requestIDHeader, id)
+	return id
+}
+
+// validRequestID accepts IDs of printable ASCII characters other than spaces and quotes, so IDs
+// can't break log lines or the payloads of events.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c <= ' ' || c > '~' || c == '"' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns the logger for messages about a request, which carry its ID.
+func (a *Forklift) requestLogger(req *http.Request) logger.Logger {
+	return logger.WithRequestID(a.logger, req.Header.Get(requestIDHeader))
+}
@@ -0,0 +1,191 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidRequestLimits = errors.New("invalid request limits")
+
+const (
+	defaultMaxHeaders     = 100
+	defaultMaxHeaderBytes = 64 << 10
+	// headerOverheadBytes is the size of the separator and line ending of each header.
+	headerOverheadBytes = 4
+
+	requestLimitsReject = "reject"
+	requestLimitsBypass = "bypass"
+
+	forkliftHeaderPrefix = "X-Forklift-"
+)
+
+// Problems of requests over the limits or malformed.
+const (
+	problemHeaderCount    = "header_count"
+	problemHeaderBytes    = "header_bytes"
+	problemInvalidHeader  = "invalid_header"
+	problemInvalidTrailer = "invalid_trailer"
+	problemInvalidTarget  = "invalid_target"
+)
+
+// forbiddenTrailers are the fields that must not be sent as trailers, as they frame, route,
+// authenticate or control the message (RFC 9110, section 6.5.1). Backends merging trailers into
+// headers could otherwise be told different things than the rules saw.
+var forbiddenTrailers = map[string]bool{
+	"Authorization": true, "Cache-Control": true, "Connection": true, "Content-Encoding": true,
+	"Content-Length": true, "Content-Range": true, "Content-Type": true, "Cookie": true,
+	"Expect": true, "Host": true, "Keep-Alive": true, "Max-Forwards": true, "Pragma": true,
+	"Proxy-Authenticate": true, "Proxy-Authorization": true, "Proxy-Connection": true,
+	"Range": true, "Te": true, "Trailer": true, "Transfer-Encoding": true, "Www-Authenticate": true,
+}
+
+// requestLimits rejects, or routes to the default backend without evaluating the rules, the
+// requests with too many or too large headers and the malformed ones: headers with invalid bytes,
+// or trailers declaring fields that must not be trailers, including the propagated X-Forklift-*
+// headers, which are dropped when bypassing the rules. Requests with invalid header bytes or whose
+// target isn't a path can't be forwarded, and are always rejected.
+type requestLimits struct {
+	maxHeaders     int
+	maxHeaderBytes int
+	reject         bool
+
+	requests *metrics.CounterVec
+}
+
+// newRequestLimits returns nil when requests are not checked.
+func newRequestLimits(cfg *config.RequestLimits, registry *metrics.Registry) (*requestLimits, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.MaxHeaders < 0 || cfg.MaxHeaderBytes < 0 {
+		return nil, fmt.Errorf("%w: limits must not be negative", errInvalidRequestLimits)
+	}
+	l := &requestLimits{maxHeaders: cfg.MaxHeaders, maxHeaderBytes: cfg.MaxHeaderBytes}
+	if l.maxHeaders == 0 {
+		l.maxHeaders = defaultMaxHeaders
+	}
+	if l.maxHeaderBytes == 0 {
+		l.maxHeaderBytes = defaultMaxHeaderBytes
+	}
+	switch cfg.Action {
+	case "", requestLimitsReject:
+		l.reject = true
+	case requestLimitsBypass:
+	default:
+		return nil, fmt.Errorf("%w: action must be reject or bypass, got %q", errInvalidRequestLimits, cfg.Action)
+	}
+	l.requests = registry.Counter("forklift_limited_requests_total",
+		"Number of requests over the header limits or malformed, by problem and action.", "problem", "action")
+	return l, nil
+}
+
+// problem returns what is wrong with the request, or "" if it is within the limits.
+func (l *requestLimits) problem(req *http.Request) string {
+	if !strings.HasPrefix(req.URL.Path, "/") {
+		// Such as the asterisk of OPTIONS *, which has no backend path to be forwarded to.
+		return problemInvalidTarget
+	}
+	count, size := 0, 0
+	for name, values := range req.Header {
+		if !validHeaderName(name) {
+			return problemInvalidHeader
+		}
+		for _, value := range values {
+			if !validHeaderValue(value) {
+				return problemInvalidHeader
+			}
+			count++
+			size += len(name) + len(value) + headerOverheadBytes
+		}
+	}
+	for name := range req.Trailer {
+		if !validTrailer(name) {
+			return problemInvalidTrailer
+		}
+		count++
+		size += len(name) + headerOverheadBytes
+	}
+	// Requests that didn't go through a server may still declare their trailers in a header.
+	for _, declared := range req.Header.Values("Trailer") {
+		for _, name := range strings.Split(declared, ",") {
+			if !validTrailer(strings.TrimSpace(name)) {
+				return problemInvalidTrailer
+			}
+		}
+	}
+	switch {
+	case count > l.maxHeaders:
+		return problemHeaderCount
+	case size > l.maxHeaderBytes:
+		return problemHeaderBytes
+	}
+	return ""
+}
+
+// limited handles the requests over the limits or malformed, and reports whether it did.
+func (a *Forklift) limited(rw http.ResponseWriter, req *http.Request) bool {
+	l := a.requestLimits
+	if l == nil {
+		return false
+	}
+	problem := l.problem(req)
+	if problem == "" {
+		return false
+	}
+	if !l.reject && problem != problemInvalidHeader && problem != problemInvalidTarget {
+		l.requests.Inc(problem, requestLimitsBypass)
+		if problem == problemInvalidTrailer {
+			req.Trailer = nil
+			req.Header.Del("Trailer")
+		}
+		selected := a.defaultBackendSelection()
+		selected.Reason = reasonLimited
+		a.serve(rw, req, a.assigned(selected))
+		return true
+	}
+	l.requests.Inc(problem, requestLimitsReject)
+	if problem == problemHeaderCount || problem == problemHeaderBytes {
+		http.Error(rw, "Request Header Fields Too Large", http.StatusRequestHeaderFieldsTooLarge)
+	} else {
+		http.Error(rw, "Bad Request", http.StatusBadRequest)
+	}
+	return true
+}
+
+// validTrailer reports whether name may be sent as a trailer.
+func validTrailer(name string) bool {
+	canonical := http.CanonicalHeaderKey(name)
+	return validHeaderName(name) && !forbiddenTrailers[canonical] && !strings.HasPrefix(canonical, forkliftHeaderPrefix)
+}
+
+// validHeaderName reports whether name is a token (RFC 9110, section 5.1).
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue reports whether value has no control characters other than tabs.
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; (c < ' ' && c != '\t') || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidResourcePinTTL = errors.New("invalid resource pin ttl")
+
+const maxResourcePins = 100000
+
+// resourcePins pin the selection that served a resource to a session, so the ranged and
+// conditional requests that follow are answered by the same variant even if the session switches
+// variants meanwhile, e.g. while resuming a download. Otherwise the byte ranges of different
+// variants would be spliced together, and validators of one variant checked against another.
+// Pins are cleared when they grow past maxResourcePins, and dropped once no active rule targets
+// their backend. They are shared by the middleware and the copies created for each bundle
+// version.
+type resourcePins struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]resourcePin
+}
+
+type resourcePin struct {
+	selected SelectedBackend
+	// backend is the backend key of the selected rule, or the default backend.
+	backend string
+	expires time.Time
+}
+
+// newResourcePins returns nil when resources are not pinned.
+func newResourcePins(ttl string) (*resourcePins, error) {
+	if ttl == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d < 0 {
+		return nil, fmt.Errorf("%w: %s", errInvalidResourcePinTTL, ttl)
+	}
+	if d == 0 {
+		return nil, nil
+	}
+	return &resourcePins{ttl: d, entries: make(map[string]resourcePin)}, nil
+}
+
+// resourcePinKey identifies a resource requested by a session.
+func resourcePinKey(req *http.Request, sessionID string) string {
+	return sessionID + " " + req.URL.RequestURI()
+}
+
+// dependsOnVariant reports whether the answer to a request depends on what the variant served
+// before: ranged requests continue a representation, and conditional requests validate one.
+func dependsOnVariant(req *http.Request) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	for _, header := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		if req.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// pinned returns the selection pinned to the session for the requested resource, if the request
+// depends on it and an active rule still targets its backend, or it was the default backend and
+// still is. Using a pin extends it.
+func (p *resourcePins) pinned(req *http.Request, sessionID string, cfg *config.Config, now time.Time) (SelectedBackend, bool) {
+	if p == nil || !dependsOnVariant(req) {
+		return SelectedBackend{}, false
+	}
+	key := resourcePinKey(req, sessionID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pin, ok := p.entries[key]
+	if !ok || now.After(pin.expires) {
+		delete(p.entries, key)
+		return SelectedBackend{}, false
+	}
+	selected, ok := pin.current(cfg)
+	if !ok {
+		delete(p.entries, key)
+		return SelectedBackend{}, false
+	}
+	pin.expires = now.Add(p.ttl)
+	p.entries[key] = pin
+	selected.Reason = reasonPinned
+	return selected, true
+}
+
+// current returns the pinned selection with its rule in the current rules, or false if no active
+// rule targets its backend anymore.
+func (pin resourcePin) current(cfg *config.Config) (SelectedBackend, bool) {
+	selected := pin.selected
+	if selected.Rule == nil {
+		return selected, pin.backend == cfg.DefaultBackend
+	}
+	for i := range cfg.Rules {
+		if rule := &cfg.Rules[i]; !rule.Paused && backendKey(*rule) == pin.backend {
+			selected.Rule = rule
+			return selected, true
+		}
+	}
+	return SelectedBackend{}, false
+}
+
+// pin records the selection that served a resource which can be resumed or revalidated: a
+// partial response, or a response with validators or support for ranges.
+func (p *resourcePins) pin(req *http.Request, sessionID string, selected SelectedBackend, status int, header http.Header, now time.Time) {
+	if p == nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return
+	}
+	switch status {
+	case http.StatusPartialContent:
+	case http.StatusOK, http.StatusNotModified:
+		if header.Get("ETag") == "" && header.Get("Last-Modified") == "" && header.Get("Accept-Ranges") != "bytes" {
+			return
+		}
+	default:
+		return
+	}
+
+	key := resourcePinKey(req, sessionID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.entries[key]; !ok && len(p.entries) >= maxResourcePins {
+		p.entries = make(map[string]resourcePin)
+	}
+	backend := selected.Backend
+	if selected.Rule != nil {
+		backend = backendKey(*selected.Rule)
+	}
+	p.entries[key] = resourcePin{selected: selected, backend: backend, expires: now.Add(p.ttl)}
+}
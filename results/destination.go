@@ -0,0 +1,130 @@
+package results
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/awsauth"
+)
+
+var (
+	errInvalidDestination = errors.New("invalid results destination: must be a directory or an s3://bucket/prefix URL")
+	errUploadStatus       = errors.New("results upload failed")
+)
+
+const (
+	defaultS3Region = "us-east-1"
+	uploadTimeout   = 30 * time.Second
+)
+
+// Destination stores result files under slash separated names.
+type Destination interface {
+	Put(ctx context.Context, name string, data []byte) error
+}
+
+// NewDestination returns the destination of a local directory or an s3://bucket/prefix URL.
+// S3 requests are signed with credentials from the environment or the ECS container endpoint,
+// for region, AWS_REGION or us-east-1, and sent to endpoint if set.
+func NewDestination(destination, region, endpoint string) (Destination, error) {
+	if destination == "" {
+		return nil, errInvalidDestination
+	}
+	if !strings.HasPrefix(destination, "s3://") {
+		if strings.Contains(destination, "://") {
+			return nil, errInvalidDestination
+		}
+		return directory(destination), nil
+	}
+
+	parsed, err := url.Parse(destination)
+	if err != nil || parsed.Host == "" {
+		return nil, errInvalidDestination
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = defaultS3Region
+	}
+	client := &http.Client{Timeout: uploadTimeout}
+	return &s3Destination{
+		bucket:      parsed.Host,
+		prefix:      strings.Trim(parsed.Path, "/"),
+		region:      region,
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		client:      client,
+		credentials: awsauth.NewCredentialProvider(client),
+		now:         time.Now,
+	}, nil
+}
+
+// directory writes files below a local directory. Files are written to a temporary file first,
+// so readers never see partial files.
+type directory string
+
+func (d directory) Put(_ context.Context, name string, data []byte) error {
+	path := filepath.Join(string(d), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// s3Destination uploads files below a prefix of an S3 bucket.
+type s3Destination struct {
+	bucket, prefix string
+	region         string
+	endpoint       string
+	client         *http.Client
+	credentials    *awsauth.CredentialProvider
+	now            func() time.Time
+}
+
+func (s *s3Destination) Put(ctx context.Context, name string, data []byte) error {
+	key := name
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+	target := "https://" + s.bucket + ".s3." + s.region + ".amazonaws.com/" + key
+	if s.endpoint != "" {
+		target = s.endpoint + "/" + s.bucket + "/" + key
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	creds, err := s.credentials.Credentials(ctx)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+	awsauth.SignRequest(req, data, creds, s.region, "s3", s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", errUploadStatus, key, resp.Status)
+	}
+	return nil
+}
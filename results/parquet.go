@@ -0,0 +1,260 @@
+package results
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Parquet files are written with a single row group holding one uncompressed, PLAIN encoded
+// data page per column. All columns are required, so pages carry no repetition or definition
+// levels. The file metadata and page headers are Thrift structures in the compact protocol.
+
+const parquetMagic = "PAR1"
+
+// Values of the Parquet format used by the writer.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+	noConvertedType        = -1
+
+	parquetRequired     = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetDataPage     = 0
+	parquetUncompressed = 0
+)
+
+// Types of the Thrift compact protocol.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// parquetField describes a column of result files: times are timestamps in milliseconds, texts
+// UTF-8 strings and counts 64 bit integers.
+type parquetField struct {
+	name      string
+	physical  int32
+	converted int32
+}
+
+func parquetFields() []parquetField {
+	fields := make([]parquetField, len(columns))
+	for i, name := range columns {
+		fields[i] = parquetField{name: name, physical: parquetInt64, converted: noConvertedType}
+		switch {
+		case i < 2:
+			fields[i].converted = parquetTimestampMillis
+		case i < 5:
+			fields[i].physical, fields[i].converted = parquetByteArray, parquetUTF8
+		}
+	}
+	return fields
+}
+
+// parquetColumn holds the PLAIN encoded values of a column.
+type parquetColumn struct {
+	parquetField
+	values bytes.Buffer
+}
+
+func (c *parquetColumn) int64(v int64) {
+	_ = binary.Write(&c.values, binary.LittleEndian, v)
+}
+
+func (c *parquetColumn) string(s string) {
+	_ = binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+	c.values.WriteString(s)
+}
+
+func encodeParquet(rows []Row) []byte {
+	fields := parquetFields()
+	chunks := make([]*parquetColumn, len(fields))
+	for i, field := range fields {
+		chunks[i] = &parquetColumn{parquetField: field}
+	}
+	for _, row := range rows {
+		chunks[0].int64(row.PeriodStart.UnixMilli())
+		chunks[1].int64(row.PeriodEnd.UnixMilli())
+		chunks[2].string(row.Experiment)
+		chunks[3].string(row.Variant)
+		chunks[4].string(row.Goal)
+		chunks[5].int64(row.Exposures)
+		chunks[6].int64(row.Sessions)
+		chunks[7].int64(row.Errors)
+		chunks[8].int64(row.Conversions)
+		chunks[9].int64(row.ConvertedSessions)
+	}
+
+	var file bytes.Buffer
+	file.WriteString(parquetMagic)
+	offsets := make([]int64, len(chunks))
+	sizes := make([]int64, len(chunks))
+	for i, chunk := range chunks {
+		header := pageHeader(len(rows), chunk.values.Len())
+		offsets[i] = int64(file.Len())
+		sizes[i] = int64(len(header) + chunk.values.Len())
+		file.Write(header)
+		file.Write(chunk.values.Bytes())
+	}
+
+	footer := fileMetadata(fields, len(rows), offsets, sizes)
+	file.Write(footer)
+	_ = binary.Write(&file, binary.LittleEndian, uint32(len(footer)))
+	file.WriteString(parquetMagic)
+	return file.Bytes()
+}
+
+// pageHeader encodes the header of a data page of values.
+func pageHeader(numValues, size int) []byte {
+	w := newThriftWriter()
+	w.i32(1, parquetDataPage)
+	w.i32(2, int32(size))
+	w.i32(3, int32(size))
+	w.beginStruct(5)
+	w.i32(1, int32(numValues))
+	w.i32(2, parquetPlain)
+	w.i32(3, parquetRLE)
+	w.i32(4, parquetRLE)
+	w.endStruct()
+	return w.end()
+}
+
+// fileMetadata encodes the footer describing the schema and the column chunks.
+func fileMetadata(fields []parquetField, numRows int, offsets, sizes []int64) []byte {
+	w := newThriftWriter()
+	w.i32(1, 1)
+
+	w.beginList(2, thriftStruct, len(fields)+1)
+	w.beginElement()
+	w.binary(4, "schema")
+	w.i32(5, int32(len(fields)))
+	w.endStruct()
+	for _, field := range fields {
+		w.beginElement()
+		w.i32(1, field.physical)
+		w.i32(3, parquetRequired)
+		w.binary(4, field.name)
+		if field.converted != noConvertedType {
+			w.i32(6, field.converted)
+		}
+		w.endStruct()
+	}
+
+	w.i64(3, int64(numRows))
+
+	var total int64
+	w.beginList(4, thriftStruct, 1)
+	w.beginElement()
+	w.beginList(1, thriftStruct, len(fields))
+	for i, field := range fields {
+		total += sizes[i]
+		w.beginElement()
+		w.i64(2, offsets[i])
+		w.beginStruct(3)
+		w.i32(1, field.physical)
+		w.beginList(2, thriftI32, 1)
+		w.varint(zigzag(parquetPlain))
+		w.beginList(3, thriftBinary, 1)
+		w.varint(uint64(len(field.name)))
+		w.buf.WriteString(field.name)
+		w.i32(4, parquetUncompressed)
+		w.i64(5, int64(numRows))
+		w.i64(6, sizes[i])
+		w.i64(7, sizes[i])
+		w.i64(9, offsets[i])
+		w.endStruct()
+		w.endStruct()
+	}
+	w.i64(2, total)
+	w.i64(3, int64(numRows))
+	w.endStruct()
+
+	w.binary(6, "forklift")
+	return w.end()
+}
+
+// thriftWriter encodes a Thrift struct in the compact protocol. Field IDs are written as deltas
+// from the previous field of the same struct, so it keeps the last ID of each nested struct.
+type thriftWriter struct {
+	buf  bytes.Buffer
+	last []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (w *thriftWriter) field(id int16, typ byte) {
+	last := &w.last[len(w.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.varint(zigzag(int64(v)))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.varint(zigzag(v))
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.varint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *thriftWriter) beginStruct(id int16) {
+	w.field(id, thriftStruct)
+	w.last = append(w.last, 0)
+}
+
+// beginList starts a list field of size elements. Struct elements start with beginElement, and
+// other elements are written as bare values.
+func (w *thriftWriter) beginList(id int16, elementType byte, size int) {
+	w.field(id, thriftList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size)<<4 | elementType)
+		return
+	}
+	w.buf.WriteByte(0xf0 | elementType)
+	w.varint(uint64(size))
+}
+
+func (w *thriftWriter) beginElement() {
+	w.last = append(w.last, 0)
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// end closes the top level struct and returns its encoding.
+func (w *thriftWriter) end() []byte {
+	w.buf.WriteByte(0)
+	return w.buf.Bytes()
+}
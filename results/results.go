@@ -0,0 +1,103 @@
+// Package results writes aggregated experiment results as CSV or Parquet files to a local
+// directory or S3, so data teams can load them into their warehouses.
+package results
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var errUnknownFormat = errors.New("unknown results format: must be csv or parquet")
+
+// Formats of result files.
+const (
+	FormatCSV     = "csv"
+	FormatParquet = "parquet"
+)
+
+// Row holds the results of a variant for a goal over a period. Exposures, Sessions and Errors
+// are the same for all goals of a variant; Goal is empty when no goals are configured.
+type Row struct {
+	PeriodStart time.Time
+	PeriodEnd   time.Time
+	Experiment  string
+	Variant     string
+	Goal        string
+	// Exposures counts exposed requests, Sessions the distinct sessions among them and Errors
+	// those answered with a 5xx status.
+	Exposures int64
+	Sessions  int64
+	Errors    int64
+	// Conversions counts goal requests attributed to the variant, ConvertedSessions the distinct
+	// sessions among them.
+	Conversions       int64
+	ConvertedSessions int64
+}
+
+// columns are the names of the columns of result files, in order.
+var columns = []string{
+	"period_start", "period_end", "experiment", "variant", "goal",
+	"exposures", "sessions", "errors", "conversions", "converted_sessions",
+}
+
+// ValidateFormat checks that format is a known format. An empty format is CSV.
+func ValidateFormat(format string) error {
+	switch format {
+	case "", FormatCSV, FormatParquet:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", errUnknownFormat, format)
+	}
+}
+
+// Extension returns the file extension of the format, without the dot.
+func Extension(format string) string {
+	if format == FormatParquet {
+		return FormatParquet
+	}
+	return FormatCSV
+}
+
+// Encode encodes rows in the format, with a header row for CSV. Times are written in UTC, as
+// RFC 3339 in CSV and as timestamps in milliseconds in Parquet.
+func Encode(format string, rows []Row) ([]byte, error) {
+	switch format {
+	case "", FormatCSV:
+		return encodeCSV(rows)
+	case FormatParquet:
+		return encodeParquet(rows), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", errUnknownFormat, format)
+	}
+}
+
+func encodeCSV(rows []Row) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(columns); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		record := []string{
+			row.PeriodStart.UTC().Format(time.RFC3339),
+			row.PeriodEnd.UTC().Format(time.RFC3339),
+			row.Experiment,
+			row.Variant,
+			row.Goal,
+			strconv.FormatInt(row.Exposures, 10),
+			strconv.FormatInt(row.Sessions, 10),
+			strconv.FormatInt(row.Errors, 10),
+			strconv.FormatInt(row.Conversions, 10),
+			strconv.FormatInt(row.ConvertedSessions, 10),
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
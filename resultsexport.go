@@ -0,0 +1,337 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/results"
+)
+
+var errInvalidResultsExport = errors.New("invalid results export")
+
+const (
+	defaultResultsInterval   = time.Hour
+	defaultAttributionWindow = 24 * time.Hour
+	// maxAttributedSessions bounds the sessions conversions can be attributed to. Sessions
+	// exposed once it is reached are counted, but their conversions are not.
+	maxAttributedSessions = 100000
+	resultsFileTime       = "20060102T150405Z"
+)
+
+// resultsExporter aggregates the exposures and conversions of each experiment by variant over a
+// period, and writes them to a file per experiment at the end of each period.
+type resultsExporter struct {
+	destination results.Destination
+	format      string
+	interval    time.Duration
+	window      time.Duration
+	goals       []config.Goal
+	// instance tells apart the files of the instances exporting to the same destination.
+	instance string
+	logger   logger.Logger
+
+	mu sync.Mutex
+	// period numbers the current period from 1, so sessions can tell whether they were counted
+	// in it.
+	period   uint64
+	start    time.Time
+	variants map[variantKey]*variantResults
+	// sessions holds the variant each session was last exposed to, by session and experiment.
+	sessions map[string]map[string]*attributedSession
+
+	exports *metrics.CounterVec
+	// counters also counts the conversions across the cluster, if configured.
+	counters *clusterCounters
+}
+
+type variantKey struct {
+	experiment, variant string
+}
+
+type variantResults struct {
+	exposures, sessions, errors int64
+	conversions                 map[string]*goalResults
+}
+
+type goalResults struct {
+	conversions, sessions int64
+}
+
+// attributedSession records the exposure of a session to an experiment, and the periods it was
+// last counted in for the variant and for each goal.
+type attributedSession struct {
+	variant   string
+	exposed   time.Time
+	counted   uint64
+	converted map[string]uint64
+}
+
+// newResultsExporter returns nil when results are not exported.
+func newResultsExporter(cfg *config.Config, name string, logger logger.Logger, registry *metrics.Registry) (*resultsExporter, error) {
+	export := cfg.ResultsExport
+	if export == nil {
+		return nil, nil
+	}
+	destination, err := results.NewDestination(export.Destination, export.Region, export.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := results.ValidateFormat(export.Format); err != nil {
+		return nil, err
+	}
+	interval, err := parseResultsDuration("interval", export.Interval, defaultResultsInterval)
+	if err != nil {
+		return nil, err
+	}
+	window, err := parseResultsDuration("attribution window", export.AttributionWindow, defaultAttributionWindow)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(export.Goals))
+	for _, goal := range export.Goals {
+		switch {
+		case goal.Name == "" || seen[goal.Name]:
+			return nil, fmt.Errorf("%w: goals need unique names", errInvalidResultsExport)
+		case (goal.Path == "") == (goal.PathPrefix == ""):
+			return nil, fmt.Errorf("%w: goal %s needs either a path or a path prefix", errInvalidResultsExport, goal.Name)
+		}
+		seen[goal.Name] = true
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "forklift"
+	}
+	return &resultsExporter{
+		destination: destination,
+		format:      export.Format,
+		interval:    interval,
+		window:      window,
+		goals:       export.Goals,
+		instance:    url.PathEscape(host + "-" + name),
+		logger:      logger,
+		period:      1,
+		variants:    make(map[variantKey]*variantResults),
+		sessions:    make(map[string]map[string]*attributedSession),
+		exports: registry.Counter("forklift_results_exports_total",
+			"Number of experiment result files exported by result: success or error.", "result"),
+	}, nil
+}
+
+func parseResultsDuration(name, value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%w: invalid %s %q", errInvalidResultsExport, name, value)
+	}
+	return d, nil
+}
+
+// record counts the exposure of a served request, and the conversion if it reached a goal.
+func (e *resultsExporter) record(hc *HookContext, now time.Time) {
+	if e == nil {
+		return
+	}
+	experiment, variant := exposureLabels(hc.Selected)
+	var goals []string
+	if hc.Status < http.StatusBadRequest {
+		for _, goal := range e.goals {
+			if goalMatches(goal, hc.Request) {
+				goals = append(goals, goal.Name)
+			}
+		}
+	}
+	if experiment == "" && len(goals) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if experiment != "" {
+		e.expose(hc.SessionID, experiment, variant, hc.Status, now)
+	}
+	for experiment, session := range e.sessions[hc.SessionID] {
+		if now.Sub(session.exposed) > e.window {
+			continue
+		}
+		counts := e.countsOf(experiment, session.variant)
+		for _, goal := range goals {
+			converted := counts.conversions[goal]
+			if converted == nil {
+				converted = &goalResults{}
+				counts.conversions[goal] = converted
+			}
+			converted.conversions++
+			e.counters.convert(experiment, session.variant, goal)
+			if session.converted[goal] != e.period {
+				session.converted[goal] = e.period
+				converted.sessions++
+			}
+		}
+	}
+}
+
+// expose counts an exposure and attributes the session to the variant. It is called with the
+// lock held.
+func (e *resultsExporter) expose(sessionID, experiment, variant string, status int, now time.Time) {
+	counts := e.countsOf(experiment, variant)
+	counts.exposures++
+	if status >= http.StatusInternalServerError {
+		counts.errors++
+	}
+
+	experiments := e.sessions[sessionID]
+	if experiments == nil {
+		if len(e.sessions) >= maxAttributedSessions {
+			counts.sessions++
+			return
+		}
+		experiments = make(map[string]*attributedSession)
+		e.sessions[sessionID] = experiments
+	}
+	session := experiments[experiment]
+	if session == nil || session.variant != variant {
+		session = &attributedSession{variant: variant, converted: make(map[string]uint64)}
+		experiments[experiment] = session
+	}
+	session.exposed = now
+	if session.counted != e.period {
+		session.counted = e.period
+		counts.sessions++
+	}
+}
+
+// countsOf returns the results of a variant in the current period. It is called with the lock
+// held.
+func (e *resultsExporter) countsOf(experiment, variant string) *variantResults {
+	key := variantKey{experiment: experiment, variant: variant}
+	counts := e.variants[key]
+	if counts == nil {
+		counts = &variantResults{conversions: make(map[string]*goalResults)}
+		e.variants[key] = counts
+	}
+	return counts
+}
+
+// goalMatches reports whether a request reaches a goal.
+func goalMatches(goal config.Goal, req *http.Request) bool {
+	if goal.Method != "" && !strings.EqualFold(goal.Method, req.Method) {
+		return false
+	}
+	if goal.Path != "" {
+		return req.URL.Path == goal.Path
+	}
+	return strings.HasPrefix(req.URL.Path, goal.PathPrefix)
+}
+
+// rotate ends the current period and returns its rows by experiment, forgetting the sessions
+// exposed longer than the attribution window ago.
+func (e *resultsExporter) rotate(now time.Time) map[string][]results.Row {
+	e.mu.Lock()
+	variants, start := e.variants, e.start
+	e.variants = make(map[variantKey]*variantResults)
+	e.start = now
+	e.period++
+	for sessionID, experiments := range e.sessions {
+		for experiment, session := range experiments {
+			if now.Sub(session.exposed) > e.window {
+				delete(experiments, experiment)
+			}
+		}
+		if len(experiments) == 0 {
+			delete(e.sessions, sessionID)
+		}
+	}
+	e.mu.Unlock()
+
+	rows := make(map[string][]results.Row)
+	for key, counts := range variants {
+		row := results.Row{
+			PeriodStart: start,
+			PeriodEnd:   now,
+			Experiment:  key.experiment,
+			Variant:     key.variant,
+			Exposures:   counts.exposures,
+			Sessions:    counts.sessions,
+			Errors:      counts.errors,
+		}
+		if len(e.goals) == 0 {
+			rows[key.experiment] = append(rows[key.experiment], row)
+			continue
+		}
+		for _, goal := range e.goals {
+			row.Goal, row.Conversions, row.ConvertedSessions = goal.Name, 0, 0
+			if converted := counts.conversions[goal.Name]; converted != nil {
+				row.Conversions, row.ConvertedSessions = converted.conversions, converted.sessions
+			}
+			rows[key.experiment] = append(rows[key.experiment], row)
+		}
+	}
+	for _, experimentRows := range rows {
+		sort.SliceStable(experimentRows, func(i, j int) bool { return experimentRows[i].Variant < experimentRows[j].Variant })
+	}
+	return rows
+}
+
+// export writes the results of the period ending now, a file per experiment named
+// <experiment>/<period start>-<instance>.<format>. Files that fail to be written are logged, and
+// their results lost.
+func (e *resultsExporter) export(ctx context.Context, now time.Time) error {
+	rows := e.rotate(now)
+	var first error
+	for experiment, experimentRows := range rows {
+		name := url.PathEscape(experiment) + "/" + experimentRows[0].PeriodStart.UTC().Format(resultsFileTime) +
+			"-" + e.instance + "." + results.Extension(e.format)
+		data, err := results.Encode(e.format, experimentRows)
+		if err == nil {
+			err = e.destination.Put(ctx, name, data)
+		}
+		if err != nil {
+			e.logger.Errorf("Error exporting results of experiment %s: %v", experiment, err)
+			e.exports.Inc("error")
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		e.exports.Inc("success")
+	}
+	return first
+}
+
+// restart starts the current period at now.
+func (e *resultsExporter) restart(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.start = now
+}
+
+// exportResults exports the results every interval until the middleware shuts down, which
+// exports the last period.
+func (a *Forklift) exportResults() {
+	go func() {
+		ticker := time.NewTicker(a.results.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = a.results.export(context.Background(), a.now())
+			case <-a.lifecycle.done:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,117 @@
+package forklift
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+// ruleMetrics tracks the requests in flight per rule, and the requests and latency per variant of
+// each experiment, which the dashboards generated by `forklift dashboard` are built on. It is nil
+// when metrics are not served.
+type ruleMetrics struct {
+	inFlight *metrics.GaugeVec
+	requests *metrics.CounterVec
+	duration *metrics.HistogramVec
+}
+
+func newRuleMetrics(cfg *config.Config, registry *metrics.Registry) *ruleMetrics {
+	if cfg.MetricsPath == "" {
+		return nil
+	}
+	return &ruleMetrics{
+		inFlight: registry.Gauge("forklift_rule_in_flight",
+			"Number of requests in flight per rule.", "rule"),
+		requests: registry.Counter("forklift_variant_requests_total",
+			"Number of requests served per experiment variant and status class.", "experiment", "variant", "code"),
+		duration: registry.Histogram("forklift_variant_request_duration_seconds",
+			"Time to serve requests per experiment variant.", metrics.DefaultBuckets, "experiment", "variant"),
+	}
+}
+
+// ruleKeys returns the metric label of each rule. Rules must already be sorted.
+func ruleKeys(rules []RoutingRule) map[*RoutingRule]string {
+	keys := make(map[*RoutingRule]string, len(rules))
+	for i := range rules {
+		keys[&rules[i]] = config.RuleKey(rules[i])
+	}
+	return keys
+}
+
+// ruleKey returns the metric label of a rule. Rules created at runtime, such as the response of
+// an unavailable flag provider, aren't in the precomputed keys.
+func (a *Forklift) ruleKey(rule *RoutingRule) string {
+	if key, ok := a.ruleKeys[rule]; ok {
+		return key
+	}
+	return config.RuleKey(*rule)
+}
+
+// started counts a request served by the selected rule as in flight.
+func (a *Forklift) started(selected SelectedBackend) {
+	if a.ruleMetrics == nil || selected.Rule == nil {
+		return
+	}
+	a.ruleMetrics.inFlight.Add(1, a.ruleLabel(selected.Rule))
+}
+
+// finished records a request served by the selected rule with its status and duration. The
+// duration of requests in a sampled trace is an exemplar of its bucket, linking latency to the
+// traces of the requests.
+func (a *Forklift) finished(req *http.Request, selected SelectedBackend, status int, elapsed time.Duration) {
+	if a.ruleMetrics == nil || selected.Rule == nil {
+		return
+	}
+	a.ruleMetrics.inFlight.Add(-1, a.ruleLabel(selected.Rule))
+
+	experiment, variant := exposureLabels(selected)
+	if experiment == "" {
+		return
+	}
+	variant = metricVariant(a.config.MetricsLabels, selected.Rule, variant)
+	a.ruleMetrics.requests.Inc(experiment, variant, statusClass(status))
+	a.ruleMetrics.duration.ObserveWithExemplar(elapsed.Seconds(), sampledTraceID(req), experiment, variant)
+}
+
+// sampledTraceID returns the trace ID of the W3C traceparent header of a request, such as the one
+// set by the OpenTelemetry tracing of Traefik, if the trace is sampled: unsampled traces are not
+// recorded, so they can't be linked to.
+func sampledTraceID(req *http.Request) string {
+	// version-traceid-parentid-flags, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+	parts := strings.Split(req.Header.Get("Traceparent"), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ""
+	}
+	for _, part := range parts[:4] {
+		if !isLowerHex(part) {
+			return ""
+		}
+	}
+	flags, _ := strconv.ParseUint(parts[3], 16, 8)
+	if flags&1 == 0 || parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return ""
+	}
+	return parts[1]
+}
+
+func isLowerHex(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// statusClass returns the class of a status code, e.g. "5xx".
+func statusClass(status int) string {
+	if status < http.StatusContinue || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
@@ -0,0 +1,99 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidScript = errors.New("invalid script")
+
+var (
+	scriptLoaderMu sync.RWMutex
+	scriptLoader   ScriptLoader
+)
+
+// ScriptEngine runs the functions of the configured script.
+type ScriptEngine interface {
+	// Identity returns the identity the script's identity function returns for the request, or "".
+	Identity(req *http.Request) string
+	// Match returns a function reporting whether the script's match function lets a matching
+	// rule, given with its key, decide the request, or nil if the script defines none. The calls
+	// for the rules of a request share one script state.
+	Match(req *http.Request) func(key string, rule *RoutingRule) bool
+	// Headers passes the headers forwarded to a backend through the script's headers function.
+	Headers(header http.Header, req *http.Request, backend string)
+}
+
+// ScriptLoader loads the script of a configuration.
+type ScriptLoader func(script *config.Script, logger logger.Logger, registry *metrics.Registry) (ScriptEngine, error)
+
+// RegisterScriptLoader sets the loader of the scripts configured with the script setting, as the
+// github.com/daemonp/forklift/luascript package does when imported. Like RegisterHook, it only
+// reaches middlewares compiled into the same binary.
+func RegisterScriptLoader(loader ScriptLoader) {
+	scriptLoaderMu.Lock()
+	defer scriptLoaderMu.Unlock()
+	scriptLoader = loader
+}
+
+// loadScript returns nil when no script is configured, and fails when no loader is registered,
+// as in the middleware loaded as a Traefik plugin.
+func loadScript(cfg *config.Config, logger logger.Logger, registry *metrics.Registry) (ScriptEngine, error) {
+	if cfg.Script == nil {
+		return nil, nil
+	}
+	scriptLoaderMu.RLock()
+	loader := scriptLoader
+	scriptLoaderMu.RUnlock()
+	if loader == nil {
+		return nil, fmt.Errorf("%w: scripts need a build importing github.com/daemonp/forklift/luascript, such as the standalone proxy", errInvalidScript)
+	}
+	return loader(cfg.Script, logger, registry)
+}
+
+// scriptIdentity returns the session ID of the identity the script returns for the request, or
+// "" if it returns none.
+func (a *Forklift) scriptIdentity(req *http.Request) string {
+	if a.script == nil {
+		return ""
+	}
+	identity := a.script.Identity(req)
+	if identity == "" {
+		return ""
+	}
+	return identityHash("script", identity)
+}
+
+// scriptMatch returns the function the rules matching a request are passed to scriptAllows with.
+func (a *Forklift) scriptMatch(req *http.Request) func(key string, rule *RoutingRule) bool {
+	if a.script == nil {
+		return nil
+	}
+	return a.script.Match(req)
+}
+
+// scriptAllows reports whether the script's match function lets a matching rule decide the
+// request.
+func (a *Forklift) scriptAllows(rule *RoutingRule, match func(key string, rule *RoutingRule) bool) bool {
+	if match == nil {
+		return true
+	}
+	allowed := match(a.ruleKey(rule), rule)
+	if !allowed && a.config.Debug {
+		a.logger.Debugf("Rule %s vetoed by the script", a.ruleKey(rule))
+	}
+	return allowed
+}
+
+// scriptHeaders passes the headers forwarded to a backend through the script.
+func (a *Forklift) scriptHeaders(header http.Header, req *http.Request, backend string) {
+	if a.script != nil {
+		a.script.Headers(header, req, backend)
+	}
+}
@@ -0,0 +1,405 @@
+// Package secrets resolves secret references in the Forklift configuration, so credentials
+// don't have to appear in Traefik's dynamic configuration.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errVaultStatus      = errors.New("vault returned an error")
+	errMissingVault     = errors.New("secret references vault, but no vault is configured")
+	errMissingVaultAuth = errors.New("vault requires a token, token file or kubernetes role")
+	errInvalidReference = errors.New("invalid vault reference: must be vault:<path>#<key>")
+	errMissingSecret    = errors.New("vault secret has no such key")
+)
+
+const (
+	referencePrefix = "vault:"
+
+	defaultVaultTimeout        = 5 * time.Second
+	defaultKubernetesMountPath = "kubernetes"
+	kubernetesTokenPath        = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	// Tokens and leases are renewed once this fraction of their TTL has passed.
+	renewFraction = 2.0 / 3
+	minRenewDelay = 5 * time.Second
+)
+
+// IsReference reports whether value refers to a Vault secret.
+func IsReference(value string) bool {
+	return strings.HasPrefix(value, referencePrefix)
+}
+
+// Vault reads secrets from HashiCorp Vault. Its token is renewed in the background before it
+// expires, or replaced by logging in again when it can't be renewed, and the leases of dynamic
+// secrets it read are renewed the same way.
+type Vault struct {
+	address   string
+	namespace string
+	client    *http.Client
+	login     func(ctx context.Context) (*vaultAuth, error)
+
+	mu     sync.Mutex
+	token  string
+	leases map[string]time.Duration
+}
+
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int    `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+type vaultResponse struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+	Auth          *vaultAuth             `json:"auth"`
+}
+
+// NewVault authenticates with the configured Vault and starts renewing its token.
+func NewVault(ctx context.Context, cfg *config.Vault) (*Vault, error) {
+	timeout := defaultVaultTimeout
+	if cfg.Timeout != "" {
+		parsed, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid vault timeout: %w", err)
+		}
+		timeout = parsed
+	}
+	address := cfg.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+
+	v := &Vault{
+		address:   strings.TrimSuffix(address, "/"),
+		namespace: cfg.Namespace,
+		client:    &http.Client{Timeout: timeout},
+		leases:    make(map[string]time.Duration),
+	}
+
+	switch {
+	case cfg.KubernetesRole != "":
+		mountPath := cfg.KubernetesMountPath
+		if mountPath == "" {
+			mountPath = defaultKubernetesMountPath
+		}
+		v.login = func(ctx context.Context) (*vaultAuth, error) {
+			return v.kubernetesLogin(ctx, mountPath, cfg.KubernetesRole)
+		}
+	case cfg.TokenFile != "":
+		v.login = func(context.Context) (*vaultAuth, error) {
+			token, err := os.ReadFile(cfg.TokenFile)
+			if err != nil {
+				return nil, err
+			}
+			return &vaultAuth{ClientToken: strings.TrimSpace(string(token))}, nil
+		}
+	default:
+		token := cfg.Token
+		if token == "" {
+			token = os.Getenv("VAULT_TOKEN")
+		}
+		if token == "" {
+			return nil, errMissingVaultAuth
+		}
+		v.login = func(context.Context) (*vaultAuth, error) {
+			return &vaultAuth{ClientToken: token}, nil
+		}
+	}
+
+	auth, err := v.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go v.maintainToken(auth)
+	return v, nil
+}
+
+// Resolve returns the secret a reference of the form vault:<path>#<key> points to. Both KV
+// version 1 and version 2 paths are supported, e.g. vault:secret/data/forklift#split.
+func (v *Vault) Resolve(ctx context.Context, reference string) (string, error) {
+	path, key, ok := strings.Cut(strings.TrimPrefix(reference, referencePrefix), "#")
+	if !ok || path == "" || key == "" {
+		return "", fmt.Errorf("%w: %q", errInvalidReference, reference)
+	}
+
+	var resp vaultResponse
+	if err := v.do(ctx, http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), nil, &resp); err != nil {
+		return "", fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	data := resp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", fmt.Errorf("%w: %s#%s", errMissingSecret, path, key)
+	}
+
+	if resp.LeaseID != "" && resp.Renewable {
+		v.mu.Lock()
+		_, renewing := v.leases[resp.LeaseID]
+		v.leases[resp.LeaseID] = time.Duration(resp.LeaseDuration) * time.Second
+		v.mu.Unlock()
+		if !renewing {
+			go v.maintainLease(resp.LeaseID, time.Duration(resp.LeaseDuration)*time.Second)
+		}
+	}
+	return value, nil
+}
+
+func (v *Vault) authenticate(ctx context.Context) (*vaultAuth, error) {
+	auth, err := v.login(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("vault login: %w", err)
+	}
+	v.mu.Lock()
+	v.token = auth.ClientToken
+	v.mu.Unlock()
+
+	// Static tokens don't report their TTL on login, so look it up.
+	if auth.LeaseDuration == 0 {
+		var resp vaultResponse
+		if err := v.do(ctx, http.MethodGet, "/v1/auth/token/lookup-self", nil, &resp); err == nil {
+			if ttl, ok := resp.Data["ttl"].(float64); ok {
+				auth.LeaseDuration = int(ttl)
+			}
+			auth.Renewable, _ = resp.Data["renewable"].(bool)
+		}
+	}
+	return auth, nil
+}
+
+// maintainToken renews the token before it expires, and logs in again if renewal fails or the
+// token isn't renewable. Tokens without a TTL are left alone.
+func (v *Vault) maintainToken(auth *vaultAuth) {
+	for auth.LeaseDuration > 0 {
+		time.Sleep(renewDelay(time.Duration(auth.LeaseDuration) * time.Second))
+
+		ctx := context.Background()
+		if auth.Renewable {
+			var resp vaultResponse
+			if err := v.do(ctx, http.MethodPost, "/v1/auth/token/renew-self", nil, &resp); err == nil && resp.Auth != nil {
+				auth = resp.Auth
+				continue
+			}
+		}
+		renewed, err := v.authenticate(ctx)
+		if err != nil {
+			// Retry soon; the current token may still be valid.
+			auth = &vaultAuth{LeaseDuration: int(minRenewDelay / time.Second), Renewable: auth.Renewable}
+			continue
+		}
+		auth = renewed
+	}
+}
+
+// maintainLease renews a secret lease until renewal fails, after which the secret expires.
+func (v *Vault) maintainLease(leaseID string, ttl time.Duration) {
+	defer func() {
+		v.mu.Lock()
+		delete(v.leases, leaseID)
+		v.mu.Unlock()
+	}()
+	for ttl > 0 {
+		time.Sleep(renewDelay(ttl))
+		var resp vaultResponse
+		body := map[string]interface{}{"lease_id": leaseID}
+		if err := v.do(context.Background(), http.MethodPut, "/v1/sys/leases/renew", body, &resp); err != nil {
+			return
+		}
+		ttl = time.Duration(resp.LeaseDuration) * time.Second
+	}
+}
+
+func renewDelay(ttl time.Duration) time.Duration {
+	delay := time.Duration(float64(ttl) * renewFraction)
+	if delay < minRenewDelay {
+		return minRenewDelay
+	}
+	return delay
+}
+
+func (v *Vault) kubernetesLogin(ctx context.Context, mountPath, role string) (*vaultAuth, error) {
+	jwt, err := os.ReadFile(kubernetesTokenPath)
+	if err != nil {
+		return nil, err
+	}
+	var resp vaultResponse
+	body := map[string]interface{}{"role": role, "jwt": strings.TrimSpace(string(jwt))}
+	if err := v.do(ctx, http.MethodPost, "/v1/auth/"+mountPath+"/login", body, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Auth == nil {
+		return nil, fmt.Errorf("%w: kubernetes login returned no token", errVaultStatus)
+	}
+	return resp.Auth, nil
+}
+
+func (v *Vault) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var payload *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	} else {
+		payload = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, v.address+path, payload)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	token := v.token
+	v.mu.Unlock()
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s", errVaultStatus, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Resolve replaces Vault references in the credentials of flag providers and event sinks, in the
+// privacy pepper, in the traffic and admin API tokens and in the introspection client secret,
+// with the secrets they point to. The configuration is not modified; a copy with resolved
+// credentials is returned.
+func Resolve(ctx context.Context, cfg *config.Config) (*config.Config, error) {
+	var references bool
+	for _, provider := range cfg.FlagProviders {
+		references = references || IsReference(provider.APIKey)
+	}
+	for _, sink := range cfg.EventSinks {
+		references = references || IsReference(sink.APIKey)
+	}
+	if cfg.Privacy != nil {
+		references = references || IsReference(cfg.Privacy.Pepper)
+	}
+	if cfg.TrafficAPI != nil {
+		references = references || IsReference(cfg.TrafficAPI.Token)
+	}
+	if cfg.AdminAPI != nil {
+		references = references || IsReference(cfg.AdminAPI.Token)
+		for _, token := range cfg.AdminAPI.Tokens {
+			references = references || IsReference(token.Token)
+		}
+		for _, user := range cfg.AdminAPI.Users {
+			references = references || IsReference(user.Password)
+		}
+	}
+	if cfg.Introspection != nil {
+		references = references || IsReference(cfg.Introspection.ClientSecret)
+	}
+	if !references {
+		return cfg, nil
+	}
+	if cfg.Vault == nil {
+		return nil, errMissingVault
+	}
+
+	vault, err := NewVault(ctx, cfg.Vault)
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := *cfg
+	resolved.FlagProviders = append([]config.FlagProvider(nil), cfg.FlagProviders...)
+	for i := range resolved.FlagProviders {
+		if err := resolveField(ctx, vault, &resolved.FlagProviders[i].APIKey); err != nil {
+			return nil, err
+		}
+	}
+	resolved.EventSinks = append([]config.EventSink(nil), cfg.EventSinks...)
+	for i := range resolved.EventSinks {
+		if err := resolveField(ctx, vault, &resolved.EventSinks[i].APIKey); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Privacy != nil {
+		privacy := *cfg.Privacy
+		if err := resolveField(ctx, vault, &privacy.Pepper); err != nil {
+			return nil, err
+		}
+		resolved.Privacy = &privacy
+	}
+	if cfg.TrafficAPI != nil {
+		trafficAPI := *cfg.TrafficAPI
+		if err := resolveField(ctx, vault, &trafficAPI.Token); err != nil {
+			return nil, err
+		}
+		resolved.TrafficAPI = &trafficAPI
+	}
+	if cfg.AdminAPI != nil {
+		adminAPI := *cfg.AdminAPI
+		if err := resolveField(ctx, vault, &adminAPI.Token); err != nil {
+			return nil, err
+		}
+		adminAPI.Tokens = append([]config.AdminToken(nil), cfg.AdminAPI.Tokens...)
+		for i := range adminAPI.Tokens {
+			if err := resolveField(ctx, vault, &adminAPI.Tokens[i].Token); err != nil {
+				return nil, err
+			}
+		}
+		adminAPI.Users = append([]config.AdminUser(nil), cfg.AdminAPI.Users...)
+		for i := range adminAPI.Users {
+			if err := resolveField(ctx, vault, &adminAPI.Users[i].Password); err != nil {
+				return nil, err
+			}
+		}
+		resolved.AdminAPI = &adminAPI
+	}
+	if cfg.Introspection != nil {
+		introspection := *cfg.Introspection
+		if err := resolveField(ctx, vault, &introspection.ClientSecret); err != nil {
+			return nil, err
+		}
+		resolved.Introspection = &introspection
+	}
+	return &resolved, nil
+}
+
+func resolveField(ctx context.Context, vault *Vault, field *string) error {
+	if !IsReference(*field) {
+		return nil
+	}
+	value, err := vault.Resolve(ctx, *field)
+	if err != nil {
+		return err
+	}
+	*field = value
+	return nil
+}
@@ -0,0 +1,319 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/flags"
+	"github.com/daemonp/forklift/store"
+)
+
+var (
+	errShuttingDown           = errors.New("shutting down")
+	errInvalidShutdownTimeout = errors.New("invalid shutdown timeout")
+)
+
+const (
+	defaultShutdownTimeout = 10 * time.Second
+	drainPollInterval      = 10 * time.Millisecond
+	shutdownRetryAfter     = "5"
+	maxUnsavedAssignments  = 10000
+)
+
+// lifecycle tracks the requests in flight and the shutdown of the middleware. It is shared by
+// the middleware and the copies created for each bundle version.
+type lifecycle struct {
+	inFlight atomic.Int64
+	closing  atomic.Bool
+	timeout  time.Duration
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newLifecycle(timeout string) (*lifecycle, error) {
+	l := &lifecycle{timeout: defaultShutdownTimeout, done: make(chan struct{})}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("%w: %s", errInvalidShutdownTimeout, timeout)
+		}
+		l.timeout = d
+	}
+	return l, nil
+}
+
+// enter counts a request in flight, unless the middleware is shutting down.
+func (l *lifecycle) enter() bool {
+	l.inFlight.Add(1)
+	if l.closing.Load() {
+		l.leave()
+		return false
+	}
+	return true
+}
+
+func (l *lifecycle) leave() {
+	l.inFlight.Add(-1)
+}
+
+// drain waits until no requests are in flight or ctx is done.
+func (l *lifecycle) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for l.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %d requests still in flight", ctx.Err(), l.inFlight.Load())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// unsavedAssignments holds the session assignments the session store failed to save or has yet
+// to save, so sessions keep their backend while the store is unavailable. They are saved on
+// shutdown.
+type unsavedAssignments struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func newUnsavedAssignments() *unsavedAssignments {
+	return &unsavedAssignments{entries: make(map[string]string)}
+}
+
+// add keeps an assignment, unless maxUnsavedAssignments are already held.
+func (u *unsavedAssignments) add(key, backend string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.entries[key]; ok || len(u.entries) < maxUnsavedAssignments {
+		u.entries[key] = backend
+	}
+}
+
+func (u *unsavedAssignments) get(key string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	backend, ok := u.entries[key]
+	return backend, ok
+}
+
+func (u *unsavedAssignments) remove(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.entries, key)
+}
+
+// saved removes an assignment once it is saved, unless the session was assigned another backend
+// meanwhile.
+func (u *unsavedAssignments) saved(key, backend string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.entries[key] == backend {
+		delete(u.entries, key)
+	}
+}
+
+// take removes and returns all assignments.
+func (u *unsavedAssignments) take() []store.Entry {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries := make([]store.Entry, 0, len(u.entries))
+	for key, backend := range u.entries {
+		entries = append(entries, store.Entry{Key: key, Value: backend})
+	}
+	u.entries = make(map[string]string)
+	return entries
+}
+
+// storedAssignment returns the backend assigned to the session under key, from the assignment
+// cache, the session store or the assignments the store failed to save. The error reports that
+// the store couldn't be read.
+func (a *Forklift) storedAssignment(ctx context.Context, key string) (string, bool, error) {
+	backend, found, cached := "", false, false
+	if a.assignments != nil {
+		backend, found, cached = a.assignments.get(key, a.now())
+	}
+	var err error
+	if !cached {
+		backend, found, err = a.sessionStore.Get(ctx, key)
+		if err != nil {
+			a.logger.Errorf("Error reading session assignment: %v", err)
+		} else if a.assignments != nil {
+			a.assignments.put(key, backend, found, a.now())
+		}
+	}
+	if !found {
+		backend, found = a.unsaved.get(key)
+	}
+	return backend, found, err
+}
+
+// saveAssignment stores the backend assigned to the session under key, or queues it when the
+// store is written behind. Assignments the store fails to save are kept in memory and saved
+// again on shutdown.
+func (a *Forklift) saveAssignment(ctx context.Context, key, backend string) {
+	if a.assignments != nil {
+		a.assignments.put(key, backend, true, a.now())
+	}
+	if a.writer != nil && a.writer.enqueue(key, backend) {
+		return
+	}
+	if err := a.sessionStore.Set(ctx, key, backend, a.storeOptions.TTL); err != nil {
+		a.logger.Errorf("Error storing session assignment: %v", err)
+		a.unsaved.add(key, backend)
+		return
+	}
+	a.unsaved.remove(key)
+}
+
+// addAssignment stores the backend assigned to a session that has no stored assignment, unless
+// another instance assigned the session meanwhile, and returns the backend the session is
+// assigned. Stores that can't write only new keys, and assignments written behind, take the last
+// backend written instead.
+func (a *Forklift) addAssignment(ctx context.Context, key, backend string) string {
+	adder, ok := a.sessionStore.(store.Adder)
+	if !ok || a.writer != nil {
+		a.saveAssignment(ctx, key, backend)
+		return backend
+	}
+	added, err := adder.Add(ctx, key, backend, a.storeOptions.TTL)
+	switch {
+	case err != nil:
+		a.logger.Errorf("Error storing session assignment: %v", err)
+		a.unsaved.add(key, backend)
+	case added:
+		a.unsaved.remove(key)
+	default:
+		// The assignment of the other instance is cached instead, but only once it can be read,
+		// e.g. from a replica.
+		stored, found, err := a.sessionStore.Get(ctx, key)
+		if err != nil || !found {
+			return backend
+		}
+		backend = stored
+	}
+	if a.assignments != nil {
+		a.assignments.put(key, backend, true, a.now())
+	}
+	return backend
+}
+
+// Shutdown stops the middleware gracefully. New requests are answered with 503 Service
+// Unavailable and the readiness check fails, while requests in flight are given until ctx is
+// done to finish. Then queued session assignments are written, those the store failed to save
+// are saved again, the exposures queued for event sinks and the events queued by flag providers
+// are flushed, and the experiment results of the current period are exported.
+// Exposures that can't be delivered stay in the on-disk buffer of their sink, if it has one.
+//
+// The middleware shuts down on its own when the context it was created with is done, waiting up
+// to shutdownTimeout. Calling Shutdown again waits for the same shutdown to complete.
+func (a *Forklift) Shutdown(ctx context.Context) error {
+	l := a.lifecycle
+	l.once.Do(func() {
+		go func() {
+			l.err = a.shutdown(ctx)
+			close(l.done)
+		}()
+	})
+	select {
+	case <-l.done:
+		return l.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdownOnDone shuts the middleware down once ctx is done.
+func (a *Forklift) shutdownOnDone(ctx context.Context) {
+	if ctx.Done() == nil {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), a.lifecycle.timeout)
+		defer cancel()
+		if err := a.Shutdown(shutdownCtx); err != nil {
+			a.logger.Errorf("Error shutting down: %v", err)
+		}
+	}()
+}
+
+func (a *Forklift) shutdown(ctx context.Context) error {
+	a.lifecycle.closing.Store(true)
+	a.logger.Infof("Shutting down Forklift middleware: %s", a.name)
+
+	var first error
+	record := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if a.leader != nil {
+		record(a.leader.release(ctx))
+	}
+	record(a.lifecycle.drain(ctx))
+	if a.writer != nil {
+		record(a.writer.close(ctx))
+	}
+	record(a.saveUnsavedAssignments(ctx))
+	if a.exposures != nil {
+		for _, sink := range a.exposures.sinks {
+			record(sink.Close(ctx))
+		}
+	}
+	if a.results != nil {
+		record(a.results.export(ctx, a.now()))
+	}
+	if a.counters != nil {
+		a.counters.flush(ctx)
+	}
+	for name, provider := range a.flagProviders {
+		if closer, ok := provider.Provider.(flags.Closer); ok {
+			if err := closer.Close(ctx); err != nil {
+				record(fmt.Errorf("flag provider %s: %w", name, err))
+			}
+		}
+	}
+	return first
+}
+
+// saveUnsavedAssignments saves the assignments the session store failed to save, in one batch
+// if the store supports it.
+func (a *Forklift) saveUnsavedAssignments(ctx context.Context) error {
+	entries := a.unsaved.take()
+	if a.sessionStore == nil || len(entries) == 0 {
+		return nil
+	}
+	if batch, ok := a.sessionStore.(store.BatchSetter); ok {
+		if err := batch.SetMany(ctx, entries, a.storeOptions.TTL); err != nil {
+			return fmt.Errorf("saving %d session assignments: %w", len(entries), err)
+		}
+		return nil
+	}
+	failed := 0
+	var last error
+	for _, entry := range entries {
+		if err := a.sessionStore.Set(ctx, entry.Key, entry.Value, a.storeOptions.TTL); err != nil {
+			failed++
+			last = err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("saving %d of %d session assignments: %w", failed, len(entries), last)
+	}
+	return nil
+}
+
+// serveShuttingDown answers requests that arrive while the middleware shuts down.
+func serveShuttingDown(rw http.ResponseWriter) {
+	rw.Header().Set("Retry-After", shutdownRetryAfter)
+	http.Error(rw, "Service Unavailable", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,251 @@
+package forklift
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+)
+
+var (
+	errInvalidSPIFFE   = errors.New("invalid SPIFFE configuration")
+	errInvalidSVID     = errors.New("invalid SVID")
+	errSVIDExpired     = errors.New("SVID expired")
+	errUntrustedServer = errors.New("backend SVID not trusted")
+)
+
+const (
+	defaultSVIDReloadInterval = 10 * time.Second
+	spiffeScheme              = "spiffe://"
+)
+
+// svidSource holds the X.509 SVID the middleware presents to backends and the trust bundle their
+// SVIDs are verified with. It reloads them when a spiffe-helper sidecar rotates the files.
+type svidSource struct {
+	certFile   string
+	keyFile    string
+	bundleFile string
+	// trustDomain is the trust domain of backend SVIDs, and allowedIDs the SPIFFE IDs accepted
+	// for backends when it is not empty.
+	trustDomain string
+	allowedIDs  map[string]bool
+	interval    time.Duration
+	logger      logger.Logger
+	rotations   *metrics.CounterVec
+	// rotated is called once the SVID changed, to close idle connections that still use the
+	// previous one.
+	rotated func()
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	roots    *x509.CertPool
+	expires  time.Time
+	modTimes [3]time.Time
+}
+
+// newSVIDSource loads the configured SVID, and returns nil when SPIFFE is not configured.
+func newSVIDSource(cfg *config.SPIFFE, logger logger.Logger, registry *metrics.Registry) (*svidSource, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	if cfg.CertFile == "" || cfg.KeyFile == "" || cfg.BundleFile == "" {
+		return nil, fmt.Errorf("%w: certFile, keyFile and bundleFile are required", errInvalidSPIFFE)
+	}
+	if cfg.TrustDomain == "" || strings.ContainsAny(cfg.TrustDomain, ":/") {
+		return nil, fmt.Errorf("%w: invalid trust domain %q", errInvalidSPIFFE, cfg.TrustDomain)
+	}
+	s := &svidSource{
+		certFile:    cfg.CertFile,
+		keyFile:     cfg.KeyFile,
+		bundleFile:  cfg.BundleFile,
+		trustDomain: cfg.TrustDomain,
+		allowedIDs:  make(map[string]bool, len(cfg.AllowedIDs)),
+		interval:    defaultSVIDReloadInterval,
+		logger:      logger,
+	}
+	for _, id := range cfg.AllowedIDs {
+		if !strings.HasPrefix(id, spiffeScheme+cfg.TrustDomain+"/") {
+			return nil, fmt.Errorf("%w: %s is not in trust domain %s", errInvalidSPIFFE, id, cfg.TrustDomain)
+		}
+		s.allowedIDs[id] = true
+	}
+	if cfg.ReloadInterval != "" {
+		interval, err := time.ParseDuration(cfg.ReloadInterval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("%w: reload interval %s", errInvalidSPIFFE, cfg.ReloadInterval)
+		}
+		s.interval = interval
+	}
+	if _, err := s.load(); err != nil {
+		return nil, err
+	}
+	s.rotations = registry.Counter("forklift_svid_reloads_total",
+		"Number of SVID reloads by result: rotated or failed.", "result")
+	return s, nil
+}
+
+// load reads the SVID, its key and the trust bundle if any of their files changed since they
+// were last read. It reports whether they were reloaded.
+func (s *svidSource) load() (bool, error) {
+	var modTimes [3]time.Time
+	for i, path := range []string{s.certFile, s.keyFile, s.bundleFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	s.mu.RLock()
+	unchanged := modTimes == s.modTimes
+	s.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errInvalidSVID, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errInvalidSVID, err)
+	}
+	if _, err := spiffeID(leaf); err != nil {
+		return false, err
+	}
+	cert.Leaf = leaf
+	bundle, err := os.ReadFile(s.bundleFile)
+	if err != nil {
+		return false, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return false, fmt.Errorf("%w: no certificates in trust bundle %s", errInvalidSVID, s.bundleFile)
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.roots = roots
+	s.expires = leaf.NotAfter
+	s.modTimes = modTimes
+	s.mu.Unlock()
+	return true, nil
+}
+
+// watch reloads the SVID every interval until done is closed. A SVID that fails to load leaves
+// the previous one in use.
+func (s *svidSource) watch(done <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := s.load()
+			switch {
+			case err != nil:
+				s.logger.Errorf("Error reloading SVID: %v", err)
+				s.rotations.Inc("failed")
+			case reloaded:
+				s.logger.Infof("Rotated SVID, valid until %s", s.expiry().Format(time.RFC3339))
+				s.rotations.Inc("rotated")
+				if s.rotated != nil {
+					s.rotated()
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *svidSource) expiry() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.expires
+}
+
+// ready reports an error once the SVID expired without being rotated.
+func (s *svidSource) ready(now time.Time) error {
+	if expires := s.expiry(); !now.Before(expires) {
+		return fmt.Errorf("%w at %s", errSVIDExpired, expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// transport returns a transport presenting the SVID to backends and verifying theirs. Backend
+// SVIDs identify workloads by their SPIFFE ID rather than their host name, so the standard
+// verification is replaced by one against the trust bundle and the allowed IDs.
+func (s *svidSource) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.cert, nil
+		},
+		InsecureSkipVerify:    true, //nolint:gosec // Verified by verifyBackend.
+		VerifyPeerCertificate: s.verifyBackend,
+	}
+	s.rotated = transport.CloseIdleConnections
+	return transport
+}
+
+// verifyBackend verifies the chain of a backend's SVID against the trust bundle and checks its
+// SPIFFE ID.
+func (s *svidSource) verifyBackend(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%w: no certificate", errUntrustedServer)
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errUntrustedServer, err)
+		}
+		certs[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	s.mu.RLock()
+	roots := s.roots
+	s.mu.RUnlock()
+	if _, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("%w: %v", errUntrustedServer, err)
+	}
+
+	id, err := spiffeID(certs[0])
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(id, spiffeScheme+s.trustDomain+"/") {
+		return fmt.Errorf("%w: %s is not in trust domain %s", errUntrustedServer, id, s.trustDomain)
+	}
+	if len(s.allowedIDs) > 0 && !s.allowedIDs[id] {
+		return fmt.Errorf("%w: %s is not allowed", errUntrustedServer, id)
+	}
+	return nil
+}
+
+// spiffeID returns the SPIFFE ID of an SVID, its only URI SAN.
+func spiffeID(cert *x509.Certificate) (string, error) {
+	if len(cert.URIs) != 1 || cert.URIs[0].Scheme != "spiffe" {
+		return "", fmt.Errorf("%w: an SVID has exactly one spiffe:// URI SAN", errInvalidSVID)
+	}
+	return cert.URIs[0].String(), nil
+}
@@ -0,0 +1,99 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var errInvalidStaticBody = errors.New("invalid static body")
+
+const (
+	defaultStaticStatus = http.StatusServiceUnavailable
+	// staticBodyTimeout bounds fetching the body of a static response from its URL.
+	staticBodyTimeout = 10 * time.Second
+	// maxStaticBodySize is the largest body fetched from a URL.
+	maxStaticBodySize = 1 << 20
+)
+
+// loadStaticBodies reads the body files, or fetches the body URLs, of static rules and of the
+// error pages of rules, so they are served from memory.
+func loadStaticBodies(rules []RoutingRule) error {
+	for _, rule := range rules {
+		if err := loadStaticBody(rule.Static); err != nil {
+			return err
+		}
+		if rule.InterceptErrors != nil {
+			if err := loadStaticBody(rule.InterceptErrors.Page); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func loadStaticBody(static *config.StaticResponse) error {
+	if static == nil {
+		return nil
+	}
+	if static.BodyFile != "" && static.BodyURL != "" {
+		return fmt.Errorf("%w: only one of bodyFile or bodyURL can be set", errInvalidStaticBody)
+	}
+	if static.BodyURL != "" {
+		return fetchStaticBody(static)
+	}
+	if static.BodyFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(static.BodyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read static body file %s: %w", static.BodyFile, err)
+	}
+	static.Body = string(data)
+	return nil
+}
+
+// fetchStaticBody fetches the body of a static response from its URL, which must answer 200.
+func fetchStaticBody(static *config.StaticResponse) error {
+	client := &http.Client{Timeout: staticBodyTimeout}
+	resp, err := client.Get(static.BodyURL)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidStaticBody, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s answered %d", errInvalidStaticBody, static.BodyURL, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxStaticBodySize+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errInvalidStaticBody, err)
+	}
+	if len(data) > maxStaticBodySize {
+		return fmt.Errorf("%w: %s is larger than %d bytes", errInvalidStaticBody, static.BodyURL, maxStaticBodySize)
+	}
+	static.Body = string(data)
+	return nil
+}
+
+func staticStatus(static *config.StaticResponse) int {
+	if static.Status == 0 {
+		return defaultStaticStatus
+	}
+	return static.Status
+}
+
+// serveStatic writes the configured static response instead of proxying the request.
+func (a *Forklift) serveStatic(rw http.ResponseWriter, static *config.StaticResponse) {
+	for key, value := range static.Headers {
+		rw.Header().Set(key, value)
+	}
+	rw.WriteHeader(staticStatus(static))
+	if _, err := io.WriteString(rw, static.Body); err != nil {
+		a.logger.Errorf("Error writing static response: %v", err)
+	}
+}
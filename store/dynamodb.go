@@ -0,0 +1,282 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/awsauth"
+)
+
+var errDynamoDBResponse = errors.New("dynamodb request failed")
+
+const (
+	dynamoDBTargetPrefix     = "DynamoDB_20120810."
+	dynamoDBBatchLimit       = 25
+	dynamoDBMaxBatchAttempts = 5
+	dynamoDBConditionFailed  = "ConditionalCheckFailedException"
+)
+
+// DynamoDBStore is a SessionStore backed by a DynamoDB table with a string partition key
+// named "pk". Items carry the assignment in "value" and a Unix expiry in "expires", which can
+// be enabled as the table's TTL attribute.
+//
+// Add only writes when no live item exists, so the first instance to assign a session wins and
+// concurrent instances cannot overwrite each other.
+type DynamoDBStore struct {
+	table       string
+	region      string
+	endpoint    string
+	client      *http.Client
+	credentials *awsauth.CredentialProvider
+	now         func() time.Time
+}
+
+// NewDynamoDBStore creates a store for the given table. The endpoint defaults to the regional
+// DynamoDB endpoint and can be overridden, e.g. for DynamoDB Local.
+func NewDynamoDBStore(table, region, endpoint string, timeout time.Duration) *DynamoDBStore {
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + region + ".amazonaws.com"
+	}
+	client := &http.Client{Timeout: timeout}
+	return &DynamoDBStore{
+		table:       table,
+		region:      region,
+		endpoint:    strings.TrimRight(endpoint, "/"),
+		client:      client,
+		credentials: awsauth.NewCredentialProvider(client),
+		now:         time.Now,
+	}
+}
+
+// SetClock replaces the clock used for expiration times. It must be called before the store is used.
+func (d *DynamoDBStore) SetClock(now func() time.Time) {
+	d.now = now
+}
+
+type dynamoDBAttribute struct {
+	S string `json:"S,omitempty"`
+	N string `json:"N,omitempty"`
+}
+
+type dynamoDBItem map[string]dynamoDBAttribute
+
+// Get implements SessionStore.
+func (d *DynamoDBStore) Get(ctx context.Context, key string) (string, bool, error) {
+	var resp struct {
+		Item dynamoDBItem `json:"Item"`
+	}
+	err := d.call(ctx, "GetItem", map[string]interface{}{
+		"TableName": d.table,
+		"Key":       dynamoDBItem{"pk": {S: key}},
+	}, &resp)
+	if err != nil || resp.Item == nil {
+		return "", false, err
+	}
+
+	// Expired items may linger until DynamoDB's TTL process deletes them.
+	expires, err := strconv.ParseInt(resp.Item["expires"].N, 10, 64)
+	if err == nil && expires <= d.now().Unix() {
+		return "", false, nil
+	}
+	return resp.Item["value"].S, true, nil
+}
+
+// Set implements SessionStore.
+func (d *DynamoDBStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	return d.call(ctx, "PutItem", map[string]interface{}{
+		"TableName": d.table,
+		"Item":      d.item(key, value, ttl),
+	}, nil)
+}
+
+// Add implements Adder with a conditional write, which succeeds when no live item exists. Expiry
+// times are in whole seconds.
+func (d *DynamoDBStore) Add(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	err := d.call(ctx, "PutItem", map[string]interface{}{
+		"TableName":           d.table,
+		"Item":                d.item(key, value, ttl),
+		"ConditionExpression": "attribute_not_exists(pk) OR expires <= :now",
+		"ExpressionAttributeValues": dynamoDBItem{
+			":now": {N: strconv.FormatInt(d.now().Unix(), 10)},
+		},
+	}, nil)
+	if err != nil && strings.Contains(err.Error(), dynamoDBConditionFailed) {
+		// Another instance already holds a live assignment for this key.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// SetMany implements BatchSetter.
+func (d *DynamoDBStore) SetMany(ctx context.Context, entries []Entry, ttl time.Duration) error {
+	for start := 0; start < len(entries); start += dynamoDBBatchLimit {
+		end := start + dynamoDBBatchLimit
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		requests := make([]map[string]interface{}, 0, end-start)
+		for _, entry := range entries[start:end] {
+			requests = append(requests, map[string]interface{}{
+				"PutRequest": map[string]interface{}{"Item": d.item(entry.Key, entry.Value, ttl)},
+			})
+		}
+		if err := d.batchWrite(ctx, requests); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan implements Scanner. It pages through a Scan of the table, filtered by key prefix and
+// expiry, so it reads the whole table.
+func (d *DynamoDBStore) Scan(ctx context.Context, prefix string, fn func(Entry) error) error {
+	var startKey dynamoDBItem
+	for {
+		in := map[string]interface{}{
+			"TableName":        d.table,
+			"FilterExpression": "begins_with(pk, :prefix) AND expires > :now",
+			"ExpressionAttributeValues": dynamoDBItem{
+				":prefix": {S: prefix},
+				":now":    {N: strconv.FormatInt(d.now().Unix(), 10)},
+			},
+		}
+		if startKey != nil {
+			in["ExclusiveStartKey"] = startKey
+		}
+		var resp struct {
+			Items            []dynamoDBItem `json:"Items"`
+			LastEvaluatedKey dynamoDBItem   `json:"LastEvaluatedKey"`
+		}
+		if err := d.call(ctx, "Scan", in, &resp); err != nil {
+			return err
+		}
+		for _, item := range resp.Items {
+			if err := fn(Entry{Key: item["pk"].S, Value: item["value"].S}); err != nil {
+				return err
+			}
+		}
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		startKey = resp.LastEvaluatedKey
+	}
+}
+
+// batchWrite sends a BatchWriteItem request, retrying unprocessed items with backoff.
+func (d *DynamoDBStore) batchWrite(ctx context.Context, requests []map[string]interface{}) error {
+	backoff := 50 * time.Millisecond
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt == dynamoDBMaxBatchAttempts {
+			return fmt.Errorf("%w: %d items left unprocessed", errDynamoDBResponse, len(requests))
+		}
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		var resp struct {
+			UnprocessedItems map[string][]map[string]interface{} `json:"UnprocessedItems"`
+		}
+		err := d.call(ctx, "BatchWriteItem", map[string]interface{}{
+			"RequestItems": map[string]interface{}{d.table: requests},
+		}, &resp)
+		if err != nil {
+			return err
+		}
+		requests = resp.UnprocessedItems[d.table]
+	}
+	return nil
+}
+
+// Lease implements Leaser with a conditional write, which succeeds when no live lease exists or
+// the holder has it. Expiry times are in whole seconds.
+func (d *DynamoDBStore) Lease(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	err := d.call(ctx, "PutItem", map[string]interface{}{
+		"TableName":                d.table,
+		"Item":                     d.item(key, holder, ttl),
+		"ConditionExpression":      "attribute_not_exists(pk) OR expires <= :now OR #value = :holder",
+		"ExpressionAttributeNames": map[string]string{"#value": "value"},
+		"ExpressionAttributeValues": dynamoDBItem{
+			":now":    {N: strconv.FormatInt(d.now().Unix(), 10)},
+			":holder": {S: holder},
+		},
+	}, nil)
+	if err != nil && strings.Contains(err.Error(), dynamoDBConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Release implements Leaser.
+func (d *DynamoDBStore) Release(ctx context.Context, key, holder string) error {
+	err := d.call(ctx, "DeleteItem", map[string]interface{}{
+		"TableName":                 d.table,
+		"Key":                       dynamoDBItem{"pk": {S: key}},
+		"ConditionExpression":       "#value = :holder",
+		"ExpressionAttributeNames":  map[string]string{"#value": "value"},
+		"ExpressionAttributeValues": dynamoDBItem{":holder": {S: holder}},
+	}, nil)
+	if err != nil && strings.Contains(err.Error(), dynamoDBConditionFailed) {
+		return nil
+	}
+	return err
+}
+
+func (d *DynamoDBStore) item(key, value string, ttl time.Duration) dynamoDBItem {
+	return dynamoDBItem{
+		"pk":      {S: key},
+		"value":   {S: value},
+		"expires": {N: strconv.FormatInt(d.now().Add(ttl).Unix(), 10)},
+	}
+}
+
+// call sends a signed DynamoDB API request and decodes the response into out.
+func (d *DynamoDBStore) call(ctx context.Context, operation string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	creds, err := d.credentials.Credentials(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", dynamoDBTargetPrefix+operation)
+	awsauth.SignRequest(req, payload, creds, d.region, "dynamodb", d.now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%w: %s %s: %s", errDynamoDBResponse, operation, apiErr.Type, apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
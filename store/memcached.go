@@ -0,0 +1,269 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errMemcachedResponse = errors.New("unexpected memcached response")
+
+const (
+	memcachedVirtualNodes = 160
+	memcachedMaxIdle      = 8
+	memcachedMaxKeyLength = 250
+	// memcachedMaxRelativeTTL is the longest expiration memcached accepts as relative seconds;
+	// longer expirations must be sent as a Unix timestamp.
+	memcachedMaxRelativeTTL = 30 * 24 * time.Hour
+)
+
+// MemcachedStore is a SessionStore backed by one or more memcached servers. Keys are
+// distributed across servers with a consistent hash ring, so adding or removing a server
+// only moves a fraction of the assignments.
+type MemcachedStore struct {
+	ring    *hashRing
+	timeout time.Duration
+	pools   map[string]chan net.Conn
+	now     func() time.Time
+}
+
+// NewMemcachedStore creates a store for the given server addresses (host:port).
+func NewMemcachedStore(servers []string, timeout time.Duration) *MemcachedStore {
+	pools := make(map[string]chan net.Conn, len(servers))
+	for _, server := range servers {
+		pools[server] = make(chan net.Conn, memcachedMaxIdle)
+	}
+	return &MemcachedStore{
+		ring:    newHashRing(servers),
+		timeout: timeout,
+		pools:   pools,
+		now:     time.Now,
+	}
+}
+
+// SetClock replaces the clock used for expiration times. It must be called before the store is used.
+func (m *MemcachedStore) SetClock(now func() time.Time) {
+	m.now = now
+}
+
+// Get implements SessionStore.
+func (m *MemcachedStore) Get(ctx context.Context, key string) (string, bool, error) {
+	key = memcachedKey(key)
+	var value string
+	var found bool
+	err := m.do(ctx, key, func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "get %s\r\n", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		var err error
+		value, found, err = readGetResponse(rw.Reader)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return value, found, nil
+}
+
+// Set implements SessionStore.
+func (m *MemcachedStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := m.store(ctx, "set", key, value, ttl)
+	return err
+}
+
+// Add implements Adder with the add command.
+func (m *MemcachedStore) Add(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return m.store(ctx, "add", key, value, ttl)
+}
+
+// store runs a storage command, and reports whether the value was stored.
+func (m *MemcachedStore) store(ctx context.Context, command, key, value string, ttl time.Duration) (bool, error) {
+	key = memcachedKey(key)
+	var stored bool
+	err := m.do(ctx, key, func(rw *bufio.ReadWriter) error {
+		if _, err := fmt.Fprintf(rw, "%s %s 0 %d %d\r\n%s\r\n", command, key, m.expiration(ttl), len(value), value); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			stored = true
+		case "NOT_STORED":
+		default:
+			return fmt.Errorf("%w: %s", errMemcachedResponse, line)
+		}
+		return nil
+	})
+	return stored, err
+}
+
+// expiration converts a TTL to memcached's expiration format.
+func (m *MemcachedStore) expiration(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcachedMaxRelativeTTL {
+		return m.now().Add(ttl).Unix()
+	}
+	return int64(ttl / time.Second)
+}
+
+// do runs a command against the server owning key, reusing an idle connection when possible.
+func (m *MemcachedStore) do(ctx context.Context, key string, command func(rw *bufio.ReadWriter) error) error {
+	server := m.ring.get(key)
+	conn, err := m.conn(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(m.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := command(rw); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if rw.Reader.Buffered() > 0 {
+		// Unread data means the connection is out of sync with the protocol.
+		_ = conn.Close()
+		return nil
+	}
+	m.release(server, conn)
+	return nil
+}
+
+func (m *MemcachedStore) conn(ctx context.Context, server string) (net.Conn, error) {
+	select {
+	case conn := <-m.pools[server]:
+		return conn, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: m.timeout}
+	return dialer.DialContext(ctx, "tcp", server)
+}
+
+func (m *MemcachedStore) release(server string, conn net.Conn) {
+	select {
+	case m.pools[server] <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// readGetResponse parses the response to a single-key get command.
+func readGetResponse(r *bufio.Reader) (string, bool, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", false, err
+	}
+	if line == "END" {
+		return "", false, nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "VALUE" {
+		return "", false, fmt.Errorf("%w: %s", errMemcachedResponse, line)
+	}
+	size, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return "", false, fmt.Errorf("%w: %s", errMemcachedResponse, line)
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", false, err
+	}
+	end, err := readLine(r)
+	if err != nil {
+		return "", false, err
+	}
+	if end != "END" {
+		return "", false, fmt.Errorf("%w: %s", errMemcachedResponse, end)
+	}
+	return string(data[:size]), true, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// memcachedKey returns a key that is valid for the memcached text protocol, hashing keys that
+// are too long or contain whitespace or control characters.
+func memcachedKey(key string) string {
+	valid := len(key) <= memcachedMaxKeyLength
+	for i := 0; valid && i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			valid = false
+		}
+	}
+	if valid {
+		return key
+	}
+	h := fnv.New128a()
+	_, _ = h.Write([]byte(key))
+	return fmt.Sprintf("forklift:%x", h.Sum(nil))
+}
+
+// hashRing maps keys to servers using consistent hashing with virtual nodes.
+type hashRing struct {
+	points  []uint32
+	servers map[uint32]string
+}
+
+func newHashRing(servers []string) *hashRing {
+	ring := &hashRing{servers: make(map[uint32]string, len(servers)*memcachedVirtualNodes)}
+	for _, server := range servers {
+		for i := 0; i < memcachedVirtualNodes; i++ {
+			point := crc32.ChecksumIEEE([]byte(server + "-" + strconv.Itoa(i)))
+			if _, exists := ring.servers[point]; exists {
+				continue
+			}
+			ring.servers[point] = server
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool {
+		return ring.points[i] < ring.points[j]
+	})
+	return ring
+}
+
+func (r *hashRing) get(key string) string {
+	hashValue := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hashValue
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.servers[r.points[i]]
+}
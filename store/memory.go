@@ -0,0 +1,167 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a SessionStore kept in process memory. Assignments are not shared between
+// instances and are lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]memoryEntry
+	counters  map[string]*memoryCounters
+	now       func() time.Time
+	lastSweep time.Time
+}
+
+// sweepInterval is the minimum time between removals of expired entries.
+const sweepInterval = time.Minute
+
+type memoryEntry struct {
+	value   string
+	expires time.Time
+}
+
+type memoryCounters struct {
+	fields  map[string]int64
+	expires time.Time
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:  make(map[string]memoryEntry),
+		counters: make(map[string]*memoryCounters),
+		now:      time.Now,
+	}
+}
+
+// SetClock replaces the clock used for expiration times. It must be called before the store is used.
+func (m *MemoryStore) SetClock(now func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+// Get implements SessionStore.
+func (m *MemoryStore) Get(_ context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[key]
+	if !ok {
+		return "", false, nil
+	}
+	if !m.now().Before(entry.expires) {
+		delete(m.entries, key)
+		return "", false, nil
+	}
+	return entry.value, true, nil
+}
+
+// Set implements SessionStore.
+func (m *MemoryStore) Set(_ context.Context, key, value string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+	if now.Sub(m.lastSweep) >= sweepInterval {
+		m.sweep(now)
+	}
+	return nil
+}
+
+// Add implements Adder.
+func (m *MemoryStore) Add(_ context.Context, key, value string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if entry, ok := m.entries[key]; ok && now.Before(entry.expires) {
+		return false, nil
+	}
+	m.entries[key] = memoryEntry{value: value, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Scan implements Scanner. It lists a snapshot of the entries, so fn may use the store.
+func (m *MemoryStore) Scan(_ context.Context, prefix string, fn func(Entry) error) error {
+	m.mu.Lock()
+	now := m.now()
+	var entries []Entry
+	for key, entry := range m.entries {
+		if strings.HasPrefix(key, prefix) && now.Before(entry.expires) {
+			entries = append(entries, Entry{Key: key, Value: entry.value})
+		}
+	}
+	m.mu.Unlock()
+
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lease implements Leaser.
+func (m *MemoryStore) Lease(_ context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if entry, ok := m.entries[key]; ok && now.Before(entry.expires) && entry.value != holder {
+		return false, nil
+	}
+	m.entries[key] = memoryEntry{value: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// Release implements Leaser.
+func (m *MemoryStore) Release(_ context.Context, key, holder string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.entries[key].value == holder {
+		delete(m.entries, key)
+	}
+	return nil
+}
+
+// Count implements Counter.
+func (m *MemoryStore) Count(_ context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	counters := m.counters[key]
+	if counters == nil || (!counters.expires.IsZero() && !now.Before(counters.expires)) {
+		counters = &memoryCounters{fields: make(map[string]int64)}
+		m.counters[key] = counters
+	}
+	for field, increment := range increments {
+		counters.fields[field] += increment
+	}
+	if len(increments) > 0 && ttl > 0 {
+		counters.expires = now.Add(ttl)
+	}
+	totals := make(map[string]int64, len(counters.fields))
+	for field, total := range counters.fields {
+		totals[field] = total
+	}
+	return totals, nil
+}
+
+// sweep removes expired entries. The caller must hold the lock.
+func (m *MemoryStore) sweep(now time.Time) {
+	m.lastSweep = now
+	for key, entry := range m.entries {
+		if !now.Before(entry.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errRedisResponse = errors.New("unexpected redis response")
+
+const (
+	redisMaxIdle = 8
+	// redisScanCount is the number of keys each SCAN iteration asks for.
+	redisScanCount = "500"
+)
+
+// RedisStore is a SessionStore backed by a Redis primary and, optionally, its read replicas.
+// Reads go to the replicas in turn and fall back to the primary when a replica can't be
+// reached, while writes always go to the primary.
+//
+// Replicas may lag behind the primary, e.g. when they are in another region, so a session can
+// miss its assignment on a replica until it has been replicated. Add only writes when no
+// assignment exists, so the assignment made in the meantime, which is derived from the same
+// hash of the session ID, never replaces the one on the primary.
+type RedisStore struct {
+	primary  string
+	replicas []string
+	next     atomic.Uint32
+	timeout  time.Duration
+	pools    map[string]chan net.Conn
+}
+
+// NewRedisStore creates a store for the primary and replica addresses (host:port).
+func NewRedisStore(primary string, replicas []string, timeout time.Duration) *RedisStore {
+	pools := make(map[string]chan net.Conn, len(replicas)+1)
+	for _, server := range append([]string{primary}, replicas...) {
+		pools[server] = make(chan net.Conn, redisMaxIdle)
+	}
+	return &RedisStore{
+		primary:  primary,
+		replicas: replicas,
+		timeout:  timeout,
+		pools:    pools,
+	}
+}
+
+// Get implements SessionStore.
+func (r *RedisStore) Get(ctx context.Context, key string) (string, bool, error) {
+	if len(r.replicas) > 0 {
+		replica := r.replicas[int(r.next.Add(1)-1)%len(r.replicas)]
+		value, found, err := r.get(ctx, replica, key)
+		if err == nil {
+			return value, found, nil
+		}
+	}
+	return r.get(ctx, r.primary, key)
+}
+
+func (r *RedisStore) get(ctx context.Context, server, key string) (string, bool, error) {
+	var value string
+	var found bool
+	err := r.do(ctx, server, func(rw *bufio.ReadWriter) error {
+		if err := writeRedisCommand(rw, "GET", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		var err error
+		value, found, err = readRedisReply(rw.Reader)
+		return err
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return value, found, nil
+}
+
+// Set implements SessionStore.
+func (r *RedisStore) Set(ctx context.Context, key, value string, ttl time.Duration) error {
+	_, err := r.set(ctx, key, value, ttl, false)
+	return err
+}
+
+// Add implements Adder with SET NX.
+func (r *RedisStore) Add(ctx context.Context, key, value string, ttl time.Duration) (bool, error) {
+	return r.set(ctx, key, value, ttl, true)
+}
+
+// set writes key on the primary, and reports whether it was written.
+func (r *RedisStore) set(ctx context.Context, key, value string, ttl time.Duration, onlyNew bool) (bool, error) {
+	var stored bool
+	err := r.do(ctx, r.primary, func(rw *bufio.ReadWriter) error {
+		if err := writeRedisCommand(rw, redisSetArgs(key, value, ttl, onlyNew)...); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		// A nil reply means the key already exists.
+		var err error
+		_, stored, err = readRedisReply(rw.Reader)
+		return err
+	})
+	return stored, err
+}
+
+// SetMany implements BatchSetter. The writes are pipelined.
+func (r *RedisStore) SetMany(ctx context.Context, entries []Entry, ttl time.Duration) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return r.do(ctx, r.primary, func(rw *bufio.ReadWriter) error {
+		for _, entry := range entries {
+			if err := writeRedisCommand(rw, redisSetArgs(entry.Key, entry.Value, ttl, false)...); err != nil {
+				return err
+			}
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		var firstErr error
+		for range entries {
+			_, _, err := readRedisReply(rw.Reader)
+			if err != nil && !errors.Is(err, errRedisResponse) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+}
+
+// Scan implements Scanner. Keys are listed with SCAN on the primary and read with MGET, so keys
+// written or expiring during the scan may be missed or listed twice.
+func (r *RedisStore) Scan(ctx context.Context, prefix string, fn func(Entry) error) error {
+	pattern := redisGlobReplacer.Replace(prefix) + "*"
+	cursor := "0"
+	for {
+		var keys, values []string
+		err := r.do(ctx, r.primary, func(rw *bufio.ReadWriter) error {
+			if err := writeRedisCommand(rw, "SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount); err != nil {
+				return err
+			}
+			if err := rw.Flush(); err != nil {
+				return err
+			}
+			if size, err := readRedisArrayHeader(rw.Reader); err != nil {
+				return err
+			} else if size != 2 {
+				return fmt.Errorf("%w: SCAN reply of %d elements", errRedisResponse, size)
+			}
+			var err error
+			if cursor, _, err = readRedisReply(rw.Reader); err != nil {
+				return err
+			}
+			keys, err = readRedisArray(rw.Reader)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		if len(keys) > 0 {
+			err = r.do(ctx, r.primary, func(rw *bufio.ReadWriter) error {
+				if err := writeRedisCommand(rw, append([]string{"MGET"}, keys...)...); err != nil {
+					return err
+				}
+				if err := rw.Flush(); err != nil {
+					return err
+				}
+				var err error
+				values, err = readRedisArray(rw.Reader)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			if len(values) != len(keys) {
+				return fmt.Errorf("%w: MGET reply of %d elements for %d keys", errRedisResponse, len(values), len(keys))
+			}
+		}
+		for i, key := range keys {
+			// Keys that expired since they were listed have no value.
+			if values[i] == "" {
+				continue
+			}
+			if err := fn(Entry{Key: key, Value: values[i]}); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Count implements Counter with a hash per key, whose fields are incremented with HINCRBY and
+// read with HGETALL in one pipeline on the primary.
+func (r *RedisStore) Count(ctx context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error) {
+	var fields []string
+	err := r.do(ctx, r.primary, func(rw *bufio.ReadWriter) error {
+		for field, increment := range increments {
+			if err := writeRedisCommand(rw, "HINCRBY", key, field, strconv.FormatInt(increment, 10)); err != nil {
+				return err
+			}
+		}
+		if len(increments) > 0 && ttl > 0 {
+			if err := writeRedisCommand(rw, "PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)); err != nil {
+				return err
+			}
+		}
+		if err := writeRedisCommand(rw, "HGETALL", key); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		var firstErr error
+		replies := len(increments)
+		if len(increments) > 0 && ttl > 0 {
+			replies++
+		}
+		for i := 0; i < replies; i++ {
+			if _, _, err := readRedisReply(rw.Reader); err != nil {
+				if !errors.Is(err, errRedisResponse) {
+					return err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		var err error
+		if fields, err = readRedisArray(rw.Reader); err != nil {
+			return err
+		}
+		return firstErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("%w: HGETALL reply of %d elements", errRedisResponse, len(fields))
+	}
+	totals := make(map[string]int64, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		total, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: counter %s is %q", errRedisResponse, fields[i], fields[i+1])
+		}
+		totals[fields[i]] = total
+	}
+	return totals, nil
+}
+
+// redisLeaseScript takes or extends the lease KEYS[1] for the holder ARGV[1] for ARGV[2]
+// milliseconds, and redisReleaseScript deletes it if the holder has it. Both compare and write
+// atomically, so an instance can't extend or delete a lease another one took after it expired.
+const (
+	redisLeaseScript = `local holder = redis.call("GET", KEYS[1])
+if holder == false then
+  redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+  return 1
+elseif holder == ARGV[1] then
+  redis.call("PEXPIRE", KEYS[1], ARGV[2])
+  return 1
+end
+return 0`
+	redisReleaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then
+  return redis.call("DEL", KEYS[1])
+end
+return 0`
+)
+
+// Lease implements Leaser with a script on the primary.
+func (r *RedisStore) Lease(ctx context.Context, key, holder string, ttl time.Duration) (bool, error) {
+	reply, err := r.eval(ctx, redisLeaseScript, key, holder, strconv.FormatInt(ttl.Milliseconds(), 10))
+	return reply == "1", err
+}
+
+// Release implements Leaser.
+func (r *RedisStore) Release(ctx context.Context, key, holder string) error {
+	_, err := r.eval(ctx, redisReleaseScript, key, holder)
+	return err
+}
+
+// eval runs a script with one key on the primary and returns its integer reply.
+func (r *RedisStore) eval(ctx context.Context, script, key string, args ...string) (string, error) {
+	var reply string
+	err := r.do(ctx, r.primary, func(rw *bufio.ReadWriter) error {
+		if err := writeRedisCommand(rw, append([]string{"EVAL", script, "1", key}, args...)...); err != nil {
+			return err
+		}
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		var err error
+		reply, _, err = readRedisReply(rw.Reader)
+		return err
+	})
+	return reply, err
+}
+
+// redisGlobReplacer escapes the characters of glob-style patterns, for SCAN MATCH.
+var redisGlobReplacer = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// redisSetArgs returns the arguments of a SET command. Keys written without a positive TTL
+// don't expire.
+func redisSetArgs(key, value string, ttl time.Duration, onlyNew bool) []string {
+	args := []string{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	if onlyNew {
+		args = append(args, "NX")
+	}
+	return args
+}
+
+// do runs a command against server, reusing an idle connection when possible.
+func (r *RedisStore) do(ctx context.Context, server string, command func(rw *bufio.ReadWriter) error) error {
+	conn, err := r.conn(ctx, server)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(r.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	err = command(rw)
+	if err != nil && !errors.Is(err, errRedisResponse) {
+		_ = conn.Close()
+		return err
+	}
+	if rw.Reader.Buffered() > 0 {
+		// Unread data means the connection is out of sync with the protocol.
+		_ = conn.Close()
+		return err
+	}
+	r.release(server, conn)
+	return err
+}
+
+func (r *RedisStore) conn(ctx context.Context, server string) (net.Conn, error) {
+	select {
+	case conn := <-r.pools[server]:
+		return conn, nil
+	default:
+	}
+	dialer := net.Dialer{Timeout: r.timeout}
+	return dialer.DialContext(ctx, "tcp", server)
+}
+
+func (r *RedisStore) release(server string, conn net.Conn) {
+	select {
+	case r.pools[server] <- conn:
+	default:
+		_ = conn.Close()
+	}
+}
+
+// writeRedisCommand writes a command as an array of bulk strings.
+func writeRedisCommand(w io.Writer, args ...string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRedisArrayHeader parses the header of an array reply and returns its size, which is -1
+// for nil arrays. Error replies are returned as errRedisResponse.
+func readRedisArrayHeader(r *bufio.Reader) (int, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case strings.HasPrefix(line, "-"):
+		return 0, fmt.Errorf("%w: %s", errRedisResponse, line[1:])
+	case strings.HasPrefix(line, "*"):
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return 0, fmt.Errorf("%w: %s", errRedisResponse, line)
+		}
+		return size, nil
+	default:
+		return 0, fmt.Errorf("%w: %s", errRedisResponse, line)
+	}
+}
+
+// readRedisArray parses an array reply of simple or bulk strings. Nil elements are returned as
+// empty strings.
+func readRedisArray(r *bufio.Reader) ([]string, error) {
+	size, err := readRedisArrayHeader(r)
+	if err != nil || size <= 0 {
+		return nil, err
+	}
+	values := make([]string, size)
+	for i := range values {
+		if values[i], _, err = readRedisReply(r); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// readRedisReply parses a simple string, integer, error or bulk string reply, and reports
+// whether it was not nil. Error replies are returned as errRedisResponse.
+func readRedisReply(r *bufio.Reader) (string, bool, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return "", false, err
+	}
+	if line == "" {
+		return "", false, fmt.Errorf("%w: empty reply", errRedisResponse)
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], true, nil
+	case '-':
+		return "", false, fmt.Errorf("%w: %s", errRedisResponse, line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", false, fmt.Errorf("%w: %s", errRedisResponse, line)
+		}
+		if size < 0 {
+			return "", false, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return "", false, err
+		}
+		return string(data[:size]), true, nil
+	default:
+		return "", false, fmt.Errorf("%w: %s", errRedisResponse, line)
+	}
+}
@@ -0,0 +1,151 @@
+// Package store provides session assignment stores for the Forklift middleware.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errUnknownStoreType = errors.New("unknown session store type")
+	errMissingServers   = errors.New("session store requires at least one server")
+	errMissingTable     = errors.New("session store requires a table and region")
+	errRedisPrimary     = errors.New("redis session store requires a single primary server")
+	errUnusedReplicas   = errors.New("session store replicas require the redis type")
+	errNonPositiveTTL   = errors.New("session store ttl must be positive")
+)
+
+const (
+	defaultTTL     = 30 * 24 * time.Hour
+	defaultTimeout = 100 * time.Millisecond
+)
+
+// SessionStore persists the backend assigned to a session so assignments survive changes to
+// rule percentages and are shared between middleware instances.
+type SessionStore interface {
+	// Get returns the stored value for key and whether it was found.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Set stores value for key, expiring it after ttl. It replaces any value key has.
+	Set(ctx context.Context, key, value string, ttl time.Duration) error
+}
+
+// Adder is implemented by stores that can write a key only when it has no live value, so the
+// first of several instances assigning a session at once wins.
+type Adder interface {
+	// Add stores value for key, expiring it after ttl, unless key has a live value. It reports
+	// whether value was stored.
+	Add(ctx context.Context, key, value string, ttl time.Duration) (bool, error)
+}
+
+// Entry is a single key and value written by a BatchSetter.
+type Entry struct {
+	Key   string
+	Value string
+}
+
+// BatchSetter is implemented by stores that can write many entries in one round trip,
+// e.g. when importing assignments.
+type BatchSetter interface {
+	SetMany(ctx context.Context, entries []Entry, ttl time.Duration) error
+}
+
+// Scanner is implemented by stores that can list their entries, e.g. when exporting
+// assignments.
+type Scanner interface {
+	// Scan calls fn with each live entry whose key starts with prefix, in no particular order.
+	// It stops at the first error fn returns.
+	Scan(ctx context.Context, prefix string, fn func(Entry) error) error
+}
+
+// Leaser is implemented by stores that can hold leases, e.g. to elect the one instance among
+// several that advances canary analyses.
+type Leaser interface {
+	// Lease takes the lease on key for holder, or extends it if holder has it already, until ttl
+	// from now. It reports whether holder has the lease.
+	Lease(ctx context.Context, key, holder string, ttl time.Duration) (bool, error)
+	// Release gives up the lease on key if holder has it.
+	Release(ctx context.Context, key, holder string) error
+}
+
+// Counter is implemented by stores that can keep counters shared by instances, e.g. the requests
+// of each variant across a cluster.
+type Counter interface {
+	// Count adds the increments to the fields of the counters at key, which expire after ttl
+	// without increments, and returns the totals of all the fields at key.
+	Count(ctx context.Context, key string, increments map[string]int64, ttl time.Duration) (map[string]int64, error)
+}
+
+// Options holds the parsed settings of a session store.
+type Options struct {
+	TTL     time.Duration
+	Timeout time.Duration
+}
+
+// New creates the session store described by the configuration. It returns nil when no
+// store is configured.
+func New(cfg *config.SessionStore) (SessionStore, Options, error) {
+	if cfg == nil || cfg.Type == "" {
+		return nil, Options{}, nil
+	}
+
+	opts, err := parseOptions(cfg)
+	if err != nil {
+		return nil, Options{}, err
+	}
+
+	storeType := strings.ToLower(cfg.Type)
+	if len(cfg.Replicas) > 0 && storeType != "redis" {
+		return nil, Options{}, errUnusedReplicas
+	}
+
+	switch storeType {
+	case "memory":
+		return NewMemoryStore(), opts, nil
+	case "memcached":
+		if len(cfg.Servers) == 0 {
+			return nil, Options{}, errMissingServers
+		}
+		return NewMemcachedStore(cfg.Servers, opts.Timeout), opts, nil
+	case "redis":
+		if len(cfg.Servers) != 1 {
+			return nil, Options{}, errRedisPrimary
+		}
+		return NewRedisStore(cfg.Servers[0], cfg.Replicas, opts.Timeout), opts, nil
+	case "dynamodb":
+		if cfg.Table == "" || cfg.Region == "" {
+			return nil, Options{}, errMissingTable
+		}
+		return NewDynamoDBStore(cfg.Table, cfg.Region, cfg.Endpoint, opts.Timeout), opts, nil
+	default:
+		return nil, Options{}, fmt.Errorf("%w: %s", errUnknownStoreType, cfg.Type)
+	}
+}
+
+func parseOptions(cfg *config.SessionStore) (Options, error) {
+	opts := Options{TTL: defaultTTL, Timeout: defaultTimeout}
+	if cfg.TTL != "" {
+		ttl, err := time.ParseDuration(cfg.TTL)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid session store ttl: %w", err)
+		}
+		// Stores disagree on what a TTL of zero means, memcached never expiring the key and the
+		// others expiring it at once, so only positive TTLs are accepted.
+		if ttl <= 0 {
+			return Options{}, fmt.Errorf("%w: %s", errNonPositiveTTL, cfg.TTL)
+		}
+		opts.TTL = ttl
+	}
+	if cfg.Timeout != "" {
+		timeout, err := time.ParseDuration(cfg.Timeout)
+		if err != nil {
+			return Options{}, fmt.Errorf("invalid session store timeout: %w", err)
+		}
+		opts.Timeout = timeout
+	}
+	return opts, nil
+}
@@ -0,0 +1,162 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidTag          = errors.New("invalid tag")
+	errInvalidTagCondition = errors.New("invalid tag condition")
+)
+
+// tagsKey is the context key of the tags of a request.
+type tagsKey struct{}
+
+// requestTags holds the tags computed for a request, by index in the configuration: 0 while a
+// tag isn't computed, then 1 or 2 for untagged or tagged requests. Rules are matched by a single
+// goroutine per request, so they are not locked.
+type requestTags []uint8
+
+// tagRules returns rules with the conditions of the tags, for the checks and lookups of
+// conditions written for rules.
+func tagRules(tags []config.Tag) []RoutingRule {
+	rules := make([]RoutingRule, len(tags))
+	for i, tag := range tags {
+		rules[i].Conditions = tag.Conditions
+	}
+	return rules
+}
+
+// validateTags checks that tags have a unique name and conditions, which are valid as conditions
+// of rules other than form conditions, and that tag conditions reference a tag. Tags may only
+// reference the tags before them, so they can't depend on each other.
+func validateTags(cfg *config.Config) error {
+	names := make(map[string]bool, len(cfg.Tags))
+	for i := range cfg.Tags {
+		tag := &cfg.Tags[i]
+		if err := tag.ExpandMatch(); err != nil {
+			return err
+		}
+		if tag.Name == "" {
+			return fmt.Errorf("%w: missing name", errInvalidTag)
+		}
+		if names[tag.Name] {
+			return fmt.Errorf("%w: duplicate name %q", errInvalidTag, tag.Name)
+		}
+		if len(tag.Conditions) == 0 {
+			return fmt.Errorf("%w: %s has no conditions", errInvalidTag, tag.Name)
+		}
+		for _, condition := range tag.Conditions {
+			if strings.EqualFold(condition.Type, "form") {
+				// The form body is only read within the limits of the rules matching on it.
+				return fmt.Errorf("%w: %s has a form condition", errInvalidTag, tag.Name)
+			}
+		}
+		if err := validateTagConditions(tag.Conditions, names); err != nil {
+			return err
+		}
+		names[tag.Name] = true
+	}
+	for _, rule := range cfg.Rules {
+		if err := validateTagConditions(rule.Conditions, names); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Tags) == 0 {
+		return nil
+	}
+
+	tagged := *cfg
+	tagged.Rules = tagRules(cfg.Tags)
+	for _, validate := range []func(*config.Config) error{
+		func(c *config.Config) error { return validateEvaluators(c) },
+		func(c *config.Config) error { return validateTraefikConditions(c.Rules) },
+		func(c *config.Config) error { return validateClientHintConditions(c.Rules) },
+		func(c *config.Config) error { return validateFingerprintConditions(c.Rules) },
+		func(c *config.Config) error { return validateFrequencyConditions(c.Rules) },
+		validateConsent,
+		validateRegexes,
+		validateTokenConditions,
+	} {
+		if err := validate(&tagged); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidTag, err)
+		}
+	}
+	return nil
+}
+
+// validateTagConditions checks that tag conditions reference one of the tags, and are either
+// plain or compare with "eq" against true or false.
+func validateTagConditions(conditions []RuleCondition, tags map[string]bool) error {
+	for _, condition := range conditions {
+		if !strings.EqualFold(condition.Type, "tag") {
+			continue
+		}
+		if !tags[condition.Parameter] {
+			return fmt.Errorf("%w: unknown tag %q", errInvalidTagCondition, condition.Parameter)
+		}
+		switch {
+		case condition.Operator == "" && condition.Value == "":
+		case strings.EqualFold(condition.Operator, "eq") && (condition.Value == "true" || condition.Value == "false"):
+		default:
+			return fmt.Errorf("%w: %s must be compared with eq true or eq false", errInvalidTagCondition, condition.Parameter)
+		}
+	}
+	return nil
+}
+
+// tagIndexes returns the index of each tag by name.
+func tagIndexes(tags []config.Tag) map[string]int {
+	if len(tags) == 0 {
+		return nil
+	}
+	indexes := make(map[string]int, len(tags))
+	for i, tag := range tags {
+		indexes[tag.Name] = i
+	}
+	return indexes
+}
+
+// classify attaches the tags of the request to it, so each tag is computed on first use and
+// reused by the other rules referencing it.
+func (re *RuleEngine) classify(req *http.Request) *http.Request {
+	if len(re.config.Tags) == 0 {
+		return req
+	}
+	tags := make(requestTags, len(re.config.Tags))
+	return req.WithContext(context.WithValue(req.Context(), tagsKey{}, tags))
+}
+
+// tagged reports whether the request has the tag at index i. Requests that weren't classified,
+// such as the ones given to SelectBackend, compute it again on every use.
+func (re *RuleEngine) tagged(req *http.Request, i int) bool {
+	tags, _ := req.Context().Value(tagsKey{}).(requestTags)
+	if len(tags) != len(re.config.Tags) {
+		return re.checkConditions(req, re.config.Tags[i].Conditions)
+	}
+	if tags[i] == 0 {
+		tags[i] = 1
+		if re.checkConditions(req, re.config.Tags[i].Conditions) {
+			tags[i] = 2
+		}
+	}
+	return tags[i] == 2
+}
+
+func (re *RuleEngine) checkTag(req *http.Request, condition RuleCondition) bool {
+	i, ok := re.tags[condition.Parameter]
+	if !ok {
+		return false
+	}
+	result := re.tagged(req, i) == (condition.Value != "false")
+	if re.config.Debug {
+		re.logger.Debugf("Tag %s %s %q: %v", condition.Parameter, condition.Operator, condition.Value, result)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestAATest(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	backend := newHeaderServer()
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/metrics",
+		Propagation:    &config.Propagation{},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL, Percentage: 50, Experiment: "checkout-aa", Variant: "a", Mode: "aa"},
+			{Path: "/checkout", Backend: backend.URL, Percentage: 50, Experiment: "checkout-aa", Variant: "b", Mode: "aa"},
+		},
+	})
+	serve := func(path, session string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+	variant := func(session string) string {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(serve("/checkout", session)), &headers); err != nil {
+			t.Fatalf("Expected the A/A backend to serve the request: %v", err)
+		}
+		return headers["X-Forklift-Variant"]
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		session := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+		first := variant(session)
+		if again := variant(session); again != first {
+			t.Fatalf("Expected session %d to keep variant %s, got %s", i, first, again)
+		}
+		counts[first]++
+	}
+	if counts["a"] < 150 || counts["b"] < 150 {
+		t.Errorf("Expected sessions to be split between both variants, got %v", counts)
+	}
+
+	metrics := serve("/metrics", "")
+	for _, line := range []string{
+		fmt.Sprintf(`forklift_variant_requests_total{experiment="checkout-aa",variant="a",code="2xx"} %d`, 2*counts["a"]),
+		fmt.Sprintf(`forklift_variant_requests_total{experiment="checkout-aa",variant="b",code="2xx"} %d`, 2*counts["b"]),
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestInvalidAATest(t *testing.T) {
+	for name, rules := range map[string][]config.RoutingRule{
+		"unknown mode": {
+			{Path: "/", Backend: "http://a", Percentage: 50, Experiment: "e", Variant: "a", Mode: "ab"},
+		},
+		"without variant": {
+			{Path: "/", Backend: "http://a", Percentage: 50, Experiment: "e", Mode: "aa"},
+		},
+		"different backends": {
+			{Path: "/", Backend: "http://a", Percentage: 50, Experiment: "e", Variant: "a", Mode: "aa"},
+			{Path: "/", Backend: "http://b", Percentage: 50, Experiment: "e", Variant: "b", Mode: "aa"},
+		},
+		"mixed modes": {
+			{Path: "/", Backend: "http://a", Percentage: 50, Experiment: "e", Variant: "a", Mode: "aa"},
+			{Path: "/", Backend: "http://a", Percentage: 50, Experiment: "e", Variant: "b"},
+		},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost:8080", Rules: rules}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestAssignmentExportImport(t *testing.T) {
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	createConfig := func(v1Percentage float64, sessionStore *config.SessionStore) *config.Config {
+		return &config.Config{
+			DefaultBackend: v1Server.URL(),
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v1Server.URL(), Percentage: v1Percentage},
+				{Path: "/", Backend: v2Server.URL(), Percentage: 100 - v1Percentage},
+			},
+			SessionStore: sessionStore,
+			AdminAPI:     &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+		}
+	}
+	call := func(middleware http.Handler, method, target, token, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	memory := createMiddleware(t, createConfig(50, &config.SessionStore{Type: "memory"}))
+	assignments := make(map[string]string)
+	for i := range 100 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+		assignments[sessionID] = serveWithSession(t, memory, sessionID)
+	}
+
+	if rr := call(memory, http.MethodGet, "/_forklift/admin/assignments", "wrong", "", ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", rr.Code)
+	}
+	exported := call(memory, http.MethodGet, "/_forklift/admin/assignments", "s3cret", "", "")
+	var export struct {
+		Assignments []struct{ Key, Value string } `json:"assignments"`
+	}
+	if err := json.Unmarshal(exported.Body.Bytes(), &export); err != nil {
+		t.Fatalf("Expected a JSON export, got %v: %s", err, exported.Body.String())
+	}
+	if len(export.Assignments) != len(assignments) {
+		t.Fatalf("Expected %d exported assignments, got %d", len(assignments), len(export.Assignments))
+	}
+	csvExport := call(memory, http.MethodGet, "/_forklift/admin/assignments?format=csv", "s3cret", "", "")
+	if lines := strings.Count(csvExport.Body.String(), "\n"); lines != len(assignments)+1 {
+		t.Fatalf("Expected a header and %d lines, got %d: %s", len(assignments), lines, csvExport.Body.String())
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{name: "JSON", contentType: "application/json", body: exported.Body.String()},
+		{name: "CSV", contentType: "text/csv; charset=utf-8", body: csvExport.Body.String()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			redis := newFakeRedis(t)
+			// Without the imported assignments, nearly all sessions would move to v2.
+			migrated := createMiddleware(t, createConfig(1, &config.SessionStore{Type: "redis", Servers: []string{redis.addr()}}))
+			rr := call(migrated, http.MethodPost, "/_forklift/admin/assignments", "s3cret", tc.contentType, tc.body)
+			if want := fmt.Sprintf(`{"imported":%d}`, len(assignments)); strings.TrimSpace(rr.Body.String()) != want {
+				t.Fatalf("Expected %s, got %d %s", want, rr.Code, rr.Body.String())
+			}
+			for sessionID, backend := range assignments {
+				if got := serveWithSession(t, migrated, sessionID); got != backend {
+					t.Errorf("Session %s moved from %q to %q after the migration", sessionID, backend, got)
+				}
+			}
+		})
+	}
+
+	rr := call(memory, http.MethodPost, "/_forklift/admin/assignments", "s3cret", "text/csv", "key,value\nsession,http://v1\n")
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a key that is not an assignment, got %d", rr.Code)
+	}
+}
+
+func TestAssignmentExportUnsupported(t *testing.T) {
+	memcached := newFakeMemcached(t)
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost",
+		SessionStore:   &config.SessionStore{Type: "memcached", Servers: []string{memcached.addr()}},
+		AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/_forklift/admin/assignments", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("Expected 501 for a store that can't list its assignments, got %d", rr.Code)
+	}
+}
+
+func TestInvalidAdminAPI(t *testing.T) {
+	testCases := []struct {
+		name string
+		api  *config.AdminAPI
+	}{
+		{name: "Without token", api: &config.AdminAPI{Path: "/_forklift/admin"}},
+		{name: "Relative path", api: &config.AdminAPI{Path: "admin", Token: "s3cret"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", AdminAPI: tc.api}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
+
+func TestAssignmentOverride(t *testing.T) {
+	oldServer := newMockServer("Old UI")
+	defer oldServer.close()
+	newServer := newMockServer("New UI")
+	defer newServer.close()
+
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: oldServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: oldServer.URL(), Percentage: 99, Experiment: "ui", Variant: "old"},
+			{Path: "/", Backend: newServer.URL(), Percentage: 1, Experiment: "ui", Variant: "new"},
+		},
+		SessionStore: &config.SessionStore{Type: "memory"},
+		Identity:     &config.Identity{Sources: []string{"header:X-API-Key"}},
+		AdminAPI:     &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", AuditLog: auditLog},
+	})
+	const sessionID = "c2Vzc2lvbi0wMDE="
+	if body := serveWithSession(t, middleware, sessionID); body != "Old UI" {
+		t.Fatalf("Expected the session on the old UI before the override, got %q", body)
+	}
+
+	rr := callAdmin(t, middleware, http.MethodPut, "/_forklift/admin/assignments/"+sessionID,
+		`{"experiment":"ui","variant":"new","ttl":"200ms"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body := serveWithSession(t, middleware, sessionID); body != "New UI" {
+		t.Errorf("Expected the override to pin the session to the new UI, got %q", body)
+	}
+	waitFor(t, func() bool { return serveWithSession(t, middleware, sessionID) == "Old UI" })
+
+	rr = callAdmin(t, middleware, http.MethodPut, "/_forklift/admin/assignments/header:X-API-Key:ceo",
+		`{"experiment":"ui","variant":"new"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	req := createTestRequest(t, http.MethodGet, "/", map[string]string{"X-API-Key": "ceo"}, nil)
+	rec := httptest.NewRecorder()
+	middleware.ServeHTTP(rec, req)
+	if body := strings.TrimSpace(rec.Body.String()); body != "New UI" {
+		t.Errorf("Expected the identity pinned to the new UI, got %q", body)
+	}
+
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"action":"override","remote"`) ||
+		!strings.Contains(lines[0], `"experiment":"ui","variant":"new"`) {
+		t.Errorf("Expected both overrides in the audit log, got %s", data)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{name: "Unknown variant", method: http.MethodPut, body: `{"experiment":"ui","variant":"beta"}`, status: http.StatusNotFound},
+		{name: "Invalid ttl", method: http.MethodPut, body: `{"experiment":"ui","variant":"new","ttl":"-1h"}`, status: http.StatusBadRequest},
+		{name: "Wrong method", method: http.MethodGet, status: http.StatusMethodNotAllowed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if rr := callAdmin(t, middleware, tc.method, "/_forklift/admin/assignments/"+sessionID, tc.body); rr.Code != tc.status {
+				t.Errorf("Expected %d, got %d: %s", tc.status, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func adminRequest(middleware http.Handler, method, target string, auth func(*http.Request)) int {
+	req := httptest.NewRequest(method, target, strings.NewReader(`{"variant":"v2"}`))
+	auth(req)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func bearer(token string) func(*http.Request) {
+	return func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+token) }
+}
+
+func TestAdminAPIRoles(t *testing.T) {
+	backend := newMockServer("Checkout")
+	defer backend.close()
+
+	digest := sha256.Sum256([]byte("hunter2"))
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: backend.URL(), Experiment: "checkout", Variant: "v1", Percentage: 50},
+			{Path: "/", Backend: backend.URL(), Experiment: "checkout", Variant: "v2", Percentage: 50},
+		},
+		SessionStore: &config.SessionStore{Type: "memory"},
+		AdminAPI: &config.AdminAPI{
+			Path:     "/_forklift/admin",
+			Tokens:   []config.AdminToken{{Name: "dashboard", Token: "look", Role: "viewer"}},
+			Users:    []config.AdminUser{{Username: "oncall", Password: "sha256:" + hex.EncodeToString(digest[:]), Role: "operator"}},
+			AuditLog: auditLog,
+			UI:       true,
+		},
+	})
+	operator := func(req *http.Request) {
+		req.SetBasicAuth("oncall", "hunter2")
+		req.Header.Set("X-Forklift-UI", "1")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		target string
+		auth   func(*http.Request)
+		status int
+	}{
+		{name: "Viewer reads the overview", method: http.MethodGet, target: "/_forklift/admin/overview", auth: bearer("look"), status: http.StatusOK},
+		{name: "Viewer can't pause", method: http.MethodPost, target: "/_forklift/admin/experiments/checkout/pause", auth: bearer("look"), status: http.StatusForbidden},
+		{name: "Viewer can't export", method: http.MethodGet, target: "/_forklift/admin/assignments", auth: bearer("look"), status: http.StatusForbidden},
+		{name: "Unknown token", method: http.MethodGet, target: "/_forklift/admin/overview", auth: bearer("nope"), status: http.StatusUnauthorized},
+		{name: "Wrong password", method: http.MethodGet, target: "/_forklift/admin/overview", auth: func(req *http.Request) { req.SetBasicAuth("oncall", "hunter3") }, status: http.StatusUnauthorized},
+		{name: "Operator pauses", method: http.MethodPost, target: "/_forklift/admin/experiments/checkout/pause", auth: operator, status: http.StatusOK},
+		{name: "Operator can't export", method: http.MethodGet, target: "/_forklift/admin/assignments", auth: operator, status: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := adminRequest(middleware, tc.method, tc.target, tc.auth); status != tc.status {
+				t.Errorf("Expected %d, got %d", tc.status, status)
+			}
+		})
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_forklift/admin/overview", nil)
+	bearer("look")(req)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	var overview struct {
+		Role string `json:"role"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &overview); err != nil || overview.Role != "viewer" {
+		t.Errorf("Expected the overview to name the viewer role, got %s", rr.Body.String())
+	}
+
+	data, err := os.ReadFile(auditLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"user":"oncall"`) {
+		t.Errorf("Expected the operator named in the audit log, got %s", data)
+	}
+}
+
+// fakeOIDCProvider serves the discovery document and JWKS of an issuer, and signs its tokens.
+type fakeOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(rw).Encode(map[string]string{"issuer": p.server.URL, "jwks_uri": p.server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(rw http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *fakeOIDCProvider) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAdminAPIOIDC(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	defer provider.server.Close()
+	backend := newMockServer("Checkout")
+	defer backend.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: backend.URL(), Experiment: "checkout", Variant: "v1", Percentage: 50},
+			{Path: "/", Backend: backend.URL(), Experiment: "checkout", Variant: "v2", Percentage: 50},
+		},
+		AdminAPI: &config.AdminAPI{
+			Path: "/_forklift/admin",
+			OIDC: &config.AdminOIDC{
+				Issuer:     provider.server.URL,
+				Audience:   "forklift",
+				RolesClaim: "groups",
+				Roles:      map[string]string{"sre": "operator"},
+			},
+			UI: true,
+		},
+	})
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    provider.server.URL,
+			"aud":    []string{"forklift"},
+			"sub":    "1234",
+			"email":  "oncall@example.com",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"groups": []string{"engineering", "sre"},
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	// A token whose claims were swapped for those of another keeps its original signature.
+	viewer := strings.Split(provider.sign(t, claims(map[string]interface{}{"groups": "viewer"})), ".")
+	admin := strings.Split(provider.sign(t, claims(map[string]interface{}{"groups": "admin"})), ".")
+	forged := viewer[0] + "." + admin[1] + "." + viewer[2]
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "Mapped operator", token: provider.sign(t, claims(nil)), status: http.StatusOK},
+		{name: "No role", token: provider.sign(t, claims(map[string]interface{}{"groups": "engineering"})), status: http.StatusForbidden},
+		{name: "Expired", token: provider.sign(t, claims(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix()})), status: http.StatusUnauthorized},
+		{name: "Wrong audience", token: provider.sign(t, claims(map[string]interface{}{"aud": "other"})), status: http.StatusUnauthorized},
+		{name: "Wrong issuer", token: provider.sign(t, claims(map[string]interface{}{"iss": "https://evil.example.com"})), status: http.StatusUnauthorized},
+		{name: "Forged role", token: forged, status: http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := adminRequest(middleware, http.MethodPost, "/_forklift/admin/experiments/checkout/resume", bearer(tc.token)); status != tc.status {
+				t.Errorf("Expected %d, got %d", tc.status, status)
+			}
+		})
+	}
+}
+
+func TestAdminAPIRejectsInvalidCredentials(t *testing.T) {
+	for name, admin := range map[string]*config.AdminAPI{
+		"Unknown role":      {Path: "/_forklift/admin", Tokens: []config.AdminToken{{Token: "t", Role: "root"}}},
+		"Missing role":      {Path: "/_forklift/admin", Users: []config.AdminUser{{Username: "u", Password: "p"}}},
+		"Duplicate user":    {Path: "/_forklift/admin", Users: []config.AdminUser{{Username: "u", Password: "p", Role: "viewer"}, {Username: "u", Password: "q", Role: "admin"}}},
+		"Invalid digest":    {Path: "/_forklift/admin", Users: []config.AdminUser{{Username: "u", Password: "sha256:zz", Role: "viewer"}}},
+		"Invalid issuer":    {Path: "/_forklift/admin", OIDC: &config.AdminOIDC{Issuer: "accounts.example.com"}},
+		"Unknown OIDC role": {Path: "/_forklift/admin", OIDC: &config.AdminOIDC{Issuer: "https://accounts.example.com", Roles: map[string]string{"sre": "god"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost:8080", AdminAPI: admin}
+			next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+			if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+				t.Error("Expected the configuration to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+type adminOverview struct {
+	Current     int `json:"current"`
+	Experiments []struct {
+		Name     string `json:"name"`
+		Paused   bool   `json:"paused"`
+		Variants []struct {
+			Variant    string  `json:"variant"`
+			Percentage float64 `json:"percentage"`
+			Requests   int64   `json:"requests"`
+			Errors     int64   `json:"errors"`
+		} `json:"variants"`
+	} `json:"experiments"`
+	Rules    []map[string]interface{} `json:"rules"`
+	Versions []struct {
+		Version int    `json:"version"`
+		Source  string `json:"source"`
+	} `json:"versions"`
+}
+
+func TestAdminUI(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v1Server := newMockServer("Checkout V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Checkout V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1Server.URL(), Experiment: "checkout", Variant: "v1", Percentage: 50},
+			{Path: "/", Backend: v2Server.URL(), Experiment: "checkout", Variant: "v2", Percentage: 50},
+		},
+		AdminAPI:    &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", UI: true},
+		RuleHistory: &config.RuleHistory{},
+	})
+	browser := func(method, target, body string, uiHeader bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("admin", "s3cret")
+		if uiHeader {
+			req.Header.Set("X-Forklift-UI", "1")
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+	overview := func() adminOverview {
+		var o adminOverview
+		rr := browser(http.MethodGet, "/_forklift/admin/overview", "", false)
+		if err := json.Unmarshal(rr.Body.Bytes(), &o); err != nil {
+			t.Fatalf("Expected the overview as JSON, got %v: %s", err, rr.Body.String())
+		}
+		return o
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/_forklift/admin/ui", nil))
+	if rr.Code != http.StatusUnauthorized || !strings.HasPrefix(strings.Join(rr.Header().Values("WWW-Authenticate"), ","), "Bearer,Basic") {
+		t.Errorf("Expected 401 with a basic auth challenge, got %d %v", rr.Code, rr.Header().Values("WWW-Authenticate"))
+	}
+	rr = browser(http.MethodGet, "/_forklift/admin/ui", "", false)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "<title>Forklift</title>") {
+		t.Fatalf("Expected the UI page, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if csp := rr.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "script-src 'sha256-") {
+		t.Errorf("Expected the inline script allowed by its hash, got %q", csp)
+	}
+
+	served := map[string]int{}
+	for i := range 40 {
+		served[serveWithSession(t, middleware, base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("ui-%02d", i))))]++
+	}
+	o := overview()
+	if len(o.Experiments) != 1 || len(o.Experiments[0].Variants) != 2 || len(o.Rules) != 2 {
+		t.Fatalf("Expected one experiment with two variants, got %+v", o)
+	}
+	for _, variant := range o.Experiments[0].Variants {
+		if want := served["Checkout "+strings.ToUpper(variant.Variant)]; want == 0 || variant.Requests != int64(want) || variant.Percentage != 50 {
+			t.Errorf("Expected %d requests at 50%% for %s, got %+v", want, variant.Variant, variant)
+		}
+	}
+
+	// Browsers send basic credentials with cross-site requests, which can't set the UI header.
+	if rr := browser(http.MethodPost, "/_forklift/admin/experiments/checkout/pause", "", false); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a change without the UI header to be rejected, got %d", rr.Code)
+	}
+	if rr := browser(http.MethodPost, "/_forklift/admin/experiments/checkout/pause", "", true); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the experiment to be paused, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body := serveWithSession(t, middleware, "cGF1c2Vk"); body != "Default Backend" {
+		t.Errorf("Expected a paused experiment to serve the default backend, got %q", body)
+	}
+	if o := overview(); !o.Experiments[0].Paused {
+		t.Errorf("Expected the experiment shown as paused, got %+v", o.Experiments[0])
+	}
+
+	if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/experiments/checkout/promote", `{"variant":"v2"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected v2 to be promoted, got %d: %s", rr.Code, rr.Body.String())
+	}
+	for i := range 10 {
+		if body := serveWithSession(t, middleware, base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("promoted-%d", i)))); body != "Checkout V2" {
+			t.Fatalf("Expected every session on the promoted variant, got %q", body)
+		}
+	}
+
+	o = overview()
+	if len(o.Versions) != 3 || o.Versions[1].Source != "pause checkout" || o.Versions[2].Source != "promote checkout" || o.Current != 3 {
+		t.Errorf("Expected the changes recorded in the rule history, got %+v", o.Versions)
+	}
+	if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/experiments/unknown/pause", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown experiment, got %d", rr.Code)
+	}
+}
+
+func TestAdminUIDisabled(t *testing.T) {
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/_forklift/admin/ui", nil)
+	req.SetBasicAuth("admin", "s3cret")
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected basic auth to be refused without the UI, got %d", rr.Code)
+	}
+	if rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/ui", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without the UI, got %d", rr.Code)
+	}
+}
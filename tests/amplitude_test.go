@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+type amplitudeEvent struct {
+	EventType       string                 `json:"event_type"`
+	DeviceID        string                 `json:"device_id"`
+	UserID          string                 `json:"user_id"`
+	EventProperties map[string]interface{} `json:"event_properties"`
+}
+
+func TestAmplitudeExposureSpill(t *testing.T) {
+	var reachable int32
+	received := make(chan amplitudeEvent, 10)
+	amplitude := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&reachable) == 0 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var body struct {
+			APIKey string           `json:"api_key"`
+			Events []amplitudeEvent `json:"events"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.APIKey != "amp-key" || req.URL.Path != "/2/httpapi" {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		for _, event := range body.Events {
+			received <- event
+		}
+	}))
+	defer amplitude.Close()
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{
+			{
+				Type:          "amplitude",
+				URL:           amplitude.URL,
+				APIKey:        "amp-key",
+				IDSource:      "cookie:amp_device_id",
+				BatchSize:     2,
+				FlushInterval: "20ms",
+				SpillPath:     filepath.Join(t.TempDir(), "amplitude.spill"),
+			},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(deviceID string) {
+		req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Cookie": "amp_device_id=" + deviceID}, nil)
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// While Amplitude is unreachable the batch is retried and then spilled.
+	serve("device-1")
+	serve("device-2")
+	time.Sleep(time.Second)
+
+	atomic.StoreInt32(&reachable, 1)
+	serve("device-3")
+
+	devices := map[string]bool{}
+	timeout := time.After(5 * time.Second)
+	for len(devices) < 3 {
+		select {
+		case event := <-received:
+			if event.EventType != "$exposure" || event.EventProperties["flag_key"] != "checkout" || event.EventProperties["variant"] != "v2" {
+				t.Errorf("Unexpected event: %+v", event)
+			}
+			devices[event.DeviceID] = true
+		case <-timeout:
+			t.Fatalf("Expected events for 3 devices, got %v", devices)
+		}
+	}
+	for _, device := range []string{"device-1", "device-2", "device-3"} {
+		if !devices[device] {
+			t.Errorf("Expected an exposure for %s, got %v", device, devices)
+		}
+	}
+}
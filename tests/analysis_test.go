@@ -0,0 +1,130 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestAnalyze(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []config.RoutingRule
+		expected []config.Finding
+	}{
+		{
+			name: "Clean rules",
+			rules: []config.RoutingRule{
+				{Path: "/", Backend: "http://v1", Percentage: 50, Experiment: "home", Variant: "v1"},
+				{Path: "/", Backend: "http://v2", Percentage: 50, Experiment: "home", Variant: "v2"},
+				{Path: "/", Backend: "http://beta", Priority: 10, Match: "header:X-Beta eq true"},
+			},
+		},
+		{
+			name: "Path outside its prefix",
+			rules: []config.RoutingRule{
+				{Path: "/home", PathPrefix: "/api", Backend: "http://v1"},
+			},
+			expected: []config.Finding{
+				{Kind: config.FindingUnreachable, Rule: "* /home -> http://v1", Message: "path /home is not under path prefix /api"},
+			},
+		},
+		{
+			name: "Contradicting conditions",
+			rules: []config.RoutingRule{
+				{Path: "/", Backend: "http://v1", Match: "query:plan eq free; query:plan eq pro"},
+			},
+			expected: []config.Finding{
+				{Kind: config.FindingUnreachable, Rule: "* / -> http://v1", Message: `query:plan must equal both "free" and "pro"`},
+			},
+		},
+		{
+			name: "Shadowed by a higher priority rule",
+			rules: []config.RoutingRule{
+				{PathPrefix: "/api", Backend: "http://api", Priority: 5},
+				{Path: "/api/users", Method: "GET", Backend: "http://users", Match: "header:X-Beta eq true"},
+				{PathPrefix: "/api", Backend: "http://paused", Priority: 10, Paused: true},
+			},
+			expected: []config.Finding{
+				{Kind: config.FindingShadowed, Rule: "GET /api/users -> http://users", Message: "every request it matches is decided by * /api* -> http://api"},
+			},
+		},
+		{
+			name: "Split shadowed by a rule of the same path",
+			rules: []config.RoutingRule{
+				{Path: "/", Backend: "http://v1", Percentage: 100, Experiment: "home", Variant: "v1"},
+				{Path: "/", Backend: "http://v2", Experiment: "home", Variant: "v2"},
+			},
+			expected: []config.Finding{
+				{Kind: config.FindingShadowed, Rule: "home/v1", Message: "every request it matches is decided by home/v2"},
+			},
+		},
+		{
+			name: "Conflicting sticky keys",
+			rules: []config.RoutingRule{
+				{Path: "/cart", Backend: "http://v1", Percentage: 50, Experiment: "checkout", Variant: "v1", AssignmentGroup: "funnel"},
+				{Path: "/cart", Backend: "http://v2", Percentage: 50, Experiment: "checkout", Variant: "v2", AffinityToken: "shared"},
+				{Path: "/", Backend: "http://v3", Percentage: 50, Experiment: "home", Variant: "v1", AffinityToken: "shared"},
+			},
+			expected: []config.Finding{
+				{Kind: config.FindingStickyConflict, Message: "experiment checkout assigns sessions in assignment groups none, funnel"},
+				{Kind: config.FindingStickyConflict, Message: "affinity token shared is shared by experiments checkout, home, so their assignments are correlated"},
+			},
+		},
+		{
+			name: "Backend typos",
+			rules: []config.RoutingRule{
+				{Path: "/", Backend: "https://default:8080", Percentage: 50, Experiment: "home", Variant: "v1"},
+				{Path: "/", Backend: "https://default:8080", Percentage: 50, Experiment: "home", Variant: "v2"},
+				{Path: "/a", Backend: "http://V3/"},
+				{Path: "/b", Backend: "http://v3"},
+				{Path: "/c", Backend: "v4.internal"},
+			},
+			expected: []config.Finding{
+				{Kind: config.FindingBackend, Message: "host default:8080 is reached over both http and https"},
+				{Kind: config.FindingBackend, Message: "backends http://V3/, http://v3 differ only in case or a trailing slash"},
+				{Kind: config.FindingBackend, Rule: "* /c -> v4.internal", Message: "backend v4.internal has no scheme or host"},
+				{Kind: config.FindingBackend, Rule: "home/v2", Message: "variants v1 and v2 of experiment home share backend https://default:8080"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := config.Analyze(&config.Config{DefaultBackend: "http://default:8080", Rules: tt.rules})
+			if len(findings) != len(tt.expected) {
+				t.Fatalf("Expected %d findings, got %+v", len(tt.expected), findings)
+			}
+			for i, finding := range findings {
+				if finding != tt.expected[i] {
+					t.Errorf("Expected finding %+v, got %+v", tt.expected[i], finding)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminAPIAnalysis(t *testing.T) {
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/", Backend: "http://localhost:8081", Priority: 1},
+			{Path: "/checkout", Backend: "http://localhost:8082"},
+		},
+		AdminAPI: &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+	})
+
+	rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/analysis", "")
+	var analysis struct {
+		Findings []config.Finding `json:"findings"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &analysis); err != nil {
+		t.Fatalf("Expected the analysis as JSON, got %v: %s", err, rr.Body.String())
+	}
+	if len(analysis.Findings) != 1 || analysis.Findings[0].Kind != config.FindingShadowed ||
+		analysis.Findings[0].Rule != "* /checkout -> http://localhost:8082" {
+		t.Errorf("Expected the shadowed rule, got %+v", analysis.Findings)
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestAssignmentCache(t *testing.T) {
+	v1Server := newMockServer("Hello from V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	newMiddleware := func(memcached *fakeMemcached, cache *config.SessionCache) http.Handler {
+		// Sessions assigned to the default backend are not stored, so half of them miss the store.
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: v1Server.URL(),
+			MetricsPath:    "/metrics",
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v2Server.URL(), Percentage: 50},
+			},
+			SessionStore: &config.SessionStore{
+				Type: "memcached", Servers: []string{memcached.addr()}, TTL: "1h", Cache: cache,
+			},
+		})
+	}
+	sessionIDs := make([]string, 20)
+	for i := range sessionIDs {
+		sessionIDs[i] = base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+	}
+
+	t.Run("Hits and negative hits", func(t *testing.T) {
+		memcached := newFakeMemcached(t)
+		middleware := newMiddleware(memcached, &config.SessionCache{})
+		assignments := make(map[string]string)
+		for range 3 {
+			for _, sessionID := range sessionIDs {
+				got := serveWithSession(t, middleware, sessionID)
+				if first, ok := assignments[sessionID]; ok && got != first {
+					t.Errorf("Session %s moved from %q to %q", sessionID, first, got)
+				}
+				assignments[sessionID] = got
+			}
+		}
+
+		if memcached.getCount() != len(sessionIDs) {
+			t.Errorf("Expected the store to be read once per session, got %d reads", memcached.getCount())
+		}
+		stored := memcached.len()
+		if stored == 0 || stored == len(sessionIDs) {
+			t.Fatalf("Expected some sessions on each backend, got %d stored", stored)
+		}
+
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/metrics", nil, nil))
+		for _, line := range []string{
+			`forklift_session_cache_lookups_total{result="miss"} 20`,
+			fmt.Sprintf(`forklift_session_cache_lookups_total{result="hit"} %d`, 2*stored),
+			fmt.Sprintf(`forklift_session_cache_lookups_total{result="negative_hit"} %d`, 2*(len(sessionIDs)-stored)),
+		} {
+			if !strings.Contains(rr.Body.String(), line) {
+				t.Errorf("Expected %q in metrics:\n%s", line, rr.Body.String())
+			}
+		}
+	})
+
+	t.Run("Least recently used evicted", func(t *testing.T) {
+		memcached := newFakeMemcached(t)
+		middleware := newMiddleware(memcached, &config.SessionCache{Size: 1})
+		for range 3 {
+			serveWithSession(t, middleware, sessionIDs[0])
+			serveWithSession(t, middleware, sessionIDs[1])
+		}
+		if memcached.getCount() != 6 {
+			t.Errorf("Expected every lookup to read the store, got %d reads", memcached.getCount())
+		}
+	})
+
+	t.Run("Negative caching disabled", func(t *testing.T) {
+		memcached := newFakeMemcached(t)
+		middleware := newMiddleware(memcached, &config.SessionCache{NegativeTTL: "0s"})
+		for range 3 {
+			for _, sessionID := range sessionIDs {
+				serveWithSession(t, middleware, sessionID)
+			}
+		}
+		unstored := len(sessionIDs) - memcached.len()
+		if want := len(sessionIDs) + 2*unstored; memcached.getCount() != want {
+			t.Errorf("Expected %d reads, got %d", want, memcached.getCount())
+		}
+	})
+}
+
+func TestInvalidAssignmentCache(t *testing.T) {
+	testCases := []struct {
+		name  string
+		cache *config.SessionCache
+	}{
+		{name: "Negative size", cache: &config.SessionCache{Size: -1}},
+		{name: "Invalid ttl", cache: &config.SessionCache{TTL: "soon"}},
+		{name: "Negative negative ttl", cache: &config.SessionCache{NegativeTTL: "-5s"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				SessionStore:   &config.SessionStore{Type: "memory", Cache: tc.cache},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
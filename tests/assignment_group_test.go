@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestAssignmentGroup(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	paths := []string{"/cart", "/checkout", "/payment"}
+	var rules []config.RoutingRule
+	for _, path := range paths {
+		for _, variant := range []string{"control", "treatment"} {
+			server := newMockServer(path + " " + variant)
+			defer server.close()
+			rules = append(rules, config.RoutingRule{
+				Path:            path,
+				Backend:         server.URL(),
+				Percentage:      30,
+				Experiment:      "checkout-flow",
+				Variant:         variant,
+				AssignmentGroup: "checkout",
+			})
+		}
+	}
+
+	serve := func(middleware http.Handler, path, sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+	sessionIDs := make([]string, 50)
+	for i := range sessionIDs {
+		sessionIDs[i] = base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+	}
+
+	// check serves every path to every session and checks each session gets one variant on all of
+	// them, with some sessions in each variant and some left on the default backend.
+	check := func(middleware http.Handler) {
+		counts := make(map[string]int)
+		for _, sessionID := range sessionIDs {
+			var variant string
+			for i, path := range paths {
+				got := serve(middleware, path, sessionID)
+				current := "default"
+				if got != "Default" {
+					current = strings.TrimPrefix(got, path+" ")
+				}
+				if i > 0 && current != variant {
+					t.Errorf("Session %s got %s on %s after %s on %s", sessionID, current, path, variant, paths[0])
+				}
+				variant = current
+			}
+			counts[variant]++
+		}
+		for _, variant := range []string{"default", "control", "treatment"} {
+			if counts[variant] == 0 {
+				t.Errorf("Expected some sessions in %s, got %v", variant, counts)
+			}
+		}
+	}
+
+	t.Run("Without session store", func(t *testing.T) {
+		check(createMiddleware(t, &config.Config{DefaultBackend: defaultServer.URL(), Rules: rules}))
+	})
+
+	t.Run("With session store", func(t *testing.T) {
+		memcached := newFakeMemcached(t)
+		middleware := createMiddleware(t, &config.Config{
+			DefaultBackend: defaultServer.URL(),
+			Rules:          rules,
+			SessionStore:   &config.SessionStore{Type: "memcached", Servers: []string{memcached.addr()}, TTL: "1h"},
+		})
+		check(middleware)
+		// Sessions in a variant are stored once for the group, not once per path.
+		if stored := memcached.len(); stored == 0 || stored >= len(sessionIDs) {
+			t.Errorf("Expected one stored assignment per session in a variant, got %d", stored)
+		}
+	})
+}
+
+func TestInvalidAssignmentGroup(t *testing.T) {
+	grouped := func(path, variant string, percentage float64) config.RoutingRule {
+		return config.RoutingRule{
+			Path: path, Backend: "http://backend", Percentage: percentage, Variant: variant, AssignmentGroup: "checkout",
+		}
+	}
+	testCases := []struct {
+		name  string
+		rules []config.RoutingRule
+	}{
+		{
+			name:  "Without percentage",
+			rules: []config.RoutingRule{grouped("/cart", "control", 0)},
+		},
+		{
+			name:  "Without variant",
+			rules: []config.RoutingRule{grouped("/cart", "", 50)},
+		},
+		{
+			name:  "Different splits",
+			rules: []config.RoutingRule{grouped("/cart", "control", 50), grouped("/checkout", "control", 40)},
+		},
+		{
+			name:  "Missing variant on a path",
+			rules: []config.RoutingRule{grouped("/cart", "control", 50), grouped("/cart", "treatment", 50), grouped("/checkout", "control", 50)},
+		},
+		{
+			name:  "Duplicate variant",
+			rules: []config.RoutingRule{grouped("/cart", "control", 20), grouped("/cart", "control", 20)},
+		},
+		{
+			name: "Mixed with ungrouped rules",
+			rules: []config.RoutingRule{
+				grouped("/cart", "control", 50),
+				{Path: "/cart", Backend: "http://backend", Percentage: 50},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", Rules: tc.rules}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
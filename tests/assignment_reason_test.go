@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestAssignmentReasons(t *testing.T) {
+	backend := newHeaderServer()
+	defer backend.Close()
+	memcached := newFakeMemcached(t)
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		MetricsPath:    "/metrics",
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL + "/a", Percentage: 50, Experiment: "checkout", Variant: "a"},
+			{Path: "/checkout", Backend: backend.URL + "/b", Percentage: 50, Experiment: "checkout", Variant: "b"},
+		},
+		SessionStore: &config.SessionStore{Type: "memcached", Servers: []string{memcached.addr()}, TTL: "1h"},
+		Propagation:  &config.Propagation{},
+	})
+	serve := func(path string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "c2Vzc2lvbi0wMDE="})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	for _, tc := range []struct{ path, want string }{
+		{"/checkout", "rule-match"},
+		{"/checkout", "sticky-reuse"},
+		{"/other", "fallback-default"},
+	} {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(serve(tc.path)), &headers); err != nil || headers["X-Forklift-Assignment"] != tc.want {
+			t.Errorf("Expected assignment reason %s for %s, got %v", tc.want, tc.path, headers)
+		}
+	}
+
+	metrics := serve("/metrics")
+	for _, line := range []string{
+		`forklift_assignments_total{experiment="checkout",reason="rule-match"} 1`,
+		`forklift_assignments_total{experiment="checkout",reason="sticky-reuse"} 1`,
+		`forklift_assignments_total{experiment="",reason="fallback-default"} 1`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestProviderErrorAssignmentReason(t *testing.T) {
+	backend := newHeaderServer()
+	defer backend.Close()
+	var failing atomic.Bool
+	posthog := newFlakyPostHog(t, &failing)
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		Propagation:    &config.Propagation{},
+		Fallback:       &config.Fallback{ProviderError: "default"},
+		FlagProviders: []config.FlagProvider{
+			{Name: "posthog", Type: "posthog", URL: posthog.URL, APIKey: "phc_project", CacheTTL: "0s"},
+		},
+		Rules: []config.RoutingRule{{
+			PathPrefix: "/checkout",
+			Flag: &config.FlagRule{
+				Provider:   "posthog",
+				Name:       "checkout",
+				Treatments: map[string]string{"test": backend.URL},
+			},
+		}},
+	})
+	serve := func() string {
+		req := createTestRequest(t, http.MethodGet, "/checkout", nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "a2Fma2Etc2Vzc2lvbg=="})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		var headers map[string]string
+		_ = json.Unmarshal(rr.Body.Bytes(), &headers)
+		return headers["X-Forklift-Assignment"]
+	}
+
+	if got := serve(); got != "rule-match" {
+		t.Errorf("Expected the flag's treatment to be a rule match, got %q", got)
+	}
+	failing.Store(true)
+	if got := serve(); got != "provider-error" {
+		t.Errorf("Expected the fallback of a failing provider to be a provider error, got %q", got)
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newEchoHeaderServer returns a backend answering with the headers it received as JSON.
+func newEchoHeaderServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(rw).Encode(req.Header)
+	}))
+}
+
+func TestBackendHeaders(t *testing.T) {
+	backend := newEchoHeaderServer()
+	defer backend.Close()
+	thirdParty := newEchoHeaderServer()
+	defer thirdParty.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		Rules:          []config.RoutingRule{{Path: "/partner", Backend: thirdParty.URL}},
+		BackendHeaders: []config.BackendHeader{{
+			Backend:            thirdParty.URL,
+			AllowCookies:       []string{"consent"},
+			StripAuthorization: true,
+			RemoveHeaders:      []string{"x-internal-token"},
+			SetHeaders:         map[string]string{"X-Partner": "forklift"},
+			ForwardedHeaders:   "normalize",
+		}},
+	})
+	serve := func(path string) http.Header {
+		req := createTestRequest(t, http.MethodGet, path, map[string]string{
+			"Authorization":      "Bearer user-token",
+			"Cookie":             "auth=secret; consent=yes",
+			"X-Internal-Token":   "internal",
+			"X-Forwarded-For":    "203.0.113.7, 10.0.0.2",
+			"X-Forwarded-Server": "edge-1",
+			"X-Real-Ip":          "10.0.0.2",
+			"Connection":         "X-Hop",
+			"X-Hop":              "hop",
+			"Te":                 "trailers",
+		}, nil)
+		req.Host = "shop.example.com"
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		var header http.Header
+		if err := json.Unmarshal(rr.Body.Bytes(), &header); err != nil {
+			t.Fatalf("Expected the headers as JSON, got %v: %s", err, rr.Body.String())
+		}
+		return header
+	}
+
+	scrubbed := serve("/partner")
+	if cookie := scrubbed.Get("Cookie"); cookie != "consent=yes" {
+		t.Errorf("Expected only the allowed cookie, got %q", cookie)
+	}
+	for _, name := range []string{"Authorization", "X-Internal-Token", "X-Forwarded-Server", "X-Real-Ip", "X-Hop"} {
+		if value := scrubbed.Get(name); value != "" {
+			t.Errorf("Expected %s to be removed, got %q", name, value)
+		}
+	}
+	if scrubbed.Get("X-Partner") != "forklift" {
+		t.Errorf("Expected the configured header to be set, got %v", scrubbed)
+	}
+	if forwarded := scrubbed.Get("X-Forwarded-For"); forwarded != "203.0.113.7" {
+		t.Errorf("Expected X-Forwarded-For to be the client address, got %q", forwarded)
+	}
+	if scrubbed.Get("X-Forwarded-Host") != "shop.example.com" || scrubbed.Get("X-Forwarded-Proto") != "http" {
+		t.Errorf("Expected the host and protocol of the request, got %v", scrubbed)
+	}
+
+	unscrubbed := serve("/other")
+	if unscrubbed.Get("Authorization") != "Bearer user-token" || unscrubbed.Get("X-Internal-Token") != "internal" {
+		t.Errorf("Expected other backends to get all headers, got %v", unscrubbed)
+	}
+}
+
+func TestBackendHeadersStripForwarded(t *testing.T) {
+	backend := newEchoHeaderServer()
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		BackendHeaders: []config.BackendHeader{{Backend: backend.URL, AllowCookies: []string{}, ForwardedHeaders: "strip"}},
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", map[string]string{
+		"Cookie":            "auth=secret",
+		"X-Forwarded-For":   "203.0.113.7",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         "for=203.0.113.7",
+	}, nil))
+	var header http.Header
+	if err := json.Unmarshal(rr.Body.Bytes(), &header); err != nil {
+		t.Fatalf("Expected the headers as JSON, got %v: %s", err, rr.Body.String())
+	}
+	for _, name := range []string{"Cookie", "X-Forwarded-For", "X-Forwarded-Proto", "Forwarded"} {
+		if value := header.Get(name); value != "" {
+			t.Errorf("Expected %s to be removed, got %q", name, value)
+		}
+	}
+}
+
+func TestInvalidBackendHeaders(t *testing.T) {
+	testCases := []struct {
+		name    string
+		headers []config.BackendHeader
+	}{
+		{name: "Without backend", headers: []config.BackendHeader{{StripAuthorization: true}}},
+		{name: "Duplicate backend", headers: []config.BackendHeader{{Backend: "http://partner"}, {Backend: "http://partner"}}},
+		{name: "Invalid forwarded headers", headers: []config.BackendHeader{{Backend: "http://partner", ForwardedHeaders: "rewrite"}}},
+		{name: "Empty header name", headers: []config.BackendHeader{{Backend: "http://partner", RemoveHeaders: []string{""}}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", BackendHeaders: tc.headers}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestBackendLimitQueueAndOverflow(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+
+	unblock := make(chan struct{})
+	received := make(chan struct{}, 10)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		received <- struct{}{}
+		<-unblock
+		_, _ = w.Write([]byte("Canary"))
+	}))
+	defer canary.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		Rules:          []config.RoutingRule{{Path: "/", Backend: canary.URL}},
+		BackendLimits:  []config.BackendLimit{{Backend: canary.URL, MaxInFlight: 1, MaxQueue: 1, QueueTimeout: "10s"}},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(path string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	results := make(chan string, 2)
+	go func() { results <- serve("/") }()
+	<-received
+	go func() { results <- serve("/") }()
+
+	waitForMetric(t, serve, `forklift_backend_queue_depth{backend="`+canary.URL+`"} 1`)
+
+	if body := serve("/"); body != "Default Backend" {
+		t.Errorf("Expected overflow request to use the default backend, got %q", body)
+	}
+
+	close(unblock)
+	for range 2 {
+		if body := <-results; body != "Canary" {
+			t.Errorf("Expected admitted and queued requests to reach the canary, got %q", body)
+		}
+	}
+
+	metrics := serve("/_forklift/metrics")
+	expected := []string{
+		`forklift_backend_overflow_total{backend="` + canary.URL + `"} 1`,
+		`forklift_backend_queue_depth{backend="` + canary.URL + `"} 0`,
+		`forklift_backend_in_flight{backend="` + canary.URL + `"} 0`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func waitForMetric(t *testing.T, serve func(path string) string, line string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if strings.Contains(serve("/_forklift/metrics"), line) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for metric %q", line)
+}
+
+func TestInvalidBackendLimit(t *testing.T) {
+	testCases := []struct {
+		name  string
+		limit config.BackendLimit
+	}{
+		{name: "Default backend", limit: config.BackendLimit{Backend: "http://localhost:8080", MaxInFlight: 1}},
+		{name: "Missing in-flight limit", limit: config.BackendLimit{Backend: "http://localhost:8081"}},
+		{name: "Invalid queue timeout", limit: config.BackendLimit{Backend: "http://localhost:8081", MaxInFlight: 1, QueueTimeout: "soon"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost:8080",
+				BackendLimits:  []config.BackendLimit{tc.limit},
+			}
+			next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+			if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+				t.Error("Expected error for invalid backend limit, got nil")
+			}
+		})
+	}
+}
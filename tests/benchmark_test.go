@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const benchmarkRuleCount = 1000
+
+// createLargeRuleSet builds a rule set mixing exact paths, path prefixes and header conditions.
+func createLargeRuleSet(count int) *config.Config {
+	rules := make([]config.RoutingRule, 0, count)
+	for i := range count {
+		id := strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			rules = append(rules, config.RoutingRule{
+				Path:    "/exact/" + id,
+				Method:  http.MethodGet,
+				Backend: "http://exact-" + id,
+			})
+		case 1:
+			rules = append(rules, config.RoutingRule{
+				PathPrefix: "/prefix/" + id + "/",
+				Backend:    "http://prefix-" + id,
+				Percentage: 50,
+			})
+		default:
+			rules = append(rules, config.RoutingRule{
+				Path:    "/header/" + id,
+				Backend: "http://header-" + id,
+				Conditions: []config.RuleCondition{
+					{Type: "header", Parameter: "X-Cohort", Operator: "eq", Value: id},
+				},
+			})
+		}
+	}
+	return &config.Config{DefaultBackend: "http://default", Rules: rules}
+}
+
+func newBenchmarkForklift(tb testing.TB) *forklift.Forklift {
+	tb.Helper()
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	f, err := forklift.NewForklift(context.Background(), next, createLargeRuleSet(benchmarkRuleCount), "bench")
+	if err != nil {
+		tb.Fatalf("Failed to create Forklift middleware: %v", err)
+	}
+	return f
+}
+
+func TestLargeRuleSetSelection(t *testing.T) {
+	f := newBenchmarkForklift(t)
+
+	testCases := []struct {
+		name     string
+		path     string
+		header   string
+		expected []string
+	}{
+		{name: "Exact path", path: "/exact/999", expected: []string{"http://exact-999"}},
+		{name: "Path prefix", path: "/prefix/997/items", expected: []string{"http://prefix-997", "http://default"}},
+		{name: "Header condition", path: "/header/998", header: "998", expected: []string{"http://header-998"}},
+		{name: "Header mismatch", path: "/header/998", header: "1", expected: []string{"http://default"}},
+		{name: "No match", path: "/unknown", expected: []string{"http://default"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, tc.path, map[string]string{"X-Cohort": tc.header}, nil)
+			selected := f.SelectBackend(req, "session")
+			if !containsString(tc.expected, selected.Backend) {
+				t.Errorf("Expected backend in %v, got %s", tc.expected, selected.Backend)
+			}
+		})
+	}
+}
+
+func BenchmarkRuleEvaluation(b *testing.B) {
+	f := newBenchmarkForklift(b)
+	paths := []string{"/exact/999", "/prefix/997/items", "/header/998", "/unknown"}
+	requests := make([]*http.Request, len(paths))
+	for i, path := range paths {
+		requests[i] = httptest.NewRequest(http.MethodGet, path, nil)
+		requests[i].Header.Set("X-Cohort", "998")
+	}
+
+	durations := make([]time.Duration, 0, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		start := time.Now()
+		f.SelectBackend(requests[i%len(requests)], "session")
+		durations = append(durations, time.Since(start))
+	}
+	b.StopTimer()
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	b.ReportMetric(float64(durations[len(durations)*99/100].Nanoseconds()), "p99-ns")
+}
+
+func BenchmarkPercentageSelection(b *testing.B) {
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	cfg := &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://v1", Percentage: 50, AffinityToken: "group1"},
+			{Path: "/", Backend: "http://v2", Percentage: 50, AffinityToken: "group2"},
+			{PathPrefix: "/", Backend: "http://v3", Priority: -1},
+		},
+	}
+	f, err := forklift.NewForklift(context.Background(), next, cfg, "bench")
+	if err != nil {
+		b.Fatalf("Failed to create Forklift middleware: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		f.SelectBackend(req, "session")
+	}
+}
+
+func BenchmarkServeHTTP(b *testing.B) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(make([]byte, 64*1024))
+	}))
+	defer backend.Close()
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	cfg := &config.Config{DefaultBackend: backend.URL}
+	f, err := forklift.NewForklift(context.Background(), next, cfg, "bench")
+	if err != nil {
+		b.Fatalf("Failed to create Forklift middleware: %v", err)
+	}
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "c2Vzc2lvbg=="}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(cookie)
+		f.ServeHTTP(httptest.NewRecorder(), req)
+	}
+}
@@ -0,0 +1,260 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const bigQueryTablePath = "/bigquery/v2/projects/analytics/datasets/experiments/tables"
+
+// fakeBigQuery serves the table and insertAll endpoints of the BigQuery API for one table,
+// rejecting rows of the "broken" experiment.
+type fakeBigQuery struct {
+	token string
+
+	mu      sync.Mutex
+	fields  []map[string]interface{}
+	created map[string]interface{}
+	patched []map[string]interface{}
+	rows    []map[string]interface{}
+}
+
+func (f *fakeBigQuery) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer "+f.token {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	table := bigQueryTablePath + "/exposures"
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == table:
+		if f.fields == nil {
+			http.NotFound(rw, req)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"schema": map[string]interface{}{"fields": f.fields}})
+	case req.Method == http.MethodPost && req.URL.Path == bigQueryTablePath:
+		_ = json.NewDecoder(req.Body).Decode(&f.created)
+		f.fields = []map[string]interface{}{}
+		_ = json.NewEncoder(rw).Encode(f.created)
+	case req.Method == http.MethodPatch && req.URL.Path == table:
+		var body struct {
+			Schema struct {
+				Fields []map[string]interface{} `json:"fields"`
+			} `json:"schema"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		f.patched, f.fields = body.Schema.Fields, body.Schema.Fields
+		_ = json.NewEncoder(rw).Encode(body)
+	case req.Method == http.MethodPost && req.URL.Path == table+"/insertAll":
+		var body struct {
+			SkipInvalidRows bool                     `json:"skipInvalidRows"`
+			Rows            []map[string]interface{} `json:"rows"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&body)
+		var valid, insertErrors []map[string]interface{}
+		for i, row := range body.Rows {
+			if row["json"].(map[string]interface{})["experiment"] == "broken" {
+				insertErrors = append(insertErrors, map[string]interface{}{
+					"index":  i,
+					"errors": []map[string]string{{"reason": "invalid", "message": "no such field"}},
+				})
+				continue
+			}
+			valid = append(valid, row)
+		}
+		// Without skipInvalidRows, a rejected row fails the whole request.
+		if len(insertErrors) == 0 || body.SkipInvalidRows {
+			f.rows = append(f.rows, valid...)
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"insertErrors": insertErrors})
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func (f *fakeBigQuery) insertedRows() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.rows...)
+}
+
+func TestBigQueryExposureSink(t *testing.T) {
+	api := &fakeBigQuery{token: "access-token"}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	deadLetters := filepath.Join(t.TempDir(), "bigquery.dead")
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{{
+			Type:           "bigquery",
+			URL:            server.URL,
+			APIKey:         "access-token",
+			Project:        "analytics",
+			Dataset:        "experiments",
+			DeadLetterPath: deadLetters,
+			BatchSize:      2,
+			FlushInterval:  "10ms",
+		}},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+			{Path: "/broken", Backend: backend.URL(), Experiment: "broken", Variant: "v1"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	sessionID := "YmlncXVlcnktc2Vzc2lvbg=="
+	for _, path := range []string{"/checkout", "/broken"} {
+		req := createTestRequest(t, http.MethodGet, path, map[string]string{"Cookie": sessionCookieName + "=" + sessionID}, nil)
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	waitFor(t, func() bool {
+		data, _ := os.ReadFile(deadLetters)
+		return len(api.insertedRows()) == 1 && strings.Contains(string(data), "no such field")
+	})
+
+	row := api.insertedRows()[0]
+	values := row["json"].(map[string]interface{})
+	if row["insertId"] == "" || values["experiment"] != "checkout" || values["variant"] != "v2" || values["session_id"] != sessionID {
+		t.Errorf("Unexpected row %v", row)
+	}
+
+	api.mu.Lock()
+	created := api.created
+	api.mu.Unlock()
+	partitioning, _ := created["timePartitioning"].(map[string]interface{})
+	if partitioning["field"] != "time" {
+		t.Errorf("Expected the table to be partitioned by time, got %v", created)
+	}
+	fields := created["schema"].(map[string]interface{})["fields"].([]interface{})
+	if len(fields) == 0 || fields[0].(map[string]interface{})["name"] != "time" {
+		t.Errorf("Expected the exposure schema, got %v", fields)
+	}
+
+	data, err := os.ReadFile(deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var deadLetter struct {
+		Exposure struct {
+			Experiment string `json:"experiment"`
+		} `json:"exposure"`
+		Errors []map[string]string `json:"errors"`
+	}
+	if err := json.Unmarshal(data, &deadLetter); err != nil || deadLetter.Exposure.Experiment != "broken" || len(deadLetter.Errors) != 1 {
+		t.Errorf("Unexpected dead letter %s: %v", data, err)
+	}
+}
+
+func TestBigQuerySinkServiceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := &fakeBigQuery{token: "service-account-token", fields: []map[string]interface{}{
+		{"name": "time", "type": "TIMESTAMP", "mode": "REQUIRED"},
+		{"name": "experiment", "type": "STRING", "mode": "REQUIRED"},
+		{"name": "variant", "type": "STRING", "mode": "REQUIRED"},
+	}}
+	mux := http.NewServeMux()
+	mux.Handle("/bigquery/", api)
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(req.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(rw, "invalid assertion", http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			http.Error(rw, "invalid signature", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{"access_token": "service-account-token", "expires_in": 3600})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	credentials := filepath.Join(t.TempDir(), "credentials.json")
+	account, _ := json.Marshal(map[string]string{
+		"client_email": "forklift@analytics.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":    server.URL + "/token",
+	})
+	if err := os.WriteFile(credentials, account, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credentials)
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{{
+			Type:          "bigquery",
+			URL:           server.URL,
+			Project:       "analytics",
+			Dataset:       "experiments",
+			FlushInterval: "10ms",
+		}},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+	middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/checkout", nil, nil))
+
+	waitFor(t, func() bool { return len(api.insertedRows()) == 1 })
+
+	// The fields missing from the existing table are added as nullable fields.
+	api.mu.Lock()
+	patched := api.patched
+	api.mu.Unlock()
+	names := make(map[string]string)
+	for _, field := range patched {
+		names[field["name"].(string)] = field["mode"].(string)
+	}
+	if names["experiment"] != "REQUIRED" || names["session_id"] != "NULLABLE" || names["status"] != "NULLABLE" {
+		t.Errorf("Unexpected patched schema %v", patched)
+	}
+}
+
+func TestBigQuerySinkRequiresDataset(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		EventSinks:     []config.EventSink{{Type: "bigquery", APIKey: "token", Project: "analytics"}},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected a bigquery sink without a dataset to be rejected")
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestGlobalBlackout(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+	apiServer := newMockServer("API")
+	defer apiServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v2Server.URL(), Percentage: 100, Experiment: "redesign", Variant: "v2"},
+			{PathPrefix: "/api", Backend: apiServer.URL()},
+		},
+		Blackouts: []config.Blackout{
+			{Name: "black-friday", Start: "2026-11-27T00:00:00Z", End: "2026-11-30T00:00:00Z"},
+		},
+	})
+	var now time.Time
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	serve := func(path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	testCases := []struct {
+		name       string
+		now        string
+		experiment string
+	}{
+		{name: "Before", now: "2026-11-26T23:59:00Z", experiment: "V2"},
+		{name: "During", now: "2026-11-28T12:00:00Z", experiment: "Default"},
+		{name: "After", now: "2026-11-30T00:00:00Z", experiment: "V2"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now, _ = time.Parse(time.RFC3339, tc.now)
+			if body := serve("/"); body != tc.experiment {
+				t.Errorf("Expected %s, got %s", tc.experiment, body)
+			}
+			if body := serve("/api/orders"); body != "API" {
+				t.Errorf("Expected rules outside of experiments to keep routing, got %s", body)
+			}
+		})
+	}
+}
+
+func TestRuleCronBlackout(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	batchServer := newMockServer("Batch")
+	defer batchServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{{
+			PathPrefix: "/reports",
+			Backend:    batchServer.URL(),
+			// Business hours on weekdays.
+			Blackouts: []config.Blackout{{Cron: "0 9 * * 1-5", Duration: "8h"}},
+		}},
+	})
+	var now time.Time
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+
+	testCases := []struct {
+		now      string
+		expected string
+	}{
+		{now: "2026-11-30T08:59:00Z", expected: "Batch"},
+		{now: "2026-11-30T09:00:00Z", expected: "Default"},
+		{now: "2026-11-30T16:59:59Z", expected: "Default"},
+		{now: "2026-11-30T17:00:00Z", expected: "Batch"},
+		{now: "2026-11-28T12:00:00Z", expected: "Batch"},
+	}
+	for _, tc := range testCases {
+		now, _ = time.Parse(time.RFC3339, tc.now)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/reports/daily", nil, nil))
+		if body := strings.TrimSpace(rr.Body.String()); body != tc.expected {
+			t.Errorf("At %s: expected %s, got %s", tc.now, tc.expected, body)
+		}
+	}
+}
+
+func TestInvalidBlackout(t *testing.T) {
+	testCases := []struct {
+		name     string
+		blackout config.Blackout
+	}{
+		{name: "End before start", blackout: config.Blackout{Start: "2026-11-30T00:00:00Z", End: "2026-11-27T00:00:00Z"}},
+		{name: "Without end", blackout: config.Blackout{Start: "2026-11-27T00:00:00Z"}},
+		{name: "Cron with four fields", blackout: config.Blackout{Cron: "0 9 * *", Duration: "1h"}},
+		{name: "Cron out of range", blackout: config.Blackout{Cron: "0 24 * * *", Duration: "1h"}},
+		{name: "Zero step", blackout: config.Blackout{Cron: "*/0 * * * *", Duration: "1h"}},
+		{name: "Cron without duration", blackout: config.Blackout{Cron: "0 9 * * *"}},
+		{name: "Cron with start", blackout: config.Blackout{Cron: "0 9 * * *", Duration: "1h", Start: "2026-11-27T00:00:00Z"}},
+		{name: "Unknown timezone", blackout: config.Blackout{Cron: "0 9 * * *", Duration: "1h", Timezone: "Mars/Olympus"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", Blackouts: []config.Blackout{tc.blackout}}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
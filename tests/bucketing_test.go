@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestPageSplit(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	newPages := newMockServer("New")
+	defer newPages.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/products/", Backend: newPages.URL(), Percentage: 10, BucketBy: "path", BucketPattern: `^/products/([0-9]+)`},
+		},
+	})
+	serve := func(path, sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		if sessionID != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	const products = 1000
+	split := 0
+	for id := 0; id < products; id++ {
+		page := fmt.Sprintf("/products/%d", id)
+		got := serve(page, "")
+		if got == "New" {
+			split++
+		}
+		if other := serve(page+"/reviews", "c2Vzc2lvbi0x"); other != got {
+			t.Fatalf("Expected %s and its reviews on one backend, got %s and %s", page, got, other)
+		}
+		if other := serve(page, "c2Vzc2lvbi0y"); other != got {
+			t.Fatalf("Expected %s on one backend for every session, got %s and %s", page, got, other)
+		}
+	}
+	if split < products/20 || split > products*3/20 {
+		t.Errorf("Expected about 10%% of the products on the new pages, got %d of %d", split, products)
+	}
+}
+
+func TestPageSplitByQuery(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	newPages := newMockServer("New")
+	defer newPages.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/product", Backend: newPages.URL(), Percentage: 100, BucketBy: "query:id"},
+		},
+	})
+	serve := func(path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+	if got := serve("/product?id=42"); got != "New" {
+		t.Errorf("Expected the new pages for a product, got %s", got)
+	}
+	if got := serve("/product"); got != "Default" {
+		t.Errorf("Expected requests without a product ID not to be split, got %s", got)
+	}
+}
+
+func TestInvalidPageSplit(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules []config.RoutingRule
+	}{
+		{name: "Unknown source", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://a", Percentage: 50, BucketBy: "referrer"},
+		}},
+		{name: "Without a percentage", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://a", BucketBy: "url"},
+		}},
+		{name: "Pattern without source", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://a", Percentage: 50, BucketPattern: "[0-9]+"},
+		}},
+		{name: "Invalid pattern", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://a", Percentage: 50, BucketBy: "path", BucketPattern: "("},
+		}},
+		{name: "Mixed bucketing", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://a", Percentage: 50, BucketBy: "url"},
+			{Path: "/a", Backend: "http://b", Percentage: 50},
+		}},
+		{name: "Assignment group", rules: []config.RoutingRule{
+			{Path: "/a", Backend: "http://a", Percentage: 50, Variant: "v2", AssignmentGroup: "checkout", BucketBy: "url"},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost:8080", Rules: tc.rules}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
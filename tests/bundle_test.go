@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+// bundleServer serves rule bundles and their signatures with ETags.
+type bundleServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string]string
+}
+
+func newBundleServer() *bundleServer {
+	b := &bundleServer{objects: make(map[string]string)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b.mu.Lock()
+		body, ok := b.objects[req.URL.Path]
+		b.mu.Unlock()
+		if !ok {
+			http.NotFound(rw, req)
+			return
+		}
+		digest := sha256.Sum256([]byte(body))
+		etag := `"` + hex.EncodeToString(digest[:8]) + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", etag)
+		_, _ = rw.Write([]byte(body))
+	}))
+	return b
+}
+
+func (b *bundleServer) put(path, body string) {
+	b.mu.Lock()
+	b.objects[path] = body
+	b.mu.Unlock()
+}
+
+// minisignKey signs bundles like `minisign -S -l`.
+type minisignKey struct {
+	id      []byte
+	private ed25519.PrivateKey
+	public  string
+}
+
+func newMinisignKey(t *testing.T) *minisignKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := []byte("forklift")
+	raw := append(append([]byte("Ed"), id...), public...)
+	return &minisignKey{
+		id:      id,
+		private: private,
+		public:  "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n",
+	}
+}
+
+func (k *minisignKey) sign(data string) string {
+	signature := ed25519.Sign(k.private, []byte(data))
+	trusted := "timestamp:1760572800\tfile:rules.yaml"
+	global := ed25519.Sign(k.private, append(append([]byte{}, signature...), trusted...))
+	return "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), k.id...), signature...)) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+}
+
+func bundleRules(backend string) string {
+	return "rules:\n  - path: /checkout\n    backend: " + backend + "\n    percentage: 100\n"
+}
+
+func TestRuleBundleReload(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v1Server := newMockServer("Checkout V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Checkout V2")
+	defer v2Server.close()
+
+	key := newMinisignKey(t)
+	bundles := newBundleServer()
+	defer bundles.Close()
+	bundles.put("/rules.yaml", bundleRules(v1Server.URL()))
+	bundles.put("/rules.yaml.minisig", key.sign(bundleRules(v1Server.URL())))
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		RuleBundle: &config.RuleBundle{
+			URL:           bundles.URL + "/rules.yaml",
+			SignatureType: "minisign",
+			PublicKey:     key.public,
+			PollInterval:  "10ms",
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(path string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	if body := serve("/checkout"); body != "Checkout V1" {
+		t.Fatalf("Expected the initial bundle to route to V1, got %q", body)
+	}
+
+	// A new version signed by another key is rejected.
+	other := newMinisignKey(t)
+	bundles.put("/rules.yaml", bundleRules(v2Server.URL()))
+	bundles.put("/rules.yaml.minisig", other.sign(bundleRules(v2Server.URL())))
+	waitForMetric(t, serve, `forklift_rule_bundle_reloads_total{result="failed"}`)
+	if body := serve("/checkout"); body != "Checkout V1" {
+		t.Errorf("Expected an unverified bundle to keep the current rules, got %q", body)
+	}
+
+	bundles.put("/rules.yaml.minisig", key.sign(bundleRules(v2Server.URL())))
+	waitForMetric(t, serve, `forklift_rule_bundle_reloads_total{result="applied"} 2`)
+	if body := serve("/checkout"); body != "Checkout V2" {
+		t.Errorf("Expected the signed bundle to route to V2, got %q", body)
+	}
+}
+
+func TestRuleBundleCosignSignature(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	canaryServer := newMockServer("Canary")
+	defer canaryServer.close()
+
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	sign := func(data string) string {
+		digest := sha256.Sum256([]byte(data))
+		signature, err := ecdsa.SignASN1(rand.Reader, private, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.StdEncoding.EncodeToString(signature)
+	}
+
+	testCases := []struct {
+		name      string
+		bundle    string
+		signature string
+		expected  string
+	}{
+		{name: "Valid signature", bundle: bundleRules(canaryServer.URL()), signature: sign(bundleRules(canaryServer.URL())), expected: "Canary"},
+		{name: "Tampered bundle", bundle: bundleRules(canaryServer.URL()), signature: sign(bundleRules(defaultServer.URL())), expected: "Default Backend"},
+		{name: "Missing signature", bundle: bundleRules(canaryServer.URL()), expected: "Default Backend"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			bundles := newBundleServer()
+			defer bundles.Close()
+			bundles.put("/rules.yaml", tc.bundle)
+			if tc.signature != "" {
+				bundles.put("/rules.yaml.sig", tc.signature)
+			}
+
+			// The inline rules serve until a verified bundle loads.
+			cfg := &config.Config{
+				DefaultBackend: defaultServer.URL(),
+				Rules:          []config.RoutingRule{{Path: "/checkout", Backend: defaultServer.URL(), Percentage: 100}},
+				RuleBundle:     &config.RuleBundle{URL: bundles.URL + "/rules.yaml", PublicKey: publicKey},
+			}
+			middleware := createMiddleware(t, cfg)
+
+			req := createTestRequest(t, http.MethodGet, "/checkout", nil, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRefererAndUTMConditions(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	landingServer := newMockServer("Landing Backend")
+	defer landingServer.close()
+	searchServer := newMockServer("Search Backend")
+	defer searchServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:     "/",
+				Backend:  landingServer.URL(),
+				Priority: 2,
+				Conditions: []config.RuleCondition{
+					{Type: "utm", Parameter: "source", Operator: "eq", Value: "newsletter"},
+					{Type: "utm", Parameter: "utm_campaign", Operator: "prefix", Value: "spring"},
+				},
+			},
+			{
+				Path:     "/",
+				Backend:  searchServer.URL(),
+				Priority: 1,
+				Conditions: []config.RuleCondition{
+					{Type: "referer", Operator: "domain", Value: "google.com"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name         string
+		path         string
+		referer      string
+		expectedBody string
+	}{
+		{
+			name:         "UTM parameters match",
+			path:         "/?utm_source=Newsletter&utm_campaign=spring-sale",
+			expectedBody: "Landing Backend",
+		},
+		{
+			name:         "Partial UTM parameters",
+			path:         "/?utm_source=newsletter",
+			expectedBody: "Default Backend",
+		},
+		{
+			name:         "Referer domain",
+			path:         "/",
+			referer:      "https://google.com/search?q=forklift",
+			expectedBody: "Search Backend",
+		},
+		{
+			name:         "Referer subdomain with port",
+			path:         "/",
+			referer:      "https://www.Google.com:443/",
+			expectedBody: "Search Backend",
+		},
+		{
+			name:         "Referer lookalike domain",
+			path:         "/",
+			referer:      "https://notgoogle.com/",
+			expectedBody: "Default Backend",
+		},
+		{
+			name:         "No referer",
+			path:         "/",
+			expectedBody: "Default Backend",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tc.referer != "" {
+				headers["Referer"] = tc.referer
+			}
+			req := createTestRequest(t, http.MethodGet, tc.path, headers, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
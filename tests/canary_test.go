@@ -0,0 +1,182 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// fakePrometheus answers instant queries with the value set for the variant in the query.
+type fakePrometheus struct {
+	server *httptest.Server
+
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newFakePrometheus(t *testing.T, values map[string]string) *fakePrometheus {
+	t.Helper()
+	p := &fakePrometheus{values: values}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/query" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query().Get("query")
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		for variant, value := range p.values {
+			if strings.Contains(query, fmt.Sprintf(`variant="%s"`, variant)) {
+				fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000000,"%s"]}]}}`, value)
+				return
+			}
+		}
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	t.Cleanup(p.server.Close)
+	return p
+}
+
+func TestCanaryAnalysis(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	newMiddleware := func(prometheus *fakePrometheus) http.Handler {
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: defaultServer.URL(),
+			MetricsPath:    "/metrics",
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v1Server.URL(), Percentage: 100, Experiment: "checkout", Variant: "v1"},
+				{Path: "/", Backend: v2Server.URL(), Percentage: 1, Experiment: "checkout", Variant: "v2"},
+			},
+			CanaryAnalysis: &config.CanaryAnalysis{
+				Prometheus: prometheus.server.URL,
+				Interval:   "10ms",
+				Canaries: []config.Canary{{
+					Experiment: "checkout",
+					Canary:     "v2",
+					Baseline:   "v1",
+					Steps:      []float64{10, 50, 100},
+					Metrics: []config.CanaryMetric{
+						{Name: "error-rate", Query: `error_rate{experiment="{experiment}",variant="{variant}"}`, Tolerance: 0.5},
+						{Name: "latency", Query: `latency{variant="{variant}"}`, Direction: "either"},
+					},
+				}},
+			},
+		})
+	}
+	serve := func(middleware http.Handler, path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+	served := func(middleware http.Handler) map[string]int {
+		counts := make(map[string]int)
+		for range 200 {
+			counts[serve(middleware, "/")]++
+		}
+		return counts
+	}
+
+	t.Run("Promoted", func(t *testing.T) {
+		prometheus := newFakePrometheus(t, map[string]string{"v1": "0.01", "v2": "0.0105"})
+		middleware := newMiddleware(prometheus)
+		waitFor(t, func() bool {
+			return strings.Contains(serve(middleware, "/metrics"),
+				`forklift_canary_decisions_total{experiment="checkout",variant="v2",decision="promote"} 1`)
+		})
+		metrics := serve(middleware, "/metrics")
+		if !strings.Contains(metrics, `forklift_canary_decisions_total{experiment="checkout",variant="v2",decision="advance"} 2`) {
+			t.Errorf("Expected the canary to advance through its steps:\n%s", metrics)
+		}
+		if counts := served(middleware); counts["V2"] != 200 {
+			t.Errorf("Expected all traffic on the canary, got %v", counts)
+		}
+	})
+
+	t.Run("Rolled back", func(t *testing.T) {
+		prometheus := newFakePrometheus(t, map[string]string{"v1": "0.01", "v2": "0.2"})
+		middleware := newMiddleware(prometheus)
+		waitFor(t, func() bool {
+			return strings.Contains(serve(middleware, "/metrics"),
+				`forklift_canary_decisions_total{experiment="checkout",variant="v2",decision="rollback"} 1`)
+		})
+		if counts := served(middleware); counts["V1"] != 200 {
+			t.Errorf("Expected all traffic on the baseline, got %v", counts)
+		}
+		if metrics := serve(middleware, "/metrics"); !strings.Contains(metrics, `forklift_canary_score{experiment="checkout",variant="v2"} 0`) {
+			t.Errorf("Expected a score of 0 with both metrics failing:\n%s", metrics)
+		}
+	})
+
+	t.Run("Held without data", func(t *testing.T) {
+		prometheus := newFakePrometheus(t, map[string]string{"v1": "0.01"})
+		middleware := newMiddleware(prometheus)
+		time.Sleep(100 * time.Millisecond)
+		counts := served(middleware)
+		if counts["V1"] == 0 || counts["V2"] == 0 {
+			t.Errorf("Expected the canary to stay at its first step, got %v", counts)
+		}
+		if metrics := serve(middleware, "/metrics"); strings.Contains(metrics, "forklift_canary_decisions_total{") {
+			t.Errorf("Expected no decision without canary data:\n%s", metrics)
+		}
+	})
+}
+
+func TestInvalidCanaryAnalysis(t *testing.T) {
+	rules := []config.RoutingRule{
+		{Path: "/", Backend: "http://v1", Percentage: 90, Experiment: "checkout", Variant: "v1"},
+		{Path: "/", Backend: "http://v2", Percentage: 10, Experiment: "checkout", Variant: "v2"},
+	}
+	valid := func() config.Canary {
+		return config.Canary{
+			Experiment: "checkout", Canary: "v2", Baseline: "v1", Steps: []float64{10, 100},
+			Metrics: []config.CanaryMetric{{Query: `up{variant="{variant}"}`}},
+		}
+	}
+	testCases := []struct {
+		name     string
+		analysis config.CanaryAnalysis
+		modify   func(*config.Canary)
+	}{
+		{name: "Invalid Prometheus URL", analysis: config.CanaryAnalysis{Prometheus: "prometheus:9090"}},
+		{name: "Invalid interval", analysis: config.CanaryAnalysis{Interval: "often"}},
+		{name: "Unknown variant", modify: func(c *config.Canary) { c.Canary = "v3" }},
+		{name: "Same variants", modify: func(c *config.Canary) { c.Baseline = "v2" }},
+		{name: "Decreasing steps", modify: func(c *config.Canary) { c.Steps = []float64{50, 10} }},
+		{name: "Step above 100", modify: func(c *config.Canary) { c.Steps = []float64{150} }},
+		{name: "Marginal above pass", modify: func(c *config.Canary) { c.PassScore, c.MarginalScore = 60, 80 }},
+		{name: "Without metrics", modify: func(c *config.Canary) { c.Metrics = nil }},
+		{name: "Unknown direction", modify: func(c *config.Canary) { c.Metrics[0].Direction = "up" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			analysis := tc.analysis
+			if analysis.Prometheus == "" {
+				analysis.Prometheus = "http://prometheus:9090"
+			}
+			canary := valid()
+			if tc.modify != nil {
+				tc.modify(&canary)
+			}
+			analysis.Canaries = []config.Canary{canary}
+			cfg := &config.Config{DefaultBackend: "http://localhost", Rules: rules, CanaryAnalysis: &analysis}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
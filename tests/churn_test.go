@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func churnConfig(control, treatment, webhookURL string) *config.Config {
+	return &config.Config{
+		DefaultBackend: control,
+		MetricsPath:    "/metrics",
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: control, Percentage: 50, Experiment: "checkout", Variant: "control"},
+			{Path: "/", Backend: treatment, Percentage: 50, Experiment: "checkout", Variant: "treatment"},
+		},
+		Churn: &config.Churn{Source: "header:X-User-ID", Window: "1m", Threshold: 5, MinReturning: 100, WebhookURL: webhookURL},
+	}
+}
+
+func TestAssignmentChurnAlert(t *testing.T) {
+	control := newMockServer("Control")
+	defer control.close()
+	treatment := newMockServer("Treatment")
+	defer treatment.close()
+	alerts := make(chan map[string]any, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert map[string]any
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &alert); err != nil {
+			t.Errorf("Invalid alert %q: %v", body, err)
+		}
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	middleware := createMiddleware(t, churnConfig(control.URL(), treatment.URL(), webhook.URL))
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	serve := func(path, userID, sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, path, map[string]string{"X-User-ID": userID}, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(sessionID))})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	// Every request loses its session cookie, so returning users are assigned again.
+	for visit := 0; visit < 2; visit++ {
+		for user := 0; user < 200; user++ {
+			serve("/", fmt.Sprintf("user-%d", user), fmt.Sprintf("session-%d-%d", user, visit))
+		}
+	}
+	now = now.Add(time.Minute)
+	serve("/", "user-0", "session-0-2")
+
+	select {
+	case alert := <-alerts:
+		if alert["returning"] != float64(200) {
+			t.Errorf("Expected 200 returning requests, got %v", alert["returning"])
+		}
+		if percentage, _ := alert["percentage"].(float64); percentage < 30 || percentage > 70 {
+			t.Errorf("Expected about half of the returning requests to change variants, got %v", alert["percentage"])
+		}
+		if experiments, _ := alert["experiments"].(map[string]any); experiments["checkout"] != alert["changed"] {
+			t.Errorf("Expected the changes to be counted for checkout, got %v", alert["experiments"])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a churn alert")
+	}
+	metrics := serve("/metrics", "", "")
+	if !strings.Contains(metrics, "forklift_assignment_churn_alerts_total 1") {
+		t.Errorf("Expected one churn alert in the metrics, got:\n%s", metrics)
+	}
+	if !strings.Contains(metrics, `forklift_assignment_changes_total{experiment="checkout"}`) {
+		t.Errorf("Expected the changes of checkout in the metrics, got:\n%s", metrics)
+	}
+}
+
+func TestAssignmentChurnStickySessions(t *testing.T) {
+	control := newMockServer("Control")
+	defer control.close()
+	treatment := newMockServer("Treatment")
+	defer treatment.close()
+
+	middleware := createMiddleware(t, churnConfig(control.URL(), treatment.URL(), ""))
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	serve := func(path, userID, sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, path, map[string]string{"X-User-ID": userID}, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(sessionID))})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	for visit := 0; visit < 2; visit++ {
+		for user := 0; user < 200; user++ {
+			serve("/", fmt.Sprintf("user-%d", user), fmt.Sprintf("session-%d", user))
+		}
+	}
+	now = now.Add(time.Minute)
+	serve("/", "user-0", "session-0")
+
+	metrics := serve("/metrics", "", "")
+	if !strings.Contains(metrics, "forklift_assignment_churn_percent 0") {
+		t.Errorf("Expected no churn for sticky sessions, got:\n%s", metrics)
+	}
+	if strings.Contains(metrics, "forklift_assignment_churn_alerts_total 1") {
+		t.Errorf("Expected no churn alert, got:\n%s", metrics)
+	}
+}
+
+func TestInvalidChurn(t *testing.T) {
+	for name, churn := range map[string]*config.Churn{
+		"source":      {Source: "path"},
+		"window":      {Window: "often"},
+		"threshold":   {Threshold: 150},
+		"returning":   {MinReturning: -1},
+		"webhook URL": {WebhookURL: "/alerts"},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost:8080", Churn: churn}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for an invalid %s", name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// fakeClickHouse records the statements and inserted rows it receives over the HTTP interface.
+type fakeClickHouse struct {
+	mu         sync.Mutex
+	statements []string
+	rows       []map[string]interface{}
+	tokens     []string
+}
+
+func (f *fakeClickHouse) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("X-ClickHouse-User") != "forklift" || req.Header.Get("X-ClickHouse-Key") != "secret" {
+		http.Error(rw, "Code: 516. DB::Exception: Authentication failed", http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	query := req.URL.Query().Get("query")
+	if query == "" {
+		body, _ := io.ReadAll(req.Body)
+		f.statements = append(f.statements, string(body))
+		return
+	}
+	if query != "INSERT INTO `analytics`.`exposures` FORMAT JSONEachRow" {
+		http.Error(rw, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+		return
+	}
+	f.tokens = append(f.tokens, req.URL.Query().Get("insert_deduplication_token"))
+	scanner := bufio.NewScanner(req.Body)
+	for scanner.Scan() {
+		var row map[string]interface{}
+		_ = json.Unmarshal(scanner.Bytes(), &row)
+		f.rows = append(f.rows, row)
+	}
+}
+
+func TestClickHouseExposureSink(t *testing.T) {
+	api := &fakeClickHouse{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{{
+			Type:          "clickhouse",
+			URL:           server.URL,
+			APIKey:        "forklift:secret",
+			Database:      "analytics",
+			FlushInterval: "10ms",
+		}},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	sessionID := "Y2xpY2tob3VzZS1zZXNzaW9u"
+	req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Cookie": sessionCookieName + "=" + sessionID}, nil)
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	waitFor(t, func() bool {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		return len(api.rows) == 1
+	})
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	row := api.rows[0]
+	if row["experiment"] != "checkout" || row["variant"] != "v2" || row["session_id"] != sessionID || row["status"] != float64(http.StatusOK) {
+		t.Errorf("Unexpected row %v", row)
+	}
+	if _, err := time.Parse("2006-01-02 15:04:05.000", row["time"].(string)); err != nil {
+		t.Errorf("Expected a ClickHouse DateTime64 time, got %v", row["time"])
+	}
+	if _, ok := row["duration_ms"]; !ok {
+		t.Errorf("Expected the request duration in %v", row)
+	}
+	if api.tokens[0] == "" {
+		t.Error("Expected a deduplication token for retried batches")
+	}
+
+	schema := strings.Join(api.statements, "\n")
+	for _, statement := range []string{
+		"CREATE TABLE IF NOT EXISTS `analytics`.`exposures` (",
+		"ALTER TABLE `analytics`.`exposures` ADD COLUMN IF NOT EXISTS time",
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS `analytics`.`exposures_hourly_mv` TO `analytics`.`exposures_hourly`",
+		"CREATE MATERIALIZED VIEW IF NOT EXISTS `analytics`.`exposures_status_daily_mv` TO `analytics`.`exposures_status_daily`",
+	} {
+		if !strings.Contains(schema, statement) {
+			t.Errorf("Expected %q among the schema statements:\n%s", statement, schema)
+		}
+	}
+}
+
+func TestClickHouseSinkRejectsInvalidTable(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		EventSinks:     []config.EventSink{{Type: "clickhouse", URL: "http://localhost:8123", Table: "exposures; DROP TABLE users"}},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected a table name that isn't an identifier to be rejected")
+	}
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestClientHintConditions(t *testing.T) {
+	defaultServer := newMockServer("Full Version")
+	defer defaultServer.close()
+	liteServer := newMockServer("Lite Version")
+	defer liteServer.close()
+	chromeServer := newMockServer("Chrome Experiment")
+	defer chromeServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/",
+				Backend:    liteServer.URL(),
+				Priority:   3,
+				Conditions: []config.RuleCondition{{Type: "clientHint", Parameter: "deviceMemory", Operator: "lt", Value: "2"}},
+			},
+			{
+				Path:       "/",
+				Backend:    liteServer.URL(),
+				Priority:   2,
+				Conditions: []config.RuleCondition{{Type: "clientHint", Parameter: "saveData", Operator: "eq", Value: "true"}},
+			},
+			{
+				Path:     "/",
+				Backend:  chromeServer.URL(),
+				Priority: 1,
+				Conditions: []config.RuleCondition{
+					{Type: "clientHint", Parameter: "brand", Operator: "eq", Value: "google chrome"},
+					{Type: "clientHint", Parameter: "mobile", Operator: "eq", Value: "true"},
+					{Type: "clientHint", Parameter: "platform", Operator: "eq", Value: "android"},
+				},
+			},
+		},
+	})
+
+	testCases := []struct {
+		name         string
+		headers      map[string]string
+		expectedBody string
+	}{
+		{name: "Low memory device", headers: map[string]string{"Sec-CH-Device-Memory": "0.5"}, expectedBody: "Lite Version"},
+		{name: "Legacy device memory header", headers: map[string]string{"Device-Memory": "1"}, expectedBody: "Lite Version"},
+		{name: "High memory device", headers: map[string]string{"Device-Memory": "8"}, expectedBody: "Full Version"},
+		{name: "Save data", headers: map[string]string{"Save-Data": "on"}, expectedBody: "Lite Version"},
+		{
+			name: "Chrome on Android",
+			headers: map[string]string{
+				"Sec-CH-UA":          `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
+				"Sec-CH-UA-Mobile":   "?1",
+				"Sec-CH-UA-Platform": `"Android"`,
+			},
+			expectedBody: "Chrome Experiment",
+		},
+		{
+			name: "Chrome on desktop",
+			headers: map[string]string{
+				"Sec-CH-UA":          `"Chromium";v="124", "Google Chrome";v="124"`,
+				"Sec-CH-UA-Mobile":   "?0",
+				"Sec-CH-UA-Platform": `"Android"`,
+			},
+			expectedBody: "Full Version",
+		},
+		{name: "Without hints", expectedBody: "Full Version"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", tc.headers, nil))
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+			expected := "Sec-CH-Device-Memory, Device-Memory, Save-Data, Sec-CH-UA, Sec-CH-UA-Mobile, Sec-CH-UA-Platform"
+			if acceptCH := rr.Header().Get("Accept-CH"); acceptCH != expected {
+				t.Errorf("Expected Accept-CH %q, got %q", expected, acceptCH)
+			}
+		})
+	}
+}
+
+func TestNoAcceptCHWithoutClientHintConditions(t *testing.T) {
+	backend := newMockServer("Backend")
+	defer backend.close()
+
+	middleware := createMiddleware(t, &config.Config{DefaultBackend: backend.URL()})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if acceptCH := rr.Header().Get("Accept-CH"); acceptCH != "" {
+		t.Errorf("Expected no Accept-CH header, got %q", acceptCH)
+	}
+}
+
+func TestUnknownClientHint(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{{
+			Path:       "/",
+			Backend:    "http://localhost:8081",
+			Conditions: []config.RuleCondition{{Type: "clientHint", Parameter: "battery", Operator: "lt", Value: "20"}},
+		}},
+	}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for unknown client hint, got nil")
+	}
+}
@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestClusterCounters(t *testing.T) {
+	redis := newFakeRedis(t)
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	newInstance := func() http.Handler {
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: v1Server.URL(),
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v1Server.URL(), Percentage: 50, Experiment: "checkout", Variant: "v1"},
+				{Path: "/", Backend: v2Server.URL(), Percentage: 50, Experiment: "checkout", Variant: "v2"},
+			},
+			SessionStore:    &config.SessionStore{Type: "redis", Servers: []string{redis.addr()}},
+			ClusterCounters: &config.ClusterCounters{FlushInterval: "20ms"},
+			ResultsExport: &config.ResultsExport{
+				Destination: t.TempDir(),
+				Goals:       []config.Goal{{Name: "purchase", Path: "/thanks"}},
+			},
+			AdminAPI: &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", UI: true},
+		})
+	}
+	first, second := newInstance(), newInstance()
+
+	for i := range 20 {
+		sessionID := fmt.Sprintf("first-%02d", i)
+		serveWithSession(t, first, sessionID)
+		if i < 3 {
+			req := createTestRequest(t, http.MethodGet, "/thanks", nil, nil)
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+			first.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+	for i := range 10 {
+		serveWithSession(t, second, fmt.Sprintf("second-%02d", i))
+	}
+
+	overview := func(middleware http.Handler) (local, cluster, conversions int64) {
+		var o struct {
+			Experiments []struct {
+				Variants []struct {
+					Requests int64 `json:"requests"`
+					Cluster  *struct {
+						Requests    int64            `json:"requests"`
+						Conversions map[string]int64 `json:"conversions"`
+					} `json:"cluster"`
+				} `json:"variants"`
+			} `json:"experiments"`
+		}
+		rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/overview", "")
+		if err := json.Unmarshal(rr.Body.Bytes(), &o); err != nil || len(o.Experiments) != 1 {
+			t.Fatalf("Expected the overview of one experiment, got %v: %s", err, rr.Body.String())
+		}
+		for _, variant := range o.Experiments[0].Variants {
+			local += variant.Requests
+			if variant.Cluster != nil {
+				cluster += variant.Cluster.Requests
+				conversions += variant.Cluster.Conversions["purchase"]
+			}
+		}
+		return local, cluster, conversions
+	}
+
+	waitFor(t, func() bool {
+		_, cluster, conversions := overview(second)
+		return cluster == 30 && conversions == 3
+	})
+	if local, _, _ := overview(second); local != 10 {
+		t.Errorf("Expected the live counts to stay per instance, got %d requests", local)
+	}
+	waitFor(t, func() bool {
+		_, cluster, _ := overview(first)
+		return cluster == 30
+	})
+}
+
+func TestClusterCountersRequireCounters(t *testing.T) {
+	for name, sessionStore := range map[string]*config.SessionStore{
+		"Without a session store": nil,
+		"DynamoDB":                {Type: "dynamodb", Table: "sessions", Region: "us-east-1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend:  "http://localhost:8080",
+				SessionStore:    sessionStore,
+				ClusterCounters: &config.ClusterCounters{},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected cluster counters to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestCompression(t *testing.T) {
+	large := strings.Repeat(`{"product":"forklift"},`, 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/large":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("ETag", `"v1"`)
+			_, _ = io.WriteString(rw, large)
+		case "/v2/streamed":
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			for i := 0; i < 4; i++ {
+				_, _ = io.WriteString(rw, large[:len(large)/4])
+				rw.(http.Flusher).Flush()
+			}
+		case "/v2/small":
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(rw, `{"product":"forklift"}`)
+		case "/v2/image":
+			rw.Header().Set("Content-Type", "image/png")
+			_, _ = io.WriteString(rw, large)
+		case "/v2/compressed":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(rw)
+			_, _ = io.WriteString(gz, large)
+			_ = gz.Close()
+		}
+	}))
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost",
+		Rules: []config.RoutingRule{{
+			PathPrefix:  "/v2",
+			Backend:     backend.URL,
+			Percentage:  100,
+			Compression: &config.Compression{MinSize: 256},
+		}},
+	})
+
+	testCases := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		encoding       string
+		expected       string
+	}{
+		{name: "Large", path: "/v2/large", acceptEncoding: "gzip, br", encoding: "br", expected: large},
+		{name: "Gzip preferred", path: "/v2/large", acceptEncoding: "br;q=0.5, gzip", encoding: "gzip", expected: large},
+		{name: "Any", path: "/v2/large", acceptEncoding: "*", encoding: "br", expected: large},
+		{name: "Streamed", path: "/v2/streamed", acceptEncoding: "gzip", encoding: "gzip", expected: large},
+		{name: "Streamed Brotli", path: "/v2/streamed", acceptEncoding: "br", encoding: "br", expected: large},
+		{name: "Small", path: "/v2/small", acceptEncoding: "gzip", expected: `{"product":"forklift"}`},
+		{name: "Not allowed type", path: "/v2/image", acceptEncoding: "gzip", expected: large},
+		{name: "Not accepted", path: "/v2/large", acceptEncoding: "identity, br;q=0, gzip;q=0", expected: large},
+		{name: "Already compressed", path: "/v2/compressed", acceptEncoding: "gzip, br", encoding: "gzip", expected: large},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, tc.path, map[string]string{"Accept-Encoding": tc.acceptEncoding}, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+			if encoding := rr.Header().Get("Content-Encoding"); encoding != tc.encoding {
+				t.Fatalf("Expected encoding %q, got headers %v", tc.encoding, rr.Header())
+			}
+			body := rr.Body.String()
+			if tc.encoding != "" {
+				var decoder io.Reader = brotli.NewReader(rr.Body)
+				if tc.encoding == "gzip" {
+					gz, err := gzip.NewReader(rr.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					decoder = gz
+				}
+				data, err := io.ReadAll(decoder)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(data)
+			}
+			if body != tc.expected {
+				t.Errorf("Expected the original body, got %q", body)
+			}
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/v2/large", map[string]string{"Accept-Encoding": "gzip"}, nil))
+	if rr.Header().Get("ETag") != `W/"v1"` || rr.Header().Get("Content-Length") != "" || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Expected a weak ETag, no length and Vary, got %v", rr.Header())
+	}
+}
+
+func TestInvalidCompression(t *testing.T) {
+	testCases := []struct {
+		name        string
+		compression *config.Compression
+	}{
+		{name: "Negative size", compression: &config.Compression{MinSize: -1}},
+		{name: "Invalid content type", compression: &config.Compression{ContentTypes: []string{"json"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Compression: tc.compression}},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
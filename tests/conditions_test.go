@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestCustomConditionEvaluator(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	liteServer := newMockServer("Lite Backend")
+	defer liteServer.close()
+
+	forklift.RegisterConditionEvaluator("test-device", forklift.ConditionEvaluatorFunc(
+		func(req *http.Request, condition config.RuleCondition) bool {
+			return req.Header.Get("X-Device") == condition.Value
+		}))
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:    "/",
+				Backend: liteServer.URL(),
+				Conditions: []config.RuleCondition{
+					{Type: "custom", Parameter: "test-device", Value: "low-end"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name         string
+		device       string
+		expectedBody string
+	}{
+		{name: "Evaluator matches", device: "low-end", expectedBody: "Lite Backend"},
+		{name: "Evaluator does not match", device: "high-end", expectedBody: "Default Backend"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, "/", map[string]string{"X-Device": tc.device}, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestUnknownConditionEvaluator(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/",
+				Backend:    "http://localhost:8081",
+				Conditions: []config.RuleCondition{{Type: "custom", Parameter: "does-not-exist"}},
+			},
+		},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for unknown condition evaluator, got nil")
+	}
+}
+
+func TestQueryConditionDecoding(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	campaignServer := newMockServer("Campaign Backend")
+	defer campaignServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:    "/landing",
+				Backend: campaignServer.URL(),
+				Conditions: []config.RuleCondition{
+					{Type: "query", QueryParam: "utm campaign", Operator: "eq", Value: "spring sale"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name         string
+		path         string
+		expectedBody string
+	}{
+		{name: "Encoded key and value", path: "/landing?utm+campaign=spring%20sale", expectedBody: "Campaign Backend"},
+		{name: "First value wins", path: "/landing?x=1&utm%20campaign=spring+sale&utm+campaign=other", expectedBody: "Campaign Backend"},
+		{name: "Different value", path: "/landing?utm+campaign=winter", expectedBody: "Default Backend"},
+		{name: "Missing parameter", path: "/landing?utm=spring+sale", expectedBody: "Default Backend"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, tc.path, nil, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// serveOnConnection sends requests over one keep-alive connection without keeping cookies, as
+// API clients do, and returns the bodies of the responses.
+func serveOnConnection(t *testing.T, server *httptest.Server, requests int) []string {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	defer client.CloseIdleConnections()
+	var bodies []string
+	for i := 0; i < requests; i++ {
+		reused := false
+		trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused }}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, server.URL+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if i > 0 && !reused {
+			t.Fatalf("Expected request %d to reuse the connection", i)
+		}
+		bodies = append(bodies, strings.TrimSpace(string(body)))
+	}
+	return bodies
+}
+
+func connectionConfig(a, b, ttl string) *config.Config {
+	return &config.Config{
+		DefaultBackend: a,
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/", Backend: a, Percentage: 50},
+			{PathPrefix: "/", Backend: b, Percentage: 50},
+		},
+		ConnectionPinTTL: ttl,
+	}
+}
+
+func TestKeepAliveRequestsAreEvaluatedAgain(t *testing.T) {
+	a := newMockServer("A")
+	defer a.close()
+	b := newMockServer("B")
+	defer b.close()
+	server := httptest.NewServer(createMiddleware(t, connectionConfig(a.URL(), b.URL(), "")))
+	defer server.Close()
+
+	seen := make(map[string]int)
+	for _, body := range serveOnConnection(t, server, 40) {
+		seen[body]++
+	}
+	if seen["A"] == 0 || seen["B"] == 0 {
+		t.Errorf("Expected the requests of a connection without session cookies to be split, got %v", seen)
+	}
+}
+
+func TestConnectionPins(t *testing.T) {
+	a := newMockServer("A")
+	defer a.close()
+	b := newMockServer("B")
+	defer b.close()
+	server := httptest.NewServer(createMiddleware(t, connectionConfig(a.URL(), b.URL(), "1m")))
+	defer server.Close()
+
+	seen := make(map[string]int)
+	for connection := 0; connection < 10; connection++ {
+		bodies := serveOnConnection(t, server, 10)
+		for _, body := range bodies[1:] {
+			if body != bodies[0] {
+				t.Fatalf("Expected every request of a connection to get the same backend, got %v", bodies)
+			}
+		}
+		seen[bodies[0]]++
+	}
+	if seen["A"] == 0 || seen["B"] == 0 {
+		t.Errorf("Expected connections to be split, got %v", seen)
+	}
+}
+
+func TestForwardedRequestsAreNotPinned(t *testing.T) {
+	a := newMockServer("A")
+	defer a.close()
+	b := newMockServer("B")
+	defer b.close()
+	middleware := createMiddleware(t, connectionConfig(a.URL(), b.URL(), "1m"))
+	// The connection is a trusted proxy's, which forwards the requests of many clients.
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Header.Set("X-Forwarded-For", "203.0.113.7")
+		middleware.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	seen := make(map[string]int)
+	for _, body := range serveOnConnection(t, server, 40) {
+		seen[body]++
+	}
+	if seen["A"] == 0 || seen["B"] == 0 {
+		t.Errorf("Expected the requests forwarded by a proxy not to be pinned to its connection, got %v", seen)
+	}
+}
+
+func TestInvalidConnectionPinTTL(t *testing.T) {
+	cfg := &config.Config{DefaultBackend: "http://localhost:8080", ConnectionPinTTL: "forever"}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected an error for an invalid connection pin TTL")
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestConsentGating(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v2Server := newMockServer("Checkout V2")
+	defer v2Server.close()
+
+	sink := newRecordingSink("consent", true)
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/metrics",
+		Consent:        &config.Consent{Source: "cookie:consent", Purpose: "analytics"},
+		EventSinks: []config.EventSink{
+			{Name: "consent", Type: "recording", FlushInterval: "10ms"},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: v2Server.URL(), Percentage: 100, Experiment: "checkout", Variant: "v2"},
+		},
+	})
+
+	testCases := []struct {
+		name    string
+		consent string
+		want    string
+	}{
+		{name: "No consent", want: "Default Backend"},
+		{name: "Other purpose", consent: "marketing", want: "Default Backend"},
+		{name: "Consent", consent: "marketing,analytics", want: "Checkout V2"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, "/checkout", nil, nil)
+			if tc.consent != "" {
+				req.AddCookie(&http.Cookie{Name: "consent", Value: tc.consent})
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, body)
+			}
+			setsSession := strings.Contains(rr.Header().Get("Set-Cookie"), sessionCookieName)
+			if consented := tc.want != "Default Backend"; setsSession != consented {
+				t.Errorf("Expected session cookie to be set: %v, got %q", consented, rr.Header().Get("Set-Cookie"))
+			}
+		})
+	}
+
+	waitFor(t, func() bool {
+		_, delivered := sink.snapshot()
+		return len(delivered) == 1
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/metrics", nil, nil))
+	if !strings.Contains(rr.Body.String(), "forklift_requests_without_consent_total 2") {
+		t.Errorf("Expected 2 requests without consent, got metrics:\n%s", rr.Body.String())
+	}
+}
+
+func TestConsentCondition(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v2Server := newMockServer("Checkout V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/checkout",
+				Backend:    v2Server.URL(),
+				Conditions: []config.RuleCondition{{Type: "consent", Parameter: "header:X-TCF-Consent"}},
+			},
+		},
+	})
+
+	testCases := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "TCF string", headers: map[string]string{"X-TCF-Consent": "CPXxRfAPXxRfAAfKABENB-CgAAAAAAAAAAYgAAAAAAAA"}, want: "Checkout V2"},
+		{name: "No TCF string", want: "Default Backend"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/checkout", tc.headers, nil))
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.want {
+				t.Errorf("Expected %q, got %q", tc.want, body)
+			}
+		})
+	}
+}
+
+func TestInvalidConsentSource(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  *config.Config
+	}{
+		{name: "Global", cfg: &config.Config{DefaultBackend: "http://localhost", Consent: &config.Consent{Source: "path"}}},
+		{name: "Condition", cfg: &config.Config{
+			DefaultBackend: "http://localhost",
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: "http://localhost:8081", Conditions: []config.RuleCondition{{Type: "consent", Parameter: "cookie"}}},
+			},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), tc.cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
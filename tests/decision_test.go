@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRemoteDecision(t *testing.T) {
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+	v1Server := newMockServer("v1")
+	defer v1Server.close()
+	v2Server := newMockServer("v2")
+	defer v2Server.close()
+
+	var calls atomic.Int32
+	decisions := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var body struct {
+			SessionID   string              `json:"sessionId"`
+			Headers     map[string]string   `json:"headers"`
+			Experiments map[string][]string `json:"experiments"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Expected a JSON request, got %v", err)
+		}
+		if fmt.Sprint(body.Experiments) != "map[home:[v1 v2]]" {
+			t.Errorf("Expected the variants of home, got %v", body.Experiments)
+		}
+		switch body.Headers["X-Plan"] {
+		case "pro":
+			_, _ = w.Write([]byte(`{"experiment": "home", "variant": "v2"}`))
+		case "free":
+			_, _ = fmt.Fprintf(w, `{"backend": %q}`, defaultServer.URL())
+		case "unknown":
+			_, _ = w.Write([]byte(`{"backend": "http://elsewhere"}`))
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+			_, _ = w.Write([]byte(`{"experiment": "home", "variant": "v2"}`))
+		case "broken":
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer decisions.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1Server.URL(), Experiment: "home", Variant: "v1"},
+			{Path: "/", Backend: v2Server.URL(), Experiment: "home", Variant: "v2", Match: "header:X-Beta eq true"},
+		},
+		Decision: &config.Decision{Type: "remote", URL: decisions.URL, Timeout: "50ms", Headers: []string{"X-Plan"}},
+	})
+
+	tests := []struct {
+		plan     string
+		expected string
+	}{
+		{plan: "pro", expected: "v2"},
+		{plan: "free", expected: "default"},
+		{plan: "none", expected: "v1"},
+		{plan: "unknown", expected: "v1"},
+		{plan: "slow", expected: "v1"},
+		{plan: "broken", expected: "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.plan, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, "/", map[string]string{"X-Plan": tt.plan}, nil)
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(tt.plan))})
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+			if body := strings.TrimSpace(rr.Body.String()); body != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, body)
+			}
+		})
+	}
+
+	// Answers are cached per session and path, errors are not.
+	before := calls.Load()
+	for _, plan := range []string{"pro", "broken"} {
+		req := createTestRequest(t, http.MethodGet, "/", map[string]string{"X-Plan": plan}, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(plan))})
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if made := calls.Load() - before; made != 1 {
+		t.Errorf("Expected only the failed decision to be asked again, got %d calls", made)
+	}
+}
+
+func TestRemoteDecisionCacheClock(t *testing.T) {
+	backend := newMockServer("v1")
+	defer backend.close()
+
+	var calls atomic.Int32
+	decisions := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = w.Write([]byte(`{"experiment": "home", "variant": "v1"}`))
+	}))
+	defer decisions.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		Rules:          []config.RoutingRule{{Path: "/", Backend: backend.URL(), Experiment: "home", Variant: "v1"}},
+		Decision:       &config.Decision{Type: "remote", URL: decisions.URL, CacheTTL: "1m"},
+	})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	serve := func() {
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte("session"))})
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve()
+	serve()
+	if calls.Load() != 1 {
+		t.Errorf("Expected the answer to be cached, got %d calls", calls.Load())
+	}
+	now = now.Add(2 * time.Minute)
+	serve()
+	if calls.Load() != 2 {
+		t.Errorf("Expected the answer to expire with the clock of the middleware, got %d calls", calls.Load())
+	}
+}
+
+func TestInvalidDecision(t *testing.T) {
+	testCases := []struct {
+		name     string
+		decision *config.Decision
+	}{
+		{name: "Unknown type", decision: &config.Decision{Type: "grpc", URL: "http://decisions"}},
+		{name: "Missing URL", decision: &config.Decision{Type: "remote"}},
+		{name: "Invalid timeout", decision: &config.Decision{Type: "remote", URL: "http://decisions", Timeout: "soon"}},
+		{name: "Zero timeout", decision: &config.Decision{Type: "remote", URL: "http://decisions", Timeout: "0s"}},
+		{name: "Negative cache TTL", decision: &config.Decision{Type: "remote", URL: "http://decisions", CacheTTL: "-1m"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost:8080", Decision: tc.decision}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
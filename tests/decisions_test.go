@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+type recentDecision struct {
+	Path      string  `json:"path"`
+	Rule      string  `json:"rule"`
+	Variant   string  `json:"variant"`
+	Status    int     `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+}
+
+func TestAdminAPIDecisions(t *testing.T) {
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: v1Server.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: failing.URL, Experiment: "checkout", Variant: "v2"},
+		},
+		AdminAPI: &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", Decisions: 3},
+	})
+	for _, path := range []string{"/one", "/checkout", "/two", "/three", "/checkout"} {
+		middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, path, nil, nil))
+	}
+
+	decisions := func(query string) []recentDecision {
+		t.Helper()
+		rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/decisions"+query, "")
+		var body struct {
+			Decisions []recentDecision `json:"decisions"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Expected the decisions as JSON, got %v: %s", err, rr.Body.String())
+		}
+		return body.Decisions
+	}
+
+	recent := decisions("")
+	if len(recent) != 3 || recent[0].Path != "/checkout" || recent[1].Path != "/three" || recent[2].Path != "/two" {
+		t.Fatalf("Expected the last 3 decisions, newest first, got %+v", recent)
+	}
+	if recent[0].Rule != "checkout/v2" || recent[0].Variant != "v2" || recent[0].Status != http.StatusBadGateway {
+		t.Errorf("Expected the decision of the checkout rule, got %+v", recent[0])
+	}
+	if recent[1].Rule != "default" || recent[1].Status != http.StatusOK || recent[1].LatencyMS <= 0 {
+		t.Errorf("Expected the decision of the default backend, got %+v", recent[1])
+	}
+	if filtered := decisions("?status=5xx"); len(filtered) != 1 || filtered[0].Path != "/checkout" {
+		t.Errorf("Expected the 5xx decision, got %+v", filtered)
+	}
+	if filtered := decisions("?rule=default&limit=1"); len(filtered) != 1 || filtered[0].Path != "/three" {
+		t.Errorf("Expected the newest decision of the default backend, got %+v", filtered)
+	}
+	if rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/decisions?limit=x", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid limit to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestAdminAPIDecisionsDisabled(t *testing.T) {
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+	})
+	if rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/decisions", ""); rr.Code != http.StatusNotImplemented {
+		t.Errorf("Expected decisions to be unavailable, got %d", rr.Code)
+	}
+
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", Decisions: -1},
+	}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected a negative number of decisions to be rejected")
+	}
+}
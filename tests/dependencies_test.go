@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestExperimentDependencies(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	controlServer := newMockServer("Auth Control")
+	defer controlServer.close()
+	treatmentServer := newMockServer("Auth Treatment")
+	defer treatmentServer.close()
+	checkoutServer := newMockServer("Checkout Treatment")
+	defer checkoutServer.close()
+	bannerServer := newMockServer("Banner")
+	defer bannerServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/login", Backend: controlServer.URL(), Percentage: 50, Experiment: "new-auth", Variant: "control"},
+			{Path: "/login", Backend: treatmentServer.URL(), Percentage: 50, Experiment: "new-auth", Variant: "treatment"},
+			{
+				Path:       "/checkout",
+				Backend:    checkoutServer.URL(),
+				Experiment: "new-checkout",
+				Variant:    "treatment",
+				Requires:   &config.ExperimentMembership{Experiment: "new-auth", Variant: "treatment"},
+			},
+			{
+				Path:     "/banner",
+				Backend:  bannerServer.URL(),
+				Excludes: &config.ExperimentMembership{Experiment: "new-checkout"},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(path, sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	counts := make(map[string]int)
+	for i := range 200 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte("dependency-session-" + strconv.Itoa(i)))
+		checkout := serve("/checkout", sessionID)
+		banner := serve("/banner", sessionID)
+		login := serve("/login", sessionID)
+		counts[login]++
+
+		expectedCheckout, expectedBanner := "Default Backend", "Banner"
+		if login == "Auth Treatment" {
+			expectedCheckout, expectedBanner = "Checkout Treatment", "Default Backend"
+		}
+		if checkout != expectedCheckout {
+			t.Errorf("Session in %q: expected checkout %q, got %q", login, expectedCheckout, checkout)
+		}
+		if banner != expectedBanner {
+			t.Errorf("Session in %q: expected banner %q, got %q", login, expectedBanner, banner)
+		}
+	}
+
+	if counts["Auth Control"] == 0 || counts["Auth Treatment"] == 0 {
+		t.Errorf("Expected sessions in both variants of the prerequisite, got %v", counts)
+	}
+}
+
+func TestExperimentDependenciesWithSessionStore(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	controlServer := newMockServer("Auth Control")
+	defer controlServer.close()
+	treatmentServer := newMockServer("Auth Treatment")
+	defer treatmentServer.close()
+	checkoutServer := newMockServer("Checkout Treatment")
+	defer checkoutServer.close()
+
+	beta := []config.RuleCondition{{Type: "header", Parameter: "X-Beta", Operator: "eq", Value: "1"}}
+	redis := newFakeRedis(t)
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		SessionStore:   &config.SessionStore{Type: "redis", Servers: []string{redis.addr()}},
+		Rules: []config.RoutingRule{
+			{Path: "/login", Backend: controlServer.URL(), Percentage: 50, Experiment: "new-auth", Variant: "control", Conditions: beta},
+			{Path: "/login", Backend: treatmentServer.URL(), Percentage: 50, Experiment: "new-auth", Variant: "treatment", Conditions: beta},
+			{
+				Path:     "/checkout",
+				Backend:  checkoutServer.URL(),
+				Requires: &config.ExperimentMembership{Experiment: "new-auth"},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(path, sessionID string, beta bool) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		if beta {
+			req.Header.Set("X-Beta", "1")
+		}
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+	storedKeys := func() int {
+		redis.mu.Lock()
+		defer redis.mu.Unlock()
+		return len(redis.data)
+	}
+
+	for i := range 20 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte("stored-dependency-" + strconv.Itoa(i)))
+		if got := serve("/checkout", sessionID, true); got != "Default Backend" {
+			t.Errorf("Expected sessions without an assignment to be in no variant, got %q", got)
+		}
+		if keys := storedKeys(); keys != i {
+			t.Fatalf("Expected the membership check not to store an assignment, got %d keys", keys)
+		}
+		if got := serve("/login", sessionID, true); got != "Auth Control" && got != "Auth Treatment" {
+			t.Fatalf("Expected a variant of the prerequisite, got %q", got)
+		}
+		if got := serve("/checkout", sessionID, true); got != "Checkout Treatment" {
+			t.Errorf("Expected the assigned session to be a member, got %q", got)
+		}
+		if got := serve("/checkout", sessionID, false); got != "Default Backend" {
+			t.Errorf("Expected requests outside of the prerequisite's conditions to be in no variant, got %q", got)
+		}
+	}
+}
+
+func TestInvalidExperimentDependencies(t *testing.T) {
+	testCases := []struct {
+		name  string
+		rules []config.RoutingRule
+	}{
+		{
+			name: "Unknown experiment",
+			rules: []config.RoutingRule{
+				{Path: "/", Backend: "http://localhost:8081", Requires: &config.ExperimentMembership{Experiment: "missing"}},
+			},
+		},
+		{
+			name: "Cycle",
+			rules: []config.RoutingRule{
+				{Path: "/a", Backend: "http://localhost:8081", Experiment: "a", Requires: &config.ExperimentMembership{Experiment: "b"}},
+				{Path: "/b", Backend: "http://localhost:8082", Experiment: "b", Excludes: &config.ExperimentMembership{Experiment: "a"}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost:8080", Rules: tc.rules}
+			next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+			if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+				t.Error("Expected error for invalid dependencies, got nil")
+			}
+		})
+	}
+}
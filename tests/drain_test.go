@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func createDrainConfig(defaultURL, v1URL, v2URL string, drain *config.Drain) *config.Config {
+	return &config.Config{
+		DefaultBackend: defaultURL,
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1URL, Percentage: 50, Experiment: "frontend", Variant: "v1"},
+			{Path: "/", Backend: v2URL, Percentage: 50, Experiment: "frontend", Variant: "v2", Drain: drain},
+		},
+	}
+}
+
+func TestDrainVariant(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	now := time.Now()
+	undrained := createMiddleware(t, createDrainConfig(defaultServer.URL(), v1Server.URL(), v2Server.URL(), nil))
+	draining := createMiddleware(t, createDrainConfig(defaultServer.URL(), v1Server.URL(), v2Server.URL(), &config.Drain{
+		Since:       now.Add(-time.Hour).Format(time.RFC3339),
+		GracePeriod: "24h",
+	}))
+	drained := createMiddleware(t, createDrainConfig(defaultServer.URL(), v1Server.URL(), v2Server.URL(), &config.Drain{
+		Since:       now.Add(-48 * time.Hour).Format(time.RFC3339),
+		GracePeriod: "24h",
+	}))
+
+	serve := func(middleware http.Handler, sessionID string, firstSeen time.Time) string {
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		if sessionID != "" {
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+			req.AddCookie(&http.Cookie{Name: firstSeenCookieName, Value: strconv.FormatInt(firstSeen.Unix(), 10)})
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	onV2 := 0
+	for i := range 200 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte("drain-session-" + strconv.Itoa(i)))
+		assigned := serve(undrained, sessionID, now.Add(-2*time.Hour))
+		if assigned == "V2" {
+			onV2++
+		}
+
+		if got := serve(draining, sessionID, now.Add(-2*time.Hour)); got != assigned {
+			t.Errorf("Existing session: expected %q during grace period, got %q", assigned, got)
+		}
+
+		expected := assigned
+		if assigned == "V2" {
+			expected = "Default Backend"
+		}
+		if got := serve(draining, sessionID, now.Add(-10*time.Minute)); got != expected {
+			t.Errorf("Session created after drain: expected %q, got %q", expected, got)
+		}
+		if got := serve(drained, sessionID, now.Add(-72*time.Hour)); got != expected {
+			t.Errorf("Session after grace period: expected %q, got %q", expected, got)
+		}
+		if got := serve(draining, "", time.Time{}); got == "V2" {
+			t.Error("Expected new sessions not to be assigned to a draining variant")
+		}
+	}
+
+	if onV2 == 0 {
+		t.Error("Expected some sessions to be assigned to the drained variant before the drain")
+	}
+}
+
+func TestDrainVariantConfig(t *testing.T) {
+	cfg := createExperimentConfig()
+	since := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if err := cfg.DrainVariant("checkout", "v2", since, 72*time.Hour); err != nil {
+		t.Fatalf("Failed to drain variant: %v", err)
+	}
+	drain := cfg.Rules[1].Drain
+	if drain == nil || drain.Since != "2024-05-01T12:00:00Z" || drain.GracePeriod != "72h0m0s" {
+		t.Errorf("Unexpected drain: %+v", drain)
+	}
+	if cfg.Rules[0].Drain != nil || cfg.Rules[2].Drain != nil {
+		t.Error("Expected other variants not to be drained")
+	}
+	if err := cfg.DrainVariant("checkout", "missing", since, time.Hour); err == nil {
+		t.Error("Expected error for unknown variant")
+	}
+}
+
+func TestDrainWithSessionStore(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	cfg := createDrainConfig(defaultServer.URL(), v1Server.URL(), v2Server.URL(), nil)
+	cfg.SessionStore = &config.SessionStore{Type: "redis", Servers: []string{newFakeRedis(t).addr()}}
+	cfg.AdminAPI = &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", UI: true}
+	middleware := createMiddleware(t, cfg)
+	serve := func(sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		req.AddCookie(&http.Cookie{Name: firstSeenCookieName, Value: strconv.FormatInt(time.Now().Add(-2*time.Hour).Unix(), 10)})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	assigned := make(map[string]string)
+	for i := range 100 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte("stored-session-" + strconv.Itoa(i)))
+		assigned[sessionID] = serve(sessionID)
+	}
+
+	for _, body := range []string{`{"variant": ""}`, `{"variant": "v2", "gracePeriod": "-1h"}`, `{"variant": "v3"}`} {
+		if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/experiments/frontend/drain", body); rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, rr.Code)
+		}
+	}
+	if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/experiments/frontend/drain", `{"variant": "v2", "gracePeriod": "1h"}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected v2 to be drained, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	for sessionID, backend := range assigned {
+		if got := serve(sessionID); got != backend {
+			t.Errorf("Expected session %s to keep its stored assignment %q, got %q", sessionID, backend, got)
+		}
+	}
+	// Sessions older than the drain but without an assignment to the variant don't get it.
+	onDefault := 0
+	for i := range 100 {
+		switch serve(base64.URLEncoding.EncodeToString([]byte("unstored-session-" + strconv.Itoa(i)))) {
+		case "V2":
+			t.Fatal("Expected sessions without a stored assignment not to be assigned a draining variant")
+		case "Default Backend":
+			onDefault++
+		}
+	}
+	if onDefault == 0 {
+		t.Error("Expected the sessions of the draining variant to fall through to the default backend")
+	}
+}
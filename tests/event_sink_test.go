@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/events"
+)
+
+var errSinkDown = errors.New("sink is down")
+
+// recordingSink is a custom event sink that records delivered exposures while it is up.
+type recordingSink struct {
+	mu        sync.Mutex
+	up        bool
+	attempts  int
+	delivered []events.Exposure
+}
+
+func (r *recordingSink) Send(_ context.Context, batch []events.Exposure) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.attempts++
+	if !r.up {
+		return errSinkDown
+	}
+	r.delivered = append(r.delivered, batch...)
+	return nil
+}
+
+func (r *recordingSink) snapshot() (attempts int, delivered []events.Exposure) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.attempts, append([]events.Exposure(nil), r.delivered...)
+}
+
+var (
+	recordingSinksMu sync.Mutex
+	recordingSinks   = make(map[string]*recordingSink)
+)
+
+func init() {
+	forklift.RegisterEventSink("recording", func(cfg config.EventSink, _ events.Options) (forklift.EventSink, error) {
+		recordingSinksMu.Lock()
+		defer recordingSinksMu.Unlock()
+		return recordingSinks[cfg.Name], nil
+	})
+}
+
+func newRecordingSink(name string, up bool) *recordingSink {
+	sink := &recordingSink{up: up}
+	recordingSinksMu.Lock()
+	recordingSinks[name] = sink
+	recordingSinksMu.Unlock()
+	return sink
+}
+
+func TestEventSinkBufferSurvivesRestart(t *testing.T) {
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	bufferPath := filepath.Join(t.TempDir(), "exposures.buffer")
+	newConfig := func(name string) *config.Config {
+		return &config.Config{
+			DefaultBackend: backend.URL(),
+			EventSinks: []config.EventSink{
+				{Name: name, Type: "recording", FlushInterval: "10ms", MaxRetries: 1, SpillPath: bufferPath},
+			},
+			Rules: []config.RoutingRule{
+				{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+			},
+		}
+	}
+
+	// The first instance can't reach its sink, so exposures stay in the buffer.
+	down := newRecordingSink("down", false)
+	middleware := createMiddleware(t, newConfig("down"))
+	for range 3 {
+		middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/checkout", nil, nil))
+	}
+	waitFor(t, func() bool {
+		attempts, _ := down.snapshot()
+		return attempts >= 2
+	})
+
+	// A new instance with the same buffer delivers them.
+	up := newRecordingSink("up", true)
+	createMiddleware(t, newConfig("up"))
+	waitFor(t, func() bool {
+		_, delivered := up.snapshot()
+		return len(delivered) >= 3
+	})
+	_, delivered := up.snapshot()
+	for _, exposure := range delivered {
+		if exposure.Experiment != "checkout" || exposure.Variant != "v2" {
+			t.Errorf("Unexpected exposure: %+v", exposure)
+		}
+	}
+}
+
+func TestEventSinkBufferOverwritesOldest(t *testing.T) {
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	// The buffer holds two exposures, so the third overwrites the first.
+	sink := newRecordingSink("small", false)
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		EventSinks: []config.EventSink{{
+			Name:          "small",
+			Type:          "recording",
+			FlushInterval: "10ms",
+			MaxRetries:    1,
+			SpillPath:     filepath.Join(t.TempDir(), "exposures.buffer"),
+			SpillMaxBytes: 600,
+		}},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+	serve := func(path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return rr.Body.String()
+	}
+
+	for range 3 {
+		serve("/checkout")
+	}
+	waitForMetric(t, serve, `forklift_events_dropped_total{sink="small"} 1`)
+
+	sink.mu.Lock()
+	sink.up = true
+	sink.mu.Unlock()
+	waitFor(t, func() bool {
+		_, delivered := sink.snapshot()
+		return len(delivered) == 2
+	})
+	waitForMetric(t, serve, `forklift_events_sent_total{sink="small"} 2`)
+}
+
+func TestUnknownEventSinkType(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		EventSinks:     []config.EventSink{{Type: "carrier-pigeon"}},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected an unregistered sink type to be rejected")
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("Timed out waiting for condition")
+}
@@ -0,0 +1,203 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func createExperimentConfig() *config.Config {
+	return &config.Config{
+		DefaultBackend: "http://default",
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: "http://v1", Percentage: 60, Experiment: "checkout", Variant: "control"},
+			{Path: "/checkout", Backend: "http://v2", Percentage: 20, Experiment: "checkout", Variant: "v2"},
+			{Path: "/checkout", Backend: "http://v3", Percentage: 20, Experiment: "checkout", Variant: "v3"},
+			{Path: "/search", Backend: "http://search", Experiment: "search", Variant: "new"},
+		},
+	}
+}
+
+func TestPromoteVariant(t *testing.T) {
+	t.Run("Partial promotion rebalances other variants", func(t *testing.T) {
+		cfg := createExperimentConfig()
+		if err := cfg.PromoteVariant("checkout", "v2", 50); err != nil {
+			t.Fatalf("Failed to promote variant: %v", err)
+		}
+		expected := []float64{37.5, 50, 12.5}
+		for i, percentage := range expected {
+			if cfg.Rules[i].Percentage != percentage {
+				t.Errorf("Rule %d: expected percentage %v, got %v", i, percentage, cfg.Rules[i].Percentage)
+			}
+			if cfg.Rules[i].Paused {
+				t.Errorf("Rule %d: expected rule not to be paused", i)
+			}
+		}
+	})
+
+	t.Run("Full promotion pauses other variants", func(t *testing.T) {
+		cfg := createExperimentConfig()
+		if err := cfg.PromoteVariant("checkout", "v2", 100); err != nil {
+			t.Fatalf("Failed to promote variant: %v", err)
+		}
+		if cfg.Rules[1].Percentage != 100 || cfg.Rules[1].Paused {
+			t.Errorf("Expected promoted variant at 100%% and active, got %+v", cfg.Rules[1])
+		}
+		if !cfg.Rules[0].Paused || !cfg.Rules[2].Paused {
+			t.Error("Expected remaining variants to be paused")
+		}
+		if cfg.Rules[3].Paused {
+			t.Error("Expected rules of other experiments to be untouched")
+		}
+	})
+
+	t.Run("Partial promotion resumes variants paused by a full one", func(t *testing.T) {
+		cfg := createExperimentConfig()
+		if err := cfg.PromoteVariant("checkout", "v2", 100); err != nil {
+			t.Fatalf("Failed to promote variant: %v", err)
+		}
+		if err := cfg.PromoteVariant("checkout", "v2", 20); err != nil {
+			t.Fatalf("Failed to promote variant: %v", err)
+		}
+		expected := []float64{60, 20, 20}
+		for i, percentage := range expected {
+			if cfg.Rules[i].Percentage != percentage || cfg.Rules[i].Paused {
+				t.Errorf("Rule %d: expected percentage %v and active, got %+v", i, percentage, cfg.Rules[i])
+			}
+		}
+	})
+
+	t.Run("Variants weighted 0 stay paused", func(t *testing.T) {
+		cfg := createExperimentConfig()
+		if err := cfg.SetVariantWeight("checkout", "v3", 0); err != nil {
+			t.Fatalf("Failed to set weight: %v", err)
+		}
+		if err := cfg.PromoteVariant("checkout", "v2", 50); err != nil {
+			t.Fatalf("Failed to promote variant: %v", err)
+		}
+		if !cfg.Rules[2].Paused {
+			t.Errorf("Expected the variant weighted 0 to stay paused, got %+v", cfg.Rules[2])
+		}
+		if cfg.Rules[0].Percentage != 50 || cfg.Rules[0].Paused {
+			t.Errorf("Expected the control to take the rest, got %+v", cfg.Rules[0])
+		}
+	})
+
+	t.Run("Unknown experiment or variant", func(t *testing.T) {
+		cfg := createExperimentConfig()
+		if err := cfg.PromoteVariant("missing", "v2", 100); err == nil {
+			t.Error("Expected error for unknown experiment")
+		}
+		if err := cfg.PromoteVariant("checkout", "missing", 100); err == nil {
+			t.Error("Expected error for unknown variant")
+		}
+		if err := cfg.PromoteVariant("checkout", "v2", 0); err == nil {
+			t.Error("Expected error for zero percentage")
+		}
+	})
+}
+
+func TestSetExperimentPaused(t *testing.T) {
+	cfg := createExperimentConfig()
+	if err := cfg.SetExperimentPaused("checkout", true); err != nil {
+		t.Fatalf("Failed to pause experiment: %v", err)
+	}
+	for _, i := range cfg.ExperimentRules("checkout") {
+		if !cfg.Rules[i].Paused {
+			t.Errorf("Rule %d: expected rule to be paused", i)
+		}
+	}
+	if cfg.Rules[3].Paused {
+		t.Error("Expected rules of other experiments to be untouched")
+	}
+}
+
+func TestDiffRules(t *testing.T) {
+	oldCfg := createExperimentConfig()
+	newCfg := createExperimentConfig()
+	newCfg.Rules[1].Percentage = 40
+	newCfg.Rules = append(newCfg.Rules[:2], config.RoutingRule{Path: "/new", Backend: "http://new"})
+
+	changes, err := config.DiffRules(oldCfg.Rules, newCfg.Rules)
+	if err != nil {
+		t.Fatalf("Failed to diff rules: %v", err)
+	}
+
+	kinds := make(map[string]string)
+	for _, change := range changes {
+		kinds[change.Key] = change.Kind
+		if change.Kind == config.RuleChanged {
+			if len(change.Fields) != 1 || change.Fields[0].Name != "percentage" || change.Fields[0].New != "40" {
+				t.Errorf("Unexpected field changes for %s: %+v", change.Key, change.Fields)
+			}
+		}
+	}
+
+	expected := map[string]string{
+		"checkout/v2":          config.RuleChanged,
+		"checkout/v3":          config.RuleRemoved,
+		"search/new":           config.RuleRemoved,
+		"* /new -> http://new": config.RuleAdded,
+	}
+	for key, kind := range expected {
+		if kinds[key] != kind {
+			t.Errorf("Expected %s to be %s, got %q", key, kind, kinds[key])
+		}
+	}
+	if len(changes) != len(expected) {
+		t.Errorf("Expected %d changes, got %d: %+v", len(expected), len(changes), changes)
+	}
+}
+
+func TestDiffRulesWithSharedKeys(t *testing.T) {
+	oldRules := []config.RoutingRule{
+		{Path: "/api", Backend: "http://api", Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Beta", Operator: "exists"}}},
+		{Path: "/api", Backend: "http://api", Percentage: 10},
+	}
+	newRules := []config.RoutingRule{
+		{Path: "/api", Backend: "http://api", Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Beta", Operator: "exists"}}},
+		{Path: "/api", Backend: "http://api", Percentage: 20},
+		{Path: "/api", Backend: "http://api", Percentage: 5},
+	}
+
+	changes, err := config.DiffRules(oldRules, newRules)
+	if err != nil {
+		t.Fatalf("Failed to diff rules: %v", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %+v", changes)
+	}
+	if changes[0].Key != "* /api -> http://api #2" || changes[0].Kind != config.RuleChanged ||
+		len(changes[0].Fields) != 1 || changes[0].Fields[0].Name != "percentage" {
+		t.Errorf("Expected the second rule to have changed, got %+v", changes[0])
+	}
+	if changes[1].Key != "* /api -> http://api #3" || changes[1].Kind != config.RuleAdded {
+		t.Errorf("Expected the third rule to have been added, got %+v", changes[1])
+	}
+}
+
+func TestPausedRulesAreSkipped(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v2Server := newMockServer("V2 Backend")
+	defer v2Server.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: v2Server.URL(), Experiment: "checkout", Variant: "v2", Paused: true},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	req := createTestRequest(t, http.MethodGet, "/checkout", nil, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if body := strings.TrimSpace(rr.Body.String()); body != "Default Backend" {
+		t.Errorf("Expected paused rule to be skipped, got body %q", body)
+	}
+}
@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestExposureLogSampling(t *testing.T) {
+	okServer := newMockServer("OK")
+	defer okServer.close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failingServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: okServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		ExposureLog: &config.ExposureLog{
+			Enabled:         true,
+			SampleRate:      10,
+			AlwaysLogErrors: true,
+			Experiments:     []config.ExperimentSampling{{Experiment: "checkout", SampleRate: 50}},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: okServer.URL(), Experiment: "checkout", Variant: "v2"},
+			{Path: "/search", Backend: okServer.URL(), Experiment: "search", Variant: "new"},
+			{Path: "/broken", Backend: failingServer.URL, Experiment: "broken", Variant: "v1"},
+			{Path: "/plain", Backend: okServer.URL()},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	requests := map[string]int{"/checkout": 120, "/search": 25, "/broken": 3, "/plain": 5}
+	for path, count := range requests {
+		for range count {
+			req := createTestRequest(t, http.MethodGet, path, nil, nil)
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+
+	req := createTestRequest(t, http.MethodGet, "/_forklift/metrics", nil, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	body := rr.Body.String()
+
+	expected := []string{
+		`forklift_exposures_total{experiment="checkout",variant="v2"} 120`,
+		`forklift_exposures_total{experiment="search",variant="new"} 25`,
+		`forklift_exposures_total{experiment="broken",variant="v1"} 3`,
+		`forklift_exposures_logged_total{experiment="checkout",variant="v2"} 3`,
+		`forklift_exposures_logged_total{experiment="search",variant="new"} 3`,
+		`forklift_exposures_logged_total{experiment="broken",variant="v1"} 3`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "forklift_exposures") && strings.Contains(line, "plain") {
+			t.Errorf("Expected rules without an experiment not to be counted, got:\n%s", body)
+		}
+	}
+}
+
+func TestExposureLogInvalidSampleRate(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		ExposureLog:    &config.ExposureLog{Enabled: true, SampleRate: -1},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for negative sample rate, got nil")
+	}
+}
+
+func TestExposureDedup(t *testing.T) {
+	okServer := newMockServer("OK")
+	defer okServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: okServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		ExposureLog:    &config.ExposureLog{Enabled: true},
+		ExposureDedup:  &config.ExposureDedup{Window: "30m"},
+		Rules:          []config.RoutingRule{{Path: "/checkout", Backend: okServer.URL(), Experiment: "checkout", Variant: "v2"}},
+	})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	serve := func(path, session string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: session})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	for range 10 {
+		serve("/checkout", "c2Vzc2lvbi0x")
+	}
+	now = now.Add(30 * time.Minute)
+	for range 5 {
+		serve("/checkout", "c2Vzc2lvbi0x")
+	}
+	serve("/checkout", "c2Vzc2lvbi0y")
+
+	body := serve("/_forklift/metrics", "")
+	for _, line := range []string{
+		`forklift_exposures_total{experiment="checkout",variant="v2"} 16`,
+		`forklift_exposures_logged_total{experiment="checkout",variant="v2"} 3`,
+		`forklift_exposures_suppressed_total{experiment="checkout",variant="v2"} 13`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+}
+
+func TestExposureDedupInvalidWindow(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		ExposureDedup:  &config.ExposureDedup{Window: "0s"},
+	}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected an error for an empty dedup window")
+	}
+}
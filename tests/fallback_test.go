@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newFlakyPostHog returns a PostHog server serving the "test" treatment of every flag until
+// failing is set.
+func newFlakyPostHog(t *testing.T, failing *atomic.Bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		if failing.Load() {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+			"featureFlags": map[string]interface{}{"checkout": "test"},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestProviderErrorFallback(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	controlServer := newMockServer("Checkout Control")
+	defer controlServer.close()
+	testServer := newMockServer("Checkout Test")
+	defer testServer.close()
+
+	var failing atomic.Bool
+	posthog := newFlakyPostHog(t, &failing)
+
+	newConfig := func(global, rule *config.Fallback) *config.Config {
+		return &config.Config{
+			DefaultBackend: defaultServer.URL(),
+			Fallback:       global,
+			FlagProviders: []config.FlagProvider{
+				{Name: "posthog", Type: "posthog", URL: posthog.URL, APIKey: "phc_project", CacheTTL: "0s"},
+			},
+			Rules: []config.RoutingRule{
+				{
+					PathPrefix: "/checkout",
+					Flag: &config.FlagRule{
+						Provider:   "posthog",
+						Name:       "checkout",
+						Treatments: map[string]string{"control": controlServer.URL(), "test": testServer.URL()},
+					},
+					Fallback: rule,
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		global     *config.Fallback
+		rule       *config.Fallback
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "Default",
+			global:     &config.Fallback{ProviderError: "default"},
+			wantStatus: http.StatusOK,
+			wantBody:   "Default Backend",
+		},
+		{
+			name:       "Error status",
+			global:     &config.Fallback{ProviderError: "error(502)"},
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "Bad Gateway",
+		},
+		{
+			name:       "Rule overrides global",
+			global:     &config.Fallback{ProviderError: "error(502)"},
+			rule:       &config.Fallback{ProviderError: "lastAssignment"},
+			wantStatus: http.StatusOK,
+			wantBody:   "Checkout Test",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			failing.Store(false)
+			middleware := createMiddleware(t, newConfig(tc.global, tc.rule))
+
+			sessionID := "a2Fma2Etc2Vzc2lvbg=="
+			serve := func() *httptest.ResponseRecorder {
+				req := createTestRequest(t, http.MethodGet, "/checkout", nil, nil)
+				req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+				rr := httptest.NewRecorder()
+				middleware.ServeHTTP(rr, req)
+				return rr
+			}
+
+			if rr := serve(); strings.TrimSpace(rr.Body.String()) != "Checkout Test" {
+				t.Fatalf("Expected the flag's treatment while the provider is up, got %q", rr.Body.String())
+			}
+			failing.Store(true)
+			rr := serve()
+			if rr.Code != tc.wantStatus || strings.TrimSpace(rr.Body.String()) != tc.wantBody {
+				t.Errorf("Expected %d %q, got %d %q", tc.wantStatus, tc.wantBody, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestStoreUnavailableFallback(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	dynamodb := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dynamodb.Close()
+
+	v1Server := newMockServer("Hello from V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: v1Server.URL(),
+		Fallback:       &config.Fallback{StoreUnavailable: "error(503)"},
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v2Server.URL(), Percentage: 100},
+		},
+		SessionStore: &config.SessionStore{
+			Type: "dynamodb", Table: "assignments", Region: "us-east-1", Endpoint: dynamodb.URL,
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 while the session store is unavailable, got %d: %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestBodyTooLargeFallback(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	formServer := newMockServer("Form Backend")
+	defer formServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/submit",
+				Method:     http.MethodPost,
+				Backend:    formServer.URL(),
+				Conditions: []config.RuleCondition{{Type: "form", Parameter: "plan", Operator: "eq", Value: "pro"}},
+				Fallback:   &config.Fallback{BodyTooLarge: "error(413)"},
+			},
+		},
+	})
+
+	serve := func(contentLength int64) *httptest.ResponseRecorder {
+		req := createTestRequest(t, http.MethodPost, "/submit", nil, url.Values{"plan": {"pro"}})
+		req.ContentLength = contentLength
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(int64(len("plan=pro"))); strings.TrimSpace(rr.Body.String()) != "Form Backend" {
+		t.Errorf("Expected the form rule to match a small body, got %d %q", rr.Code, rr.Body.String())
+	}
+	if rr := serve(11 << 20); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected 413 for a body too large for form conditions, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestInvalidFallback(t *testing.T) {
+	testCases := []struct {
+		name   string
+		global *config.Fallback
+		rule   *config.Fallback
+	}{
+		{name: "Unknown mode", global: &config.Fallback{ProviderError: "retry"}},
+		{name: "Status out of range", global: &config.Fallback{StoreUnavailable: "error(200)"}},
+		{name: "Malformed status", rule: &config.Fallback{BodyTooLarge: "error(413"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Fallback:       tc.global,
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Fallback: tc.rule}},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/fingerprint"
+)
+
+// vector prefixes data with its length in lengthBytes bytes.
+func vector(lengthBytes int, data ...[]byte) []byte {
+	body := []byte{}
+	for _, d := range data {
+		body = append(body, d...)
+	}
+	if lengthBytes == 1 {
+		return append([]byte{byte(len(body))}, body...)
+	}
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(body))), body...)
+}
+
+func uint16s(values ...uint16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+func extension(kind uint16, data []byte) []byte {
+	return append(uint16s(kind), vector(2, data)...)
+}
+
+// testClientHello returns a ClientHello with GREASE values, split over two TLS records.
+func testClientHello() []byte {
+	body := [][]byte{
+		uint16s(0x0303),
+		make([]byte, 32),
+		vector(1),
+		vector(2, uint16s(0x0a0a, 0x1301, 0x1302, 0xc02b)),
+		vector(1, []byte{0}),
+		vector(2,
+			extension(0x1a1a, nil),
+			extension(0x0000, vector(2, []byte{0}, vector(2, []byte("example.com")))),
+			extension(0x000a, vector(2, uint16s(0x2a2a, 0x001d, 0x0017))),
+			extension(0x000b, vector(1, []byte{0})),
+			extension(0x000d, vector(2, uint16s(0x0403, 0x0804, 0x0401))),
+			extension(0x0010, vector(2, vector(1, []byte("h2")), vector(1, []byte("http/1.1")))),
+			extension(0x002b, vector(1, uint16s(0x0304, 0x0303))),
+		),
+	}
+	var hello []byte
+	for _, b := range body {
+		hello = append(hello, b...)
+	}
+	message := append([]byte{1, 0, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+	record := func(fragment []byte) []byte {
+		return append([]byte{0x16, 0x03, 0x01}, vector(2, fragment)...)
+	}
+	return append(record(message[:20]), record(message[20:])...)
+}
+
+func TestFingerprintClientHello(t *testing.T) {
+	data := testClientHello()
+	if _, err := fingerprint.Parse(data[:len(data)-1]); !errors.Is(err, fingerprint.ErrIncomplete) {
+		t.Errorf("Expected a truncated ClientHello to be incomplete, got %v", err)
+	}
+	if _, err := fingerprint.Parse([]byte("GET / HTTP/1.1\r\n")); !errors.Is(err, fingerprint.ErrNotClientHello) {
+		t.Errorf("Expected plain HTTP not to be a ClientHello, got %v", err)
+	}
+
+	hello, err := fingerprint.Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse the ClientHello: %v", err)
+	}
+	if got, want := hello.JA3String(), "771,4865-4866-49195,0-10-11-13-16-43,29-23,0"; got != want {
+		t.Errorf("Expected JA3 string %s, got %s", want, got)
+	}
+	if got, want := hello.JA3(), "11138d9933242c3a03b6aad35a296476"; got != want {
+		t.Errorf("Expected JA3 %s, got %s", want, got)
+	}
+	if got, want := hello.JA4(), "t13d0306h2_5559582ccdc4_0d385148b956"; got != want {
+		t.Errorf("Expected JA4 %s, got %s", want, got)
+	}
+}
+
+func TestFingerprintListener(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hello := fingerprint.FromRequest(r); hello != nil {
+			_, _ = io.WriteString(w, hello.JA3()+" "+hello.JA4())
+		}
+	}))
+	server.Listener = fingerprint.NewListener(server.Listener)
+	server.Config.ConnContext = fingerprint.ConnContext
+	server.StartTLS()
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !regexp.MustCompile(`^[0-9a-f]{32} t13i\d{4}[0-9a-z]{2}_[0-9a-f]{12}_[0-9a-f]{12}$`).Match(body) {
+		t.Errorf("Expected the JA3 and JA4 of a TLS 1.3 client without server name, got %q", body)
+	}
+}
+
+func TestFingerprintCondition(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	hardened := newMockServer("Hardened")
+	defer hardened.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: hardened.URL(), Conditions: []config.RuleCondition{
+				{Type: "fingerprint", Parameter: "ja4", Operator: "prefix", Value: "t12i"},
+			}},
+			{Path: "/", Backend: hardened.URL(), Conditions: []config.RuleCondition{
+				{Type: "fingerprint", Parameter: "JA3", Operator: "eq", Value: "e7d705a3286e19ea42f587b344ee6865"},
+			}},
+		},
+		Fingerprint: &config.Fingerprint{JA4Header: "CloudFront-Viewer-JA4-Fingerprint"},
+	})
+	serve := func(headers map[string]string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", headers, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	if got := serve(map[string]string{"CloudFront-Viewer-JA4-Fingerprint": "t12i0810h1_c866b44c5a26_b0d3b4ac2a14"}); got != "Hardened" {
+		t.Errorf("Expected a scripted client's JA4 to go to the hardened backend, got %s", got)
+	}
+	if got := serve(map[string]string{config.DefaultJA3Header: "e7d705a3286e19ea42f587b344ee6865"}); got != "Hardened" {
+		t.Errorf("Expected a scripted client's JA3 to go to the hardened backend, got %s", got)
+	}
+	if got := serve(map[string]string{config.DefaultJA4Header: "t12i0810h1_c866b44c5a26_b0d3b4ac2a14"}); got != "Default" {
+		t.Errorf("Expected the JA4 to be read from the configured header only, got %s", got)
+	}
+	if got := serve(nil); got != "Default" {
+		t.Errorf("Expected requests without fingerprints not to match, got %s", got)
+	}
+}
+
+func TestInvalidFingerprintCondition(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{{Path: "/", Backend: "http://a", Conditions: []config.RuleCondition{
+			{Type: "fingerprint", Parameter: "ja5", Operator: "eq", Value: "x"},
+		}}},
+	}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected an error")
+	}
+}
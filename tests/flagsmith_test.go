@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const flagsmithEnvironment = `{
+  "api_key": "env-key",
+  "feature_states": [
+    {
+      "feature": {"id": 1, "name": "pricing_page"},
+      "enabled": true,
+      "feature_state_value": "control",
+      "django_id": 10,
+      "multivariate_feature_state_values": [
+        {"id": 1, "percentage_allocation": 50, "multivariate_feature_option": {"value": "annual"}}
+      ]
+    }
+  ],
+  "project": {
+    "segments": [
+      {
+        "id": 5,
+        "rules": [{"type": "ALL", "rules": [{"type": "ANY", "conditions": [{"operator": "EQUAL", "property_": "plan", "value": "beta"}]}]}],
+        "feature_states": [
+          {"feature": {"id": 1, "name": "pricing_page"}, "enabled": false, "feature_state_value": null, "feature_segment": {"priority": 0}}
+        ]
+      }
+    ]
+  },
+  "identity_overrides": [
+    {"identifier": "vip", "identity_features": [{"feature": {"id": 1, "name": "pricing_page"}, "enabled": true, "feature_state_value": "annual"}]}
+  ]
+}`
+
+func TestFlagsmithLocalEvaluation(t *testing.T) {
+	flagsmith := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/v1/environment-document/" || req.Header.Get("X-Environment-Key") != "ser.secret" {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+			return
+		}
+		_, _ = rw.Write([]byte(flagsmithEnvironment))
+	}))
+	defer flagsmith.Close()
+
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	controlServer := newMockServer("Monthly Pricing")
+	defer controlServer.close()
+	annualServer := newMockServer("Annual Pricing")
+	defer annualServer.close()
+	legacyServer := newMockServer("Legacy Pricing")
+	defer legacyServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		FlagProviders: []config.FlagProvider{
+			{Name: "flagsmith", Type: "flagsmith", URL: flagsmith.URL, APIKey: "ser.secret", LocalEvaluation: true},
+		},
+		Rules: []config.RoutingRule{
+			{
+				Path: "/pricing",
+				Flag: &config.FlagRule{
+					Provider: "flagsmith",
+					Name:     "pricing_page",
+					Key:      "header:X-User-ID",
+					Treatments: map[string]string{
+						"control":  controlServer.URL(),
+						"annual":   annualServer.URL(),
+						"disabled": legacyServer.URL(),
+					},
+					Attributes: map[string]string{"plan": "header:X-Plan"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(headers map[string]string) string {
+		req := createTestRequest(t, http.MethodGet, "/pricing", headers, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	if body := serve(map[string]string{"X-User-ID": "vip", "X-Plan": "beta"}); body != "Annual Pricing" {
+		t.Errorf("Expected identity override to select Annual Pricing, got %q", body)
+	}
+	if body := serve(map[string]string{"X-User-ID": "u1", "X-Plan": "beta"}); body != "Legacy Pricing" {
+		t.Errorf("Expected segment override to select Legacy Pricing, got %q", body)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		counts[serve(map[string]string{"X-User-ID": "user-" + strconv.Itoa(i), "X-Plan": "free"})]++
+	}
+	for _, variant := range []string{"Monthly Pricing", "Annual Pricing"} {
+		if counts[variant] < 400 || counts[variant] > 600 {
+			t.Errorf("Expected about half of the users on %s, got %d of 1000", variant, counts[variant])
+		}
+	}
+}
+
+func TestFlagsmithFailClosed(t *testing.T) {
+	flagsmith := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		_, _ = rw.Write([]byte(`{"flags": [{"feature": {"name": "new_cart"}, "enabled": true, "feature_state_value": null}]}`))
+	}))
+	defer flagsmith.Close()
+
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	cartServer := newMockServer("New Cart")
+	defer cartServer.close()
+
+	for _, mode := range []string{"open", "closed"} {
+		t.Run(mode, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: defaultServer.URL(),
+				FlagProviders: []config.FlagProvider{
+					{Name: "flagsmith", Type: "flagsmith", URL: "http://127.0.0.1:1", APIKey: "env-key", FailureMode: mode},
+				},
+				Rules: []config.RoutingRule{
+					{
+						Path: "/cart",
+						Flag: &config.FlagRule{
+							Provider:   "flagsmith",
+							Name:       "new_cart",
+							Treatments: map[string]string{"enabled": cartServer.URL()},
+						},
+					},
+				},
+			}
+			middleware := createMiddleware(t, cfg)
+
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/cart", nil, nil))
+			expected := http.StatusOK
+			if mode == "closed" {
+				expected = http.StatusServiceUnavailable
+			}
+			if rr.Code != expected {
+				t.Errorf("Expected status %d, got %d", expected, rr.Code)
+			}
+		})
+	}
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		FlagProviders:  []config.FlagProvider{{Name: "flagsmith", Type: "flagsmith", URL: flagsmith.URL, APIKey: "env-key"}},
+		Rules: []config.RoutingRule{
+			{Path: "/cart", Flag: &config.FlagRule{Provider: "flagsmith", Name: "new_cart", Treatments: map[string]string{"enabled": cartServer.URL()}}},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/cart", nil, nil))
+	if body := strings.TrimSpace(rr.Body.String()); body != "New Cart" {
+		t.Errorf("Expected remote evaluation to select New Cart, got %q", body)
+	}
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestFrequencyCondition(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	betaServer := newMockServer("Power User Beta")
+	defer betaServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Frequency:      &config.Frequency{Window: "7h"},
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/",
+				Backend:    betaServer.URL(),
+				Conditions: []config.RuleCondition{{Type: "frequency", Parameter: "header:X-User-ID", Operator: "gt", Value: "3"}},
+			},
+		},
+	})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+
+	serve := func(userID, path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, map[string]string{"X-User-ID": userID}, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	// Requests to any path count, including the one being matched.
+	for i, path := range []string{"/", "/pricing", "/docs"} {
+		if got := serve("user-1", path); got != "Default Backend" {
+			t.Errorf("Expected request %d to be served by the default backend, got %q", i+1, got)
+		}
+	}
+	if got := serve("user-1", "/"); got != "Power User Beta" {
+		t.Errorf("Expected the 4th request to be served by the beta, got %q", got)
+	}
+	if got := serve("user-2", "/"); got != "Default Backend" {
+		t.Errorf("Expected another user to be served by the default backend, got %q", got)
+	}
+
+	// Requests are forgotten once they are older than the window.
+	now = now.Add(8 * time.Hour)
+	if got := serve("user-1", "/"); got != "Default Backend" {
+		t.Errorf("Expected old requests to be forgotten, got %q", got)
+	}
+}
+
+func TestFrequencyConditionSession(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	returningServer := newMockServer("Returning Visitor")
+	defer returningServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/",
+				Backend:    returningServer.URL(),
+				Conditions: []config.RuleCondition{{Type: "frequency", Operator: "gt", Value: "1"}},
+			},
+		},
+	})
+
+	want := []string{"Default Backend", "Returning Visitor", "Returning Visitor"}
+	for i, expected := range want {
+		if got := serveWithSession(t, middleware, "a2Fma2Etc2Vzc2lvbg=="); got != expected {
+			t.Errorf("Expected request %d to be served by %q, got %q", i+1, expected, got)
+		}
+	}
+}
+
+func TestInvalidFrequency(t *testing.T) {
+	condition := func(parameter, operator, value string) []config.RoutingRule {
+		return []config.RoutingRule{{
+			Path:       "/",
+			Backend:    "http://localhost:8081",
+			Conditions: []config.RuleCondition{{Type: "frequency", Parameter: parameter, Operator: operator, Value: value}},
+		}}
+	}
+	testCases := []struct {
+		name      string
+		frequency *config.Frequency
+		rules     []config.RoutingRule
+	}{
+		{name: "Invalid window", frequency: &config.Frequency{Window: "a week"}},
+		{name: "Negative width", frequency: &config.Frequency{Width: -1}},
+		{name: "Invalid source", rules: condition("path", "gt", "10")},
+		{name: "Invalid operator", rules: condition("", "contains", "10")},
+		{name: "Invalid count", rules: condition("", "gt", "ten")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", Frequency: tc.frequency, Rules: tc.rules}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
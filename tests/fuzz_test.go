@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// The fuzz targets run their seeds with the tests; `make fuzz` fuzzes each of them in turn.
+
+// newFuzzMiddleware returns a middleware whose rules use most condition types and answer with
+// static responses, so fuzzed requests don't depend on backends. Only requests bypassing the rules
+// reach the default backend, as background connections make coverage unstable.
+func newFuzzMiddleware(t testing.TB, backend string) http.Handler {
+	t.Helper()
+	static := func(body string) *config.StaticResponse {
+		return &config.StaticResponse{Status: http.StatusOK, Body: body}
+	}
+	cfg := &config.Config{
+		DefaultBackend:  backend,
+		PathCaseFolding: true,
+		RequestLimits:   &config.RequestLimits{MaxHeaders: 20, MaxHeaderBytes: 1024, Action: "bypass"},
+		Tags:            []config.Tag{{Name: "isBeta", Match: "header:X-Beta eq true"}},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Static: static("checkout"), Priority: 10, Match: "tag:isBeta"},
+			{PathPrefix: "/admin", Static: static("admin"), Priority: 5},
+			{Path: "/checkout", Static: static("checkout"), Match: "query:plan regex ^p[a-z]+$; cookie:ab contains x"},
+			{PathPrefix: "/", Static: static("news"), Match: "utm:source eq news"},
+			{Path: "/form", Static: static("form"), Match: "form:plan eq pro"},
+			{Path: "/consent", Static: static("consent"), Match: "consent:cookie:consent analytics"},
+			{PathPrefix: "/", Static: static("default"), Priority: -10},
+		},
+	}
+	middleware, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "fuzz-forklift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return middleware
+}
+
+func FuzzServeRawRequest(f *testing.F) {
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+	middleware := newFuzzMiddleware(f, defaultServer.URL())
+
+	for _, seed := range []string{
+		"GET /checkout?plan=pro HTTP/1.1\r\nHost: a\r\nCookie: ab=xx\r\n\r\n",
+		"GET /Admin%2F..%2Fcheckout HTTP/1.1\r\nHost: a\r\nX-Beta: true\r\n\r\n",
+		"GET //checkout/./ HTTP/1.1\r\nHost: a\r\nReferer: https://www.example.com/\r\n\r\n",
+		"POST /form HTTP/1.1\r\nHost: a\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: 8\r\n\r\nplan=pro",
+		"POST /form HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTrailer: X-Forklift-Variant\r\n\r\n0\r\nX-Forklift-Variant: b\r\n\r\n",
+		"GET /%ff%fe/../admin HTTP/1.1\r\nHost: a\r\nCookie: ;;=;ab\r\nX-Beta: \t\r\n\r\n",
+		"GET /?utm_source=news&utm_source=%00 HTTP/1.0\r\n\r\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(raw)))
+		if err != nil {
+			return
+		}
+		// Truncated bodies fail to be forwarded whatever the rules did.
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		if rr.Code >= http.StatusInternalServerError {
+			t.Errorf("Expected no server error for %q, got %d %q", raw, rr.Code, rr.Body.String())
+		}
+	})
+}
+
+func FuzzMatchPath(f *testing.F) {
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+	middleware := newFuzzMiddleware(f, defaultServer.URL())
+
+	for _, seed := range []string{"/checkout", "/Admin%2F..%2Fcheckout", "/admin/../checkout", "/%2e%2e/checkout", "//CHECKOUT", "/a%2fb/..%2F..", "/%"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, target string) {
+		req, err := http.NewRequest(http.MethodGet, "http://forklift.test"+target, nil)
+		if err != nil || req.URL.Host != "forklift.test" {
+			return
+		}
+		req.Header.Set("X-Beta", "true")
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		body := strings.TrimSpace(rr.Body.String())
+		// Decoding encoded slashes is at least as permissive as keeping them, so a request the
+		// checkout rule matched is /checkout by any reading of its path.
+		if body == "checkout" && !strings.EqualFold(path.Clean("/"+req.URL.Path), "/checkout") {
+			t.Errorf("Expected %q not to match /checkout", target)
+		}
+
+		upper := req.Clone(req.Context())
+		upper.URL.Path, upper.URL.RawPath = strings.ToUpper(req.URL.Path), strings.ToUpper(req.URL.RawPath)
+		rr = httptest.NewRecorder()
+		middleware.ServeHTTP(rr, upper)
+		if upperBody := strings.TrimSpace(rr.Body.String()); upperBody != body {
+			t.Errorf("Expected %q to match as %q with case folding, got %q", upper.URL.Path, body, upperBody)
+		}
+	})
+}
+
+func FuzzParseMatch(f *testing.F) {
+	for _, seed := range []string{
+		"header:X-Beta eq true; query:plan eq pro",
+		`cookie:ab eq "a;b"; utm:source contains " news "`,
+		"tag:isBeta eq false",
+		`header:X regex "\\d+`,
+		";;; :x eq",
+		"frequency:session gt 10; consent:cookie:c analytics",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, match string) {
+		conditions, err := config.ParseMatch(match)
+		if err != nil {
+			return
+		}
+		for _, condition := range conditions {
+			if condition.Type == "" || strings.ContainsAny(condition.Type, " :") {
+				t.Fatalf("Expected a type without spaces or colons for %q, got %q", match, condition.Type)
+			}
+		}
+
+		cfg := &config.Config{
+			DefaultBackend: "http://localhost:8080",
+			Tags:           []config.Tag{{Name: "isBeta", Match: "header:X-Beta eq true"}},
+			Rules:          []config.RoutingRule{{PathPrefix: "/", Backend: "http://localhost:8081", Match: match}},
+		}
+		middleware, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "fuzz-forklift")
+		if err != nil {
+			return
+		}
+		defer func() { _ = middleware.Shutdown(context.Background()) }()
+		req := createTestRequest(t, http.MethodGet, "/?plan=pro&utm_source=news", map[string]string{"X-Beta": "true", "Cookie": "ab=x; c=analytics"}, nil)
+		middleware.SelectBackend(req, "c2Vzc2lvbg==")
+	})
+}
+
+func FuzzFormBody(f *testing.F) {
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+	middleware := newFuzzMiddleware(f, defaultServer.URL())
+
+	for _, seed := range []struct{ contentType, body string }{
+		{"application/x-www-form-urlencoded", "plan=pro"},
+		{"application/x-www-form-urlencoded", "plan=%zz&plan=pro"},
+		{"application/x-www-form-urlencoded; charset=utf-8", "a=1&&&plan=pro;x"},
+		{"multipart/form-data; boundary=x", "--x\r\nContent-Disposition: form-data; name=\"plan\"\r\n\r\npro\r\n--x--\r\n"},
+		{"multipart/form-data", "--"},
+		{"text/plain", "plan=pro"},
+	} {
+		f.Add(seed.contentType, seed.body)
+	}
+	f.Fuzz(func(t *testing.T, contentType, body string) {
+		req, err := http.NewRequest(http.MethodPost, "http://forklift.test/form", strings.NewReader(body))
+		if err != nil {
+			return
+		}
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		if rr.Code >= http.StatusInternalServerError {
+			t.Fatalf("Expected no server error for %q %q, got %d", contentType, body, rr.Code)
+		}
+		values, err := url.ParseQuery(body)
+		if contentType == "application/x-www-form-urlencoded" && err == nil && values.Get("plan") == "pro" {
+			if got := strings.TrimSpace(rr.Body.String()); got != "form" {
+				t.Errorf("Expected the form condition to match %q, got %q", body, got)
+			}
+		}
+	})
+}
+
+func FuzzCookies(f *testing.F) {
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+	middleware := newFuzzMiddleware(f, defaultServer.URL())
+
+	for _, seed := range []string{
+		"forklift_id=c2Vzc2lvbg==; ab=x",
+		"forklift_id=not base64!; consent=analytics",
+		"forklift_id=; forklift_id=c2Vzc2lvbg==",
+		`ab="x"; consent="ads|analytics"`,
+		";;;=;==",
+		"forklift_id=" + strings.Repeat("QUFB", 100),
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, cookie string) {
+		for _, target := range []string{"/checkout?plan=pro", "/consent"} {
+			req, err := http.NewRequest(http.MethodGet, "http://forklift.test"+target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Cookie", cookie)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+			if rr.Code >= http.StatusInternalServerError {
+				t.Fatalf("Expected no server error for %q, got %d", cookie, rr.Code)
+			}
+			for _, set := range rr.Result().Cookies() {
+				if set.Name != sessionCookieName {
+					continue
+				}
+				if _, err := base64.URLEncoding.DecodeString(set.Value); err != nil || set.Value == "" {
+					t.Errorf("Expected a valid session ID to be set for %q, got %q", cookie, set.Value)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/geoip"
+)
+
+// mmdbString encodes a string of the MaxMind DB data section.
+func mmdbString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...)
+}
+
+// countryDB builds an IPv6 MaxMind DB with 28-bit records, mapping IPv4 networks to the ISO code
+// of their country.
+func countryDB(t *testing.T, networks [][2]string) []byte {
+	t.Helper()
+	// Records are -1 while empty, a node index, or -2-k for the k-th country.
+	nodes := [][2]int{{-1, -1}}
+	var data []byte
+	var offsets []int
+	for _, network := range networks {
+		_, ipNet, err := net.ParseCIDR(network[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := append(make([]byte, 12), ipNet.IP.To4()...)
+		offsets = append(offsets, len(data))
+		data = append(data, 0xe1)
+		data = append(data, mmdbString("country")...)
+		data = append(data, 0xe1)
+		data = append(data, mmdbString("iso_code")...)
+		data = append(data, mmdbString(network[1])...)
+
+		n, bits := 0, 96+ones
+		for i := 0; i < bits; i++ {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[n][bit] = -2 - (len(offsets) - 1)
+				break
+			}
+			if nodes[n][bit] < 0 {
+				nodes = append(nodes, [2]int{-1, -1})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+
+	nodeCount := len(nodes)
+	record := func(value int) uint32 {
+		switch {
+		case value == -1:
+			return uint32(nodeCount)
+		case value < -1:
+			return uint32(nodeCount + 16 + offsets[-2-value])
+		}
+		return uint32(value)
+	}
+	var db []byte
+	for _, node := range nodes {
+		left, right := record(node[0]), record(node[1])
+		db = append(db, byte(left>>16), byte(left>>8), byte(left),
+			byte(left>>24)<<4|byte(right>>24), byte(right>>16), byte(right>>8), byte(right))
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xAB\xCD\xEFMaxMind.com"...)
+	db = append(db, 0xe3)
+	db = append(db, mmdbString("node_count")...)
+	db = binary.BigEndian.AppendUint32(append(db, 0xc4), uint32(nodeCount))
+	db = append(db, mmdbString("record_size")...)
+	db = append(db, 0xa2, 0, 28)
+	db = append(db, mmdbString("ip_version")...)
+	return append(db, 0xa2, 0, 6)
+}
+
+var testCountryNetworks = [][2]string{{"5.9.0.0/16", "DE"}, {"81.2.69.0/24", "GB"}, {"2.0.0.0/12", "FR"}}
+
+func TestGeoIPDatabase(t *testing.T) {
+	reader, err := geoip.New(countryDB(t, testCountryNetworks))
+	if err != nil {
+		t.Fatalf("Failed to read the database: %v", err)
+	}
+	for address, want := range map[string]string{
+		"5.9.120.7":   "DE",
+		"81.2.69.160": "GB",
+		"2.15.255.1":  "FR",
+		"2.16.0.1":    "",
+		"8.8.8.8":     "",
+		"2001:db8::1": "",
+	} {
+		got, err := reader.Country(net.ParseIP(address))
+		if err != nil || got != want {
+			t.Errorf("Expected %s in %q, got %q (%v)", address, want, got, err)
+		}
+	}
+
+	if _, err := geoip.New([]byte("not a database")); err == nil {
+		t.Error("Expected an error for a file that isn't a MaxMind DB")
+	}
+}
+
+func TestCountryPercentages(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	rollout := newMockServer("Rollout")
+	defer rollout.close()
+	database := filepath.Join(t.TempDir(), "countries.mmdb")
+	if err := os.WriteFile(database, countryDB(t, testCountryNetworks), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/", Backend: rollout.URL(), Percentage: 20, CountryPercentages: map[string]float64{"DE": 5, "FR": 0}},
+		},
+		GeoIP: &config.GeoIP{CountryHeader: "CF-IPCountry", Database: database},
+	})
+	rolledOut := func(headers map[string]string) map[int]bool {
+		sessions := make(map[int]bool)
+		for i := 0; i < 2000; i++ {
+			req := createTestRequest(t, http.MethodGet, "/", headers, nil)
+			req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%04d", i)))})
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+			if strings.TrimSpace(rr.Body.String()) == "Rollout" {
+				sessions[i] = true
+			}
+		}
+		return sessions
+	}
+
+	global := rolledOut(map[string]string{"CF-IPCountry": "US"})
+	if len(global) < 300 || len(global) > 500 {
+		t.Errorf("Expected about 20%% of the sessions in the rollout, got %d of 2000", len(global))
+	}
+	germany := rolledOut(map[string]string{"CF-IPCountry": "de"})
+	if len(germany) < 60 || len(germany) > 140 {
+		t.Errorf("Expected about 5%% of the sessions in Germany in the rollout, got %d of 2000", len(germany))
+	}
+	for session := range germany {
+		if !global[session] {
+			t.Fatalf("Expected the sessions in the rollout in Germany to be in it globally, session %d isn't", session)
+		}
+	}
+	if located := rolledOut(map[string]string{"X-Forwarded-For": "5.9.120.7, 10.0.0.1"}); len(located) != len(germany) {
+		t.Errorf("Expected clients located in Germany by the database to be capped too, got %d of 2000", len(located))
+	}
+	if france := rolledOut(map[string]string{"CF-IPCountry": "FR"}); len(france) != 0 {
+		t.Errorf("Expected no session in France in the rollout, got %d", len(france))
+	}
+	if unknown := rolledOut(map[string]string{"X-Forwarded-For": "8.8.8.8"}); len(unknown) != len(global) {
+		t.Errorf("Expected clients of unknown countries to get the global percentage, got %d of 2000", len(unknown))
+	}
+}
+
+func TestInvalidCountryPercentages(t *testing.T) {
+	geo := &config.GeoIP{CountryHeader: "CF-IPCountry"}
+	for name, cfg := range map[string]*config.Config{
+		"Without geoIP": {Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://a", Percentage: 20, CountryPercentages: map[string]float64{"DE": 5}},
+		}},
+		"Without percentage": {GeoIP: geo, Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://a", CountryPercentages: map[string]float64{"DE": 5}},
+		}},
+		"Lowercase country": {GeoIP: geo, Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://a", Percentage: 20, CountryPercentages: map[string]float64{"de": 5}},
+		}},
+		"Percentage over 100": {GeoIP: geo, Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://a", Percentage: 20, CountryPercentages: map[string]float64{"DE": 150}},
+		}},
+		"Assignment group": {GeoIP: geo, Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://a", Percentage: 20, AssignmentGroup: "g", Variant: "a", CountryPercentages: map[string]float64{"DE": 5}},
+		}},
+		"Empty geoIP":      {GeoIP: &config.GeoIP{}},
+		"Missing database": {GeoIP: &config.GeoIP{Database: filepath.Join(t.TempDir(), "missing.mmdb")}},
+	} {
+		cfg.DefaultBackend = "http://localhost:8080"
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+const growthBookFeatures = `{
+  "features": {
+    "new-search": {
+      "defaultValue": false,
+      "rules": [
+        {"condition": {"country": {"$in": ["NZ", "AU"]}}, "force": true},
+        {"condition": {"plan": "free"}, "force": false},
+        {"key": "search-test", "variations": [false, true], "weights": [0.5, 0.5], "coverage": 1, "hashVersion": 2}
+      ]
+    }
+  }
+}`
+
+func TestGrowthBookFeatures(t *testing.T) {
+	evaluator := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/features/sdk-abc" {
+			http.NotFound(rw, req)
+			return
+		}
+		_, _ = rw.Write([]byte(growthBookFeatures))
+	}))
+	defer evaluator.Close()
+
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	searchV1 := newMockServer("Search V1")
+	defer searchV1.close()
+	searchV2 := newMockServer("Search V2")
+	defer searchV2.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		FlagProviders: []config.FlagProvider{
+			{Name: "growthbook", Type: "growthbook", URL: evaluator.URL, APIKey: "sdk-abc"},
+		},
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/search",
+				Flag: &config.FlagRule{
+					Provider:   "growthbook",
+					Name:       "new-search",
+					Key:        "header:X-User-ID",
+					Treatments: map[string]string{"true": searchV2.URL(), "false": searchV1.URL()},
+					Attributes: map[string]string{"country": "header:X-Country", "plan": "query:plan"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(path string, headers map[string]string) string {
+		req := createTestRequest(t, http.MethodGet, path, headers, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	if body := serve("/search", map[string]string{"X-Country": "NZ", "X-User-ID": "u1"}); body != "Search V2" {
+		t.Errorf("Expected forced rule to select Search V2, got %q", body)
+	}
+	if body := serve("/search?plan=free", map[string]string{"X-Country": "US", "X-User-ID": "u1"}); body != "Search V1" {
+		t.Errorf("Expected forced rule to select Search V1, got %q", body)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		userID := "user-" + strconv.Itoa(i)
+		body := serve("/search", map[string]string{"X-Country": "US", "X-User-ID": userID})
+		if again := serve("/search", map[string]string{"X-Country": "US", "X-User-ID": userID}); again != body {
+			t.Fatalf("Expected stable assignment for %s, got %q and %q", userID, body, again)
+		}
+		counts[body]++
+	}
+	for _, variant := range []string{"Search V1", "Search V2"} {
+		if counts[variant] < 350 || counts[variant] > 650 {
+			t.Errorf("Expected about half of the users on %s, got %d of 1000", variant, counts[variant])
+		}
+	}
+}
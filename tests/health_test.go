@@ -0,0 +1,82 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestHealthAndReadiness(t *testing.T) {
+	backend := newMockServer("Backend")
+	defer backend.close()
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	testCases := []struct {
+		name     string
+		cfg      func(cfg *config.Config)
+		status   int
+		contains string
+	}{
+		{
+			name:     "Inline rules",
+			cfg:      func(*config.Config) {},
+			status:   http.StatusOK,
+			contains: "[+]rules ok",
+		},
+		{
+			name: "Memory session store",
+			cfg: func(cfg *config.Config) {
+				cfg.SessionStore = &config.SessionStore{Type: "memory"}
+			},
+			status:   http.StatusOK,
+			contains: "[+]sessionStore ok",
+		},
+		{
+			name: "Rule bundle not loaded",
+			cfg: func(cfg *config.Config) {
+				cfg.RuleBundle = &config.RuleBundle{URL: unavailable.URL + "/rules.yaml", SignatureType: "minisign", PublicKey: newMinisignKey(t).public}
+			},
+			status:   http.StatusServiceUnavailable,
+			contains: "[-]rules failed",
+		},
+		{
+			name: "Flag definitions not loaded",
+			cfg: func(cfg *config.Config) {
+				cfg.FlagProviders = []config.FlagProvider{{Name: "growthbook", Type: "growthbook", URL: unavailable.URL, APIKey: "sdk-key"}}
+			},
+			status:   http.StatusServiceUnavailable,
+			contains: "[-]flagProvider/growthbook failed",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: backend.URL(),
+				HealthPath:     "/_forklift/healthz",
+				ReadinessPath:  "/_forklift/readyz",
+			}
+			tc.cfg(cfg)
+			middleware := createMiddleware(t, cfg)
+
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/healthz", nil, nil))
+			if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "ok" {
+				t.Errorf("Expected the middleware to be alive, got %d %q", rr.Code, rr.Body.String())
+			}
+
+			rr = httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/readyz", nil, nil))
+			if rr.Code != tc.status || !strings.Contains(rr.Body.String(), tc.contains) {
+				t.Errorf("Expected %d with %q, got %d:\n%s", tc.status, tc.contains, rr.Code, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+type ruleVersions struct {
+	Current  int `json:"current"`
+	Versions []struct {
+		Version int    `json:"version"`
+		Source  string `json:"source"`
+		Rules   int    `json:"rules"`
+		Current bool   `json:"current"`
+	} `json:"versions"`
+}
+
+func callAdmin(t *testing.T, middleware http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	return rr
+}
+
+func listRuleVersions(t *testing.T, middleware http.Handler) ruleVersions {
+	t.Helper()
+	var versions ruleVersions
+	rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/rules/versions", "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &versions); err != nil {
+		t.Fatalf("Expected the versions as JSON, got %v: %s", err, rr.Body.String())
+	}
+	return versions
+}
+
+func TestRuleHistoryRollback(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v1Server := newMockServer("Checkout V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Checkout V2")
+	defer v2Server.close()
+
+	key := newMinisignKey(t)
+	bundles := newBundleServer()
+	defer bundles.Close()
+	bundles.put("/rules.yaml", bundleRules(v1Server.URL()))
+	bundles.put("/rules.yaml.minisig", key.sign(bundleRules(v1Server.URL())))
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		RuleBundle: &config.RuleBundle{
+			URL:           bundles.URL + "/rules.yaml",
+			SignatureType: "minisign",
+			PublicKey:     key.public,
+			PollInterval:  "10ms",
+		},
+		AdminAPI:    &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+		RuleHistory: &config.RuleHistory{},
+	})
+	serve := func(path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	bundles.put("/rules.yaml", bundleRules(v2Server.URL()))
+	bundles.put("/rules.yaml.minisig", key.sign(bundleRules(v2Server.URL())))
+	waitForMetric(t, serve, `forklift_rule_bundle_reloads_total{result="applied"} 2`)
+	if body := serve("/checkout"); body != "Checkout V2" {
+		t.Fatalf("Expected the new bundle to route to V2, got %q", body)
+	}
+
+	versions := listRuleVersions(t, middleware)
+	if len(versions.Versions) != 3 || versions.Current != 3 || !versions.Versions[2].Current {
+		t.Fatalf("Expected the configuration and two bundles, the last one current, got %+v", versions)
+	}
+	if source := versions.Versions[0].Source; source != "configuration" {
+		t.Errorf("Expected the first version to come from the configuration, got %q", source)
+	}
+
+	rr := callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/rules/diff?from=2", "")
+	var diff struct {
+		Changes []config.RuleChange `json:"changes"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &diff); err != nil || len(diff.Changes) != 2 {
+		t.Errorf("Expected the V1 rule removed and the V2 rule added, got %s", rr.Body.String())
+	}
+	rr = callAdmin(t, middleware, http.MethodGet, "/_forklift/admin/rules/versions/2", "")
+	if !strings.Contains(rr.Body.String(), "backend: "+v1Server.URL()) {
+		t.Errorf("Expected the rules of version 2 as YAML, got %s", rr.Body.String())
+	}
+
+	rr = callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/rules/rollback", `{"version":2}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body := serve("/checkout"); body != "Checkout V1" {
+		t.Errorf("Expected the rollback to route to V1, got %q", body)
+	}
+	versions = listRuleVersions(t, middleware)
+	if len(versions.Versions) != 4 || versions.Versions[3].Source != "rollback to 2" {
+		t.Errorf("Expected the rollback recorded as a new version, got %+v", versions)
+	}
+
+	if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/rules/rollback", `{"version":9}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown version, got %d", rr.Code)
+	}
+}
+
+func TestRuleHistoryOnDisk(t *testing.T) {
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	dir := t.TempDir()
+	createConfig := func(backend string) *config.Config {
+		return &config.Config{
+			DefaultBackend: "http://localhost",
+			Rules:          []config.RoutingRule{{Path: "/", Backend: backend}},
+			AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+			RuleHistory:    &config.RuleHistory{Size: 2, Path: dir},
+		}
+	}
+
+	createMiddleware(t, createConfig(v1Server.URL()))
+	// Reloading the same configuration doesn't add a version.
+	createMiddleware(t, createConfig(v1Server.URL()))
+	createMiddleware(t, createConfig(v2Server.URL()))
+	middleware := createMiddleware(t, createConfig(v1Server.URL()))
+
+	versions := listRuleVersions(t, middleware)
+	if len(versions.Versions) != 2 || versions.Versions[0].Version != 2 || versions.Current != 3 {
+		t.Fatalf("Expected the last 2 of 3 versions, got %+v", versions)
+	}
+	if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/rules/rollback", `{"version":1}`); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a version beyond the history size, got %d", rr.Code)
+	}
+	if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/rules/rollback", `{"version":2}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if body := serveWithSession(t, middleware, "c2Vzc2lvbi0wMDE="); body != "V2" {
+		t.Errorf("Expected version 2 to route to V2, got %q", body)
+	}
+}
+
+func TestInvalidRuleHistory(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  *config.Config
+	}{
+		{name: "Without admin API", cfg: &config.Config{DefaultBackend: "http://localhost", RuleHistory: &config.RuleHistory{}}},
+		{name: "Negative size", cfg: &config.Config{
+			DefaultBackend: "http://localhost",
+			AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+			RuleHistory:    &config.RuleHistory{Size: -1},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), tc.cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestHooks(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	canaryServer := newMockServer("Canary Backend")
+	defer canaryServer.close()
+
+	var stages []string
+	var seenSessionID string
+	var seenStatus int
+	forklift.RegisterHook("test-recorder", forklift.HookFuncs{
+		PreMatchFunc: func(hc *forklift.HookContext) {
+			stages = append(stages, "pre-match")
+			if userID := hc.Request.Header.Get("X-User-ID"); userID != "" {
+				hc.SessionID = userID
+			}
+		},
+		PostDecisionFunc: func(hc *forklift.HookContext) {
+			stages = append(stages, "post-decision")
+			seenSessionID = hc.SessionID
+			if hc.Request.Header.Get("X-Force-Canary") == "true" {
+				hc.Selected = forklift.SelectedBackend{Backend: canaryServer.URL()}
+			}
+		},
+		PostResponseFunc: func(hc *forklift.HookContext) {
+			stages = append(stages, "post-response")
+			seenStatus = hc.Status
+		},
+	})
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Hooks:          []string{"test-recorder"},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	req := createTestRequest(t, http.MethodGet, "/", map[string]string{
+		"X-User-ID":      "user-42",
+		"X-Force-Canary": "true",
+	}, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	if body := strings.TrimSpace(rr.Body.String()); body != "Canary Backend" {
+		t.Errorf("Expected PostDecision override to route to canary, got %q", body)
+	}
+	if strings.Join(stages, ",") != "pre-match,post-decision,post-response" {
+		t.Errorf("Unexpected hook stages: %v", stages)
+	}
+	if seenSessionID != "user-42" {
+		t.Errorf("Expected PreMatch identity to be used, got %q", seenSessionID)
+	}
+	if seenStatus != http.StatusOK {
+		t.Errorf("Expected PostResponse to see status 200, got %d", seenStatus)
+	}
+}
+
+func TestUnknownHook(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Hooks:          []string{"does-not-exist"},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for unknown hook, got nil")
+	}
+}
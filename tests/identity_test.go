@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestIdentityBucketing(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1Server.URL(), Percentage: 50},
+			{Path: "/", Backend: v2Server.URL(), Percentage: 50},
+		},
+		Identity: &config.Identity{Sources: []string{"basic", "header:X-API-Key"}},
+	})
+	serve := func(setup func(req *http.Request)) *httptest.ResponseRecorder {
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		setup(req)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	counts := make(map[string]int)
+	for i := range 40 {
+		key := fmt.Sprintf("key-%d", i)
+		first := serve(func(req *http.Request) { req.Header.Set("X-API-Key", key) })
+		if cookies := first.Header().Values("Set-Cookie"); len(cookies) > 0 {
+			t.Fatalf("Expected no cookies for an identified client, got %v", cookies)
+		}
+		body := strings.TrimSpace(first.Body.String())
+		counts[body]++
+		for range 5 {
+			rr := serve(func(req *http.Request) { req.Header.Set("X-API-Key", key) })
+			if got := strings.TrimSpace(rr.Body.String()); got != body {
+				t.Fatalf("Expected %s to stay on %s, got %s", key, body, got)
+			}
+		}
+	}
+	if counts["V1"] == 0 || counts["V2"] == 0 {
+		t.Errorf("Expected API keys to be split between the variants, got %v", counts)
+	}
+
+	for i := range 10 {
+		user := fmt.Sprintf("user-%d", i)
+		first := serve(func(req *http.Request) { req.SetBasicAuth(user, "password") })
+		for range 5 {
+			rr := serve(func(req *http.Request) { req.SetBasicAuth(user, "other-password") })
+			if rr.Body.String() != first.Body.String() {
+				t.Fatalf("Expected %s to keep its variant, got %s and %s", user, first.Body.String(), rr.Body.String())
+			}
+		}
+	}
+
+	if rr := serve(func(*http.Request) {}); len(rr.Header().Values("Set-Cookie")) == 0 {
+		t.Error("Expected a session cookie for a request without identity")
+	}
+}
+
+func TestIdentityLists(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	betaServer := newMockServer("Beta")
+	defer betaServer.close()
+
+	hash := sha256.Sum256([]byte("partner-key"))
+	testCases := []struct {
+		name     string
+		list     *config.IdentityList
+		apiKey   string
+		expected string
+	}{
+		{name: "Allowed", list: &config.IdentityList{Allow: []string{"partner-key"}}, apiKey: "partner-key", expected: "Beta"},
+		{name: "Allowed by hash", list: &config.IdentityList{Allow: []string{"sha256:" + hex.EncodeToString(hash[:])}}, apiKey: "partner-key", expected: "Beta"},
+		{name: "Not allowed", list: &config.IdentityList{Allow: []string{"partner-key"}}, apiKey: "other-key", expected: "Default"},
+		{name: "Without identity", list: &config.IdentityList{Allow: []string{"partner-key"}}, expected: "Default"},
+		{name: "Denied", list: &config.IdentityList{Deny: []string{"partner-key"}}, apiKey: "partner-key", expected: "Default"},
+		{name: "Not denied", list: &config.IdentityList{Deny: []string{"partner-key"}}, apiKey: "other-key", expected: "Beta"},
+		{name: "Deny without identity", list: &config.IdentityList{Deny: []string{"partner-key"}}, expected: "Beta"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			middleware := createMiddleware(t, &config.Config{
+				DefaultBackend: defaultServer.URL(),
+				Rules:          []config.RoutingRule{{Path: "/", Backend: betaServer.URL(), Identities: tc.list}},
+				Identity:       &config.Identity{Sources: []string{"header:X-API-Key"}},
+			})
+			headers := map[string]string{}
+			if tc.apiKey != "" {
+				headers["X-API-Key"] = tc.apiKey
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", headers, nil))
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, body)
+			}
+		})
+	}
+}
+
+func TestInvalidIdentity(t *testing.T) {
+	testCases := []struct {
+		name     string
+		identity *config.Identity
+		list     *config.IdentityList
+	}{
+		{name: "Cookie source", identity: &config.Identity{Sources: []string{"cookie:api_key"}}},
+		{name: "Source without name", identity: &config.Identity{Sources: []string{"header:"}}},
+		{name: "List without sources", list: &config.IdentityList{Allow: []string{"partner"}}},
+		{
+			name:     "Invalid hash",
+			identity: &config.Identity{Sources: []string{"basic"}},
+			list:     &config.IdentityList{Deny: []string{"sha256:1234"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Identities: tc.list}},
+				Identity:       tc.identity,
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package integration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The harness brings up Traefik with the local plugin and the variant backends when they are not
+// already running. FORKLIFT_E2E_HARNESS selects compose or kind, as make e2e and make e2e-kind
+// do; unset or none, the tests run against a Traefik already running and skip otherwise, so go
+// test ./... doesn't start containers. FORKLIFT_E2E_KEEP leaves the environment running after the
+// tests.
+const (
+	harnessEnv      = "FORKLIFT_E2E_HARNESS"
+	keepEnv         = "FORKLIFT_E2E_KEEP"
+	composeProject  = "forklift-e2e"
+	readyTimeout    = 3 * time.Minute
+	commandTimeout  = 10 * time.Minute
+	readyPollPeriod = time.Second
+)
+
+// errNoHarness is returned when no harness was selected, or its tools are not installed.
+var errNoHarness = errors.New("no e2e harness")
+
+// skipReason is set when no harness is selected or available, so the tests skip instead of failing.
+var skipReason string
+
+func TestMain(m *testing.M) {
+	os.Exit(runWithHarness(m))
+}
+
+func runWithHarness(m *testing.M) int {
+	if traefikReady() {
+		return m.Run()
+	}
+
+	root, err := filepath.Abs(filepath.Join("..", ".."))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "e2e harness: %v\n", err)
+		return 1
+	}
+
+	up, down, err := harnessCommands(os.Getenv(harnessEnv), root)
+	if errors.Is(err, errNoHarness) {
+		skipReason = err.Error()
+		return m.Run()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "e2e harness: %v\n", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "starting e2e harness: %s\n", strings.Join(up, " "))
+	if os.Getenv(keepEnv) == "" {
+		// The environment is also stopped when it failed to start, as parts of it may be running.
+		defer func() {
+			if err := runCommand(root, down); err != nil {
+				fmt.Fprintf(os.Stderr, "stopping e2e harness failed: %v\n", err)
+			}
+		}()
+	}
+	if err := runCommand(root, up); err != nil {
+		fmt.Fprintf(os.Stderr, "starting e2e harness failed: %v\n", err)
+		return 1
+	}
+	if !waitForTraefik() {
+		fmt.Fprintf(os.Stderr, "e2e harness started but Traefik did not become ready within %s\n", readyTimeout)
+		return 1
+	}
+	return m.Run()
+}
+
+func harnessCommands(harness, root string) ([]string, []string, error) {
+	switch harness {
+	case "", "none":
+		return nil, nil, fmt.Errorf("%w: traefik is not running on %s and %s is not set to compose or kind", errNoHarness, traefikURL, harnessEnv)
+	case "compose":
+		if _, err := exec.LookPath("docker"); err != nil {
+			return nil, nil, fmt.Errorf("%w: docker is not available for the compose harness: %v", errNoHarness, err)
+		}
+		compose := []string{"docker", "compose", "-f", filepath.Join(root, "docker-compose.yml"), "-p", composeProject}
+		return append(compose, "up", "-d"), append(compose, "down", "-v"), nil
+	case "kind":
+		for _, tool := range []string{"kind", "kubectl"} {
+			if _, err := exec.LookPath(tool); err != nil {
+				return nil, nil, fmt.Errorf("%w: %s is not available for the kind harness: %v", errNoHarness, tool, err)
+			}
+		}
+		dir := filepath.Join(root, "tests", "integration", "kind")
+		return []string{filepath.Join(dir, "up.sh")}, []string{filepath.Join(dir, "down.sh")}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown %s: %s", harnessEnv, harness)
+	}
+}
+
+func runCommand(dir string, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// traefikReady reports whether Traefik serves the plugin's routes, which only happens once the
+// plugin has been loaded.
+func traefikReady() bool {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(traefikURL + "/v3")
+	if err != nil {
+		return false
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	return err == nil && strings.Contains(string(body), "Hello from V3")
+}
+
+func waitForTraefik() bool {
+	deadline := time.Now().Add(readyTimeout)
+	for time.Now().Before(deadline) {
+		if traefikReady() {
+			return true
+		}
+		time.Sleep(readyPollPeriod)
+	}
+	return false
+}
+
+func requireHarness(t *testing.T) {
+	t.Helper()
+	if skipReason != "" {
+		t.Skip(skipReason)
+	}
+}
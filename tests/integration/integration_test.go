@@ -20,6 +20,8 @@ func closeBody(t *testing.T, body io.Closer) {
 }
 
 func TestIntegration(t *testing.T) {
+	requireHarness(t)
+
 	tests := []struct {
 		name           string
 		path           string
@@ -0,0 +1,5 @@
+#!/bin/sh
+# Deletes the Kind cluster created by up.sh.
+set -eu
+
+kind delete cluster --name "${FORKLIFT_KIND_CLUSTER:-forklift-e2e}"
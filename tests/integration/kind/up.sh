@@ -0,0 +1,25 @@
+#!/bin/sh
+# Creates a Kind cluster running Traefik with the local Forklift plugin, the variant backends and
+# Redis, with Traefik's web entrypoint published on localhost:80.
+set -eu
+
+CLUSTER="${FORKLIFT_KIND_CLUSTER:-forklift-e2e}"
+DIR="$(cd "$(dirname "$0")" && pwd)"
+REPO="$(cd "$DIR/../../.." && pwd)"
+
+cat <<CONFIG | kind create cluster --name "$CLUSTER" --wait 120s --config -
+kind: Cluster
+apiVersion: kind.x-k8s.io/v1alpha4
+nodes:
+  - role: control-plane
+    extraMounts:
+      - hostPath: $REPO
+        containerPath: /forklift
+        readOnly: true
+    extraPortMappings:
+      - containerPort: 30080
+        hostPort: 80
+CONFIG
+
+kubectl --context "kind-$CLUSTER" apply -f "$DIR/manifests.yaml"
+kubectl --context "kind-$CLUSTER" -n forklift-e2e rollout status deployment --timeout=180s
@@ -0,0 +1,156 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestErrorInterception(t *testing.T) {
+	defaultServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		_, _ = io.WriteString(rw, "Default "+req.URL.Path+" "+string(body))
+	}))
+	defer defaultServer.Close()
+	canary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/canary/unavailable":
+			http.Error(rw, "Canary unavailable", http.StatusServiceUnavailable)
+		case "/canary/bad-gateway":
+			http.Error(rw, "Canary bad gateway", http.StatusBadGateway)
+		default:
+			_, _ = io.WriteString(rw, "Canary")
+		}
+	}))
+	defer canary.Close()
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close()
+
+	testCases := []struct {
+		name           string
+		backend        string
+		interception   *config.ErrorInterception
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:         "Retry",
+			backend:      canary.URL,
+			interception: &config.ErrorInterception{Action: "retry"},
+			path:         "/canary/unavailable",
+			expectedBody: "Default /canary/unavailable",
+		},
+		{
+			name:         "Retry with body",
+			backend:      canary.URL,
+			interception: &config.ErrorInterception{Action: "retry"},
+			method:       http.MethodPost,
+			path:         "/canary/unavailable",
+			body:         `{"order":42}`,
+			expectedBody: `Default /canary/unavailable {"order":42}`,
+		},
+		{
+			name:         "Retry unreachable backend",
+			backend:      stopped.URL,
+			interception: &config.ErrorInterception{Action: "retry"},
+			path:         "/canary",
+			expectedBody: "Default /canary",
+		},
+		{
+			name:         "Successful response",
+			backend:      canary.URL,
+			interception: &config.ErrorInterception{Action: "retry"},
+			path:         "/canary",
+			expectedBody: "Canary",
+		},
+		{
+			name:    "Page",
+			backend: canary.URL,
+			interception: &config.ErrorInterception{Action: "page", Page: &config.StaticResponse{
+				Status: http.StatusOK,
+				Body:   "The new checkout is taking a break",
+			}},
+			path:         "/canary/unavailable",
+			expectedBody: "The new checkout is taking a break",
+		},
+		{
+			name:           "Status not intercepted",
+			backend:        canary.URL,
+			interception:   &config.ErrorInterception{Action: "retry", Statuses: []int{http.StatusBadGateway}},
+			path:           "/canary/unavailable",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "Canary unavailable",
+		},
+		{
+			name:         "Listed status",
+			backend:      canary.URL,
+			interception: &config.ErrorInterception{Action: "retry", Statuses: []int{http.StatusBadGateway}},
+			path:         "/canary/bad-gateway",
+			expectedBody: "Default /canary/bad-gateway",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			middleware := createMiddleware(t, &config.Config{
+				DefaultBackend: defaultServer.URL,
+				MetricsPath:    "/_forklift/metrics",
+				Rules: []config.RoutingRule{
+					{PathPrefix: "/canary", Backend: tc.backend, Percentage: 100, InterceptErrors: tc.interception},
+				},
+			})
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, httptest.NewRequest(method, tc.path, strings.NewReader(tc.body)))
+			expectedStatus := tc.expectedStatus
+			if expectedStatus == 0 {
+				expectedStatus = http.StatusOK
+			}
+			if rr.Code != expectedStatus || strings.TrimSpace(rr.Body.String()) != tc.expectedBody {
+				t.Errorf("Expected %d %q, got %d %q", expectedStatus, tc.expectedBody, rr.Code, rr.Body.String())
+			}
+
+			metrics := httptest.NewRecorder()
+			middleware.ServeHTTP(metrics, httptest.NewRequest(http.MethodGet, "/_forklift/metrics", nil))
+			intercepted := strings.Contains(metrics.Body.String(), `forklift_intercepted_errors_total{rule="`)
+			if expectIntercepted := tc.expectedBody != "Canary" && tc.expectedStatus == 0; intercepted != expectIntercepted {
+				t.Errorf("Expected the interception counted: %v, got %v", expectIntercepted, intercepted)
+			}
+		})
+	}
+}
+
+func TestInvalidErrorInterception(t *testing.T) {
+	testCases := []struct {
+		name         string
+		interception *config.ErrorInterception
+	}{
+		{name: "Unknown action", interception: &config.ErrorInterception{Action: "ignore"}},
+		{name: "Page without page", interception: &config.ErrorInterception{Action: "page"}},
+		{name: "Status not 5xx", interception: &config.ErrorInterception{Action: "retry", Statuses: []int{404}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", InterceptErrors: tc.interception}},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newFakeIntrospection starts an introspection endpoint answering with the claims of known tokens
+// and counting the calls.
+func newFakeIntrospection(t *testing.T, tokens map[string]map[string]interface{}) (*httptest.Server, *int64) {
+	t.Helper()
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "forklift" || secret != "s3cret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims, ok := tokens[r.PostFormValue("token")]
+		if !ok {
+			claims = map[string]interface{}{"active": false}
+		}
+		_ = json.NewEncoder(w).Encode(claims)
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func TestTokenCondition(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	betaServer := newMockServer("Beta")
+	defer betaServer.close()
+
+	introspection, calls := newFakeIntrospection(t, map[string]map[string]interface{}{
+		"beta-token": {
+			"active":          true,
+			"scope":           "openid profile",
+			"realm_access":    map[string]interface{}{"roles": []string{"beta-tester"}},
+			"resource_access": map[string]interface{}{"shop": map[string]interface{}{"roles": []string{"buyer"}}},
+		},
+		"user-token": {"active": true, "scope": "openid checkout:write", "groups": []string{"staff"}},
+	})
+
+	serve := func(t *testing.T, middleware http.Handler, token string) string {
+		t.Helper()
+		headers := map[string]string{}
+		if token != "" {
+			headers["Authorization"] = "Bearer " + token
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", headers, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	testCases := []struct {
+		name      string
+		condition config.RuleCondition
+		token     string
+		expected  string
+	}{
+		{name: "Realm role", condition: config.RuleCondition{Type: "token", Parameter: "role", Operator: "eq", Value: "beta-tester"}, token: "beta-token", expected: "Beta"},
+		{name: "Client role", condition: config.RuleCondition{Type: "token", Parameter: "role", Operator: "eq", Value: "buyer"}, token: "beta-token", expected: "Beta"},
+		{name: "Missing role", condition: config.RuleCondition{Type: "token", Parameter: "role", Operator: "eq", Value: "beta-tester"}, token: "user-token", expected: "Default"},
+		{name: "Scope", condition: config.RuleCondition{Type: "token", Parameter: "scope", Operator: "prefix", Value: "checkout:"}, token: "user-token", expected: "Beta"},
+		{name: "Claim", condition: config.RuleCondition{Type: "token", Parameter: "claim:groups", Operator: "eq", Value: "staff"}, token: "user-token", expected: "Beta"},
+		{name: "Inactive token", condition: config.RuleCondition{Type: "token", Parameter: "scope", Operator: "eq", Value: "openid"}, token: "revoked", expected: "Default"},
+		{name: "No token", condition: config.RuleCondition{Type: "token", Parameter: "scope", Operator: "eq", Value: "openid"}, expected: "Default"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			middleware := createMiddleware(t, &config.Config{
+				DefaultBackend: defaultServer.URL(),
+				Rules: []config.RoutingRule{
+					{Path: "/", Backend: betaServer.URL(), Conditions: []config.RuleCondition{tc.condition}},
+				},
+				Introspection: &config.Introspection{URL: introspection.URL, ClientID: "forklift", ClientSecret: "s3cret"},
+			})
+			if body := serve(t, middleware, tc.token); body != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, body)
+			}
+		})
+	}
+
+	t.Run("Cached", func(t *testing.T) {
+		middleware := createMiddleware(t, &config.Config{
+			DefaultBackend: defaultServer.URL(),
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: betaServer.URL(), Conditions: []config.RuleCondition{
+					{Type: "token", Parameter: "role", Operator: "eq", Value: "beta-tester"},
+				}},
+			},
+			Introspection: &config.Introspection{URL: introspection.URL, ClientID: "forklift", ClientSecret: "s3cret"},
+		})
+		before := atomic.LoadInt64(calls)
+		for range 5 {
+			serve(t, middleware, "beta-token")
+			serve(t, middleware, "revoked")
+		}
+		if n := atomic.LoadInt64(calls) - before; n != 2 {
+			t.Errorf("Expected each token to be introspected once, got %d calls", n)
+		}
+	})
+
+	t.Run("Wrong credentials", func(t *testing.T) {
+		middleware := createMiddleware(t, &config.Config{
+			DefaultBackend: defaultServer.URL(),
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: betaServer.URL(), Conditions: []config.RuleCondition{
+					{Type: "token", Parameter: "role", Operator: "eq", Value: "beta-tester"},
+				}},
+			},
+			Introspection: &config.Introspection{URL: introspection.URL, ClientID: "forklift", ClientSecret: "wrong"},
+		})
+		if body := serve(t, middleware, "beta-token"); body != "Default" {
+			t.Errorf("Expected Default when introspection fails, got %s", body)
+		}
+	})
+}
+
+func TestInvalidTokenCondition(t *testing.T) {
+	introspection := &config.Introspection{URL: "https://keycloak.example.com/introspect", ClientID: "forklift"}
+	testCases := []struct {
+		name          string
+		condition     config.RuleCondition
+		introspection *config.Introspection
+	}{
+		{name: "Without introspection", condition: config.RuleCondition{Type: "token", Parameter: "role", Value: "beta-tester"}},
+		{name: "Unknown parameter", condition: config.RuleCondition{Type: "token", Parameter: "group", Value: "staff"}, introspection: introspection},
+		{name: "Empty claim", condition: config.RuleCondition{Type: "token", Parameter: "claim:", Value: "staff"}, introspection: introspection},
+		{
+			name:          "Relative URL",
+			condition:     config.RuleCondition{Type: "token", Parameter: "role", Value: "beta-tester"},
+			introspection: &config.Introspection{URL: "/introspect", ClientID: "forklift"},
+		},
+		{
+			name:          "Invalid cache TTL",
+			condition:     config.RuleCondition{Type: "token", Parameter: "role", Value: "beta-tester"},
+			introspection: &config.Introspection{URL: introspection.URL, ClientID: "forklift", CacheTTL: "forever"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules: []config.RoutingRule{
+					{Path: "/", Backend: "http://localhost:8081", Conditions: []config.RuleCondition{tc.condition}},
+				},
+				Introspection: tc.introspection,
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestPanickingConditionFallsThrough(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	betaServer := newMockServer("Beta Backend")
+	defer betaServer.close()
+	stableServer := newMockServer("Stable Backend")
+	defer stableServer.close()
+
+	forklift.RegisterConditionEvaluator("test-panic", forklift.ConditionEvaluatorFunc(
+		func(*http.Request, config.RuleCondition) bool {
+			panic("bad regex")
+		}))
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/app",
+				Backend:    betaServer.URL(),
+				Priority:   10,
+				Experiment: "beta",
+				Variant:    "on",
+				Conditions: []config.RuleCondition{{Type: "custom", Parameter: "test-panic"}},
+			},
+			{Path: "/app", Backend: stableServer.URL()},
+		},
+	})
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/app", nil, nil))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "Stable Backend" {
+		t.Fatalf("Expected the next rule to serve the request, got %d: %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/metrics", nil, nil))
+	if line := `forklift_rule_failures_total{rule="beta/on",reason="panic"} 1`; !strings.Contains(rr.Body.String(), line) {
+		t.Errorf("Expected %q in metrics, got:\n%s", line, rr.Body.String())
+	}
+}
+
+func TestErrorBudgetSkipsFailingRule(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	betaServer := newMockServer("Beta Backend")
+	defer betaServer.close()
+
+	var calls atomic.Int64
+	forklift.RegisterConditionEvaluator("test-flaky", forklift.ConditionEvaluatorFunc(
+		func(*http.Request, config.RuleCondition) bool {
+			calls.Add(1)
+			panic("evaluator failed")
+		}))
+
+	middleware, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:        "/app",
+				Backend:     betaServer.URL(),
+				Conditions:  []config.RuleCondition{{Type: "custom", Parameter: "test-flaky"}},
+				ErrorBudget: &config.ErrorBudget{Failures: 2, Window: "1m", Cooldown: "5m"},
+			},
+		},
+	}, "test-forklift")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.SetClock(func() time.Time { return now })
+
+	serve := func() string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/app", nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	for range 4 {
+		if got := serve(); got != "Default Backend" {
+			t.Fatalf("Expected default backend, got %q", got)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("Expected the rule to be skipped after 2 failures, evaluator called %d times", got)
+	}
+
+	now = now.Add(5 * time.Minute)
+	serve()
+	if got := calls.Load(); got != 3 {
+		t.Errorf("Expected the rule to be evaluated again after the cooldown, evaluator called %d times", got)
+	}
+}
+
+func TestInvalidErrorBudget(t *testing.T) {
+	testCases := []struct {
+		name   string
+		budget *config.ErrorBudget
+	}{
+		{name: "No failures", budget: &config.ErrorBudget{Window: "1m"}},
+		{name: "Invalid window", budget: &config.ErrorBudget{Failures: 3, Window: "soon"}},
+		{name: "Invalid cooldown", budget: &config.ErrorBudget{Failures: 3, Window: "1m", Cooldown: "-1s"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", ErrorBudget: tc.budget}},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
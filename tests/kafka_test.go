@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// kafkaRecord is a record produced to the fake REST proxy, with its key and value decoded.
+type kafkaRecord struct {
+	key   string
+	value []byte
+}
+
+func newKafkaProxy(t *testing.T, schemas chan<- map[string]string, records chan<- kafkaRecord) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/subjects/exposures-value/versions":
+			var schema map[string]string
+			_ = json.NewDecoder(req.Body).Decode(&schema)
+			schemas <- schema
+			_ = json.NewEncoder(rw).Encode(map[string]int{"id": 42})
+		case "/topics/exposures":
+			if key, secret, ok := req.BasicAuth(); !ok || key != "key" || secret != "secret" {
+				http.Error(rw, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			var body struct {
+				Records []struct {
+					Key   string `json:"key"`
+					Value string `json:"value"`
+				} `json:"records"`
+			}
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			offsets := make([]map[string]interface{}, len(body.Records))
+			for i, record := range body.Records {
+				key, _ := base64.StdEncoding.DecodeString(record.Key)
+				value, _ := base64.StdEncoding.DecodeString(record.Value)
+				records <- kafkaRecord{key: string(key), value: value}
+				offsets[i] = map[string]interface{}{"partition": 0, "offset": i}
+			}
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{"offsets": offsets})
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+}
+
+func TestKafkaExposureSink(t *testing.T) {
+	sessionID := "a2Fma2Etc2Vzc2lvbg=="
+	// The schema version, experiment and variant lead both encodings of the exposure.
+	avroPrefix := func(value []byte) bool {
+		r := bytes.NewReader(value)
+		version, _ := binary.ReadVarint(r)
+		_, _ = binary.ReadVarint(r)
+		length, _ := binary.ReadVarint(r)
+		experiment := make([]byte, length)
+		_, _ = r.Read(experiment)
+		return version == 3 && string(experiment) == "checkout"
+	}
+	protoPrefix := func(value []byte) bool {
+		// Message index 0, then field 1 (schema version) set to 3.
+		return len(value) > 3 && value[0] == 0 && value[1] == 0x08 && value[2] == 3 &&
+			bytes.Contains(value, append([]byte{0x1a, 8}, "checkout"...))
+	}
+
+	testCases := []struct {
+		name       string
+		format     string
+		schemaType string
+		framed     bool
+		decodes    func([]byte) bool
+	}{
+		{name: "JSON", format: "json", decodes: func(value []byte) bool {
+			var exposure map[string]interface{}
+			return json.Unmarshal(value, &exposure) == nil && exposure["experiment"] == "checkout"
+		}},
+		{name: "Avro", format: "avro", framed: true, decodes: avroPrefix},
+		{name: "Protobuf", format: "protobuf", schemaType: "PROTOBUF", framed: true, decodes: protoPrefix},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			schemas := make(chan map[string]string, 10)
+			records := make(chan kafkaRecord, 10)
+			proxy := newKafkaProxy(t, schemas, records)
+			defer proxy.Close()
+
+			backend := newMockServer("Checkout V2")
+			defer backend.close()
+
+			cfg := &config.Config{
+				DefaultBackend: backend.URL(),
+				EventSinks: []config.EventSink{{
+					Type:           "kafka",
+					URL:            proxy.URL,
+					APIKey:         "key:secret",
+					Topic:          "exposures",
+					Format:         tc.format,
+					SchemaRegistry: proxy.URL,
+					FlushInterval:  "10ms",
+				}},
+				Rules: []config.RoutingRule{
+					{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+				},
+			}
+			middleware := createMiddleware(t, cfg)
+
+			req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Cookie": sessionCookieName + "=" + sessionID}, nil)
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+			var record kafkaRecord
+			select {
+			case record = <-records:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected an exposure record")
+			}
+			if record.key != sessionID {
+				t.Errorf("Expected the record to be keyed by session, got %q", record.key)
+			}
+
+			value := record.value
+			if tc.framed {
+				select {
+				case schema := <-schemas:
+					if schema["schemaType"] != tc.schemaType || !strings.Contains(schema["schema"], "session_id") {
+						t.Errorf("Unexpected registered schema: %v", schema)
+					}
+				default:
+					t.Error("Expected the schema to be registered")
+				}
+				if len(value) < 5 || value[0] != 0 || binary.BigEndian.Uint32(value[1:5]) != 42 {
+					t.Fatalf("Expected the Confluent wire format with schema ID 42, got %x", value)
+				}
+				value = value[5:]
+			}
+			if !tc.decodes(value) {
+				t.Errorf("Unexpected %s record: %x", tc.format, value)
+			}
+		})
+	}
+}
+
+func TestKafkaSinkRequiresSchemaRegistry(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		EventSinks:     []config.EventSink{{Type: "kafka", URL: "http://localhost:8082", Topic: "exposures", Format: "avro"}},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected Avro records without a schema registry to be rejected")
+	}
+}
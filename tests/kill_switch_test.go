@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// killSwitchClient serves requests and admin API calls to a middleware with the admin token
+// "s3cret".
+type killSwitchClient struct {
+	t          *testing.T
+	middleware http.Handler
+}
+
+func (c killSwitchClient) get(path string) string {
+	rr := httptest.NewRecorder()
+	c.middleware.ServeHTTP(rr, createTestRequest(c.t, http.MethodGet, path, nil, nil))
+	return strings.TrimSpace(rr.Body.String())
+}
+
+func (c killSwitchClient) admin(method, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/_forklift/admin/killswitch", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer s3cret")
+	rr := httptest.NewRecorder()
+	c.middleware.ServeHTTP(rr, req)
+	return rr
+}
+
+func (c killSwitchClient) state() (engaged bool, sources []string) {
+	var state struct {
+		Engaged bool     `json:"engaged"`
+		Sources []string `json:"sources"`
+	}
+	rr := c.admin(http.MethodGet, "")
+	if err := json.Unmarshal(rr.Body.Bytes(), &state); err != nil {
+		c.t.Fatalf("Failed to decode the kill switch state %q: %v", rr.Body.String(), err)
+	}
+	return state.Engaged, state.Sources
+}
+
+func killSwitchConfig(defaultBackend, backend string, killSwitch *config.KillSwitch) *config.Config {
+	return &config.Config{
+		DefaultBackend: defaultBackend,
+		MetricsPath:    "/metrics",
+		AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+		KillSwitch:     killSwitch,
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: backend, Percentage: 100, Experiment: "checkout", Variant: "v2"},
+		},
+	}
+}
+
+func TestKillSwitchAdminAPI(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	newServer := newMockServer("New")
+	defer newServer.close()
+
+	c := killSwitchClient{t: t, middleware: createMiddleware(t, killSwitchConfig(defaultServer.URL(), newServer.URL(), nil))}
+	if body := c.get("/"); body != "New" {
+		t.Fatalf("Expected the rules to route the request, got %q", body)
+	}
+
+	if rr := c.admin(http.MethodPut, `{"engaged": true}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the kill switch to be engaged, got %d %q", rr.Code, rr.Body.String())
+	}
+	if engaged, sources := c.state(); !engaged || len(sources) != 1 || sources[0] != "admin" {
+		t.Errorf("Expected the kill switch to be engaged by admin, got %v %v", engaged, sources)
+	}
+	for range 3 {
+		if body := c.get("/"); body != "Default" {
+			t.Errorf("Expected the kill switch to send requests to the default backend, got %q", body)
+		}
+	}
+	metrics := c.get("/metrics")
+	for _, line := range []string{
+		`forklift_kill_switch_engaged{source="admin"} 1`,
+		`forklift_kill_switch_engaged{source="config"} 0`,
+		`forklift_kill_switch_requests_total 3`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", line, metrics)
+		}
+	}
+
+	if rr := c.admin(http.MethodPut, `{}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without engaged, got %d", rr.Code)
+	}
+	if rr := c.admin(http.MethodPost, `{"engaged": false}`); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST, got %d", rr.Code)
+	}
+	if rr := c.admin(http.MethodPut, `{"engaged": false}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the kill switch to be released, got %d %q", rr.Code, rr.Body.String())
+	}
+	if body := c.get("/"); body != "New" {
+		t.Errorf("Expected the rules to route requests once the kill switch is released, got %q", body)
+	}
+}
+
+func TestKillSwitchConfigured(t *testing.T) {
+	defaultServer := newHeaderServer()
+	defer defaultServer.Close()
+	newServer := newMockServer("New")
+	defer newServer.close()
+
+	cfg := killSwitchConfig(defaultServer.URL, newServer.URL(), &config.KillSwitch{Engaged: true})
+	cfg.Propagation = &config.Propagation{}
+	c := killSwitchClient{t: t, middleware: createMiddleware(t, cfg)}
+	if body := c.get("/"); !strings.Contains(body, `"X-Forklift-Reason":"kill_switch"`) {
+		t.Errorf("Expected the request to be sent to the default backend by the kill switch, got %q", body)
+	}
+
+	// The configuration engages the kill switch however it is released through the admin API.
+	c.admin(http.MethodPut, `{"engaged": false}`)
+	if engaged, sources := c.state(); !engaged || len(sources) != 1 || sources[0] != "config" {
+		t.Errorf("Expected the kill switch to stay engaged by config, got %v %v", engaged, sources)
+	}
+}
+
+func TestKillSwitchStoreKey(t *testing.T) {
+	redis := newFakeRedis(t)
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	newServer := newMockServer("New")
+	defer newServer.close()
+
+	newInstance := func() killSwitchClient {
+		cfg := killSwitchConfig(defaultServer.URL(), newServer.URL(), &config.KillSwitch{Key: "forklift:killswitch", PollInterval: "10ms"})
+		cfg.SessionStore = &config.SessionStore{Type: "redis", Servers: []string{redis.addr()}}
+		middleware := newShutdownMiddleware(t, cfg)
+		t.Cleanup(func() { _ = middleware.Shutdown(context.Background()) })
+		return killSwitchClient{t: t, middleware: middleware}
+	}
+	first, second := newInstance(), newInstance()
+
+	if rr := first.admin(http.MethodPut, `{"engaged": true}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the kill switch to be engaged, got %d %q", rr.Code, rr.Body.String())
+	}
+	if value, _ := redis.get("forklift:killswitch"); value != "on" {
+		t.Errorf("Expected the admin API to write the key, got %q", value)
+	}
+	if body := first.get("/"); body != "Default" {
+		t.Errorf("Expected the instance engaging the kill switch to follow it at once, got %q", body)
+	}
+	// The other instances follow the key.
+	waitFor(t, func() bool { return second.get("/") == "Default" })
+	if _, sources := second.state(); len(sources) != 1 || sources[0] != "store" {
+		t.Errorf("Expected the kill switch to be engaged by store, got %v", sources)
+	}
+
+	// Releasing it overwrites the key the admin API wrote.
+	if rr := second.admin(http.MethodPut, `{"engaged": false}`); rr.Code != http.StatusOK {
+		t.Fatalf("Expected the kill switch to be released, got %d %q", rr.Code, rr.Body.String())
+	}
+	if value, _ := redis.get("forklift:killswitch"); value != "off" {
+		t.Errorf("Expected the admin API to release the key, got %q", value)
+	}
+	waitFor(t, func() bool { return first.get("/") == "New" && second.get("/") == "New" })
+	if engaged, _ := first.state(); engaged {
+		t.Error("Expected the kill switch to stay released after polling the key")
+	}
+
+	redis.set("forklift:killswitch", "on")
+	waitFor(t, func() bool { return first.get("/") == "Default" && second.get("/") == "Default" })
+	redis.set("forklift:killswitch", "off")
+	waitFor(t, func() bool { return first.get("/") == "New" && second.get("/") == "New" })
+	if metrics := second.get("/metrics"); !strings.Contains(metrics, `forklift_kill_switch_engaged{source="store"} 0`) {
+		t.Errorf("Expected the kill switch to be released in the metrics, got:\n%s", metrics)
+	}
+}
+
+func TestInvalidKillSwitch(t *testing.T) {
+	for name, killSwitch := range map[string]*config.KillSwitch{
+		"key without store": {Key: "forklift:killswitch"},
+		"poll interval":     {PollInterval: "0s"},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost:8080", KillSwitch: killSwitch}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
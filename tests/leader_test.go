@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/store"
+)
+
+func TestLeaderElection(t *testing.T) {
+	redis := newFakeRedis(t)
+	prometheus := newFakePrometheus(t, map[string]string{"v1": "0.01", "v2": "0.0105"})
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	newInstance := func() *forklift.Forklift {
+		return newShutdownMiddleware(t, &config.Config{
+			DefaultBackend: v1Server.URL(),
+			MetricsPath:    "/metrics",
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v1Server.URL(), Percentage: 100, Experiment: "checkout", Variant: "v1"},
+				{Path: "/", Backend: v2Server.URL(), Percentage: 1, Experiment: "checkout", Variant: "v2"},
+			},
+			SessionStore:   &config.SessionStore{Type: "redis", Servers: []string{redis.addr()}},
+			LeaderElection: &config.LeaderElection{LeaseDuration: "150ms"},
+			CanaryAnalysis: &config.CanaryAnalysis{
+				Prometheus: prometheus.server.URL,
+				Interval:   "10ms",
+				Canaries: []config.Canary{{
+					Experiment: "checkout",
+					Canary:     "v2",
+					Baseline:   "v1",
+					Steps:      []float64{10, 50, 100},
+					Metrics:    []config.CanaryMetric{{Name: "error-rate", Query: `error_rate{variant="{variant}"}`}},
+				}},
+			},
+		})
+	}
+	serve := func(middleware http.Handler, path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+	leading := func(middleware http.Handler) bool {
+		return strings.Contains(serve(middleware, "/metrics"), "forklift_leader 1")
+	}
+
+	first := newInstance()
+	waitFor(t, func() bool { return leading(first) })
+	second := newInstance()
+	defer func() { _ = second.Shutdown(context.Background()) }()
+
+	waitFor(t, func() bool {
+		return strings.Contains(serve(first, "/metrics"),
+			`forklift_canary_decisions_total{experiment="checkout",variant="v2",decision="promote"} 1`)
+	})
+	// The follower serves the steps the leader published, without analyzing the canary itself.
+	waitFor(t, func() bool {
+		for range 50 {
+			if serve(second, "/") != "V2" {
+				return false
+			}
+		}
+		return true
+	})
+	if metrics := serve(second, "/metrics"); strings.Contains(metrics, "forklift_canary_decisions_total{") || leading(second) {
+		t.Errorf("Expected the follower to leave the analysis to the leader:\n%s", metrics)
+	}
+	if holder, _ := redis.get("forklift:leader:test-forklift"); holder == "" {
+		t.Error("Expected the lease in the session store")
+	}
+
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down the leader: %v", err)
+	}
+	waitFor(t, func() bool { return leading(second) })
+	// The new leader carries on from the published steps instead of starting the canary over.
+	if body := serve(second, "/"); body != "V2" {
+		t.Errorf("Expected the new leader to keep the canary promoted, got %q", body)
+	}
+}
+
+func TestMemoryStoreLease(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1700000000, 0)
+	s := store.NewMemoryStore()
+	s.SetClock(func() time.Time { return now })
+
+	if ok, err := s.Lease(ctx, "leader", "a", time.Minute); !ok || err != nil {
+		t.Fatalf("Expected a to take the free lease, got %v %v", ok, err)
+	}
+	if ok, _ := s.Lease(ctx, "leader", "b", time.Minute); ok {
+		t.Error("Expected b to be refused a lease a holds")
+	}
+	now = now.Add(50 * time.Second)
+	if ok, _ := s.Lease(ctx, "leader", "a", time.Minute); !ok {
+		t.Error("Expected a to renew its lease")
+	}
+	now = now.Add(50 * time.Second)
+	if ok, _ := s.Lease(ctx, "leader", "b", time.Minute); ok {
+		t.Error("Expected the renewed lease to outlast its first expiry")
+	}
+	_ = s.Release(ctx, "leader", "b")
+	now = now.Add(time.Minute)
+	if ok, _ := s.Lease(ctx, "leader", "b", time.Minute); !ok {
+		t.Error("Expected b to take the expired lease")
+	}
+	_ = s.Release(ctx, "leader", "b")
+	if ok, _ := s.Lease(ctx, "leader", "a", time.Minute); !ok {
+		t.Error("Expected a to take the released lease")
+	}
+}
+
+func TestLeaderElectionRequiresLeases(t *testing.T) {
+	for name, sessionStore := range map[string]*config.SessionStore{
+		"Without a session store": nil,
+		"Memcached":               {Type: "memcached", Servers: []string{"localhost:11211"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost:8080",
+				SessionStore:   sessionStore,
+				LeaderElection: &config.LeaderElection{},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected leader election to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/metrics"
+)
+
+func TestConcurrentMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.Counter("requests_total", "Requests.", "code")
+	inFlight := registry.Gauge("in_flight", "Requests in flight.")
+	duration := registry.Histogram("duration_seconds", "Duration.", []float64{0.1, 1}, "code")
+
+	const workers, updates = 8, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var b strings.Builder
+			for i := 0; i < updates; i++ {
+				inFlight.Add(1)
+				requests.Inc("200")
+				requests.Add(0.5, "500")
+				duration.Observe(float64(i%3)*0.5, "200")
+				inFlight.Add(-1)
+				if i%100 == 0 {
+					_, _ = registry.WriteTo(&b)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := requests.Value("200"); got != workers*updates {
+		t.Errorf("Expected %d requests, got %v", workers*updates, got)
+	}
+	if got := requests.Value("500"); got != workers*updates/2 {
+		t.Errorf("Expected %d for the halves, got %v", workers*updates/2, got)
+	}
+	if got := inFlight.Value(); got != 0 {
+		t.Errorf("Expected no requests in flight, got %v", got)
+	}
+
+	var b strings.Builder
+	if _, err := registry.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	// Observations cycle through 0, 0.5 and 1, a third of them in each bucket.
+	for _, line := range []string{
+		`duration_seconds_bucket{code="200",le="0.1"} 2672`,
+		`duration_seconds_bucket{code="200",le="1"} 8000`,
+		`duration_seconds_bucket{code="200",le="+Inf"} 8000`,
+		`duration_seconds_count{code="200"} 8000`,
+		`requests_total{code="200"} 8000`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("Expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestOpenMetricsGrammar(t *testing.T) {
+	registry := metrics.NewRegistry()
+	registry.Counter("jobs", `Jobs run by "kind".`, "kind").Inc(`quoted "kind"`)
+	registry.Counter("requests_total", "Requests.", "path").Add(2, `C:\path`+"\n")
+	registry.Gauge("in_flight", `Requests in flight, \ included.`).Set(-1)
+	duration := registry.Histogram("duration_seconds", "Duration.", []float64{0.1, 1}, "code")
+	duration.Observe(0.05, "200")
+	duration.ObserveWithExemplar(0.5, "4bf92f3577b34da6a3ce929d0e0e4736", "200")
+	duration.ObserveWithExemplar(5, "0af7651916cd43dd8448eb211c80319c", "500")
+	registry.Histogram("unobserved_seconds", "Unobserved.", metrics.DefaultBuckets)
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0")
+	rr := httptest.NewRecorder()
+	registry.ServeHTTP(rr, req)
+	if err := parseOpenMetrics(rr.Body.String()); err != nil {
+		t.Fatalf("Expected valid OpenMetrics, got %v in:\n%s", err, rr.Body.String())
+	}
+	for _, line := range []string{
+		"# TYPE jobs counter\n",
+		"# HELP jobs Jobs run by \\\"kind\\\".\n",
+		"jobs_total{kind=\"quoted \\\"kind\\\"\"} 1\n",
+		"# TYPE requests counter\n",
+		"requests_total{path=\"C:\\\\path\\n\"} 2\n",
+	} {
+		if !strings.Contains(rr.Body.String(), line) {
+			t.Errorf("Expected %q in:\n%s", line, rr.Body.String())
+		}
+	}
+
+	// All the families of a middleware parse too.
+	backend := newMockServer("OK")
+	defer backend.close()
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		MetricsPath:    "/metrics",
+		AdminAPI:       &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret"},
+		KillSwitch:     &config.KillSwitch{},
+		SessionStore:   &config.SessionStore{Type: "memory", Cache: &config.SessionCache{}},
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: backend.URL(), Percentage: 50, Experiment: "home", Variant: "v1"},
+			{Path: "/", Backend: backend.URL(), Percentage: 50, Experiment: "home", Variant: "v2"},
+		},
+	})
+	for _, traceparent := range []string{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""} {
+		middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/", map[string]string{"Traceparent": traceparent}, nil))
+	}
+	rr = httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/metrics", map[string]string{"Accept": "application/openmetrics-text"}, nil))
+	if err := parseOpenMetrics(rr.Body.String()); err != nil {
+		t.Fatalf("Expected valid OpenMetrics, got %v in:\n%s", err, rr.Body.String())
+	}
+}
+
+var (
+	openMetricsName   = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	openMetricsLabel  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	openMetricsNumber = regexp.MustCompile(`^(?:[+-]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][+-]?[0-9]+)?|(?i:[+-]?inf(?:inity)?|nan))$`)
+	openMetricsHelp   = regexp.MustCompile(`^(?:[^\\"\n]|\\[\\"n])*$`)
+)
+
+// openMetricsSuffixes are the suffixes of the samples of each type of family.
+var openMetricsSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+	"info":           {"_info"},
+	"stateset":       {""},
+	"unknown":        {""},
+}
+
+// openMetricsBuckets follows the buckets of a histogram series.
+type openMetricsBuckets struct {
+	le, count float64
+	inf       bool
+}
+
+// parseOpenMetrics checks body against the OpenMetrics 1.0 text format: families are declared
+// once, with their TYPE before their samples, samples are named after their family and type,
+// exemplars only follow counter totals and histogram buckets, histogram buckets are cumulative
+// and end with +Inf, and the exposition ends with # EOF.
+func parseOpenMetrics(body string) error {
+	rest, ok := strings.CutSuffix(body, "# EOF\n")
+	if !ok {
+		return errors.New("missing # EOF at the end")
+	}
+	if rest != "" && !strings.HasSuffix(rest, "\n") {
+		return errors.New("# EOF isn't on a line of its own")
+	}
+
+	families := make(map[string]bool)
+	var family, kind string
+	var sampled bool
+	metadata := make(map[string]bool)
+	series := make(map[string]bool)
+	buckets := make(map[string]*openMetricsBuckets)
+	var lines []string
+	if rest != "" {
+		lines = strings.Split(strings.TrimSuffix(rest, "\n"), "\n")
+	}
+	for i, line := range lines {
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("line %d %q: %s", i+1, line, fmt.Sprintf(format, args...))
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 4 || fields[0] != "#" {
+				return fail("malformed metadata")
+			}
+			name, text := fields[2], fields[3]
+			if name != family {
+				if families[name] {
+					return fail("family %s declared twice", name)
+				}
+				families[name] = true
+				family, kind, sampled = name, "unknown", false
+				metadata = make(map[string]bool)
+			}
+			switch {
+			case !openMetricsName.MatchString(name):
+				return fail("invalid family name")
+			case sampled:
+				return fail("metadata after the samples of the family")
+			case metadata[fields[1]]:
+				return fail("duplicate %s", fields[1])
+			}
+			metadata[fields[1]] = true
+			switch fields[1] {
+			case "TYPE":
+				if openMetricsSuffixes[text] == nil {
+					return fail("unknown type %s", text)
+				}
+				kind = text
+			case "HELP":
+				if !openMetricsHelp.MatchString(text) {
+					return fail("unescaped help")
+				}
+			case "UNIT":
+				if !strings.HasSuffix(name, "_"+text) {
+					return fail("family name doesn't end with its unit")
+				}
+			default:
+				return fail("unknown metadata %s", fields[1])
+			}
+			continue
+		}
+
+		name, labels, value, exemplar, err := parseOpenMetricsSample(line)
+		if err != nil {
+			return fail("%v", err)
+		}
+		if family == "" || !metadata["TYPE"] {
+			return fail("sample without a TYPE")
+		}
+		suffix, ok := strings.CutPrefix(name, family)
+		if !ok || !containsString(openMetricsSuffixes[kind], suffix) {
+			return fail("sample name doesn't fit the %s family %s", kind, family)
+		}
+		sampled = true
+		key := name + formatOpenMetricsLabels(labels, "")
+		if series[key] {
+			return fail("duplicate sample")
+		}
+		series[key] = true
+		if exemplar != "" && !(kind == "counter" && suffix == "_total" || kind == "histogram" && suffix == "_bucket") {
+			return fail("exemplar on a %s%s sample", kind, suffix)
+		}
+		number, _ := strconv.ParseFloat(value, 64)
+		if kind == "counter" && suffix == "_total" && (number < 0 || math.IsNaN(number)) {
+			return fail("counter total must be a non-negative number")
+		}
+		if kind != "histogram" {
+			continue
+		}
+		b := buckets[family+formatOpenMetricsLabels(labels, "le")]
+		if b == nil {
+			b = &openMetricsBuckets{le: math.Inf(-1)}
+			buckets[family+formatOpenMetricsLabels(labels, "le")] = b
+		}
+		switch suffix {
+		case "_bucket":
+			le, err := strconv.ParseFloat(labels["le"], 64)
+			switch {
+			case err != nil:
+				return fail("bucket without a valid le label")
+			case b.inf || le <= b.le:
+				return fail("buckets out of order")
+			case number < b.count:
+				return fail("buckets aren't cumulative")
+			}
+			b.le, b.count, b.inf = le, number, math.IsInf(le, 1)
+		case "_count":
+			if !b.inf || number != b.count {
+				return fail("count doesn't match the +Inf bucket")
+			}
+		}
+	}
+	return nil
+}
+
+// parseOpenMetricsSample splits a sample line into its name, labels, value and exemplar, checking
+// the timestamp and exemplar if any.
+func parseOpenMetricsSample(line string) (name string, labels map[string]string, value, exemplar string, err error) {
+	end := strings.IndexAny(line, "{ ")
+	if end < 0 {
+		return "", nil, "", "", errors.New("missing value")
+	}
+	name, rest := line[:end], line[end:]
+	if !openMetricsName.MatchString(name) {
+		return "", nil, "", "", errors.New("invalid metric name")
+	}
+	labels = map[string]string{}
+	if strings.HasPrefix(rest, "{") {
+		if labels, rest, err = parseOpenMetricsLabels(rest); err != nil {
+			return "", nil, "", "", err
+		}
+	}
+	rest, ok := strings.CutPrefix(rest, " ")
+	if !ok {
+		return "", nil, "", "", errors.New("missing space before the value")
+	}
+	rest, exemplar, _ = strings.Cut(rest, " # ")
+	fields := strings.Split(rest, " ")
+	if len(fields) > 2 || !openMetricsNumber.MatchString(fields[0]) || len(fields) == 2 && !openMetricsNumber.MatchString(fields[1]) {
+		return "", nil, "", "", errors.New("invalid value or timestamp")
+	}
+	if exemplar != "" {
+		exemplarLabels, rest, err := parseOpenMetricsLabels(exemplar)
+		if err != nil {
+			return "", nil, "", "", fmt.Errorf("exemplar: %w", err)
+		}
+		length := 0
+		for labelName, labelValue := range exemplarLabels {
+			length += utf8.RuneCountInString(labelName) + utf8.RuneCountInString(labelValue)
+		}
+		fields := strings.Split(strings.TrimPrefix(rest, " "), " ")
+		switch {
+		case length > 128:
+			return "", nil, "", "", errors.New("exemplar labels longer than 128 characters")
+		case !strings.HasPrefix(rest, " ") || len(fields) > 2 || !openMetricsNumber.MatchString(fields[0]) ||
+			len(fields) == 2 && !openMetricsNumber.MatchString(fields[1]):
+			return "", nil, "", "", errors.New("invalid exemplar value or timestamp")
+		}
+	}
+	return name, labels, fields[0], exemplar, nil
+}
+
+// parseOpenMetricsLabels parses the label set at the start of s, and returns the rest of s.
+func parseOpenMetricsLabels(s string) (map[string]string, string, error) {
+	labels := make(map[string]string)
+	s, ok := strings.CutPrefix(s, "{")
+	if !ok {
+		return nil, "", errors.New("missing label set")
+	}
+	for {
+		if rest, ok := strings.CutPrefix(s, "}"); ok && len(labels) == 0 {
+			return labels, rest, nil
+		}
+		name, rest, ok := strings.Cut(s, `="`)
+		if !ok || !openMetricsLabel.MatchString(name) {
+			return nil, "", fmt.Errorf("invalid label name %q", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, "", fmt.Errorf("duplicate label %s", name)
+		}
+		var value strings.Builder
+		i := 0
+		for ; i < len(rest) && rest[i] != '"'; i++ {
+			switch {
+			case rest[i] == '\n':
+				return nil, "", errors.New("unescaped line feed in a label value")
+			case rest[i] != '\\':
+				value.WriteByte(rest[i])
+			case i+1 < len(rest) && (rest[i+1] == '\\' || rest[i+1] == '"'):
+				i++
+				value.WriteByte(rest[i])
+			case i+1 < len(rest) && rest[i+1] == 'n':
+				i++
+				value.WriteByte('\n')
+			default:
+				return nil, "", errors.New("invalid escape in a label value")
+			}
+		}
+		if i == len(rest) {
+			return nil, "", errors.New("unterminated label value")
+		}
+		labels[name] = value.String()
+		s = rest[i+1:]
+		if rest, ok := strings.CutPrefix(s, "}"); ok {
+			return labels, rest, nil
+		}
+		if s, ok = strings.CutPrefix(s, ","); !ok {
+			return nil, "", errors.New("missing comma between labels")
+		}
+	}
+}
+
+// formatOpenMetricsLabels formats labels in name order, without the label skip.
+func formatOpenMetricsLabels(labels map[string]string, skip string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name != skip {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%q,", name, labels[name])
+	}
+	return "{" + b.String() + "}"
+}
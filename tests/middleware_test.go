@@ -4,6 +4,7 @@ package tests
 import (
 	"context"
 	"math"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -14,14 +15,17 @@ import (
 	"github.com/daemonp/forklift/config"
 )
 
-const sessionCookieName = "forklift_id"
+const (
+	sessionCookieName = "forklift_id"
+	testSeed          = 2
+)
 
 func TestForkliftMiddleware(t *testing.T) {
 	servers := setupMockServers(t)
 	defer closeMockServers(servers)
 
 	config := createTestConfig(servers)
-	middleware := createMiddleware(t, config)
+	middleware := createSeededMiddleware(t, config, testSeed)
 
 	runBasicTests(t, middleware)
 	runPercentageBasedRoutingTest(t, middleware)
@@ -146,6 +150,19 @@ func createMiddleware(t *testing.T, cfg *config.Config) http.Handler {
 	return middleware
 }
 
+// createSeededMiddleware creates a middleware whose session IDs come from a seeded random source,
+// so the bucketing of new sessions is the same on every run.
+func createSeededMiddleware(t *testing.T, cfg *config.Config, seed int64) http.Handler {
+	t.Helper()
+	middleware := createMiddleware(t, cfg)
+	f, ok := middleware.(*forklift.Forklift)
+	if !ok {
+		t.Fatalf("Expected *forklift.Forklift, got %T", middleware)
+	}
+	f.SetRandomSource(rand.New(rand.NewSource(seed)))
+	return f
+}
+
 func runBasicTests(t *testing.T, middleware http.Handler) {
 	t.Helper()
 	tests := []struct {
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestLegacyConfigMigration(t *testing.T) {
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	cfg, err := config.LoadConfig("v1Backend: " + v1Server.URL() + "\nv2Backend: " + v2Server.URL() + "\nv2Percentage: 100\n")
+	if err != nil {
+		t.Fatalf("Failed to load the legacy configuration: %v", err)
+	}
+	middleware := createMiddleware(t, cfg)
+	if cfg.SchemaVersion != config.SchemaVersion || cfg.DefaultBackend != v1Server.URL() || len(cfg.Rules) != 1 {
+		t.Fatalf("Expected the configuration to be migrated, got %+v", cfg)
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/any/path", nil, nil))
+	if body := strings.TrimSpace(rr.Body.String()); body != "V2" {
+		t.Errorf("Expected v2Percentage of the traffic to go to v2Backend, got %q", body)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	cfg := &config.Config{SchemaVersion: 1, V1Backend: "http://v1", V2Backend: "http://v2"}
+	notices, err := config.Migrate(cfg)
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if len(notices) != 3 {
+		t.Errorf("Expected notices for the schema version and each legacy field, got %q", notices)
+	}
+	if cfg.DefaultBackend != "http://v1" || cfg.V1Backend != "" || cfg.V2Backend != "" ||
+		len(cfg.Rules) != 1 || cfg.Rules[0].Percentage != 50 || cfg.Rules[0].PathPrefix != "/" {
+		t.Errorf("Expected the legacy backends to become the default backend and a 50%% rule, got %+v", cfg)
+	}
+
+	if notices, err := config.Migrate(cfg); err != nil || len(notices) != 0 || len(cfg.Rules) != 1 {
+		t.Errorf("Expected migrating again to change nothing, got %q %v %+v", notices, err, cfg.Rules)
+	}
+	current := &config.Config{DefaultBackend: "http://v1"}
+	if notices, err := config.Migrate(current); err != nil || len(notices) != 0 || current.SchemaVersion != config.SchemaVersion {
+		t.Errorf("Expected configurations without a version to be current, got %q %v", notices, err)
+	}
+}
+
+func TestUnsupportedSchemaVersions(t *testing.T) {
+	for name, cfg := range map[string]*config.Config{
+		"Newer version":                  {SchemaVersion: config.SchemaVersion + 1, DefaultBackend: "http://localhost:8080"},
+		"Negative version":               {SchemaVersion: -1, DefaultBackend: "http://localhost:8080"},
+		"Legacy fields in version 2":     {SchemaVersion: 2, DefaultBackend: "http://localhost:8080", V2Backend: "http://localhost:8081"},
+		"Legacy percentage in version 2": {SchemaVersion: 2, DefaultBackend: "http://localhost:8080", V2Percentage: 10},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected the configuration to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func createMigrationConfig(defaultURL, v1URL, v2URL, v3URL string) *config.Config {
+	return &config.Config{
+		DefaultBackend: defaultURL,
+		MetricsPath:    "/_forklift/metrics",
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1URL, Percentage: 30, Experiment: "frontend", Variant: "v1"},
+			{Path: "/", Backend: v2URL, Percentage: 30, Experiment: "frontend", Variant: "v2"},
+			{Path: "/", Backend: v3URL, Percentage: 40, Experiment: "frontend", Variant: "v3"},
+		},
+	}
+}
+
+func TestSessionMigration(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+	v3Server := newMockServer("V3")
+	defer v3Server.close()
+
+	active := createMiddleware(t, createMigrationConfig(defaultServer.URL(), v1Server.URL(), v2Server.URL(), v3Server.URL()))
+
+	ended := createMigrationConfig(defaultServer.URL(), v1Server.URL(), v2Server.URL(), v3Server.URL())
+	ended.Rules[0].Paused = true
+	ended.Rules[0].OnEnd = &config.OnEnd{MigrateTo: "v2"}
+	ended.Rules[2].Paused = true
+	ended.Rules[2].OnEnd = &config.OnEnd{MigrateTo: "default"}
+	middleware := createMiddleware(t, ended)
+
+	serve := func(middleware http.Handler, path, sessionID string) string {
+		req := createTestRequest(t, http.MethodGet, path, nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	previous := make(map[string]int)
+	for i := range 300 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte("migration-session-" + strconv.Itoa(i)))
+		assigned := serve(active, "/", sessionID)
+		previous[assigned]++
+
+		for range 3 {
+			got := serve(middleware, "/", sessionID)
+			switch assigned {
+			case "V1":
+				if got != "V2" {
+					t.Errorf("Expected session from V1 to migrate to V2, got %q", got)
+				}
+			case "V3":
+				if got != "Default Backend" {
+					t.Errorf("Expected session from V3 to migrate to the default backend, got %q", got)
+				}
+			}
+		}
+	}
+
+	metrics := serve(middleware, "/_forklift/metrics", "bWV0cmljcy1zZXNzaW9u")
+	expected := []string{
+		fmt.Sprintf(`forklift_migrations_total{experiment="frontend",from="v1",to="v2"} %d`, previous["V1"]),
+		fmt.Sprintf(`forklift_migrations_total{experiment="frontend",from="v3",to="default"} %d`, previous["V3"]),
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestInvalidSessionMigration(t *testing.T) {
+	cfg := createMigrationConfig("http://localhost:8080", "http://localhost:8081", "http://localhost:8082", "http://localhost:8083")
+	cfg.Rules[0].OnEnd = &config.OnEnd{MigrateTo: "v4"}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for migration to an unknown variant, got nil")
+	}
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// natsMessage is a message published to the fake JetStream server.
+type natsMessage struct {
+	subject string
+	msgID   string
+	data    []byte
+}
+
+// newJetStreamServer accepts NATS connections and acknowledges published messages like a
+// stream would, rejecting the first one to exercise retries.
+func newJetStreamServer(t *testing.T, messages chan<- natsMessage) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		published := 0
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true}\r\n")
+			sid := ""
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					break
+				}
+				fields := strings.Fields(line)
+				switch {
+				case len(fields) == 0:
+				case fields[0] == "PING":
+					fmt.Fprintf(conn, "PONG\r\n")
+				case fields[0] == "SUB":
+					sid = fields[2]
+				case fields[0] == "HPUB" && len(fields) == 5:
+					headerSize, _ := strconv.Atoi(fields[3])
+					total, _ := strconv.Atoi(fields[4])
+					data := make([]byte, total+2)
+					if _, err := io.ReadFull(reader, data); err != nil {
+						break
+					}
+					msgID := ""
+					for _, header := range strings.Split(string(data[:headerSize]), "\r\n") {
+						if name, value, ok := strings.Cut(header, ": "); ok && name == "Nats-Msg-Id" {
+							msgID = value
+						}
+					}
+					published++
+					ack := `{"stream":"EXPOSURES","seq":` + strconv.Itoa(published) + `}`
+					if published == 1 {
+						ack = `{"error":{"code":503,"description":"stream is not ready"}}`
+					} else {
+						messages <- natsMessage{subject: fields[1], msgID: msgID, data: data[headerSize:total]}
+					}
+					fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", fields[2], sid, len(ack), ack)
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+	return listener
+}
+
+func TestNATSExposureSink(t *testing.T) {
+	messages := make(chan natsMessage, 10)
+	server := newJetStreamServer(t, messages)
+	defer server.Close()
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{{
+			Type:          "nats",
+			URL:           "nats://" + server.Addr().String(),
+			Subject:       "exposures.{experiment}.{variant}",
+			FlushInterval: "10ms",
+		}},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2.1"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	sessionID := "bmF0cy1zZXNzaW9u"
+	req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Cookie": sessionCookieName + "=" + sessionID}, nil)
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case message := <-messages:
+		// Dots in values would add subject tokens, so they become underscores.
+		if message.subject != "exposures.checkout.v2_1" {
+			t.Errorf("Expected the rendered subject, got %q", message.subject)
+		}
+		if message.msgID == "" {
+			t.Error("Expected a Nats-Msg-Id header for deduplication")
+		}
+		var exposure map[string]interface{}
+		if err := json.Unmarshal(message.data, &exposure); err != nil || exposure["sessionId"] != sessionID {
+			t.Errorf("Unexpected exposure %s: %v", message.data, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the rejected exposure to be published again")
+	}
+}
+
+func TestNATSSinkRejectsInvalidURL(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		EventSinks:     []config.EventSink{{Type: "nats", URL: "http://localhost:4222"}},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected an http:// URL to be rejected")
+	}
+}
@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const firstSeenCookieName = "forklift_first_seen"
+
+func TestNewSessionsOnly(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	newServer := newMockServer("New Backend")
+	defer newServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:             "/",
+				Backend:          newServer.URL(),
+				NewSessionsOnly:  true,
+				NewSessionWindow: "10m",
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	sessionID := "dGVzdC1zZXNzaW9uLWlkLTEyMzQ1Ng=="
+	testCases := []struct {
+		name         string
+		cookies      []*http.Cookie
+		expectedBody string
+	}{
+		{
+			name:         "Request without session is new",
+			expectedBody: "New Backend",
+		},
+		{
+			name: "Session within window is new",
+			cookies: []*http.Cookie{
+				{Name: sessionCookieName, Value: sessionID},
+				{Name: firstSeenCookieName, Value: strconv.FormatInt(time.Now().Add(-5*time.Minute).Unix(), 10)},
+			},
+			expectedBody: "New Backend",
+		},
+		{
+			name: "Session outside window is returning",
+			cookies: []*http.Cookie{
+				{Name: sessionCookieName, Value: sessionID},
+				{Name: firstSeenCookieName, Value: strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)},
+			},
+			expectedBody: "Default Backend",
+		},
+		{
+			name:         "Session without first-seen time is returning",
+			cookies:      []*http.Cookie{{Name: sessionCookieName, Value: sessionID}},
+			expectedBody: "Default Backend",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+			for _, cookie := range tc.cookies {
+				req.AddCookie(cookie)
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestNewSessionSetsFirstSeenCookie(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+
+	middleware := createMiddleware(t, &config.Config{DefaultBackend: defaultServer.URL()})
+
+	req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name != firstSeenCookieName {
+			continue
+		}
+		seconds, err := strconv.ParseInt(cookie.Value, 10, 64)
+		if err != nil {
+			t.Fatalf("Expected unix timestamp in first-seen cookie, got %q", cookie.Value)
+		}
+		if age := time.Since(time.Unix(seconds, 0)); age < 0 || age > time.Minute {
+			t.Errorf("Expected first-seen time close to now, got %s ago", age)
+		}
+		return
+	}
+	t.Error("Expected first-seen cookie to be set for a new session")
+}
+
+func TestInvalidNewSessionWindow(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: "http://localhost:8081", NewSessionsOnly: true, NewSessionWindow: "soon"},
+		},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for invalid new session window, got nil")
+	}
+}
+
+func TestNewSessionWindowWithInjectedClock(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	newServer := newMockServer("New Backend")
+	defer newServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: newServer.URL(), NewSessionsOnly: true, NewSessionWindow: "10m"},
+		},
+	}
+	middleware := createSeededMiddleware(t, cfg, testSeed)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+
+	req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	cookies := rr.Result().Cookies()
+
+	serve := func() string {
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	now = now.Add(9 * time.Minute)
+	if body := serve(); body != "New Backend" {
+		t.Errorf("Expected session to be new within the window, got %q", body)
+	}
+	now = now.Add(2 * time.Minute)
+	if body := serve(); body != "Default Backend" {
+		t.Errorf("Expected session to be returning after the window, got %q", body)
+	}
+}
@@ -0,0 +1,129 @@
+package tests
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+// newCanaryServer returns a backend that sends 103 Early Hints, reads the uploaded body, and
+// answers with a Grpc-Status trailer. Uploads over maxBody are rejected without being read.
+func newCanaryServer(t *testing.T, maxBody int64, uploads chan<- string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.ContentLength > maxBody {
+			http.Error(rw, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		rw.Header().Set("Link", "</app.css>; rel=preload; as=style")
+		rw.WriteHeader(http.StatusEarlyHints)
+
+		body, _ := io.ReadAll(req.Body)
+		uploads <- string(body)
+
+		rw.Header().Del("Link")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		_, _ = io.WriteString(rw, "Canary")
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestInformationalAndTrailerPassthrough(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	uploads := make(chan string, 1)
+	canary := newCanaryServer(t, 1024, uploads)
+
+	sink := newRecordingSink("passthrough", true)
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		EventSinks: []config.EventSink{
+			{Name: "passthrough", Type: "recording", FlushInterval: "10ms"},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/upload", Method: http.MethodPost, Backend: canary.URL, Percentage: 100, Experiment: "upload", Variant: "canary"},
+		},
+	})
+	proxy := httptest.NewServer(middleware)
+	defer proxy.Close()
+
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 5 * time.Second}}
+	upload := func(body string) (*http.Response, []int) {
+		var mu sync.Mutex
+		var informational []int
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, _ textproto.MIMEHeader) error {
+				mu.Lock()
+				defer mu.Unlock()
+				informational = append(informational, code)
+				return nil
+			},
+		}
+		req, err := http.NewRequest(http.MethodPost, proxy.URL+"/upload", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Expect", "100-continue")
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return resp, informational
+	}
+
+	t.Run("Expect continue", func(t *testing.T) {
+		resp, informational := upload("payload")
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+
+		if resp.StatusCode != http.StatusOK || string(body) != "Canary" {
+			t.Fatalf("Expected the canary to answer, got %d %q", resp.StatusCode, body)
+		}
+		if got := <-uploads; got != "payload" {
+			t.Errorf("Expected the canary to receive the upload, got %q", got)
+		}
+		// The canary sends its Early Hints before it asks for the body.
+		if len(informational) != 2 || informational[0] != http.StatusEarlyHints || informational[1] != http.StatusContinue {
+			t.Errorf("Expected 103 Early Hints and 100 Continue, got %v", informational)
+		}
+		if resp.Header.Get("Link") != "" {
+			t.Errorf("Expected Early Hints headers not to be kept for the final response, got %q", resp.Header.Get("Link"))
+		}
+		if resp.Trailer.Get("Grpc-Status") != "0" {
+			t.Errorf("Expected the Grpc-Status trailer, got %v", resp.Trailer)
+		}
+
+		waitFor(t, func() bool {
+			_, delivered := sink.snapshot()
+			return len(delivered) == 1
+		})
+		if _, delivered := sink.snapshot(); delivered[0].Status != http.StatusOK {
+			t.Errorf("Expected the exposure to record the final status, got %d", delivered[0].Status)
+		}
+	})
+
+	t.Run("Rejected upload", func(t *testing.T) {
+		resp, informational := upload(strings.Repeat("x", 2048))
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected the canary to reject the upload, got %d", resp.StatusCode)
+		}
+		if len(informational) != 0 {
+			t.Errorf("Expected no 100 Continue for a rejected upload, got %v", informational)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newPathServer answers with its name and the escaped path it got.
+func newPathServer(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(name + " " + r.URL.EscapedPath()))
+	}))
+}
+
+func TestPathNormalization(t *testing.T) {
+	defaultServer := newPathServer("Default")
+	defer defaultServer.Close()
+	checkout := newPathServer("Checkout")
+	defer checkout.Close()
+	admin := newPathServer("Admin")
+	defer admin.Close()
+	form := newPathServer("Form")
+	defer form.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend:  defaultServer.URL,
+		PathCaseFolding: true,
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: checkout.URL, Percentage: 100},
+			{PathPrefix: "/admin", Backend: admin.URL, Percentage: 100},
+			{Path: "/submit", Backend: form.URL, Match: "form:plan eq pro"},
+		},
+	})
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/checkout", expected: "Checkout /checkout"},
+		{path: "//checkout", expected: "Checkout //checkout"},
+		{path: "/./checkout", expected: "Checkout /./checkout"},
+		{path: "/%63heckout", expected: "Checkout /%63heckout"},
+		{path: "/Checkout", expected: "Checkout /Checkout"},
+		{path: "/static/../checkout", expected: "Checkout /static/../checkout"},
+		{path: "/static/%2E%2E/checkout", expected: "Checkout /static/%2E%2E/checkout"},
+		// Encoded slashes are part of a segment for backends, so they neither trigger the rule of
+		// /checkout nor escape the rules of /admin.
+		{path: "/Admin%2F..%2Fcheckout", expected: "Admin /Admin%2F..%2Fcheckout"},
+		{path: "/static%2F..%2Fcheckout", expected: "Default /static%2F..%2Fcheckout"},
+		{path: "/ADMIN/users", expected: "Admin /ADMIN/users"},
+		{path: "/checkout/../admin/users", expected: "Admin /checkout/../admin/users"},
+		{path: "/admin/../checkout", expected: "Checkout /admin/../checkout"},
+		{path: "/../../checkout", expected: "Checkout /../../checkout"},
+		{path: "/checkout/", expected: "Default /checkout/"},
+	} {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "http://forklift.test"+tc.path, nil, nil))
+		if body := strings.TrimSpace(rr.Body.String()); body != tc.expected {
+			t.Errorf("Expected %q for %s, got %q", tc.expected, tc.path, body)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodPost, "http://forklift.test//Submit", nil, url.Values{"plan": {"pro"}}))
+	if body := strings.TrimSpace(rr.Body.String()); body != "Form //Submit" {
+		t.Errorf("Expected the form condition to match a normalized path, got %q", body)
+	}
+}
+
+func TestPathPrefixRewriteNormalized(t *testing.T) {
+	defaultServer := newPathServer("Default")
+	defer defaultServer.Close()
+	api := newPathServer("API")
+	defer api.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend:  defaultServer.URL,
+		PathCaseFolding: true,
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/api", PathPrefixRewrite: "/v2", Backend: api.URL, Percentage: 100},
+		},
+	})
+
+	for _, tc := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/api/users", expected: "API /v2/users"},
+		{path: "/API/Users", expected: "API /v2/Users"},
+		{path: "//api/users", expected: "API /v2/users"},
+		{path: "/./Api//users", expected: "API /v2/users"},
+		{path: "/%61pi/a%20b", expected: "API /v2/a%20b"},
+		{path: "/api/a%2Fb", expected: "API /v2/a%2Fb"},
+		{path: "/ap", expected: "Default /ap"},
+	} {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "http://forklift.test"+tc.path, nil, nil))
+		if body := strings.TrimSpace(rr.Body.String()); body != tc.expected {
+			t.Errorf("Expected %q for %s, got %q", tc.expected, tc.path, body)
+		}
+	}
+}
+
+func TestInvalidRulePaths(t *testing.T) {
+	for name, cfg := range map[string]*config.Config{
+		"duplicate slashes": {Rules: []config.RoutingRule{{Path: "/a//b", Backend: "http://a"}}},
+		"dot segments":      {Rules: []config.RoutingRule{{PathPrefix: "/a/../b", Backend: "http://a"}}},
+		"uppercase":         {PathCaseFolding: true, Rules: []config.RoutingRule{{Path: "/Checkout", Backend: "http://a"}}},
+	} {
+		cfg.DefaultBackend = "http://localhost:8080"
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestVariantResponsePolicies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Content-Security-Policy", "default-src *")
+		_, _ = w.Write([]byte("Backend"))
+	}))
+	defer backend.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: backend.URL,
+		Rules: []config.RoutingRule{
+			{
+				Path:    "/api",
+				Method:  http.MethodPut,
+				Backend: backend.URL,
+				Variant: "v1",
+				Conditions: []config.RuleCondition{
+					{Type: "header", Parameter: "X-Frontend", Operator: "eq", Value: "v1"},
+				},
+				ResponsePolicy: &config.ResponsePolicy{
+					CORS: &config.CORSPolicy{AllowOrigins: []string{"https://www.example.com"}},
+				},
+			},
+			{
+				Path:    "/api",
+				Method:  http.MethodPut,
+				Backend: backend.URL,
+				Variant: "v2",
+				ResponsePolicy: &config.ResponsePolicy{
+					CORS: &config.CORSPolicy{
+						AllowOrigins:     []string{"https://app.example.com"},
+						AllowMethods:     []string{"GET", "PUT"},
+						AllowHeaders:     []string{"X-Frontend"},
+						AllowCredentials: true,
+						MaxAge:           600,
+					},
+					ContentSecurityPolicy:   "default-src 'self'",
+					StrictTransportSecurity: "max-age=63072000",
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name           string
+		method         string
+		headers        map[string]string
+		expectedStatus int
+		expectedHeader map[string]string
+	}{
+		{
+			name:           "V1 origin allowed",
+			method:         http.MethodPut,
+			headers:        map[string]string{"X-Frontend": "v1", "Origin": "https://www.example.com"},
+			expectedStatus: http.StatusOK,
+			expectedHeader: map[string]string{
+				"Access-Control-Allow-Origin": "https://www.example.com",
+				"Content-Security-Policy":     "default-src *",
+			},
+		},
+		{
+			name:           "V1 rejects V2 origin",
+			method:         http.MethodPut,
+			headers:        map[string]string{"X-Frontend": "v1", "Origin": "https://app.example.com"},
+			expectedStatus: http.StatusOK,
+			expectedHeader: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:           "V2 origin and security headers",
+			method:         http.MethodPut,
+			headers:        map[string]string{"Origin": "https://app.example.com"},
+			expectedStatus: http.StatusOK,
+			expectedHeader: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Content-Security-Policy":          "default-src 'self'",
+				"Strict-Transport-Security":        "max-age=63072000",
+			},
+		},
+		{
+			name:   "Preflight answered by the middleware",
+			method: http.MethodOptions,
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "PUT",
+			},
+			expectedStatus: http.StatusNoContent,
+			expectedHeader: map[string]string{
+				"Access-Control-Allow-Origin":  "https://app.example.com",
+				"Access-Control-Allow-Methods": "GET, PUT",
+				"Access-Control-Allow-Headers": "X-Frontend",
+				"Access-Control-Max-Age":       "600",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, tc.method, "/api", tc.headers, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			for key, value := range tc.expectedHeader {
+				if got := rr.Header().Get(key); got != value {
+					t.Errorf("Expected header %s=%q, got %q", key, value, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestPostHogFlags(t *testing.T) {
+	events := make(chan map[string]interface{}, 10)
+	posthog := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body struct {
+			APIKey           string                   `json:"api_key"`
+			DistinctID       string                   `json:"distinct_id"`
+			PersonProperties map[string]string        `json:"person_properties"`
+			Batch            []map[string]interface{} `json:"batch"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.APIKey != "phc_project" {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/decide/":
+			variant := "control"
+			if body.PersonProperties["beta"] == "yes" {
+				variant = "test"
+			}
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"featureFlags": map[string]interface{}{"onboarding": variant, "dark-mode": true},
+			})
+		case "/batch/":
+			for _, event := range body.Batch {
+				events <- event
+			}
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer posthog.Close()
+
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	controlServer := newMockServer("Onboarding Control")
+	defer controlServer.close()
+	testServer := newMockServer("Onboarding Test")
+	defer testServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		FlagProviders: []config.FlagProvider{
+			{Name: "posthog", Type: "posthog", URL: posthog.URL, APIKey: "phc_project", SendEvents: true},
+		},
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/onboarding",
+				Flag: &config.FlagRule{
+					Provider:   "posthog",
+					Name:       "onboarding",
+					Key:        "cookie:ph_distinct_id",
+					Treatments: map[string]string{"control": controlServer.URL(), "test": testServer.URL()},
+					Attributes: map[string]string{"beta": "header:X-Beta"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	serve := func(headers map[string]string) string {
+		req := createTestRequest(t, http.MethodGet, "/onboarding", headers, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	if body := serve(map[string]string{"Cookie": "ph_distinct_id=user-1", "X-Beta": "yes"}); body != "Onboarding Test" {
+		t.Errorf("Expected Onboarding Test, got %q", body)
+	}
+	if body := serve(map[string]string{"Cookie": "ph_distinct_id=user-2"}); body != "Onboarding Control" {
+		t.Errorf("Expected Onboarding Control, got %q", body)
+	}
+
+	reported := map[string]string{}
+	timeout := time.After(5 * time.Second)
+	for len(reported) < 2 {
+		select {
+		case event := <-events:
+			if event["event"] != "$feature_flag_called" {
+				t.Fatalf("Expected $feature_flag_called event, got %v", event["event"])
+			}
+			properties, _ := event["properties"].(map[string]interface{})
+			if properties["$feature_flag"] != "onboarding" {
+				t.Errorf("Expected flag onboarding, got %v", properties["$feature_flag"])
+			}
+			distinctID, _ := event["distinct_id"].(string)
+			response, _ := properties["$feature_flag_response"].(string)
+			reported[distinctID] = response
+		case <-timeout:
+			t.Fatalf("Expected 2 events, got %v", reported)
+		}
+	}
+	if reported["user-1"] != "test" || reported["user-2"] != "control" {
+		t.Errorf("Unexpected reported variants: %v", reported)
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestPreloadEarlyHints(t *testing.T) {
+	defaultServer := newMockServer("Control")
+	defer defaultServer.close()
+	treatment := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Add("Link", "</backend.js>; rel=preload; as=script")
+		_, _ = rw.Write([]byte("Treatment"))
+	}))
+	defer treatment.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:    "/treatment",
+				Backend: treatment.URL,
+				Preload: &config.Preload{
+					Links:      []string{"</app.css>; rel=preload; as=style", "<https://cdn.example.com>; rel=preconnect"},
+					EarlyHints: true,
+				},
+			},
+			{Path: "/control", Backend: defaultServer.URL()},
+		},
+	})
+	proxy := httptest.NewServer(middleware)
+	defer proxy.Close()
+
+	get := func(path string) (*http.Response, []textproto.MIMEHeader) {
+		var hints []textproto.MIMEHeader
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				if code == http.StatusEarlyHints {
+					hints = append(hints, header)
+				}
+				return nil
+			},
+		}
+		req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, proxy.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp, hints
+	}
+
+	resp, hints := get("/treatment")
+	if len(hints) != 1 || len(hints[0].Values("Link")) != 2 {
+		t.Fatalf("Expected one 103 Early Hints response with the two links, got %v", hints)
+	}
+	if links := resp.Header.Values("Link"); len(links) != 3 || links[0] != "</app.css>; rel=preload; as=style" {
+		t.Errorf("Expected the preload links before the backend's, got %v", links)
+	}
+
+	resp, hints = get("/control")
+	if len(hints) != 0 || resp.Header.Get("Link") != "" {
+		t.Errorf("Expected no preload for the control, got %v and %v", hints, resp.Header.Values("Link"))
+	}
+}
+
+func TestPreloadWithoutEarlyHints(t *testing.T) {
+	backend := newMockServer("Treatment")
+	defer backend.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: backend.URL(), Preload: &config.Preload{Links: []string{"</app.js>; rel=modulepreload"}}},
+		},
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("Link") != "</app.js>; rel=modulepreload" {
+		t.Errorf("Expected 200 with the preload link, got %d and %v", rr.Code, rr.Header())
+	}
+}
+
+func TestInvalidPreload(t *testing.T) {
+	for _, links := range [][]string{nil, {"/app.css; rel=preload"}} {
+		cfg := &config.Config{
+			DefaultBackend: "http://localhost",
+			Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Preload: &config.Preload{Links: links}}},
+		}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected configuration error for links %v, got nil", links)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func hashIdentity(pepper, id string) string {
+	mac := hmac.New(sha256.New, []byte(pepper))
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestPrivacyScrubsExposureIDs(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	}))
+	defer backend.Close()
+
+	testCases := []struct {
+		name     string
+		idSource string
+		wantID   string
+	}{
+		{name: "Denied header", idSource: "header:X-User-Email", wantID: ""},
+		{name: "Redacted cookie", idSource: "cookie:amp_device_id", wantID: ""},
+		{name: "Kept cookie", idSource: "cookie:theme", wantID: "dark"},
+		{name: "Truncated IPv4", idSource: "header:X-Forwarded-For", wantID: "203.0.113.0"},
+		{name: "Truncated IPv6", idSource: "header:X-Real-IP", wantID: "2001:db8:85a3::"},
+	}
+
+	sinks := make([]config.EventSink, len(testCases))
+	recorded := make([]*recordingSink, len(testCases))
+	for i, tc := range testCases {
+		name := "privacy-" + tc.name
+		recorded[i] = newRecordingSink(name, true)
+		sinks[i] = config.EventSink{Name: name, Type: "recording", FlushInterval: "10ms", IDSource: tc.idSource}
+	}
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		EventSinks:     sinks,
+		Privacy: &config.Privacy{
+			DenyHeaders:   []string{"x-user-email"},
+			RedactCookies: []string{"amp_device_id"},
+			TruncateIPs:   true,
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL, Experiment: "checkout", Variant: "v2"},
+		},
+	})
+
+	req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{
+		"X-User-Email":    "jane@example.com",
+		"X-Forwarded-For": "203.0.113.42",
+		"X-Real-IP":       "2001:db8:85a3:8d3:1319:8a2e:370:7348",
+		"Cookie":          "amp_device_id=device-1234; theme=dark",
+	}, nil)
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Scrubbing applies to logs and exports only, backends receive the request as sent.
+	forwarded := <-received
+	if forwarded.Get("X-User-Email") != "jane@example.com" || forwarded.Get("X-Forwarded-For") != "203.0.113.42" {
+		t.Errorf("Expected the backend to receive unscrubbed headers, got %v", forwarded)
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			waitFor(t, func() bool {
+				_, delivered := recorded[i].snapshot()
+				return len(delivered) == 1
+			})
+			if _, delivered := recorded[i].snapshot(); delivered[0].ID != tc.wantID {
+				t.Errorf("Expected exposure ID %q, got %q", tc.wantID, delivered[0].ID)
+			}
+		})
+	}
+}
+
+func TestPrivacyHashesIdentities(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	fake, dynamodb := newFakeDynamoDB(t)
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	users := newRecordingSink("hashed-users", true)
+	networks := newRecordingSink("hashed-networks", true)
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{
+			{Name: "hashed-users", Type: "recording", FlushInterval: "10ms", IDSource: "header:X-User-ID"},
+			{Name: "hashed-networks", Type: "recording", FlushInterval: "10ms", IDSource: "header:X-Forwarded-For"},
+		},
+		Privacy: &config.Privacy{HashIdentities: true, Pepper: "pepper", TruncateIPs: true, IPv4Prefix: 16},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Percentage: 100, Experiment: "checkout", Variant: "v2"},
+		},
+		SessionStore: &config.SessionStore{
+			Type: "dynamodb", Table: "assignments", Region: "us-east-1", Endpoint: dynamodb.URL,
+		},
+	})
+
+	sessionID := "a2Fma2Etc2Vzc2lvbg=="
+	req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{
+		"X-User-ID":       "user-42",
+		"X-Forwarded-For": "203.0.113.42",
+	}, nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	hashedSession := hashIdentity("pepper", sessionID)
+	fake.mu.Lock()
+	_, stored := fake.items["forklift:"+hashedSession+":/checkout"]
+	for key := range fake.items {
+		if strings.Contains(key, sessionID) {
+			t.Errorf("Expected session store keys without the session ID, got %q", key)
+		}
+	}
+	fake.mu.Unlock()
+	if !stored {
+		t.Error("Expected the assignment to be stored under the hashed session ID")
+	}
+
+	testCases := []struct {
+		name   string
+		sink   *recordingSink
+		wantID string
+	}{
+		{name: "User ID", sink: users, wantID: hashIdentity("pepper", "user-42")},
+		{name: "Truncated IP", sink: networks, wantID: hashIdentity("pepper", "203.0.0.0")},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			waitFor(t, func() bool {
+				_, delivered := tc.sink.snapshot()
+				return len(delivered) == 1
+			})
+			_, delivered := tc.sink.snapshot()
+			if delivered[0].SessionID != hashedSession || delivered[0].ID != tc.wantID {
+				t.Errorf("Expected session %s and ID %s, got %s and %s",
+					hashedSession, tc.wantID, delivered[0].SessionID, delivered[0].ID)
+			}
+		})
+	}
+}
+
+func TestInvalidPrivacy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		privacy *config.Privacy
+	}{
+		{name: "Hashing without pepper", privacy: &config.Privacy{HashIdentities: true}},
+		{name: "IPv4 prefix too long", privacy: &config.Privacy{TruncateIPs: true, IPv4Prefix: 33}},
+		{name: "Negative IPv6 prefix", privacy: &config.Privacy{TruncateIPs: true, IPv6Prefix: -1}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", Privacy: tc.privacy}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newHeaderServer returns a backend answering with the propagated headers it received as JSON.
+func newHeaderServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		headers := make(map[string]string)
+		for _, name := range []string{"X-Forklift-Experiment", "X-Forklift-Variant", "X-Forklift-Bucket", "X-Forklift-Reason", "X-Forklift-Assignment", "X-Forklift-Rules-Version"} {
+			if value := req.Header.Get(name); value != "" {
+				headers[name] = value
+			}
+		}
+		_ = json.NewEncoder(rw).Encode(headers)
+	}))
+}
+
+func TestPropagatedHeaders(t *testing.T) {
+	backend := newHeaderServer()
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL + "/a", Percentage: 50, Experiment: "checkout", Variant: "a"},
+			{Path: "/checkout", Backend: backend.URL + "/b", Percentage: 50, Experiment: "checkout", Variant: "b"},
+			{Path: "/beta", Backend: backend.URL},
+		},
+		Propagation: &config.Propagation{StripClientHeaders: true, ContractPath: "/_forklift/contract"},
+	})
+	serve := func(path string) map[string]string {
+		req := createTestRequest(t, http.MethodGet, path, map[string]string{
+			"X-Forklift-Variant": "spoofed",
+			"X-Forklift-Bucket":  "1",
+		}, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "c2Vzc2lvbi0wMDE="})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		var headers map[string]string
+		if err := json.Unmarshal(rr.Body.Bytes(), &headers); err != nil {
+			t.Fatalf("Expected the headers as JSON, got %v: %s", err, rr.Body.String())
+		}
+		return headers
+	}
+
+	split := serve("/checkout")
+	if split["X-Forklift-Reason"] != "split" || split["X-Forklift-Assignment"] != "rule-match" || split["X-Forklift-Experiment"] != "checkout" {
+		t.Errorf("Expected the split of the checkout experiment, got %v", split)
+	}
+	if variant := split["X-Forklift-Variant"]; variant != "a" && variant != "b" {
+		t.Errorf("Expected the variant of the session, got %q", variant)
+	}
+	bucket, err := strconv.Atoi(split["X-Forklift-Bucket"])
+	if err != nil || bucket < 1 || bucket > 100 {
+		t.Fatalf("Expected a bucket between 1 and 100, got %q", split["X-Forklift-Bucket"])
+	}
+	if expected := map[bool]string{true: "a", false: "b"}[bucket <= 50]; split["X-Forklift-Variant"] != expected {
+		t.Errorf("Expected bucket %d to be in variant %s, got %v", bucket, expected, split)
+	}
+
+	rule := serve("/beta")
+	if rule["X-Forklift-Reason"] != "rule" || rule["X-Forklift-Variant"] != "" || rule["X-Forklift-Bucket"] != "" {
+		t.Errorf("Expected a rule decision without the spoofed headers, got %v", rule)
+	}
+	if unmatched := serve("/other"); unmatched["X-Forklift-Reason"] != "default" || unmatched["X-Forklift-Assignment"] != "fallback-default" {
+		t.Errorf("Expected the default backend, got %v", unmatched)
+	}
+	if version := rule["X-Forklift-Rules-Version"]; len(version) != 12 {
+		t.Errorf("Expected the rules version, got %q", version)
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/contract", nil, nil))
+	var contract struct {
+		Version            int    `json:"version"`
+		RulesVersion       string `json:"rulesVersion"`
+		StripClientHeaders bool   `json:"stripClientHeaders"`
+		Headers            []struct {
+			Name     string `json:"name"`
+			Presence string `json:"presence"`
+		} `json:"headers"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &contract); err != nil {
+		t.Fatalf("Expected the contract as JSON, got %v: %s", err, rr.Body.String())
+	}
+	if contract.Version != 1 || contract.RulesVersion != rule["X-Forklift-Rules-Version"] || !contract.StripClientHeaders || len(contract.Headers) != 6 {
+		t.Errorf("Unexpected contract: %+v", contract)
+	}
+}
+
+func TestPropagatedHeadersWithoutStripping(t *testing.T) {
+	backend := newHeaderServer()
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		Propagation:    &config.Propagation{},
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", map[string]string{
+		"X-Forklift-Experiment": "upstream",
+		"X-Forklift-Reason":     "spoofed",
+	}, nil))
+	var headers map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &headers); err != nil {
+		t.Fatalf("Expected the headers as JSON, got %v: %s", err, rr.Body.String())
+	}
+	if headers["X-Forklift-Reason"] != "default" || headers["X-Forklift-Experiment"] != "upstream" {
+		t.Errorf("Expected the reason replaced and other client headers kept, got %v", headers)
+	}
+}
+
+func TestInvalidPropagation(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost",
+		Propagation:    &config.Propagation{ContractPath: "contract"},
+	}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected configuration error, got nil")
+	}
+}
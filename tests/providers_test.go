@@ -0,0 +1,204 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"gopkg.in/yaml.v3"
+)
+
+const pluginLabelPrefix = "traefik.http.middlewares.forklift.plugin.forklift."
+
+// TestTraefikProviders checks that the examples of each Traefik provider in traefik/ decode to the
+// same configuration, and route alike.
+func TestTraefikProviders(t *testing.T) {
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+	v3Server := newMockServer("V3")
+	defer v3Server.close()
+	backends := strings.NewReplacer(
+		"http://echo1:5678", v1Server.URL(),
+		"http://echo2:5678", v2Server.URL(),
+		"http://echo3:5678", v3Server.URL(),
+		"http://default:5678", v1Server.URL(),
+	)
+	read := func(name string) []byte {
+		data, err := os.ReadFile("../traefik/" + name)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		return []byte(backends.Replace(string(data)))
+	}
+
+	var file struct {
+		HTTP struct {
+			Middlewares map[string]struct {
+				Plugin map[string]config.Config `yaml:"plugin"`
+			} `yaml:"middlewares"`
+		} `yaml:"http"`
+	}
+	if err := yaml.Unmarshal(read("forklift_v3.yml"), &file); err != nil {
+		t.Fatalf("Failed to decode the file provider example: %v", err)
+	}
+	var crd struct {
+		Kind string `yaml:"kind"`
+		Spec struct {
+			Plugin map[string]config.Config `yaml:"plugin"`
+		} `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal(read("kubernetes.yml"), &crd); err != nil || crd.Kind != "Middleware" {
+		t.Fatalf("Failed to decode the Kubernetes example: %v", err)
+	}
+	var compose struct {
+		Labels []string `yaml:"labels"`
+	}
+	if err := yaml.Unmarshal(read("labels.yml"), &compose); err != nil {
+		t.Fatalf("Failed to decode the labels example: %v", err)
+	}
+
+	providers := map[string]config.Config{
+		"file":       file.HTTP.Middlewares["forklift"].Plugin["forklift"],
+		"kubernetes": crd.Spec.Plugin["forklift"],
+		"labels":     decodeLabels(t, compose.Labels),
+	}
+	// All matches are expanded before comparing, as the examples are visited in random order.
+	for name, cfg := range providers {
+		for i := range cfg.Rules {
+			if err := cfg.Rules[i].ExpandMatch(); err != nil {
+				t.Fatalf("Failed to expand the matches of the %s example: %v", name, err)
+			}
+		}
+	}
+	for name, cfg := range providers {
+		if len(cfg.Rules) != 4 || len(cfg.Rules[0].Conditions) != 2 || len(cfg.Rules[1].Conditions) != 2 {
+			t.Fatalf("Expected the %s example to decode all rules and conditions, got %+v", name, cfg.Rules)
+		}
+		if !reflect.DeepEqual(cfg, providers["file"]) {
+			t.Errorf("Expected the %s example to match the file provider:\n%+v\n%+v", name, cfg, providers["file"])
+		}
+	}
+
+	for name, cfg := range providers {
+		t.Run(name, func(t *testing.T) {
+			middleware := createMiddleware(t, &cfg)
+			serve := func(req *http.Request) string {
+				rr := httptest.NewRecorder()
+				middleware.ServeHTTP(rr, req)
+				return strings.TrimSpace(rr.Body.String())
+			}
+
+			beta := createTestRequest(t, http.MethodGet, "/?plan=pro", map[string]string{"X-Beta": "true"}, nil)
+			if body := serve(beta); body != "V3" {
+				t.Errorf("Expected the match to route to V3, got %q", body)
+			}
+			partial := createTestRequest(t, http.MethodGet, "/?plan=free", map[string]string{"X-Beta": "true"}, nil)
+			if body := serve(partial); body != "V1" && body != "V2" {
+				t.Errorf("Expected a partial match to be split, got %q", body)
+			}
+			form := createTestRequest(t, http.MethodPost, "/", nil, url.Values{"MID": {"a"}})
+			form.AddCookie(&http.Cookie{Name: "tier", Value: "gold-plus"})
+			if body := serve(form); body != "V3" {
+				t.Errorf("Expected the conditions to route to V3, got %q", body)
+			}
+		})
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	conditions, err := config.ParseMatch(`header:X-Beta eq true; query:plan eq pro;utm:source contains "a; b "; consent:cookie:consent`)
+	if err != nil {
+		t.Fatalf("Failed to parse the match: %v", err)
+	}
+	expected := []config.RuleCondition{
+		{Type: "header", Parameter: "X-Beta", Operator: "eq", Value: "true"},
+		{Type: "query", QueryParam: "plan", Operator: "eq", Value: "pro"},
+		{Type: "utm", Parameter: "source", Operator: "contains", Value: "a; b "},
+		{Type: "consent", Parameter: "cookie:consent"},
+	}
+	if !reflect.DeepEqual(conditions, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, conditions)
+	}
+
+	for _, match := range []string{`header:X-Beta eq "true`, ":X-Beta eq true", `header:X-Beta eq "a\"`} {
+		cfg := &config.Config{
+			DefaultBackend: "http://localhost:8080",
+			Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Match: match}},
+		}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected match %q to be rejected", match)
+		}
+	}
+}
+
+// decodeLabels decodes the plugin configuration of Docker labels or Consul Catalog tags like
+// Traefik: keys are split at dots into nested objects, indices make lists, and values are typed
+// as the configuration expects.
+func decodeLabels(t *testing.T, labels []string) config.Config {
+	t.Helper()
+	root := map[string]any{}
+	for _, label := range labels {
+		key, value, _ := strings.Cut(label, "=")
+		key, ok := strings.CutPrefix(key, pluginLabelPrefix)
+		if !ok {
+			continue
+		}
+		var typed any
+		if err := yaml.Unmarshal([]byte(value), &typed); err != nil {
+			typed = value
+		}
+		setLabel(t, root, strings.Split(key, "."), typed)
+	}
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		t.Fatalf("Failed to encode the labels: %v", err)
+	}
+	var cfg config.Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		t.Fatalf("Failed to decode the labels: %v", err)
+	}
+	return cfg
+}
+
+func setLabel(t *testing.T, node map[string]any, path []string, value any) {
+	t.Helper()
+	name, index, indexed := strings.Cut(path[0], "[")
+	if !indexed {
+		if len(path) == 1 {
+			node[name] = value
+			return
+		}
+		child, _ := node[name].(map[string]any)
+		if child == nil {
+			child = map[string]any{}
+			node[name] = child
+		}
+		setLabel(t, child, path[1:], value)
+		return
+	}
+
+	i, err := strconv.Atoi(strings.TrimSuffix(index, "]"))
+	if err != nil {
+		t.Fatalf("Invalid label index %s", path[0])
+	}
+	list, _ := node[name].([]any)
+	for len(list) <= i {
+		list = append(list, map[string]any{})
+	}
+	node[name] = list
+	if len(path) == 1 {
+		list[i] = value
+		return
+	}
+	setLabel(t, list[i].(map[string]any), path[1:], value)
+}
@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRedirectBackend(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/shop",
+				Redirect:   &config.Redirect{Location: "https://new.example.com${path}${query}"},
+			},
+			{
+				Path:     "/old",
+				Redirect: &config.Redirect{Status: http.StatusMovedPermanently, Location: "${scheme}://${host}/new"},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name             string
+		path             string
+		expectedStatus   int
+		expectedLocation string
+	}{
+		{
+			name:             "Path and query are expanded",
+			path:             "/shop/cart?item=42",
+			expectedStatus:   http.StatusFound,
+			expectedLocation: "https://new.example.com/shop/cart?item=42",
+		},
+		{
+			name:             "Empty query expands to nothing",
+			path:             "/shop",
+			expectedStatus:   http.StatusFound,
+			expectedLocation: "https://new.example.com/shop",
+		},
+		{
+			name:             "Path is expanded escaped",
+			path:             "/shop/a%3Fb%20c",
+			expectedStatus:   http.StatusFound,
+			expectedLocation: "https://new.example.com/shop/a%3Fb%20c",
+		},
+		{
+			name:             "Scheme and host with explicit status",
+			path:             "http://example.org/old",
+			expectedStatus:   http.StatusMovedPermanently,
+			expectedLocation: "http://example.org/new",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, tc.path, nil, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if location := rr.Header().Get("Location"); location != tc.expectedLocation {
+				t.Errorf("Expected location %q, got %q", tc.expectedLocation, location)
+			}
+		})
+	}
+}
+
+func TestRedirectBackendValidation(t *testing.T) {
+	testCases := []struct {
+		name     string
+		redirect *config.Redirect
+	}{
+		{name: "Missing location", redirect: &config.Redirect{}},
+		{name: "Non-redirect status", redirect: &config.Redirect{Status: http.StatusOK, Location: "/"}},
+	}
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost:8080",
+				Rules:          []config.RoutingRule{{Path: "/", Redirect: tc.redirect}},
+			}
+			if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRegexConditions(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	backend := newMockServer("Matched")
+	defer backend.close()
+
+	newMiddleware := func(conditions []config.RuleCondition, regex *config.Regex) http.Handler {
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: defaultServer.URL(),
+			Rules:          []config.RoutingRule{{Path: "/", Backend: backend.URL(), Conditions: conditions}},
+			Regex:          regex,
+		})
+	}
+	serve := func(middleware http.Handler, path string, headers map[string]string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, headers, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	header := newMiddleware([]config.RuleCondition{
+		{Type: "header", Parameter: "User-Agent", Operator: "regex", Value: `(iphone|ipad) os 1[7-9]_`},
+	}, nil)
+	if got := serve(header, "/", map[string]string{"User-Agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X)"}); got != "Matched" {
+		t.Errorf("Expected the header to match, got %s", got)
+	}
+	if got := serve(header, "/", map[string]string{"User-Agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X)"}); got != "Default" {
+		t.Errorf("Expected the header not to match, got %s", got)
+	}
+
+	query := newMiddleware([]config.RuleCondition{
+		{Type: "query", QueryParam: "sku", Operator: "regex", Value: `^SKU-\d{4}$`},
+	}, &config.Regex{MaxInputLength: 8})
+	if got := serve(query, "/?sku=SKU-1234", nil); got != "Matched" {
+		t.Errorf("Expected the query parameter to match, got %s", got)
+	}
+	if got := serve(query, "/?sku=sku-1234", nil); got != "Default" {
+		t.Errorf("Expected query parameters to be matched case-sensitively, got %s", got)
+	}
+	if got := serve(query, "/?sku=SKU-12345", nil); got != "Default" {
+		t.Errorf("Expected values over the maximum input length not to match, got %s", got)
+	}
+
+	budget := newMiddleware([]config.RuleCondition{
+		{Type: "header", Parameter: "X-Path", Operator: "regex", Value: `^(/[a-z0-9]+)+$`},
+	}, &config.Regex{Budget: "1ns"})
+	if got := serve(budget, "/", map[string]string{"X-Path": strings.Repeat("/segment", 500)}); got != "Default" {
+		t.Errorf("Expected rules over the regex budget not to match, got %s", got)
+	}
+}
+
+func TestInvalidRegex(t *testing.T) {
+	testCases := []struct {
+		name      string
+		condition config.RuleCondition
+		regex     *config.Regex
+	}{
+		{name: "Syntax", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "regex", Value: "(a"}},
+		{name: "Backreference", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "regex", Value: `(a)\1`}},
+		{name: "Lookahead", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "regex", Value: `a(?=b)`}},
+		{name: "Program too large", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "regex", Value: `(a|b){1000}`}},
+		{name: "Over the configured program size", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "regex", Value: `[a-z]+@[a-z]+\.com`},
+			regex: &config.Regex{MaxProgramSize: 5}},
+		{name: "Uppercase header pattern", condition: config.RuleCondition{Type: "header", Parameter: "X-Id", Operator: "regex", Value: `^\D+$`}},
+		{name: "Negative input length", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "eq", Value: "a"},
+			regex: &config.Regex{MaxInputLength: -1}},
+		{name: "Invalid budget", condition: config.RuleCondition{Type: "query", QueryParam: "q", Operator: "eq", Value: "a"},
+			regex: &config.Regex{Budget: "soon"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost:8080",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://a", Conditions: []config.RuleCondition{tc.condition}}},
+				Regex:          tc.regex,
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRequestIDPropagation(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get("X-Request-ID")
+	}))
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{DefaultBackend: backend.URL})
+
+	testCases := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{name: "Generated", incoming: ""},
+		{name: "Propagated", incoming: "req-7f3a9c21", keep: true},
+		{name: "Invalid replaced", incoming: "bad id\"with quotes"},
+		{name: "Too long replaced", incoming: strings.Repeat("a", 201)},
+	}
+
+	seen := make(map[string]bool)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tc.incoming != "" {
+				headers["X-Request-ID"] = tc.incoming
+			}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", headers, nil))
+
+			id := rr.Header().Get("X-Request-ID")
+			if forwarded := <-received; forwarded != id {
+				t.Errorf("Expected backend to receive request ID %q, got %q", id, forwarded)
+			}
+			switch {
+			case tc.keep && id != tc.incoming:
+				t.Errorf("Expected request ID %q to be kept, got %q", tc.incoming, id)
+			case !tc.keep && (id == "" || id == tc.incoming):
+				t.Errorf("Expected a generated request ID, got %q", id)
+			case seen[id]:
+				t.Errorf("Expected unique request IDs, got %q twice", id)
+			}
+			seen[id] = true
+		})
+	}
+}
+
+func TestRequestIDInExposures(t *testing.T) {
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	sink := newRecordingSink("request-id", true)
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{
+			{Name: "request-id", Type: "recording", FlushInterval: "10ms"},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	})
+
+	req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"X-Request-ID": "req-checkout-1"}, nil)
+	middleware.ServeHTTP(httptest.NewRecorder(), req)
+
+	waitFor(t, func() bool {
+		_, delivered := sink.snapshot()
+		return len(delivered) == 1
+	})
+	if _, delivered := sink.snapshot(); delivered[0].RequestID != "req-checkout-1" {
+		t.Errorf("Expected exposure with request ID req-checkout-1, got %q", delivered[0].RequestID)
+	}
+}
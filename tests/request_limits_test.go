@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestRequestLimits(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	newServer := newMockServer("New")
+	defer newServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/metrics",
+		RequestLimits:  &config.RequestLimits{MaxHeaders: 5, MaxHeaderBytes: 256},
+		Rules:          []config.RoutingRule{{Path: "/", Backend: newServer.URL(), Percentage: 100}},
+	})
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := serve(createTestRequest(t, http.MethodGet, "/", map[string]string{"X-A": "1"}, nil)); strings.TrimSpace(rr.Body.String()) != "New" {
+		t.Errorf("Expected a request within the limits to be routed by the rules, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	for name, tc := range map[string]struct {
+		req    func() *http.Request
+		status int
+	}{
+		"too many headers": {status: http.StatusRequestHeaderFieldsTooLarge, req: func() *http.Request {
+			req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+			for i := range 6 {
+				req.Header.Add("X-Header", fmt.Sprint(i))
+			}
+			return req
+		}},
+		"too large headers": {status: http.StatusRequestHeaderFieldsTooLarge, req: func() *http.Request {
+			return createTestRequest(t, http.MethodGet, "/", map[string]string{"X-Large": strings.Repeat("a", 300)}, nil)
+		}},
+		"invalid header value": {status: http.StatusBadRequest, req: func() *http.Request {
+			req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+			req.Header["X-Split"] = []string{"a\r\nX-Forklift-Variant: b"}
+			return req
+		}},
+		"invalid header name": {status: http.StatusBadRequest, req: func() *http.Request {
+			req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+			req.Header["X Space"] = []string{"a"}
+			return req
+		}},
+		"forbidden trailer": {status: http.StatusBadRequest, req: func() *http.Request {
+			req := createTestRequest(t, http.MethodPost, "/", nil, nil)
+			req.Trailer = http.Header{"Cookie": nil}
+			return req
+		}},
+		"propagated trailer": {status: http.StatusBadRequest, req: func() *http.Request {
+			req := createTestRequest(t, http.MethodPost, "/", nil, nil)
+			req.Header.Set("Trailer", "X-Checksum, X-Forklift-Variant")
+			return req
+		}},
+	} {
+		if rr := serve(tc.req()); rr.Code != tc.status {
+			t.Errorf("Expected status %d for %s, got %d", tc.status, name, rr.Code)
+		}
+	}
+
+	metrics := serve(createTestRequest(t, http.MethodGet, "/metrics", nil, nil)).Body.String()
+	for _, line := range []string{
+		`forklift_limited_requests_total{problem="header_count",action="reject"} 1`,
+		`forklift_limited_requests_total{problem="invalid_trailer",action="reject"} 2`,
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestRequestLimitsBypass(t *testing.T) {
+	defaultServer := newHeaderServer()
+	defer defaultServer.Close()
+	newServer := newMockServer("New")
+	defer newServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL,
+		Propagation:    &config.Propagation{},
+		RequestLimits:  &config.RequestLimits{MaxHeaders: 2, Action: "bypass"},
+		Rules:          []config.RoutingRule{{Path: "/", Backend: newServer.URL(), Percentage: 100}},
+	})
+	req := createTestRequest(t, http.MethodGet, "/", map[string]string{"X-A": "1", "X-B": "2", "X-C": "3"}, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	if body := rr.Body.String(); !strings.Contains(body, `"X-Forklift-Reason":"limited"`) {
+		t.Errorf("Expected the request to bypass the rules to the default backend, got %d %q", rr.Code, body)
+	}
+}
+
+func TestInvalidRequestLimits(t *testing.T) {
+	for name, limits := range map[string]*config.RequestLimits{
+		"negative headers": {MaxHeaders: -1},
+		"negative bytes":   {MaxHeaderBytes: -1},
+		"action":           {Action: "drop"},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost:8080", RequestLimits: limits}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
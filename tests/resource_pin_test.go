@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const downloadSize = 8 << 20
+
+// newDownloadServer serves a large file with ranges, an ETag and a modification time. The
+// content differs per variant.
+func newDownloadServer(t *testing.T, variant byte, modified time.Time) (*httptest.Server, []byte) {
+	t.Helper()
+	content := bytes.Repeat([]byte{variant}, downloadSize)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("ETag", fmt.Sprintf(`"release-%c"`, variant))
+		http.ServeContent(rw, req, "release.tar", modified, bytes.NewReader(content))
+	}))
+	t.Cleanup(server.Close)
+	return server, content
+}
+
+func TestResourcePins(t *testing.T) {
+	modified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	stable, _ := newDownloadServer(t, 's', modified.Add(time.Hour))
+	canary, canaryContent := newDownloadServer(t, 'c', modified)
+
+	newMiddleware := func(ttl string) http.Handler {
+		// Sessions are in the canary while they send X-Canary, so dropping the header switches
+		// a session to the stable variant mid-download.
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: stable.URL,
+			ResourcePinTTL: ttl,
+			Rules: []config.RoutingRule{
+				{
+					Path:       "/release.tar",
+					Backend:    canary.URL,
+					Experiment: "release",
+					Variant:    "canary",
+					Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Canary", Operator: "eq", Value: "true"}},
+				},
+			},
+			AdminAPI: &config.AdminAPI{Path: "/_forklift/admin", Token: "s3cret", UI: true},
+		})
+	}
+
+	sessionID := "a2Fma2Etc2Vzc2lvbg=="
+	serve := func(middleware http.Handler, headers map[string]string) *httptest.ResponseRecorder {
+		req := createTestRequest(t, http.MethodGet, "/release.tar", headers, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// download starts in the canary and resumes in 1 MiB ranges after the switch.
+	download := func(middleware http.Handler) ([]byte, string) {
+		first := serve(middleware, map[string]string{"X-Canary": "true", "Range": "bytes=0-1048575"})
+		if first.Code != http.StatusPartialContent {
+			t.Fatalf("Expected 206 for the first range, got %d", first.Code)
+		}
+		etag := first.Header().Get("ETag")
+		got := append([]byte(nil), first.Body.Bytes()...)
+		for offset := 1 << 20; offset < downloadSize; offset += 1 << 20 {
+			rr := serve(middleware, map[string]string{
+				"Range":    fmt.Sprintf("bytes=%d-%d", offset, offset+1<<20-1),
+				"If-Range": etag,
+			})
+			body, _ := io.ReadAll(rr.Body)
+			if rr.Code == http.StatusOK {
+				// The validator didn't match, so the whole representation was sent.
+				return body, etag
+			}
+			got = append(got, body...)
+		}
+		return got, etag
+	}
+
+	t.Run("Pinned download", func(t *testing.T) {
+		middleware := newMiddleware("1h")
+		got, etag := download(middleware)
+		if !bytes.Equal(got, canaryContent) {
+			t.Errorf("Expected the download to be completed by the canary, got %d bytes starting %q", len(got), got[:1])
+		}
+
+		if rr := serve(middleware, map[string]string{"If-None-Match": etag}); rr.Code != http.StatusNotModified {
+			t.Errorf("Expected the canary to validate its ETag, got %d", rr.Code)
+		}
+		since := modified.Add(30 * time.Minute).Format(http.TimeFormat)
+		if rr := serve(middleware, map[string]string{"If-Modified-Since": since}); rr.Code != http.StatusNotModified {
+			t.Errorf("Expected the canary to validate its modification time, got %d", rr.Code)
+		}
+		if rr := serve(middleware, nil); rr.Body.Bytes()[0] != 's' {
+			t.Errorf("Expected unconditional requests to follow the switch, got %q", rr.Body.Bytes()[:1])
+		}
+	})
+
+	t.Run("Pins disabled", func(t *testing.T) {
+		for _, ttl := range []string{"", "0s"} {
+			got, _ := download(newMiddleware(ttl))
+			if len(got) != downloadSize || got[0] != 's' {
+				t.Errorf("Expected the stable variant to resend the whole file after the switch with ttl %q, got %d bytes starting %q", ttl, len(got), got[:1])
+			}
+		}
+	})
+
+	t.Run("Pins dropped with their rule", func(t *testing.T) {
+		middleware := newMiddleware("1h")
+		first := serve(middleware, map[string]string{"X-Canary": "true", "Range": "bytes=0-1048575"})
+		if first.Code != http.StatusPartialContent {
+			t.Fatalf("Expected 206 for the first range, got %d", first.Code)
+		}
+		if rr := callAdmin(t, middleware, http.MethodPost, "/_forklift/admin/experiments/release/pause", ""); rr.Code != http.StatusOK {
+			t.Fatalf("Expected the experiment to be paused, got %d: %s", rr.Code, rr.Body.String())
+		}
+		rr := serve(middleware, map[string]string{"Range": "bytes=1048576-2097151", "If-Range": first.Header().Get("ETag")})
+		if rr.Code != http.StatusOK || rr.Body.Bytes()[0] != 's' {
+			t.Errorf("Expected the stable variant to resend the whole file once the canary is paused, got %d starting %q", rr.Code, rr.Body.Bytes()[:1])
+		}
+	})
+}
+
+func TestInvalidResourcePinTTL(t *testing.T) {
+	cfg := &config.Config{DefaultBackend: "http://localhost", ResourcePinTTL: "-1h"}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected configuration error, got nil")
+	}
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func checkoutExperimentConfig(backend string, export *config.ResultsExport) *config.Config {
+	return &config.Config{
+		DefaultBackend: backend,
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/checkout",
+				Backend:    backend,
+				Priority:   2,
+				Experiment: "checkout",
+				Variant:    "b",
+				Conditions: []config.RuleCondition{{Type: "header", Parameter: "X-Variant", Operator: "eq", Value: "b"}},
+			},
+			{Path: "/checkout", Backend: backend, Priority: 1, Experiment: "checkout", Variant: "a"},
+		},
+		ResultsExport: export,
+	}
+}
+
+func TestResultsExportCSV(t *testing.T) {
+	backend := newMockServer("Backend")
+	defer backend.close()
+	dir := t.TempDir()
+
+	middleware := createMiddleware(t, checkoutExperimentConfig(backend.URL(), &config.ResultsExport{
+		Destination: dir,
+		Goals:       []config.Goal{{Name: "purchase", Path: "/checkout/complete", Method: http.MethodPost}},
+	}))
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return start })
+	serve := func(session, method, path string, headers map[string]string) {
+		req := createTestRequest(t, method, path, headers, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(session))})
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("session-1", http.MethodGet, "/checkout", nil)
+	serve("session-1", http.MethodGet, "/checkout", nil)
+	serve("session-1", http.MethodPost, "/checkout/complete", nil)
+	serve("session-2", http.MethodGet, "/checkout", map[string]string{"X-Variant": "b"})
+	serve("session-2", http.MethodPost, "/checkout/complete", nil)
+	serve("session-2", http.MethodPost, "/checkout/complete", nil)
+	// Neither exposed sessions nor other methods convert.
+	serve("session-3", http.MethodPost, "/checkout/complete", nil)
+	serve("session-1", http.MethodGet, "/checkout/complete", nil)
+
+	if err := middleware.(*forklift.Forklift).Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "checkout", "*.csv"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("Expected one results file for the experiment, got %v", files)
+	}
+	file, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"period_start", "period_end", "experiment", "variant", "goal", "exposures", "sessions", "errors", "conversions", "converted_sessions"},
+		{"checkout", "a", "purchase", "2", "1", "0", "1", "1"},
+		{"checkout", "b", "purchase", "1", "1", "0", "2", "1"},
+	}
+	if len(records) != len(expected) || strings.Join(records[0], ",") != strings.Join(expected[0], ",") {
+		t.Fatalf("Unexpected results: %v", records)
+	}
+	for i, record := range records[1:] {
+		if got := strings.Join(record[2:], ","); got != strings.Join(expected[i+1], ",") {
+			t.Errorf("Expected row %v, got %v", expected[i+1], record)
+		}
+		if record[0] != "2024-03-01T12:00:00Z" || record[1] != "2024-03-01T12:00:00Z" {
+			t.Errorf("Expected the period to follow the clock of the middleware, got %v", record[:2])
+		}
+	}
+}
+
+func TestResultsExportParquetToS3(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	backend := newMockServer("Backend")
+	defer backend.close()
+
+	var mu sync.Mutex
+	uploads := make(map[string][]byte)
+	s3 := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut || !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			http.Error(rw, "Forbidden", http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		uploads[req.URL.Path] = body
+		mu.Unlock()
+	}))
+	defer s3.Close()
+
+	middleware := createMiddleware(t, checkoutExperimentConfig(backend.URL(), &config.ResultsExport{
+		Destination: "s3://results/forklift",
+		Endpoint:    s3.URL,
+		Format:      "parquet",
+		Interval:    "20ms",
+	}))
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/checkout", nil, nil))
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(uploads) > 0
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	for path, body := range uploads {
+		if !strings.HasPrefix(path, "/results/forklift/checkout/") || !strings.HasSuffix(path, ".parquet") {
+			t.Errorf("Unexpected object path %s", path)
+		}
+		if len(body) < 12 || string(body[:4]) != "PAR1" || string(body[len(body)-4:]) != "PAR1" {
+			t.Errorf("Expected a Parquet file, got %q", body)
+		}
+		if !strings.Contains(string(body), "period_start") || !strings.Contains(string(body), "checkout") {
+			t.Errorf("Expected the schema and the experiment in the file")
+		}
+	}
+}
+
+func TestInvalidResultsExport(t *testing.T) {
+	testCases := []struct {
+		name   string
+		export *config.ResultsExport
+	}{
+		{name: "Without destination", export: &config.ResultsExport{}},
+		{name: "Unsupported destination", export: &config.ResultsExport{Destination: "gs://results"}},
+		{name: "Unknown format", export: &config.ResultsExport{Destination: "/tmp/results", Format: "avro"}},
+		{name: "Invalid interval", export: &config.ResultsExport{Destination: "/tmp/results", Interval: "hourly"}},
+		{name: "Goal without path", export: &config.ResultsExport{Destination: "/tmp/results", Goals: []config.Goal{{Name: "purchase"}}}},
+		{name: "Duplicate goal", export: &config.ResultsExport{Destination: "/tmp/results", Goals: []config.Goal{
+			{Name: "purchase", Path: "/a"}, {Name: "purchase", Path: "/b"},
+		}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", ResultsExport: tc.export}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift/config"
+)
+
+func TestVariantRequestMetrics(t *testing.T) {
+	okServer := newMockServer("OK")
+	defer okServer.close()
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failingServer.Close()
+
+	cfg := &config.Config{
+		DefaultBackend: okServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: okServer.URL(), Experiment: "checkout", Variant: "v1"},
+			{Path: "/broken", Backend: failingServer.URL, Experiment: "checkout", Variant: "v2"},
+			{Path: "/plain", Method: http.MethodGet, Backend: okServer.URL()},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	requests := map[string]int{"/checkout": 4, "/broken": 2, "/plain": 3}
+	for path, count := range requests {
+		for range count {
+			req := createTestRequest(t, http.MethodGet, path, nil, nil)
+			middleware.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+
+	req := createTestRequest(t, http.MethodGet, "/_forklift/metrics", nil, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	body := rr.Body.String()
+
+	expected := []string{
+		`forklift_variant_requests_total{experiment="checkout",variant="v1",code="2xx"} 4`,
+		`forklift_variant_requests_total{experiment="checkout",variant="v2",code="5xx"} 2`,
+		`forklift_variant_request_duration_seconds_bucket{experiment="checkout",variant="v1",le="+Inf"} 4`,
+		`forklift_variant_request_duration_seconds_count{experiment="checkout",variant="v2"} 2`,
+		`forklift_rule_in_flight{rule="checkout/v1"} 0`,
+		`forklift_rule_in_flight{rule="GET /plain -> ` + okServer.URL() + `"} 0`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `variant="`+okServer.URL()) {
+		t.Errorf("Expected rules without an experiment to have no variant metrics, got:\n%s", body)
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	okServer := newMockServer("OK")
+	defer okServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: okServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		MetricsLabels:  &config.MetricsLabels{RulePaths: "hash", MaxRules: 3, MinVariantPercentage: 10},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: okServer.URL() + "/a", Percentage: 95, Experiment: "checkout", Variant: "v1", Priority: 1},
+			{Path: "/checkout", Backend: okServer.URL() + "/b", Percentage: 5, Experiment: "checkout", Variant: "v2", Priority: 1},
+			{Path: "/plain", Method: http.MethodGet, Backend: okServer.URL(), Priority: 1},
+			{Path: "/extra", Backend: okServer.URL()},
+		},
+	})
+	for _, path := range []string{"/plain", "/extra"} {
+		middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, path, nil, nil))
+	}
+	// Sessions are split 95/5, so enough of them reach v2.
+	for range 200 {
+		middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/checkout", nil, nil))
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/metrics", nil, nil))
+	body := rr.Body.String()
+	for _, line := range []string{
+		`forklift_variant_requests_total{experiment="checkout",variant="v1",code="2xx"}`,
+		`forklift_variant_requests_total{experiment="checkout",variant="other",code="2xx"}`,
+		`forklift_rule_in_flight{rule="checkout/other"} 0`,
+		`forklift_rule_in_flight{rule="other"} 0`,
+		`forklift_rule_in_flight{rule="GET `,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", line, body)
+		}
+	}
+	for _, label := range []string{`variant="v2"`, `/plain`, `/extra`} {
+		if strings.Contains(body, label) {
+			t.Errorf("Expected no %s label in the metrics, got:\n%s", label, body)
+		}
+	}
+}
+
+func TestVariantLatencyExemplars(t *testing.T) {
+	okServer := newMockServer("OK")
+	defer okServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: okServer.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		Rules: []config.RoutingRule{
+			{Path: "/sampled", Backend: okServer.URL(), Experiment: "checkout", Variant: "v1"},
+			{Path: "/unsampled", Backend: okServer.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	})
+	for path, traceparent := range map[string]string{
+		"/sampled":   "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"/unsampled": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00",
+	} {
+		req := createTestRequest(t, http.MethodGet, path, map[string]string{"Traceparent": traceparent}, nil)
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	scrape := func(accept string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/metrics", map[string]string{"Accept": accept}, nil))
+		return rr
+	}
+
+	rr := scrape("application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("Expected OpenMetrics, got %q", contentType)
+	}
+	body := rr.Body.String()
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Expected OpenMetrics to end with # EOF, got:\n%s", body)
+	}
+	if !strings.Contains(body, "# TYPE forklift_variant_requests counter\n") {
+		t.Errorf("Expected counter families to be named without _total, got:\n%s", body)
+	}
+	var sampled, unsampled int
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, "forklift_variant_request_duration_seconds_bucket") || !strings.Contains(line, " # ") {
+			continue
+		}
+		switch {
+		case strings.Contains(line, `variant="v1"`) && strings.Contains(line, `# {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} `):
+			sampled++
+		case strings.Contains(line, `variant="v2"`):
+			unsampled++
+		}
+	}
+	if sampled != 1 || unsampled != 0 {
+		t.Errorf("Expected one exemplar for the sampled trace and none for the unsampled one, got %d and %d:\n%s", sampled, unsampled, body)
+	}
+
+	if body := scrape("").Body.String(); strings.Contains(body, "trace_id") || strings.Contains(body, "# EOF") {
+		t.Errorf("Expected the text format to have no exemplars, got:\n%s", body)
+	}
+}
@@ -0,0 +1,263 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	_ "github.com/daemonp/forklift/luascript"
+)
+
+func TestScriptLanguage(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected string
+	}{
+		{name: "Arithmetic", source: `return 1 + 2 * 3 ^ 2 % 5 - -2`, expected: "6"},
+		{name: "Concatenation", source: `return "n=" .. 1.5 .. "/" .. 10 / 2`, expected: "n=1.5/5"},
+		{name: "Logic", source: `return (nil or "a") .. tostring(false and 1) .. tostring(not nil)`, expected: "afalsetrue"},
+		{name: "Closures", source: `
+			local function counter()
+				local n = 0
+				return function() n = n + 1; return n end
+			end
+			local c = counter(); c(); c()
+			return c()`, expected: "3"},
+		{name: "Recursion", source: `
+			local function fib(n) if n < 2 then return n end return fib(n - 1) + fib(n - 2) end
+			return fib(15)`, expected: "610"},
+		{name: "Loops", source: `
+			local sum = 0
+			for i = 10, 1, -2 do sum = sum + i end
+			local t = {}
+			for _, v in ipairs({3, 4, 5}) do t[#t + 1] = v end
+			local j = 0
+			while true do j = j + 1; if j == 4 then break end end
+			repeat j = j + 1 until j >= 6
+			return sum .. ":" .. table.concat(t, ",") .. ":" .. j`, expected: "30:3,4,5:6"},
+		{name: "Tables", source: `
+			local t = {a = 1, ["b c"] = 2, 10, 20; 30}
+			t.a = nil
+			local keys = {}
+			for k, v in pairs(t) do keys[#keys + 1] = k .. "=" .. v end
+			table.insert(t, 1, 5)
+			return table.concat(keys, " ") .. " " .. #t .. " " .. table.remove(t)`, expected: "1=10 2=20 3=30 b c=2 4 30"},
+		{name: "Methods", source: `
+			local account = {balance = 10}
+			function account:deposit(n) self.balance = self.balance + n end
+			account:deposit(5)
+			return ("%d-%s"):format(account.balance, ("Forklift"):upper():sub(1, 4))`, expected: "15-FORK"},
+		{name: "Multiple results", source: `
+			local function pair() return 1, 2 end
+			local a, b, c = pair()
+			local t = {pair(), pair()}
+			return a + b + #t + select("#", pair()) + tostring(c):len()`, expected: "11"},
+		{name: "String find", source: `
+			local s = "tenant=acme; plan=pro"
+			local i, j, tenant = s:find("tenant=(%w+)")
+			return i .. j .. tenant .. tostring(s:find(".", 1, true)) .. s:find("plan")`, expected: "111acmenil14"},
+		{name: "String match", source: `
+			local key, value = string.match("  X-Tenant: acme  ", "^%s*([%w-]+):%s*(.-)%s*$")
+			return key .. "|" .. value .. "|" .. string.match("[[a]]", "%b[]") .. "|" .. tostring(string.match("abc", "()b()"))`,
+			expected: "X-Tenant|acme|[[a]]|2"},
+		{name: "String gsub", source: `
+			local s, n = string.gsub("hello world", "(o)", "%1%1")
+			local t = string.gsub("$name is $role", "%$(%w+)", {name = "ada", role = "admin"})
+			local u = string.gsub("a,b,,c", "[^,]+", function(w) return w:upper() end)
+			return s .. n .. "|" .. t .. "|" .. u .. "|" .. string.gsub("aaa", "^a", "b")`,
+			expected: "helloo woorld2|ada is admin|A,B,,C|baa"},
+		{name: "String gmatch", source: `
+			local words = {}
+			for k, v in string.gmatch("a=1, b=2", "(%w+)=(%w+)") do words[#words + 1] = k .. v end
+			return table.concat(words, ";")`, expected: "a1;b2"},
+		{name: "String format", source: `return string.format("[%5.2f]|%-4s|%03d|%x|%q|%%", 3.14159, "ab", 7, 255, 'a"b')`,
+			expected: `[ 3.14]|ab  |007|ff|"a\"b"|%`},
+		{name: "Conversions", source: `return tonumber("0x1F") + tonumber("  2.5 ") + tonumber("z", 36) + (tonumber("1e") or 0)`, expected: "68.5"},
+		{name: "Long strings", source: "--[[ a comment ]] return [==[\nline]]\n]==] .. '\\65\\t'", expected: `line]]\10A\9`},
+		{name: "Math", source: `return math.floor(-2.5) + math.ceil(2.1) + math.max(1, 7, 3) + math.min(4, -1) + math.abs(-2)`, expected: "8"},
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Result"))
+	}))
+	defer backend.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The result is forwarded in a header, with control characters escaped.
+			source := "local function f()\n" + tt.source + "\nend\n" + `
+				function headers(request, headers)
+					headers["X-Result"] = (tostring(f()):gsub("%c", function(c) return "\\" .. c:byte() end))
+				end`
+			middleware := createMiddleware(t, &config.Config{
+				DefaultBackend: backend.URL,
+				Script:         &config.Script{Source: source},
+			})
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+			if result := rr.Body.String(); result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	backend := newMockServer("beta")
+	defer backend.close()
+
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{name: "Index nil", source: "local t\nreturn t.x"},
+		{name: "Arithmetic on a table", source: "return {} + 1"},
+		{name: "Error", source: `error("no tenant")`},
+		{name: "Bad argument", source: `return ("x"):rep({})`},
+		{name: "Malformed pattern", source: `return ("x"):find("[a")`},
+		{name: "String too large", source: `return ("x"):rep(1e7)`},
+		{name: "Runaway loop", source: "while true do end"},
+		{name: "Runaway recursion", source: "local function f() return f() + 1 end\nreturn f()"},
+		{name: "No io", source: `return io.open("/etc/hostname") == nil`},
+		{name: "No os", source: `os.exit(1)`},
+		{name: "No dofile", source: `dofile("/etc/hostname")`},
+		{name: "No require", source: `require("os")`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			middleware := createMiddleware(t, &config.Config{
+				DefaultBackend: "http://localhost:1",
+				MetricsPath:    "/metrics",
+				Rules:          []config.RoutingRule{{PathPrefix: "/", Backend: backend.URL()}},
+				Script:         &config.Script{Source: "function match(request, rule)\n(function()\n" + tt.source + "\nend)()\nreturn false\nend"},
+			})
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+			if body := strings.TrimSpace(rr.Body.String()); body != "beta" {
+				t.Errorf("Expected the failing script not to veto the rule, got %s", body)
+			}
+			rr = httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/metrics", nil, nil))
+			if line := `forklift_script_errors_total{function="match"} 1`; !strings.Contains(rr.Body.String(), line) {
+				t.Errorf("Expected %s in the metrics, got:\n%s", line, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestScriptHooks(t *testing.T) {
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "beta tenant=%s internal=%s", r.Header.Get("X-Tenant-Routed"), r.Header.Get("X-Internal"))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hooks.lua")
+	source := `
+		local tenants = {acme = true, globex = true}
+
+		function identity(request)
+			return request.headers["X-Tenant"]
+		end
+
+		function headers(request, headers, backend)
+			headers["X-Internal"] = nil
+			headers["X-Tenant-Routed"] = request.headers["X-Tenant"] or "none"
+		end
+
+		function match(request, rule)
+			if rule.experiment == "beta" then
+				return tenants[request.headers["X-Tenant"] or ""] == true
+			end
+		end
+	`
+	if err := os.WriteFile(path, []byte(source), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/", Backend: backend.URL, Experiment: "beta", Variant: "on"},
+		},
+		Script: &config.Script{File: path},
+	})
+
+	serve := func(tenant string) *httptest.ResponseRecorder {
+		headers := map[string]string{"X-Internal": "secret"}
+		if tenant != "" {
+			headers["X-Tenant"] = tenant
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", headers, nil))
+		return rr
+	}
+
+	rr := serve("acme")
+	if body := strings.TrimSpace(rr.Body.String()); body != "beta tenant=acme internal=" {
+		t.Errorf("Expected the beta backend with rewritten headers, got %s", body)
+	}
+	if cookies := rr.Header().Values("Set-Cookie"); len(cookies) > 0 {
+		t.Errorf("Expected no session cookie for a tenant identified by the script, got %v", cookies)
+	}
+	if body := strings.TrimSpace(serve("initech").Body.String()); body != "default" {
+		t.Errorf("Expected the script to veto the beta rule, got %s", body)
+	}
+	rr = serve("")
+	if body := strings.TrimSpace(rr.Body.String()); body != "default" {
+		t.Errorf("Expected the default backend without a tenant, got %s", body)
+	}
+	if len(rr.Header().Values("Set-Cookie")) == 0 {
+		t.Error("Expected a session cookie without an identity")
+	}
+}
+
+func TestScriptFailureFallsBack(t *testing.T) {
+	backend := newMockServer("beta")
+	defer backend.close()
+	defaultServer := newMockServer("default")
+	defer defaultServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules:          []config.RoutingRule{{PathPrefix: "/", Backend: backend.URL()}},
+		Script:         &config.Script{Source: "function match(request, rule) while true do end end", Timeout: "5ms"},
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if body := strings.TrimSpace(rr.Body.String()); body != "beta" {
+		t.Errorf("Expected a failing script not to veto the rule, got %s", body)
+	}
+}
+
+func TestInvalidScript(t *testing.T) {
+	testCases := []struct {
+		name   string
+		script *config.Script
+	}{
+		{name: "Without source", script: &config.Script{}},
+		{name: "Source and file", script: &config.Script{Source: "function match() end", File: "hooks.lua"}},
+		{name: "Missing file", script: &config.Script{File: filepath.Join(t.TempDir(), "missing.lua")}},
+		{name: "Syntax error", script: &config.Script{Source: "function match("}},
+		{name: "No hooks", script: &config.Script{Source: "local x = 1"}},
+		{name: "Failing chunk", script: &config.Script{Source: "error('boom')"}},
+		{name: "Negative timeout", script: &config.Script{Source: "function match() end", Timeout: "-1s"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost:8080", Script: tc.script}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+)
+
+type segmentTrack struct {
+	Type        string                 `json:"type"`
+	Event       string                 `json:"event"`
+	AnonymousID string                 `json:"anonymousId"`
+	MessageID   string                 `json:"messageId"`
+	Properties  map[string]interface{} `json:"properties"`
+}
+
+func TestSegmentExposureSink(t *testing.T) {
+	var attempts int64
+	tracks := make(chan segmentTrack, 10)
+	segment := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if writeKey, _, ok := req.BasicAuth(); !ok || writeKey != "write-key" || req.URL.Path != "/v1/batch" {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		// Fail the first attempt to exercise retries.
+		if atomic.AddInt64(&attempts, 1) == 1 {
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var body struct {
+			Batch []segmentTrack `json:"batch"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+		for _, track := range body.Batch {
+			tracks <- track
+		}
+	}))
+	defer segment.Close()
+
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	cfg := &config.Config{
+		DefaultBackend: backend.URL(),
+		MetricsPath:    "/_forklift/metrics",
+		EventSinks: []config.EventSink{
+			{Type: "segment", URL: segment.URL, APIKey: "write-key", BatchSize: 2, FlushInterval: "50ms"},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	sessionID := "c2VnbWVudC1zZXNzaW9u"
+	for range 2 {
+		req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Cookie": sessionCookieName + "=" + sessionID}, nil)
+		middleware.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for i := range 2 {
+		select {
+		case track := <-tracks:
+			if track.Type != "track" || track.Event != "Experiment Viewed" || track.AnonymousID != sessionID || track.MessageID == "" {
+				t.Errorf("Unexpected track call: %+v", track)
+			}
+			if track.Properties["experiment_name"] != "checkout" || track.Properties["variation_name"] != "v2" {
+				t.Errorf("Unexpected track properties: %v", track.Properties)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 track calls, got %d", i)
+		}
+	}
+
+	serve := func(path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return rr.Body.String()
+	}
+	waitForMetric(t, serve, `forklift_events_sent_total{sink="segment"} 2`)
+}
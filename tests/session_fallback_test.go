@@ -0,0 +1,224 @@
+package tests
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const checkoutPage = "<html><head><title>Checkout</title></head><body>Checkout V2</body></html>"
+
+func sessionCookieValue(rr *httptest.ResponseRecorder) string {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+func TestSessionFallbackScript(t *testing.T) {
+	// The backend compresses pages for clients accepting gzip.
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/checkout/api" {
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(rw, `{"ok":true}`)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if req.URL.Path == "/checkout/brotli" {
+			rw.Header().Set("Content-Encoding", "br")
+			_, _ = io.WriteString(rw, "brotli page")
+			return
+		}
+		// The legacy page is compressed whatever the client accepts.
+		if req.URL.Path == "/checkout/legacy" || strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			rw.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(rw)
+			_, _ = io.WriteString(gz, checkoutPage)
+			_ = gz.Close()
+			return
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(len(checkoutPage)))
+		_, _ = io.WriteString(rw, checkoutPage)
+	}))
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost:1",
+		MetricsPath:    "/metrics",
+		Rules: []config.RoutingRule{
+			{PathPrefix: "/checkout", Backend: backend.URL, SessionFallback: &config.SessionFallback{Mode: "script"}},
+		},
+	})
+
+	t.Run("Script injected", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Accept-Encoding": "gzip"}, nil))
+
+		sessionID := sessionCookieValue(rr)
+		script := fmt.Sprintf(`<script>document.cookie="%s=%s; Path=/; Max-Age=2592000; SameSite=Strict";</script>`, sessionCookieName, sessionID)
+		want := strings.Replace(checkoutPage, "</head>", script+"</head>", 1)
+		if rr.Body.String() != want {
+			t.Errorf("Expected the session script in the head, got %q", rr.Body.String())
+		}
+		if rr.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+			t.Errorf("Expected Content-Length %d, got %q", len(want), rr.Header().Get("Content-Length"))
+		}
+		if rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("Expected an uncompressed response, got Content-Encoding %q", rr.Header().Get("Content-Encoding"))
+		}
+	})
+
+	t.Run("Script injected into a gzip page", func(t *testing.T) {
+		// With a Range header the transport doesn't ask for and decode gzip itself, like
+		// transports with compression disabled, so the page the backend ignoring the range
+		// compresses anyway reaches the middleware encoded.
+		rr := httptest.NewRecorder()
+		headers := map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-"}
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/checkout/legacy", headers, nil))
+
+		if rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Expected the page encoded again, got Content-Encoding %q", rr.Header().Get("Content-Encoding"))
+		}
+		if rr.Header().Get("Content-Length") != strconv.Itoa(rr.Body.Len()) {
+			t.Errorf("Expected Content-Length %d, got %q", rr.Body.Len(), rr.Header().Get("Content-Length"))
+		}
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("Expected a gzip body: %v", err)
+		}
+		page, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatalf("Expected a gzip body: %v", err)
+		}
+		script := fmt.Sprintf(`<script>document.cookie="%s=%s; Path=/; Max-Age=2592000; SameSite=Strict";</script>`, sessionCookieName, sessionCookieValue(rr))
+		if want := strings.Replace(checkoutPage, "</head>", script+"</head>", 1); string(page) != want {
+			t.Errorf("Expected the session script in the head, got %q", page)
+		}
+	})
+
+	t.Run("Page in another encoding", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/checkout/brotli", nil, nil))
+		if rr.Header().Get("Content-Encoding") != "br" || rr.Body.String() != "brotli page" {
+			t.Errorf("Expected the page as is, got Content-Encoding %q and %q", rr.Header().Get("Content-Encoding"), rr.Body.String())
+		}
+		rr = httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/metrics", nil, nil))
+		if !strings.Contains(rr.Body.String(), `forklift_session_script_skipped_total{reason="encoding"} 1`) {
+			t.Errorf("Expected the skipped injection to be counted, got:\n%s", rr.Body.String())
+		}
+	})
+
+	t.Run("Session cookie present", func(t *testing.T) {
+		req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"Accept-Encoding": "gzip"}, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "a2Fma2Etc2Vzc2lvbg=="})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		if rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected the compressed page as is, got Content-Encoding %q", rr.Header().Get("Content-Encoding"))
+		}
+	})
+
+	t.Run("Not HTML", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/checkout/api", nil, nil))
+		if rr.Body.String() != `{"ok":true}` {
+			t.Errorf("Expected the JSON response as is, got %q", rr.Body.String())
+		}
+	})
+}
+
+func TestSessionFallbackQuery(t *testing.T) {
+	v1Server := newMockServer("Checkout V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Checkout V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: v1Server.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path: "/checkout", Backend: v2Server.URL(), Percentage: 50,
+				SessionFallback: &config.SessionFallback{Mode: "query", Parameter: "sid"},
+			},
+		},
+	})
+
+	// Requests never carry the session cookie, as if it was stripped.
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+
+	redirected := 0
+	for i := range 20 {
+		rr := serve(http.MethodGet, fmt.Sprintf("/checkout?step=%d", i))
+		body := strings.TrimSpace(rr.Body.String())
+		if rr.Code != http.StatusFound {
+			// Sessions assigned to the default backend match no rule with a fallback.
+			if body != "Checkout V1" {
+				t.Fatalf("Expected a redirect or the default backend, got %d %q", rr.Code, body)
+			}
+			continue
+		}
+
+		location, err := url.Parse(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatalf("Invalid Location: %v", err)
+		}
+		sessionID := location.Query().Get("sid")
+		if sessionID != sessionCookieValue(rr) || location.Query().Get("step") != strconv.Itoa(i) {
+			t.Fatalf("Expected the session ID and query in the Location, got %q", location)
+		}
+		for range 3 {
+			rr := serve(http.MethodGet, location.String())
+			if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "Checkout V2" {
+				t.Errorf("Expected the session to keep V2, got %d %q", rr.Code, rr.Body.String())
+			}
+		}
+		redirected++
+	}
+	if redirected == 0 {
+		t.Error("Expected some sessions to be redirected")
+	}
+
+	if rr := serve(http.MethodPost, "/checkout"); rr.Code == http.StatusFound {
+		t.Error("Expected POST requests not to be redirected")
+	}
+}
+
+func TestInvalidSessionFallback(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fallback *config.SessionFallback
+	}{
+		{name: "Unknown mode", fallback: &config.SessionFallback{Mode: "localStorage"}},
+		{name: "Invalid parameter", fallback: &config.SessionFallback{Mode: "query", Parameter: "session id"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", SessionFallback: tc.fallback}},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
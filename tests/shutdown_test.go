@@ -0,0 +1,267 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newBlockingServer returns a backend that holds every request until release is closed, and
+// signals each request it receives on started.
+func newBlockingServer(t *testing.T) (server *httptest.Server, started chan struct{}, release chan struct{}) {
+	t.Helper()
+	started = make(chan struct{}, 10)
+	release = make(chan struct{})
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		started <- struct{}{}
+		<-release
+		_, _ = io.WriteString(w, "Slow V1")
+	}))
+	t.Cleanup(server.Close)
+	return server, started, release
+}
+
+func newShutdownMiddleware(t *testing.T, cfg *config.Config) *forklift.Forklift {
+	t.Helper()
+	middleware, err := forklift.NewForklift(context.Background(), http.NotFoundHandler(), cfg, "test-forklift")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+	return middleware
+}
+
+func TestShutdownDrainsInFlightRequests(t *testing.T) {
+	backend, started, release := newBlockingServer(t)
+	middleware := newShutdownMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL,
+		ReadinessPath:  "/_forklift/readyz",
+	})
+
+	inFlight := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		middleware.ServeHTTP(inFlight, createTestRequest(t, http.MethodGet, "/", nil, nil))
+		close(served)
+	}()
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- middleware.Shutdown(context.Background())
+	}()
+
+	// Readiness fails and new requests are turned away while the request in flight finishes.
+	waitFor(t, func() bool {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/_forklift/readyz", nil, nil))
+		return rr.Code == http.StatusServiceUnavailable && strings.Contains(rr.Body.String(), "[-]shutdown failed")
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 503 with Retry-After during shutdown, got %d", rr.Code)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned before the request in flight finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-served
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if inFlight.Code != http.StatusOK || inFlight.Body.String() != "Slow V1" {
+		t.Errorf("Expected request in flight to complete, got %d: %q", inFlight.Code, inFlight.Body.String())
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	backend, started, release := newBlockingServer(t)
+	defer close(release)
+	middleware := newShutdownMiddleware(t, &config.Config{DefaultBackend: backend.URL})
+
+	go middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/", nil, nil))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := middleware.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected deadline exceeded with a request in flight, got %v", err)
+	}
+}
+
+func TestShutdownFlushesEventSinks(t *testing.T) {
+	backend := newMockServer("Checkout V2")
+	defer backend.close()
+
+	sink := newRecordingSink("shutdown", true)
+	middleware := newShutdownMiddleware(t, &config.Config{
+		DefaultBackend: backend.URL(),
+		EventSinks: []config.EventSink{
+			{Name: "shutdown", Type: "recording", FlushInterval: "1h", BatchSize: 100},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/checkout", Backend: backend.URL(), Experiment: "checkout", Variant: "v2"},
+		},
+	})
+
+	for range 3 {
+		middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/checkout", nil, nil))
+	}
+	if _, delivered := sink.snapshot(); len(delivered) != 0 {
+		t.Fatalf("Expected exposures to be batched until shutdown, got %d delivered", len(delivered))
+	}
+
+	if err := middleware.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected clean shutdown, got %v", err)
+	}
+	if _, delivered := sink.snapshot(); len(delivered) != 3 {
+		t.Errorf("Expected 3 exposures flushed on shutdown, got %d", len(delivered))
+	}
+}
+
+func TestShutdownSavesUnsavedAssignments(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	fake, _ := newFakeDynamoDB(t)
+	// Single writes fail, so assignments can only be saved by the batch written on shutdown.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".PutItem") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fake.handle(w, r)
+	}))
+	defer server.Close()
+
+	v1Server := newMockServer("Hello from V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	middleware := newShutdownMiddleware(t, &config.Config{
+		DefaultBackend: v1Server.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v2Server.URL(), Percentage: 100},
+		},
+		SessionStore: &config.SessionStore{
+			Type: "dynamodb", Table: "assignments", Region: "us-east-1", Endpoint: server.URL, TTL: "1h",
+		},
+	})
+
+	sessionID := "a2Fma2Etc2Vzc2lvbg=="
+	for range 2 {
+		if got := serveWithSession(t, middleware, sessionID); got != "Hello from V2" {
+			t.Fatalf("Expected V2 while the store can't save the assignment, got %q", got)
+		}
+	}
+
+	if err := middleware.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected clean shutdown, got %v", err)
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.items) != 1 {
+		t.Errorf("Expected the assignment to be saved on shutdown, got %d items", len(fake.items))
+	}
+}
+
+func TestShutdownOnContextDone(t *testing.T) {
+	backend := newMockServer("Hello from V1")
+	defer backend.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	middleware, err := forklift.New(ctx, http.NotFoundHandler(), &config.Config{
+		DefaultBackend:  backend.URL(),
+		ShutdownTimeout: "1s",
+	}, "test-forklift")
+	if err != nil {
+		t.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200 before shutdown, got %d", rr.Code)
+	}
+
+	cancel()
+	waitFor(t, func() bool {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+		return rr.Code == http.StatusServiceUnavailable
+	})
+}
+
+func TestInvalidShutdownTimeout(t *testing.T) {
+	_, err := forklift.New(context.Background(), http.NotFoundHandler(), &config.Config{
+		DefaultBackend:  "http://localhost",
+		ShutdownTimeout: "soon",
+	}, "test-forklift")
+	if err == nil {
+		t.Error("Expected error for invalid shutdown timeout, got nil")
+	}
+}
+
+func TestShutdownFlushesPostHogEvents(t *testing.T) {
+	batches := make(chan int, 10)
+	posthog := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/batch/" {
+			var body struct {
+				Batch []json.RawMessage `json:"batch"`
+			}
+			_ = json.NewDecoder(req.Body).Decode(&body)
+			batches <- len(body.Batch)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+			"featureFlags": map[string]interface{}{"checkout": "test"},
+		})
+	}))
+	defer posthog.Close()
+
+	testServer := newMockServer("Checkout Test")
+	defer testServer.close()
+
+	middleware := newShutdownMiddleware(t, &config.Config{
+		DefaultBackend: testServer.URL(),
+		FlagProviders: []config.FlagProvider{
+			{Name: "posthog", Type: "posthog", URL: posthog.URL, APIKey: "phc_project", SendEvents: true},
+		},
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/checkout",
+				Flag: &config.FlagRule{
+					Provider:   "posthog",
+					Name:       "checkout",
+					Treatments: map[string]string{"test": testServer.URL()},
+				},
+			},
+		},
+	})
+	middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/checkout", nil, nil))
+
+	if err := middleware.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Expected clean shutdown, got %v", err)
+	}
+	select {
+	case n := <-batches:
+		if n != 1 {
+			t.Errorf("Expected 1 $feature_flag_called event, got %d", n)
+		}
+	default:
+		t.Error("Expected queued PostHog events to be sent on shutdown")
+	}
+}
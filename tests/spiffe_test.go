@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// testCA issues SVIDs for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of an SVID with the SPIFFE ID.
+func (ca *testCA) issue(t *testing.T, id string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeSVID writes an SVID and the trust bundle where spiffe-helper would.
+func (ca *testCA) writeSVID(t *testing.T, dir, id string) *config.SPIFFE {
+	t.Helper()
+	cert, key := ca.issue(t, id)
+	files := map[string][]byte{"svid.pem": cert, "svid_key.pem": key, "svid_bundle.pem": ca.pem}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &config.SPIFFE{
+		CertFile:    filepath.Join(dir, "svid.pem"),
+		KeyFile:     filepath.Join(dir, "svid_key.pem"),
+		BundleFile:  filepath.Join(dir, "svid_bundle.pem"),
+		TrustDomain: "example.org",
+	}
+}
+
+// newSPIFFEBackend starts a backend that requires an SVID from the CA and answers with the
+// SPIFFE ID of the client.
+func newSPIFFEBackend(t *testing.T, ca *testCA, id string) *httptest.Server {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, id)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(ca.cert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].URIs[0].String()))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clients,
+		MinVersion:   tls.VersionTLS12,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSPIFFE(t *testing.T) {
+	ca := newTestCA(t)
+	backend := newSPIFFEBackend(t, ca, "spiffe://example.org/checkout")
+	serve := func(middleware http.Handler) (int, string) {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+		return rr.Code, strings.TrimSpace(rr.Body.String())
+	}
+
+	t.Run("Rotated", func(t *testing.T) {
+		dir := t.TempDir()
+		spiffe := ca.writeSVID(t, dir, "spiffe://example.org/forklift")
+		spiffe.ReloadInterval = "10ms"
+		middleware := createMiddleware(t, &config.Config{DefaultBackend: backend.URL, SPIFFE: spiffe})
+
+		if code, body := serve(middleware); code != http.StatusOK || body != "spiffe://example.org/forklift" {
+			t.Fatalf("Expected the backend to see the SVID, got %d %q", code, body)
+		}
+		ca.writeSVID(t, dir, "spiffe://example.org/forklift-rotated")
+		waitFor(t, func() bool {
+			_, body := serve(middleware)
+			return body == "spiffe://example.org/forklift-rotated"
+		})
+	})
+
+	t.Run("Backend not allowed", func(t *testing.T) {
+		spiffe := ca.writeSVID(t, t.TempDir(), "spiffe://example.org/forklift")
+		spiffe.AllowedIDs = []string{"spiffe://example.org/payments"}
+		middleware := createMiddleware(t, &config.Config{DefaultBackend: backend.URL, SPIFFE: spiffe})
+		if code, _ := serve(middleware); code != http.StatusBadGateway {
+			t.Errorf("Expected 502 for a backend with another SPIFFE ID, got %d", code)
+		}
+	})
+
+	t.Run("Backend of another trust domain", func(t *testing.T) {
+		spiffe := ca.writeSVID(t, t.TempDir(), "spiffe://example.org/forklift")
+		spiffe.TrustDomain = "example.com"
+		middleware := createMiddleware(t, &config.Config{DefaultBackend: backend.URL, SPIFFE: spiffe})
+		if code, _ := serve(middleware); code != http.StatusBadGateway {
+			t.Errorf("Expected 502 for a backend of another trust domain, got %d", code)
+		}
+	})
+}
+
+func TestInvalidSPIFFE(t *testing.T) {
+	ca := newTestCA(t)
+	testCases := []struct {
+		name   string
+		modify func(t *testing.T, spiffe *config.SPIFFE)
+	}{
+		{name: "Missing file", modify: func(_ *testing.T, spiffe *config.SPIFFE) { spiffe.KeyFile = "/nonexistent" }},
+		{name: "Trust domain with scheme", modify: func(_ *testing.T, spiffe *config.SPIFFE) { spiffe.TrustDomain = "spiffe://example.org" }},
+		{name: "Allowed ID of another trust domain", modify: func(_ *testing.T, spiffe *config.SPIFFE) {
+			spiffe.AllowedIDs = []string{"spiffe://example.com/checkout"}
+		}},
+		{name: "Invalid reload interval", modify: func(_ *testing.T, spiffe *config.SPIFFE) { spiffe.ReloadInterval = "often" }},
+		{name: "Certificate without SPIFFE ID", modify: func(t *testing.T, spiffe *config.SPIFFE) {
+			cert, key := ca.issue(t, "https://example.org/forklift")
+			_ = os.WriteFile(spiffe.CertFile, cert, 0o600)
+			_ = os.WriteFile(spiffe.KeyFile, key, 0o600)
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spiffe := ca.writeSVID(t, t.TempDir(), "spiffe://example.org/forklift")
+			tc.modify(t, spiffe)
+			cfg := &config.Config{DefaultBackend: "http://localhost", SPIFFE: spiffe}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
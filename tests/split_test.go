@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// newSplitEvaluator serves treatments of the "checkout" split: "on" for the enterprise plan,
+// "broken" for the broken plan, an error for the failing plan and "off" otherwise.
+func newSplitEvaluator(t *testing.T, calls *int64) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(calls, 1)
+		if req.URL.Path != "/client/get-treatment" || req.Header.Get("Authorization") != "evaluator-token" {
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("split-name") != "checkout" || req.URL.Query().Get("key") == "" {
+			http.Error(rw, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		var attributes map[string]string
+		_ = json.Unmarshal([]byte(req.URL.Query().Get("attributes")), &attributes)
+		treatment := "off"
+		switch attributes["plan"] {
+		case "enterprise":
+			treatment = "on"
+		case "broken":
+			treatment = "broken"
+		case "failing":
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]string{"splitName": "checkout", "treatment": treatment})
+	}))
+}
+
+func TestSplitTreatments(t *testing.T) {
+	var calls int64
+	evaluator := newSplitEvaluator(t, &calls)
+	defer evaluator.Close()
+
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	onServer := newMockServer("Checkout V2")
+	defer onServer.close()
+	offServer := newMockServer("Checkout V1")
+	defer offServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		FlagProviders: []config.FlagProvider{
+			{Name: "split", Type: "split", URL: evaluator.URL, APIKey: "evaluator-token", CacheTTL: "1m"},
+		},
+		Rules: []config.RoutingRule{
+			{
+				PathPrefix: "/checkout",
+				Flag: &config.FlagRule{
+					Provider:   "split",
+					Name:       "checkout",
+					Treatments: map[string]string{"on": onServer.URL(), "off": offServer.URL()},
+					Attributes: map[string]string{"plan": "header:X-Plan"},
+					Fallback:   "off",
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name         string
+		plan         string
+		expectedBody string
+	}{
+		{name: "Treatment on", plan: "enterprise", expectedBody: "Checkout V2"},
+		{name: "Treatment off", plan: "free", expectedBody: "Checkout V1"},
+		{name: "Unmapped treatment falls through", plan: "broken", expectedBody: "Default Backend"},
+		{name: "Evaluation error uses fallback", plan: "failing", expectedBody: "Checkout V1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers := map[string]string{"X-Plan": tc.plan, "Cookie": sessionCookieName + "=c3BsaXQtc2Vzc2lvbg=="}
+			req := createTestRequest(t, http.MethodGet, "/checkout", headers, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+
+	before := atomic.LoadInt64(&calls)
+	headers := map[string]string{"X-Plan": "enterprise", "Cookie": sessionCookieName + "=c3BsaXQtc2Vzc2lvbg=="}
+	middleware.ServeHTTP(httptest.NewRecorder(), createTestRequest(t, http.MethodGet, "/checkout", headers, nil))
+	if after := atomic.LoadInt64(&calls); after != before {
+		t.Errorf("Expected cached treatment, got %d evaluator calls", after-before)
+	}
+}
+
+func TestInvalidFlagRules(t *testing.T) {
+	providers := []config.FlagProvider{{Name: "split", Type: "split", URL: "http://localhost:7548"}}
+	testCases := []struct {
+		name      string
+		providers []config.FlagProvider
+		flag      *config.FlagRule
+		backend   string
+	}{
+		{
+			name:      "Unknown provider",
+			providers: providers,
+			flag:      &config.FlagRule{Provider: "launchdarkly", Name: "checkout", Treatments: map[string]string{"on": "http://localhost:8081"}},
+		},
+		{
+			name:      "No treatments",
+			providers: providers,
+			flag:      &config.FlagRule{Provider: "split", Name: "checkout"},
+		},
+		{
+			name:      "Backend and flag",
+			providers: providers,
+			flag:      &config.FlagRule{Provider: "split", Name: "checkout", Treatments: map[string]string{"on": "http://localhost:8081"}},
+			backend:   "http://localhost:8082",
+		},
+		{
+			name:      "Invalid attribute source",
+			providers: providers,
+			flag: &config.FlagRule{
+				Provider: "split", Name: "checkout",
+				Treatments: map[string]string{"on": "http://localhost:8081"},
+				Attributes: map[string]string{"plan": "body:plan"},
+			},
+		},
+		{
+			name:      "Unknown provider type",
+			providers: []config.FlagProvider{{Name: "split", Type: "unknown", URL: "http://localhost:7548"}},
+			flag:      &config.FlagRule{Provider: "split", Name: "checkout", Treatments: map[string]string{"on": "http://localhost:8081"}},
+		},
+	}
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost:8080",
+				FlagProviders:  tc.providers,
+				Rules:          []config.RoutingRule{{Path: "/", Backend: tc.backend, Flag: tc.flag}},
+			}
+			if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestStaticBackend(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+
+	bodyFile := filepath.Join(t.TempDir(), "maintenance.html")
+	if err := os.WriteFile(bodyFile, []byte("<h1>Down for maintenance</h1>"), 0o600); err != nil {
+		t.Fatalf("Failed to write body file: %v", err)
+	}
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path: "/maintenance",
+				Static: &config.StaticResponse{
+					BodyFile: bodyFile,
+					Headers:  map[string]string{"Content-Type": "text/html", "Retry-After": "120"},
+				},
+			},
+			{
+				Path: "/teapot",
+				Static: &config.StaticResponse{
+					Status: http.StatusTeapot,
+					Body:   "short and stout",
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+		expectedHeader map[string]string
+	}{
+		{
+			name:           "Body file with default status",
+			path:           "/maintenance",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "<h1>Down for maintenance</h1>",
+			expectedHeader: map[string]string{"Content-Type": "text/html", "Retry-After": "120"},
+		},
+		{
+			name:           "Inline body with explicit status",
+			path:           "/teapot",
+			expectedStatus: http.StatusTeapot,
+			expectedBody:   "short and stout",
+		},
+		{
+			name:           "Unmatched path is proxied",
+			path:           "/other",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Default Backend",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, tc.path, nil, nil)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+			for key, value := range tc.expectedHeader {
+				if got := rr.Header().Get(key); got != value {
+					t.Errorf("Expected header %s=%q, got %q", key, value, got)
+				}
+			}
+		})
+	}
+}
+
+func TestStaticBackendPercentageSplit(t *testing.T) {
+	liveServer := newMockServer("Live Backend")
+	defer liveServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: liveServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/",
+				Backend:    liveServer.URL(),
+				Percentage: 50,
+			},
+			{
+				Path:       "/",
+				Percentage: 50,
+				Static:     &config.StaticResponse{Body: "Maintenance"},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	counts := make(map[string]int)
+	for range 1000 {
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		counts[strings.TrimSpace(rr.Body.String())]++
+	}
+
+	if counts["Live Backend"] == 0 || counts["Maintenance"] == 0 {
+		t.Errorf("Expected traffic to be split between live and static backends, got %v", counts)
+	}
+}
+
+func TestStaticBackendMissingBodyFile(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{
+			{
+				Path:   "/maintenance",
+				Static: &config.StaticResponse{BodyFile: filepath.Join(t.TempDir(), "missing.html")},
+			},
+		},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for missing static body file, got nil")
+	}
+}
+
+func TestStaticBackendObject(t *testing.T) {
+	cfg, err := config.LoadConfig(`
+defaultBackend: http://localhost:8080
+rules:
+  - path: /checkout
+    percentage: 10
+    backend:
+      type: static
+      status: 503
+      body: Down for maintenance
+      headers:
+        Retry-After: "120"
+`)
+	if err != nil {
+		t.Fatalf("Failed to load the configuration: %v", err)
+	}
+	rule := cfg.Rules[0]
+	if rule.Backend != "" || rule.Percentage != 10 || rule.Static == nil || rule.Static.Status != http.StatusServiceUnavailable ||
+		rule.Static.Body != "Down for maintenance" || rule.Static.Headers["Retry-After"] != "120" {
+		t.Errorf("Expected the backend object to be loaded as a static response, got %+v", rule)
+	}
+
+	for name, yaml := range map[string]string{
+		"unknown type": "rules:\n  - path: /\n    backend: {type: grpc}\n",
+		"static twice": "rules:\n  - path: /\n    backend: {type: static}\n    static: {body: down}\n",
+	} {
+		if _, err := config.LoadConfig(yaml); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
+
+func TestStaticBackendBodyURL(t *testing.T) {
+	pages := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/maintenance.html" {
+			http.NotFound(rw, req)
+			return
+		}
+		_, _ = rw.Write([]byte("<h1>Back soon</h1>"))
+	}))
+	defer pages.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{
+			{Path: "/", Static: &config.StaticResponse{BodyURL: pages.URL + "/maintenance.html"}},
+		},
+	})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+	if rr.Code != http.StatusServiceUnavailable || rr.Body.String() != "<h1>Back soon</h1>" {
+		t.Errorf("Expected the page fetched at startup, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	for name, static := range map[string]*config.StaticResponse{
+		"missing page":    {BodyURL: pages.URL + "/missing.html"},
+		"file and URL":    {BodyURL: pages.URL + "/maintenance.html", BodyFile: "maintenance.html"},
+		"unreachable URL": {BodyURL: "http://127.0.0.1:1/maintenance.html"},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost:8080", Rules: []config.RoutingRule{{Path: "/", Static: static}}}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
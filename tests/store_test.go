@@ -0,0 +1,879 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/store"
+)
+
+// fakeMemcached is a minimal memcached server supporting the get, set and add commands.
+type fakeMemcached struct {
+	listener net.Listener
+	mu       sync.Mutex
+	data     map[string]string
+	gets     int
+	sets     int
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	m := &fakeMemcached{listener: listener, data: make(map[string]string)}
+	go m.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+	return m
+}
+
+func (m *fakeMemcached) addr() string {
+	return m.listener.Addr().String()
+}
+
+func (m *fakeMemcached) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn)
+	}
+}
+
+func (m *fakeMemcached) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 2 && fields[0] == "get":
+			m.mu.Lock()
+			value, ok := m.data[fields[1]]
+			m.gets++
+			m.mu.Unlock()
+			if ok {
+				_, _ = fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\n", fields[1], len(value), value)
+			}
+			_, _ = io.WriteString(conn, "END\r\n")
+		case len(fields) == 5 && (fields[0] == "set" || fields[0] == "add"):
+			size, _ := strconv.Atoi(fields[4])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			m.mu.Lock()
+			_, exists := m.data[fields[1]]
+			if exists && fields[0] == "add" {
+				m.mu.Unlock()
+				_, _ = io.WriteString(conn, "NOT_STORED\r\n")
+				break
+			}
+			m.data[fields[1]] = string(data[:size])
+			m.sets++
+			m.mu.Unlock()
+			_, _ = io.WriteString(conn, "STORED\r\n")
+		default:
+			_, _ = io.WriteString(conn, "ERROR\r\n")
+		}
+	}
+}
+
+func (m *fakeMemcached) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.data)
+}
+
+func (m *fakeMemcached) getCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gets
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewMemoryStore()
+
+	if err := s.Set(ctx, "session", "http://v1", time.Hour); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if value, found, err := s.Get(ctx, "session"); err != nil || !found || value != "http://v1" {
+		t.Errorf("Expected stored value, got %q found=%v err=%v", value, found, err)
+	}
+
+	if err := s.Set(ctx, "expired", "http://v2", -time.Second); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if _, found, _ := s.Get(ctx, "expired"); found {
+		t.Error("Expected expired value not to be found")
+	}
+	if _, found, _ := s.Get(ctx, "missing"); found {
+		t.Error("Expected missing value not to be found")
+	}
+
+	if err := s.Set(ctx, "session", "http://v2", time.Hour); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if value, _, _ := s.Get(ctx, "session"); value != "http://v2" {
+		t.Errorf("Expected Set to replace the value, got %q", value)
+	}
+	if added, err := s.Add(ctx, "session", "http://v3", time.Hour); err != nil || added {
+		t.Errorf("Expected Add to keep the live value, got added=%v err=%v", added, err)
+	}
+	if added, err := s.Add(ctx, "expired", "http://v3", time.Hour); err != nil || !added {
+		t.Errorf("Expected Add to replace the expired value, got added=%v err=%v", added, err)
+	}
+	if value, _, _ := s.Get(ctx, "expired"); value != "http://v3" {
+		t.Errorf("Expected the added value, got %q", value)
+	}
+}
+
+func TestMemcachedStore(t *testing.T) {
+	ctx := context.Background()
+	servers := []*fakeMemcached{newFakeMemcached(t), newFakeMemcached(t)}
+	s := store.NewMemcachedStore([]string{servers[0].addr(), servers[1].addr()}, time.Second)
+
+	longKey := "forklift:" + strings.Repeat("x", 300) + " with spaces"
+	keys := []string{longKey}
+	for i := range 50 {
+		keys = append(keys, "forklift:session-"+strconv.Itoa(i)+":/")
+	}
+
+	for i, key := range keys {
+		if err := s.Set(ctx, key, "backend-"+strconv.Itoa(i), time.Hour); err != nil {
+			t.Fatalf("Failed to set %s: %v", key, err)
+		}
+	}
+	for i, key := range keys {
+		value, found, err := s.Get(ctx, key)
+		if err != nil || !found || value != "backend-"+strconv.Itoa(i) {
+			t.Errorf("Expected backend-%d for %s, got %q found=%v err=%v", i, key, value, found, err)
+		}
+	}
+
+	if _, found, err := s.Get(ctx, "forklift:missing"); err != nil || found {
+		t.Errorf("Expected miss for unknown key, got found=%v err=%v", found, err)
+	}
+	if servers[0].len() == 0 || servers[1].len() == 0 {
+		t.Errorf("Expected keys on both servers, got %d and %d", servers[0].len(), servers[1].len())
+	}
+
+	if added, err := s.Add(ctx, keys[1], "other", time.Hour); err != nil || added {
+		t.Errorf("Expected Add to keep the existing value, got added=%v err=%v", added, err)
+	}
+	if added, err := s.Add(ctx, "forklift:new", "backend-new", time.Hour); err != nil || !added {
+		t.Errorf("Expected Add to store a new key, got added=%v err=%v", added, err)
+	}
+	if err := s.Set(ctx, keys[1], "other", time.Hour); err != nil {
+		t.Fatalf("Failed to set %s: %v", keys[1], err)
+	}
+	if value, _, _ := s.Get(ctx, keys[1]); value != "other" {
+		t.Errorf("Expected Set to replace the value, got %q", value)
+	}
+}
+
+func TestSessionStoreKeepsAssignments(t *testing.T) {
+	memcached := newFakeMemcached(t)
+	v1Server := newMockServer("Hello from V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	createConfig := func(v1Percentage float64) *config.Config {
+		return &config.Config{
+			DefaultBackend: v1Server.URL(),
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v1Server.URL(), Percentage: v1Percentage},
+				{Path: "/", Backend: v2Server.URL(), Percentage: 100 - v1Percentage},
+			},
+			SessionStore: &config.SessionStore{Type: "memcached", Servers: []string{memcached.addr()}, TTL: "1h"},
+		}
+	}
+
+	before := createMiddleware(t, createConfig(50))
+	after := createMiddleware(t, createConfig(1))
+
+	assignments := make(map[string]string)
+	for i := range 200 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+		assignments[sessionID] = serveWithSession(t, before, sessionID)
+	}
+	if memcached.len() != len(assignments) {
+		t.Errorf("Expected %d stored assignments, got %d", len(assignments), memcached.len())
+	}
+
+	for sessionID, backend := range assignments {
+		if got := serveWithSession(t, after, sessionID); got != backend {
+			t.Errorf("Session %s moved from %q to %q after percentage change", sessionID, backend, got)
+		}
+	}
+}
+
+func serveWithSession(t *testing.T, middleware http.Handler, sessionID string) string {
+	t.Helper()
+	req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: sessionID})
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	return strings.TrimSpace(rr.Body.String())
+}
+
+func TestInvalidSessionStore(t *testing.T) {
+	testCases := []struct {
+		name  string
+		store *config.SessionStore
+	}{
+		{name: "Unknown type", store: &config.SessionStore{Type: "etcd"}},
+		{name: "Memcached without servers", store: &config.SessionStore{Type: "memcached"}},
+		{name: "Invalid ttl", store: &config.SessionStore{Type: "memory", TTL: "forever"}},
+		{name: "Zero ttl", store: &config.SessionStore{Type: "memcached", Servers: []string{"localhost:11211"}, TTL: "0s"}},
+		{name: "Negative ttl", store: &config.SessionStore{Type: "memory", TTL: "-1h"}},
+		{name: "Redis without primary", store: &config.SessionStore{Type: "redis", Replicas: []string{"localhost:6380"}}},
+		{name: "Replicas without redis", store: &config.SessionStore{Type: "memcached", Servers: []string{"localhost:11211"}, Replicas: []string{"localhost:11212"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := store.New(tc.store); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
+
+// fakeRedis is a minimal Redis server supporting the GET, SET, SCAN, MGET, HINCRBY, PEXPIRE and
+// HGETALL commands, and the lease scripts of the store.
+type fakeRedis struct {
+	listener net.Listener
+	mu       sync.Mutex
+	data     map[string]string
+	ttls     map[string]string
+	hashes   map[string]map[string]int64
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	r := &fakeRedis{
+		listener: listener,
+		data:     make(map[string]string),
+		ttls:     make(map[string]string),
+		hashes:   make(map[string]map[string]int64),
+	}
+	go r.serve()
+	t.Cleanup(func() { _ = listener.Close() })
+	return r
+}
+
+func (r *fakeRedis) addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *fakeRedis) handle(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRedisCommand(reader)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		switch {
+		case len(args) == 2 && strings.EqualFold(args[0], "GET"):
+			if value, ok := r.data[args[1]]; ok {
+				_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+			} else {
+				_, _ = io.WriteString(conn, "$-1\r\n")
+			}
+		case len(args) >= 3 && strings.EqualFold(args[0], "SET"):
+			var ttl string
+			onlyNew := false
+			for i := 3; i < len(args); i++ {
+				switch strings.ToUpper(args[i]) {
+				case "NX":
+					onlyNew = true
+				case "PX":
+					i++
+					ttl = args[i]
+				}
+			}
+			if _, exists := r.data[args[1]]; exists && onlyNew {
+				_, _ = io.WriteString(conn, "$-1\r\n")
+				break
+			}
+			r.data[args[1]] = args[2]
+			r.ttls[args[1]] = ttl
+			_, _ = io.WriteString(conn, "+OK\r\n")
+		case len(args) == 4 && strings.EqualFold(args[0], "HINCRBY"):
+			increment, _ := strconv.ParseInt(args[3], 10, 64)
+			if r.hashes[args[1]] == nil {
+				r.hashes[args[1]] = make(map[string]int64)
+			}
+			r.hashes[args[1]][args[2]] += increment
+			_, _ = fmt.Fprintf(conn, ":%d\r\n", r.hashes[args[1]][args[2]])
+		case len(args) == 3 && strings.EqualFold(args[0], "PEXPIRE"):
+			r.ttls[args[1]] = args[2]
+			_, _ = io.WriteString(conn, ":1\r\n")
+		case len(args) == 2 && strings.EqualFold(args[0], "HGETALL"):
+			_, _ = fmt.Fprintf(conn, "*%d\r\n", 2*len(r.hashes[args[1]]))
+			for field, value := range r.hashes[args[1]] {
+				total := strconv.FormatInt(value, 10)
+				_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n$%d\r\n%s\r\n", len(field), field, len(total), total)
+			}
+		case len(args) >= 4 && strings.EqualFold(args[0], "EVAL"):
+			r.eval(conn, args[1], args[3], args[4:])
+		case len(args) == 6 && strings.EqualFold(args[0], "SCAN"):
+			r.scan(conn, args[1], args[3], args[5])
+		case len(args) >= 2 && strings.EqualFold(args[0], "MGET"):
+			_, _ = fmt.Fprintf(conn, "*%d\r\n", len(args)-1)
+			for _, key := range args[1:] {
+				if value, ok := r.data[key]; ok {
+					_, _ = fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+				} else {
+					_, _ = io.WriteString(conn, "$-1\r\n")
+				}
+			}
+		default:
+			_, _ = io.WriteString(conn, "-ERR unknown command\r\n")
+		}
+		r.mu.Unlock()
+	}
+}
+
+// eval runs the lease scripts of the store: a script that extends leases with PEXPIRE takes or
+// extends the lease for its holder, and any other deletes the lease if the holder has it.
+func (r *fakeRedis) eval(w io.Writer, script, key string, args []string) {
+	holder, exists := r.data[key]
+	switch {
+	case exists && holder != args[0]:
+		_, _ = io.WriteString(w, ":0\r\n")
+	case strings.Contains(script, "PEXPIRE"):
+		r.data[key] = args[0]
+		r.ttls[key] = args[1]
+		_, _ = io.WriteString(w, ":1\r\n")
+	case exists:
+		delete(r.data, key)
+		_, _ = io.WriteString(w, ":1\r\n")
+	default:
+		_, _ = io.WriteString(w, ":0\r\n")
+	}
+}
+
+// scan answers SCAN cursor MATCH prefix* COUNT count, paging through the sorted keys with the
+// cursor as their offset.
+func (r *fakeRedis) scan(w io.Writer, cursor, pattern, count string) {
+	prefix := strings.ReplaceAll(strings.TrimSuffix(pattern, "*"), `\`, "")
+	var keys []string
+	for key := range r.data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	offset, _ := strconv.Atoi(cursor)
+	size, _ := strconv.Atoi(count)
+	end := offset + size
+	next := strconv.Itoa(end)
+	if end >= len(keys) {
+		end, next = len(keys), "0"
+	}
+	_, _ = fmt.Fprintf(w, "*2\r\n$%d\r\n%s\r\n*%d\r\n", len(next), next, end-offset)
+	for _, key := range keys[offset:end] {
+		_, _ = fmt.Fprintf(w, "$%d\r\n%s\r\n", len(key), key)
+	}
+}
+
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func (r *fakeRedis) get(key string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	value, ok := r.data[key]
+	return value, ok
+}
+
+func (r *fakeRedis) set(key, value string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data[key] = value
+}
+
+// replicateTo copies the data of r to replica.
+func (r *fakeRedis) replicateTo(replica *fakeRedis) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	for key, value := range r.data {
+		replica.data[key] = value
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	primary := newFakeRedis(t)
+	replica := newFakeRedis(t)
+	s := store.NewRedisStore(primary.addr(), []string{replica.addr()}, time.Second)
+
+	if err := s.Set(ctx, "session-1", "http://v1", time.Hour); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	primary.mu.Lock()
+	ttl := primary.ttls["session-1"]
+	primary.mu.Unlock()
+	if ttl != "3600000" {
+		t.Errorf("Expected a TTL of 3600000ms, got %q", ttl)
+	}
+	if _, found, err := s.Get(ctx, "session-1"); err != nil || found {
+		t.Errorf("Expected a miss on the lagging replica, got found=%v err=%v", found, err)
+	}
+	if added, err := s.Add(ctx, "session-1", "http://v2", time.Hour); err != nil || added {
+		t.Fatalf("Expected Add to keep the existing key, got added=%v err=%v", added, err)
+	}
+
+	primary.replicateTo(replica)
+	if value, found, err := s.Get(ctx, "session-1"); err != nil || !found || value != "http://v1" {
+		t.Errorf("Expected first assignment from the replica, got %q found=%v err=%v", value, found, err)
+	}
+	if added, err := s.Add(ctx, "session-3", "http://v2", time.Hour); err != nil || !added {
+		t.Errorf("Expected Add to write a new key, got added=%v err=%v", added, err)
+	}
+	if err := s.Set(ctx, "session-3", "http://v1", time.Hour); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if value, _ := primary.get("session-3"); value != "http://v1" {
+		t.Errorf("Expected Set to replace the value, got %q", value)
+	}
+
+	entries := []store.Entry{{Key: "session-1", Value: "http://v2"}, {Key: "session-2", Value: "http://v1"}}
+	if err := s.SetMany(ctx, entries, time.Hour); err != nil {
+		t.Fatalf("Failed to batch write: %v", err)
+	}
+	for _, entry := range entries {
+		if value, _ := primary.get(entry.Key); value != entry.Value {
+			t.Errorf("Expected %s=%s after batch write, got %q", entry.Key, entry.Value, value)
+		}
+	}
+
+	down := newFakeRedis(t)
+	_ = down.listener.Close()
+	s = store.NewRedisStore(primary.addr(), []string{down.addr()}, time.Second)
+	if value, found, err := s.Get(ctx, "session-2"); err != nil || !found || value != "http://v1" {
+		t.Errorf("Expected reads to fall back to the primary, got %q found=%v err=%v", value, found, err)
+	}
+}
+
+func TestRedisCounters(t *testing.T) {
+	ctx := context.Background()
+	redis := newFakeRedis(t)
+	s := store.NewRedisStore(redis.addr(), nil, time.Second)
+
+	if _, err := s.Count(ctx, "counters", map[string]int64{"requests:v1": 3, "requests:v2": 1}, time.Hour); err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	totals, err := s.Count(ctx, "counters", map[string]int64{"requests:v1": 2}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to count: %v", err)
+	}
+	if totals["requests:v1"] != 5 || totals["requests:v2"] != 1 || len(totals) != 2 {
+		t.Errorf("Expected the totals of both fields, got %v", totals)
+	}
+	if totals, err := s.Count(ctx, "counters", nil, time.Hour); err != nil || totals["requests:v1"] != 5 {
+		t.Errorf("Expected the totals without increments, got %v %v", totals, err)
+	}
+	redis.mu.Lock()
+	ttl := redis.ttls["counters"]
+	redis.mu.Unlock()
+	if ttl != "3600000" {
+		t.Errorf("Expected the counters to expire after 3600000ms, got %q", ttl)
+	}
+}
+
+func TestRedisReplicationLag(t *testing.T) {
+	primary := newFakeRedis(t)
+	v1Server := newMockServer("Hello from V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	// Each region reads from its own replica, which has not received any assignment yet.
+	newRegion := func(v1Percentage float64) http.Handler {
+		return createMiddleware(t, &config.Config{
+			DefaultBackend: v1Server.URL(),
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v1Server.URL(), Percentage: v1Percentage},
+				{Path: "/", Backend: v2Server.URL(), Percentage: 100 - v1Percentage},
+			},
+			SessionStore: &config.SessionStore{
+				Type: "redis", Servers: []string{primary.addr()}, Replicas: []string{newFakeRedis(t).addr()}, TTL: "1h",
+			},
+		})
+	}
+	east, west := newRegion(50), newRegion(50)
+
+	for i := range 50 {
+		sessionID := base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+		first := serveWithSession(t, east, sessionID)
+		if got := serveWithSession(t, west, sessionID); got != first {
+			t.Errorf("Session %s got %q in one region and %q in the other", sessionID, first, got)
+		}
+	}
+
+	// An instance with other percentages doesn't replace the assignments on the primary.
+	before := make(map[string]string)
+	primary.mu.Lock()
+	for key, value := range primary.data {
+		before[key] = value
+	}
+	primary.mu.Unlock()
+	changed := newRegion(1)
+	for i := range 50 {
+		serveWithSession(t, changed, base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i))))
+	}
+	for key, value := range before {
+		if got, _ := primary.get(key); got != value {
+			t.Errorf("Expected %s to keep %q on the primary, got %q", key, value, got)
+		}
+	}
+}
+
+func TestConcurrentAssignment(t *testing.T) {
+	primary, replica := newFakeRedis(t), newFakeRedis(t)
+	v1Server := newMockServer("Hello from V1")
+	defer v1Server.close()
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: v1Server.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1Server.URL(), Percentage: 1},
+			{Path: "/", Backend: v2Server.URL(), Percentage: 99},
+		},
+		SessionStore: &config.SessionStore{
+			Type: "redis", Servers: []string{primary.addr()}, Replicas: []string{replica.addr()}, TTL: "1h",
+			Cache: &config.SessionCache{},
+		},
+	})
+	// Another instance assigned the sessions to V1, which the replica hasn't received yet.
+	sessionIDs := make([]string, 20)
+	for i := range sessionIDs {
+		sessionIDs[i] = base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+		primary.set("forklift:"+sessionIDs[i]+":/", v1Server.URL())
+	}
+
+	for _, sessionID := range sessionIDs {
+		serveWithSession(t, middleware, sessionID)
+		if value, _ := primary.get("forklift:" + sessionID + ":/"); value != v1Server.URL() {
+			t.Errorf("Expected the first assignment of %s to be kept, got %q", sessionID, value)
+		}
+	}
+	// Assignments that lost to the other instance's aren't cached, so the sessions follow the
+	// stored assignment once it is replicated.
+	primary.replicateTo(replica)
+	for _, sessionID := range sessionIDs {
+		if got := serveWithSession(t, middleware, sessionID); got != "Hello from V1" {
+			t.Errorf("Expected session %s to follow its stored assignment, got %q", sessionID, got)
+		}
+	}
+}
+
+// fakeDynamoDB emulates the DynamoDB operations used by the DynamoDB store.
+type fakeDynamoDB struct {
+	mu          sync.Mutex
+	items       map[string]map[string]map[string]string
+	batchCalls  int
+	unsignedHit bool
+}
+
+func newFakeDynamoDB(t *testing.T) (*fakeDynamoDB, *httptest.Server) {
+	t.Helper()
+	f := &fakeDynamoDB{items: make(map[string]map[string]map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(f.handle))
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeDynamoDB) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+		f.unsignedHit = true
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.") {
+	case "GetItem":
+		var key map[string]map[string]string
+		_ = json.Unmarshal(body["Key"], &key)
+		item, ok := f.items[key["pk"]["S"]]
+		if !ok {
+			_, _ = io.WriteString(w, "{}")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"Item": item})
+	case "PutItem":
+		var item map[string]map[string]string
+		_ = json.Unmarshal(body["Item"], &item)
+		if existing, ok := f.items[item["pk"]["S"]]; ok && len(body["ConditionExpression"]) > 0 {
+			var values map[string]map[string]string
+			_ = json.Unmarshal(body["ExpressionAttributeValues"], &values)
+			expires, _ := strconv.ParseInt(existing["expires"]["N"], 10, 64)
+			now, _ := strconv.ParseInt(values[":now"]["N"], 10, 64)
+			if expires > now {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`)
+				return
+			}
+		}
+		f.items[item["pk"]["S"]] = item
+		_, _ = io.WriteString(w, "{}")
+	case "BatchWriteItem":
+		f.batchCalls++
+		var requestItems map[string][]map[string]map[string]map[string]map[string]string
+		_ = json.Unmarshal(body["RequestItems"], &requestItems)
+		unprocessed := make(map[string]interface{})
+		for table, requests := range requestItems {
+			// Leave the last item unprocessed on the first call to exercise retries.
+			if f.batchCalls == 1 && len(requests) > 1 {
+				unprocessed[table] = requests[len(requests)-1:]
+				requests = requests[:len(requests)-1]
+			}
+			for _, request := range requests {
+				item := request["PutRequest"]["Item"]
+				f.items[item["pk"]["S"]] = item
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"UnprocessedItems": unprocessed})
+	case "Scan":
+		f.scan(w, body)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// scan answers Scan requests filtered by key prefix and expiry, one item per page.
+func (f *fakeDynamoDB) scan(w io.Writer, body map[string]json.RawMessage) {
+	var values map[string]map[string]string
+	_ = json.Unmarshal(body["ExpressionAttributeValues"], &values)
+	var start map[string]map[string]string
+	_ = json.Unmarshal(body["ExclusiveStartKey"], &start)
+	now, _ := strconv.ParseInt(values[":now"]["N"], 10, 64)
+	var keys []string
+	for key := range f.items {
+		if key > start["pk"]["S"] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	resp := map[string]interface{}{"Items": []interface{}{}}
+	if len(keys) == 0 {
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	item := f.items[keys[0]]
+	expires, _ := strconv.ParseInt(item["expires"]["N"], 10, 64)
+	if strings.HasPrefix(keys[0], values[":prefix"]["S"]) && expires > now {
+		resp["Items"] = []interface{}{item}
+	}
+	if len(keys) > 1 {
+		resp["LastEvaluatedKey"] = map[string]interface{}{"pk": item["pk"]}
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	fake, server := newFakeDynamoDB(t)
+	ctx := context.Background()
+	s := store.NewDynamoDBStore("assignments", "us-east-1", server.URL, time.Second)
+
+	if _, found, err := s.Get(ctx, "session-1"); err != nil || found {
+		t.Fatalf("Expected miss for unknown key, got found=%v err=%v", found, err)
+	}
+
+	if added, err := s.Add(ctx, "session-1", "http://v1", time.Hour); err != nil || !added {
+		t.Fatalf("Failed to add value: added=%v err=%v", added, err)
+	}
+	if added, err := s.Add(ctx, "session-1", "http://v2", time.Hour); err != nil || added {
+		t.Fatalf("Expected conditional conflict to be reported, got added=%v err=%v", added, err)
+	}
+	if value, found, err := s.Get(ctx, "session-1"); err != nil || !found || value != "http://v1" {
+		t.Errorf("Expected first assignment to win, got %q found=%v err=%v", value, found, err)
+	}
+	if err := s.Set(ctx, "session-1", "http://v2", time.Hour); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if value, _, _ := s.Get(ctx, "session-1"); value != "http://v2" {
+		t.Errorf("Expected Set to replace the value, got %q", value)
+	}
+
+	if err := s.Set(ctx, "session-2", "http://v1", -time.Hour); err != nil {
+		t.Fatalf("Failed to set value: %v", err)
+	}
+	if _, found, _ := s.Get(ctx, "session-2"); found {
+		t.Error("Expected expired item not to be found")
+	}
+	if added, err := s.Add(ctx, "session-2", "http://v2", time.Hour); err != nil || !added {
+		t.Fatalf("Expected expired item to be replaceable, got added=%v err=%v", added, err)
+	}
+	if value, _, _ := s.Get(ctx, "session-2"); value != "http://v2" {
+		t.Errorf("Expected expired item to be replaced, got %q", value)
+	}
+
+	entries := make([]store.Entry, 30)
+	for i := range entries {
+		entries[i] = store.Entry{Key: "batch-" + strconv.Itoa(i), Value: "http://v" + strconv.Itoa(i%2+1)}
+	}
+	if err := s.SetMany(ctx, entries, time.Hour); err != nil {
+		t.Fatalf("Failed to batch write: %v", err)
+	}
+	for _, entry := range entries {
+		if value, found, _ := s.Get(ctx, entry.Key); !found || value != entry.Value {
+			t.Errorf("Expected %s=%s after batch write, got %q", entry.Key, entry.Value, value)
+		}
+	}
+	if fake.batchCalls != 3 {
+		t.Errorf("Expected 2 batches plus 1 retry, got %d calls", fake.batchCalls)
+	}
+	if fake.unsignedHit {
+		t.Error("Expected all requests to be signed")
+	}
+}
+
+// scanned returns the entries a store lists under prefix.
+func scanned(t *testing.T, s store.Scanner, prefix string) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	err := s.Scan(context.Background(), prefix, func(entry store.Entry) error {
+		entries[entry.Key] = entry.Value
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	return entries
+}
+
+func TestStoreScan(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	_, dynamoDB := newFakeDynamoDB(t)
+	testCases := []struct {
+		name  string
+		store interface {
+			store.SessionStore
+			store.Scanner
+		}
+		// entries spans several pages: Redis scans 500 keys at a time and the fake DynamoDB
+		// returns one item per page.
+		entries int
+	}{
+		{name: "memory", store: store.NewMemoryStore(), entries: 10},
+		{name: "redis", store: store.NewRedisStore(newFakeRedis(t).addr(), nil, time.Second), entries: 1200},
+		{name: "dynamodb", store: store.NewDynamoDBStore("assignments", "us-east-1", dynamoDB.URL, time.Second), entries: 5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := tc.store
+			expected := make(map[string]string)
+			for i := range tc.entries {
+				expected[fmt.Sprintf("forklift:session-%04d:/", i)] = "http://v" + strconv.Itoa(i%2+1)
+			}
+			for key, value := range expected {
+				if err := s.Set(ctx, key, value, time.Hour); err != nil {
+					t.Fatalf("Failed to set value: %v", err)
+				}
+			}
+			if err := s.Set(ctx, "other:session", "http://v1", time.Hour); err != nil {
+				t.Fatalf("Failed to set value: %v", err)
+			}
+			if tc.name != "redis" {
+				// The fake Redis doesn't expire keys.
+				if err := s.Set(ctx, "forklift:expired:/", "http://v1", -time.Hour); err != nil {
+					t.Fatalf("Failed to set value: %v", err)
+				}
+			}
+
+			entries := scanned(t, s, "forklift:")
+			if len(entries) != len(expected) {
+				t.Fatalf("Expected %d entries, got %d", len(expected), len(entries))
+			}
+			for key, value := range expected {
+				if entries[key] != value {
+					t.Errorf("Expected %s=%s, got %q", key, value, entries[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestTags(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	internalMobile := newMockServer("Internal Mobile")
+	defer internalMobile.close()
+	internal := newMockServer("Internal")
+	defer internal.close()
+	mobile := newMockServer("Mobile")
+	defer mobile.close()
+
+	var evaluations atomic.Int64
+	forklift.RegisterConditionEvaluator("test-internal", forklift.ConditionEvaluatorFunc(
+		func(req *http.Request, condition config.RuleCondition) bool {
+			evaluations.Add(1)
+			return req.Header.Get("X-Internal") == condition.Value
+		}))
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Tags: []config.Tag{
+			{Name: "isInternal", Conditions: []config.RuleCondition{{Type: "custom", Parameter: "test-internal", Value: "1"}}},
+			{Name: "isMobile", Match: "header:X-Device eq mobile"},
+			{Name: "isInternalMobile", Match: "tag:isInternal; tag:isMobile"},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: internalMobile.URL(), Priority: 30, Match: "tag:isInternalMobile"},
+			{Path: "/", Backend: internal.URL(), Priority: 20, Match: "tag:isInternal"},
+			{Path: "/", Backend: mobile.URL(), Priority: 10, Match: "tag:isInternal eq false; tag:isMobile"},
+		},
+	})
+
+	for _, tc := range []struct {
+		name     string
+		headers  map[string]string
+		expected string
+	}{
+		{name: "internal mobile", headers: map[string]string{"X-Internal": "1", "X-Device": "mobile"}, expected: "Internal Mobile"},
+		{name: "internal", headers: map[string]string{"X-Internal": "1"}, expected: "Internal"},
+		{name: "mobile", headers: map[string]string{"X-Device": "mobile"}, expected: "Mobile"},
+		{name: "untagged", headers: nil, expected: "Default"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			evaluations.Store(0)
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", tc.headers, nil))
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expected {
+				t.Errorf("Expected body %q, got %q", tc.expected, body)
+			}
+			if n := evaluations.Load(); n != 1 {
+				t.Errorf("Expected the tag to be computed once, got %d evaluations", n)
+			}
+		})
+	}
+}
+
+func TestInvalidTags(t *testing.T) {
+	for name, cfg := range map[string]struct {
+		tags  []config.Tag
+		match string
+	}{
+		"missing name":      {tags: []config.Tag{{Match: "header:X-Device eq mobile"}}},
+		"duplicate name":    {tags: []config.Tag{{Name: "a", Match: "header:X-A eq 1"}, {Name: "a", Match: "header:X-B eq 1"}}},
+		"no conditions":     {tags: []config.Tag{{Name: "a"}}},
+		"form condition":    {tags: []config.Tag{{Name: "a", Match: "form:plan eq pro"}}},
+		"invalid condition": {tags: []config.Tag{{Name: "a", Match: "fingerprint:ja5 eq abc"}}},
+		"forward reference": {tags: []config.Tag{{Name: "a", Match: "tag:b"}, {Name: "b", Match: "header:X-B eq 1"}}},
+		"unknown tag":       {tags: []config.Tag{{Name: "a", Match: "header:X-A eq 1"}}, match: "tag:b"},
+		"invalid value":     {tags: []config.Tag{{Name: "a", Match: "header:X-A eq 1"}}, match: "tag:a eq yes"},
+	} {
+		rules := []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Match: cfg.match}}
+		c := &config.Config{DefaultBackend: "http://localhost:8080", Tags: cfg.tags, Rules: rules}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), c, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+;; Matches requests whose X-Team header equals the value of the condition.
+(module
+  (import "forklift" "get_header" (func $get_header (param i32 i32 i32 i32) (result i32)))
+  (import "forklift" "get_value" (func $get_value (param i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "X-Team")
+  (func (export "evaluate") (result i32)
+    (local $n i32) (local $m i32) (local $i i32)
+    (local.set $n (call $get_header (i32.const 0) (i32.const 6) (i32.const 64) (i32.const 256)))
+    (local.set $m (call $get_value (i32.const 512) (i32.const 256)))
+    ;; A missing header is -1, which is greater than 256 unsigned.
+    (if (i32.or (i32.ne (local.get $n) (local.get $m)) (i32.gt_u (local.get $n) (i32.const 256)))
+      (then (return (i32.const 0))))
+    (block $done
+      (loop $next
+        (br_if $done (i32.ge_u (local.get $i) (local.get $n)))
+        (if (i32.ne (i32.load8_u offset=64 (local.get $i)) (i32.load8_u offset=512 (local.get $i)))
+          (then (return (i32.const 0))))
+        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+        (br $next)))
+    (i32.const 1)))
@@ -0,0 +1,8 @@
+;; Reads the request from _initialize, outside of an evaluation, so it traps at startup.
+(module
+  (import "forklift" "get_method" (func $get_method (param i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "_initialize")
+    (drop (call $get_method (i32.const 0) (i32.const 0))))
+  (func (export "evaluate") (result i32)
+    (i32.const 1)))
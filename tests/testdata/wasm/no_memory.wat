@@ -0,0 +1,4 @@
+;; Matches every request, but doesn't export its memory, so it is rejected at startup.
+(module
+  (func (export "evaluate") (result i32)
+    (i32.const 1)))
@@ -0,0 +1,6 @@
+;; Never returns, to test the timeout of evaluations.
+(module
+  (memory (export "memory") 1)
+  (func (export "evaluate") (result i32)
+    (loop $forever (br $forever))
+    (i32.const 0)))
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestTraefikMetadataConditions(t *testing.T) {
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	secureServer := newMockServer("Secure Experiment")
+	defer secureServer.close()
+	routerServer := newMockServer("Router Experiment")
+	defer routerServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{
+				Path:     "/",
+				Backend:  secureServer.URL(),
+				Priority: 2,
+				Conditions: []config.RuleCondition{
+					{Type: "traefik", Parameter: "entrypoint", Operator: "eq", Value: "websecure"},
+					{Type: "traefik", Parameter: "tls", Operator: "eq", Value: "true"},
+					{Type: "traefik", Parameter: "tlsVersion", Operator: "eq", Value: "TLS 1.3"},
+					{Type: "traefik", Parameter: "sni", Operator: "suffix", Value: ".example.com"},
+				},
+			},
+			{
+				Path:     "/",
+				Backend:  routerServer.URL(),
+				Priority: 1,
+				Conditions: []config.RuleCondition{
+					{Type: "traefik", Parameter: "router", Operator: "prefix", Value: "shop-"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	testCases := []struct {
+		name         string
+		headers      map[string]string
+		tls          *tls.ConnectionState
+		expectedBody string
+	}{
+		{
+			name:         "Secure entrypoint with TLS 1.3",
+			headers:      map[string]string{"X-Forklift-Entrypoint": "websecure"},
+			tls:          &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "Shop.Example.com"},
+			expectedBody: "Secure Experiment",
+		},
+		{
+			name:         "Secure entrypoint with TLS 1.2",
+			headers:      map[string]string{"X-Forklift-Entrypoint": "websecure"},
+			tls:          &tls.ConnectionState{Version: tls.VersionTLS12, ServerName: "shop.example.com"},
+			expectedBody: "Default Backend",
+		},
+		{
+			name:         "Secure entrypoint header without TLS",
+			headers:      map[string]string{"X-Forklift-Entrypoint": "websecure"},
+			expectedBody: "Default Backend",
+		},
+		{
+			name:         "Router name",
+			headers:      map[string]string{"X-Forklift-Router": "shop-frontend"},
+			expectedBody: "Router Experiment",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, "/", tc.headers, nil)
+			req.TLS = tc.tls
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestProtocolConditions(t *testing.T) {
+	defaultServer := newMockServer("HTTP/1 Stack")
+	defer defaultServer.close()
+	h2Server := newMockServer("HTTP/2 Stack")
+	defer h2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{{
+			Path:    "/",
+			Backend: h2Server.URL(),
+			Conditions: []config.RuleCondition{
+				{Type: "traefik", Parameter: "protocol", Operator: "eq", Value: "h2"},
+				{Type: "traefik", Parameter: "tlsCipher", Operator: "prefix", Value: "TLS_AES_"},
+			},
+		}},
+	})
+
+	testCases := []struct {
+		name         string
+		protoMajor   int
+		cipherSuite  uint16
+		expectedBody string
+	}{
+		{name: "HTTP/2 with a TLS 1.3 cipher", protoMajor: 2, cipherSuite: tls.TLS_AES_128_GCM_SHA256, expectedBody: "HTTP/2 Stack"},
+		{name: "HTTP/1.1 with a TLS 1.3 cipher", protoMajor: 1, cipherSuite: tls.TLS_AES_128_GCM_SHA256, expectedBody: "HTTP/1 Stack"},
+		{name: "HTTP/2 with a TLS 1.2 cipher", protoMajor: 2, cipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, expectedBody: "HTTP/1 Stack"},
+		{name: "HTTP/3", protoMajor: 3, cipherSuite: tls.TLS_AES_128_GCM_SHA256, expectedBody: "HTTP/1 Stack"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+			req.ProtoMajor = tc.protoMajor
+			req.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tc.cipherSuite}
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, req)
+
+			if body := strings.TrimSpace(rr.Body.String()); body != tc.expectedBody {
+				t.Errorf("Expected body %q, got %q", tc.expectedBody, body)
+			}
+		})
+	}
+}
+
+func TestUnknownTraefikMetadata(t *testing.T) {
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules: []config.RoutingRule{
+			{
+				Path:       "/",
+				Backend:    "http://localhost:8081",
+				Conditions: []config.RuleCondition{{Type: "traefik", Parameter: "service", Operator: "eq", Value: "x"}},
+			},
+		},
+	}
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+		t.Error("Expected error for unknown traefik metadata, got nil")
+	}
+}
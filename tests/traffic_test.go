@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func TestTrafficAPI(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	v1Server := newMockServer("V1")
+	defer v1Server.close()
+	v2Server := newMockServer("V2")
+	defer v2Server.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: v1Server.URL(), Percentage: 50, Experiment: "checkout", Variant: "v1"},
+			{Path: "/", Backend: v2Server.URL(), Percentage: 50, Experiment: "checkout", Variant: "v2"},
+		},
+		TrafficAPI: &config.TrafficAPI{Path: "/_forklift/traffic", Token: "s3cret"},
+	})
+
+	call := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return rr
+	}
+	served := func() map[string]int {
+		counts := make(map[string]int)
+		for range 200 {
+			rr := httptest.NewRecorder()
+			middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/", nil, nil))
+			counts[strings.TrimSpace(rr.Body.String())]++
+		}
+		return counts
+	}
+
+	if rr := call(http.MethodPost, "/_forklift/traffic", "wrong", `{"experiment":"checkout","variant":"v2","weight":100}`); rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with a wrong token, got %d", rr.Code)
+	}
+	if counts := served(); counts["V1"] == 0 || counts["V2"] == 0 {
+		t.Fatalf("Expected the configured split, got %v", counts)
+	}
+
+	rr := call(http.MethodPost, "/_forklift/traffic", "s3cret", `{"experiment":"checkout","variant":"v2","weight":100}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if counts := served(); counts["V2"] != 200 {
+		t.Errorf("Expected all traffic on v2, got %v", counts)
+	}
+	rr = call(http.MethodGet, "/_forklift/traffic", "s3cret", "")
+	if want := `{"weights":[{"experiment":"checkout","variant":"v2","weight":100}]}`; strings.TrimSpace(rr.Body.String()) != want {
+		t.Errorf("Expected %s, got %s", want, rr.Body.String())
+	}
+
+	// Rejected weights leave the current ones in place.
+	if rr := call(http.MethodPost, "/_forklift/traffic", "s3cret", `{"experiment":"checkout","variant":"v3","weight":10}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown variant, got %d", rr.Code)
+	}
+	if rr := call(http.MethodPost, "/_forklift/traffic", "s3cret", `{"experiment":"checkout","variant":"v2","weight":120}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a weight above 100, got %d", rr.Code)
+	}
+	if counts := served(); counts["V2"] != 200 {
+		t.Errorf("Expected all traffic to stay on v2, got %v", counts)
+	}
+
+	// A Flagger webhook for a failed canary takes its traffic away. Flagger can't set headers, so
+	// the token comes in the metadata.
+	rr = call(http.MethodPost, "/_forklift/traffic", "",
+		`{"name":"checkout","namespace":"shop","phase":"Failed","metadata":{"experiment":"checkout","variant":"v2","token":"s3cret"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if counts := served(); counts["V1"] != 200 {
+		t.Errorf("Expected all traffic on v1, got %v", counts)
+	}
+
+	if rr := call(http.MethodDelete, "/_forklift/traffic?experiment=checkout", "s3cret", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rr.Code)
+	}
+	if counts := served(); counts["V1"] == 0 || counts["V2"] == 0 {
+		t.Errorf("Expected the configured split once the weight is cleared, got %v", counts)
+	}
+}
+
+func TestInvalidTrafficAPI(t *testing.T) {
+	testCases := []struct {
+		name string
+		api  *config.TrafficAPI
+	}{
+		{name: "Without token", api: &config.TrafficAPI{Path: "/_forklift/traffic"}},
+		{name: "Relative path", api: &config.TrafficAPI{Path: "traffic", Token: "s3cret"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{DefaultBackend: "http://localhost", TrafficAPI: tc.api}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
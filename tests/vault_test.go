@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+func newVaultServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Vault-Token") != "root-token" {
+			http.Error(rw, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{"data": map[string]interface{}{"ttl": 0, "renewable": false}})
+		case "/v1/secret/data/forklift":
+			_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+				"data": map[string]interface{}{
+					"data":     map[string]interface{}{"split": "evaluator-token"},
+					"metadata": map[string]interface{}{"version": 3},
+				},
+			})
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+}
+
+func TestVaultSecrets(t *testing.T) {
+	vault := newVaultServer(t)
+	defer vault.Close()
+
+	var calls int64
+	evaluator := newSplitEvaluator(t, &calls)
+	defer evaluator.Close()
+
+	defaultServer := newMockServer("Default Backend")
+	defer defaultServer.close()
+	onServer := newMockServer("Checkout V2")
+	defer onServer.close()
+
+	cfg := &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		Vault:          &config.Vault{Address: vault.URL, Token: "root-token"},
+		FlagProviders: []config.FlagProvider{
+			{Name: "split", Type: "split", URL: evaluator.URL, APIKey: "vault:secret/data/forklift#split"},
+		},
+		Rules: []config.RoutingRule{
+			{
+				Path: "/checkout",
+				Flag: &config.FlagRule{
+					Provider:   "split",
+					Name:       "checkout",
+					Treatments: map[string]string{"on": onServer.URL()},
+					Attributes: map[string]string{"plan": "header:X-Plan"},
+				},
+			},
+		},
+	}
+	middleware := createMiddleware(t, cfg)
+
+	req := createTestRequest(t, http.MethodGet, "/checkout", map[string]string{"X-Plan": "enterprise"}, nil)
+	rr := httptest.NewRecorder()
+	middleware.ServeHTTP(rr, req)
+	if body := strings.TrimSpace(rr.Body.String()); body != "Checkout V2" {
+		t.Errorf("Expected the Vault token to authorize the evaluator, got %q", body)
+	}
+	if cfg.FlagProviders[0].APIKey != "vault:secret/data/forklift#split" {
+		t.Errorf("Expected the configuration to keep the reference, got %q", cfg.FlagProviders[0].APIKey)
+	}
+}
+
+func TestVaultSecretErrors(t *testing.T) {
+	vault := newVaultServer(t)
+	defer vault.Close()
+
+	testCases := []struct {
+		name   string
+		vault  *config.Vault
+		apiKey string
+	}{
+		{name: "No vault configured", apiKey: "vault:secret/data/forklift#split"},
+		{name: "Missing key", vault: &config.Vault{Address: vault.URL, Token: "root-token"}, apiKey: "vault:secret/data/forklift#unknown"},
+		{name: "Missing path", vault: &config.Vault{Address: vault.URL, Token: "root-token"}, apiKey: "vault:secret/data/other#split"},
+		{name: "Invalid reference", vault: &config.Vault{Address: vault.URL, Token: "root-token"}, apiKey: "vault:secret/data/forklift"},
+		{name: "Wrong token", vault: &config.Vault{Address: vault.URL, Token: "guest"}, apiKey: "vault:secret/data/forklift#split"},
+	}
+
+	next := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {})
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost:8080",
+				Vault:          tc.vault,
+				FlagProviders:  []config.FlagProvider{{Name: "split", Type: "split", URL: "http://localhost:7548", APIKey: tc.apiKey}},
+			}
+			if _, err := forklift.New(context.Background(), next, cfg, "test-forklift"); err == nil {
+				t.Error("Expected error, got nil")
+			}
+		})
+	}
+}
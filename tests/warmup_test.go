@@ -0,0 +1,162 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+// warmingBackend counts the mirrored requests and health checks it gets, answering mirrored
+// requests with status.
+type warmingBackend struct {
+	*httptest.Server
+	mirrored atomic.Int64
+	probed   atomic.Int64
+}
+
+func newWarmingBackend(status int) *warmingBackend {
+	b := &warmingBackend{}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("X-Forklift-Mirror") {
+		case "warm-up":
+			b.mirrored.Add(1)
+			w.WriteHeader(status)
+			return
+		case "health":
+			b.probed.Add(1)
+		}
+		_, _ = w.Write([]byte("New"))
+	}))
+	return b
+}
+
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBackendWarmUp(t *testing.T) {
+	control := newMockServer("Control")
+	defer control.close()
+	backend := newWarmingBackend(http.StatusOK)
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: control.URL(),
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: control.URL(), Percentage: 50},
+			{Path: "/", Backend: backend.URL, Percentage: 50, WarmUp: &config.WarmUp{
+				Duration: "5m", Percentage: 50, HealthPath: "/healthz", MaxLatency: "1s", MinRequests: 5,
+			}},
+		},
+	})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	session := 0
+	serve := func() string {
+		session++
+		req := createTestRequest(t, http.MethodGet, "/", nil, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%d", session)))})
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, req)
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	for i := 0; i < 40; i++ {
+		if body := serve(); body != "Control" {
+			t.Fatalf("Expected the warming backend not to be assigned, got %q", body)
+		}
+	}
+	eventually(t, "the mirrored requests", func() bool { return backend.mirrored.Load() == 20 })
+	if backend.probed.Load() != 0 {
+		t.Error("Expected no health check before the end of the warm-up duration")
+	}
+
+	now = now.Add(5 * time.Minute)
+	eventually(t, "the warming backend to be assigned", func() bool { return serve() == "New" })
+	if backend.probed.Load() != 1 {
+		t.Errorf("Expected one health check, got %d", backend.probed.Load())
+	}
+	mirrored := backend.mirrored.Load()
+	serve()
+	if backend.mirrored.Load() != mirrored {
+		t.Error("Expected no more mirrored requests once the backend is warm")
+	}
+}
+
+func TestBackendWarmUpThresholds(t *testing.T) {
+	control := newMockServer("Control")
+	defer control.close()
+	backend := newWarmingBackend(http.StatusInternalServerError)
+	defer backend.Close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: control.URL(),
+		MetricsPath:    "/metrics",
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: backend.URL, Percentage: 100, WarmUp: &config.WarmUp{
+				Duration: "1m", Percentage: 100, MaxErrorRate: 10, MinRequests: 5,
+			}},
+		},
+	})
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	middleware.(*forklift.Forklift).SetClock(func() time.Time { return now })
+	serve := func(path string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, nil, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	for i := 0; i < 10; i++ {
+		serve("/")
+	}
+	eventually(t, "the mirrored requests", func() bool { return backend.mirrored.Load() == 10 })
+	now = now.Add(time.Hour)
+	if body := serve("/"); body != "Control" {
+		t.Errorf("Expected a backend failing its mirrored requests to stay out of assignment, got %q", body)
+	}
+
+	metrics := serve("/metrics")
+	for _, line := range []string{
+		fmt.Sprintf(`forklift_warmup_mirrored_requests_total{backend=%q,result="error"}`, backend.URL),
+		fmt.Sprintf(`forklift_warmup_ready{backend=%q} 0`, backend.URL),
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("Expected %s in the metrics, got:\n%s", line, metrics)
+		}
+	}
+}
+
+func TestInvalidWarmUp(t *testing.T) {
+	for name, warmUp := range map[string]*config.WarmUp{
+		"duration":     {},
+		"percentage":   {Duration: "1m", Percentage: 150},
+		"health path":  {Duration: "1m", HealthPath: "healthz"},
+		"latency":      {Duration: "1m", MaxLatency: "fast"},
+		"error rate":   {Duration: "1m", MaxErrorRate: -1},
+		"min requests": {Duration: "1m", MinRequests: 5000},
+	} {
+		cfg := &config.Config{
+			DefaultBackend: "http://localhost:8080",
+			Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Percentage: 10, WarmUp: warmUp}},
+		}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for an invalid %s", name)
+		}
+	}
+}
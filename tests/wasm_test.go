@@ -0,0 +1,89 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	_ "github.com/daemonp/forklift/wasmcond"
+)
+
+func TestWasmEvaluators(t *testing.T) {
+	defaultServer := newMockServer("Default")
+	defer defaultServer.close()
+	opsServer := newMockServer("Ops")
+	defer opsServer.close()
+
+	middleware := createMiddleware(t, &config.Config{
+		DefaultBackend: defaultServer.URL(),
+		MetricsPath:    "/metrics",
+		WasmEvaluators: []config.WasmEvaluator{
+			{Name: "team", Path: "testdata/wasm/header_eq.wasm"},
+			{Name: "spin", Path: "testdata/wasm/spin.wasm", Timeout: "10ms"},
+		},
+		Rules: []config.RoutingRule{
+			{Path: "/", Backend: opsServer.URL(), Priority: 10, Conditions: []config.RuleCondition{{Type: "custom", Parameter: "team", Value: "ops"}}},
+			{Path: "/spin", Backend: opsServer.URL(), Conditions: []config.RuleCondition{{Type: "custom", Parameter: "spin"}}},
+		},
+	})
+	serve := func(path string, headers map[string]string) string {
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, path, headers, nil))
+		return strings.TrimSpace(rr.Body.String())
+	}
+
+	for _, tc := range []struct {
+		team     string
+		expected string
+	}{
+		{team: "ops", expected: "Ops"},
+		{team: "opsx", expected: "Default"},
+		{team: "dev", expected: "Default"},
+		{team: "", expected: "Default"},
+	} {
+		headers := map[string]string{}
+		if tc.team != "" {
+			headers["X-Team"] = tc.team
+		}
+		for range 3 {
+			if body := serve("/", headers); body != tc.expected {
+				t.Errorf("Expected %q for team %q, got %q", tc.expected, tc.team, body)
+			}
+		}
+	}
+
+	if body := serve("/spin", nil); body != "Default" {
+		t.Errorf("Expected an evaluator timing out not to match, got %q", body)
+	}
+	if metrics := serve("/metrics", nil); !strings.Contains(metrics, `forklift_wasm_evaluator_errors_total{evaluator="spin"} 1`) {
+		t.Errorf("Expected the timeout to be counted, got:\n%s", metrics)
+	}
+}
+
+func TestInvalidWasmEvaluators(t *testing.T) {
+	for name, evaluators := range map[string][]config.WasmEvaluator{
+		"missing file":   {{Name: "team", Path: "testdata/wasm/missing.wasm"}},
+		"not a module":   {{Name: "team", Path: "testdata/wasm/header_eq.wat"}},
+		"duplicate name": {{Name: "team", Path: "testdata/wasm/header_eq.wasm"}, {Name: "team", Path: "testdata/wasm/spin.wasm"}},
+		"timeout":        {{Name: "team", Path: "testdata/wasm/header_eq.wasm", Timeout: "0s"}},
+		"no memory":      {{Name: "team", Path: "testdata/wasm/no_memory.wasm"}},
+		"host call":      {{Name: "team", Path: "testdata/wasm/init_host.wasm"}},
+	} {
+		cfg := &config.Config{DefaultBackend: "http://localhost:8080", WasmEvaluators: evaluators}
+		if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+			t.Errorf("Expected an error for %s", name)
+		}
+	}
+
+	cfg := &config.Config{
+		DefaultBackend: "http://localhost:8080",
+		Rules:          []config.RoutingRule{{Path: "/", Backend: "http://localhost:8081", Conditions: []config.RuleCondition{{Type: "custom", Parameter: "team"}}}},
+	}
+	if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+		t.Error("Expected an error for a condition without evaluator")
+	}
+}
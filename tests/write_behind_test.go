@@ -0,0 +1,164 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+)
+
+const slowWrite = 150 * time.Millisecond
+
+// newSlowDynamoDB returns a fake DynamoDB whose writes take slowWrite, and the number of single
+// writes it received.
+func newSlowDynamoDB(t *testing.T) (*fakeDynamoDB, *httptest.Server, *atomic.Int64) {
+	t.Helper()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	fake, _ := newFakeDynamoDB(t)
+	var puts atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Header.Get("X-Amz-Target")
+		if strings.HasSuffix(target, ".PutItem") || strings.HasSuffix(target, ".BatchWriteItem") {
+			time.Sleep(slowWrite)
+		}
+		if strings.HasSuffix(target, ".PutItem") {
+			puts.Add(1)
+		}
+		fake.handle(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return fake, server, &puts
+}
+
+func TestWriteBehind(t *testing.T) {
+	v2Server := newMockServer("Hello from V2")
+	defer v2Server.close()
+
+	newMiddleware := func(endpoint string, writeBehind *config.WriteBehind) *forklift.Forklift {
+		return newShutdownMiddleware(t, &config.Config{
+			DefaultBackend: "http://localhost:1",
+			MetricsPath:    "/metrics",
+			Rules: []config.RoutingRule{
+				{Path: "/", Backend: v2Server.URL(), Percentage: 100},
+			},
+			SessionStore: &config.SessionStore{
+				Type: "dynamodb", Table: "assignments", Region: "us-east-1", Endpoint: endpoint,
+				Timeout: "2s", WriteBehind: writeBehind,
+			},
+		})
+	}
+	sessionIDs := make([]string, 10)
+	for i := range sessionIDs {
+		sessionIDs[i] = base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("session-%03d", i)))
+	}
+
+	t.Run("Batched writes", func(t *testing.T) {
+		fake, server, puts := newSlowDynamoDB(t)
+		middleware := newMiddleware(server.URL, &config.WriteBehind{BatchSize: 5, FlushInterval: "10ms"})
+
+		start := time.Now()
+		for _, sessionID := range sessionIDs {
+			if got := serveWithSession(t, middleware, sessionID); got != "Hello from V2" {
+				t.Fatalf("Expected V2, got %q", got)
+			}
+		}
+		if elapsed := time.Since(start); elapsed >= slowWrite {
+			t.Errorf("Expected requests not to wait for the store, took %v", elapsed)
+		}
+
+		if err := middleware.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Expected clean shutdown, got %v", err)
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.items) != len(sessionIDs) {
+			t.Errorf("Expected %d assignments written, got %d", len(sessionIDs), len(fake.items))
+		}
+		if puts.Load() != 0 || fake.batchCalls == 0 {
+			t.Errorf("Expected batched writes only, got %d single writes and %d batches", puts.Load(), fake.batchCalls)
+		}
+	})
+
+	t.Run("Overflow dropped", func(t *testing.T) {
+		fake, server, puts := newSlowDynamoDB(t)
+		middleware := newMiddleware(server.URL, &config.WriteBehind{QueueSize: 1, BatchSize: 1, Overflow: "drop"})
+
+		start := time.Now()
+		for _, sessionID := range sessionIDs {
+			serveWithSession(t, middleware, sessionID)
+		}
+		if elapsed := time.Since(start); elapsed >= slowWrite {
+			t.Errorf("Expected dropped assignments not to be written during requests, took %v", elapsed)
+		}
+
+		rr := httptest.NewRecorder()
+		middleware.ServeHTTP(rr, createTestRequest(t, http.MethodGet, "/metrics", nil, nil))
+		if !strings.Contains(rr.Body.String(), `forklift_session_store_queue_overflow_total{policy="drop"}`) {
+			t.Errorf("Expected dropped assignments to be counted, got metrics:\n%s", rr.Body.String())
+		}
+
+		if err := middleware.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Expected clean shutdown, got %v", err)
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.items) == 0 || len(fake.items) == len(sessionIDs) {
+			t.Errorf("Expected some assignments to be dropped, got %d written", len(fake.items))
+		}
+		if puts.Load() != 0 {
+			t.Errorf("Expected no single writes, got %d", puts.Load())
+		}
+	})
+
+	t.Run("Overflow written synchronously", func(t *testing.T) {
+		fake, server, puts := newSlowDynamoDB(t)
+		middleware := newMiddleware(server.URL, &config.WriteBehind{QueueSize: 1, BatchSize: 1})
+		for _, sessionID := range sessionIDs {
+			serveWithSession(t, middleware, sessionID)
+		}
+		if puts.Load() == 0 {
+			t.Error("Expected overflowing assignments to be written during requests")
+		}
+
+		if err := middleware.Shutdown(context.Background()); err != nil {
+			t.Fatalf("Expected clean shutdown, got %v", err)
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if len(fake.items) != len(sessionIDs) {
+			t.Errorf("Expected %d assignments written, got %d", len(sessionIDs), len(fake.items))
+		}
+	})
+}
+
+func TestInvalidWriteBehind(t *testing.T) {
+	testCases := []struct {
+		name        string
+		writeBehind *config.WriteBehind
+	}{
+		{name: "Negative queue size", writeBehind: &config.WriteBehind{QueueSize: -1}},
+		{name: "Invalid flush interval", writeBehind: &config.WriteBehind{FlushInterval: "0s"}},
+		{name: "Unknown overflow policy", writeBehind: &config.WriteBehind{Overflow: "block"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &config.Config{
+				DefaultBackend: "http://localhost",
+				SessionStore:   &config.SessionStore{Type: "memory", WriteBehind: tc.writeBehind},
+			}
+			if _, err := forklift.New(context.Background(), http.NotFoundHandler(), cfg, "test-forklift"); err == nil {
+				t.Error("Expected configuration error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package forklift
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var errUnknownFingerprint = errors.New("unknown TLS fingerprint")
+
+// validateFingerprintConditions checks that fingerprint conditions match on ja3 or ja4.
+func validateFingerprintConditions(rules []RoutingRule) error {
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "fingerprint") {
+				continue
+			}
+			switch strings.ToLower(condition.Parameter) {
+			case "ja3", "ja4":
+			default:
+				return fmt.Errorf("%w: %s", errUnknownFingerprint, condition.Parameter)
+			}
+		}
+	}
+	return nil
+}
+
+// checkFingerprint compares the JA3 or JA4 fingerprint of the client's TLS connection, from the
+// configured header, with the condition value. Requests without the fingerprint don't match,
+// whatever the operator.
+func (re *RuleEngine) checkFingerprint(req *http.Request, condition RuleCondition) bool {
+	ja3Header, ja4Header := re.config.Fingerprint.Headers()
+	header := ja3Header
+	if strings.EqualFold(condition.Parameter, "ja4") {
+		header = ja4Header
+	}
+	value := strings.TrimSpace(req.Header.Get(header))
+	result := value != "" && re.compareValues(value, condition.Operator, condition.Value)
+	if re.config.Debug {
+		re.logger.Debugf("Fingerprint %s %q %s %q: %v", condition.Parameter, value, condition.Operator, condition.Value, result)
+	}
+	return result
+}
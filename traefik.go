@@ -0,0 +1,92 @@
+package forklift
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Traefik does not pass router or entrypoint names to plugins, so they are handed over in request
+// headers set by a headers middleware placed before Forklift on each router.
+const (
+	entrypointHeader = "X-Forklift-Entrypoint"
+	routerHeader     = "X-Forklift-Router"
+)
+
+var errUnknownTraefikMetadata = errors.New("unknown traefik metadata")
+
+var traefikMetadata = map[string]func(req *http.Request) string{
+	"entrypoint": func(req *http.Request) string { return req.Header.Get(entrypointHeader) },
+	"router":     func(req *http.Request) string { return req.Header.Get(routerHeader) },
+	"tls":        func(req *http.Request) string { return strconv.FormatBool(req.TLS != nil) },
+	"tlsversion": func(req *http.Request) string {
+		if req.TLS == nil {
+			return ""
+		}
+		return tls.VersionName(req.TLS.Version)
+	},
+	"tlscipher": func(req *http.Request) string {
+		if req.TLS == nil {
+			return ""
+		}
+		return tls.CipherSuiteName(req.TLS.CipherSuite)
+	},
+	"alpn": func(req *http.Request) string {
+		if req.TLS == nil {
+			return ""
+		}
+		return req.TLS.NegotiatedProtocol
+	},
+	"sni": func(req *http.Request) string {
+		if req.TLS == nil {
+			return ""
+		}
+		return strings.ToLower(req.TLS.ServerName)
+	},
+	"protocol": httpProtocol,
+}
+
+// httpProtocol names the HTTP version the client negotiated as in ALPN: "h1" for HTTP/1.x, "h2"
+// for HTTP/2, including h2c, and "h3" for HTTP/3.
+func httpProtocol(req *http.Request) string {
+	switch req.ProtoMajor {
+	case 2:
+		return "h2"
+	case 3:
+		return "h3"
+	default:
+		return "h1"
+	}
+}
+
+// validateTraefikConditions checks that traefik conditions reference known metadata.
+func validateTraefikConditions(rules []RoutingRule) error {
+	for _, rule := range rules {
+		for _, condition := range rule.Conditions {
+			if !strings.EqualFold(condition.Type, "traefik") {
+				continue
+			}
+			if _, ok := traefikMetadata[strings.ToLower(condition.Parameter)]; !ok {
+				return fmt.Errorf("%w: %s", errUnknownTraefikMetadata, condition.Parameter)
+			}
+		}
+	}
+	return nil
+}
+
+func (re *RuleEngine) checkTraefik(req *http.Request, condition RuleCondition) bool {
+	metadata, ok := traefikMetadata[strings.ToLower(condition.Parameter)]
+	if !ok {
+		re.logger.Warnf("Unknown traefik metadata: %s", condition.Parameter)
+		return false
+	}
+	value := metadata(req)
+	result := re.compareValues(value, condition.Operator, condition.Value)
+	if re.config.Debug {
+		re.logger.Debugf("Traefik %s %q %s %q: %v", condition.Parameter, value, condition.Operator, condition.Value, result)
+	}
+	return result
+}
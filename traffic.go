@@ -0,0 +1,220 @@
+package forklift
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/daemonp/forklift/config"
+)
+
+var (
+	errInvalidTrafficAPI     = errors.New("invalid traffic API")
+	errInvalidTrafficRequest = errors.New("invalid traffic request")
+)
+
+const (
+	// maxTrafficRequestSize bounds the bodies of traffic API requests.
+	maxTrafficRequestSize = 64 << 10
+
+	flaggerFailed      = "Failed"
+	flaggerTerminating = "Terminating"
+)
+
+// trafficAPI lets progressive delivery controllers set the weight of a variant of each
+// experiment over HTTP, e.g. from Flagger webhooks or Argo Rollouts steps. Weights are applied on
+// top of the rule source and are kept per instance until they are cleared. It is shared by the
+// middleware and the copies created for each rule change, and its weights are only accessed with
+// the rule source locked.
+type trafficAPI struct {
+	path    string
+	token   string
+	weights map[string]trafficWeight
+}
+
+// trafficWeight is the percentage of traffic set for a variant of an experiment.
+type trafficWeight struct {
+	Experiment string  `json:"experiment"`
+	Variant    string  `json:"variant"`
+	Weight     float64 `json:"weight"`
+}
+
+// trafficRequest sets the weight of a variant, given directly or in the metadata of a Flagger
+// webhook. Flagger webhooks of failed or terminating canaries set the weight to 0.
+type trafficRequest struct {
+	Experiment string   `json:"experiment"`
+	Variant    string   `json:"variant"`
+	Weight     *float64 `json:"weight"`
+
+	Phase    string            `json:"phase"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// newTrafficAPI returns nil when the traffic API is not configured.
+func newTrafficAPI(cfg *config.Config) (*trafficAPI, error) {
+	if cfg.TrafficAPI == nil {
+		return nil, nil
+	}
+	if !strings.HasPrefix(cfg.TrafficAPI.Path, "/") {
+		return nil, fmt.Errorf("%w: path must start with /", errInvalidTrafficAPI)
+	}
+	if cfg.TrafficAPI.Token == "" {
+		return nil, fmt.Errorf("%w: token is required", errInvalidTrafficAPI)
+	}
+	return &trafficAPI{
+		path:    cfg.TrafficAPI.Path,
+		token:   cfg.TrafficAPI.Token,
+		weights: make(map[string]trafficWeight),
+	}, nil
+}
+
+// apply sets the weights on the variants of the rules.
+func (t *trafficAPI) apply(cfg *config.Config) error {
+	for _, weight := range t.weights {
+		if err := cfg.SetVariantWeight(weight.Experiment, weight.Variant, weight.Weight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weight returns the weight the request sets.
+func (r *trafficRequest) weight() (trafficWeight, error) {
+	w := trafficWeight{Experiment: r.Experiment, Variant: r.Variant}
+	if w.Experiment == "" {
+		w.Experiment = r.Metadata["experiment"]
+	}
+	if w.Variant == "" {
+		w.Variant = r.Metadata["variant"]
+	}
+	if w.Experiment == "" || w.Variant == "" {
+		return w, fmt.Errorf("%w: experiment and variant are required", errInvalidTrafficRequest)
+	}
+
+	switch {
+	case r.Phase == flaggerFailed || r.Phase == flaggerTerminating:
+		w.Weight = 0
+	case r.Weight != nil:
+		w.Weight = *r.Weight
+	case r.Metadata["weight"] != "":
+		weight, err := strconv.ParseFloat(r.Metadata["weight"], 64)
+		if err != nil {
+			return w, fmt.Errorf("%w: weight %q", errInvalidTrafficRequest, r.Metadata["weight"])
+		}
+		w.Weight = weight
+	default:
+		return w, fmt.Errorf("%w: weight is required", errInvalidTrafficRequest)
+	}
+	if w.Weight < 0 || w.Weight > maxPercentage {
+		return w, fmt.Errorf("%w: weight must be between 0 and 100", errInvalidTrafficRequest)
+	}
+	return w, nil
+}
+
+// authorized reports whether the request carries the token as a bearer token, or, as Flagger
+// webhooks can't set headers, in the metadata of the payload.
+func (t *trafficAPI) authorized(req *http.Request, body *trafficRequest) bool {
+	token, bearer := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !bearer && body != nil {
+		token, bearer = body.Metadata["token"], true
+	}
+	return bearer && subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1
+}
+
+// serveTraffic lists the weights set through the traffic API on GET, sets the weight of a
+// variant on POST and clears the weight of the experiment in the query on DELETE.
+func (a *Forklift) serveTraffic(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-store")
+	var body *trafficRequest
+	if req.Method == http.MethodPost {
+		body = &trafficRequest{}
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxTrafficRequestSize)).Decode(body); err != nil {
+			body = nil
+		}
+	}
+	if !a.traffic.authorized(req, body) {
+		rw.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		a.source.mu.Lock()
+		weights := make([]trafficWeight, 0, len(a.traffic.weights))
+		for _, weight := range a.traffic.weights {
+			weights = append(weights, weight)
+		}
+		a.source.mu.Unlock()
+		sort.Slice(weights, func(i, j int) bool {
+			return weights[i].Experiment < weights[j].Experiment
+		})
+		writeJSON(rw, http.StatusOK, map[string][]trafficWeight{"weights": weights})
+	case http.MethodPost:
+		if body == nil {
+			http.Error(rw, fmt.Sprintf("%v: malformed JSON", errInvalidTrafficRequest), http.StatusBadRequest)
+			return
+		}
+		weight, err := body.weight()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := a.setTrafficWeight(weight.Experiment, &weight); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.logger.Infof("Traffic API set %s/%s to %g%%", weight.Experiment, weight.Variant, weight.Weight)
+		writeJSON(rw, http.StatusOK, weight)
+	case http.MethodDelete:
+		experiment := req.URL.Query().Get("experiment")
+		if experiment == "" {
+			http.Error(rw, fmt.Sprintf("%v: experiment is required", errInvalidTrafficRequest), http.StatusBadRequest)
+			return
+		}
+		if err := a.setTrafficWeight(experiment, nil); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.logger.Infof("Traffic API cleared the weight of %s", experiment)
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(rw, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setTrafficWeight sets the weight of the experiment, or clears it when weight is nil, and
+// applies it to the rules. The previous weight is restored if the rules reject the new one.
+func (a *Forklift) setTrafficWeight(experiment string, weight *trafficWeight) error {
+	a.source.mu.Lock()
+	defer a.source.mu.Unlock()
+	previous, had := a.traffic.weights[experiment]
+	if weight != nil {
+		a.traffic.weights[experiment] = *weight
+	} else {
+		delete(a.traffic.weights, experiment)
+	}
+	err := a.applyRules(a.source.rules)
+	if err == nil {
+		return nil
+	}
+	if had {
+		a.traffic.weights[experiment] = previous
+	} else {
+		delete(a.traffic.weights, experiment)
+	}
+	return err
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(value)
+}
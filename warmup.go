@@ -0,0 +1,342 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/daemonp/forklift/metrics"
+)
+
+var errInvalidWarmUp = errors.New("invalid warm-up")
+
+const (
+	defaultWarmUpPercentage  = 1
+	defaultWarmUpMinRequests = 10
+	maxWarmUpMinRequests     = 1000
+	// maxMirrorsInFlight bounds the mirrored requests in flight to a warming backend, so a slow
+	// backend doesn't pile them up.
+	maxMirrorsInFlight = 16
+	// warmUpProbeInterval is the time between health checks of a backend that failed one.
+	warmUpProbeInterval = 10 * time.Second
+	warmUpProbeTimeout  = 5 * time.Second
+	// mirrorHeader marks mirrored requests, so backends can tell them from user traffic.
+	mirrorHeader = "X-Forklift-Mirror"
+)
+
+// validateWarmUps checks the warm-ups of the rules, which need a backend to mirror requests to.
+func validateWarmUps(rules []RoutingRule) error {
+	for _, rule := range rules {
+		if rule.WarmUp == nil {
+			continue
+		}
+		if _, err := parseWarmUp(&rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmUpSettings is the parsed warm-up of a rule.
+type warmUpSettings struct {
+	duration     time.Duration
+	percentage   float64
+	healthPath   string
+	maxLatency   time.Duration
+	maxErrorRate float64
+	minRequests  int
+}
+
+func parseWarmUp(rule *RoutingRule) (warmUpSettings, error) {
+	cfg := rule.WarmUp
+	key := backendKey(*rule)
+	if rule.Backend == "" || rule.Flag != nil {
+		return warmUpSettings{}, fmt.Errorf("%w: %s: rules warming up must route to a backend", errInvalidWarmUp, rulePathKey(rule))
+	}
+	duration, err := time.ParseDuration(cfg.Duration)
+	if err != nil || duration <= 0 {
+		return warmUpSettings{}, fmt.Errorf("%w: %s: duration must be a positive duration", errInvalidWarmUp, key)
+	}
+	settings := warmUpSettings{
+		duration:     duration,
+		percentage:   cfg.Percentage,
+		healthPath:   cfg.HealthPath,
+		maxErrorRate: cfg.MaxErrorRate,
+		minRequests:  cfg.MinRequests,
+	}
+	if settings.percentage == 0 {
+		settings.percentage = defaultWarmUpPercentage
+	}
+	if settings.minRequests == 0 {
+		settings.minRequests = defaultWarmUpMinRequests
+	}
+	switch {
+	case settings.percentage < 0 || settings.percentage > 100:
+		return warmUpSettings{}, fmt.Errorf("%w: %s: %w", errInvalidWarmUp, key, errInvalidPercentage)
+	case settings.healthPath != "" && !strings.HasPrefix(settings.healthPath, "/"):
+		return warmUpSettings{}, fmt.Errorf("%w: %s: healthPath must start with /", errInvalidWarmUp, key)
+	case settings.maxErrorRate < 0 || settings.maxErrorRate > 100:
+		return warmUpSettings{}, fmt.Errorf("%w: %s: maxErrorRate must be between 0 and 100", errInvalidWarmUp, key)
+	case settings.minRequests < 0 || settings.minRequests > maxWarmUpMinRequests:
+		return warmUpSettings{}, fmt.Errorf("%w: %s: minRequests must be between 1 and %d", errInvalidWarmUp, key, maxWarmUpMinRequests)
+	}
+	if cfg.MaxLatency != "" {
+		settings.maxLatency, err = time.ParseDuration(cfg.MaxLatency)
+		if err != nil || settings.maxLatency <= 0 {
+			return warmUpSettings{}, fmt.Errorf("%w: %s: maxLatency must be a positive duration", errInvalidWarmUp, key)
+		}
+	}
+	return settings, nil
+}
+
+// mirrorResult is the outcome of one mirrored request.
+type mirrorResult struct {
+	latency time.Duration
+	failed  bool
+}
+
+// backendWarmUp is the warm-up of a backend. It is kept across rule changes as long as a rule
+// warms the backend up, so changing other rules doesn't restart it.
+type backendWarmUp struct {
+	backend  string
+	url      string
+	settings warmUpSettings
+
+	// ready is set once the backend may be assigned sessions, and stays set.
+	ready    atomic.Bool
+	probing  atomic.Bool
+	matched  atomic.Int64
+	inFlight atomic.Int64
+
+	mu        sync.Mutex
+	started   time.Time
+	nextProbe time.Time
+	// results are the most recent mirrored requests, in a ring of minRequests entries.
+	results []mirrorResult
+	next    int
+}
+
+// record adds the result of a mirrored request.
+func (w *backendWarmUp) record(result mirrorResult) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.results) < w.settings.minRequests {
+		w.results = append(w.results, result)
+		return
+	}
+	w.results[w.next] = result
+	w.next = (w.next + 1) % len(w.results)
+}
+
+// withinThresholds reports whether the warm-up lasted long enough and the recent mirrored
+// requests are within the latency and error thresholds.
+func (w *backendWarmUp) withinThresholds(now time.Time) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.started.IsZero() || now.Sub(w.started) < w.settings.duration || len(w.results) < w.settings.minRequests {
+		return false
+	}
+	var total time.Duration
+	failed := 0
+	for _, result := range w.results {
+		total += result.latency
+		if result.failed {
+			failed++
+		}
+	}
+	if w.settings.maxLatency > 0 && total/time.Duration(len(w.results)) > w.settings.maxLatency {
+		return false
+	}
+	return w.settings.maxErrorRate == 0 || float64(failed)*100/float64(len(w.results)) <= w.settings.maxErrorRate
+}
+
+// mirrors reports whether the n-th request matched by the rule is mirrored, spreading the
+// mirrored requests evenly.
+func (w *backendWarmUp) mirrors(n int64) bool {
+	p := w.settings.percentage / 100
+	return int64(float64(n)*p) > int64(float64(n-1)*p)
+}
+
+// warmUps holds the warm-ups of the backends. It is shared by the middleware and the copies
+// created for each rule change.
+type warmUps struct {
+	mu       sync.Mutex
+	backends map[string]*backendWarmUp
+
+	mirrored *metrics.CounterVec
+	ready    *metrics.GaugeVec
+}
+
+func newWarmUps(registry *metrics.Registry) *warmUps {
+	return &warmUps{
+		backends: make(map[string]*backendWarmUp),
+		mirrored: registry.Counter("forklift_warmup_mirrored_requests_total",
+			"Number of requests mirrored to warming backends by backend and result: success or error.", "backend", "result"),
+		ready: registry.Gauge("forklift_warmup_ready",
+			"Whether a backend finished its warm-up and is assigned sessions: 1 or 0.", "backend"),
+	}
+}
+
+// rules returns the warm-ups of the rules, continuing those of backends already warming up.
+// Backends no rule warms up anymore are forgotten, so adding a warm-up again starts over.
+func (w *warmUps) rules(rules []RoutingRule) (map[*RoutingRule]*backendWarmUp, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	warming := make(map[*RoutingRule]*backendWarmUp)
+	backends := make(map[string]*backendWarmUp)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.WarmUp == nil {
+			continue
+		}
+		settings, err := parseWarmUp(rule)
+		if err != nil {
+			return nil, err
+		}
+		backend := backendKey(*rule)
+		state := backends[backend]
+		if state == nil {
+			state = w.backends[backend]
+			if state == nil || state.settings != settings {
+				// A changed warm-up starts over, unless the backend is already warm.
+				previous := state
+				state = &backendWarmUp{backend: backend, url: rule.Backend, settings: settings}
+				if previous != nil && previous.ready.Load() {
+					state.ready.Store(true)
+				} else {
+					w.ready.Set(0, backend)
+				}
+			}
+			backends[backend] = state
+		}
+		warming[rule] = state
+	}
+	w.backends = backends
+	return warming, nil
+}
+
+// warmingUp reports whether a rule matching the request is warming up, in which case it doesn't
+// take part in the selection and a share of its requests are mirrored to its backend.
+func (a *Forklift) warmingUp(req *http.Request, rule *RoutingRule) bool {
+	if !a.warming(rule) {
+		return false
+	}
+	state := a.ruleWarmUps[rule]
+	now := a.now()
+	state.mu.Lock()
+	if state.started.IsZero() {
+		state.started = now
+	}
+	state.mu.Unlock()
+
+	if state.mirrors(state.matched.Add(1)) {
+		a.mirror(req, rule, state)
+	}
+	if state.withinThresholds(now) {
+		a.probeWarmUp(state, now)
+	}
+	return !state.ready.Load()
+}
+
+// warming reports whether the backend of a rule is warming up and may not be assigned yet.
+func (a *Forklift) warming(rule *RoutingRule) bool {
+	state := a.ruleWarmUps[rule]
+	return state != nil && !state.ready.Load()
+}
+
+// probeWarmUp checks the health of a backend whose mirrored requests are within the thresholds,
+// and ends its warm-up if it passes. Checks run in the background, one at a time.
+func (a *Forklift) probeWarmUp(state *backendWarmUp, now time.Time) {
+	if state.settings.healthPath == "" {
+		a.warmedUp(state)
+		return
+	}
+	state.mu.Lock()
+	due := !now.Before(state.nextProbe)
+	if due {
+		state.nextProbe = now.Add(warmUpProbeInterval)
+	}
+	state.mu.Unlock()
+	if !due || !state.probing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer state.probing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), warmUpProbeTimeout)
+		defer cancel()
+		probe, err := http.NewRequestWithContext(ctx, http.MethodGet, state.url+state.settings.healthPath, nil)
+		if err != nil {
+			return
+		}
+		probe.Header.Set(mirrorHeader, "health")
+		resp, err := a.client.Do(probe)
+		if err != nil {
+			a.logger.Errorf("Health check of warming backend %s failed: %v", state.backend, err)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			a.logger.Errorf("Health check of warming backend %s failed with status %d", state.backend, resp.StatusCode)
+			return
+		}
+		a.warmedUp(state)
+	}()
+}
+
+func (a *Forklift) warmedUp(state *backendWarmUp) {
+	if state.ready.CompareAndSwap(false, true) {
+		a.warmUps.ready.Set(1, state.backend)
+		a.logger.Infof("Backend %s finished its warm-up and is assigned sessions", state.backend)
+	}
+}
+
+// mirror sends a copy of the request to the warming backend of a rule in the background, and
+// records its latency and whether it failed. Only requests without side effects are mirrored:
+// GET, HEAD and OPTIONS requests without a body.
+func (a *Forklift) mirror(req *http.Request, rule *RoutingRule, state *backendWarmUp) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return
+	}
+	if req.ContentLength != 0 || len(req.TransferEncoding) > 0 {
+		return
+	}
+	if state.inFlight.Add(1) > maxMirrorsInFlight {
+		state.inFlight.Add(-1)
+		return
+	}
+
+	mirrored := req.Clone(context.Background())
+	mirrored.Body = http.NoBody
+	proxyReq, err := a.createProxyRequest(mirrored, state.url, rule)
+	if err != nil {
+		state.inFlight.Add(-1)
+		return
+	}
+	proxyReq.Header.Set(mirrorHeader, "warm-up")
+	go func() {
+		defer state.inFlight.Add(-1)
+		start := time.Now()
+		resp, err := a.client.Do(proxyReq)
+		failed := err != nil
+		if err == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			failed = resp.StatusCode >= http.StatusInternalServerError
+		}
+		state.record(mirrorResult{latency: time.Since(start), failed: failed})
+		result := "success"
+		if failed {
+			result = "error"
+		}
+		a.warmUps.mirrored.Inc(state.backend, result)
+	}()
+}
@@ -0,0 +1,250 @@
+// Package wasmcond runs the WebAssembly evaluators of custom conditions configured with
+// wasmEvaluators. It registers itself with the middleware when imported, as the standalone proxy
+// does; the middleware loaded as a Traefik plugin doesn't import it, as Yaegi can't interpret
+// wazero.
+package wasmcond
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/daemonp/forklift"
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var (
+	errInvalidWasmEvaluator = errors.New("invalid WASM evaluator")
+	errWasmMemory           = errors.New("WASM evaluator memory access out of range")
+	errWasmNoCall           = errors.New("WASM evaluator called the host outside of an evaluation")
+)
+
+const (
+	defaultWasmTimeout = 50 * time.Millisecond
+
+	// wasmHostModule is the module whose functions evaluators import to read the request.
+	wasmHostModule = "forklift"
+	// wasmEvaluate is the function evaluators export, returning non-zero when the request matches.
+	wasmEvaluate = "evaluate"
+	// wasmMemory is the memory evaluators export, which the host functions write to.
+	wasmMemory = "memory"
+)
+
+func init() {
+	forklift.RegisterEvaluatorLoader(load)
+}
+
+// wasmCallKey is the context key of the request being evaluated, read by the host functions.
+type wasmCallKey struct{}
+
+// wasmCall is the request and condition of an evaluation.
+type wasmCall struct {
+	req       *http.Request
+	condition forklift.RuleCondition
+}
+
+// wasmEvaluators runs the custom conditions of the WebAssembly evaluators. Modules run in
+// wazero's interpreter, without access to the file system, environment or network, and are
+// stopped after their timeout. It is shared by the middleware and the copies created for each rule
+// change, and closed on shutdown.
+type wasmEvaluators struct {
+	runtime    wazero.Runtime
+	evaluators map[string]*wasmEvaluator
+	errors     *metrics.CounterVec
+	logger     logger.Logger
+}
+
+// wasmEvaluator is a compiled module and its idle instances. Instances aren't safe for
+// concurrent use, so each evaluation takes one, or instantiates one if none is idle.
+type wasmEvaluator struct {
+	evaluators *wasmEvaluators
+	name       string
+	compiled   wazero.CompiledModule
+	timeout    time.Duration
+	idle       chan api.Module
+}
+
+// load compiles the configured modules, returning the evaluators by name and a function closing
+// them, or nothing when there are none.
+func load(cfg *config.Config, logger logger.Logger, registry *metrics.Registry) (map[string]forklift.ConditionEvaluator, func(), error) {
+	if len(cfg.WasmEvaluators) == 0 {
+		return nil, nil, nil
+	}
+	ctx := context.Background()
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().WithCloseOnContextDone(true))
+	w := &wasmEvaluators{
+		runtime:    r,
+		evaluators: make(map[string]*wasmEvaluator, len(cfg.WasmEvaluators)),
+		errors: registry.Counter("forklift_wasm_evaluator_errors_total",
+			"Number of WASM evaluations that failed or timed out, by evaluator.", "evaluator"),
+		logger: logger,
+	}
+	if err := w.load(ctx, cfg.WasmEvaluators); err != nil {
+		_ = r.Close(ctx)
+		return nil, nil, err
+	}
+	evaluators := make(map[string]forklift.ConditionEvaluator, len(w.evaluators))
+	for name, e := range w.evaluators {
+		evaluators[name] = e
+	}
+	return evaluators, w.close, nil
+}
+
+func (w *wasmEvaluators) load(ctx context.Context, evaluators []config.WasmEvaluator) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, w.runtime); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidWasmEvaluator, err)
+	}
+	if err := instantiateWasmHost(ctx, w.runtime); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidWasmEvaluator, err)
+	}
+	for _, cfg := range evaluators {
+		if cfg.Name == "" || w.evaluators[cfg.Name] != nil {
+			return fmt.Errorf("%w: names must be set and unique, got %q", errInvalidWasmEvaluator, cfg.Name)
+		}
+		e := &wasmEvaluator{evaluators: w, name: cfg.Name, timeout: defaultWasmTimeout, idle: make(chan api.Module, runtime.GOMAXPROCS(0))}
+		if cfg.Timeout != "" {
+			timeout, err := time.ParseDuration(cfg.Timeout)
+			if err != nil || timeout <= 0 {
+				return fmt.Errorf("%w %s: timeout %s", errInvalidWasmEvaluator, cfg.Name, cfg.Timeout)
+			}
+			e.timeout = timeout
+		}
+		binary, err := os.ReadFile(cfg.Path)
+		if err != nil {
+			return fmt.Errorf("%w %s: %v", errInvalidWasmEvaluator, cfg.Name, err)
+		}
+		if e.compiled, err = w.runtime.CompileModule(ctx, binary); err != nil {
+			return fmt.Errorf("%w %s: %v", errInvalidWasmEvaluator, cfg.Name, err)
+		}
+		evaluate, ok := e.compiled.ExportedFunctions()[wasmEvaluate]
+		if !ok || len(evaluate.ParamTypes()) != 0 || len(evaluate.ResultTypes()) != 1 || evaluate.ResultTypes()[0] != api.ValueTypeI32 {
+			return fmt.Errorf("%w %s: the module must export %s() -> i32", errInvalidWasmEvaluator, cfg.Name, wasmEvaluate)
+		}
+		if _, ok := e.compiled.ExportedMemories()[wasmMemory]; !ok {
+			return fmt.Errorf("%w %s: the module must export its %s", errInvalidWasmEvaluator, cfg.Name, wasmMemory)
+		}
+		// Instantiating a first instance checks the imports of the module.
+		m, err := e.instantiate(ctx, w.runtime)
+		if err != nil {
+			return fmt.Errorf("%w %s: %v", errInvalidWasmEvaluator, cfg.Name, err)
+		}
+		e.idle <- m
+		w.evaluators[cfg.Name] = e
+	}
+	return nil
+}
+
+// Evaluate implements forklift.ConditionEvaluator. Evaluations that fail, such as on a trap or a
+// timeout, are logged and counted, and don't match.
+func (e *wasmEvaluator) Evaluate(req *http.Request, condition forklift.RuleCondition) bool {
+	w := e.evaluators
+	matched, err := e.evaluate(w.runtime, req, condition)
+	if err != nil {
+		w.errors.Inc(e.name)
+		w.logger.Warnf("Error running WASM evaluator %s: %v", e.name, err)
+		return false
+	}
+	return matched
+}
+
+// close closes the runtime, and all instances of the modules.
+func (w *wasmEvaluators) close() {
+	_ = w.runtime.Close(context.Background())
+}
+
+func (e *wasmEvaluator) instantiate(ctx context.Context, r wazero.Runtime) (api.Module, error) {
+	// Anonymous instances can be instantiated any number of times. TinyGo and Rust reactors
+	// initialize themselves in _initialize, which other modules don't export.
+	return r.InstantiateModule(ctx, e.compiled, wazero.NewModuleConfig().WithName("").WithStartFunctions("_initialize"))
+}
+
+func (e *wasmEvaluator) evaluate(r wazero.Runtime, req *http.Request, condition forklift.RuleCondition) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.WithValue(req.Context(), wasmCallKey{}, &wasmCall{req: req, condition: condition}), e.timeout)
+	defer cancel()
+
+	var m api.Module
+	select {
+	case m = <-e.idle:
+	default:
+		var err error
+		if m, err = e.instantiate(ctx, r); err != nil {
+			return false, err
+		}
+	}
+	results, err := m.ExportedFunction(wasmEvaluate).Call(ctx)
+	if err != nil {
+		// The instance may be closed by the timeout, or left in an inconsistent state by a trap.
+		_ = m.Close(context.Background())
+		return false, err
+	}
+	select {
+	case e.idle <- m:
+	default:
+		_ = m.Close(context.Background())
+	}
+	return uint32(results[0]) != 0, nil
+}
+
+// instantiateWasmHost instantiates the host module evaluators read the request with. Each
+// function writes a string to the buffer at ptr of size bytes if it fits, and returns its length,
+// so that a module can retry with a larger buffer. Calls outside of an evaluation, such as from
+// _initialize, trap:
+//
+//	get_method(ptr, size i32) -> i32
+//	get_path(ptr, size i32) -> i32, the escaped path
+//	get_header(name_ptr, name_len, ptr, size i32) -> i32, the first value, or -1 if missing
+//	get_value(ptr, size i32) -> i32, the value of the condition
+func instantiateWasmHost(ctx context.Context, r wazero.Runtime) error {
+	i32 := api.ValueTypeI32
+	host := r.NewHostModuleBuilder(wasmHostModule)
+	for name, value := range map[string]func(call *wasmCall) string{
+		"get_method": func(call *wasmCall) string { return call.req.Method },
+		"get_path":   func(call *wasmCall) string { return call.req.URL.EscapedPath() },
+		"get_value":  func(call *wasmCall) string { return call.condition.Value },
+	} {
+		value := value
+		host.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {
+			call, ok := ctx.Value(wasmCallKey{}).(*wasmCall)
+			if !ok {
+				panic(errWasmNoCall)
+			}
+			stack[0] = api.EncodeI32(writeWasmString(m, uint32(stack[0]), uint32(stack[1]), value(call)))
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).Export(name)
+	}
+	host.NewFunctionBuilder().WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {
+		call, ok := ctx.Value(wasmCallKey{}).(*wasmCall)
+		if !ok {
+			panic(errWasmNoCall)
+		}
+		name, ok := m.Memory().Read(uint32(stack[0]), uint32(stack[1]))
+		if !ok {
+			panic(errWasmMemory)
+		}
+		values := call.req.Header.Values(string(name))
+		if len(values) == 0 {
+			stack[0] = api.EncodeI32(-1)
+			return
+		}
+		stack[0] = api.EncodeI32(writeWasmString(m, uint32(stack[2]), uint32(stack[3]), values[0]))
+	}), []api.ValueType{i32, i32, i32, i32}, []api.ValueType{i32}).Export("get_header")
+	_, err := host.Instantiate(ctx)
+	return err
+}
+
+// writeWasmString writes value to the memory of the module at ptr if it fits in size bytes, and
+// returns its length. Writing out of the memory traps.
+func writeWasmString(m api.Module, ptr, size uint32, value string) int32 {
+	if uint32(len(value)) <= size && !m.Memory().WriteString(ptr, value) {
+		panic(errWasmMemory)
+	}
+	return int32(len(value))
+}
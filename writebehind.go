@@ -0,0 +1,195 @@
+package forklift
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daemonp/forklift/config"
+	"github.com/daemonp/forklift/logger"
+	"github.com/daemonp/forklift/metrics"
+	"github.com/daemonp/forklift/store"
+)
+
+var errInvalidWriteBehind = errors.New("invalid session store write-behind")
+
+const (
+	defaultWriteBehindQueueSize     = 10000
+	defaultWriteBehindBatchSize     = 25
+	defaultWriteBehindFlushInterval = 100 * time.Millisecond
+
+	overflowSync = "sync"
+	overflowDrop = "drop"
+)
+
+// assignmentWriter saves session assignments to the session store in batches from a background
+// goroutine, so requests don't wait for the store. Queued assignments are held with the unsaved
+// ones until they are written, so sessions keep their backend meanwhile and assignments that
+// can't be written are saved on shutdown. When the queue is full, assignments are written during
+// the request or dropped, depending on the overflow policy. The writer is shared by the
+// middleware and the copies created for each bundle version.
+type assignmentWriter struct {
+	store     store.SessionStore
+	ttl       time.Duration
+	batchSize int
+	interval  time.Duration
+	overflow  string
+	queue     chan store.Entry
+	unsaved   *unsavedAssignments
+	logger    logger.Logger
+	overflows *metrics.CounterVec
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+}
+
+// newAssignmentWriter returns nil unless the session store has write-behind configured.
+func newAssignmentWriter(cfg *config.SessionStore, sessionStore store.SessionStore, opts store.Options,
+	unsaved *unsavedAssignments, logger logger.Logger, registry *metrics.Registry,
+) (*assignmentWriter, error) {
+	if sessionStore == nil || cfg.WriteBehind == nil {
+		return nil, nil
+	}
+	wb := cfg.WriteBehind
+	if wb.QueueSize < 0 || wb.BatchSize < 0 {
+		return nil, fmt.Errorf("%w: queue and batch size must not be negative", errInvalidWriteBehind)
+	}
+	w := &assignmentWriter{
+		store:     sessionStore,
+		ttl:       opts.TTL,
+		batchSize: defaultWriteBehindBatchSize,
+		interval:  defaultWriteBehindFlushInterval,
+		overflow:  overflowSync,
+		unsaved:   unsaved,
+		logger:    logger,
+		closing:   make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	queueSize := defaultWriteBehindQueueSize
+	if wb.QueueSize > 0 {
+		queueSize = wb.QueueSize
+	}
+	if wb.BatchSize > 0 {
+		w.batchSize = wb.BatchSize
+	}
+	if wb.FlushInterval != "" {
+		interval, err := time.ParseDuration(wb.FlushInterval)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("%w: invalid flush interval %q", errInvalidWriteBehind, wb.FlushInterval)
+		}
+		w.interval = interval
+	}
+	switch overflow := strings.ToLower(wb.Overflow); overflow {
+	case "", overflowSync:
+	case overflowDrop:
+		w.overflow = overflow
+	default:
+		return nil, fmt.Errorf("%w: unknown overflow policy %q", errInvalidWriteBehind, wb.Overflow)
+	}
+	w.queue = make(chan store.Entry, queueSize)
+	w.overflows = registry.Counter("forklift_session_store_queue_overflow_total",
+		"Number of session assignments that didn't fit in the write-behind queue, by overflow policy.", "policy")
+	go w.run()
+	return w, nil
+}
+
+// enqueue queues an assignment to be written. It reports false when the queue is full and the
+// overflow policy has the assignment written by the caller.
+func (w *assignmentWriter) enqueue(key, backend string) bool {
+	w.unsaved.add(key, backend)
+	select {
+	case w.queue <- store.Entry{Key: key, Value: backend}:
+		return true
+	default:
+	}
+	w.overflows.Inc(w.overflow)
+	if w.overflow == overflowSync {
+		return false
+	}
+	w.unsaved.saved(key, backend)
+	return true
+}
+
+func (w *assignmentWriter) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]store.Entry, 0, w.batchSize)
+	for {
+		select {
+		case entry := <-w.queue:
+			batch = append(batch, entry)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-w.closing:
+			w.flush(batch)
+			close(w.done)
+			return
+		}
+		w.write(batch)
+		batch = make([]store.Entry, 0, w.batchSize)
+	}
+}
+
+// flush writes the pending batch and the assignments left in the queue.
+func (w *assignmentWriter) flush(batch []store.Entry) {
+	for {
+		select {
+		case entry := <-w.queue:
+			batch = append(batch, entry)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				w.write(batch)
+			}
+			return
+		}
+		w.write(batch)
+		batch = make([]store.Entry, 0, w.batchSize)
+	}
+}
+
+// write saves a batch in one round trip if the store supports it. Assignments that fail to be
+// written stay unsaved.
+func (w *assignmentWriter) write(batch []store.Entry) {
+	ctx := context.Background()
+	if setter, ok := w.store.(store.BatchSetter); ok {
+		if err := setter.SetMany(ctx, batch, w.ttl); err != nil {
+			w.logger.Errorf("Error storing %d session assignments: %v", len(batch), err)
+			return
+		}
+		for _, entry := range batch {
+			w.unsaved.saved(entry.Key, entry.Value)
+		}
+		return
+	}
+	for _, entry := range batch {
+		if err := w.store.Set(ctx, entry.Key, entry.Value, w.ttl); err != nil {
+			w.logger.Errorf("Error storing session assignment: %v", err)
+			continue
+		}
+		w.unsaved.saved(entry.Key, entry.Value)
+	}
+}
+
+// close stops the writer after writing the assignments queued so far, waiting until ctx is done.
+func (w *assignmentWriter) close(ctx context.Context) error {
+	w.closeOnce.Do(func() { close(w.closing) })
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: writing queued session assignments", ctx.Err())
+	}
+}